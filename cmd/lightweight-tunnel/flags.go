@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strconv"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+)
+
+// overrideFromFlags copies the settings given on the command line over cfg,
+// so that flags take precedence over LWT_ environment variables. build
+// returns the configuration the flags describe. It returns the flags applied.
+func overrideFromFlags(cfg *config.Config, build func() *config.Config) []string {
+	given := build()
+	dst := reflect.ValueOf(cfg).Elem()
+	src := reflect.ValueOf(given).Elem()
+
+	var applied []string
+	flag.Visit(func(f *flag.Flag) {
+		fields := flagFields(f, given, build)
+		for _, i := range fields {
+			dst.Field(i).Set(src.Field(i))
+		}
+		if len(fields) > 0 {
+			applied = append(applied, "-"+f.Name)
+		}
+	})
+	return applied
+}
+
+// flagFields returns the indexes of the Config fields flag f sets, found by
+// building the configuration again with another value of f. Flags that do not
+// feed the configuration (-c, -json, ...) set none.
+func flagFields(f *flag.Flag, given *config.Config, build func() *config.Config) []int {
+	value := f.Value.String()
+	if err := f.Value.Set(otherFlagValue(f)); err != nil {
+		return nil
+	}
+	changed := build()
+	_ = f.Value.Set(value)
+
+	var fields []int
+	a := reflect.ValueOf(given).Elem()
+	b := reflect.ValueOf(changed).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !a.Field(i).CanInterface() {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+// otherFlagValue returns a valid value of f that differs from its current one
+func otherFlagValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		on, _ := strconv.ParseBool(value)
+		return strconv.FormatBool(!on)
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return strconv.FormatInt(n+1, 10)
+	}
+	if x, err := strconv.ParseFloat(value, 64); err == nil {
+		return strconv.FormatFloat(x+1, 'g', -1, 64)
+	}
+	return value + "x"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// -ifstats prints a running tunnel's interface counters for the monitoring
+// that routers already have:
+//
+//	text      name and value per line
+//	snmp      the eight values alone, in IF-MIB order (ifInOctets,
+//	          ifInUcastPkts, ifInErrors, ifInDiscards, then the same for out),
+//	          for a net-snmp "extend lwt /usr/bin/lightweight-tunnel -ifstats
+//	          127.0.0.1:9100 -ifstats-format snmp" line: the values are then
+//	          NET-SNMP-EXTEND-MIB::nsExtendOutLine."lwt".1 to 8
+//	collectd  PUTVAL lines for the exec plugin, repeated every
+//	          COLLECTD_INTERVAL seconds until collectd stops the program. The
+//	          values use the interface plugin's types (if_octets, if_packets,
+//	          if_errors, if_dropped) under interface-lwt_<TUN device or tunnel
+//	          name>, so graphs made for it work unchanged.
+
+const defaultCollectdInterval = 10 * time.Second
+
+// runIfStats prints the counters of the tunnel behind client in format
+func runIfStats(client *adminClient, format string) error {
+	switch format {
+	case "text", "snmp":
+		s, err := client.fetchStatus()
+		if err != nil {
+			return err
+		}
+		if format == "text" {
+			printIfCounters(os.Stdout, s.Interface)
+		} else {
+			printIfCountersSNMP(os.Stdout, s.Interface)
+		}
+		return nil
+	case "collectd":
+		return runCollectd(client)
+	}
+	return fmt.Errorf("unknown -ifstats-format %q (use text, snmp or collectd)", format)
+}
+
+func printIfCounters(w io.Writer, c api.InterfaceCounters) {
+	fmt.Fprintf(w, "in_octets %d\nin_packets %d\nin_errors %d\nin_discards %d\n", c.InOctets, c.InPackets, c.InErrors, c.InDiscards)
+	fmt.Fprintf(w, "out_octets %d\nout_packets %d\nout_errors %d\nout_discards %d\n", c.OutOctets, c.OutPackets, c.OutErrors, c.OutDiscards)
+}
+
+func printIfCountersSNMP(w io.Writer, c api.InterfaceCounters) {
+	for _, v := range []uint64{c.InOctets, c.InPackets, c.InErrors, c.InDiscards, c.OutOctets, c.OutPackets, c.OutErrors, c.OutDiscards} {
+		fmt.Fprintln(w, v)
+	}
+}
+
+// runCollectd feeds collectd's exec plugin, which sets COLLECTD_HOSTNAME and
+// COLLECTD_INTERVAL; a failed query is logged to stderr, which collectd logs,
+// and retried at the next interval
+func runCollectd(client *adminClient) error {
+	host := os.Getenv("COLLECTD_HOSTNAME")
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	interval := defaultCollectdInterval
+	if secs, err := strconv.ParseFloat(os.Getenv("COLLECTD_INTERVAL"), 64); err == nil && secs > 0 {
+		interval = time.Duration(secs * float64(time.Second))
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		s, err := client.fetchStatus()
+		if err != nil {
+			log.Printf("Status query failed: %v", err)
+			continue
+		}
+		// Prefixed so as not to clash with the interface plugin's own
+		// values for the TUN device
+		instance := "lwt_" + s.TunName
+		if s.Name != "" {
+			instance = "lwt_" + s.Name
+		}
+		c := s.Interface
+		for _, v := range []struct {
+			typ     string
+			in, out uint64
+		}{
+			{"if_octets", c.InOctets, c.OutOctets},
+			{"if_packets", c.InPackets, c.OutPackets},
+			{"if_errors", c.InErrors, c.OutErrors},
+			{"if_dropped", c.InDiscards, c.OutDiscards},
+		} {
+			fmt.Printf("PUTVAL \"%s/interface-%s/%s\" interval=%g N:%d:%d\n", host, instance, v.typ, interval.Seconds(), v.in, v.out)
+		}
+	}
+}
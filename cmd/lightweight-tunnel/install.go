@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/tunnel"
+)
+
+// -install turns a configuration file into a service: the file is validated
+// as a start would, a systemd unit or an OpenWrt procd init script running
+// this binary with it is written, the state directory is created and the
+// service is enabled (not started). The service runs as root, which the TUN
+// device and raw sockets need anyway.
+
+const (
+	initSystemd = "systemd"
+	initProcd   = "procd"
+)
+
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var systemdTemplate = template.Must(template.New("unit").Parse(`# Written by lightweight-tunnel -install
+[Unit]
+Description=Lightweight Tunnel ({{.Name}})
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{.Binary}} -c {{.Config}}
+Restart=on-failure
+RestartSec=5s
+StateDirectory={{.Name}}
+StateDirectoryMode=0700
+WorkingDirectory={{.StateDir}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var procdTemplate = template.Must(template.New("init").Parse(`#!/bin/sh /etc/rc.common
+# Written by lightweight-tunnel -install
+
+START=95
+STOP=10
+USE_PROCD=1
+
+start_service() {
+	mkdir -p -m 0700 {{.StateDir}}
+	procd_open_instance
+	procd_set_param command {{.Binary}} -c {{.Config}}
+	procd_set_param file {{.Config}}
+	procd_set_param respawn 3600 5 0
+	procd_set_param stdout 1
+	procd_set_param stderr 1
+	procd_close_instance
+}
+`))
+
+type serviceSpec struct {
+	Name     string
+	Binary   string
+	Config   string
+	StateDir string
+}
+
+// detectInit picks the init system of this host
+func detectInit() (string, error) {
+	if fi, err := os.Stat("/run/systemd/system"); err == nil && fi.IsDir() {
+		return initSystemd, nil
+	}
+	if _, err := os.Stat("/sbin/procd"); err == nil {
+		return initProcd, nil
+	}
+	return "", fmt.Errorf("neither systemd nor procd found (choose one with -init)")
+}
+
+// checkServiceConfig validates the configuration file the service will run
+// with, the way a start would
+func checkServiceConfig(path string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Tunnels) > 0 {
+		for name, section := range cfg.Tunnels {
+			if _, err := section.ApplyProfile(); err != nil {
+				return nil, fmt.Errorf("tunnel %s: %v", name, err)
+			}
+			if err := validateConfig(section); err != nil {
+				return nil, fmt.Errorf("tunnel %s: %v", name, err)
+			}
+		}
+		if _, err := tunnel.NewGroup(cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+	if _, err := cfg.ApplyProfile(); err != nil {
+		return nil, err
+	}
+	if err := normalizeTunnelAddr(cfg, true); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// stateDirs returns the directories the configured state files go in
+func stateDirs(cfg *config.Config) []string {
+	var dirs []string
+	for _, file := range []string{cfg.StateCacheFile, cfg.MTUCacheFile, cfg.KnownServersFile, cfg.AuditLog, cfg.AccountingSpool} {
+		if filepath.IsAbs(file) {
+			dirs = append(dirs, filepath.Dir(file))
+		}
+	}
+	if filepath.IsAbs(cfg.TraceDir) {
+		dirs = append(dirs, cfg.TraceDir)
+	}
+	for _, section := range cfg.Tunnels {
+		dirs = append(dirs, stateDirs(section)...)
+	}
+	return dirs
+}
+
+// installService installs the configuration file at configPath as the
+// service name of the init system given ("" = this host's)
+func installService(configPath, name, initSystem string) (*api.ServiceInstall, error) {
+	if configPath == "" {
+		return nil, fmt.Errorf("-install needs the configuration file (-c)")
+	}
+	if !serviceNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid service name %q", name)
+	}
+	if initSystem == "" {
+		var err error
+		if initSystem, err = detectInit(); err != nil {
+			return nil, err
+		}
+	}
+
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := checkServiceConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return nil, err
+	}
+	// The paths end up unquoted in the unit or script
+	for _, path := range []string{binary, configPath} {
+		if strings.ContainsAny(path, " \t\n\"'\\$%;|&<>`") {
+			return nil, fmt.Errorf("path %q contains characters unsafe in a service definition", path)
+		}
+	}
+
+	spec := serviceSpec{Name: name, Binary: binary, Config: configPath, StateDir: "/var/lib/" + name}
+	result := &api.ServiceInstall{Service: name, Init: initSystem, ConfigPath: configPath, StateDir: spec.StateDir}
+	var tmpl *template.Template
+	var mode os.FileMode
+	var enable [][]string
+	switch initSystem {
+	case initSystemd:
+		tmpl, mode = systemdTemplate, 0644
+		result.Path = "/etc/systemd/system/" + name + ".service"
+		enable = [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", name}}
+	case initProcd:
+		// /var is a tmpfs on OpenWrt
+		spec.StateDir = "/etc/" + name
+		result.StateDir = spec.StateDir
+		tmpl, mode = procdTemplate, 0755
+		result.Path = "/etc/init.d/" + name
+		enable = [][]string{{result.Path, "enable"}}
+	default:
+		return nil, fmt.Errorf("unknown init system %q (systemd or procd)", initSystem)
+	}
+
+	for _, dir := range append([]string{spec.StateDir}, stateDirs(cfg)...) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+	if err := os.Chmod(spec.StateDir, 0700); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(configPath); err == nil && fi.Mode().Perm()&0077 != 0 && (cfg.Key != "" || len(cfg.Tunnels) > 0) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%s holds the tunnel key and is readable by other users (chmod 600)", configPath))
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, spec); err != nil {
+		return nil, err
+	}
+	tmp := result.Path + ".new"
+	if err := os.WriteFile(tmp, []byte(b.String()), mode); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, result.Path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write %s: %v", result.Path, err)
+	}
+
+	for _, args := range enable {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return result, nil
+}
+
+// printServiceInstall reports what -install did
+func printServiceInstall(result *api.ServiceInstall) {
+	fmt.Printf("Wrote %s (%s) running %s\n", result.Path, result.Init, result.ConfigPath)
+	fmt.Printf("State directory: %s\n", result.StateDir)
+	for _, w := range result.Warnings {
+		fmt.Printf("⚠️  %s\n", w)
+	}
+	if result.Init == initProcd {
+		fmt.Printf("Service enabled. Start it with: %s start\n", result.Path)
+	} else {
+		fmt.Printf("Service enabled. Start it with: systemctl start %s\n", result.Service)
+	}
+}
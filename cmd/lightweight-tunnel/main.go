@@ -1,15 +1,23 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/fec"
 	"github.com/openbmx/lightweight-tunnel/pkg/tunnel"
 )
 
@@ -20,68 +28,289 @@ var (
 func main() {
 	// Command line flags
 	configFile := flag.String("c", "", "Configuration file path")
-	mode := flag.String("m", "server", "Mode: server or client")
+	mode := flag.String("m", "server", "Mode: server, client, or peer (both ends listen and dial; the first connection decides the roles)")
 	// Transport mode is now fixed to rawtcp only
 	// transport flag removed - always use rawtcp mode for true TCP disguise
 	localAddr := flag.String("l", "0.0.0.0:9000", "Local address to listen on")
-	remoteAddr := flag.String("r", "", "Remote address to connect to (client mode)")
+	remoteAddr := flag.String("r", "", "Remote address to connect to (client and peer mode)")
 	tunnelAddr := flag.String("t", "10.0.0.1/24", "Tunnel IP address and netmask")
 	mtu := flag.Int("mtu", 1400, "MTU size")
 	fecData := flag.Int("fec-data", 10, "FEC data shards")
 	fecParity := flag.Int("fec-parity", 3, "FEC parity shards")
+	fecMaxData := flag.Int("fec-max-data", 32, "Largest FEC data shard count accepted from the peer")
+	fecMaxParity := flag.Int("fec-max-parity", 16, "Largest FEC parity shard count accepted from the peer")
+	fecReorderHold := flag.Int("fec-reorder-hold", 0, "Milliseconds a gap in FEC groups is held before they are declared lost (0=auto)")
+	fecReorderMax := flag.Int("fec-reorder-max", 200, "Upper bound in milliseconds for the automatic FEC reorder hold")
+	fecReorderWindow := flag.Int("fec-reorder-window", 256, "Max FEC groups outstanding behind a gap before it is skipped")
+	fecGroupTimeout := flag.Int("fec-group-timeout", 2000, "Milliseconds an incomplete FEC group waits for more shards")
+	fecCodec := flag.String("fec-codec", "reed-solomon", "FEC parity codec: reed-solomon, or xor (one parity shard, cheapest; both ends)")
+	fecDiagnostics := flag.Int("fec-diagnostics", 0, "Keep the last N unrecoverable FEC groups for diagnostics, dumped on SIGUSR1 (0=off)")
 	sendQueueSize := flag.Int("send-queue", 5000, "Send queue buffer size (increased default for better performance)")
 	recvQueueSize := flag.Int("recv-queue", 5000, "Receive queue buffer size (increased default for better performance)")
+	packetPoolSize := flag.Int("packet-pool", 0, "Most packet buffers kept for reuse (0 = unbounded)")
+	shutdownDrain := flag.Int("shutdown-drain", 2000, "Milliseconds shutdown waits for queued packets and FEC groups to be sent (negative = don't wait; a second Ctrl+C stops at once)")
+	profile := flag.String("profile", "", "Resource preset: small (16-32 MB routers; smaller queues, xor FEC, optional subsystems off)")
 	multiClient := flag.Bool("multi-client", true, "Enable multi-client support (server mode)")
 	maxClients := flag.Int("max-clients", 100, "Maximum number of concurrent clients (server mode)")
 	clientIsolation := flag.Bool("client-isolation", false, "Enable client isolation mode (clients cannot communicate with each other)")
+	hibernateAfter := flag.Int("hibernate-after", 0, "Server: seconds without data before an idle session's receive buffers are released until traffic resumes (0=never)")
 	tunName := flag.String("tun-name", "", "TUN device name (empty = auto)")
 	routeList := flag.String("routes", "", "Comma-separated list of CIDR routes to advertise to peers")
+	bypassList := flag.String("bypass", "", "Client: comma-separated destinations to send directly instead of through the tunnel (CIDR or proto:port[-port][@CIDR], e.g. 192.168.1.0/24,udp:3478)")
+	dnsServers := flag.String("dns", "", "Client: comma-separated nameservers reached through the tunnel, set as system DNS while it is up")
+	dnsDomains := flag.String("dns-domain", "", "Client: comma-separated search domains for -dns (systemd-resolved: ~domain routes only that domain through the tunnel)")
+	gossipListen := flag.String("gossip-listen", "", "Server: UDP address for the liveness exchange with other servers (e.g. :9001)")
+	gossipPeers := flag.String("gossip-peers", "", "Server: comma-separated gossip addresses of the other servers")
+	advertiseAddr := flag.String("advertise-addr", "", "Server: address clients reach this server at, told to gossip peers (default: source IP and listen port)")
+	serverFailover := flag.Bool("failover", false, "Client: learn which other servers are alive from the connected one and fail over to them")
 	configPushInterval := flag.Int("config-push-interval", 0, "Server: interval in seconds to push new config/key to clients (0=disabled)")
+	maxSessionDuration := flag.Int("max-session-duration", 0, "Server: seconds after which a session must renew its connection (0=unlimited)")
+	rekeyAfterMB := flag.Int("rekey-after-mb", 0, "Server: rotate the tunnel key after this many MB of traffic (0=disabled)")
 	p2pEnabled := flag.Bool("p2p", true, "Enable P2P direct connections")
 	p2pPort := flag.Int("p2p-port", 0, "UDP port for P2P connections (0 = auto)")
 	enableMeshRouting := flag.Bool("mesh-routing", true, "Enable mesh routing through other clients")
 	maxHops := flag.Int("max-hops", 3, "Maximum hops for mesh routing")
 	routeUpdateInterval := flag.Int("route-update", 30, "Route quality check interval in seconds")
 	enableNATDetection := flag.Bool("nat-detection", true, "Enable automatic NAT type detection")
+	natReflector := flag.String("nat-reflector", "", "Server: UDP address answering -nat-report probes on it and the next port (e.g. :3478)")
+	natReportAddr := flag.String("nat-report", "", "Report how this host's NAT maps and filters UDP, probing a server's -nat-reflector at this address, then exit")
+	natReportLifetime := flag.Int("nat-report-lifetime", 120, "Longest idle period in seconds -nat-report waits to measure the mapping lifetime (0 = skip)")
 	enableXDP := flag.Bool("xdp", true, "Enable eBPF/XDP-style fast path classification to reduce CPU cost")
 	enableKernelTune := flag.Bool("kernel-tune", true, "Enable kernel tuning (TFO/BBR2) on startup")
+	fixSysctl := flag.Bool("fix-sysctl", false, "Loosen rp_filter and enable accept_local/ip_forward where the tunnel needs it; original values are restored on exit")
 	encryptAfterAuth := flag.Bool("encrypt-after-auth", false, "Skip per-packet encryption after authentication (lower CPU, assumes trusted network)")
 	faketcpPacingUs := flag.Int("faketcp-pacing-us", 0, "Minimum delay between fake TCP segments in microseconds (0=auto/off)")
 	faketcpMaxSeg := flag.Int("faketcp-max-seg", 0, "Max payload bytes per fake TCP segment (0=auto)")
+	socketBuffer := flag.Int("socket-buffer", 0, "Fixed receive and send buffer of the tunnel's sockets in bytes (0 = scale with the measured bandwidth-delay product)")
+	socketBufferMax := flag.Int("socket-buffer-max", 0, "Largest socket buffer automatic scaling asks for in bytes (0 = the kernel's limit)")
+	tcpPersonality := flag.String("tcp-personality", "", "Imitate the TCP fingerprint (ISN, TTL, window, options, timestamps) of linux, windows or macos")
+	ecn := flag.Bool("ecn", false, "Mark fake TCP data segments ECN-capable (ECT) and pace sending when the peer reports congestion marks (raw mode)")
+	ttl := flag.Int("ttl", 0, "TTL of forged segments (0 = the TCP personality's)")
+	dscp := flag.String("dscp", "", "DSCP class of forged segments: a name such as ef, af41 or cs1, or 0-63")
+	ecnCodepoint := flag.String("ecn-codepoint", "", "ECN codepoint of forged data segments: ect0, ect1 or ce (default: ECT(0) with -ecn, else none)")
+	handshakeCookies := flag.Bool("syn-cookies", false, "Answer fake TCP SYNs statelessly with a cookie bound to the client address; connection state is kept only for clients that echo it (server)")
+	ipID := flag.String("ip-id", "counter", "IP Identification of forged segments: counter (per flow), random or kernel (Linux-like)")
+	ipOptions := flag.Int("ip-options", 0, "Pad the IP header of forged segments with this many bytes of NOP options (0-40, multiple of 4; raw mode)")
+	strictValidation := flag.Bool("strict", false, "Verify IP/TCP checksums, header lengths and flags of received segments and drop malformed ones (costs CPU)")
+	recvMTU := flag.Int("recv-mtu", 0, "Largest outer IP packet this host receives; caps the MTU discovered toward the peer, which is advertised to it (0=as discovered)")
+	priorityLane := flag.Bool("priority-lane", false, "Send DNS and TCP SYN packets immediately instead of waiting for an FEC group")
+	priorityDup := flag.Int("priority-dup", 1, "Times each priority-lane packet is sent")
+	quic := flag.Bool("quic", false, "Never hold inner QUIC packets (UDP 443) for aggregation and class them interactive under -rate-limit")
+	quicNoFEC := flag.Bool("quic-no-fec", false, "Like -quic, and send QUIC packets outside FEC groups since QUIC recovers its own losses")
+	duplicate := flag.Int("duplicate", 1, "Times every wire packet is sent; the receiver drops the copies (for gaming/VoIP: costs bandwidth, not latency)")
+	duplicateSpacingUs := flag.Int("duplicate-spacing-us", 0, "Gap between the copies of -duplicate in microseconds (0=back to back, e.g. 500 to survive short loss bursts)")
+	portHopRange := flag.String("port-hop-range", "", "Server ports to hop over, e.g. 40000-40999: both ends derive the port of each interval from a secret the server derives from the key and announces (needs -k; same range on both ends)")
+	portHopInterval := flag.Int("port-hop-interval", 300, "Seconds on each port with -port-hop-range")
+	reliability := flag.String("reliability", "fec", "Reliability of data packets: fec (parity groups) or kcp (retransmission and in-order delivery over KCP; both ends, disables FEC)")
+	kcpNoDelay := flag.Int("kcp-nodelay", 1, "KCP nodelay mode: 0 normal, 1 lower minimum RTO and slower backoff, 2 back off from the RTT estimate")
+	kcpInterval := flag.Int("kcp-interval", 20, "KCP flush interval in milliseconds (10-5000)")
+	kcpResend := flag.Int("kcp-resend", 2, "KCP fast retransmit after this many later packets were acknowledged (0 = off)")
+	kcpNC := flag.Bool("kcp-nc", true, "Disable KCP congestion control, leaving only the windows (-kcp-nc=false enables it)")
+	kcpSndWnd := flag.Int("kcp-sndwnd", 128, "KCP send window in packets")
+	kcpRcvWnd := flag.Int("kcp-rcvwnd", 512, "KCP receive window in packets")
+	wgListen := flag.String("wg-listen", "", "WireGuard passthrough (client): local UDP address to set as WireGuard's peer endpoint, e.g. 127.0.0.1:51821; no TUN device is created")
+	wgEndpoint := flag.String("wg-endpoint", "", "WireGuard passthrough (server): WireGuard's UDP address to pass the datagrams to, e.g. 127.0.0.1:51820")
+	rateLimit := flag.Int("rate-limit", 0, "Cap on the traffic sent in Mbps, shared by control, interactive and bulk packets (0=unlimited)")
+	rateLimitControl := flag.Float64("rate-limit-control", 0.05, "Share of -rate-limit assured to keepalives and reports")
+	rateLimitInteractive := flag.Float64("rate-limit-interactive", 0.25, "Share of -rate-limit assured to small and DSCP EF packets; they may also borrow bulk's share")
+	congestionResponse := flag.String("congestion-response", "", "On receive drops reported by the peer: comma-separated pace (slow down), fec (smaller FEC groups), shed (drop DSCP CS1/LE packets)")
+	aggregateUs := flag.Int("aggregate-us", 0, "Pack small packets queued within this many microseconds into one wire packet (0=off, e.g. 1000; both ends must enable it)")
+	stateCache := flag.String("state-cache", "", "Client: file remembering path MTU and NAT type per server, reused instead of probing again on restart")
+	mtuCache := flag.String("mtu-cache", "", "Deprecated: same as -state-cache")
+	keepaliveAlways := flag.Bool("keepalive-always", false, "Send keepalives even while data is flowing (by default they are skipped when data already shows the peer we are alive)")
+	mtuProbeInterval := flag.Int("mtu-probe-interval", 60, "Client: seconds between probes to restore an auto-detected MTU that was lowered (negative disables)")
 	showVersion := flag.Bool("v", false, "Show version")
+	checkUpdateFlag := flag.Bool("check-update", false, "Check the release endpoint for a newer version and verify its signature")
+	selfUpdate := flag.Bool("self-update", false, "Like -check-update, and replace this binary with a newer verified release")
+	updateURL := flag.String("update-url", defaultUpdateURL, "Release endpoint queried by -check-update")
+	updateKey := flag.String("update-key", "", "Base64 Ed25519 public key release binaries are signed with (default: built-in key)")
 	generateConfig := flag.String("g", "", "Generate example config file")
 	// TLS flags removed: TLS over the UDP fake-TCP transport is not supported.
 	key := flag.String("k", "", "Encryption key for tunnel traffic (required for secure communication)")
+	caCert := flag.String("ca-cert", "", "PEM CA bundle for certificate authentication (enables PKI mode)")
+	certFile := flag.String("cert", "", "PEM certificate presented during authentication (PKI mode; on a server without -ca-cert, the key clients pin)")
+	certKey := flag.String("cert-key", "", "PEM private key for -cert")
+	crlFile := flag.String("crl", "", "Optional CRL file checked during authentication (PKI mode)")
+	serverFingerprint := flag.String("server-fingerprint", "", "Client: hex SHA-256 of the server's public key; the server must prove it holds the key (server needs -cert and -cert-key)")
+	knownServers := flag.String("known-servers", "", "Client: file recording the server's key on first connect; later connections are refused if it changes")
+	acceptNewServerKey := flag.Bool("accept-new-server-key", false, "Client: accept a server key that differs from the one in -known-servers and record it")
+	auditLog := flag.String("audit-log", "", "Server: append session audit records (JSON lines) to this file")
+	auditLogMaxSize := flag.Int("audit-log-max-size", 100, "Server: rotate the audit log after this many MB")
+	auditLogMaxBackups := flag.Int("audit-log-max-backups", 5, "Server: number of rotated audit logs to keep")
+	clientQuotaMB := flag.Int("client-quota-mb", 0, "Server: disconnect a client once it moved this many MB within -client-quota-period, across reconnects (0=unlimited)")
+	clientQuotaPeriod := flag.Int("client-quota-period", 86400, "Server: seconds after which a client's quota usage starts over")
+	unauthBanThreshold := flag.Int("unauth-ban-threshold", 0, "Server: firewall off a source address whose packets are dropped before authentication this many times in a minute (0 = never)")
+	unauthBanDuration := flag.Int("unauth-ban-duration", 600, "Server: seconds a ban from -unauth-ban-threshold lasts")
+	managementBypass := flag.String("management-bypass", "", "Server: comma-separated management traffic accepted ahead of the tunnel's firewall rules, as proto:port[-port][@CIDR] or CIDR (default tcp:22 and the admin port; \"none\" = no bypass)")
+	firewallConfirmTimeout := flag.Int("firewall-confirm-timeout", 0, "Server: remove the tunnel's firewall rules this many seconds after start unless confirmed with POST /firewall/confirm on the admin API (0 = keep them)")
+	unauthBanClasses := flag.String("unauth-ban-classes", "", "Server: comma-separated drop classes counted toward a ban: bad_mac, unknown_session, malformed, not_our_flow, auth_rejected (default all but not_our_flow)")
+	accountingSink := flag.String("accounting-sink", "", "Server: deliver per-session usage reports for billing to file:///path, http(s)://url or statsd://host:port")
+	accountingInterval := flag.Int("accounting-interval", 60, "Server: seconds between usage reports")
+	accountingSpool := flag.String("accounting-spool", "", "Server: file keeping usage reports until the sink accepts them (required with -accounting-sink)")
+	mirrorTarget := flag.String("mirror-target", "", "Server: copy the decrypted traffic of -mirror-sessions to this target for IDS inspection: vxlan://host[:port][?vni=N] or packet://<interface>")
+	mirrorSessions := flag.String("mirror-sessions", "", "Server: comma-separated tunnel IPs, CIDRs or certificate identities of the sessions to mirror")
+	mirrorRate := flag.Int("mirror-rate", 100, "Server: drop mirrored traffic beyond this many Mbit/s")
+	lbWorkers := flag.Int("lb-workers", 0, "Server: number of server processes sharing the listen port (0/1 = disabled)")
+	lbWorkerID := flag.Int("lb-worker-id", 0, "Server: this process' worker index in [0, lb-workers)")
+	netNS := flag.String("netns", "", "Create raw sockets and firewall rules in this network namespace (a path like /proc/1/ns/net, or a name under /var/run/netns); the TUN device stays in ours")
+	afxdpIfaces := flag.String("afxdp", "", "Server: comma-separated interfaces to receive on via AF_XDP (falls back to raw socket)")
+	packetRing := flag.String("packet-ring", "", "Server: receive through an AF_PACKET mmap ring on this interface (\"any\" = all) instead of recvfrom")
+	adminListen := flag.String("admin", "", "Serve the admin API (status, peers, config, impairment injection) on this address, e.g. 127.0.0.1:9100")
+	adminToken := flag.String("admin-token", "", "Require this bearer token on admin API requests (also sent by -top)")
+	adminTLSCert := flag.String("admin-tls-cert", "", "Serve the admin API over HTTPS with this PEM certificate (-top trusts it for https:// addresses)")
+	adminTLSKey := flag.String("admin-tls-key", "", "PEM private key for -admin-tls-cert")
+	healthListen := flag.String("health-listen", "", "Serve liveness (/healthz), readiness (/readyz) and load balancer (/health) probes on this address, e.g. :8080")
+	healthHandshakeAge := flag.Int("health-handshake-age", 0, "Fail /health when no handshake completed within this many seconds (0 = only report the last one)")
+	traceSeconds := flag.Int("trace-seconds", 0, "Keep each connection's last N seconds of TCP segments in memory for pcapng dumps on failure and via the admin API (0=disabled)")
+	tracePayload := flag.Bool("trace-payload", false, "Keep segment payloads in connection traces, not just the IP and TCP headers")
+	traceDir := flag.String("trace-dir", "", "Directory for connection trace dumps of failed sessions (default: system temp dir)")
+	logLevel := flag.String("log-level", "info", "Log level: info, or trace to also log every tunnel frame decoded (rate limited)")
+	firstFrames := flag.Int("first-frames", 0, "Log the first N frames sent and received on each connection, decoded, and keep them for support bundles (0=disabled)")
+	upgradeSocket := flag.String("upgrade-socket", "", "Server: Unix socket on which a new binary started with -takeover receives the running sessions")
+	brokerSocket := flag.String("broker-socket", "", "Unix socket on which local programs open TCP streams through the tunnel (pkg/broker)")
+	takeover := flag.Bool("takeover", false, "Server: take over the TUN device, socket and sessions of the instance on the upgrade socket")
+	ifStatsAddr := flag.String("ifstats", "", "Print the interface counters (octets, packets, errors, discards) of the tunnel whose admin API listens on this address, for SNMP or collectd, then exit")
+	ifStatsFormat := flag.String("ifstats-format", "text", "Output of -ifstats: text, snmp (values for a net-snmp extend line) or collectd (exec plugin PUTVAL lines, repeated)")
+	supportBundleAddr := flag.String("support-bundle", "", "Collect the configuration, status, recent logs and first frames of the tunnel whose admin API listens on this address, with this host's sysctl values and iptables rules, into a .tar.gz for bug reports, then exit")
+	supportBundleOut := flag.String("support-bundle-out", "", "Archive written by -support-bundle (default: lightweight-tunnel-support-<time>.tar.gz)")
+	topAddr := flag.String("top", "", "Show a live status dashboard for the tunnel whose admin API listens on this address (host:port or https://host:port), then exit")
+	installFlag := flag.Bool("install", false, "Validate the configuration file (-c), write a service running this binary with it, create its state directory and enable it")
+	serviceName := flag.String("service-name", "lightweight-tunnel", "Service name written by -install")
+	initSystem := flag.String("init", "", "Init system for -install: systemd or procd (OpenWrt) (empty = detect)")
+	jsonOutput := flag.Bool("json", false, "Print the result of -v, -check-update, -self-update, -g, -install, -nat-report, -support-bundle and -top as JSON (-top prints one status snapshot)")
 
 	flag.Parse()
+	log.SetOutput(io.MultiWriter(os.Stderr, tunnel.RecentLog))
+	tunnel.Version = version
 
 	// Show version
 	if *showVersion {
+		if *jsonOutput {
+			printJSON(api.VersionInfo{Version: version, GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH})
+			return
+		}
 		fmt.Printf("lightweight-tunnel version %s\n", version)
 		return
 	}
 
-	// Generate config file
-	if *generateConfig != "" {
-		if err := generateConfigFile(*generateConfig); err != nil {
-			log.Fatalf("Failed to generate config: %v", err)
+	// Check for a newer release
+	if *checkUpdateFlag || *selfUpdate {
+		result, err := checkUpdate(*updateURL, *updateKey, *selfUpdate)
+		if err != nil {
+			fatalCommand(*jsonOutput, "Update check failed", err)
+		}
+		if *jsonOutput {
+			printJSON(result)
+		} else {
+			printUpdateCheck(result)
 		}
-		fmt.Printf("Generated config file: %s\n", *generateConfig)
 		return
 	}
 
-	// Load configuration
-	var cfg *config.Config
-	var err error
+	// Status dashboard for a running tunnel
+	if *topAddr != "" {
+		client, err := newAdminClient(*topAddr, *adminToken, *adminTLSCert)
+		if err != nil {
+			fatalCommand(*jsonOutput, "Status query failed", err)
+		}
+		if *jsonOutput {
+			status, err := client.fetchStatus()
+			if err != nil {
+				fatalCommand(true, "Status query failed", err)
+			}
+			printJSON(status)
+			return
+		}
+		if err := runTop(client); err != nil {
+			log.Fatalf("Status dashboard failed: %v", err)
+		}
+		return
+	}
 
-	if *configFile != "" {
-		cfg, err = config.LoadConfig(*configFile)
+	// Interface counters for SNMP and collectd
+	if *ifStatsAddr != "" {
+		client, err := newAdminClient(*ifStatsAddr, *adminToken, *adminTLSCert)
 		if err != nil {
-			log.Fatalf("Failed to load config: %v", err)
+			fatalCommand(*jsonOutput, "Status query failed", err)
 		}
-	} else {
-		// Use command line arguments
-		cfg = &config.Config{
+		if *jsonOutput {
+			status, err := client.fetchStatus()
+			if err != nil {
+				fatalCommand(true, "Status query failed", err)
+			}
+			printJSON(status.Interface)
+			return
+		}
+		if err := runIfStats(client, *ifStatsFormat); err != nil {
+			log.Fatalf("Interface counters failed: %v", err)
+		}
+		return
+	}
+
+	// Support bundle for bug reports
+	if *supportBundleAddr != "" {
+		client, err := newAdminClient(*supportBundleAddr, *adminToken, *adminTLSCert)
+		if err != nil {
+			fatalCommand(*jsonOutput, "Support bundle failed", err)
+		}
+		result, err := runSupportBundle(client, *supportBundleOut)
+		if err != nil {
+			fatalCommand(*jsonOutput, "Support bundle failed", err)
+		}
+		if *jsonOutput {
+			printJSON(result)
+		} else {
+			printSupportResult(result)
+		}
+		return
+	}
+
+	// Install as a service
+	if *installFlag {
+		result, err := installService(*configFile, *serviceName, *initSystem)
+		if err != nil {
+			fatalCommand(*jsonOutput, "Install failed", err)
+		}
+		if *jsonOutput {
+			printJSON(result)
+		} else {
+			printServiceInstall(result)
+		}
+		return
+	}
+
+	// NAT behavior report
+	if *natReportAddr != "" {
+		report, err := natReport(*natReportAddr, time.Duration(*natReportLifetime)*time.Second)
+		if err != nil {
+			fatalCommand(*jsonOutput, "NAT report failed", err)
+		}
+		if *jsonOutput {
+			printJSON(report)
+		} else {
+			printNATReport(report)
+		}
+		return
+	}
+
+	// Generate config file
+	if *generateConfig != "" {
+		clientFile, err := generateConfigFile(*generateConfig)
+		if err != nil {
+			fatalCommand(*jsonOutput, "Failed to generate config", err)
+		}
+		if *jsonOutput {
+			printJSON(api.GeneratedConfig{ServerPath: *generateConfig, ClientPath: clientFile})
+			return
+		}
+		printGeneratedConfig(*generateConfig, clientFile)
+		fmt.Printf("Generated config file: %s\n", *generateConfig)
+		return
+	}
+
+	// Configuration built from command line arguments
+	flagConfig := func() *config.Config {
+		return &config.Config{
 			Mode:               *mode,
 			Transport:          "rawtcp", // Fixed to rawtcp mode only
 			LocalAddr:          *localAddr,
@@ -90,35 +319,179 @@ func main() {
 			MTU:                *mtu,
 			FECDataShards:      *fecData,
 			FECParityShards:    *fecParity,
+			FECMaxDataShards:   *fecMaxData,
+			FECMaxParityShards: *fecMaxParity,
+			FECCodec:           *fecCodec,
+			FECDiagnostics:     *fecDiagnostics,
+			FECReorderHoldMs:   *fecReorderHold,
+			FECReorderMaxMs:    *fecReorderMax,
+			FECReorderWindow:   *fecReorderWindow,
+			FECGroupTimeoutMs:  *fecGroupTimeout,
 			Timeout:            30,
 			KeepaliveInterval:  10,
+			KeepaliveAlways:    *keepaliveAlways,
 			SendQueueSize:      *sendQueueSize,
 			RecvQueueSize:      *recvQueueSize,
+			PacketPoolSize:     *packetPoolSize,
+			ShutdownDrainMs:    *shutdownDrain,
+			Profile:            *profile,
 			Key:                *key,
 			TunName:            *tunName,
-			Routes:             parseRoutes(*routeList),
+			Routes:             parseList(*routeList),
+			Bypass:             parseList(*bypassList),
+			DNSServers:         parseList(*dnsServers),
+			DNSDomains:         parseList(*dnsDomains),
 			ConfigPushInterval: *configPushInterval,
+			MaxSessionDuration: *maxSessionDuration,
+			RekeyAfterMB:       *rekeyAfterMB,
+			GossipListen:       *gossipListen,
+			GossipPeers:        parseList(*gossipPeers),
+			AdvertiseAddr:      *advertiseAddr,
+			ServerFailover:     *serverFailover,
 			// TLS configuration is available via config file only; CLI flags were removed
 			MultiClient:         *multiClient,
 			MaxClients:          *maxClients,
 			ClientIsolation:     *clientIsolation,
+			HibernateAfter:      *hibernateAfter,
 			P2PEnabled:          *p2pEnabled,
 			P2PPort:             *p2pPort,
 			EnableMeshRouting:   *enableMeshRouting,
 			MaxHops:             *maxHops,
 			RouteUpdateInterval: *routeUpdateInterval,
 			EnableNATDetection:  *enableNATDetection,
+			NATReflector:        *natReflector,
 			P2PTimeout:          5,
 			EnableXDP:           *enableXDP,
 			EnableKernelTune:    *enableKernelTune,
+			FixSysctl:           *fixSysctl,
 			EncryptAfterAuth:    *encryptAfterAuth,
 			FakeTCPWritePacingUs: *faketcpPacingUs,
 			FakeTCPMaxSegment:    *faketcpMaxSeg,
+			RecvMTU:              *recvMTU,
+			SocketBuffer:         *socketBuffer,
+			SocketBufferMax:      *socketBufferMax,
+			TCPPersonality:       *tcpPersonality,
+			IPOptions:            *ipOptions,
+			IPID:                 *ipID,
+			StrictValidation:     *strictValidation,
+			ECN:                  *ecn,
+			TTL:                  *ttl,
+			DSCP:                 *dscp,
+			ECNCodepoint:         *ecnCodepoint,
+			HandshakeCookies:     *handshakeCookies,
+			MTUProbeInterval:     *mtuProbeInterval,
+			StateCacheFile:       *stateCache,
+			MTUCacheFile:         *mtuCache,
+			AggregateDelayUs:     *aggregateUs,
+			PriorityLane:         *priorityLane,
+			PriorityDuplicate:    *priorityDup,
+			QUIC:                 *quic,
+			QUICNoFEC:            *quicNoFEC,
+			Duplicate:            *duplicate,
+			DuplicateSpacingUs:   *duplicateSpacingUs,
+			CongestionResponse:   parseList(*congestionResponse),
+			RateLimitMbps:        *rateLimit,
+			RateLimitControl:     *rateLimitControl,
+			RateLimitInteractive: *rateLimitInteractive,
+			PortHopRange:         *portHopRange,
+			PortHopInterval:      *portHopInterval,
+			Reliability:          *reliability,
+			KCPNoDelay:           *kcpNoDelay,
+			KCPInterval:          *kcpInterval,
+			KCPResend:            *kcpResend,
+			KCPNoCongestion:      *kcpNC,
+			KCPSendWindow:        *kcpSndWnd,
+			KCPRecvWindow:        *kcpRcvWnd,
+			WireGuardListen:      *wgListen,
+			WireGuardEndpoint:    *wgEndpoint,
+			CACertFile:           *caCert,
+			CertFile:             *certFile,
+			CertKeyFile:          *certKey,
+			CRLFile:              *crlFile,
+			ServerFingerprint:    *serverFingerprint,
+			KnownServersFile:     *knownServers,
+			AcceptNewServerKey:   *acceptNewServerKey,
+			AuditLog:             *auditLog,
+			AuditLogMaxSizeMB:    *auditLogMaxSize,
+			AuditLogMaxBackups:   *auditLogMaxBackups,
+			ClientQuotaMB:        *clientQuotaMB,
+			ClientQuotaPeriod:    *clientQuotaPeriod,
+			UnauthBanThreshold:   *unauthBanThreshold,
+			UnauthBanDuration:    *unauthBanDuration,
+			UnauthBanClasses:     parseList(*unauthBanClasses),
+			ManagementBypass:     parseList(*managementBypass),
+			FirewallConfirmTimeout: *firewallConfirmTimeout,
+			AccountingSink:       *accountingSink,
+			AccountingInterval:   *accountingInterval,
+			AccountingSpool:      *accountingSpool,
+			MirrorTarget:         *mirrorTarget,
+			MirrorSessions:       parseList(*mirrorSessions),
+			MirrorRateMbps:       *mirrorRate,
+			LBWorkers:            *lbWorkers,
+			LBWorkerID:           *lbWorkerID,
+			AFXDPInterfaces:      parseList(*afxdpIfaces),
+			PacketRing:           *packetRing,
+			NetNS:                *netNS,
+			AdminListen:          *adminListen,
+			AdminToken:           *adminToken,
+			AdminTLSCert:         *adminTLSCert,
+			AdminTLSKey:          *adminTLSKey,
+			HealthListen:         *healthListen,
+			HealthHandshakeAge:   *healthHandshakeAge,
+			TraceSeconds:         *traceSeconds,
+			TracePayload:         *tracePayload,
+			TraceDir:             *traceDir,
+			LogLevel:             *logLevel,
+			FirstFrames:          *firstFrames,
+			UpgradeSocket:        *upgradeSocket,
+			BrokerSocket:         *brokerSocket,
 		}
 	}
 
+	// Load configuration
+	var cfg *config.Config
+	var err error
+	var fromEnv bool
+
+	if *configFile != "" {
+		cfg, err = config.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	} else if cfg, fromEnv, err = config.LoadEnv(); err != nil {
+		log.Fatalf("Failed to load config from environment: %v", err)
+	} else if fromEnv {
+		// Containers (e.g. a Kubernetes sidecar) configure us through LWT_
+		// variables; flags given as well take precedence over them
+		log.Printf("Configuration loaded from %s environment variables", config.EnvPrefix)
+		if applied := overrideFromFlags(cfg, flagConfig); len(applied) > 0 {
+			log.Printf("Command line flags override the environment: %s", strings.Join(applied, " "))
+		}
+	} else {
+		cfg = flagConfig()
+	}
+	cfg.Takeover = *takeover
+
+	if len(cfg.Tunnels) > 0 {
+		if cfg.Takeover {
+			log.Fatalf("-takeover is not supported with named tunnels")
+		}
+		runTunnelGroup(cfg)
+		return
+	}
+
+	// Presets override the settings they cover
+	if changes, err := cfg.ApplyProfile(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	} else if len(changes) > 0 {
+		log.Printf("Profile %s: %s", cfg.Profile, strings.Join(changes, ", "))
+	}
+	if cfg.Profile == config.ProfileSmall && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(config.SmallMemoryLimit)
+	}
+
 	// Normalize client tunnel address when running without explicit config file
-	if err := normalizeTunnelAddr(cfg, *configFile != ""); err != nil {
+	if err := normalizeTunnelAddr(cfg, *configFile != "" || fromEnv); err != nil {
 		log.Fatalf("Failed to normalize tunnel address: %v", err)
 	}
 
@@ -133,12 +506,17 @@ func main() {
 	log.Printf("Mode: %s", cfg.Mode)
 	log.Printf("Transport: rawtcp (true TCP disguise)")
 	log.Printf("Local Address: %s", cfg.LocalAddr)
-	if cfg.Mode == "client" {
+	if cfg.Mode != "server" {
 		log.Printf("Remote Address: %s", cfg.RemoteAddr)
 	}
 	log.Printf("Tunnel Address: %s", cfg.TunnelAddr)
 	log.Printf("MTU: %d", cfg.MTU)
-	log.Printf("FEC: %d data + %d parity shards", cfg.FECDataShards, cfg.FECParityShards)
+	if cfg.Reliability == tunnel.ReliabilityKCP {
+		log.Printf("Reliability: KCP (nodelay %d, interval %dms, resend %d, windows %d/%d)",
+			cfg.KCPNoDelay, cfg.KCPInterval, cfg.KCPResend, cfg.KCPSendWindow, cfg.KCPRecvWindow)
+	} else {
+		log.Printf("FEC: %d data + %d parity shards", cfg.FECDataShards, cfg.FECParityShards)
+	}
 	log.Printf("Send Queue Size: %d", cfg.SendQueueSize)
 	log.Printf("Receive Queue Size: %d", cfg.RecvQueueSize)
 	if cfg.Mode == "server" {
@@ -152,6 +530,14 @@ func main() {
 		log.Println("⚠️  Anyone can connect to this tunnel without authentication")
 		log.Println("⚠️  Use -k <key> to enable encryption and prevent unauthorized access")
 	}
+	if cfg.CACertFile != "" {
+		log.Printf("🔐  Certificate Authentication: Enabled (CA: %s)", cfg.CACertFile)
+	}
+
+	if tunnel.WireGuardPassthrough(cfg) {
+		runWireGuardRelay(cfg)
+		return
+	}
 
 	// Create tunnel
 	tun, err := tunnel.NewTunnel(cfg, *configFile)
@@ -168,22 +554,141 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
+	// SIGUSR1 dumps FEC diagnostics without stopping the tunnel
+	diagCh := make(chan os.Signal, 1)
+	signal.Notify(diagCh, syscall.SIGUSR1)
+
 	log.Println("Tunnel running. Press Ctrl+C to stop.")
+wait:
+	for {
+		select {
+		case <-sigCh:
+			break wait
+		case <-tun.Done():
+			break wait
+		case <-tun.HandedOff():
+			// The new process owns the device, socket and sessions now
+			log.Println("Upgrade complete, exiting")
+			return
+		case <-diagCh:
+			dumpFECDiagnostics(tun)
+		}
+	}
+
+	// Stop tunnel, letting queued packets go out unless interrupted again
+	log.Println("Shutting down...")
+	closed := make(chan error, 1)
+	go func() { closed <- tun.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			log.Printf("Shutdown drain incomplete: %v", err)
+		}
+	case <-sigCh:
+		log.Println("Interrupted again, stopping without waiting")
+		tun.ForceClose()
+		<-closed
+	}
+	log.Println("Shutdown complete")
+
+	// The server ended the session and asked us not to reconnect
+	if err := tun.Err(); err != nil {
+		log.Fatalf("Tunnel stopped: %v", err)
+	}
+}
+
+// runWireGuardRelay carries a WireGuard flow until interrupted
+func runWireGuardRelay(cfg *config.Config) {
+	relay, err := tunnel.NewWireGuardRelay(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create WireGuard relay: %v", err)
+	}
+	if err := relay.Start(); err != nil {
+		log.Fatalf("Failed to start WireGuard relay: %v", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	log.Println("WireGuard relay running. Press Ctrl+C to stop.")
 	<-sigCh
 
-	// Stop tunnel
 	log.Println("Shutting down...")
-	tun.Stop()
+	relay.Stop()
+	log.Println("Shutdown complete")
+}
+
+// runTunnelGroup runs the named tunnels of cfg until interrupted
+func runTunnelGroup(cfg *config.Config) {
+	for name, section := range cfg.Tunnels {
+		if changes, err := section.ApplyProfile(); err != nil {
+			log.Fatalf("Invalid configuration of tunnel %s: %v", name, err)
+		} else if len(changes) > 0 {
+			log.Printf("Tunnel %s: profile %s: %s", name, section.Profile, strings.Join(changes, ", "))
+		}
+		if err := validateConfig(section); err != nil {
+			log.Fatalf("Invalid configuration of tunnel %s: %v", name, err)
+		}
+	}
+	group, err := tunnel.NewGroup(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	log.Println("=== Lightweight Tunnel ===")
+	log.Printf("Version: %s", version)
+	log.Printf("Tunnels: %s", strings.Join(group.Names(), ", "))
+	if err := group.Start(); err != nil {
+		log.Fatalf("Failed to start tunnels: %v", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	diagCh := make(chan os.Signal, 1)
+	signal.Notify(diagCh, syscall.SIGUSR1)
+
+	log.Println("Tunnels running. Press Ctrl+C to stop.")
+wait:
+	for {
+		select {
+		case <-sigCh:
+			break wait
+		case <-diagCh:
+			for _, name := range group.Names() {
+				if tun := group.Tunnel(name); tun != nil {
+					log.Printf("Tunnel %s:", name)
+					dumpFECDiagnostics(tun)
+				}
+			}
+		}
+	}
+
+	log.Println("Shutting down...")
+	group.Stop()
 	log.Println("Shutdown complete")
 }
 
+// dumpFECDiagnostics logs the recorded unrecoverable FEC groups
+func dumpFECDiagnostics(tun *tunnel.Tunnel) {
+	groups := tun.FECDiagnostics()
+	if groups == nil {
+		log.Println("FEC diagnostics are disabled (use -fec-diagnostics N)")
+		return
+	}
+	log.Printf("FEC diagnostics: %d unrecoverable groups recorded", len(groups))
+	for _, g := range groups {
+		log.Printf("  %s peer=%s session=%d reason=%s shards=%d+%d size=%d present=%v span=%s reorder_next=%d reorder_passed=%v",
+			g.Time.Format(time.RFC3339Nano), g.Peer, g.SessionID, g.Reason, g.DataShards, g.ParityShards, g.ShardSize,
+			g.Present, g.LastShard.Sub(g.FirstShard), g.ReorderNext, g.ReorderPassed)
+	}
+}
+
 func validateConfig(cfg *config.Config) error {
-	if cfg.Mode != "server" && cfg.Mode != "client" {
-		return fmt.Errorf("mode must be 'server' or 'client'")
+	if cfg.Mode != "server" && cfg.Mode != "client" && cfg.Mode != "peer" {
+		return fmt.Errorf("mode must be 'server', 'client' or 'peer'")
 	}
 
-	if cfg.Mode == "client" && cfg.RemoteAddr == "" {
-		return fmt.Errorf("remote address required in client mode")
+	if (cfg.Mode == "client" || cfg.Mode == "peer") && cfg.RemoteAddr == "" {
+		return fmt.Errorf("remote address required in %s mode", cfg.Mode)
 	}
 
 	if cfg.TunnelAddr == "" {
@@ -194,14 +699,248 @@ func validateConfig(cfg *config.Config) error {
 		return fmt.Errorf("MTU must be between 500 and 9000")
 	}
 
+	if cfg.RecvMTU != 0 && (cfg.RecvMTU < 576 || cfg.RecvMTU > 9000) {
+		return fmt.Errorf("recv MTU must be between 576 and 9000")
+	}
+
 	if cfg.FECDataShards < 1 || cfg.FECParityShards < 1 {
 		return fmt.Errorf("FEC shards must be positive")
 	}
 
+	if cfg.FECDataShards > cfg.FECMaxDataShards || cfg.FECParityShards > cfg.FECMaxParityShards {
+		return fmt.Errorf("FEC shards (%d+%d) exceed the accepted maximum (%d+%d)",
+			cfg.FECDataShards, cfg.FECParityShards, cfg.FECMaxDataShards, cfg.FECMaxParityShards)
+	}
+
+	if codec, err := fec.ParseCodec(cfg.FECCodec); err != nil {
+		return err
+	} else if codec == fec.XOR && cfg.FECParityShards != 1 {
+		return fmt.Errorf("the xor FEC codec needs exactly one parity shard (fec-parity 1)")
+	}
+
+	if cfg.PacketPoolSize < 0 {
+		return fmt.Errorf("packet-pool must not be negative")
+	}
+
+	if cfg.FECReorderHoldMs < 0 || cfg.FECReorderMaxMs < 0 || cfg.FECReorderWindow < 0 || cfg.FECGroupTimeoutMs < 0 {
+		return fmt.Errorf("FEC reorder settings must not be negative")
+	}
+
+	if cfg.FECWorkers < 0 || cfg.TUNWriters < 0 {
+		return fmt.Errorf("fec_workers and tun_writers must not be negative")
+	}
+
+	if cfg.PriorityDuplicate < 0 || cfg.PriorityDuplicate > 8 {
+		return fmt.Errorf("priority-dup must be between 1 and 8")
+	}
+
+	if cfg.IPOptions < 0 || cfg.IPOptions > 40 || cfg.IPOptions%4 != 0 {
+		return fmt.Errorf("ip-options must be a multiple of 4 between 0 and 40")
+	}
+
+	if cfg.SocketBuffer < 0 || cfg.SocketBufferMax < 0 {
+		return fmt.Errorf("socket-buffer and socket-buffer-max must not be negative")
+	}
+
+	if cfg.TTL < 0 || cfg.TTL > 255 {
+		return fmt.Errorf("ttl must be between 0 and 255")
+	}
+
+	if cfg.HealthHandshakeAge < 0 {
+		return fmt.Errorf("health-handshake-age must not be negative")
+	}
+
+	if cfg.Duplicate < 0 || cfg.Duplicate > 8 {
+		return fmt.Errorf("duplicate must be between 1 and 8")
+	}
+	if cfg.DuplicateSpacingUs < 0 || cfg.DuplicateSpacingUs > 100000 {
+		return fmt.Errorf("duplicate-spacing-us must be between 0 and 100000")
+	}
+	for _, name := range cfg.CongestionResponse {
+		if !tunnel.ValidCongestionResponse(name) {
+			return fmt.Errorf("unknown congestion-response %q (want pace, fec or shed)", name)
+		}
+	}
+
+	for _, name := range cfg.UnauthBanClasses {
+		if !tunnel.ValidUnauthClass(name) {
+			return fmt.Errorf("unknown unauth-ban-classes entry %q (want bad_mac, unknown_session, malformed, not_our_flow or auth_rejected)", name)
+		}
+	}
+	if cfg.UnauthBanThreshold < 0 {
+		return fmt.Errorf("unauth-ban-threshold must not be negative")
+	}
+	if cfg.FirewallConfirmTimeout < 0 {
+		return fmt.Errorf("firewall-confirm-timeout must not be negative")
+	}
+	if cfg.FirewallConfirmTimeout > 0 && cfg.AdminListen == "" {
+		return fmt.Errorf("firewall-confirm-timeout requires -admin, through which the rules are confirmed")
+	}
+
+	if cfg.PortHopRange != "" {
+		if _, _, err := tunnel.ParsePortRange(cfg.PortHopRange); err != nil {
+			return fmt.Errorf("port-hop-range: %v", err)
+		}
+		if cfg.Mode != "client" && cfg.Mode != "server" {
+			return fmt.Errorf("port hopping is only supported in client and server mode")
+		}
+		if cfg.Key == "" {
+			return fmt.Errorf("port hopping derives its schedule from the key (-k)")
+		}
+		if cfg.PortHopInterval != 0 && cfg.PortHopInterval < 10 {
+			return fmt.Errorf("port-hop-interval must be at least 10 seconds")
+		}
+	}
+
+	if tunnel.WireGuardPassthrough(cfg) {
+		if cfg.Mode == "client" && cfg.WireGuardListen == "" {
+			return fmt.Errorf("WireGuard passthrough clients need wg-listen")
+		}
+		if cfg.Mode == "server" && cfg.WireGuardEndpoint == "" {
+			return fmt.Errorf("WireGuard passthrough servers need wg-endpoint")
+		}
+		if cfg.Mode == "peer" {
+			return fmt.Errorf("WireGuard passthrough is only supported in client and server mode")
+		}
+	}
+
+	switch cfg.Reliability {
+	case "", tunnel.ReliabilityFEC:
+	case tunnel.ReliabilityKCP:
+		if cfg.Mode != "client" && cfg.Mode != "server" {
+			return fmt.Errorf("KCP reliability is only supported in client and server mode")
+		}
+		if cfg.KCPNoDelay < 0 || cfg.KCPNoDelay > 2 {
+			return fmt.Errorf("kcp-nodelay must be 0, 1 or 2")
+		}
+		if cfg.KCPInterval != 0 && (cfg.KCPInterval < 10 || cfg.KCPInterval > 5000) {
+			return fmt.Errorf("kcp-interval must be between 10 and 5000 milliseconds")
+		}
+		if cfg.KCPResend < 0 || cfg.KCPSendWindow < 0 || cfg.KCPRecvWindow < 0 {
+			return fmt.Errorf("KCP resend and window settings must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown reliability %q (want fec or kcp)", cfg.Reliability)
+	}
+
+	if cfg.LBWorkers > 1 {
+		if cfg.Mode != "server" {
+			return fmt.Errorf("lb-workers is only supported in server mode")
+		}
+		if cfg.LBWorkerID < 0 || cfg.LBWorkerID >= cfg.LBWorkers {
+			return fmt.Errorf("lb-worker-id must be between 0 and %d", cfg.LBWorkers-1)
+		}
+	}
+
+	if cfg.UpgradeSocket != "" && cfg.Mode != "server" {
+		return fmt.Errorf("upgrade-socket is only supported in server mode")
+	}
+	if cfg.Takeover && cfg.UpgradeSocket == "" {
+		return fmt.Errorf("takeover requires upgrade-socket")
+	}
+
+	if (cfg.AdminTLSCert == "") != (cfg.AdminTLSKey == "") {
+		return fmt.Errorf("admin TLS requires both admin-tls-cert and admin-tls-key")
+	}
+	if cfg.AdminListen == "" && (cfg.AdminToken != "" || cfg.AdminTLSCert != "") {
+		return fmt.Errorf("admin-token and admin-tls-cert require admin_listen (-admin)")
+	}
+	if cfg.TraceSeconds < 0 {
+		return fmt.Errorf("trace-seconds must not be negative")
+	}
+	switch cfg.LogLevel {
+	case "", tunnel.LogLevelInfo, tunnel.LogLevelTrace:
+	default:
+		return fmt.Errorf("log-level must be %s or %s", tunnel.LogLevelInfo, tunnel.LogLevelTrace)
+	}
+	if cfg.FirstFrames < 0 {
+		return fmt.Errorf("first-frames must not be negative")
+	}
+
+	if cfg.RateLimitMbps < 0 {
+		return fmt.Errorf("rate-limit must not be negative")
+	}
+	if cfg.RateLimitControl < 0 || cfg.RateLimitInteractive < 0 || cfg.RateLimitControl+cfg.RateLimitInteractive > 1 {
+		return fmt.Errorf("rate-limit-control and rate-limit-interactive must not be negative and must add up to at most 1")
+	}
+
+	if cfg.MaxSessionDuration < 0 || cfg.RekeyAfterMB < 0 {
+		return fmt.Errorf("max-session-duration and rekey-after-mb must not be negative")
+	}
+	if (cfg.MaxSessionDuration > 0 || cfg.RekeyAfterMB > 0) && cfg.Mode != "server" {
+		return fmt.Errorf("max-session-duration and rekey-after-mb are only supported in server mode")
+	}
+	if cfg.RekeyAfterMB > 0 && cfg.Key == "" {
+		return fmt.Errorf("rekey-after-mb requires a key (-k)")
+	}
+
+	if cfg.AccountingSink != "" {
+		if cfg.Mode != "server" {
+			return fmt.Errorf("accounting-sink is only supported in server mode")
+		}
+		if cfg.AccountingSpool == "" {
+			return fmt.Errorf("accounting-sink requires accounting-spool, the file keeping reports until they are delivered")
+		}
+	}
+	if cfg.AccountingInterval < 0 {
+		return fmt.Errorf("accounting-interval must not be negative")
+	}
+
+	if cfg.MirrorTarget != "" || len(cfg.MirrorSessions) > 0 {
+		if cfg.Mode != "server" {
+			return fmt.Errorf("mirror-target is only supported in server mode")
+		}
+		if cfg.MirrorTarget == "" || len(cfg.MirrorSessions) == 0 {
+			return fmt.Errorf("traffic mirroring requires both mirror-target and mirror-sessions")
+		}
+	}
+
+	if (cfg.GossipListen != "" || len(cfg.GossipPeers) > 0) && cfg.Mode != "server" {
+		return fmt.Errorf("gossip-listen and gossip-peers are only supported in server mode")
+	}
+	if len(cfg.GossipPeers) > 0 && cfg.GossipListen == "" {
+		return fmt.Errorf("gossip-peers requires gossip-listen")
+	}
+	if cfg.NATReflector != "" && cfg.Mode != "server" {
+		return fmt.Errorf("nat-reflector is only supported in server mode")
+	}
+	if cfg.ServerFailover && cfg.Mode != "client" {
+		return fmt.Errorf("failover is only supported in client mode")
+	}
+
+	if cfg.ServerFingerprint != "" || cfg.KnownServersFile != "" {
+		if cfg.Mode != "client" {
+			return fmt.Errorf("server-fingerprint and known-servers are only supported in client mode")
+		}
+		if cfg.Key == "" {
+			return fmt.Errorf("server key pinning requires an encryption key (-k)")
+		}
+	}
+	if fp := strings.ReplaceAll(cfg.ServerFingerprint, ":", ""); fp != "" {
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("server-fingerprint must be a hex SHA-256 (64 hex digits)")
+		}
+	}
+
+	if cfg.CACertFile != "" {
+		if cfg.Key == "" {
+			return fmt.Errorf("certificate authentication requires an encryption key (-k)")
+		}
+		if cfg.CertFile == "" || cfg.CertKeyFile == "" {
+			return fmt.Errorf("certificate authentication requires both cert and cert-key")
+		}
+	}
+
+	if cfg.ClientQuotaMB < 0 || cfg.ClientQuotaPeriod < 0 {
+		return fmt.Errorf("client-quota-mb and client-quota-period must not be negative")
+	}
+
 	return nil
 }
 
-func generateConfigFile(filename string) error {
+// generateConfigFile writes example server and client configs and returns the
+// client config's path
+func generateConfigFile(filename string) (string, error) {
 	// Generate minimalist server config with only essential parameters
 	serverCfg := &config.Config{
 		Mode:               "server",
@@ -215,7 +954,7 @@ func generateConfigFile(filename string) error {
 	}
 
 	if err := config.SaveConfig(filename, serverCfg); err != nil {
-		return err
+		return "", err
 	}
 
 	// Generate minimalist client config example with only essential parameters
@@ -232,9 +971,13 @@ func generateConfigFile(filename string) error {
 	}
 
 	if err := config.SaveConfig(clientFilename, clientCfg); err != nil {
-		return err
+		return "", err
 	}
+	return clientFilename, nil
+}
 
+// printGeneratedConfig explains the files written by generateConfigFile
+func printGeneratedConfig(filename, clientFilename string) {
 	fmt.Printf("✅ 已生成服务端配置: %s\n", filename)
 	fmt.Printf("✅ 已生成客户端配置: %s\n", clientFilename)
 	fmt.Printf("\n📝 配置说明:\n")
@@ -245,7 +988,6 @@ func generateConfigFile(filename string) error {
 	fmt.Printf("   - key: 加密密钥（必须设置且双方一致）\n")
 	fmt.Printf("   - mtu: 最大传输单元 (0=自动检测)\n")
 	fmt.Printf("\n⚠️  重要: 请修改配置文件中的密钥为强密码！\n")
-	return nil
 }
 
 // normalizeTunnelAddr ensures the client does not reuse the default server tunnel IP
@@ -271,18 +1013,18 @@ func normalizeTunnelAddr(cfg *config.Config, configFromFile bool) error {
 	return nil
 }
 
-// parseRoutes splits comma-separated routes and trims spaces
-func parseRoutes(raw string) []string {
+// parseList splits a comma-separated flag value (routes, interfaces) and trims spaces
+func parseList(raw string) []string {
 	if raw == "" {
 		return []string{}
 	}
 	parts := strings.Split(raw, ",")
-	routes := make([]string, 0, len(parts))
+	items := make([]string, 0, len(parts))
 	for _, p := range parts {
 		p = strings.TrimSpace(p)
 		if p != "" {
-			routes = append(routes, p)
+			items = append(items, p)
 		}
 	}
-	return routes
+	return items
 }
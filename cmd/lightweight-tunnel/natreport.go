@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/nat"
+)
+
+// -nat-report probes a server's nat_reflector to tell whether P2P hole
+// punching can work from this host and how long idle UDP mappings last. The
+// mapping lifetime test leaves mappings idle for up to -nat-report-lifetime
+// seconds, so the report takes about that long.
+
+const natReportTimeout = 2 * time.Second
+
+// natReport probes the NAT of this host with the reflector at addr
+func natReport(addr string, maxIdle time.Duration) (*api.NATReport, error) {
+	b, err := nat.DiscoverBehavior(addr, natReportTimeout, maxIdle)
+	if err != nil {
+		return nil, err
+	}
+	report := &api.NATReport{
+		Reflector:     addr,
+		LocalAddr:     b.LocalAddr.String(),
+		MappedAddr:    b.MappedAddr.String(),
+		Type:          b.Type().String(),
+		Mapping:       b.Mapping,
+		Filtering:     b.Filtering,
+		PortPreserved: b.PortPreserved,
+		Hairpinning:   b.Hairpinning,
+		LifetimeMin:   b.LifetimeAlive.Seconds(),
+		LifetimeMax:   b.LifetimeGone.Seconds(),
+	}
+	switch b.Type() {
+	case nat.NATNone:
+		report.HolePunching = "not needed: peers reach this host directly"
+	case nat.NATRestrictedCone, nat.NATPortRestrictedCone:
+		report.HolePunching = "works with peers behind cone NATs, rarely with symmetric NATs"
+	case nat.NATSymmetric:
+		report.HolePunching = "works only with peers without NAT or behind restricted cone NATs; traffic to other peers is relayed by the server"
+	default:
+		report.HolePunching = "unknown"
+	}
+	return report, nil
+}
+
+// printNATReport prints a NAT report for people
+func printNATReport(r *api.NATReport) {
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	fmt.Printf("Reflector:      %s\n", r.Reflector)
+	fmt.Printf("Local address:  %s\n", r.LocalAddr)
+	fmt.Printf("Public address: %s (port preserved: %v)\n", r.MappedAddr, r.PortPreserved)
+	fmt.Printf("NAT type:       %s\n", r.Type)
+	fmt.Printf("Mapping:        %s\n", orUnknown(r.Mapping))
+	fmt.Printf("Filtering:      %s\n", orUnknown(r.Filtering))
+	if r.Hairpinning != nil {
+		fmt.Printf("Hairpinning:    %v\n", *r.Hairpinning)
+	}
+	switch {
+	case r.LifetimeMax > 0:
+		fmt.Printf("Mapping lifetime: %.0f-%.0f s idle (keepalives must be more frequent)\n", r.LifetimeMin, r.LifetimeMax)
+	case r.LifetimeMin > 0:
+		fmt.Printf("Mapping lifetime: at least %.0f s idle\n", r.LifetimeMin)
+	}
+	fmt.Printf("Hole punching:  %s\n", r.HolePunching)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// printJSON writes v to stdout as indented JSON (-json)
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("Failed to write JSON output: %v", err)
+	}
+}
+
+// fatalCommand reports a failed command and exits. With -json the error goes
+// to stdout as an api.Error so scripts only have to parse one stream.
+func fatalCommand(jsonOutput bool, what string, err error) {
+	if jsonOutput {
+		printJSON(api.Error{Error: what + ": " + err.Error()})
+		os.Exit(1)
+	}
+	log.Fatalf("%s: %v", what, err)
+}
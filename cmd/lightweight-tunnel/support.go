@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// -support-bundle packs what a bug report needs into one .tar.gz: from the
+// running tunnel's admin API its configuration (key and admin token
+// redacted by the API), status including the state of its firewall rules,
+// recent log lines and the first frames of its connections (first_frames);
+// from the host it runs on the kernel settings the tunnel depends on and the
+// iptables rules. It is meant to run on the tunnel's host. A part that
+// cannot be collected is listed in errors.txt and the bundle written anyway.
+
+// supportSysctls are the kernel settings included in support bundles
+var supportSysctls = []string{
+	"net/core/rmem_max", "net/core/wmem_max", "net/core/rmem_default", "net/core/wmem_default",
+	"net/core/netdev_max_backlog",
+	"net/ipv4/ip_forward", "net/ipv4/conf/all/rp_filter", "net/ipv4/conf/default/rp_filter",
+	"net/ipv4/conf/all/accept_local", "net/ipv4/ip_local_port_range",
+	"net/ipv4/tcp_rmem", "net/ipv4/tcp_wmem", "net/ipv4/tcp_congestion_control",
+	"net/ipv6/conf/all/forwarding", "net/netfilter/nf_conntrack_max", "net/netfilter/nf_conntrack_count",
+}
+
+// supportResult is the -json output of -support-bundle
+type supportResult struct {
+	Path   string   `json:"path"`
+	Files  []string `json:"files"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// fetch returns the body of a GET on the admin API
+func (c *adminClient) fetch(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API returned %s for %s", resp.Status, path)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// runSupportBundle writes the bundle of the tunnel behind client to path
+// ("" = lightweight-tunnel-support-<time>.tar.gz in the working directory)
+func runSupportBundle(client *adminClient, path string) (*supportResult, error) {
+	now := time.Now()
+	if path == "" {
+		path = "lightweight-tunnel-support-" + now.Format("20060102-150405") + ".tar.gz"
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	result := &supportResult{Path: path}
+	add := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		result.Files = append(result.Files, name)
+		return nil
+	}
+	failed := func(part string, err error) {
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", part, err))
+	}
+
+	about := fmt.Sprintf("lightweight-tunnel %s\n%s %s/%s\ncollected %s\n",
+		version, runtime.Version(), runtime.GOOS, runtime.GOARCH, now.Format(time.RFC3339))
+	if err := add("version.txt", []byte(about)); err != nil {
+		return nil, err
+	}
+	for _, part := range []struct{ name, path string }{
+		{"config.json", "/config"},
+		{"status.json", "/status"},
+		{"frames.json", "/frames"},
+		{"logs.txt", "/logs"},
+	} {
+		data, err := client.fetch(part.path)
+		if err != nil {
+			failed(part.name, err)
+			continue
+		}
+		if err := add(part.name, data); err != nil {
+			return nil, err
+		}
+	}
+
+	var sysctl strings.Builder
+	for _, name := range supportSysctls {
+		value, err := os.ReadFile("/proc/sys/" + name)
+		if err != nil {
+			continue // Not on this kernel
+		}
+		fmt.Fprintf(&sysctl, "%s = %s\n", strings.ReplaceAll(name, "/", "."), strings.TrimSpace(string(value)))
+	}
+	if err := add("sysctl.txt", []byte(sysctl.String())); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range []string{"iptables-save", "ip6tables-save"} {
+		out, err := exec.Command(cmd).Output()
+		if err != nil {
+			failed(cmd, err)
+			continue
+		}
+		if err := add(cmd+".txt", out); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(result.Errors) > 0 {
+		if err := add("errors.txt", []byte(strings.Join(result.Errors, "\n")+"\n")); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return result, f.Close()
+}
+
+func printSupportResult(r *supportResult) {
+	fmt.Printf("Support bundle written to %s (%s)\n", r.Path, strings.Join(r.Files, ", "))
+	for _, e := range r.Errors {
+		fmt.Printf("  not collected: %s\n", e)
+	}
+}
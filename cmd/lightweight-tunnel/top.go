@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// -top polls a running tunnel's admin API and redraws a read-only dashboard
+// once per interval: throughput sparklines, FEC recovery, sessions and the
+// health of the firewall rules the tunnel installed. Rates are derived from
+// the difference between two consecutive snapshots.
+
+const (
+	topInterval = time.Second
+	topHistory  = 60 // Samples kept for the sparklines
+)
+
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+// adminClient queries a tunnel's admin API
+type adminClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// newAdminClient accepts host:port (plain HTTP) or an http:// or https://
+// URL. For HTTPS the system roots are trusted, plus caFile if given, which
+// lets -top reuse the self-signed -admin-tls-cert of a local tunnel.
+func newAdminClient(addr, token, caFile string) (*adminClient, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	c := &adminClient{
+		baseURL: strings.TrimSuffix(addr, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 3 * time.Second},
+	}
+	if strings.HasPrefix(addr, "https://") && caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		c.http.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+	return c, nil
+}
+
+func (c *adminClient) fetchStatus() (*api.Status, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	var s api.Status
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid status response: %v", err)
+	}
+	return &s, nil
+}
+
+// runTop shows the dashboard for the admin API behind client until interrupted
+func runTop(client *adminClient) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	var (
+		prev          *api.Status
+		prevAt        time.Time
+		inRate        []float64
+		outRate       []float64
+		sessionsPrev  = map[string]api.SessionStatus{}
+		failures      int
+		lastErr       error
+		everConnected bool
+	)
+	for {
+		s, err := client.fetchStatus()
+		now := time.Now()
+		if err != nil {
+			failures++
+			lastErr = err
+			if !everConnected && failures >= 3 {
+				return err
+			}
+		} else {
+			everConnected = true
+			failures = 0
+			if prev != nil {
+				secs := now.Sub(prevAt).Seconds()
+				inRate = appendSample(inRate, rate(s.BytesIn, prev.BytesIn, secs))
+				outRate = appendSample(outRate, rate(s.BytesOut, prev.BytesOut, secs))
+			}
+		}
+
+		var b strings.Builder
+		b.WriteString("\x1b[H\x1b[2J")
+		if s == nil {
+			fmt.Fprintf(&b, "lightweight-tunnel top - %s\n\nadmin API unreachable: %v\n", client.baseURL, lastErr)
+		} else {
+			renderTop(&b, client.baseURL, s, prev, now.Sub(prevAt).Seconds(), inRate, outRate, sessionsPrev)
+			sessionsPrev = make(map[string]api.SessionStatus, len(s.Sessions))
+			for _, session := range s.Sessions {
+				sessionsPrev[session.RemoteAddr] = session
+			}
+			prev, prevAt = s, now
+		}
+		b.WriteString("\nCtrl+C to quit\n")
+		os.Stdout.WriteString(b.String())
+
+		select {
+		case <-sigCh:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func renderTop(b *strings.Builder, addr string, s, prev *api.Status, secs float64,
+	inRate, outRate []float64, sessionsPrev map[string]api.SessionStatus) {
+	fmt.Fprintf(b, "lightweight-tunnel %s - %s mode on %s (%s) - up %s\n",
+		s.Version, s.Mode, s.TunName, addr, (time.Duration(s.Uptime) * time.Second).String())
+	if s.Server != "" {
+		fmt.Fprintf(b, "server %s  rtt %s\n", s.Server, formatRTT(s.RTTMs))
+	}
+
+	b.WriteString("\nThroughput\n")
+	fmt.Fprintf(b, "  in  %10s/s %s  total %s\n", formatBytes(last(inRate)), sparkline(inRate), formatBytes(float64(s.BytesIn)))
+	fmt.Fprintf(b, "  out %10s/s %s  total %s\n", formatBytes(last(outRate)), sparkline(outRate), formatBytes(float64(s.BytesOut)))
+
+	b.WriteString("\nFEC\n")
+	var recovered, unrecoverable float64
+	if prev != nil {
+		recovered = rate(s.FEC.GroupsRecovered, prev.FEC.GroupsRecovered, secs)
+		unrecoverable = rate(s.FEC.GroupsUnrecoverable, prev.FEC.GroupsUnrecoverable, secs)
+	}
+	fmt.Fprintf(b, "  groups recovered %d (%.1f/s)  unrecoverable %d (%.1f/s)  packets recovered %d\n",
+		s.FEC.GroupsRecovered, recovered, s.FEC.GroupsUnrecoverable, unrecoverable, s.FEC.PacketsRecovered)
+	fmt.Fprintf(b, "  late drops %d  gap skips %d  corrupt shards %d  queue drops %d\n",
+		s.FEC.LateDrops, s.FEC.GapSkips, s.FEC.CorruptShards, s.Drops)
+
+	if s.Mode == "server" {
+		fmt.Fprintf(b, "\nSessions (%d)\n", len(s.Sessions))
+		if len(s.Sessions) > 0 {
+			fmt.Fprintf(b, "  %-15s %-21s %-16s %10s %10s %9s %5s %s\n",
+				"TUNNEL IP", "REMOTE", "IDENTITY", "IN/s", "OUT/s", "RTT", "MTU", "CONNECTED")
+		}
+		for _, session := range s.Sessions {
+			var in, out float64
+			if p, ok := sessionsPrev[session.RemoteAddr]; ok {
+				in = rate(session.BytesIn, p.BytesIn, secs)
+				out = rate(session.BytesOut, p.BytesOut, secs)
+			}
+			fmt.Fprintf(b, "  %-15s %-21s %-16s %10s %10s %9s %5d %s\n",
+				orDash(session.TunnelIP), session.RemoteAddr, orDash(session.Identity),
+				formatBytes(in), formatBytes(out), formatRTT(session.RTTMs), session.SendMTU,
+				time.Since(session.ConnectedAt).Truncate(time.Second))
+		}
+	}
+
+	fmt.Fprintf(b, "\nFirewall rules (%d)\n", len(s.Firewall))
+	for _, rule := range s.Firewall {
+		mark := "✓"
+		if !rule.Present {
+			mark = "✗ missing"
+		}
+		fmt.Fprintf(b, "  %s iptables %s\n", mark, rule.Rule)
+	}
+}
+
+// rate is the per-second increase of a counter; a counter that went down
+// (restart, departed session) counts as no traffic
+func rate(cur, prev uint64, secs float64) float64 {
+	if cur < prev || secs <= 0 {
+		return 0
+	}
+	return float64(cur-prev) / secs
+}
+
+func appendSample(samples []float64, v float64) []float64 {
+	samples = append(samples, v)
+	if len(samples) > topHistory {
+		samples = samples[len(samples)-topHistory:]
+	}
+	return samples
+}
+
+func last(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	return samples[len(samples)-1]
+}
+
+// sparkline scales samples to the window's peak
+func sparkline(samples []float64) string {
+	var peak float64
+	for _, v := range samples {
+		peak = max(peak, v)
+	}
+	var b strings.Builder
+	for i := len(samples); i < topHistory; i++ {
+		b.WriteRune(' ')
+	}
+	for _, v := range samples {
+		level := 0
+		if peak > 0 {
+			level = int(v / peak * float64(len(sparkLevels)-1))
+		}
+		b.WriteRune(sparkLevels[level])
+	}
+	return b.String()
+}
+
+func formatBytes(v float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", v, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+func formatRTT(ms float64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f ms", ms)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
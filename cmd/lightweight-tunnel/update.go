@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/sigverify"
+	"github.com/openbmx/lightweight-tunnel/pkg/tunnel"
+)
+
+// Releases are looked up from a GitHub-style release endpoint. Each release
+// carries a binary per platform named lightweight-tunnel-<os>-<arch> and an
+// Ed25519 signature of it named <binary>.sig (raw 64 bytes or base64), checked
+// with pkg/sigverify. Without a public key the check only reports whether a
+// newer version exists, and -self-update refuses to install anything.
+
+const (
+	defaultUpdateURL = "https://api.github.com/repos/openbmx/lightweight-tunnel/releases/latest"
+	maxUpdateSize    = 64 << 20
+)
+
+// updatePublicKey is the base64 Ed25519 key release binaries are signed with,
+// set at build time with -ldflags "-X main.updatePublicKey=..."; when empty
+// the keys embedded in pkg/sigverify are used
+var updatePublicKey = ""
+
+type releaseInfo struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+var updateClient = &http.Client{Timeout: 60 * time.Second}
+
+// checkUpdate looks up the latest release and, when install is set, downloads
+// it, verifies its signature and replaces the running binary
+func checkUpdate(endpoint, publicKey string, install bool) (*api.UpdateCheck, error) {
+	release, err := fetchRelease(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	latest := strings.TrimPrefix(release.TagName, "v")
+	result := &api.UpdateCheck{CurrentVersion: version, LatestVersion: latest}
+	if tunnel.CompareVersions(latest, version) <= 0 {
+		return result, nil
+	}
+	result.UpdateAvailable = true
+
+	if publicKey == "" {
+		publicKey = updatePublicKey
+	}
+	verifier, err := sigverify.Load(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid update key: %v", err)
+	}
+	if verifier.Keys() == 0 {
+		if install {
+			return nil, fmt.Errorf("refusing to install unverified release %s: no update signing key (-update-key)", latest)
+		}
+		return result, nil
+	}
+
+	name := fmt.Sprintf("lightweight-tunnel-%s-%s", runtime.GOOS, runtime.GOARCH)
+	var binURL, sigURL string
+	for _, asset := range release.Assets {
+		switch asset.Name {
+		case name:
+			binURL = asset.URL
+		case name + sigverify.SignatureSuffix:
+			sigURL = asset.URL
+		}
+	}
+	if binURL == "" || sigURL == "" {
+		return nil, fmt.Errorf("release %s has no signed binary %s", latest, name)
+	}
+
+	binary, err := download(binURL)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := download(sigURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.Verify(binary, sig); err != nil {
+		return nil, fmt.Errorf("%v for %s %s", err, name, latest)
+	}
+	result.Asset = name
+	result.Verified = true
+
+	if install {
+		if result.InstalledPath, err = replaceExecutable(binary); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// printUpdateCheck describes the outcome of checkUpdate for a terminal
+func printUpdateCheck(result *api.UpdateCheck) {
+	if !result.UpdateAvailable {
+		fmt.Printf("lightweight-tunnel %s is up to date (latest release %s)\n", result.CurrentVersion, result.LatestVersion)
+		return
+	}
+	fmt.Printf("Update available: %s -> %s\n", result.CurrentVersion, result.LatestVersion)
+	if !result.Verified {
+		fmt.Println("No update signing key configured (-update-key); the release cannot be verified")
+		return
+	}
+	fmt.Printf("Verified signature of %s %s\n", result.Asset, result.LatestVersion)
+	if result.InstalledPath == "" {
+		fmt.Println("Run with -self-update to install it")
+		return
+	}
+	fmt.Printf("Installed new version to %s; restart the service to use it\n", result.InstalledPath)
+}
+
+func fetchRelease(endpoint string) (*releaseInfo, error) {
+	data, err := download(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var release releaseInfo
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("invalid release information from %s: %v", endpoint, err)
+	}
+	if release.TagName == "" {
+		return nil, fmt.Errorf("no release found at %s", endpoint)
+	}
+	return &release, nil
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", url, err)
+	}
+	if len(data) > maxUpdateSize {
+		return nil, fmt.Errorf("%s exceeds %d bytes", url, maxUpdateSize)
+	}
+	return data, nil
+}
+
+// replaceExecutable atomically swaps the running binary for the new one and
+// returns its path
+func replaceExecutable(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	tmp := exe + ".new"
+	if err := os.WriteFile(tmp, binary, 0755); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to replace %s: %v", exe, err)
+	}
+	return exe, nil
+}
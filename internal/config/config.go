@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 )
 
 // Config holds the tunnel configuration
 type Config struct {
-	Mode               string   `json:"mode"`                 // "client" or "server"
+	Mode               string   `json:"mode"`                 // "client", "server" or "peer"
 	Transport          string   `json:"transport"`            // "rawtcp" only (true TCP disguise, requires root)
 	LocalAddr          string   `json:"local_addr"`           // Local address to listen on
 	RemoteAddr         string   `json:"remote_addr"`          // Remote address to connect to (client mode)
@@ -17,17 +18,52 @@ type Config struct {
 	MTU                int      `json:"mtu"`                  // MTU size (0 = auto-detect)
 	FECDataShards      int      `json:"fec_data"`             // Number of FEC data shards
 	FECParityShards    int      `json:"fec_parity"`           // Number of FEC parity shards
+	FECMaxDataShards   int      `json:"fec_max_data"`         // Largest data shard count accepted from the peer (default 32)
+	FECMaxParityShards int      `json:"fec_max_parity"`       // Largest parity shard count accepted from the peer (default 16)
+	FECCodec           string   `json:"fec_codec"`            // Parity codec: reed-solomon (default) or xor (one parity shard); both ends must match
+	FECDiagnostics     int      `json:"fec_diagnostics"`      // Number of unrecoverable FEC groups kept for diagnostics (0=off)
+	FECReorderHoldMs   int      `json:"fec_reorder_hold_ms"`  // How long a gap in FEC groups is waited on before they are declared lost (0=auto, adapts to jitter)
+	FECReorderMaxMs    int      `json:"fec_reorder_max_ms"`   // Upper bound for the automatic reorder hold time (default 200)
+	FECReorderWindow   int      `json:"fec_reorder_window"`   // Max FEC groups outstanding behind a gap before it is skipped (default 256)
+	FECGroupTimeoutMs  int      `json:"fec_group_timeout_ms"` // How long an incomplete FEC group waits for more shards (default 2000)
 	Timeout            int      `json:"timeout"`              // Connection timeout in seconds
 	KeepaliveInterval  int      `json:"keepalive"`            // Keepalive interval in seconds
+	KeepaliveAlways    bool     `json:"keepalive_always"`     // Send keepalives even while data traffic already shows the peer we are alive
+	IdleAfter          int      `json:"idle_after"`           // Client: seconds without data before the tunnel reports idle to SetIdleHandler (default 30)
 	SendQueueSize      int      `json:"send_queue_size"`      // Size of send queue buffer (default 1000)
 	RecvQueueSize      int      `json:"recv_queue_size"`      // Size of receive queue buffer (default 1000)
+	PacketPoolSize     int      `json:"packet_pool_size"`     // Most packet buffers kept for reuse (0 = unbounded, the runtime frees idle ones)
+	ShutdownDrainMs    int      `json:"shutdown_drain_ms"`    // How long shutdown waits for queued packets, FEC groups and unacknowledged KCP data to go out (0=default 2000, negative=don't wait)
+	Profile            string   `json:"profile"`              // Resource preset applied over the other settings: "small" for 16-32 MB routers (see profile.go)
 	Key                string   `json:"key"`                  // Encryption key for tunnel traffic (required for secure communication)
 	TunName            string   `json:"tun_name"`             // Optional TUN device name (empty = auto)
 	Routes             []string `json:"routes"`               // Additional routes to advertise to peers
+	Bypass             []string `json:"bypass,omitempty"`     // Client: destinations sent directly instead of through the tunnel (CIDR or proto:port[-port][@CIDR])
 	ConfigPushInterval int      `json:"config_push_interval"` // Interval (seconds) for server to push new config/key (0=disabled)
+	MaxSessionDuration int      `json:"max_session_duration"` // Server: seconds after which a session must renew its connection (0=unlimited)
+	RekeyAfterMB       int      `json:"rekey_after_mb"`       // Server: rotate the key after this much traffic in MB (0=disabled)
 	MultiClient        bool     `json:"multi_client"`         // Enable multi-client support (server mode, default true)
 	MaxClients         int      `json:"max_clients"`          // Maximum number of concurrent clients (default 100)
 	ClientIsolation    bool     `json:"client_isolation"`     // Enable client isolation (clients cannot communicate with each other)
+	HibernateAfter     int      `json:"hibernate_after"`      // Server: seconds without data before a session's receive buffers are released (0 = never)
+
+	// System DNS (client mode): nameservers reached through the tunnel are set as the
+	// resolver while it is up, via systemd-resolved or a replaced /etc/resolv.conf.
+	DNSServers []string `json:"dns_servers,omitempty"` // Nameserver IPs (empty = leave DNS alone)
+	DNSDomains []string `json:"dns_domains,omitempty"` // Search domains; with systemd-resolved "~corp.example" routes only that domain
+
+	// Per-client settings the server pushes when a session starts (server mode), keyed by
+	// certificate identity. The "*" entry applies to every client; a client's own entry
+	// overrides it field by field.
+	ClientPush map[string]ClientPush `json:"client_push,omitempty"`
+
+	// Multi-server deployments (e.g. DNS round-robin): servers exchange liveness over UDP
+	// and tell their clients which of the others are alive, so a client whose server stops
+	// answering can fail over to one of them.
+	GossipListen   string   `json:"gossip_listen,omitempty"`   // Server: UDP address for the liveness exchange
+	GossipPeers    []string `json:"gossip_peers,omitempty"`    // Server: gossip_listen addresses of the other servers
+	AdvertiseAddr  string   `json:"advertise_addr,omitempty"`  // Server: address clients reach this server at (default: gossip source IP, local_addr port)
+	ServerFailover bool     `json:"server_failover,omitempty"` // Client: fail over to servers reported alive
 
 	// P2P and routing configuration
 	P2PEnabled          bool `json:"p2p_enabled"`           // Enable P2P direct connections (default true)
@@ -37,8 +73,10 @@ type Config struct {
 	RouteUpdateInterval int  `json:"route_update_interval"` // Route quality check interval in seconds (default 30)
 	P2PTimeout          int  `json:"p2p_timeout"`           // P2P connection timeout in seconds (default 5)
 	EnableNATDetection  bool `json:"enable_nat_detection"`  // Enable automatic NAT type detection (default true)
+	NATReflector        string `json:"nat_reflector,omitempty"` // Server: UDP address (and the next port) answering the STUN binding requests of -nat-report
 	EnableXDP           bool `json:"enable_xdp"`            // Enable lightweight XDP/eBPF fast-path classification
 	EnableKernelTune    bool `json:"enable_kernel_tune"`    // Apply kernel tunings (TFO/BBR2) on startup
+	FixSysctl           bool `json:"fix_sysctl"`            // Loosen rp_filter and set accept_local/ip_forward as needed, restored on exit (default false)
 
 	// On-demand P2P configuration
 	RouteAdvertInterval  int `json:"route_advert_interval"`  // Route advertisement interval in seconds (default 300)
@@ -53,9 +91,196 @@ type Config struct {
 	// Fake TCP pacing configuration
 	FakeTCPWritePacingUs int `json:"faketcp_pacing_us"` // Minimum delay between fake TCP segments (microseconds, 0=auto/off)
 	FakeTCPMaxSegment    int `json:"faketcp_max_segment"` // Max payload bytes per fake TCP segment (0=auto)
+	RecvMTU              int `json:"recv_mtu"`            // Largest outer IP packet this host receives; advertised to the peer in the handshake (0=1500)
+	SocketBuffer         int `json:"socket_buffer"`       // Fixed receive and send buffer of the tunnel's sockets in bytes (0 = scale with the bandwidth-delay product)
+	SocketBufferMax      int `json:"socket_buffer_max"`   // Largest buffer automatic scaling asks for in bytes (0 = the kernel's limit)
+	MTUProbeInterval     int `json:"mtu_probe_interval"`  // Seconds between upward probes after auto-detection lowered the MTU (default 60, negative disables)
+	StateCacheFile       string `json:"state_cache"`     // File remembering path MTU and NAT type per server so restarts skip probing (client mode)
+	MTUCacheFile         string `json:"mtu_cache"`       // Deprecated: older name for state_cache
+	AggregateDelayUs     int `json:"aggregate_delay_us"`  // Pack small packets queued within this window into one wire packet (microseconds, 0=off; both ends must enable it)
+	TCPPersonality       string `json:"tcp_personality"` // OS whose TCP fingerprint forged segments imitate: linux, windows, macos (empty = default layout)
+	IPOptions            int    `json:"ip_options"`        // Bytes of NOP options padding the IP header of forged segments (0-40, multiple of 4; raw mode)
+	IPID                 string `json:"ip_id"`             // IP Identification of forged segments: counter (per flow, default), random or kernel (Linux-like buckets)
+	StrictValidation     bool   `json:"strict_validation"` // Verify checksums, header lengths and flags of received segments, dropping malformed ones (default false)
+	ECN                  bool   `json:"ecn"`               // Mark forged data segments ECN-capable and slow down on congestion marks echoed by the peer (raw mode)
+	TTL                  int    `json:"ttl"`               // TTL of forged segments (0 = the TCP personality's, 64 by default)
+	DSCP                 string `json:"dscp"`              // DSCP class of forged segments: a name such as ef, af41 or cs1, or 0-63 (empty = 0)
+	ECNCodepoint         string `json:"ecn_codepoint"`     // ECN codepoint of forged data segments: ect0, ect1 or ce (empty = ECT(0) with ecn, else none)
+	HandshakeCookies     bool   `json:"handshake_cookies"` // Answer SYNs with a stateless cookie and create connections only when the client echoes it (server)
+
+	// Priority lane for latency-critical packets
+	PriorityLane      bool `json:"priority_lane"` // Send DNS and TCP SYN packets immediately instead of in FEC groups
+	PriorityDuplicate int  `json:"priority_dup"`  // Times each priority-lane packet is sent (default 1)
+
+	// Inner QUIC (HTTP/3) flows, which recover their own losses
+	QUIC      bool `json:"quic"`        // Never hold QUIC packets for aggregation and class them interactive under rate_limit_mbps
+	QUICNoFEC bool `json:"quic_no_fec"` // Also send QUIC packets outside FEC groups (implies quic; only the sender needs it)
+
+	// Duplication of every wire packet, for small flows where bandwidth is
+	// cheaper than recovery latency
+	Duplicate          int `json:"duplicate"`            // Times each fake TCP segment is sent (default 1; only the sender needs it)
+	DuplicateSpacingUs int `json:"duplicate_spacing_us"` // Gap between copies (microseconds, 0 = back to back)
+
+	// What the sender does when the peer reports receive queue drops: any of
+	// pace, fec, shed (empty = keep sending as before)
+	CongestionResponse []string `json:"congestion_response,omitempty"`
+
+	// Cap on the traffic this end sends, shared by traffic classes: control always gets
+	// through, interactive borrows from bulk, bulk gets the rest. Shares are fractions of the cap.
+	RateLimitMbps        int     `json:"rate_limit_mbps"`        // Megabits per second (0 = unlimited)
+	RateLimitControl     float64 `json:"rate_limit_control"`     // Share assured to keepalives and reports (default 0.05)
+	RateLimitInteractive float64 `json:"rate_limit_interactive"` // Share assured to small and DSCP EF packets (default 0.25)
+
+	// Port hopping: both ends derive a server port per interval from the key and
+	// move the connection there, so no 5-tuple carries the tunnel for long. Both
+	// ends need the same range, interval and clock (to within one interval).
+	PortHopRange    string `json:"port_hop_range,omitempty"`    // Server ports to hop over, e.g. "40000-40999" (empty = off)
+	PortHopInterval int    `json:"port_hop_interval,omitempty"` // Seconds on each port (default 300)
+
+	// Reliability of data packets: "fec" (default) adds parity to groups of
+	// packets, "kcp" retransmits lost packets and delivers them in order over a
+	// KCP conversation per connection (both ends need it; FEC is then off)
+	Reliability     string `json:"reliability,omitempty"`
+	KCPNoDelay      int    `json:"kcp_nodelay"`  // 0 normal, 1 lower minimum RTO and slower backoff (default), 2 back off from the RTT estimate
+	KCPInterval     int    `json:"kcp_interval"` // Flush interval in ms (default 20)
+	KCPResend       int    `json:"kcp_resend"`   // Fast retransmit after this many later packets were acknowledged (default 2, 0 = off)
+	KCPNoCongestion bool   `json:"kcp_nc"`       // Disable KCP congestion control, leaving only the windows (default true)
+	KCPSendWindow   int    `json:"kcp_sndwnd"`   // Send window in packets (default 128)
+	KCPRecvWindow   int    `json:"kcp_rcvwnd"`   // Receive window in packets (default 512)
+
+	// WireGuard passthrough: carry an existing WireGuard flow instead of running
+	// a TUN device (tunnel_addr, routes and the other TUN settings are unused)
+	WireGuardListen   string `json:"wg_listen,omitempty"`   // Local UDP address WireGuard uses as its peer endpoint (client)
+	WireGuardEndpoint string `json:"wg_endpoint,omitempty"` // WireGuard server's UDP address the datagrams are passed to (server)
 
 	// Performance tuning
 	SendWorkers int `json:"send_workers"` // Number of parallel send workers (default 4)
+	FECWorkers  int `json:"fec_workers"`  // Number of parallel FEC reconstruction/decryption workers (default send_workers)
+	TUNWriters  int `json:"tun_writers"`  // Number of TUN writers in client mode; more than 1 gives up in-order delivery (default 1)
+
+	// Certificate (PKI) authentication
+	// When ca_cert is set, both ends must present a certificate signed by the CA during the
+	// authentication handshake (client certs need clientAuth EKU, server certs need serverAuth EKU).
+	CACertFile  string `json:"ca_cert"`   // PEM CA bundle used to verify peer certificates (enables PKI mode)
+	CertFile    string `json:"cert_file"` // PEM certificate presented to the peer
+	CertKeyFile string `json:"cert_key"`  // PEM private key for cert_file
+	CRLFile     string `json:"crl_file"`  // Optional PEM/DER CRL, reloaded when the file changes
+
+	// Server key pinning (client mode); the server needs cert_file and cert_key
+	ServerFingerprint  string `json:"server_fingerprint"`    // Hex SHA-256 of the server's public key that must match
+	KnownServersFile   string `json:"known_servers"`         // File recording each server's key on first use (TOFU); a changed key is refused
+	AcceptNewServerKey bool   `json:"accept_new_server_key"` // Replace a changed key in known_servers instead of refusing the server
+
+	// Session audit log (server mode): JSON lines with connect/auth/disconnect records
+	AuditLog           string `json:"audit_log"`             // Audit log file path (empty = disabled)
+	AuditLogMaxSizeMB  int    `json:"audit_log_max_size_mb"` // Rotate when the file exceeds this size (default 100)
+	AuditLogMaxBackups int    `json:"audit_log_max_backups"` // Number of rotated files to keep (default 5)
+
+	// Per-client traffic quota (server mode), kept per certificate identity or tunnel IP across sessions
+	ClientQuotaMB     int `json:"client_quota_mb"`     // Disconnect a client once it moved this much traffic in MB within the period (0=unlimited)
+	ClientQuotaPeriod int `json:"client_quota_period"` // Seconds after which a client's quota usage starts over (0 = 86400)
+
+	// Unauthenticated traffic (server mode): packets dropped before their sender authenticated are
+	// counted per source address and class (bad_mac, unknown_session, malformed, not_our_flow,
+	// auth_rejected). A source whose drops of the ban classes reach unauth_ban_threshold within a
+	// minute is firewalled off the tunnel ports for unauth_ban_duration seconds.
+	UnauthBanThreshold int      `json:"unauth_ban_threshold"`         // Drops per minute before a ban (0 = never ban)
+	UnauthBanDuration  int      `json:"unauth_ban_duration"`          // Seconds a ban lasts (default 600)
+	UnauthBanClasses   []string `json:"unauth_ban_classes,omitempty"` // Classes counted toward a ban (default all but not_our_flow)
+
+	// Lockout protection (server mode): management traffic is accepted ahead of the firewall rules
+	// the server installs (RST filter, bans), and with firewall_confirm_timeout set those rules are
+	// removed again unless POST /firewall/confirm on the admin API confirms them in time.
+	ManagementBypass       []string `json:"management_bypass,omitempty"` // proto:port[-port][@CIDR] or operator CIDR entries (default tcp:22 and a non-loopback admin port; "none" = no bypass)
+	FirewallConfirmTimeout int      `json:"firewall_confirm_timeout"`    // Seconds to confirm the firewall rules in (0 = no confirmation)
+
+	// Usage accounting for billing (server mode): the traffic of each session since its previous
+	// report is delivered every accounting_interval seconds, at least once; reports wait in
+	// accounting_spool until the sink accepts them, also across restarts.
+	AccountingSink     string `json:"accounting_sink"`     // file:///path, http(s)://url or statsd://host:port[?prefix=p] (empty = disabled)
+	AccountingInterval int    `json:"accounting_interval"` // Seconds between reports (default 60)
+	AccountingSpool    string `json:"accounting_spool"`    // File holding undelivered reports (required with accounting_sink)
+
+	// Traffic mirroring (server mode): the decrypted inner packets of the sessions listed in
+	// mirror_sessions are copied to mirror_target for IDS inspection. Sessions are selected by
+	// tunnel IP, CIDR or certificate identity; each one mirrored is recorded in the audit log.
+	MirrorTarget   string   `json:"mirror_target"`    // vxlan://host[:port][?vni=N] or packet://<interface> (empty = disabled)
+	MirrorSessions []string `json:"mirror_sessions"`  // Sessions to mirror; nothing is mirrored unless listed
+	MirrorRateMbps int      `json:"mirror_rate_mbps"` // Mirrored traffic beyond this rate is dropped (default 100)
+
+	// Multi-process load balancing (server mode)
+	// Several server processes can share local_addr; clients are partitioned between them by
+	// a consistent hash of their address. Each process needs its own lb_worker_id.
+	LBWorkers  int `json:"lb_workers"`   // Number of server processes sharing the port (0/1 = disabled)
+	LBWorkerID int `json:"lb_worker_id"` // This process' index in [0, lb_workers)
+
+	// Kernel-bypass receive (server mode): an XDP program steers the tunnel port's packets on
+	// these interfaces to AF_XDP sockets. Interfaces where setup fails keep using the raw socket.
+	AFXDPInterfaces []string `json:"afxdp_interfaces"`
+
+	// Receive ring (server mode): listeners receive through an AF_PACKET TPACKET_V3 ring on this
+	// interface ("any" = all) instead of one recvfrom per packet. It takes 8 MiB per listener.
+	PacketRing string `json:"packet_ring"`
+
+	// Network namespace of the raw sockets and their firewall rules: a path such as the host's
+	// /proc/1/ns/net mounted into a container, or a name from "ip netns add". The TUN device stays
+	// in the process's own namespace.
+	NetNS string `json:"netns"`
+
+	// Admin API: HTTP/JSON endpoint for operating the running tunnel (status, peers,
+	// configuration, capture, impairment injection). Without a token it is unauthenticated
+	// and belongs on loopback; with admin_token and a certificate central tooling can reach it.
+	AdminListen  string `json:"admin_listen"`   // Listen address, e.g. 127.0.0.1:9100 (empty = disabled)
+	AdminToken   string `json:"admin_token"`    // Bearer token required on every request (empty = none)
+	AdminTLSCert string `json:"admin_tls_cert"` // PEM certificate; serves the admin API over HTTPS
+	AdminTLSKey  string `json:"admin_tls_key"`  // PEM private key for admin_tls_cert
+
+	// Liveness (/healthz) and readiness (/readyz) endpoints for orchestrator probes, e.g. :8080
+	// in a Kubernetes pod, and /health for load balancers. Unauthenticated; they serve nothing
+	// but status lines.
+	HealthListen       string `json:"health_listen"`
+	HealthHandshakeAge int    `json:"health_handshake_age"` // /health fails when the last completed handshake is older (seconds, 0 = only reported)
+
+	// Connection traces: every connection keeps its last trace_seconds of TCP segments in memory,
+	// written as pcapng to trace_dir when its session fails and served by the admin API (/trace).
+	TraceSeconds int    `json:"trace_seconds"` // Seconds of segments kept per connection (0 = disabled)
+	TracePayload bool   `json:"trace_payload"` // Keep payloads, not just the IP and TCP headers
+	TraceDir     string `json:"trace_dir"`     // Directory for dumps of failed sessions (default: system temp dir)
+
+	// Log level: "info" (default) or "trace", which also logs every tunnel frame decoded (type,
+	// sizes, FEC group and index, sequence numbers), rate limited. Changeable at runtime with
+	// PUT /loglevel on the admin API.
+	LogLevel string `json:"log_level"`
+
+	// Support bundles: the first first_frames frames sent and received on each connection are logged
+	// decoded, whatever the log level, and kept for GET /frames and -support-bundle (0 = disabled).
+	FirstFrames int `json:"first_frames"`
+
+	// Hitless upgrade (server mode): a new binary started with -takeover connects to the running
+	// server's upgrade socket and receives its TUN device, listening socket and client sessions.
+	UpgradeSocket string `json:"upgrade_socket"` // Unix socket path (empty = disabled)
+	Takeover      bool   `json:"-"`              // Take over from the instance listening on upgrade_socket (set by -takeover)
+
+	// Local broker: programs on this host open TCP streams through the tunnel over this Unix
+	// socket with pkg/broker (broker.Dial), sharing its one flow and firewall rules.
+	BrokerSocket string `json:"broker_socket"` // Unix socket path (empty = disabled)
+
+	// Named tunnels: a file whose tunnels object maps names to complete configurations runs each
+	// of them in one process. The other top-level fields are then unused, except admin_listen,
+	// admin_token and admin_tls_*, which serve the admin API that lists, starts and stops them.
+	Tunnels map[string]*Config `json:"tunnels,omitempty"`
+	Name    string             `json:"name,omitempty"` // Key of the section in tunnels (set when loading)
+}
+
+// ClientPush holds settings a server pushes to a client, so the client's own
+// configuration need not repeat them. Empty fields leave the client's values alone.
+type ClientPush struct {
+	TunnelAddr string   `json:"tunnel_addr,omitempty"` // Static tunnel address with prefix, e.g. "10.0.0.5/24"
+	Routes     []string `json:"routes,omitempty"`      // Routes the client installs through the tunnel
+	DNSServers []string `json:"dns_servers,omitempty"` // Nameservers set as the client's system DNS
+	DNSDomains []string `json:"dns_domains,omitempty"` // Search or routing domains for DNSServers
+	MTU        int      `json:"mtu,omitempty"`         // TUN MTU; only lowers the client's own
+	Keepalive  int      `json:"keepalive,omitempty"`   // Keepalive interval in seconds
 }
 
 // DefaultConfig returns a default configuration
@@ -69,6 +294,11 @@ func DefaultConfig() *Config {
 		MTU:                  1400,
 		FECDataShards:        10,
 		FECParityShards:      2,
+		FECMaxDataShards:     32,
+		FECMaxParityShards:   16,
+		FECReorderMaxMs:      200,
+		FECReorderWindow:     256,
+		FECGroupTimeoutMs:    2000,
 		Timeout:              30,
 		KeepaliveInterval:    5,    // Reduced from 10 to 5 seconds for faster detection of connection issues
 		RecvQueueSize:        2048, // Reasonable to prevent excessive accumulation
@@ -93,17 +323,34 @@ func DefaultConfig() *Config {
 		EncryptAfterAuth:     false,
 		FakeTCPWritePacingUs: 0,
 		FakeTCPMaxSegment:    0,
+		MTUProbeInterval:     60,
 		SendWorkers:          4, // Default to 4 workers for high throughput
+		AuditLogMaxSizeMB:    100,
+		AuditLogMaxBackups:   5,
+		UnauthBanDuration:    600,
+		AccountingInterval:   60,
+		RateLimitControl:     0.05,
+		RateLimitInteractive: 0.25,
+		KCPNoDelay:           1,
+		KCPResend:            2,
+		KCPNoCongestion:      true,
 	}
 }
 
-// LoadConfig loads configuration from a file
+// LoadConfig loads configuration from a JSON or UCI file
 func LoadConfig(filename string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	if isUCI(data) {
+		return parseUCI(data)
+	}
+	return parseConfig(data)
+}
 
+// parseConfig decodes a JSON configuration and fills in defaults for missing fields
+func parseConfig(data []byte) (*Config, error) {
 	// First unmarshal to a map to check which fields are explicitly set
 	var rawConfig map[string]interface{}
 	if err := json.Unmarshal(data, &rawConfig); err != nil {
@@ -114,6 +361,9 @@ func LoadConfig(filename string) (*Config, error) {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, err
 	}
+	if err := parseTunnels(&config, data); err != nil {
+		return nil, err
+	}
 
 	// Set defaults for missing fields
 	if config.MTU == 0 {
@@ -125,6 +375,12 @@ func LoadConfig(filename string) (*Config, error) {
 	if config.FECParityShards == 0 {
 		config.FECParityShards = 3
 	}
+	if config.FECMaxDataShards == 0 {
+		config.FECMaxDataShards = 32
+	}
+	if config.FECMaxParityShards == 0 {
+		config.FECMaxParityShards = 16
+	}
 	if config.Timeout == 0 {
 		config.Timeout = 30
 	}
@@ -158,6 +414,28 @@ func LoadConfig(filename string) (*Config, error) {
 	if config.P2PKeepAliveInterval == 0 {
 		config.P2PKeepAliveInterval = 25
 	}
+	if config.MTUProbeInterval == 0 {
+		config.MTUProbeInterval = 60
+	}
+	if config.AuditLogMaxSizeMB == 0 {
+		config.AuditLogMaxSizeMB = 100
+	}
+	if config.AuditLogMaxBackups == 0 {
+		config.AuditLogMaxBackups = 5
+	}
+	if config.UnauthBanDuration == 0 {
+		config.UnauthBanDuration = 600
+	}
+	if config.AccountingInterval == 0 {
+		config.AccountingInterval = 60
+	}
+
+	if _, exists := rawConfig["rate_limit_control"]; !exists {
+		config.RateLimitControl = 0.05
+	}
+	if _, exists := rawConfig["rate_limit_interactive"]; !exists {
+		config.RateLimitInteractive = 0.25
+	}
 
 	// Default multi_client to true for server mode if not explicitly set
 	// This matches the command-line default and expected behavior
@@ -183,10 +461,46 @@ func LoadConfig(filename string) (*Config, error) {
 	if _, exists := rawConfig["enable_kernel_tune"]; !exists {
 		config.EnableKernelTune = true
 	}
+	if _, exists := rawConfig["kcp_nodelay"]; !exists {
+		config.KCPNoDelay = 1
+	}
+	if _, exists := rawConfig["kcp_resend"]; !exists {
+		config.KCPResend = 2
+	}
+	if _, exists := rawConfig["kcp_nc"]; !exists {
+		config.KCPNoCongestion = true
+	}
 
 	return &config, nil
 }
 
+// parseTunnels parses the sections of the tunnels object, each a complete
+// configuration with defaults of its own
+func parseTunnels(config *Config, data []byte) error {
+	var named struct {
+		Tunnels map[string]json.RawMessage `json:"tunnels"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil || len(named.Tunnels) == 0 {
+		return err
+	}
+	config.Tunnels = make(map[string]*Config, len(named.Tunnels))
+	for name, section := range named.Tunnels {
+		if name == "" || strings.ContainsAny(name, "/ ") {
+			return fmt.Errorf("tunnel name %q must be non-empty without spaces or slashes", name)
+		}
+		cfg, err := parseConfig(section)
+		if err != nil {
+			return fmt.Errorf("tunnel %s: %v", name, err)
+		}
+		if len(cfg.Tunnels) > 0 {
+			return fmt.Errorf("tunnel %s: tunnels cannot be nested", name)
+		}
+		cfg.Name = name
+		config.Tunnels[name] = cfg
+	}
+	return nil
+}
+
 // SaveConfig saves configuration to a file
 // Only saves essential fields for cleaner config files.
 // Note: This function saves a minimal subset of configuration fields.
@@ -199,13 +513,13 @@ func SaveConfig(filename string, config *Config) error {
 	// Always include mode
 	minimalConfig["mode"] = config.Mode
 
-	// Server-specific fields
-	if config.Mode == "server" {
+	// Server-specific fields (peer mode listens as well)
+	if config.Mode == "server" || config.Mode == "peer" {
 		minimalConfig["local_addr"] = config.LocalAddr
 	}
 
-	// Client-specific fields
-	if config.Mode == "client" {
+	// Client-specific fields (peer mode dials as well)
+	if config.Mode == "client" || config.Mode == "peer" {
 		minimalConfig["remote_addr"] = config.RemoteAddr
 	}
 
@@ -236,6 +550,9 @@ func UpdateConfigKey(filename string, newKey string) error {
 		return err
 	}
 
+	if isUCI(data) {
+		return uciKeyError(filename)
+	}
 	data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF}) // Handle UTF-8 BOM
 
 	var cfgMap map[string]interface{}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables read by LoadEnv. Every
+// configuration file key has one: LWT_<KEY> with the key upper-cased, e.g.
+// LWT_REMOTE_ADDR or LWT_FEC_DATA. Lists are comma-separated, booleans and
+// numbers are written as usual and nested objects (client_push) as JSON.
+// LWT_<KEY>_FILE reads the value from a file instead, for keys and
+// certificates mounted from a secret.
+const EnvPrefix = "LWT_"
+
+// LoadEnv builds a configuration from LWT_ environment variables, with the
+// same defaults as LoadConfig. It reports false if none is set.
+func LoadEnv() (*Config, bool, error) {
+	raw := make(map[string]interface{})
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := EnvPrefix + strings.ToUpper(key)
+		value, ok, err := lookupEnv(name)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		v, err := envValue(field.Type, value)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", name, err)
+		}
+		raw[key] = v
+	}
+	if len(raw) == 0 {
+		return nil, false, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return cfg, true, nil
+}
+
+// lookupEnv returns the value of name, or the contents of the file named by
+// name_FILE (without a trailing newline)
+func lookupEnv(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// envValue converts a variable to the JSON value of a field of type t
+func envValue(t reflect.Type, value string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			return list, nil
+		}
+	}
+	if !json.Valid([]byte(value)) {
+		return nil, fmt.Errorf("expected a JSON value")
+	}
+	return json.RawMessage(value), nil
+}
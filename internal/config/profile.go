@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profiles are presets applied over the rest of the configuration, so one
+// setting adapts the tunnel to the host. ProfileSmall fits routers and phones
+// with 16-32 MB of RAM. It overrides explicit values, since a single larger
+// queue or an optional subsystem can exhaust such a host; each limit below
+// gives up throughput or diagnostics for memory:
+//
+//	queues          send/receive queues of smallQueueSize packets: bursts
+//	                overflow and are dropped sooner
+//	send_workers    one worker: no parallel encryption on multi-core CPUs
+//	FEC             the xor codec with one parity shard: cheap to compute and
+//	                no Galois field tables, but only one lost shard per group
+//	                is recovered (the peer must use fec_codec xor too)
+//	reorder window  smallReorderWindow FEC groups: longer reordering counts
+//	                as loss
+//	packet pool     smallPacketPool buffers kept for reuse; more are allocated
+//	                under load and left to the garbage collector
+//	KCP windows     smallKCPWindow packets: lower throughput on long paths
+//	socket buffers  scaled up to smallSocketBufferMax bytes: long fast paths
+//	                may overflow them
+//	server          at most smallMaxClients sessions, idle ones hibernate
+//	                after smallHibernateAfter seconds, one process
+//	off             connection traces and admin API captures (pcap), traffic
+//	                mirroring, accounting export (metrics), XDP/AF_XDP, and
+//	                kernel tuning, which raises socket buffers to megabytes
+//
+// The Go runtime also aims to keep the heap under SmallMemoryLimit unless
+// GOMEMLIMIT is set.
+const ProfileSmall = "small"
+
+const (
+	smallQueueSize       = 256
+	smallReorderWindow   = 32
+	smallPacketPool      = 128
+	smallKCPWindow       = 64
+	smallMaxClients      = 16
+	smallHibernateAfter  = 60
+	smallFECParityShards = 1
+	smallSocketBufferMax = 1 << 20
+
+	// SmallMemoryLimit is the Go runtime's soft memory limit in the small profile
+	SmallMemoryLimit = 20 << 20
+)
+
+// ApplyProfile applies the preset named by Profile and describes the settings
+// it changed
+func (c *Config) ApplyProfile() ([]string, error) {
+	switch c.Profile {
+	case "":
+		return nil, nil
+	case ProfileSmall:
+	default:
+		return nil, fmt.Errorf("unknown profile %q (use %s)", c.Profile, ProfileSmall)
+	}
+
+	var changed []string
+	set := func(name string, from, to interface{}) {
+		if from == 0 || from == "" {
+			from = "default"
+		}
+		changed = append(changed, fmt.Sprintf("%s %v -> %v", name, from, to))
+	}
+	// limit caps a setting where 0 means a larger default
+	limit := func(name string, v *int, max int) {
+		if *v <= 0 || *v > max {
+			set(name, *v, max)
+			*v = max
+		}
+	}
+	disable := func(name string, on bool) bool {
+		if on {
+			changed = append(changed, name+" off")
+		}
+		return false
+	}
+
+	limit("send_queue_size", &c.SendQueueSize, smallQueueSize)
+	limit("recv_queue_size", &c.RecvQueueSize, smallQueueSize)
+	limit("send_workers", &c.SendWorkers, 1)
+	limit("packet_pool_size", &c.PacketPoolSize, smallPacketPool)
+	limit("fec_reorder_window", &c.FECReorderWindow, smallReorderWindow)
+	limit("kcp_sndwnd", &c.KCPSendWindow, smallKCPWindow)
+	limit("kcp_rcvwnd", &c.KCPRecvWindow, smallKCPWindow)
+	if c.SocketBuffer > smallSocketBufferMax {
+		set("socket_buffer", c.SocketBuffer, smallSocketBufferMax)
+		c.SocketBuffer = smallSocketBufferMax
+	}
+	limit("socket_buffer_max", &c.SocketBufferMax, smallSocketBufferMax)
+	if c.Reliability != "kcp" {
+		if c.FECParityShards != smallFECParityShards {
+			set("fec_parity", c.FECParityShards, smallFECParityShards)
+			c.FECParityShards = smallFECParityShards
+		}
+		if c.FECCodec != "xor" {
+			set("fec_codec", c.FECCodec, "xor")
+			c.FECCodec = "xor"
+		}
+	}
+	if c.Mode == "server" {
+		limit("max_clients", &c.MaxClients, smallMaxClients)
+		limit("hibernate_after", &c.HibernateAfter, smallHibernateAfter)
+		if c.LBWorkers > 1 {
+			set("lb_workers", c.LBWorkers, 1)
+			c.LBWorkers = 1
+		}
+	}
+
+	if c.TraceSeconds > 0 {
+		set("trace_seconds", c.TraceSeconds, 0)
+		c.TraceSeconds = 0
+	}
+	if c.MirrorTarget != "" {
+		set("mirror_target", c.MirrorTarget, `""`)
+		c.MirrorTarget = ""
+	}
+	if c.AccountingSink != "" {
+		set("accounting_sink", c.AccountingSink, `""`)
+		c.AccountingSink = ""
+	}
+	if len(c.AFXDPInterfaces) > 0 {
+		set("afxdp_interfaces", strings.Join(c.AFXDPInterfaces, ","), `""`)
+		c.AFXDPInterfaces = nil
+	}
+	if c.PacketRing != "" {
+		set("packet_ring", c.PacketRing, `""`)
+		c.PacketRing = ""
+	}
+	c.EnableXDP = disable("enable_xdp", c.EnableXDP)
+	c.EnableKernelTune = disable("enable_kernel_tune", c.EnableKernelTune)
+	return changed, nil
+}
@@ -0,0 +1,291 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// LoadConfig also reads OpenWrt UCI configurations, so router packages can
+// ship /etc/config/lightweight-tunnel and edit it with uci or LuCI. Either
+// the file itself or the output of `uci show lightweight-tunnel` is accepted:
+//
+//	config tunnel 'wan'
+//		option mode 'client'
+//		option remote_addr 'vpn.example.com:9000'
+//		list routes '192.168.10.0/24'
+//
+// Options are named like the keys of the JSON file. Lists take list entries
+// or a comma-separated option, booleans also 1/0, yes/no and on/off, and
+// nested objects (client_push) are written as JSON. Sections of type tunnel
+// with enabled '0' are skipped. One tunnel section is the configuration;
+// several are named tunnels, named after their sections, and the options of
+// a globals section (admin_listen, ...) apply to the group.
+
+const (
+	uciTunnelType  = "tunnel"
+	uciGlobalsType = "globals"
+)
+
+type uciSection struct {
+	name    string
+	typ     string
+	options map[string][]string
+}
+
+// isUCI reports whether a configuration file is in UCI rather than JSON form
+func isUCI(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] != '{'
+}
+
+// parseUCI maps the sections of a UCI configuration to a Config
+func parseUCI(data []byte) (*Config, error) {
+	sections, err := readUCI(data)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	tunnels := make(map[string]interface{})
+	index := 0
+	for _, s := range sections {
+		switch s.typ {
+		case uciGlobalsType:
+			if err := uciOptions(raw, uciGlobalsType, s); err != nil {
+				return nil, err
+			}
+		case uciTunnelType:
+			name := s.name
+			if name == "" || strings.HasPrefix(name, "@") {
+				name = fmt.Sprintf("tunnel%d", index) // Anonymous, or @tunnel[N] in uci show
+			}
+			index++
+			if enabled, ok := s.options["enabled"]; ok && len(enabled) == 1 {
+				if on, err := uciBool(enabled[0]); err != nil {
+					return nil, fmt.Errorf("section %s: enabled: %v", name, err)
+				} else if !on {
+					continue
+				}
+			}
+			section := make(map[string]interface{})
+			if err := uciOptions(section, name, s); err != nil {
+				return nil, err
+			}
+			tunnels[name] = section
+		}
+	}
+
+	switch len(tunnels) {
+	case 0:
+		return nil, fmt.Errorf("no enabled %s section in UCI configuration", uciTunnelType)
+	case 1:
+		for _, section := range tunnels {
+			for key, v := range section.(map[string]interface{}) {
+				raw[key] = v
+			}
+		}
+	default:
+		raw["tunnels"] = tunnels
+	}
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// uciOptions converts the options of a section to the JSON values of the
+// configuration fields they name
+func uciOptions(raw map[string]interface{}, name string, s *uciSection) error {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" || key == "tunnels" || key == "name" {
+			continue
+		}
+		values, ok := s.options[key]
+		if !ok {
+			continue
+		}
+		v, err := uciValue(field.Type, values)
+		if err != nil {
+			return fmt.Errorf("section %s: %s: %v", name, key, err)
+		}
+		raw[key] = v
+	}
+	return nil
+}
+
+// uciValue converts the values of an option to the JSON value of a field of
+// type t
+func uciValue(t reflect.Type, values []string) (interface{}, error) {
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String {
+		list := []string{}
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+		}
+		return list, nil
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("expected one value, got %d", len(values))
+	}
+	if t.Kind() == reflect.Bool {
+		return uciBool(values[0])
+	}
+	return envValue(t, values[0])
+}
+
+// uciBool parses a boolean the way OpenWrt scripts do
+func uciBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "yes", "on", "true", "enabled":
+		return true, nil
+	case "0", "no", "off", "false", "disabled":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", value)
+}
+
+// readUCI reads the sections of a UCI file or of `uci show` output, in the
+// order they appear
+func readUCI(data []byte) ([]*uciSection, error) {
+	var sections []*uciSection
+	byName := make(map[string]*uciSection)
+	var current *uciSection
+	for n, line := range strings.Split(string(bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("UCI line %d: %s", n+1, fmt.Sprintf(format, args...))
+		}
+
+		keyword, _, _ := strings.Cut(line, " ")
+		keyword, _, _ = strings.Cut(keyword, "\t")
+		switch keyword {
+		case "package":
+			continue
+		case "config":
+			words, err := splitUCIWords(line)
+			if err != nil || len(words) < 2 || len(words) > 3 {
+				return nil, fail("expected config <type> ['<name>']")
+			}
+			current = &uciSection{typ: words[1], options: make(map[string][]string)}
+			if len(words) == 3 {
+				current.name = words[2]
+			}
+			sections = append(sections, current)
+			continue
+		case "option", "list":
+			words, err := splitUCIWords(line)
+			if err != nil || len(words) != 3 {
+				return nil, fail("expected %s <name> '<value>'", keyword)
+			}
+			if current == nil {
+				return nil, fail("%s outside a config section", keyword)
+			}
+			if keyword == "option" {
+				current.options[words[1]] = []string{words[2]}
+			} else {
+				current.options[words[1]] = append(current.options[words[1]], words[2])
+			}
+			continue
+		}
+
+		// uci show: package.section=type or package.section.option='value' ...
+		path, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fail("unrecognized line")
+		}
+		parts := strings.Split(path, ".")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fail("expected package.section[.option]=value")
+		}
+		words, err := splitUCIWords(value)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		s := byName[parts[1]]
+		if len(parts) == 2 {
+			if len(words) != 1 {
+				return nil, fail("expected the section type")
+			}
+			if s == nil {
+				s = &uciSection{name: parts[1], options: make(map[string][]string)}
+				byName[parts[1]] = s
+				sections = append(sections, s)
+			}
+			s.typ = words[0]
+			continue
+		}
+		if s == nil {
+			return nil, fail("option of undeclared section %s", parts[1])
+		}
+		s.options[parts[2]] = words
+	}
+	return sections, nil
+}
+
+// splitUCIWords splits a line into words the way the UCI parser does:
+// separated by blanks, with '...' and "..." quoting and backslash escapes
+func splitUCIWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// uciKeyError explains why a rotated key is not written back to a UCI file
+func uciKeyError(filename string) error {
+	return fmt.Errorf("%s is a UCI configuration; set the new key with uci set and uci commit", filename)
+}
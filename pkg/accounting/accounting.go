@@ -0,0 +1,324 @@
+// Package accounting delivers per-session traffic checkpoints for billing. The
+// tunnel periodically hands a Checkpointer the bytes and packets each session
+// moved since its previous checkpoint; the Checkpointer writes them to a spool
+// file first and removes them only once the sink has accepted them, so records
+// of a failed delivery, or pending when the process stopped, are sent again.
+// Delivery is therefore at least once: each record carries a unique ID for the
+// receiver to discard duplicates. Sinks are given as URLs:
+//
+//	file:///var/lib/lwt/usage.jsonl     JSON lines appended and synced to disk
+//	https://billing.example.com/usage   JSON array POSTed; any 2xx accepts it
+//	statsd://127.0.0.1:8125?prefix=lwt  statsd counters over UDP, accepted once sent
+package accounting
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is the traffic of one session between two checkpoints
+type Usage struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"` // End of the interval
+	Session    string    `json:"session"`
+	TunnelIP   string    `json:"tunnel_ip,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Interval   float64   `json:"interval_sec"` // Time covered by the deltas
+	BytesIn    uint64    `json:"bytes_in"`     // Tunnel payload received from the client
+	BytesOut   uint64    `json:"bytes_out"`    // Tunnel payload sent to the client
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+	Final      bool      `json:"final,omitempty"` // The session ended; no more records follow
+}
+
+// Sink receives usage records. Send returns nil only once the records are
+// stored on the other side.
+type Sink interface {
+	Send(records []Usage) error
+	Close() error
+}
+
+// maxBatch bounds the records handed to a sink at once
+const maxBatch = 1000
+
+// NewSink opens the sink described by target
+func NewSink(target string) (Sink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accounting sink %q: %v", target, err)
+	}
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque // file:relative/path
+		}
+		if path == "" {
+			return nil, fmt.Errorf("accounting sink %q has no path", target)
+		}
+		return &fileSink{path: path}, nil
+	case "http", "https":
+		return &webhookSink{url: target, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "statsd":
+		if u.Host == "" {
+			return nil, fmt.Errorf("accounting sink %q has no address", target)
+		}
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		prefix := u.Query().Get("prefix")
+		if prefix == "" {
+			prefix = "lightweight_tunnel"
+		}
+		return &statsdSink{conn: conn, prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("unsupported accounting sink %q (use file://, http(s):// or statsd://)", target)
+	}
+}
+
+// fileSink appends records as JSON lines
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Send(records []Usage) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileSink) Close() error { return nil }
+
+// webhookSink POSTs records as a JSON array
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(records []Usage) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// statsdSink sends each record as counters named after the session's tunnel
+// IP (or session ID before the IP is known)
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// statsdDatagram keeps datagrams below common path MTUs
+const statsdDatagram = 1400
+
+func (s *statsdSink) Send(records []Usage) error {
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		buf.Reset()
+		return err
+	}
+	for _, rec := range records {
+		name := rec.TunnelIP
+		if name == "" {
+			name = rec.Session
+		}
+		name = strings.NewReplacer(".", "_", ":", "_").Replace(name)
+		for _, c := range []struct {
+			metric string
+			value  uint64
+		}{
+			{"bytes_in", rec.BytesIn},
+			{"bytes_out", rec.BytesOut},
+			{"packets_in", rec.PacketsIn},
+			{"packets_out", rec.PacketsOut},
+		} {
+			line := fmt.Sprintf("%s.client.%s.%s:%d|c\n", s.prefix, name, c.metric, c.value)
+			if buf.Len()+len(line) > statsdDatagram {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			buf.WriteString(line)
+		}
+	}
+	return flush()
+}
+
+func (s *statsdSink) Close() error { return s.conn.Close() }
+
+// Checkpointer spools usage records and delivers them to a sink
+type Checkpointer struct {
+	sink  Sink
+	spool string
+
+	mu      sync.Mutex
+	pending []Usage
+
+	flushMu sync.Mutex // One delivery at a time
+}
+
+// NewCheckpointer delivers records to sink, spooling them in the file spool
+// meanwhile. Records left in the spool by an earlier run are delivered first.
+func NewCheckpointer(sink Sink, spool string) (*Checkpointer, error) {
+	c := &Checkpointer{sink: sink, spool: spool}
+	data, err := os.ReadFile(spool)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read accounting spool: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var rec Usage
+		if err := dec.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("corrupt accounting spool %s: %v", spool, err)
+		}
+		c.pending = append(c.pending, rec)
+	}
+	return c, nil
+}
+
+// Add spools records, giving those without an ID a random one
+func (c *Checkpointer) Add(records ...Usage) error {
+	if len(records) == 0 {
+		return nil
+	}
+	for i := range records {
+		if records[i].ID == "" {
+			records[i].ID = newID()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, records...)
+	return c.writeSpool()
+}
+
+// Pending returns the number of records not yet accepted by the sink
+func (c *Checkpointer) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Flush delivers the spooled records, oldest first, stopping at the first
+// batch the sink refuses
+func (c *Checkpointer) Flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	for {
+		c.mu.Lock()
+		batch := append([]Usage(nil), c.pending[:min(len(c.pending), maxBatch)]...)
+		c.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := c.sink.Send(batch); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		// Add only appends, so the batch is still the head of pending
+		c.pending = append([]Usage(nil), c.pending[len(batch):]...)
+		err := c.writeSpool()
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the sink; spooled records stay for the next run
+func (c *Checkpointer) Close() error {
+	return c.sink.Close()
+}
+
+// writeSpool replaces the spool file with the pending records (c.mu held)
+func (c *Checkpointer) writeSpool() error {
+	if len(c.pending) == 0 {
+		if err := os.Remove(c.spool); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range c.pending {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.spool), filepath.Base(c.spool)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.spool)
+}
+
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,110 @@
+package accounting
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flakySink refuses deliveries while down and remembers what it accepted
+type flakySink struct {
+	down     bool
+	accepted []Usage
+}
+
+func (s *flakySink) Send(records []Usage) error {
+	if s.down {
+		return errors.New("unavailable")
+	}
+	s.accepted = append(s.accepted, records...)
+	return nil
+}
+
+func (s *flakySink) Close() error { return nil }
+
+// TestSpoolSurvivesRestart checks that records the sink refused are delivered
+// by the next Checkpointer using the same spool, and only once they are
+func TestSpoolSurvivesRestart(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "usage.spool")
+	sink := &flakySink{down: true}
+	c, err := NewCheckpointer(sink, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(Usage{Session: "a", BytesIn: 100}, Usage{Session: "b", BytesOut: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err == nil {
+		t.Fatal("Flush succeeded with the sink down")
+	}
+	c.Close()
+
+	sink.down = false
+	c, err = NewCheckpointer(sink, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Pending() != 2 {
+		t.Fatalf("%d records pending after restart, want 2", c.Pending())
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.accepted) != 2 || sink.accepted[0].BytesIn != 100 || sink.accepted[1].BytesOut != 200 {
+		t.Fatalf("sink accepted %+v", sink.accepted)
+	}
+	if sink.accepted[0].ID == "" || sink.accepted[0].ID == sink.accepted[1].ID {
+		t.Errorf("records lack unique IDs: %q, %q", sink.accepted[0].ID, sink.accepted[1].ID)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("spool not removed once delivered: %v", err)
+	}
+}
+
+// TestSinks checks the file and statsd sinks' output
+func TestSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	sink, err := NewSink("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Usage{ID: "1", Session: "s1", TunnelIP: "10.0.0.2", BytesIn: 10, PacketsIn: 1}
+	for i := 0; i < 2; i++ {
+		if err := sink.Send([]Usage{rec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 || !strings.Contains(string(data), `"bytes_in":10`) {
+		t.Errorf("file sink wrote %q", data)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink, err = NewSink("statsd://" + pc.LocalAddr().String() + "?prefix=lwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send([]Usage{rec}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); !strings.HasPrefix(got, "lwt.client.10_0_0_2.bytes_in:10|c\n") {
+		t.Errorf("statsd datagram %q", got)
+	}
+
+	if _, err := NewSink("ftp://example.com"); err == nil {
+		t.Error("unsupported scheme accepted")
+	}
+}
@@ -0,0 +1,431 @@
+//go:build linux && (amd64 || arm64)
+
+package afxdp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// AF_XDP socket constants (linux/if_xdp.h)
+const (
+	afXDP  = 44
+	solXDP = 283
+
+	xdpMmapOffsets         = 1
+	xdpRxRing              = 2
+	xdpUmemReg             = 4
+	xdpUmemFillRing        = 5
+	xdpUmemCompletionRing  = 6
+	xdpPgoffRxRing         = 0
+	xdpUmemPgoffFillRing   = 0x100000000
+	xdpUmemPgoffCompletion = 0x180000000
+
+	frameSize  = 2048
+	frameCount = 2048 // per queue; also the ring size
+
+	ethHeaderLen = 14
+)
+
+// ErrTimeout is returned by ReadFrame when no frame arrived in time
+var ErrTimeout = errors.New("afxdp: read timeout")
+
+// ErrClosed is returned by ReadFrame after Close
+var ErrClosed = errors.New("afxdp: receiver closed")
+
+// Receiver delivers the IPv4 packets for one TCP port from every RX queue of an
+// interface through AF_XDP sockets, bypassing netfilter and skb allocation.
+// Everything else, including our packets with IP options, still goes to the kernel.
+type Receiver struct {
+	ifname  string
+	mapFD   int
+	progFD  int
+	linkFD  int
+	sockets []*xsk
+	packets chan []byte
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+
+	framesRecv atomic.Uint64
+}
+
+// Open loads the steering program on ifname and binds one AF_XDP socket per RX queue.
+// Callers should fall back to their regular receive path when it returns an error.
+func Open(ifname string, port uint16) (*Receiver, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", ifname, err)
+	}
+	queues := rxQueueCount(ifname)
+
+	r := &Receiver{
+		ifname:  ifname,
+		mapFD:   -1,
+		progFD:  -1,
+		linkFD:  -1,
+		packets: make(chan []byte, frameCount*queues),
+		stopCh:  make(chan struct{}),
+	}
+
+	if r.mapFD, err = createXSKMap(queues); err != nil {
+		return nil, err
+	}
+	for q := 0; q < queues; q++ {
+		sock, err := newXSK(iface.Index, q)
+		if err != nil {
+			r.release()
+			return nil, fmt.Errorf("queue %d: %v", q, err)
+		}
+		r.sockets = append(r.sockets, sock)
+		if err := updateXSKMap(r.mapFD, q, sock.fd); err != nil {
+			r.release()
+			return nil, fmt.Errorf("failed to register queue %d socket: %v", q, err)
+		}
+	}
+	if r.progFD, err = loadProgram(steeringProgram(r.mapFD, port)); err != nil {
+		r.release()
+		return nil, err
+	}
+	if r.linkFD, err = attachProgram(r.progFD, iface.Index); err != nil {
+		r.release()
+		return nil, err
+	}
+
+	for _, sock := range r.sockets {
+		r.wg.Add(1)
+		go r.rxLoop(sock)
+	}
+	log.Printf("AF_XDP receive enabled on %s (%d queues, port %d)", ifname, queues, port)
+	return r, nil
+}
+
+// ReadFrame returns the next IPv4 packet (Ethernet header stripped).
+// A timeout <= 0 blocks until a packet arrives or the receiver is closed.
+func (r *Receiver) ReadFrame(timeout time.Duration) ([]byte, error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case pkt := <-r.packets:
+		return pkt, nil
+	case <-timer:
+		return nil, ErrTimeout
+	case <-r.stopCh:
+		return nil, ErrClosed
+	}
+}
+
+// Packets returns the channel frames are delivered on, for use in select loops
+func (r *Receiver) Packets() <-chan []byte {
+	return r.packets
+}
+
+// FramesReceived returns the number of frames taken from the AF_XDP rings
+func (r *Receiver) FramesReceived() uint64 {
+	return r.framesRecv.Load()
+}
+
+// Close detaches the XDP program and releases the sockets
+func (r *Receiver) Close() error {
+	r.once.Do(func() {
+		close(r.stopCh)
+		// Detach first so the kernel stops steering packets into our rings
+		if r.linkFD >= 0 {
+			syscall.Close(r.linkFD)
+			r.linkFD = -1
+		}
+		r.wg.Wait()
+		r.release()
+	})
+	return nil
+}
+
+func (r *Receiver) release() {
+	if r.linkFD >= 0 {
+		syscall.Close(r.linkFD)
+		r.linkFD = -1
+	}
+	if r.progFD >= 0 {
+		syscall.Close(r.progFD)
+		r.progFD = -1
+	}
+	for _, sock := range r.sockets {
+		sock.close()
+	}
+	r.sockets = nil
+	if r.mapFD >= 0 {
+		syscall.Close(r.mapFD)
+		r.mapFD = -1
+	}
+}
+
+func (r *Receiver) rxLoop(sock *xsk) {
+	defer r.wg.Done()
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		log.Printf("AF_XDP queue %d: epoll failed: %v", sock.queue, err)
+		return
+	}
+	defer syscall.Close(epfd)
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(sock.fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, sock.fd, &ev); err != nil {
+		log.Printf("AF_XDP queue %d: epoll_ctl failed: %v", sock.queue, err)
+		return
+	}
+
+	events := make([]syscall.EpollEvent, 1)
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		default:
+		}
+
+		if n := sock.receive(r.deliver); n > 0 {
+			r.framesRecv.Add(uint64(n))
+			continue
+		}
+		// Ring empty: sleep until the kernel signals new descriptors (100ms cap to notice Close)
+		if _, err := syscall.EpollWait(epfd, events, 100); err != nil && err != syscall.EINTR {
+			log.Printf("AF_XDP queue %d: epoll_wait failed: %v", sock.queue, err)
+			return
+		}
+	}
+}
+
+func (r *Receiver) deliver(frame []byte) {
+	if len(frame) <= ethHeaderLen {
+		return
+	}
+	pkt := make([]byte, len(frame)-ethHeaderLen)
+	copy(pkt, frame[ethHeaderLen:])
+	select {
+	case r.packets <- pkt:
+	default:
+		// Consumer is behind; drop like a full socket buffer would
+	}
+}
+
+// rxQueueCount returns the number of RX queues of ifname (at least 1)
+func rxQueueCount(ifname string) int {
+	matches, err := filepath.Glob(filepath.Join("/sys/class/net", ifname, "queues", "rx-*"))
+	if err != nil || len(matches) == 0 {
+		return 1
+	}
+	return len(matches)
+}
+
+// ring is a single-producer/single-consumer descriptor ring shared with the kernel
+type ring struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	desc     unsafe.Pointer
+	mask     uint32
+}
+
+// xsk is one AF_XDP socket bound to a single RX queue with its own UMEM
+type xsk struct {
+	fd    int
+	queue int
+	umem  []byte
+	fill  ring
+	comp  ring
+	rx    ring
+}
+
+type ringOffset struct {
+	producer, consumer, desc, flags uint64
+}
+
+type mmapOffsets struct {
+	rx, tx, fr, cr ringOffset
+}
+
+func newXSK(ifindex, queue int) (*xsk, error) {
+	fd, err := syscall.Socket(afXDP, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("AF_XDP socket: %v", err)
+	}
+	s := &xsk{fd: fd, queue: queue}
+
+	s.umem, err = syscall.Mmap(-1, 0, frameSize*frameCount,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_POPULATE)
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("UMEM allocation: %v", err)
+	}
+	reg := struct {
+		addr      uint64
+		len       uint64
+		chunkSize uint32
+		headroom  uint32
+	}{
+		addr:      uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		len:       uint64(len(s.umem)),
+		chunkSize: frameSize,
+	}
+	if err := setsockopt(fd, xdpUmemReg, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("UMEM registration: %v", err)
+	}
+
+	size := uint32(frameCount)
+	for _, opt := range []int{xdpUmemFillRing, xdpUmemCompletionRing, xdpRxRing} {
+		if err := setsockopt(fd, opt, unsafe.Pointer(&size), 4); err != nil {
+			s.close()
+			return nil, fmt.Errorf("ring setup: %v", err)
+		}
+	}
+
+	off, err := getMmapOffsets(fd)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.fill, err = mapRing(fd, off.fr, 8, xdpUmemPgoffFillRing); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.comp, err = mapRing(fd, off.cr, 8, xdpUmemPgoffCompletion); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.rx, err = mapRing(fd, off.rx, 16, xdpPgoffRxRing); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	// Hand every frame to the kernel up front
+	for i := uint32(0); i < frameCount; i++ {
+		*(*uint64)(unsafe.Add(s.fill.desc, uintptr(i)*8)) = uint64(i) * frameSize
+	}
+	atomic.StoreUint32(s.fill.producer, frameCount)
+
+	sa := struct {
+		family       uint16
+		flags        uint16
+		ifindex      uint32
+		queueID      uint32
+		sharedUmemFD uint32
+	}{family: afXDP, ifindex: uint32(ifindex), queueID: uint32(queue)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa)); errno != 0 {
+		s.close()
+		return nil, fmt.Errorf("bind: %v", errno)
+	}
+	return s, nil
+}
+
+// receive drains the RX ring, calling fn for each frame, and recycles the
+// frames into the fill ring. It returns the number of frames processed.
+func (s *xsk) receive(fn func([]byte)) int {
+	cons := *s.rx.consumer
+	prod := atomic.LoadUint32(s.rx.producer)
+	if cons == prod {
+		return 0
+	}
+
+	fillProd := *s.fill.producer
+	n := 0
+	for ; cons != prod; cons++ {
+		desc := unsafe.Add(s.rx.desc, uintptr(cons&s.rx.mask)*16)
+		addr := *(*uint64)(desc)
+		length := *(*uint32)(unsafe.Add(desc, 8))
+		if addr+uint64(length) <= uint64(len(s.umem)) {
+			fn(s.umem[addr : addr+uint64(length)])
+		}
+		*(*uint64)(unsafe.Add(s.fill.desc, uintptr(fillProd&s.fill.mask)*8)) = addr &^ (frameSize - 1)
+		fillProd++
+		n++
+	}
+	atomic.StoreUint32(s.fill.producer, fillProd)
+	atomic.StoreUint32(s.rx.consumer, cons)
+	return n
+}
+
+func (s *xsk) close() {
+	for _, r := range []*ring{&s.rx, &s.comp, &s.fill} {
+		if r.mem != nil {
+			syscall.Munmap(r.mem)
+			r.mem = nil
+		}
+	}
+	if s.fd >= 0 {
+		syscall.Close(s.fd)
+		s.fd = -1
+	}
+	if s.umem != nil {
+		syscall.Munmap(s.umem)
+		s.umem = nil
+	}
+}
+
+func setsockopt(fd, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), solXDP, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getMmapOffsets reads the ring layout; older kernels return the layout without flags
+func getMmapOffsets(fd int) (mmapOffsets, error) {
+	var buf [4 * 4]uint64
+	size := uint32(unsafe.Sizeof(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), solXDP, xdpMmapOffsets,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return mmapOffsets{}, fmt.Errorf("XDP_MMAP_OFFSETS: %v", errno)
+	}
+	stride := 4
+	if size < uint32(unsafe.Sizeof(buf)) {
+		stride = 3
+	}
+	get := func(i int) ringOffset {
+		return ringOffset{producer: buf[i*stride], consumer: buf[i*stride+1], desc: buf[i*stride+2]}
+	}
+	return mmapOffsets{rx: get(0), tx: get(1), fr: get(2), cr: get(3)}, nil
+}
+
+func mapRing(fd int, off ringOffset, descSize uintptr, pgoff int64) (ring, error) {
+	length := int(off.desc + uint64(frameCount)*uint64(descSize))
+	mem, err := syscall.Mmap(fd, pgoff, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return ring{}, fmt.Errorf("ring mmap: %v", err)
+	}
+	base := unsafe.Pointer(&mem[0])
+	return ring{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Add(base, off.producer)),
+		consumer: (*uint32)(unsafe.Add(base, off.consumer)),
+		desc:     unsafe.Add(base, off.desc),
+		mask:     frameCount - 1,
+	}, nil
+}
+
+// Supported reports whether this host can plausibly run the AF_XDP path
+func Supported() bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+	fd, err := syscall.Socket(afXDP, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
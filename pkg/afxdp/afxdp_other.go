@@ -0,0 +1,51 @@
+//go:build !linux || !(amd64 || arm64)
+
+package afxdp
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTimeout is returned by ReadFrame when no frame arrived in time
+var ErrTimeout = errors.New("afxdp: read timeout")
+
+// ErrClosed is returned by ReadFrame after Close
+var ErrClosed = errors.New("afxdp: receiver closed")
+
+// errUnsupported is returned by Open where the AF_XDP path is not built
+var errUnsupported = errors.New("afxdp: not supported on this platform")
+
+// Receiver is never created on this platform; Open always fails and callers
+// stay on their regular receive path
+type Receiver struct{}
+
+// Open always fails on this platform
+func Open(ifname string, port uint16) (*Receiver, error) {
+	return nil, errUnsupported
+}
+
+// ReadFrame reports the receiver as closed
+func (r *Receiver) ReadFrame(timeout time.Duration) ([]byte, error) {
+	return nil, ErrClosed
+}
+
+// Packets returns a nil channel, which never delivers
+func (r *Receiver) Packets() <-chan []byte {
+	return nil
+}
+
+// FramesReceived always returns 0
+func (r *Receiver) FramesReceived() uint64 {
+	return 0
+}
+
+// Close does nothing
+func (r *Receiver) Close() error {
+	return nil
+}
+
+// Supported always reports false on this platform
+func Supported() bool {
+	return false
+}
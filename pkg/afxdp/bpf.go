@@ -0,0 +1,205 @@
+//go:build linux && (amd64 || arm64)
+
+package afxdp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// bpf(2) commands and constants used by the receive path
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfLinkCreate    = 28
+
+	bpfMapTypeXSKMap = 17
+	bpfProgTypeXDP   = 6
+	bpfAttachXDP     = 37
+
+	bpfPseudoMapFD     = 1
+	bpfFuncRedirectMap = 51
+
+	xdpPass = 2
+)
+
+// bpfInsn is a single eBPF instruction (struct bpf_insn)
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst:4 | src:4
+	off  int16
+	imm  int32
+}
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// eBPF opcodes
+const (
+	opLdxW    = 0x61 // dst = *(u32 *)(src + off)
+	opLdxH    = 0x69 // dst = *(u16 *)(src + off)
+	opLdxB    = 0x71 // dst = *(u8 *)(src + off)
+	opMovX    = 0xbf // dst = src
+	opMovK    = 0xb7 // dst = imm
+	opAddK    = 0x07 // dst += imm
+	opJgtX    = 0x2d // if dst > src goto pc+off
+	opJneK    = 0x55 // if dst != imm goto pc+off
+	opLdImm64 = 0x18
+	opCall    = 0x85
+	opExit    = 0x95
+)
+
+// steeringProgram builds an XDP program that redirects IPv4 TCP segments for
+// port into the XSK map slot of the receiving queue and passes everything else
+// to the kernel. Packets with IP options also fall through to the raw socket.
+func steeringProgram(mapFD int, port uint16) []bpfInsn {
+	const pass = 20 // index of the XDP_PASS epilogue
+
+	// Packet bytes are loaded in host order, so compare against the
+	// network-order value as it reads on this host
+	ethIPv4 := int32(hostOrder16([]byte{0x08, 0x00}))
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], port)
+	portN := int32(hostOrder16(portBytes[:]))
+
+	return []bpfInsn{
+		insn(opMovX, 6, 1, 0, 0),                            // 0: r6 = ctx
+		insn(opLdxW, 2, 1, 0, 0),                            // 1: r2 = ctx->data
+		insn(opLdxW, 3, 1, 4, 0),                            // 2: r3 = ctx->data_end
+		insn(opMovX, 4, 2, 0, 0),                            // 3: r4 = data
+		insn(opAddK, 4, 0, 0, 14+20+4),                      // 4: r4 += eth + ip + ports
+		insn(opJgtX, 4, 3, pass-6, 0),                       // 5: if r4 > data_end goto pass
+		insn(opLdxH, 5, 2, 12, 0),                           // 6: r5 = ethertype
+		insn(opJneK, 5, 0, pass-8, ethIPv4),                 // 7: not IPv4 -> pass
+		insn(opLdxB, 5, 2, 14, 0),                           // 8: r5 = version/IHL
+		insn(opJneK, 5, 0, pass-10, 0x45),                   // 9: options present -> pass
+		insn(opLdxB, 5, 2, 23, 0),                           // 10: r5 = protocol
+		insn(opJneK, 5, 0, pass-12, 6),                      // 11: not TCP -> pass
+		insn(opLdxH, 5, 2, 36, 0),                           // 12: r5 = TCP dst port
+		insn(opJneK, 5, 0, pass-14, portN),                  // 13: other port -> pass
+		insn(opLdxW, 2, 6, 16, 0),                           // 14: r2 = ctx->rx_queue_index
+		insn(opLdImm64, 1, bpfPseudoMapFD, 0, int32(mapFD)), // 15: r1 = xsk map
+		insn(0, 0, 0, 0, 0),                                 // 16: (ld_imm64 upper half)
+		insn(opMovK, 3, 0, 0, xdpPass),                      // 17: r3 = XDP_PASS if the slot is empty
+		insn(opCall, 0, 0, 0, bpfFuncRedirectMap),           // 18: bpf_redirect_map
+		insn(opExit, 0, 0, 0, 0),                            // 19
+		insn(opMovK, 0, 0, 0, xdpPass),                      // 20: pass: r0 = XDP_PASS
+		insn(opExit, 0, 0, 0, 0),                            // 21
+	}
+}
+
+// hostOrder16 reads two bytes the way a native 16-bit load would
+func hostOrder16(b []byte) uint16 {
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// createXSKMap creates a BPF_MAP_TYPE_XSKMAP with one slot per RX queue
+func createXSKMap(entries int) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+	}{bpfMapTypeXSKMap, 4, 4, uint32(entries), 0}
+	fd, err := bpfCall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create XSK map: %v", err)
+	}
+	return fd, nil
+}
+
+func updateXSKMap(mapFD, queue, sockFD int) error {
+	key := uint32(queue)
+	value := uint32(sockFD)
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{
+		mapFD: uint32(mapFD),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err := bpfCall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	return err
+}
+
+// loadProgram loads the steering program and returns its fd
+func loadProgram(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 4096)
+	attr := struct {
+		progType           uint32
+		insnCnt            uint32
+		insns              uint64
+		license            uint64
+		logLevel           uint32
+		logSize            uint32
+		logBuf             uint64
+		kernVersion        uint32
+		progFlags          uint32
+		progName           [16]byte
+		progIfindex        uint32
+		expectedAttachType uint32
+	}{
+		progType:           bpfProgTypeXDP,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:           1,
+		logSize:            uint32(len(logBuf)),
+		logBuf:             uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+		expectedAttachType: bpfAttachXDP,
+	}
+	copy(attr.progName[:], "lwt_xsk_steer")
+	fd, err := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return -1, fmt.Errorf("failed to load XDP program: %v (verifier: %s)", err, cString(logBuf))
+	}
+	return fd, nil
+}
+
+// attachProgram attaches the program to ifindex through a BPF link, which is
+// detached automatically when the link fd is closed (or the process exits)
+func attachProgram(progFD, ifindex int) (int, error) {
+	attr := struct {
+		progFD     uint32
+		ifindex    uint32
+		attachType uint32
+		flags      uint32
+	}{uint32(progFD), uint32(ifindex), bpfAttachXDP, 0}
+	fd, err := bpfCall(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to attach XDP program: %v", err)
+	}
+	return fd, nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,4 @@
+package afxdp
+
+// sysBPF is the bpf(2) syscall number
+const sysBPF = 321
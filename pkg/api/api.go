@@ -0,0 +1,379 @@
+// Package api defines the JSON documents exchanged between a running tunnel
+// and the tools that inspect it: the admin API responses and the -json output
+// of the command line. Fields are only ever added, never renamed or retyped,
+// so scripts written against one release keep working with the next.
+package api
+
+import "time"
+
+// Status is a snapshot of a running tunnel (GET /status, -top -json).
+// Counters are totals since start; rates are left to the reader.
+type Status struct {
+	Name       string            `json:"name,omitempty"` // Section of a named tunnel
+	Mode       string            `json:"mode"`
+	Version    string            `json:"version"`
+	TunName    string            `json:"tun_name"`
+	Uptime     float64           `json:"uptime_seconds"`
+	BytesIn    uint64            `json:"bytes_in"`  // Tunnel payload received from peers
+	BytesOut   uint64            `json:"bytes_out"` // Tunnel payload sent to peers
+	Server     string            `json:"server,omitempty"`
+	SessionID  string            `json:"session_id,omitempty"` // Session ID the server announced (client mode)
+	RTTMs      float64           `json:"rtt_ms,omitempty"`     // Keepalive RTT to the server (client mode)
+	Clock      *ClockStatus      `json:"clock,omitempty"`      // Server clock as measured at the session start (client mode)
+	FEC        FECStatus         `json:"fec"`
+	Drops      uint64            `json:"drops"`                // Packets dropped on full queues
+	Interface  InterfaceCounters `json:"interface"`            // The tunnel's counters as those of a network interface
+	DeadPaths  uint64            `json:"dead_paths,omitempty"` // Connections abandoned because the peer stopped receiving our packets
+	Panics     uint64            `json:"panics,omitempty"`     // Panics recovered in tunnel goroutines; each ended a session or restarted a loop
+	Resumes    uint64            `json:"resumes,omitempty"`    // Resumes from sleep, after which the server was probed (client mode)
+	Transforms *TransformStatus  `json:"transforms,omitempty"` // Set when frame transforms are registered
+	Unauth     *UnauthStatus     `json:"unauth,omitempty"`     // Packets dropped before authentication (server mode)
+	Sessions   []SessionStatus   `json:"sessions"`
+	Firewall   []FirewallRule    `json:"firewall"`
+	Guard      *FirewallGuard    `json:"firewall_guard,omitempty"`
+	Strict     *StrictStatus     `json:"strict,omitempty"`     // Set when strict validation is enabled
+	Cookies    *CookieStatus     `json:"cookies,omitempty"`    // Set when handshake cookies are enabled
+	Mirror     *MirrorStatus     `json:"mirror,omitempty"`     // Set when traffic mirroring is enabled
+	Duplicates *DuplicateStatus  `json:"duplicates,omitempty"` // Set when duplicating or once copies were received
+	ICMP       *ICMPStatus       `json:"icmp,omitempty"`       // ICMP errors about the fake TCP flows (raw mode)
+	Congestion *CongestionStatus `json:"congestion,omitempty"` // Set when responding to drop reports or once drops were reported
+	RateLimit  *RateLimitStatus  `json:"rate_limit,omitempty"` // Set when the traffic sent is capped
+	PortHop    *PortHopStatus    `json:"port_hop,omitempty"`   // Set when port hopping is enabled
+	Broker     *BrokerStatus     `json:"broker,omitempty"`     // Set when local programs may share the tunnel
+	Servers    []ServerHealth    `json:"servers,omitempty"`    // Other servers: gossip peers (server), live alternatives (client)
+	Handshakes []TCPState        `json:"handshakes,omitempty"` // Raw mode connections of the process not established yet, and its last failed dial
+	Buffers    *BufferStatus     `json:"socket_buffers,omitempty"`
+}
+
+// FrameRecord is one of the first frames of a connection (GET /frames)
+type FrameRecord struct {
+	Time    time.Time `json:"time"`
+	Sent    bool      `json:"sent"`              // Sent by this end, else received
+	Peer    string    `json:"peer"`              // Address of the other end
+	Session string    `json:"session,omitempty"` // Session ID of the connection
+	Index   int       `json:"index"`             // 1 for the connection's first frame
+	Frame   string    `json:"frame"`             // Decoded headers, as logged at log level trace
+}
+
+// TunnelInfo describes one of the named tunnels run by a process (GET /tunnels)
+type TunnelInfo struct {
+	Name    string    `json:"name"`
+	Mode    string    `json:"mode"`
+	Running bool      `json:"running"`
+	Started time.Time `json:"started,omitzero"`
+	Error   string    `json:"error,omitempty"` // Why it last failed to start or stopped on its own
+}
+
+// InterfaceCounters count the traffic of the tunnel like the IF-MIB counters
+// of an interface (ifInOctets, ifInUcastPkts, ...): in is what the tunnel
+// received from its peers, out what it sent them. Octets are those of the
+// inner packets, like BytesIn and BytesOut.
+type InterfaceCounters struct {
+	InOctets    uint64 `json:"in_octets"`
+	InPackets   uint64 `json:"in_packets"`
+	InErrors    uint64 `json:"in_errors"`   // Packets that could not be written to the TUN device
+	InDiscards  uint64 `json:"in_discards"` // Packets received but dropped on full queues
+	OutOctets   uint64 `json:"out_octets"`
+	OutPackets  uint64 `json:"out_packets"`
+	OutErrors   uint64 `json:"out_errors"`   // Failed writes to the network connection
+	OutDiscards uint64 `json:"out_discards"` // Packets dropped before sending: full queues, too large, shed, over the rate limit
+}
+
+// ServerHealth is what is known about another server of a multi-server
+// deployment. A server reports it to its clients as their failover targets.
+type ServerHealth struct {
+	Addr       string    `json:"addr"` // Address clients connect to
+	Alive      bool      `json:"alive"`
+	Clients    int       `json:"clients"`
+	MaxClients int       `json:"max_clients,omitempty"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// StrictStatus counts received packets dropped by strict validation, by reason
+type StrictStatus struct {
+	IPHeader    uint64 `json:"ip_header"`
+	IPChecksum  uint64 `json:"ip_checksum"`
+	TCPHeader   uint64 `json:"tcp_header"`
+	TCPChecksum uint64 `json:"tcp_checksum"`
+	TCPFlags    uint64 `json:"tcp_flags"`
+}
+
+// CookieStatus counts the handshake cookies of the listener
+type CookieStatus struct {
+	Sent     uint64 `json:"sent"`     // SYN-ACKs carrying a cookie
+	Accepted uint64 `json:"accepted"` // Connections created from a valid cookie
+	Rejected uint64 `json:"rejected"` // Segments of unknown connections without a valid cookie
+}
+
+// ICMPStatus counts the ICMP errors received about the tunnel's own flows
+type ICMPStatus struct {
+	FragNeeded   uint64 `json:"frag_needed"`
+	Unreachable  uint64 `json:"unreachable"`
+	TimeExceeded uint64 `json:"ttl_exceeded"`
+	Ignored      uint64 `json:"ignored"` // Quoting an unknown flow or an unsent sequence number
+}
+
+// MirrorStatus counts the packets copied to the mirror target
+type MirrorStatus struct {
+	Target  string `json:"target"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"` // Over the rate limit or beyond a full queue
+	Errors  uint64 `json:"errors"`  // Refused by the target
+}
+
+// CongestionStatus describes the drop reports exchanged with peers
+type CongestionStatus struct {
+	Response    []string `json:"response"`     // Configured responses (empty: none)
+	Level       int      `json:"level"`        // 0 (not congested) to 4; the highest session's on servers
+	PeerDrops   uint64   `json:"peer_drops"`   // Receive queue drops reported by peers
+	Shed        uint64   `json:"shed"`         // Low-priority packets dropped while congested
+	ReportsSent uint64   `json:"reports_sent"` // Drop reports sent about this end's receive queues
+}
+
+// RateLimitStatus describes the cap on the traffic sent
+type RateLimitStatus struct {
+	Mbps    int               `json:"mbps"`
+	Classes []RateClassStatus `json:"classes"`
+}
+
+// RateClassStatus is the traffic of one class under the rate limit
+type RateClassStatus struct {
+	Class   string  `json:"class"`   // control, interactive or bulk
+	Share   float64 `json:"share"`   // Fraction of the cap assured to the class
+	Bytes   uint64  `json:"bytes"`   // Bytes let through
+	Packets uint64  `json:"packets"` // Packets let through
+	Dropped uint64  `json:"dropped"` // Packets dropped over the cap
+}
+
+// ConnStatus is the transport of one connection and its runtime knobs
+// (GET and PUT /conn on the admin API)
+type ConnStatus struct {
+	Remote            string        `json:"remote"`
+	SessionID         string        `json:"session_id,omitempty"`
+	Socket            *SocketStatus `json:"socket,omitempty"`              // Kernel figures of the connection's socket
+	SocketError       string        `json:"socket_error,omitempty"`        // Why some socket figures are missing
+	PacingUs          int64         `json:"pacing_us"`                     // Delay between segments or batches written (0 = off)
+	FECParity         int           `json:"fec_parity,omitempty"`          // Parity shards per full FEC group (0 without FEC)
+	FECParityOverride bool          `json:"fec_parity_override,omitempty"` // Set by PUT /conn instead of fec_parity
+	TCP               *TCPState     `json:"tcp,omitempty"`                 // Fake TCP state machine (raw mode)
+}
+
+// TCPState is where the fake TCP handshake or teardown of a raw mode
+// connection stands
+type TCPState struct {
+	Local          string    `json:"local"`
+	Remote         string    `json:"remote"`
+	State          string    `json:"state"`                     // SYN_SENT, SYN_RECEIVED, ESTABLISHED, CLOSE_WAIT, CLOSING or CLOSED
+	Since          time.Time `json:"since"`                     // When State was entered
+	HandshakeMs    float64   `json:"handshake_ms,omitempty"`    // From the first SYN to ESTABLISHED
+	Deadline       time.Time `json:"deadline,omitzero"`         // SYN_SENT: when the SYN is sent again or the dial gives up
+	SYNRetransmits int       `json:"syn_retransmits,omitempty"` // SYNs (client) or SYN-ACKs (server) sent again
+	LastSent       time.Time `json:"last_sent,omitzero"`
+	LastReceived   time.Time `json:"last_received,omitzero"`
+	Reason         string    `json:"reason,omitempty"` // Why it is closing or closed
+}
+
+// SocketStatus are the kernel's figures for a connection's socket. On a
+// server, connections share the listening socket and its figures (Shared).
+type SocketStatus struct {
+	RecvQueued int    `json:"recv_queued"` // Bytes waiting in the receive buffer
+	SendQueued int    `json:"send_queued"` // Bytes not yet sent
+	RecvBuffer int    `json:"recv_buffer"` // Receive buffer size
+	SendBuffer int    `json:"send_buffer"` // Send buffer size
+	Drops      uint64 `json:"drops"`       // Packets dropped on a full receive buffer
+	Shared     bool   `json:"shared,omitempty"`
+}
+
+// BufferStatus describes the buffers of the tunnel's sockets: the connection
+// to the server, or the listeners all clients share
+type BufferStatus struct {
+	Auto      bool   `json:"auto"`       // Sized from the bandwidth-delay product; false when socket_buffer fixes them
+	Recv      int    `json:"recv"`       // Receive buffer asked for in bytes (the kernel reports twice as much)
+	Send      int    `json:"send"`       // Send buffer asked for in bytes
+	RecvLimit int    `json:"recv_limit"` // Largest receive buffer scaling asks for
+	SendLimit int    `json:"send_limit"` // Largest send buffer scaling asks for
+	BDP       int    `json:"bdp"`        // Larger direction's bandwidth-delay product over the last interval, in bytes
+	Overflows uint64 `json:"overflows"`  // Packets dropped on a full receive buffer since the start
+	Resizes   uint64 `json:"resizes"`
+}
+
+// BrokerStatus describes the local programs sharing the tunnel
+type BrokerStatus struct {
+	Socket   string `json:"socket"`            // Unix socket programs connect to
+	Sessions int64  `json:"sessions"`          // Programs connected
+	Streams  int64  `json:"streams"`           // Streams open
+	Refused  uint64 `json:"refused,omitempty"` // Streams whose target could not be connected
+}
+
+// ClockStatus is the offset of the server's clock and the one-way delays
+// measured with it
+type ClockStatus struct {
+	OffsetMs float64 `json:"offset_ms"` // Server clock minus ours
+	UpMs     float64 `json:"up_ms"`     // Delay to the server
+	DownMs   float64 `json:"down_ms"`   // Delay from the server
+	Samples  int     `json:"samples"`   // Replies received since start
+}
+
+// TransformStatus describes the frame transforms registered by the embedding program
+type TransformStatus struct {
+	Names   []string `json:"names"`   // In the order applied to sent frames
+	Dropped uint64   `json:"dropped"` // Frames dropped by a transform
+}
+
+// UnauthStatus counts the packets dropped before their sender authenticated,
+// by class: bad_mac, unknown_session, malformed, not_our_flow, auth_rejected
+type UnauthStatus struct {
+	Drops   map[string]uint64 `json:"drops"`
+	Sources []UnauthSource    `json:"sources"`          // Sources with the most drops, most first
+	Bans    []UnauthBan       `json:"bans,omitempty"`   // Sources firewalled off now
+	Banned  uint64            `json:"banned,omitempty"` // Bans imposed since start
+}
+
+// UnauthSource is one address sending packets that were dropped before authentication
+type UnauthSource struct {
+	Addr     string            `json:"addr"`
+	Drops    map[string]uint64 `json:"drops"`
+	LastSeen time.Time         `json:"last_seen"`
+}
+
+// UnauthBan is a source firewalled off after too many drops
+type UnauthBan struct {
+	Addr  string    `json:"addr"`
+	Until time.Time `json:"until"`
+}
+
+// PortHopStatus describes the port hopping schedule
+type PortHopStatus struct {
+	Range       string    `json:"range"`               // Server ports hopped over
+	IntervalSec int       `json:"interval_sec"`        // Seconds on each port
+	Port        uint16    `json:"port"`                // Server port of the current interval
+	NextHop     time.Time `json:"next_hop"`            // When the current interval ends
+	Hops        uint64    `json:"hops,omitempty"`      // Connections moved to a new port (client)
+	Listening   []uint16  `json:"listening,omitempty"` // Hop ports with an open listener (server)
+}
+
+// DuplicateStatus counts the extra copies of duplicated segments
+type DuplicateStatus struct {
+	Copies  int    `json:"copies"`  // Times each segment is sent (1: not duplicating)
+	Sent    uint64 `json:"sent"`    // Copies sent in addition to the originals
+	Dropped uint64 `json:"dropped"` // Copies received and dropped
+}
+
+// FECStatus counts received FEC groups and their outcome
+type FECStatus struct {
+	ShardsReceived      uint64 `json:"shards_received"`
+	GroupsRecovered     uint64 `json:"groups_recovered"`
+	GroupsUnrecoverable uint64 `json:"groups_unrecoverable"`
+	PacketsRecovered    uint64 `json:"packets_recovered"`
+	LateDrops           uint64 `json:"late_drops"`
+	GapSkips            uint64 `json:"gap_skips"`
+	CorruptShards       uint64 `json:"corrupt_shards"`
+}
+
+// SessionStatus describes one connected client (server mode)
+type SessionStatus struct {
+	TunnelIP      string    `json:"tunnel_ip,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	SessionID     string    `json:"session_id,omitempty"`
+	Identity      string    `json:"identity,omitempty"`
+	Version       string    `json:"version,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	BytesIn       uint64    `json:"bytes_in"`
+	BytesOut      uint64    `json:"bytes_out"`
+	RTTMs         float64   `json:"rtt_ms,omitempty"`
+	SendMTU       int       `json:"send_mtu"`
+	Hibernating   bool      `json:"hibernating,omitempty"`     // Buffers released while idle (hibernate_after)
+	Mirrored      bool      `json:"mirrored,omitempty"`        // Traffic copied to the mirror target (mirror_sessions)
+	ClockOffsetMs float64   `json:"clock_offset_ms,omitempty"` // Client clock minus ours, as the client measured it
+}
+
+// Peers lists the tunnel's peers (GET /peers)
+type Peers struct {
+	Server   string          `json:"server,omitempty"` // Server address (client mode)
+	Sessions []SessionStatus `json:"sessions"`         // Connected clients (server mode)
+	P2P      []P2PPeer       `json:"p2p"`
+}
+
+// P2PPeer is a peer known to the P2P manager (client mode)
+type P2PPeer struct {
+	TunnelIP      string    `json:"tunnel_ip"`
+	PublicAddr    string    `json:"public_addr,omitempty"`
+	LocalAddr     string    `json:"local_addr,omitempty"`
+	NATType       string    `json:"nat_type"`
+	Connected     bool      `json:"connected"`
+	LocalNetwork  bool      `json:"local_network"`
+	ThroughServer bool      `json:"through_server"`
+	LatencyMs     float64   `json:"latency_ms,omitempty"`
+	PacketLoss    float64   `json:"packet_loss"` // 0.0 - 1.0
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// FirewallRule is an iptables rule the tunnel installed and whether it is
+// still in place
+type FirewallRule struct {
+	Rule    string `json:"rule"`
+	Present bool   `json:"present"`
+}
+
+// FirewallGuard is the state of the safety timer of the server's firewall
+// rules, set in Status when firewall_confirm_timeout is, and the response of
+// POST /firewall/confirm
+type FirewallGuard struct {
+	RevertAt  *time.Time `json:"revert_at,omitempty"` // When the rules are removed unless confirmed first
+	Confirmed bool       `json:"confirmed"`
+	Reverted  bool       `json:"reverted"` // Not confirmed in time: the rules were removed
+}
+
+// VersionInfo describes the binary (-v -json)
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// UpdateCheck is the outcome of -check-update and -self-update
+type UpdateCheck struct {
+	CurrentVersion  string `json:"current_version"`
+	LatestVersion   string `json:"latest_version"`
+	UpdateAvailable bool   `json:"update_available"`
+	Asset           string `json:"asset,omitempty"`          // Release binary for this platform
+	Verified        bool   `json:"verified"`                 // Asset signature checked (false without a signing key)
+	InstalledPath   string `json:"installed_path,omitempty"` // Set once -self-update replaced the binary
+}
+
+// GeneratedConfig reports the example configs written by -g
+type GeneratedConfig struct {
+	ServerPath string `json:"server_path"`
+	ClientPath string `json:"client_path"`
+}
+
+// ServiceInstall reports the service written and enabled by -install
+type ServiceInstall struct {
+	Service    string   `json:"service"`
+	Init       string   `json:"init"`        // systemd or procd
+	Path       string   `json:"path"`        // Unit file or init script
+	ConfigPath string   `json:"config_path"` // Configuration file the service runs with
+	StateDir   string   `json:"state_dir"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+// NATReport describes the NAT in front of a host (-nat-report)
+type NATReport struct {
+	Reflector     string  `json:"reflector"`
+	LocalAddr     string  `json:"local_addr"`
+	MappedAddr    string  `json:"mapped_addr"`         // Public address as the reflector saw it
+	Type          string  `json:"type"`                // Classification used for P2P decisions
+	Mapping       string  `json:"mapping,omitempty"`   // none, endpoint_independent or address_and_port_dependent
+	Filtering     string  `json:"filtering,omitempty"` // none, address_dependent or address_and_port_dependent
+	PortPreserved bool    `json:"port_preserved"`
+	Hairpinning   *bool   `json:"hairpinning,omitempty"`
+	LifetimeMin   float64 `json:"mapping_lifetime_min_seconds,omitempty"` // Longest idle period a mapping survived
+	LifetimeMax   float64 `json:"mapping_lifetime_max_seconds,omitempty"` // Shortest idle period after which one was gone
+	HolePunching  string  `json:"hole_punching"`                          // What to expect of P2P hole punching
+}
+
+// Error is returned by the admin API and printed by -json commands that fail
+type Error struct {
+	Error string `json:"error"`
+}
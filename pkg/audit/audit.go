@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types written to the audit log
+const (
+	EventConnect    = "connect"
+	EventAuth       = "auth"
+	EventDisconnect = "disconnect"
+	EventMirror     = "mirror" // The session's traffic is copied to the mirror target
+)
+
+// Record is a single audit log entry, written as one JSON line
+type Record struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	RemoteAddr string    `json:"remote_addr"`
+	Session    string    `json:"session,omitempty"` // Session ID, as prefixed to the server's log lines
+	TunnelIP   string    `json:"tunnel_ip,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	Result     string    `json:"result,omitempty"`       // Authentication outcome (auth events)
+	BytesIn    uint64    `json:"bytes_in,omitempty"`     // Tunnel payload bytes received from the client
+	BytesOut   uint64    `json:"bytes_out,omitempty"`    // Tunnel payload bytes sent to the client
+	Duration   float64   `json:"duration_sec,omitempty"` // Session duration (disconnect events)
+	Reason     string    `json:"reason,omitempty"`       // Disconnect reason
+}
+
+// Logger appends audit records to a file, rotating it once it exceeds maxSize.
+// Rotated files are renamed to path.1 ... path.N (newest first).
+type Logger struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewLogger opens (or creates) the audit log at path in append mode.
+// maxSizeMB <= 0 disables rotation; maxBackups <= 0 keeps no rotated files.
+func NewLogger(path string, maxSizeMB, maxBackups int) (*Logger, error) {
+	l := &Logger{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %v", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Log writes a record. It is safe to call on a nil or closed Logger.
+func (l *Logger) Log(rec Record) {
+	if l == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Audit log: failed to encode record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Audit log: rotation failed: %v", err)
+			if l.file == nil {
+				return
+			}
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Audit log: write failed: %v", err)
+	}
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1 and reopens path. Caller holds mu.
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		log.Printf("Audit log: close before rotation failed: %v", err)
+	}
+	l.file = nil
+
+	if l.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxBackups))
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+			// Keep appending to the current file rather than losing records
+			if openErr := l.open(); openErr != nil {
+				return openErr
+			}
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	return l.open()
+}
+
+// Close flushes and closes the audit log. Subsequent Log calls are dropped.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
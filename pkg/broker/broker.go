@@ -0,0 +1,458 @@
+// Package broker lets several programs on one host share a single tunnel.
+// The daemon that owns the tunnel serves a Unix socket; a program opens a
+// session on it and dials TCP streams through the session, which the daemon
+// connects over the tunnel. All of them leave the host in the daemon's one
+// fake TCP flow, under its one set of firewall rules, and the programs need
+// neither privileges nor their own tunnel:
+//
+//	conn, err := broker.Dial("/run/lightweight-tunnel.sock", "10.0.0.1:8080")
+//
+// Streams are multiplexed on the session in frames:
+//
+//	[type:1][stream:4][length:2][payload]
+//
+// open carries the target address and is answered by opened or refused
+// (with the reason); data carries stream bytes; window grants the sender
+// more credit (4 bytes); close ends the stream in that direction. Each stream
+// may have at most streamWindow bytes in flight, so a stream its program does
+// not read stalls only itself and not the session.
+package broker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	frameOpen byte = iota + 1
+	frameOpened
+	frameRefused
+	frameData
+	frameWindow
+	frameClose
+)
+
+const (
+	frameHeaderLen = 7
+	maxPayload     = 16 << 10
+	streamWindow   = 256 << 10
+	// MaxStreams is the most streams open at once on one session
+	MaxStreams = 1024
+)
+
+var (
+	// ErrClosed is returned on streams of a closed session
+	ErrClosed = errors.New("broker session closed")
+	// ErrRefused wraps the reason the daemon could not connect a stream
+	ErrRefused = errors.New("broker refused stream")
+)
+
+// session multiplexes streams on one Unix socket connection; both ends run one
+type session struct {
+	conn net.Conn
+	wmu  sync.Mutex // Serializes frame writes
+
+	mu      sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+	err     error // Why the session ended (nil while open)
+	done    chan struct{}
+
+	// onOpen handles a stream the peer opened (daemon side; nil refuses)
+	onOpen func(s *stream)
+}
+
+func newSession(conn net.Conn, onOpen func(s *stream)) *session {
+	return &session{
+		conn:    conn,
+		streams: make(map[uint32]*stream),
+		done:    make(chan struct{}),
+		onOpen:  onOpen,
+	}
+}
+
+// writeFrame sends one frame
+func (s *session) writeFrame(typ byte, id uint32, payload []byte) error {
+	var hdr [frameHeaderLen]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], id)
+	binary.BigEndian.PutUint16(hdr[5:], uint16(len(payload)))
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLoop dispatches the peer's frames until the connection fails
+func (s *session) readLoop() {
+	var hdr [frameHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.close(err)
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(hdr[5:]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.close(err)
+			return
+		}
+		if err := s.handle(hdr[0], binary.BigEndian.Uint32(hdr[1:]), payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+// handle processes one frame; an error is a protocol violation
+func (s *session) handle(typ byte, id uint32, payload []byte) error {
+	if typ == frameOpen {
+		if s.onOpen == nil {
+			return fmt.Errorf("unexpected open of stream %d", id)
+		}
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok {
+			s.mu.Unlock()
+			return fmt.Errorf("stream %d opened twice", id)
+		}
+		if len(s.streams) >= MaxStreams {
+			s.mu.Unlock()
+			return s.writeFrame(frameRefused, id, []byte("too many streams"))
+		}
+		st := newStream(s, id, string(payload))
+		s.streams[id] = st
+		s.mu.Unlock()
+		go s.onOpen(st)
+		return nil
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil {
+		return nil // Closed on our side while the frame was in flight
+	}
+	switch typ {
+	case frameOpened:
+		st.answer(nil)
+	case frameRefused:
+		st.answer(fmt.Errorf("%w: %s", ErrRefused, payload))
+		s.remove(id)
+	case frameData:
+		return st.receive(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("bad window update on stream %d", id)
+		}
+		st.grant(int(binary.BigEndian.Uint32(payload)))
+	case frameClose:
+		st.peerClosed()
+	default:
+		return fmt.Errorf("unknown frame type %d", typ)
+	}
+	return nil
+}
+
+// open starts a stream to target (program side)
+func (s *session) open(target string) (*stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if len(s.streams) >= MaxStreams {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: too many streams", ErrRefused)
+	}
+	s.nextID++
+	st := newStream(s, s.nextID, target)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, st.id, []byte(target)); err != nil {
+		s.close(err)
+		return nil, ErrClosed
+	}
+	select {
+	case err := <-st.opened:
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-s.done:
+		return nil, ErrClosed
+	}
+}
+
+// remove forgets a stream that is closed in both directions
+func (s *session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// close ends the session and every stream on it
+func (s *session) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*stream)
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail()
+	}
+}
+
+// stream is one multiplexed connection; it implements net.Conn
+type stream struct {
+	sess   *session
+	id     uint32
+	target string
+	opened chan error // Answer to our open (program side)
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte // Received and not yet read
+	unacked    int    // Bytes read since the last window update
+	credit     int    // Bytes we may still send
+	readEOF    bool   // Peer closed its side
+	closed     bool   // We closed our side
+	failed     bool   // Session ended
+	rdeadline  time.Time
+	wdeadline  time.Time
+	deadlineFn *time.Timer
+}
+
+func newStream(s *session, id uint32, target string) *stream {
+	st := &stream{sess: s, id: id, target: target, opened: make(chan error, 1), credit: streamWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// Target returns the address the stream was opened to
+func (st *stream) Target() string {
+	return st.target
+}
+
+// answer delivers the peer's answer to our open; extra answers are ignored
+func (st *stream) answer(err error) {
+	select {
+	case st.opened <- err:
+	default:
+	}
+}
+
+func (st *stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	if len(st.buf)+len(data) > streamWindow {
+		return fmt.Errorf("stream %d exceeded its window", st.id)
+	}
+	st.buf = append(st.buf, data...)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *stream) grant(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *stream) peerClosed() {
+	st.mu.Lock()
+	st.readEOF = true
+	done := st.closed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+func (st *stream) fail() {
+	st.mu.Lock()
+	st.failed = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	st.answer(ErrClosed)
+}
+
+// expired reports whether deadline has passed; the caller holds st.mu
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 {
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.readEOF:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.failed:
+			st.mu.Unlock()
+			return 0, ErrClosed
+		case expired(st.rdeadline):
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	if len(st.buf) == 0 {
+		st.buf = nil
+	}
+	st.unacked += n
+	var update []byte
+	if st.unacked >= streamWindow/2 && !st.readEOF {
+		update = binary.BigEndian.AppendUint32(nil, uint32(st.unacked))
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+	if update != nil {
+		st.sess.writeFrame(frameWindow, st.id, update)
+	}
+	return n, nil
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		for st.credit == 0 && !st.closed && !st.failed && !st.readEOF && !expired(st.wdeadline) {
+			st.cond.Wait()
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.failed:
+			st.mu.Unlock()
+			return written, ErrClosed
+		case st.readEOF:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case expired(st.wdeadline):
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := min(len(p)-written, st.credit, maxPayload)
+		st.credit -= n
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(frameData, st.id, p[written:written+n]); err != nil {
+			st.sess.close(err)
+			return written, ErrClosed
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close ends the stream; the peer reads EOF
+func (st *stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	done := st.readEOF || st.failed
+	if st.deadlineFn != nil {
+		st.deadlineFn.Stop()
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+	if st.failed {
+		return nil
+	}
+	return st.sess.writeFrame(frameClose, st.id, nil)
+}
+
+func (st *stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *stream) RemoteAddr() net.Addr {
+	return streamAddr(st.target)
+}
+
+func (st *stream) SetDeadline(t time.Time) error {
+	return st.setDeadlines(t, t, true, true)
+}
+
+func (st *stream) SetReadDeadline(t time.Time) error {
+	return st.setDeadlines(t, time.Time{}, true, false)
+}
+
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	return st.setDeadlines(time.Time{}, t, false, true)
+}
+
+func (st *stream) setDeadlines(r, w time.Time, setR, setW bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if setR {
+		st.rdeadline = r
+	}
+	if setW {
+		st.wdeadline = w
+	}
+	// Wake blocked calls when the earliest deadline passes
+	next := st.rdeadline
+	if next.IsZero() || (!st.wdeadline.IsZero() && st.wdeadline.Before(next)) {
+		next = st.wdeadline
+	}
+	if st.deadlineFn != nil {
+		st.deadlineFn.Stop()
+		st.deadlineFn = nil
+	}
+	if !next.IsZero() {
+		st.deadlineFn = time.AfterFunc(time.Until(next), func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+// streamAddr is the target of a stream as a net.Addr
+type streamAddr string
+
+func (a streamAddr) Network() string { return "broker" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStreams runs two streams on one session, one of them moving more than
+// a window while the other is left unread, and checks a refused target
+func TestStreams(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	socket := filepath.Join(t.TempDir(), "broker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Dial: func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, DialTimeout)
+	}}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	sess, err := Open(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// A stream nobody reads fills its window without blocking the other
+	idle, err := sess.Dial(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.Write(bytes.Repeat([]byte{1}, 64<<10))
+
+	conn, err := sess.Dial(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 3*streamWindow)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	go conn.Write(want)
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("echoed data differs")
+	}
+	conn.Close()
+	idle.Close()
+
+	if _, err := sess.Dial("127.0.0.1:1"); !errors.Is(err, ErrRefused) {
+		t.Fatalf("dial to a closed port: %v, want ErrRefused", err)
+	}
+	if n := srv.Stats().Refused; n != 1 {
+		t.Errorf("refused %d, want 1", n)
+	}
+}
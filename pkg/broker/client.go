@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"net"
+)
+
+// Session is a program's connection to the broker, carrying any number of
+// streams
+type Session struct {
+	s *session
+}
+
+// Open connects to the broker listening on socket
+func Open(socket string) (*Session, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(conn, nil)
+	go s.readLoop()
+	return &Session{s: s}, nil
+}
+
+// Dial opens a TCP stream to target (host:port) through the tunnel
+func (c *Session) Dial(target string) (net.Conn, error) {
+	st, err := c.s.open(target)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close ends the session and all of its streams
+func (c *Session) Close() error {
+	c.s.close(ErrClosed)
+	return nil
+}
+
+// Dial opens a session on the broker listening on socket and one TCP stream
+// through it to target; closing the stream closes the session
+func Dial(socket, target string) (net.Conn, error) {
+	c, err := Open(socket)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.Dial(target)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &soleStream{Conn: conn, session: c}, nil
+}
+
+// soleStream is the only stream of a session opened by Dial
+type soleStream struct {
+	net.Conn
+	session *Session
+}
+
+func (s *soleStream) Close() error {
+	err := s.Conn.Close()
+	s.session.Close()
+	return err
+}
@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialTimeout bounds how long the daemon tries to connect a stream
+const DialTimeout = 10 * time.Second
+
+// Server is the daemon side of the broker
+type Server struct {
+	// Dial connects a stream's target, e.g. through the tunnel device
+	Dial func(network, address string) (net.Conn, error)
+
+	mu       sync.Mutex
+	ln       net.Listener
+	sessions map[*session]struct{}
+
+	sessionCount atomic.Int64
+	streamCount  atomic.Int64
+	refused      atomic.Uint64
+}
+
+// Stats are the server's counters
+type Stats struct {
+	Sessions int64  // Programs connected now
+	Streams  int64  // Streams open now
+	Refused  uint64 // Streams whose target could not be connected
+}
+
+// Stats returns the server's counters
+func (srv *Server) Stats() Stats {
+	return Stats{
+		Sessions: srv.sessionCount.Load(),
+		Streams:  srv.streamCount.Load(),
+		Refused:  srv.refused.Load(),
+	}
+}
+
+// Serve accepts sessions on ln until Close
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	srv.ln = ln
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	srv.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		s := newSession(conn, srv.serveStream)
+		srv.mu.Lock()
+		srv.sessions[s] = struct{}{}
+		srv.mu.Unlock()
+		srv.sessionCount.Add(1)
+		go func() {
+			s.readLoop()
+			srv.mu.Lock()
+			delete(srv.sessions, s)
+			srv.mu.Unlock()
+			srv.sessionCount.Add(-1)
+		}()
+	}
+}
+
+// Close stops accepting and ends every session
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	ln := srv.ln
+	sessions := srv.sessions
+	srv.sessions = nil
+	srv.mu.Unlock()
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	for s := range sessions {
+		s.close(ErrClosed)
+	}
+	return err
+}
+
+// serveStream connects a stream a program opened and copies between the two
+func (srv *Server) serveStream(st *stream) {
+	target, err := srv.Dial("tcp", st.target)
+	if err != nil {
+		srv.refused.Add(1)
+		st.sess.remove(st.id)
+		st.sess.writeFrame(frameRefused, st.id, []byte(err.Error()))
+		return
+	}
+	if err := st.sess.writeFrame(frameOpened, st.id, nil); err != nil {
+		target.Close()
+		st.sess.close(err)
+		return
+	}
+	srv.streamCount.Add(1)
+	defer srv.streamCount.Add(-1)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(st, target)
+		st.Close()
+		close(done)
+	}()
+	io.Copy(target, st)
+	// The program closed the stream, or the session ended
+	target.Close()
+	<-done
+}
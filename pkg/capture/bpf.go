@@ -0,0 +1,120 @@
+package capture
+
+import "encoding/binary"
+
+// Classic BPF opcodes (linux/filter.h), limited to what the filter compiler emits
+const (
+	bpfLD   = 0x00
+	bpfLDX  = 0x01
+	bpfALU  = 0x04
+	bpfJMP  = 0x05
+	bpfRET  = 0x06
+	bpfW    = 0x00
+	bpfH    = 0x08
+	bpfB    = 0x10
+	bpfABS  = 0x20
+	bpfIND  = 0x40
+	bpfLEN  = 0x80
+	bpfMSH  = 0xa0
+	bpfAND  = 0x50
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJGE  = 0x30
+	bpfJSET = 0x40
+	bpfK    = 0x00
+)
+
+// Instruction is one classic BPF instruction, laid out like struct sock_filter
+// so a Program can also be attached to a socket with SO_ATTACH_FILTER
+type Instruction struct {
+	Op uint16
+	Jt uint8
+	Jf uint8
+	K  uint32
+}
+
+// Program is a compiled filter. Packets start at the IPv4 header
+// (LINKTYPE_RAW); Run returns the number of bytes to keep, 0 to drop.
+type Program []Instruction
+
+// Matches reports whether the program accepts pkt
+func (p Program) Matches(pkt []byte) bool {
+	return p.Run(pkt) > 0
+}
+
+// Run executes the program on pkt like the kernel would: a load beyond the
+// end of the packet rejects it
+func (p Program) Run(pkt []byte) uint32 {
+	var a, x uint32
+	for pc := 0; pc < len(p); pc++ {
+		ins := p[pc]
+		switch ins.Op {
+		case bpfLD | bpfW | bpfABS, bpfLD | bpfH | bpfABS, bpfLD | bpfB | bpfABS:
+			v, ok := load(pkt, ins.Op&0x18, ins.K)
+			if !ok {
+				return 0
+			}
+			a = v
+		case bpfLD | bpfW | bpfIND, bpfLD | bpfH | bpfIND, bpfLD | bpfB | bpfIND:
+			v, ok := load(pkt, ins.Op&0x18, x+ins.K)
+			if !ok {
+				return 0
+			}
+			a = v
+		case bpfLD | bpfW | bpfLEN:
+			a = uint32(len(pkt))
+		case bpfLDX | bpfB | bpfMSH:
+			if int(ins.K) >= len(pkt) {
+				return 0
+			}
+			x = 4 * uint32(pkt[ins.K]&0x0f)
+		case bpfALU | bpfAND | bpfK:
+			a &= ins.K
+		case bpfJMP | bpfJA:
+			pc += int(ins.K)
+		case bpfJMP | bpfJEQ | bpfK:
+			pc += jump(a == ins.K, ins)
+		case bpfJMP | bpfJGT | bpfK:
+			pc += jump(a > ins.K, ins)
+		case bpfJMP | bpfJGE | bpfK:
+			pc += jump(a >= ins.K, ins)
+		case bpfJMP | bpfJSET | bpfK:
+			pc += jump(a&ins.K != 0, ins)
+		case bpfRET | bpfK:
+			return ins.K
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+func load(pkt []byte, size uint16, off uint32) (uint32, bool) {
+	end := uint64(off)
+	switch size {
+	case bpfW:
+		end += 4
+	case bpfH:
+		end += 2
+	default:
+		end++
+	}
+	if end > uint64(len(pkt)) {
+		return 0, false
+	}
+	switch size {
+	case bpfW:
+		return binary.BigEndian.Uint32(pkt[off:]), true
+	case bpfH:
+		return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+	}
+	return uint32(pkt[off]), true
+}
+
+func jump(cond bool, ins Instruction) int {
+	if cond {
+		return int(ins.Jt)
+	}
+	return int(ins.Jf)
+}
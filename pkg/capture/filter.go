@@ -0,0 +1,656 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Compile translates a tcpdump/pcap-filter expression into a classic BPF
+// program for IPv4 packets without a link-layer header. The supported subset:
+//
+//	ip | tcp | udp | icmp | ip proto <tcp|udp|icmp|N>
+//	[src|dst|src or dst|src and dst] host <addr>
+//	[src|dst|...] net <cidr> | net <addr> mask <mask>
+//	[tcp|udp] [src|dst|...] port <N> | portrange <N-M>
+//	less <N> | greater <N> | len <relop> <N>
+//	<ip|tcp|udp|icmp>[<off>[:<1|2|4>]] [& <mask>] <relop> <value>
+//
+// combined with and/&&, or/||, not/! and parentheses. Values may be numbers
+// or the usual names (tcpflags, tcp-syn, tcp-ack, icmptype, icmp-echo, ...),
+// joined with |. An empty expression matches every packet.
+func Compile(expr string) (Program, error) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	g := &codegen{}
+	accept, reject := g.newLabel(), g.newLabel()
+	if len(toks) == 0 {
+		g.emit(bpfRET|bpfK, snapLen)
+		return g.prog, nil
+	}
+	p := &parser{toks: toks}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	c(g, accept, reject)
+	g.place(accept)
+	g.emit(bpfRET|bpfK, snapLen)
+	g.place(reject)
+	g.emit(bpfRET|bpfK, 0)
+	return g.finish()
+}
+
+// snapLen is what an accepting program returns: keep the whole packet
+const snapLen = 0x40000
+
+// cond emits code that jumps to label t when it holds and to f otherwise
+type cond func(g *codegen, t, f int)
+
+// codegen collects instructions whose jump targets are labels until finish
+// turns them into the relative offsets BPF uses
+type codegen struct {
+	prog   Program
+	labels []int
+	fixups []fixup
+}
+
+type fixup struct {
+	pc     int
+	jt, jf int // Labels, or -1 for the next instruction
+}
+
+func (g *codegen) newLabel() int {
+	g.labels = append(g.labels, -1)
+	return len(g.labels) - 1
+}
+
+func (g *codegen) place(label int) {
+	g.labels[label] = len(g.prog)
+}
+
+func (g *codegen) emit(op uint16, k uint32) {
+	g.prog = append(g.prog, Instruction{Op: op, K: k})
+}
+
+// jump emits a conditional jump; -1 continues with the next instruction
+func (g *codegen) jump(op uint16, k uint32, t, f int) {
+	g.fixups = append(g.fixups, fixup{pc: len(g.prog), jt: t, jf: f})
+	g.emit(bpfJMP|op|bpfK, k)
+}
+
+func (g *codegen) finish() (Program, error) {
+	offset := func(pc, label int) (int, error) {
+		if label < 0 {
+			return 0, nil
+		}
+		off := g.labels[label] - pc - 1
+		if off < 0 {
+			return 0, fmt.Errorf("internal error: backward jump")
+		}
+		return off, nil
+	}
+	for _, fx := range g.fixups {
+		jt, err := offset(fx.pc, fx.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(fx.pc, fx.jf)
+		if err != nil {
+			return nil, err
+		}
+		if jt > 255 || jf > 255 {
+			return nil, fmt.Errorf("filter expression too large")
+		}
+		g.prog[fx.pc].Jt, g.prog[fx.pc].Jf = uint8(jt), uint8(jf)
+	}
+	return g.prog, nil
+}
+
+// Header layout of the fields the primitives test
+const (
+	ipProtoOffset = 9
+	ipFragOffset  = 6
+	ipSrcOffset   = 12
+	ipDstOffset   = 16
+	protoICMP     = 1
+	protoTCP      = 6
+	protoUDP      = 17
+)
+
+// ipv4 falls through for IPv4 packets and jumps to f otherwise
+func ipv4(g *codegen, f int) {
+	g.emit(bpfLD|bpfB|bpfABS, 0)
+	g.emit(bpfALU|bpfAND|bpfK, 0xf0)
+	g.jump(bpfJEQ, 0x40, -1, f)
+}
+
+// transport falls through for an unfragmented or first-fragment IPv4 packet
+// of one of protos, with X pointing at the transport header
+func transport(g *codegen, protos []uint32, f int) {
+	ipv4(g, f)
+	g.emit(bpfLD|bpfB|bpfABS, ipProtoOffset)
+	if len(protos) > 0 {
+		ok := g.newLabel()
+		for i, proto := range protos {
+			if i == len(protos)-1 {
+				g.jump(bpfJEQ, proto, -1, f)
+			} else {
+				g.jump(bpfJEQ, proto, ok, -1)
+			}
+		}
+		g.place(ok)
+	}
+	g.emit(bpfLD|bpfH|bpfABS, ipFragOffset)
+	g.jump(bpfJSET, 0x1fff, f, -1)
+	g.emit(bpfLDX|bpfB|bpfMSH, 0)
+}
+
+// compare jumps on A relop k
+func compare(g *codegen, relop string, k uint32, t, f int) {
+	switch relop {
+	case "==", "=":
+		g.jump(bpfJEQ, k, t, f)
+	case "!=":
+		g.jump(bpfJEQ, k, f, t)
+	case ">":
+		g.jump(bpfJGT, k, t, f)
+	case ">=":
+		g.jump(bpfJGE, k, t, f)
+	case "<":
+		g.jump(bpfJGE, k, f, t)
+	case "<=":
+		g.jump(bpfJGT, k, f, t)
+	}
+}
+
+// direction is a src/dst qualifier
+type direction int
+
+const (
+	dirSrcOrDst direction = iota
+	dirSrc
+	dirDst
+	dirSrcAndDst
+)
+
+// either tests the source field and the destination field as dir asks;
+// test emits the comparison for one of them
+func either(g *codegen, dir direction, t, f int, test func(dst bool, t, f int)) {
+	switch dir {
+	case dirSrc:
+		test(false, t, f)
+	case dirDst:
+		test(true, t, f)
+	case dirSrcAndDst:
+		next := g.newLabel()
+		test(false, next, f)
+		g.place(next)
+		test(true, t, f)
+	default:
+		next := g.newLabel()
+		test(false, t, next)
+		g.place(next)
+		test(true, t, f)
+	}
+}
+
+type parser struct {
+	toks []string
+	pos  int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		if got == "" {
+			got = "end of expression"
+		}
+		return fmt.Errorf("expected %q, found %q", tok, got)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (cond, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(g *codegen, t, f int) {
+			next := g.newLabel()
+			a(g, t, next)
+			g.place(next)
+			b(g, t, f)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (cond, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(g *codegen, t, f int) {
+			next := g.newLabel()
+			a(g, next, f)
+			g.place(next)
+			b(g, t, f)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (cond, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(g *codegen, t, f int) { c(g, f, t) }, nil
+	case "(":
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+	return p.parsePrimitive()
+}
+
+var protoNumbers = map[string]uint32{"icmp": protoICMP, "tcp": protoTCP, "udp": protoUDP}
+
+func (p *parser) parsePrimitive() (cond, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "less", "greater":
+		n, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		relop := "<="
+		if tok == "greater" {
+			relop = ">="
+		}
+		return lengthCond(relop, n), nil
+	case "len":
+		relop := p.next()
+		if !isRelop(relop) {
+			return nil, fmt.Errorf("expected comparison after len, found %q", relop)
+		}
+		n, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return lengthCond(relop, n), nil
+	}
+
+	// [proto] [dir] type value, a bare protocol, or proto[off] relop value
+	var protos []uint32
+	proto := ""
+	if tok == "ip" || protoNumbers[tok] != 0 {
+		proto = tok
+		switch p.peek() {
+		case "[":
+			return p.parseRelation(proto)
+		case "proto":
+			if proto == "ip" {
+				p.next()
+				return p.parseIPProto()
+			}
+		case "src", "dst", "host", "net", "port", "portrange":
+		default:
+			return protoCond(proto), nil
+		}
+		if proto != "ip" {
+			protos = []uint32{protoNumbers[proto]}
+		}
+		tok = p.next()
+	}
+
+	dir := dirSrcOrDst
+	if tok == "src" || tok == "dst" {
+		dir = dirSrc
+		if tok == "dst" {
+			dir = dirDst
+		}
+		// "src or dst" and "src and dst" qualify a single primitive
+		if (p.peek() == "or" || p.peek() == "and") && p.pos+1 < len(p.toks) &&
+			(p.toks[p.pos+1] == "src" || p.toks[p.pos+1] == "dst") && p.toks[p.pos+1] != tok {
+			if p.next() == "and" {
+				dir = dirSrcAndDst
+			} else {
+				dir = dirSrcOrDst
+			}
+			p.next()
+		}
+		tok = p.next()
+	}
+
+	switch tok {
+	case "host":
+		return p.parseHost(dir)
+	case "net":
+		return p.parseNet(dir)
+	case "port", "portrange":
+		if proto == "icmp" {
+			return nil, fmt.Errorf("icmp has no ports")
+		}
+		if len(protos) == 0 {
+			protos = []uint32{protoTCP, protoUDP}
+		}
+		return p.parsePort(tok == "portrange", dir, protos)
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unsupported filter primitive %q", tok)
+}
+
+func protoCond(proto string) cond {
+	if proto == "ip" {
+		return func(g *codegen, t, f int) {
+			g.emit(bpfLD|bpfB|bpfABS, 0)
+			g.emit(bpfALU|bpfAND|bpfK, 0xf0)
+			g.jump(bpfJEQ, 0x40, t, f)
+		}
+	}
+	return ipProtoCond(protoNumbers[proto])
+}
+
+func ipProtoCond(proto uint32) cond {
+	return func(g *codegen, t, f int) {
+		ipv4(g, f)
+		g.emit(bpfLD|bpfB|bpfABS, ipProtoOffset)
+		g.jump(bpfJEQ, proto, t, f)
+	}
+}
+
+func lengthCond(relop string, n uint32) cond {
+	return func(g *codegen, t, f int) {
+		g.emit(bpfLD|bpfW|bpfLEN, 0)
+		compare(g, relop, n, t, f)
+	}
+}
+
+func (p *parser) parseIPProto() (cond, error) {
+	tok := p.next()
+	if n, ok := protoNumbers[tok]; ok {
+		return ipProtoCond(n), nil
+	}
+	n, err := strconv.ParseUint(tok, 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol %q", tok)
+	}
+	return ipProtoCond(uint32(n)), nil
+}
+
+func (p *parser) parseHost(dir direction) (cond, error) {
+	tok := p.next()
+	ip := net.ParseIP(tok).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 host %q", tok)
+	}
+	return netCond(dir, binary.BigEndian.Uint32(ip), 0xffffffff), nil
+}
+
+func (p *parser) parseNet(dir direction) (cond, error) {
+	tok := p.next()
+	var addr, mask uint32
+	if strings.Contains(tok, "/") {
+		_, ipnet, err := net.ParseCIDR(tok)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 network %q", tok)
+		}
+		addr = binary.BigEndian.Uint32(ipnet.IP.To4())
+		mask = binary.BigEndian.Uint32(ipnet.Mask)
+	} else {
+		ip := net.ParseIP(tok).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 network %q", tok)
+		}
+		if err := p.expect("mask"); err != nil {
+			return nil, err
+		}
+		m := net.ParseIP(p.next()).To4()
+		if m == nil {
+			return nil, fmt.Errorf("invalid network mask")
+		}
+		mask = binary.BigEndian.Uint32(m)
+		addr = binary.BigEndian.Uint32(ip) & mask
+	}
+	return netCond(dir, addr, mask), nil
+}
+
+func netCond(dir direction, addr, mask uint32) cond {
+	return func(g *codegen, t, f int) {
+		ipv4(g, f)
+		either(g, dir, t, f, func(dst bool, t, f int) {
+			off := uint32(ipSrcOffset)
+			if dst {
+				off = ipDstOffset
+			}
+			g.emit(bpfLD|bpfW|bpfABS, off)
+			if mask != 0xffffffff {
+				g.emit(bpfALU|bpfAND|bpfK, mask)
+			}
+			g.jump(bpfJEQ, addr, t, f)
+		})
+	}
+}
+
+func (p *parser) parsePort(isRange bool, dir direction, protos []uint32) (cond, error) {
+	tok := p.next()
+	lo, hi := tok, tok
+	if isRange {
+		var ok bool
+		if lo, hi, ok = strings.Cut(tok, "-"); !ok {
+			return nil, fmt.Errorf("invalid port range %q", tok)
+		}
+	}
+	first, err1 := strconv.ParseUint(lo, 10, 16)
+	last, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || first > last {
+		return nil, fmt.Errorf("invalid port %q", tok)
+	}
+	return func(g *codegen, t, f int) {
+		transport(g, protos, f)
+		either(g, dir, t, f, func(dst bool, t, f int) {
+			off := uint32(0)
+			if dst {
+				off = 2
+			}
+			g.emit(bpfLD|bpfH|bpfIND, off)
+			if first == last {
+				g.jump(bpfJEQ, uint32(first), t, f)
+				return
+			}
+			g.jump(bpfJGE, uint32(first), -1, f)
+			g.jump(bpfJGT, uint32(last), f, t)
+		})
+	}, nil
+}
+
+// parseRelation parses proto[off:size] [& mask] relop value
+func (p *parser) parseRelation(proto string) (cond, error) {
+	p.next() // [
+	off, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	size := uint32(1)
+	if p.peek() == ":" {
+		p.next()
+		if size, err = p.parseValue(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	op := map[uint32]uint16{1: bpfB, 2: bpfH, 4: bpfW}[size]
+	if size != 1 && op == 0 {
+		return nil, fmt.Errorf("field size must be 1, 2 or 4, not %d", size)
+	}
+	mask := uint32(0xffffffff)
+	if p.peek() == "&" {
+		p.next()
+		if mask, err = p.parseValue(); err != nil {
+			return nil, err
+		}
+	}
+	relop := p.next()
+	if !isRelop(relop) {
+		return nil, fmt.Errorf("expected comparison, found %q", relop)
+	}
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return func(g *codegen, t, f int) {
+		if proto == "ip" {
+			ipv4(g, f)
+			g.emit(bpfLD|op|bpfABS, off)
+		} else {
+			transport(g, []uint32{protoNumbers[proto]}, f)
+			g.emit(bpfLD|op|bpfIND, off)
+		}
+		if mask != 0xffffffff {
+			g.emit(bpfALU|bpfAND|bpfK, mask)
+		}
+		compare(g, relop, value, t, f)
+	}, nil
+}
+
+func isRelop(tok string) bool {
+	switch tok {
+	case "==", "=", "!=", ">", ">=", "<", "<=":
+		return true
+	}
+	return false
+}
+
+var namedValues = map[string]uint32{
+	"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+	"tcp-ack": 0x10, "tcp-urg": 0x20, "tcp-ece": 0x40, "tcp-cwr": 0x80,
+	"icmptype": 0, "icmpcode": 1, "icmp-echoreply": 0, "icmp-unreach": 3,
+	"icmp-sourcequench": 4, "icmp-redirect": 5, "icmp-echo": 8, "icmp-timxceed": 11,
+}
+
+// parseValue parses a number, a named constant, a parenthesized value or
+// several of them joined with |
+func (p *parser) parseValue() (uint32, error) {
+	var v uint32
+	for {
+		tok := p.next()
+		var n uint32
+		switch {
+		case tok == "(":
+			inner, err := p.parseValue()
+			if err != nil {
+				return 0, err
+			}
+			if err := p.expect(")"); err != nil {
+				return 0, err
+			}
+			n = inner
+		default:
+			if named, ok := namedValues[tok]; ok {
+				n = named
+				break
+			}
+			parsed, err := strconv.ParseUint(tok, 0, 32)
+			if err != nil {
+				if tok == "" {
+					tok = "end of expression"
+				}
+				return 0, fmt.Errorf("expected a value, found %q", tok)
+			}
+			n = uint32(parsed)
+		}
+		v |= n
+		if p.peek() != "|" {
+			return v, nil
+		}
+		p.next()
+	}
+}
+
+// tokenize splits an expression into words and operators
+func tokenize(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("()[]:", c) >= 0:
+			toks = append(toks, string(c))
+			i++
+		case strings.IndexByte("&|!=<>", c) >= 0:
+			op := string(c)
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "&&", "||", "==", "!=", ">=", "<=":
+					op = two
+				}
+			}
+			toks = append(toks, op)
+			i += len(op)
+		case isWordByte(c):
+			j := i
+			for j < len(expr) && isWordByte(expr[j]) {
+				j++
+			}
+			toks = append(toks, strings.ToLower(expr[i:j]))
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '.' || c == '-' || c == '_' || c == '/'
+}
@@ -0,0 +1,114 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// packet builds an IPv4 packet with a 20-byte header followed by a minimal
+// TCP, UDP or ICMP header
+func packet(proto byte, src, dst string, sport, dport uint16, tcpFlags byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[9] = proto
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[20:], sport)
+	binary.BigEndian.PutUint16(pkt[22:], dport)
+	pkt[20+13] = tcpFlags
+	return pkt
+}
+
+// TestCompileMatches checks filter expressions against hand-built packets
+func TestCompileMatches(t *testing.T) {
+	syn := packet(protoTCP, "1.2.3.4", "10.0.0.1", 40000, 443, 0x02)
+	ack := packet(protoTCP, "10.0.0.1", "1.2.3.4", 443, 40000, 0x10)
+	dns := packet(protoUDP, "10.0.0.2", "8.8.8.8", 5353, 53, 0)
+	ping := packet(protoICMP, "10.0.0.2", "8.8.8.8", 0x0800, 0, 0)
+	frag := packet(protoTCP, "1.2.3.4", "10.0.0.1", 40000, 443, 0x02)
+	binary.BigEndian.PutUint16(frag[6:], 0x0010) // Non-first fragment: no ports
+	ipv6 := append([]byte{0x60}, syn[1:]...)
+
+	tests := []struct {
+		expr string
+		pkt  []byte
+		want bool
+	}{
+		{"", syn, true},
+		{"tcp", syn, true},
+		{"tcp", dns, false},
+		{"udp port 53", dns, true},
+		{"port 53", dns, true},
+		{"tcp port 53", dns, false},
+		{"host 1.2.3.4", syn, true},
+		{"host 1.2.3.4", ack, true},
+		{"src host 1.2.3.4", ack, false},
+		{"dst host 1.2.3.4", ack, true},
+		{"src or dst host 8.8.8.8", dns, true},
+		{"src and dst host 8.8.8.8", dns, false},
+		{"net 10.0.0.0/8", dns, true},
+		{"src net 10.0.0.0 mask 255.0.0.0", syn, false},
+		{"dst port 443", syn, true},
+		{"src port 443", syn, false},
+		{"portrange 400-500", syn, true},
+		{"portrange 400-442", syn, false},
+		{"port 443", frag, false},
+		{"tcp[tcpflags] & tcp-syn != 0", syn, true},
+		{"tcp[tcpflags] & tcp-syn != 0", ack, false},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-ack", ack, true},
+		{"tcp[13] = 2", syn, true},
+		{"tcp[2:2] >= 443", syn, true},
+		{"tcp[2:2] < 443", syn, false},
+		{"icmp[icmptype] == icmp-echo", ping, true},
+		{"icmp", syn, false},
+		{"ip proto udp", dns, true},
+		{"ip proto 6", dns, false},
+		{"ip[9] == 17", dns, true},
+		{"not tcp", dns, true},
+		{"! tcp", syn, false},
+		{"host 1.2.3.4 and not port 22", syn, true},
+		{"(udp or icmp) and dst host 8.8.8.8", ping, true},
+		{"udp && dst host 8.8.8.8 || tcp", syn, true},
+		{"less 40", syn, true},
+		{"greater 41", syn, false},
+		{"len > 39", syn, true},
+		{"ip", ipv6, false},
+		{"tcp", ipv6, false},
+	}
+	for _, tt := range tests {
+		prog, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := prog.Matches(tt.pkt); got != tt.want {
+			t.Errorf("%q matched = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestCompileErrors checks that malformed expressions are rejected
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and", "host", "host 1.2.3", "port x", "portrange 5-1", "icmp port 1",
+		"tcp[13", "tcp[0:3] == 1", "(tcp", "tcp)", "ether host 1", "len 5", "tcp $",
+	} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("Compile(%q) succeeded", expr)
+		}
+	}
+}
+
+// TestTruncatedPacket checks that loads past the end reject the packet
+func TestTruncatedPacket(t *testing.T) {
+	prog, err := Compile("tcp port 443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := packet(protoTCP, "1.2.3.4", "10.0.0.1", 40000, 443, 0)
+	if prog.Matches(pkt[:21]) {
+		t.Fatal("truncated packet matched")
+	}
+}
@@ -0,0 +1,49 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// linkTypeRaw marks pcap records that start at the IP header
+const linkTypeRaw = 101
+
+// Writer writes packets in the classic pcap format read by tcpdump -r and
+// Wireshark
+type Writer struct {
+	w       io.Writer
+	snapLen int
+	hdr     [16]byte
+}
+
+// NewWriter writes the pcap file header to w
+func NewWriter(w io.Writer, snapLen int) (*Writer, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(snapLen))
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, snapLen: snapLen}, nil
+}
+
+// WritePacket appends one record; data may be shorter than the original
+// length when the capture truncated it
+func (w *Writer) WritePacket(ts time.Time, data []byte, length int) error {
+	if len(data) > w.snapLen {
+		data = data[:w.snapLen]
+	}
+	binary.LittleEndian.PutUint32(w.hdr[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(w.hdr[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(w.hdr[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(w.hdr[12:], uint32(length))
+	if _, err := w.w.Write(w.hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
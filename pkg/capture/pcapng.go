@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and options used by PcapngWriter
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterfaceDesc  = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	optEndOfOpt = 0
+	optIfName   = 2
+	optTSResol  = 9
+	optEPBFlags = 2
+
+	epbInbound  = 1
+	epbOutbound = 2
+)
+
+// PcapngWriter writes packets as pcapng, which unlike classic pcap records
+// whether each packet was sent or received. Timestamps have nanosecond
+// resolution.
+type PcapngWriter struct {
+	w       io.Writer
+	snapLen int
+	buf     []byte
+}
+
+// NewPcapngWriter writes the section header and one interface description
+// (raw IP, named name) to w
+func NewPcapngWriter(w io.Writer, name string, snapLen int) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w, snapLen: snapLen}
+
+	b := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, ^uint64(0)) // Section length unknown
+	if err := pw.writeBlock(pcapngSectionHeader, b); err != nil {
+		return nil, err
+	}
+
+	b = binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(snapLen))
+	if name != "" {
+		b = appendOption(b, optIfName, []byte(name))
+	}
+	b = appendOption(b, optTSResol, []byte{9})
+	b = appendOption(b, optEndOfOpt, nil)
+	if err := pw.writeBlock(pcapngInterfaceDesc, b); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WritePacket appends an enhanced packet block; data may be shorter than the
+// original length when it was truncated
+func (pw *PcapngWriter) WritePacket(ts time.Time, data []byte, length int, outbound bool) error {
+	if len(data) > pw.snapLen {
+		data = data[:pw.snapLen]
+	}
+	flags := uint32(epbInbound)
+	if outbound {
+		flags = epbOutbound
+	}
+	nanos := uint64(ts.UnixNano())
+
+	b := binary.LittleEndian.AppendUint32(pw.buf[:0], 0) // Interface 0
+	b = binary.LittleEndian.AppendUint32(b, uint32(nanos>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(nanos))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	b = append(b, data...)
+	b = append(b, make([]byte, pad4(len(data)))...)
+	b = appendOption(b, optEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	b = appendOption(b, optEndOfOpt, nil)
+	pw.buf = b
+	return pw.writeBlock(pcapngEnhancedPacket, b)
+}
+
+// writeBlock writes body framed by the block type and the total length,
+// which pcapng repeats at the end
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	var hdr [8]byte
+	total := uint32(12 + len(body))
+	binary.LittleEndian.PutUint32(hdr[0:], blockType)
+	binary.LittleEndian.PutUint32(hdr[4:], total)
+	if _, err := pw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := pw.w.Write(body); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(hdr[4:8])
+	return err
+}
+
+// appendOption appends a pcapng option padded to 32 bits
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
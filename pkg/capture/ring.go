@@ -0,0 +1,143 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Ring keeps the last seconds of one connection's segments in memory so they
+// can be written out after something went wrong. Without payload only the IP
+// and TCP headers are kept. A nil *Ring records nothing.
+type Ring struct {
+	mu      sync.Mutex
+	span    time.Duration
+	payload bool
+	records []Record
+	next    int // Slot written next
+	count   int
+}
+
+// Record is one packet kept by a ring
+type Record struct {
+	Packet
+	Outbound bool
+}
+
+// NewRing keeps up to max packets of the last span, each truncated to the IP
+// and TCP headers unless payload is set
+func NewRing(span time.Duration, max int, payload bool) *Ring {
+	return &Ring{span: span, payload: payload, records: make([]Record, max)}
+}
+
+// Add records an IPv4 packet; pkt may be followed by unused buffer space
+func (r *Ring) Add(outbound bool, pkt []byte) {
+	if r == nil || len(pkt) < 20 {
+		return
+	}
+	if n := int(binary.BigEndian.Uint16(pkt[2:4])); n >= 20 && n <= len(pkt) {
+		pkt = pkt[:n]
+	}
+	keep := len(pkt)
+	if !r.payload {
+		keep = min(keep, headersLen(pkt))
+	}
+
+	r.mu.Lock()
+	rec := r.slot(outbound, len(pkt))
+	rec.Data = append(rec.Data, pkt[:keep]...)
+	r.mu.Unlock()
+}
+
+// AddTCP records a TCP segment behind a synthesized IPv4 header, for segments
+// that have none (UDP mode) or whose header the kernel side builds (raw sends)
+func (r *Ring) AddTCP(outbound bool, src, dst net.IP, tcpHeader, payload []byte) {
+	if r == nil {
+		return
+	}
+	length := 20 + len(tcpHeader) + len(payload)
+	if !r.payload {
+		payload = nil
+	}
+
+	r.mu.Lock()
+	rec := r.slot(outbound, length)
+	var ip [20]byte
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(length))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:]))
+	rec.Data = append(append(append(rec.Data, ip[:]...), tcpHeader...), payload...)
+	r.mu.Unlock()
+}
+
+// slot returns the emptied record to fill next, reusing its buffer; r.mu is held
+func (r *Ring) slot(outbound bool, length int) *Record {
+	rec := &r.records[r.next]
+	r.next = (r.next + 1) % len(r.records)
+	r.count = min(r.count+1, len(r.records))
+	rec.Time = time.Now()
+	rec.Outbound = outbound
+	rec.Length = length
+	rec.Data = rec.Data[:0]
+	return rec
+}
+
+// Records returns copies of the packets of the last span, oldest first
+func (r *Ring) Records() []Record {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := time.Now().Add(-r.span)
+	out := make([]Record, 0, r.count)
+	for i := 0; i < r.count; i++ {
+		rec := r.records[(r.next-r.count+i+len(r.records))%len(r.records)]
+		if rec.Time.Before(cutoff) {
+			continue
+		}
+		rec.Data = append([]byte(nil), rec.Data...)
+		out = append(out, rec)
+	}
+	return out
+}
+
+// Dump writes the ring's packets as pcapng, on an interface named name
+func (r *Ring) Dump(w io.Writer, name string) error {
+	pw, err := NewPcapngWriter(w, name, 65535)
+	if err != nil {
+		return err
+	}
+	for _, rec := range r.Records() {
+		if err := pw.WritePacket(rec.Time, rec.Data, rec.Length, rec.Outbound); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headersLen is the length of the IP header plus the TCP header, if any
+func headersLen(pkt []byte) int {
+	ihl := int(pkt[0]&0x0F) * 4
+	if pkt[9] != 6 || len(pkt) < ihl+13 {
+		return ihl
+	}
+	return ihl + int(pkt[ihl+12]>>4)*4
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,117 @@
+// Package capture mirrors packets passing through the tunnel to on-demand
+// captures, selected with tcpdump-style filter expressions and written as
+// pcap.
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The taps are process-wide so the transports can feed them without being
+// handed a reference. Each costs one atomic load per packet while no capture
+// is running.
+var (
+	// Outer sees the fake-TCP segments on the wire (raw socket mode)
+	Outer = &Tap{}
+	// Inner sees the tunneled IP packets read from and written to the TUN device
+	Inner = &Tap{}
+)
+
+// Tap fans packets out to the captures started on it
+type Tap struct {
+	active int32
+	mu     sync.RWMutex
+	sinks  map[*Capture]struct{}
+}
+
+// Packet is one captured packet
+type Packet struct {
+	Time   time.Time
+	Data   []byte // Possibly truncated to the capture's snap length
+	Length int    // Original length
+}
+
+// Capture receives the packets of a tap that pass its filter
+type Capture struct {
+	tap     *Tap
+	filter  Program
+	snapLen int
+	packets chan Packet
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Active reports whether any capture is running on the tap
+func (t *Tap) Active() bool {
+	return atomic.LoadInt32(&t.active) != 0
+}
+
+// Packet offers pkt to the running captures; it is copied by those whose
+// filter accepts it, so the caller may reuse the buffer
+func (t *Tap) Packet(pkt []byte) {
+	if !t.Active() {
+		return
+	}
+	now := time.Now()
+	t.mu.RLock()
+	for c := range t.sinks {
+		c.offer(now, pkt)
+	}
+	t.mu.RUnlock()
+}
+
+// Start begins a capture of the packets accepted by filter (nil = all). Up
+// to queue packets are buffered; more are counted as dropped.
+func (t *Tap) Start(filter Program, snapLen, queue int) *Capture {
+	c := &Capture{tap: t, filter: filter, snapLen: snapLen, packets: make(chan Packet, queue)}
+	t.mu.Lock()
+	if t.sinks == nil {
+		t.sinks = make(map[*Capture]struct{})
+	}
+	t.sinks[c] = struct{}{}
+	atomic.StoreInt32(&t.active, int32(len(t.sinks)))
+	t.mu.Unlock()
+	return c
+}
+
+func (c *Capture) offer(now time.Time, pkt []byte) {
+	keep := len(pkt)
+	if c.filter != nil {
+		n := int(c.filter.Run(pkt))
+		if n == 0 {
+			return
+		}
+		keep = min(keep, n)
+	}
+	keep = min(keep, c.snapLen)
+	p := Packet{Time: now, Data: append([]byte(nil), pkt[:keep]...), Length: len(pkt)}
+	select {
+	case c.packets <- p:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Packets delivers the captured packets; it is closed by Stop
+func (c *Capture) Packets() <-chan Packet {
+	return c.packets
+}
+
+// Dropped is the number of matching packets lost to a full queue
+func (c *Capture) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Stop detaches the capture from its tap
+func (c *Capture) Stop() {
+	c.once.Do(func() {
+		t := c.tap
+		t.mu.Lock()
+		delete(t.sinks, c)
+		atomic.StoreInt32(&t.active, int32(len(t.sinks)))
+		t.mu.Unlock()
+		close(c.packets)
+	})
+}
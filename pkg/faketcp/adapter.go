@@ -58,12 +58,14 @@ type ConnAdapter interface {
 	WritePacket(data []byte) error
 	WriteBatch(packets [][]byte) error // Optimized batch write
 	ReadPacket() ([]byte, error)
+	ReadBatch(max int) ([][]byte, error) // At least one packet plus those already queued, up to max
 	Close() error
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	SetDeadline(t time.Time) error
 	SetReadDeadline(t time.Time) error
 	SetWriteDeadline(t time.Time) error
+	SendMSS() int // Largest payload per segment toward the peer
 }
 
 // ListenerAdapter is a unified interface for both UDP and Raw socket listeners
@@ -144,7 +146,7 @@ func ModeString(mode Mode) string {
 // CheckRawSocketSupport checks if raw socket mode is supported
 func CheckRawSocketSupport() error {
 	// Try to create a test raw socket
-	testSock, err := rawsocket.NewRawSocket(net.IPv4(127, 0, 0, 1), 12345, net.IPv4(127, 0, 0, 1), 54321, true)
+	testSock, err := rawsocket.NewRawSocket(net.IPv4(127, 0, 0, 1), 12345, net.IPv4(127, 0, 0, 1), 54321, true, rawsocket.JoinNetNS(netnsPath))
 	if err != nil {
 		return fmt.Errorf("raw socket not supported: %v (需要root权限)", err)
 	}
@@ -0,0 +1,144 @@
+package faketcp
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Vectored I/O for UDP mode: WriteBatch hands all segments of a batch to the
+// kernel in one sendmmsg(2) call and ReadBatch drains every datagram already
+// queued on a connected socket with one recvmmsg(2) call, instead of one
+// syscall per segment.
+
+// maxReadBatch is the most datagrams ReadBatch returns at once
+const maxReadBatch = 64
+
+// udpSyscalls counts send/receive syscalls made by UDP mode connections
+var udpSyscalls atomic.Uint64
+
+// mmsghdr mirrors struct mmsghdr: a msghdr plus the byte count the kernel fills
+// in. Alignment pads it to the C size; a trailing zero-length field would not,
+// Go grows a struct ending in one.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	n   uint32
+}
+
+// sockaddr converts addr to a raw socket address for msg_name
+func sockaddr(addr *net.UDPAddr) (unsafe.Pointer, uint32) {
+	port := [2]byte{byte(addr.Port >> 8), byte(addr.Port)}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		*(*[2]byte)(unsafe.Pointer(&sa.Port)) = port
+		copy(sa.Addr[:], ip4)
+		return unsafe.Pointer(sa), syscall.SizeofSockaddrInet4
+	}
+	sa := &syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	*(*[2]byte)(unsafe.Pointer(&sa.Port)) = port
+	copy(sa.Addr[:], addr.IP.To16())
+	return unsafe.Pointer(sa), syscall.SizeofSockaddrInet6
+}
+
+// sendmmsg writes each segment as one datagram, addressed to to unless the
+// socket is connected (to == nil)
+func sendmmsg(conn *net.UDPConn, segments [][]byte, to *net.UDPAddr) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var name unsafe.Pointer
+	var namelen uint32
+	if to != nil {
+		name, namelen = sockaddr(to)
+	}
+	iovs := make([]syscall.Iovec, len(segments))
+	msgs := make([]mmsghdr, len(segments))
+	for i, seg := range segments {
+		iovs[i].Base = &seg[0]
+		iovs[i].SetLen(len(seg))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+		msgs[i].hdr.Name = (*byte)(name)
+		msgs[i].hdr.Namelen = namelen
+	}
+
+	for sent := 0; sent < len(msgs); {
+		var n uintptr
+		var errno syscall.Errno
+		err := rc.Write(func(fd uintptr) bool {
+			n, _, errno = syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+			return errno != syscall.EAGAIN
+		})
+		udpSyscalls.Add(1)
+		if err != nil {
+			return err
+		}
+		if errno != 0 {
+			return errno
+		}
+		sent += int(n)
+	}
+	runtime.KeepAlive(segments)
+	runtime.KeepAlive(name)
+	return nil
+}
+
+// recvBatch holds the buffers for one recvmmsg call
+type recvBatch struct {
+	bufs [][]byte
+	iovs []syscall.Iovec
+	msgs []mmsghdr
+}
+
+var recvBatchPool = sync.Pool{
+	New: func() interface{} {
+		b := &recvBatch{
+			bufs: make([][]byte, maxReadBatch),
+			iovs: make([]syscall.Iovec, maxReadBatch),
+			msgs: make([]mmsghdr, maxReadBatch),
+		}
+		for i := range b.bufs {
+			b.bufs[i] = make([]byte, MaxPacketSize)
+			b.iovs[i].Base = &b.bufs[i][0]
+			b.iovs[i].SetLen(MaxPacketSize)
+			b.msgs[i].hdr.Iov = &b.iovs[i]
+			b.msgs[i].hdr.Iovlen = 1
+		}
+		return b
+	},
+}
+
+// recvmmsg blocks until at least one datagram is queued on the connected socket
+// and reads up to max of them. The datagrams are b.bufs[i][:b.msgs[i].n].
+func (b *recvBatch) recvmmsg(conn *net.UDPConn, max int) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if max > len(b.msgs) {
+		max = len(b.msgs)
+	}
+
+	var n uintptr
+	var errno syscall.Errno
+	err = rc.Read(func(fd uintptr) bool {
+		// The socket is non-blocking: EAGAIN parks the goroutine in the poller
+		n, _, errno = syscall.Syscall6(sysRecvmmsg, fd,
+			uintptr(unsafe.Pointer(&b.msgs[0])), uintptr(max), 0, 0, 0)
+		return errno != syscall.EAGAIN
+	})
+	udpSyscalls.Add(1)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
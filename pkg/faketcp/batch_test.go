@@ -0,0 +1,153 @@
+package faketcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+const benchBatch = 16
+
+// connectedPair returns two fake TCP connections over loopback UDP sockets
+// connected to each other
+func connectedPair(tb testing.TB) (*Conn, *Conn) {
+	addrs := make([]*net.UDPAddr, 2)
+	for i := range addrs {
+		probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		addrs[i] = probe.LocalAddr().(*net.UDPAddr)
+		probe.Close()
+	}
+	conns := make([]*Conn, 2)
+	for i := range conns {
+		local, remote := addrs[i], addrs[1-i]
+		udpConn, err := net.DialUDP("udp", local, remote)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		_ = udpConn.SetReadBuffer(4 << 20)
+		tb.Cleanup(func() { udpConn.Close() })
+		conns[i] = &Conn{
+			udpConn:     udpConn,
+			localAddr:   local,
+			remoteAddr:  remote,
+			srcPort:     uint16(local.Port),
+			dstPort:     uint16(remote.Port),
+			isConnected: true,
+		}
+	}
+	return conns[0], conns[1]
+}
+
+func testPackets(n, size int) [][]byte {
+	packets := make([][]byte, n)
+	for i := range packets {
+		packets[i] = bytes.Repeat([]byte{byte(i + 1)}, size)
+	}
+	return packets
+}
+
+// TestBatchRoundTrip verifies that WriteBatch and ReadBatch carry every packet
+// intact and in order
+func TestBatchRoundTrip(t *testing.T) {
+	sender, receiver := connectedPair(t)
+
+	packets := testPackets(benchBatch, 1000)
+	if err := sender.WriteBatch(packets); err != nil {
+		t.Fatal(err)
+	}
+	var got [][]byte
+	for len(got) < len(packets) {
+		batch, err := receiver.ReadBatch(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, batch...)
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Fatalf("packet %d corrupted", i)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, batched bool) {
+	conn, peer := connectedPair(b)
+	packets := testPackets(benchBatch, 1000)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, MaxPacketSize)
+		for {
+			if _, err := peer.udpConn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := udpSyscalls.Load()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batched {
+			if err := conn.WriteBatch(packets); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, pkt := range packets {
+			if err := conn.WritePacket(pkt); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(udpSyscalls.Load()-start)/float64(b.N), "syscalls/op")
+	peer.udpConn.Close()
+	<-done
+}
+
+// BenchmarkWritePacket sends 16 packets per op with one syscall each
+func BenchmarkWritePacket(b *testing.B) { benchmarkWrite(b, false) }
+
+// BenchmarkWriteBatch sends the same 16 packets per op with sendmmsg
+func BenchmarkWriteBatch(b *testing.B) { benchmarkWrite(b, true) }
+
+func benchmarkRead(b *testing.B, batched bool) {
+	sender, conn := connectedPair(b)
+	packets := testPackets(benchBatch, 1000)
+
+	var syscalls uint64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := sender.WriteBatch(packets); err != nil {
+			b.Fatal(err)
+		}
+		start := udpSyscalls.Load()
+		b.StartTimer()
+		for read := 0; read < benchBatch; {
+			if batched {
+				batch, err := conn.ReadBatch(0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += len(batch)
+			} else {
+				if _, err := conn.ReadPacket(); err != nil {
+					b.Fatal(err)
+				}
+				read++
+			}
+		}
+		syscalls += udpSyscalls.Load() - start
+	}
+	b.ReportMetric(float64(syscalls)/float64(b.N), "syscalls/op")
+}
+
+// BenchmarkReadPacket receives 16 queued packets per op with one syscall each
+func BenchmarkReadPacket(b *testing.B) { benchmarkRead(b, false) }
+
+// BenchmarkReadBatch receives the same 16 packets per op with recvmmsg
+func BenchmarkReadBatch(b *testing.B) { benchmarkRead(b, true) }
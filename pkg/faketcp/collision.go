@@ -0,0 +1,61 @@
+package faketcp
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// Both ends of a raw flow can start a handshake at once: peers that dial each
+// other from the ports they listen on, and a client that dials again from the
+// same port before the server has noticed its previous connection is gone.
+// Every such collision is resolved the same way at both ends, so a flow never
+// ends up with two half-open connections answering in different sequence
+// spaces:
+//
+//   - Simultaneous open, a SYN reaching a connection in SYN_SENT: the SYN with
+//     the larger ISN wins, the addresses and ports breaking a tie. The winner
+//     ignores the other SYN and keeps waiting for its SYN-ACK; the loser stops
+//     sending its SYN and answers the winner's with a SYN-ACK from its own
+//     ISN, as a listener would, so the flow carries one handshake.
+//   - A listener leaves the segments of a flow a local connection is dialing
+//     to that connection instead of accepting its SYNs.
+//   - A SYN with a new ISN on a flow the listener already has a connection
+//     for means the peer started over: the old connection, half-open or
+//     established, is closed without a FIN and the SYN accepted as a new
+//     one. A retransmission of the SYN that opened it is answered as before.
+//
+// UDP mode needs none of this; each dial has a socket and port of its own.
+
+// synWins reports whether our SYN beats the peer's in a simultaneous open
+func synWins(localISN uint32, localIP net.IP, localPort uint16, peerISN uint32, remoteIP net.IP, remotePort uint16) bool {
+	if localISN != peerISN {
+		return localISN > peerISN
+	}
+	if c := bytes.Compare(canonicalIP(localIP), canonicalIP(remoteIP)); c != 0 {
+		return c > 0
+	}
+	return localPort > remotePort
+}
+
+// dialingFlow reports whether a connection this process dialed owns the flow
+func dialingFlow(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) bool {
+	v, ok := flows.Load(newFlowKey(localIP, localPort, remoteIP, remotePort))
+	if !ok {
+		return false
+	}
+	c := v.(*ConnRaw)
+	return !c.isListener && atomic.LoadInt32(&c.closed) == 0
+}
+
+// supersede closes a listener's connection whose peer started a new
+// handshake on the same flow; the caller holds l.mu and removes it from
+// connMap. No FIN is sent: it would reach the peer's new handshake.
+func (c *ConnRaw) supersede(peerISN uint32) {
+	log.Printf("New SYN from %s:%d (ISN %d, was %d), replacing its connection",
+		c.remoteIP, c.remotePort, peerISN, c.peerISN)
+	atomic.StoreInt32(&c.closed, 1)
+	unregisterFlow(c)
+	c.fsm.close("superseded by a new SYN")
+}
@@ -0,0 +1,65 @@
+package faketcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSynWins checks that exactly one end of a collision wins
+func TestSynWins(t *testing.T) {
+	a, b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	cases := []struct {
+		isnA, isnB   uint32
+		portA, portB uint16
+	}{
+		{100, 200, 4000, 4000},
+		{0xfffffff0, 5, 4000, 4000}, // Plain comparison, not sequence space
+		{7, 7, 4000, 4000},          // Addresses break the tie
+		{7, 7, 4000, 4001},
+	}
+	for _, c := range cases {
+		winsA := synWins(c.isnA, a, c.portA, c.isnB, b, c.portB)
+		winsB := synWins(c.isnB, b, c.portB, c.isnA, a, c.portA)
+		if winsA == winsB {
+			t.Errorf("%+v: both ends see the same result (%v)", c, winsA)
+		}
+	}
+	if !synWins(7, a, 4001, 7, a, 4000) || synWins(7, a, 4000, 7, a, 4001) {
+		t.Error("ports do not break a tie between equal addresses")
+	}
+}
+
+// TestSimultaneousOpen dials both ways on one loopback flow at once and
+// checks that both ends settle on the same sequence numbers
+func TestSimultaneousOpen(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1).To4()
+	const portA, portB = 47101, 47102
+	a, err := NewConnRaw(lo, portA, lo, portB, true)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer a.Close()
+	b, err := NewConnRaw(lo, portB, lo, portA, true)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer b.Close()
+	isnA, isnB := a.seqNum, b.seqNum
+
+	errs := make(chan error, 2)
+	for _, c := range []*ConnRaw{a, b} {
+		go func() { errs <- c.performHandshake(3 * time.Second) }()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.seqNum != isnA+1 || b.seqNum != isnB+1 {
+		t.Errorf("SYNs not consumed: %d/%d from ISNs %d/%d", a.seqNum, b.seqNum, isnA, isnB)
+	}
+	if a.ackNum != b.seqNum || b.ackNum != a.seqNum {
+		t.Errorf("ends disagree: a seq %d ack %d, b seq %d ack %d", a.seqNum, a.ackNum, b.seqNum, b.ackNum)
+	}
+}
@@ -0,0 +1,109 @@
+package faketcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake cookies keep a listener from allocating anything for a SYN: the
+// SYN-ACK's sequence number is a cookie, a keyed hash of the connection tuple,
+// the client's ISN and a coarse time slot, with the client's MSS in its low
+// bits. Only an ACK that echoes a valid cookie (ack-1) creates the
+// connection, so a flood of SYNs from spoofed sources costs one reply each
+// and leaves no half-open state. Both ends of a cookie handshake look like an
+// ordinary one. Cookies are off unless enabled with SetHandshakeCookies.
+
+var handshakeCookies bool
+
+// SetHandshakeCookies makes listeners answer SYNs statelessly
+func SetHandshakeCookies(on bool) {
+	handshakeCookies = on
+}
+
+// HandshakeCookies reports whether listeners use handshake cookies
+func HandshakeCookies() bool {
+	return handshakeCookies
+}
+
+// cookieSlot is the lifetime granularity of a cookie; one from the current
+// or the previous slot is accepted
+const cookieSlot = 64 * time.Second
+
+// cookieMSS are the MSS values a cookie can carry; a client's MSS is rounded
+// down to one of them (index 0: no MSS option, or one below 536)
+var cookieMSS = [8]int{0, 536, 1200, 1300, 1360, 1400, 1440, 1460}
+
+// cookieSecret keys the cookie hash
+var cookieSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+var cookieStats struct {
+	sent, accepted, rejected atomic.Uint64
+}
+
+// CookieCounts are the handshake cookies handled by the listeners
+type CookieCounts struct {
+	Sent     uint64 // SYN-ACKs carrying a cookie
+	Accepted uint64 // Connections created from a valid cookie
+	Rejected uint64 // Segments of unknown flows without a valid cookie
+}
+
+// Cookies returns the handshake cookies handled so far
+func Cookies() CookieCounts {
+	return CookieCounts{
+		Sent:     cookieStats.sent.Load(),
+		Accepted: cookieStats.accepted.Load(),
+		Rejected: cookieStats.rejected.Load(),
+	}
+}
+
+func cookieHash(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isn, slot uint32, mssIndex int) uint32 {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write(localIP.To16())
+	mac.Write(remoteIP.To16())
+	binary.Write(mac, binary.BigEndian, [2]uint16{localPort, remotePort})
+	binary.Write(mac, binary.BigEndian, [3]uint32{isn, slot, uint32(mssIndex)})
+	return binary.BigEndian.Uint32(mac.Sum(nil))&^7 | uint32(mssIndex)
+}
+
+func cookieSlotAt(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(cookieSlot/time.Second))
+}
+
+// makeCookie returns the ISN of the SYN-ACK answering a SYN with sequence
+// number isn and MSS option mss (0 if absent)
+func makeCookie(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isn uint32, mss int) uint32 {
+	index := 0
+	for i, m := range cookieMSS {
+		if m <= mss {
+			index = i
+		}
+	}
+	cookieStats.sent.Add(1)
+	return cookieHash(localIP, localPort, remoteIP, remotePort, isn, cookieSlotAt(time.Now()), index)
+}
+
+// checkCookie verifies the ACK completing a cookie handshake: seq and ack are
+// its sequence and acknowledgment numbers. It returns the client's MSS as
+// carried by the cookie.
+func checkCookie(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, seq, ack uint32) (mss int, ok bool) {
+	cookie := ack - 1
+	index := int(cookie & 7)
+	slot := cookieSlotAt(time.Now())
+	for _, s := range []uint32{slot, slot - 1} {
+		if cookieHash(localIP, localPort, remoteIP, remotePort, seq-1, s, index) == cookie {
+			cookieStats.accepted.Add(1)
+			return cookieMSS[index], true
+		}
+	}
+	cookieStats.rejected.Add(1)
+	return 0, false
+}
@@ -0,0 +1,35 @@
+package faketcp
+
+import (
+	"net"
+	"testing"
+)
+
+// TestHandshakeCookie checks that a cookie is accepted only from the tuple it
+// was issued to and carries the client's MSS, rounded down
+func TestHandshakeCookie(t *testing.T) {
+	server, client := net.IPv4(10, 0, 0, 1), net.IPv4(192, 0, 2, 7)
+	const isn = 0xfffffff0
+
+	for _, tc := range []struct{ mss, want int }{{0, 0}, {500, 0}, {1380, 1360}, {1460, 1460}, {8960, 1460}} {
+		cookie := makeCookie(server, 443, client, 50000, isn, tc.mss)
+		mss, ok := checkCookie(server, 443, client, 50000, isn+1, cookie+1)
+		if !ok || mss != tc.want {
+			t.Errorf("MSS %d: check = %d %v, want %d true", tc.mss, mss, ok, tc.want)
+		}
+	}
+
+	cookie := makeCookie(server, 443, client, 50000, isn, 1460)
+	if _, ok := checkCookie(server, 443, client, 50001, isn+1, cookie+1); ok {
+		t.Error("cookie accepted from another source port")
+	}
+	if _, ok := checkCookie(server, 443, net.IPv4(192, 0, 2, 8), 50000, isn+1, cookie+1); ok {
+		t.Error("cookie accepted from another source address")
+	}
+	if _, ok := checkCookie(server, 443, client, 50000, isn+2, cookie+1); ok {
+		t.Error("cookie accepted with another client ISN")
+	}
+	if _, ok := checkCookie(server, 443, client, 50000, isn+1, cookie+9); ok {
+		t.Error("forged cookie accepted")
+	}
+}
@@ -0,0 +1,62 @@
+package faketcp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DropReason classifies a segment a listener dropped before any connection
+// took it
+type DropReason int
+
+const (
+	DropMalformed   DropReason = iota // Failed strict validation
+	DropUnknownFlow                   // Not part of a known flow and not opening one (incl. bad cookies)
+)
+
+type dropObserver func(reason DropReason, src net.IP, port uint16)
+
+var (
+	dropObserversMu sync.Mutex
+	dropObservers   atomic.Pointer[[]*dropObserver] // Copied on change, read without locking
+)
+
+// ObserveDrops calls fn with the source address and local port of each
+// segment a listener drops for one of the DropReasons, until the returned
+// function is called. fn runs on the receive path and must not block.
+func ObserveDrops(fn func(reason DropReason, src net.IP, port uint16)) (stop func()) {
+	obs := (*dropObserver)(&fn)
+	update := func(change func([]*dropObserver) []*dropObserver) {
+		dropObserversMu.Lock()
+		defer dropObserversMu.Unlock()
+		var cur []*dropObserver
+		if p := dropObservers.Load(); p != nil {
+			cur = *p
+		}
+		next := change(append([]*dropObserver(nil), cur...))
+		dropObservers.Store(&next)
+	}
+	update(func(list []*dropObserver) []*dropObserver { return append(list, obs) })
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			update(func(list []*dropObserver) []*dropObserver {
+				for i, o := range list {
+					if o == obs {
+						return append(list[:i], list[i+1:]...)
+					}
+				}
+				return list
+			})
+		})
+	}
+}
+
+func noteDrop(reason DropReason, src net.IP, port uint16) {
+	if p := dropObservers.Load(); p != nil {
+		for _, fn := range *p {
+			(*fn)(reason, src, port)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package faketcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Duplication sends every payload segment several times. The copies carry the
+// sequence number of the original, so on the wire they look like TCP
+// retransmissions, and a loss costs no recovery time as long as one copy gets
+// through. Every receiver drops copies by sequence number whether or not it
+// duplicates itself, so only the sender needs to enable it.
+
+// Duplicate configures segment duplication
+type Duplicate struct {
+	Copies  int           // Times each payload segment is sent (0 or 1: once)
+	Spacing time.Duration // Gap between consecutive copies (0: back to back)
+}
+
+var duplicate Duplicate
+
+// SetDuplicate applies to all connections; set it before they are created
+func SetDuplicate(d Duplicate) {
+	duplicate = d
+}
+
+var duplicateStats struct {
+	sent, dropped atomic.Uint64
+}
+
+// DuplicateCounts are the extra copies handled by all connections
+type DuplicateCounts struct {
+	Sent    uint64 // Copies sent in addition to the original segments
+	Dropped uint64 // Received segments dropped as copies of one already seen
+}
+
+// Duplicates returns the copies handled so far
+func Duplicates() DuplicateCounts {
+	return DuplicateCounts{
+		Sent:    duplicateStats.sent.Load(),
+		Dropped: duplicateStats.dropped.Load(),
+	}
+}
+
+// repeatSegments sends the extra copies of n segments just sent: back to back
+// without spacing, otherwise from timers so the writer is not held up
+func repeatSegments(n int, send func() error) {
+	for i := 1; i < duplicate.Copies; i++ {
+		if duplicate.Spacing <= 0 {
+			if send() == nil {
+				duplicateStats.sent.Add(uint64(n))
+			}
+			continue
+		}
+		time.AfterFunc(time.Duration(i)*duplicate.Spacing, func() {
+			if send() == nil {
+				duplicateStats.sent.Add(uint64(n))
+			}
+		})
+	}
+}
+
+// dupFilterBits sizes a connection's filter: 1024 slots of 8 bytes
+const dupFilterBits = 10
+
+// dupFilter remembers the sequence numbers of recently received payload
+// segments in a direct-mapped table. A collision evicts the older entry, so a
+// copy may occasionally get through, but a new segment is never taken for one.
+type dupFilter struct {
+	slots [1 << dupFilterBits]atomic.Uint64 // Sequence number | 1<<32 (0: empty)
+}
+
+// seen records seq and reports whether it was already there
+func (f *dupFilter) seen(seq uint32) bool {
+	slot := &f.slots[(seq*2654435761)>>(32-dupFilterBits)]
+	v := uint64(seq) | 1<<32
+	if slot.Load() == v {
+		duplicateStats.dropped.Add(1)
+		return true
+	}
+	slot.Store(v)
+	return false
+}
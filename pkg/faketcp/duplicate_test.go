@@ -0,0 +1,52 @@
+package faketcp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestDuplicate checks that every segment is sent the configured number of
+// times and that the receiver passes each on exactly once
+func TestDuplicate(t *testing.T) {
+	SetDuplicate(Duplicate{Copies: 3, Spacing: time.Millisecond})
+	defer SetDuplicate(Duplicate{})
+	sender, receiver := connectedPair(t)
+	before := Duplicates()
+
+	packets := testPackets(8, 200)
+	for _, pkt := range packets[:4] {
+		if err := sender.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sender.WriteBatch(packets[4:]); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]byte
+	receiver.udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		batch, err := receiver.ReadBatch(0)
+		if err != nil {
+			break // Deadline: the last copies have long arrived
+		}
+		for _, pkt := range batch {
+			if len(pkt) > 0 {
+				got = append(got, pkt)
+			}
+		}
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("received %d packets, want %d", len(got), len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Fatalf("packet %d corrupted", i)
+		}
+	}
+	after := Duplicates()
+	if sent, dropped := after.Sent-before.Sent, after.Dropped-before.Dropped; sent != 16 || dropped != 16 {
+		t.Errorf("sent %d and dropped %d copies, want 16 each", sent, dropped)
+	}
+}
@@ -0,0 +1,237 @@
+package faketcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// ECN lets routers signal congestion by marking packets instead of dropping
+// them. With SetECN, forged data segments (raw mode) are sent as ECT(0); the
+// receiving connection counts segments that arrive marked CE and the tunnel
+// echoes the count back in a control frame, which the sending connection
+// feeds into its CongestionController. The default controller spaces out
+// segments while marks keep coming and relaxes again once they stop. UDP mode
+// neither sets nor sees the ECN bits.
+
+var ecnEnabled bool
+
+// SetECN marks outgoing data segments ECN-capable (ECT(0))
+func SetECN(on bool) {
+	ecnEnabled = on
+}
+
+// ECNEnabled reports whether outgoing segments are marked ECN-capable
+func ECNEnabled() bool {
+	return ecnEnabled
+}
+
+// CongestionController reacts to the congestion signals of one connection.
+// Methods may be called concurrently.
+type CongestionController interface {
+	// OnCongestion is called with the number of CE marks the peer newly
+	// reported
+	OnCongestion(marks uint64)
+	// Gap is the delay to leave after sending a segment
+	Gap() time.Duration
+}
+
+var (
+	congestionMux     sync.RWMutex
+	congestionFactory = func() CongestionController { return &ecnPacer{} }
+)
+
+// SetCongestionController replaces the congestion controller of connections
+// created afterwards
+func SetCongestionController(factory func() CongestionController) {
+	congestionMux.Lock()
+	congestionFactory = factory
+	congestionMux.Unlock()
+}
+
+func newCongestionController() CongestionController {
+	congestionMux.RLock()
+	defer congestionMux.RUnlock()
+	return congestionFactory()
+}
+
+// CongestionConn is implemented by connections paced by a
+// CongestionController (raw and UDP mode)
+type CongestionConn interface {
+	// OnCongestion feeds congestion signalled by other means than ECN, such
+	// as queue overflows the peer reported, into the congestion controller
+	OnCongestion(events uint64)
+}
+
+// ECNConn is implemented by connections that see ECN marks (raw mode)
+type ECNConn interface {
+	// CEMarks returns the number of CE-marked segments received
+	CEMarks() uint64
+	// PendingECNEcho returns the mark count to echo to the peer, ok only when
+	// it grew since the last echo and ecnEchoInterval has passed
+	PendingECNEcho() (marks uint64, ok bool)
+	// OnECNEcho feeds a mark count echoed by the peer into the congestion
+	// controller
+	OnECNEcho(marks uint64)
+}
+
+// ecnEchoInterval bounds how often marks are echoed
+const ecnEchoInterval = 20 * time.Millisecond
+
+// ecnState is the ECN bookkeeping of a connection; the zero value is ready
+type ecnState struct {
+	ceMarks atomic.Uint64 // CE-marked segments received
+	echoed  atomic.Uint64 // Count last echoed to the peer, at echoedAt
+
+	signalled uint32 // Set once the controller saw congestion, so pacing costs nothing before (atomic)
+
+	mu         sync.Mutex
+	echoedAt   time.Time
+	peerMarks  uint64 // Count last reported by the peer
+	controller CongestionController
+}
+
+// noteECN counts a received packet marked CE
+func (e *ecnState) noteECN(pkt []byte) {
+	if rawsocket.TrafficClass(pkt)&rawsocket.ECNMask == rawsocket.ECNCE {
+		e.ceMarks.Add(1)
+	}
+}
+
+// pendingEcho is called for every received packet, so the common case of no
+// new marks takes no lock
+func (e *ecnState) pendingEcho() (uint64, bool) {
+	marks := e.ceMarks.Load()
+	if marks == e.echoed.Load() {
+		return 0, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.echoedAt) < ecnEchoInterval {
+		return 0, false
+	}
+	e.echoed.Store(marks)
+	e.echoedAt = time.Now()
+	return marks, true
+}
+
+func (e *ecnState) onEcho(marks uint64) {
+	e.mu.Lock()
+	if marks <= e.peerMarks {
+		e.mu.Unlock()
+		return // Reordered or repeated echo
+	}
+	delta := marks - e.peerMarks
+	e.peerMarks = marks
+	e.mu.Unlock()
+	e.onCongestion(delta)
+}
+
+func (e *ecnState) onCongestion(events uint64) {
+	e.mu.Lock()
+	ctrl := e.controllerLocked()
+	e.mu.Unlock()
+	atomic.StoreUint32(&e.signalled, 1)
+	ctrl.OnCongestion(events)
+}
+
+// pacingGap returns the delay to leave after a segment, without taking a
+// lock until congestion was first signalled
+func (e *ecnState) pacingGap() time.Duration {
+	if atomic.LoadUint32(&e.signalled) == 0 {
+		return 0
+	}
+	return e.gap()
+}
+
+// gap returns the controller's delay between segments
+func (e *ecnState) gap() time.Duration {
+	e.mu.Lock()
+	ctrl := e.controllerLocked()
+	e.mu.Unlock()
+	return ctrl.Gap()
+}
+
+func (e *ecnState) controllerLocked() CongestionController {
+	if e.controller == nil {
+		e.controller = newCongestionController()
+	}
+	return e.controller
+}
+
+// Pacing of the default controller: each echo with new marks doubles the gap
+// between segments, up to ecnMaxGap; every ecnRelax without marks halves it
+const (
+	ecnMinGap = 20 * time.Microsecond
+	ecnMaxGap = 2 * time.Millisecond
+	ecnRelax  = 250 * time.Millisecond
+)
+
+// ecnPacer is the default CongestionController
+type ecnPacer struct {
+	mu      sync.Mutex
+	gap     time.Duration
+	changed time.Time
+}
+
+func (p *ecnPacer) OnCongestion(marks uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gap = min(max(2*p.gap, ecnMinGap), ecnMaxGap)
+	p.changed = time.Now()
+}
+
+func (p *ecnPacer) Gap() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.gap > 0 && time.Since(p.changed) >= ecnRelax {
+		p.gap /= 2
+		p.changed = p.changed.Add(ecnRelax)
+		if p.gap < ecnMinGap {
+			p.gap = 0
+		}
+	}
+	return p.gap
+}
+
+// CEMarks returns the number of CE-marked segments received
+func (c *ConnRaw) CEMarks() uint64 {
+	return c.ecn.ceMarks.Load()
+}
+
+// PendingECNEcho returns the mark count to echo to the peer
+func (c *ConnRaw) PendingECNEcho() (uint64, bool) {
+	return c.ecn.pendingEcho()
+}
+
+// OnECNEcho feeds a mark count echoed by the peer into the congestion controller
+func (c *ConnRaw) OnECNEcho(marks uint64) {
+	c.ecn.onEcho(marks)
+}
+
+// OnCongestion feeds congestion reported by other means into the controller
+func (c *ConnRaw) OnCongestion(events uint64) {
+	c.ecn.onCongestion(events)
+}
+
+// OnCongestion feeds congestion reported by other means into the controller
+func (c *Conn) OnCongestion(events uint64) {
+	c.ecn.onCongestion(events)
+}
+
+// ecnTOS returns the ECN bits of a segment: for data, codepoint if set, else
+// ECT(0) when ECN is on. SYNs and pure ACKs stay Not-ECT (RFC 3168).
+func ecnTOS(flags uint8, payload []byte, codepoint uint8) uint8 {
+	if len(payload) == 0 || flags&SYN != 0 {
+		return 0
+	}
+	if codepoint != 0 {
+		return codepoint
+	}
+	if ecnEnabled {
+		return rawsocket.ECNECT0
+	}
+	return 0
+}
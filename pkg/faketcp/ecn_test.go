@@ -0,0 +1,68 @@
+package faketcp
+
+import (
+	"testing"
+	"time"
+)
+
+type countingController struct{ marks uint64 }
+
+func (c *countingController) OnCongestion(marks uint64) { c.marks += marks }
+func (c *countingController) Gap() time.Duration        { return 0 }
+
+// TestECNEcho checks that CE marks are echoed once per change and that the
+// peer's running totals reach the controller as increments
+func TestECNEcho(t *testing.T) {
+	var e ecnState
+	e.noteECN([]byte{0x45, 0x02}) // ECT(0), not marked
+	e.noteECN([]byte{0x45, 0x03})
+	e.noteECN([]byte{0x45, 0x03})
+	if marks, ok := e.pendingEcho(); !ok || marks != 2 {
+		t.Fatalf("echo %d %v, want 2 marks", marks, ok)
+	}
+	if _, ok := e.pendingEcho(); ok {
+		t.Fatal("unchanged count echoed again")
+	}
+
+	ctrl := &countingController{}
+	e.controller = ctrl
+	for _, total := range []uint64{3, 5, 4, 5, 9} {
+		e.onEcho(total)
+	}
+	if ctrl.marks != 9 {
+		t.Errorf("controller saw %d marks, want 9", ctrl.marks)
+	}
+}
+
+// TestECNPacer checks that the default controller backs off on marks and
+// relaxes without them
+func TestECNPacer(t *testing.T) {
+	p := &ecnPacer{}
+	for i := 0; i < 20; i++ {
+		p.OnCongestion(1)
+	}
+	if p.Gap() != ecnMaxGap {
+		t.Fatalf("gap %v after repeated marks, want %v", p.Gap(), ecnMaxGap)
+	}
+	p.changed = time.Now().Add(-3 * ecnRelax)
+	if gap := p.Gap(); gap != ecnMaxGap/8 {
+		t.Errorf("gap %v after three quiet periods, want %v", gap, ecnMaxGap/8)
+	}
+	p.changed = time.Now().Add(-time.Minute)
+	if gap := p.Gap(); gap != 0 {
+		t.Errorf("gap %v long after the last mark, want 0", gap)
+	}
+}
+
+// TestOnCongestion checks that congestion reported without ECN paces a
+// connection that was not pacing before
+func TestOnCongestion(t *testing.T) {
+	var e ecnState
+	if gap := e.pacingGap(); gap != 0 {
+		t.Fatalf("gap %v before any congestion, want 0", gap)
+	}
+	e.onCongestion(3)
+	if gap := e.pacingGap(); gap != ecnMinGap {
+		t.Errorf("gap %v after congestion, want %v", gap, ecnMinGap)
+	}
+}
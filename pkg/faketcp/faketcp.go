@@ -1,15 +1,20 @@
 package faketcp
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
 )
 
 const (
@@ -47,6 +52,8 @@ type Tuning struct {
 	HandshakeMaxErrors  int           // max non-timeout handshake read errors before giving up
 	WritePacingMinDelay time.Duration // optional pacing delay between segments to reduce burst loss
 	MaxSegmentSize      int           // max payload bytes per fake TCP segment
+	RecvMTU             int           // largest IP packet this host accepts, caps the discovered MTU advertised to the peer as MSS (raw mode, 0 = as discovered)
+	SourcePortRotate    time.Duration // UDP mode: move dialed connections to a new local port this often (0 = never)
 }
 
 var tunables = Tuning{
@@ -74,6 +81,12 @@ func SetTuning(t Tuning) {
 	if t.MaxSegmentSize > 0 {
 		tunables.MaxSegmentSize = t.MaxSegmentSize
 	}
+	if t.RecvMTU > 0 {
+		tunables.RecvMTU = t.RecvMTU
+	}
+	if t.SourcePortRotate > 0 {
+		tunables.SourcePortRotate = t.SourcePortRotate
+	}
 }
 
 // GetTuning returns the current tuning values.
@@ -121,10 +134,21 @@ type Conn struct {
 	seqNum      uint32
 	ackNum      uint32
 	mu          sync.Mutex
-	isConnected bool        // true if UDP socket is connected, false if shared listener socket
-	recvQueue   chan []byte // for listener connections
-	closed      int32       // atomic flag: 1 if connection is closed, 0 otherwise
-	closeOnce   sync.Once   // ensures channel is closed only once
+	isConnected bool         // true if UDP socket is connected, false if shared listener socket
+	recvQueue   *packetQueue // for listener connections
+	closed      int32        // atomic flag: 1 if connection is closed, 0 otherwise
+
+	trace *capture.Ring // Recent segments for post-mortem dumps (nil unless tracing)
+	dups  dupFilter     // Recently received sequence numbers, for dropping copies
+	ecn   ecnState      // Congestion controller only: UDP mode sees no ECN marks
+
+	pacing pacingOverride // Delay the tunnel leaves after each batch (SetWritePacing)
+
+	// Source port rotation of dialed connections (rotate.go)
+	rotated    atomic.Pointer[net.UDPConn] // Socket on the current source port, once moved
+	offers     chan uint64                 // Tokens offered by the listener
+	rotateStop chan struct{}               // Closed on Close when rotating periodically
+	movedWith  uint64                      // Token of the last move (accepted connections)
 }
 
 // Listener accepts and dispatches fake TCP connections
@@ -134,6 +158,10 @@ type Listener struct {
 	mu        sync.RWMutex
 	newConnCh chan *Conn
 	closeOnce sync.Once
+
+	tokens       map[uint64]*Conn // Port rotation tokens offered, by token
+	detached     int32         // Receiving was handed to another process (Detach, atomic)
+	dispatchDone chan struct{} // Closed when the running dispatch loop returns
 }
 
 // NewConn creates a new fake TCP connection
@@ -155,6 +183,8 @@ func NewConn(udpConn *net.UDPConn, remoteAddr *net.UDPAddr, isConnected bool) (*
 		seqNum:      isn, // Initial sequence number (random)
 		ackNum:      0,
 		isConnected: isConnected,
+		trace:       newTraceRing(),
+		offers:      make(chan uint64, 1),
 	}
 
 	return conn, nil
@@ -162,6 +192,9 @@ func NewConn(udpConn *net.UDPConn, remoteAddr *net.UDPAddr, isConnected bool) (*
 
 // dispatch continuously reads UDP packets and routes them to connections
 func (l *Listener) dispatch() {
+	done := l.dispatchDone
+	defer close(done)
+
 	buf := make([]byte, MaxPacketSize)
 
 	// Simple 1-item cache to reduce map lookups and allocations for the active stream
@@ -169,10 +202,15 @@ func (l *Listener) dispatch() {
 	var lastPort int
 	var lastIP net.IP
 	var lastKey string
+	localPort := uint16(l.udpConn.LocalAddr().(*net.UDPAddr).Port)
 
 	for {
 		n, remoteAddr, err := l.udpConn.ReadFromUDP(buf)
 		if err != nil {
+			// Detach interrupts the read with a deadline; the socket stays open
+			if atomic.LoadInt32(&l.detached) != 0 {
+				return
+			}
 			// If closed, return immediately
 			if opErr, ok := err.(*net.OpError); ok && !opErr.Temporary() {
 				// Connection closed
@@ -185,7 +223,8 @@ func (l *Listener) dispatch() {
 			return
 		}
 
-		if n < TCPHeaderSize {
+		if n < TCPHeaderSize || dropMalformedSegment(buf[:n]) {
+			noteDrop(DropMalformed, remoteAddr.IP, localPort)
 			continue
 		}
 
@@ -234,8 +273,17 @@ func (l *Listener) dispatch() {
 			lastConn = nil // Clear cache
 		}
 
+		if kind, token, ok := parseRotate(tcpHeader, buf[:n]); ok {
+			if !exists {
+				conn = nil
+			}
+			l.handleRotate(conn, remoteAddr, kind, token)
+			lastConn = nil
+			continue
+		}
+
 		if !exists {
-			conn = l.createConnection(remoteAddr, tcpHeader)
+			conn = l.createConnection(remoteAddr, tcpHeader, buf[:n])
 			if conn == nil {
 				continue
 			}
@@ -258,15 +306,42 @@ func (l *Listener) dispatch() {
 			continue
 		}
 
+		conn.traceSegment(false, buf[:n])
 		l.enqueuePayload(connKey, conn, tcpHeader, buf[:n], n)
 	}
 }
 
-func (l *Listener) createConnection(remoteAddr *net.UDPAddr, tcpHeader *TCPHeader) *Conn {
+func (l *Listener) createConnection(remoteAddr *net.UDPAddr, tcpHeader *TCPHeader, seg []byte) *Conn {
 	serverIsn, err := randomUint32()
 	if err != nil {
 		serverIsn = uint32(time.Now().UnixNano())
 	}
+	ackNum := tcpHeader.SeqNum + 1
+	if handshakeCookies {
+		localAddr := l.udpConn.LocalAddr().(*net.UDPAddr)
+		if tcpHeader.Flags&SYN != 0 {
+			// Answer with a cookie and forget the peer until it echoes it
+			synAck := &TCPHeader{
+				SrcPort: uint16(localAddr.Port),
+				DstPort: tcpHeader.SrcPort,
+				SeqNum:  makeCookie(localAddr.IP, uint16(localAddr.Port), remoteAddr.IP, uint16(remoteAddr.Port), tcpHeader.SeqNum, 0),
+				AckNum:  ackNum,
+				Flags:   SYN | ACK,
+				Window:  65535,
+			}
+			l.udpConn.WriteToUDP(serializeTCPHeaderStatic(synAck), remoteAddr)
+			return nil
+		}
+		if tcpHeader.Flags&ACK == 0 || tcpHeader.Flags&(FIN|RST) != 0 {
+			noteDrop(DropUnknownFlow, remoteAddr.IP, uint16(localAddr.Port))
+			return nil
+		}
+		if _, ok := checkCookie(localAddr.IP, uint16(localAddr.Port), remoteAddr.IP, uint16(remoteAddr.Port), tcpHeader.SeqNum, tcpHeader.AckNum); !ok {
+			noteDrop(DropUnknownFlow, remoteAddr.IP, uint16(localAddr.Port))
+			return nil
+		}
+		serverIsn, ackNum = tcpHeader.AckNum, tcpHeader.SeqNum
+	}
 	conn := &Conn{
 		udpConn:     l.udpConn,
 		localAddr:   l.udpConn.LocalAddr().(*net.UDPAddr),
@@ -274,10 +349,12 @@ func (l *Listener) createConnection(remoteAddr *net.UDPAddr, tcpHeader *TCPHeade
 		srcPort:     uint16(l.udpConn.LocalAddr().(*net.UDPAddr).Port),
 		dstPort:     tcpHeader.SrcPort,
 		seqNum:      serverIsn,
-		ackNum:      tcpHeader.SeqNum + 1,
+		ackNum:      ackNum,
 		isConnected: false,
-		recvQueue:   make(chan []byte, tunables.RecvQueueSize),
+		recvQueue:   newPacketQueue(tunables.RecvQueueSize),
+		trace:       newTraceRing(),
 	}
+	conn.traceSegment(false, seg)
 
 	// Respond with SYN-ACK when possible to improve handshake success
 	if tcpHeader.Flags&SYN != 0 {
@@ -290,6 +367,7 @@ func (l *Listener) createConnection(remoteAddr *net.UDPAddr, tcpHeader *TCPHeade
 			Window:  65535,
 		}
 		synAckBytes := serializeTCPHeaderStatic(synAck)
+		conn.traceSegment(true, synAckBytes)
 		l.udpConn.WriteToUDP(synAckBytes, remoteAddr)
 	}
 
@@ -304,6 +382,10 @@ func (l *Listener) enqueuePayload(connKey string, conn *Conn, tcpHeader *TCPHead
 	if n <= headerLen {
 		return
 	}
+	// A copy of a segment already received (see SetDuplicate)
+	if conn.dups.seen(tcpHeader.SeqNum) {
+		return
+	}
 
 	payload := make([]byte, n-headerLen)
 	copy(payload, buf[headerLen:n])
@@ -312,9 +394,7 @@ func (l *Listener) enqueuePayload(connKey string, conn *Conn, tcpHeader *TCPHead
 		return
 	}
 
-	select {
-	case conn.recvQueue <- payload:
-	default:
+	if !conn.recvQueue.push(payload) {
 		log.Printf("WARNING: Receive queue full for %s, dropping packet (%d bytes)", connKey, len(payload))
 	}
 }
@@ -346,6 +426,19 @@ func Dial(remoteAddr string, timeout time.Duration) (*Conn, error) {
 		log.Printf("⚠️  Failed to set UDP write buffer to %d: %v", bufferSize, err)
 	}
 
+	return DialUDPConn(udpConn, timeout)
+}
+
+// DialUDPConn is Dial on a UDP socket created by the caller, which must be
+// connected to the server. It takes ownership of udpConn and closes it on
+// failure; buffer sizes are left as the caller set them.
+func DialUDPConn(udpConn *net.UDPConn, timeout time.Duration) (*Conn, error) {
+	raddr, ok := udpConn.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		udpConn.Close()
+		return nil, fmt.Errorf("UDP socket is not connected")
+	}
+
 	conn, err := NewConn(udpConn, raddr, true)
 	if err != nil {
 		udpConn.Close()
@@ -357,6 +450,7 @@ func Dial(remoteAddr string, timeout time.Duration) (*Conn, error) {
 	synHdr := conn.buildTCPHeader(0)
 	synHdr.Flags = SYN
 	synBytes := conn.serializeTCPHeader(synHdr)
+	conn.traceSegment(true, synBytes)
 	if _, err := conn.udpConn.Write(synBytes); err != nil {
 		conn.udpConn.Close()
 		return nil, fmt.Errorf("failed to send SYN: %v", err)
@@ -389,6 +483,7 @@ func Dial(remoteAddr string, timeout time.Duration) (*Conn, error) {
 		if hdr == nil {
 			continue
 		}
+		conn.traceSegment(false, buf[:n])
 		if hdr.Flags&(SYN|ACK) == (SYN | ACK) {
 			// Set ack and send ACK back
 			conn.ackNum = hdr.SeqNum + 1
@@ -396,12 +491,15 @@ func Dial(remoteAddr string, timeout time.Duration) (*Conn, error) {
 			ackHdr.Flags = ACK
 			ackHdr.AckNum = conn.ackNum
 			ackBytes := conn.serializeTCPHeader(ackHdr)
+			conn.traceSegment(true, ackBytes)
 			conn.udpConn.Write(ackBytes)
+			conn.startRotation()
 			return conn, nil
 		}
 	}
 
 	// Handshake timed out; still return connection (best-effort disguise)
+	conn.startRotation()
 	return conn, nil
 }
 
@@ -413,10 +511,21 @@ func Listen(addr string) (*Listener, error) {
 		return nil, fmt.Errorf("failed to resolve address: %v", err)
 	}
 
-	// Create UDP listener
-	udpConn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to listen UDP: %v", err)
+	// Create UDP listener (shared with other server processes via SO_REUSEPORT if configured)
+	var udpConn *net.UDPConn
+	if loadBalance.Enabled() {
+		lc := net.ListenConfig{Control: reusePortControl}
+		pc, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen UDP with SO_REUSEPORT: %v", err)
+		}
+		udpConn = pc.(*net.UDPConn)
+		log.Printf("Sharing UDP port %d with other workers (worker %d/%d)", laddr.Port, loadBalance.WorkerID, loadBalance.Workers)
+	} else {
+		udpConn, err = net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen UDP: %v", err)
+		}
 	}
 
 	// Determine buffer size
@@ -437,15 +546,24 @@ func Listen(addr string) (*Listener, error) {
 		log.Printf("✅ UDP Write Buffer set to %d bytes", bufferSize)
 	}
 
+	return ListenUDPConn(udpConn), nil
+}
+
+// ListenUDPConn is Listen on a UDP socket created by the caller, e.g. one
+// passed in by systemd socket activation. The listener owns udpConn; buffer
+// sizes are left as the caller set them.
+func ListenUDPConn(udpConn *net.UDPConn) *Listener {
 	l := &Listener{
-		udpConn:   udpConn,
-		connMap:   make(map[string]*Conn),
-		newConnCh: make(chan *Conn, tunables.ListenerQueueSize),
+		udpConn:      udpConn,
+		connMap:      make(map[string]*Conn),
+		tokens:       make(map[uint64]*Conn),
+		newConnCh:    make(chan *Conn, tunables.ListenerQueueSize),
+		dispatchDone: make(chan struct{}),
 	}
 
 	go l.dispatch()
 
-	return l, nil
+	return l
 }
 
 // Accept accepts a new connection (blocks until packet arrives)
@@ -467,36 +585,92 @@ func (l *Listener) Addr() net.Addr {
 	return l.udpConn.LocalAddr()
 }
 
+// SendMSS returns the largest payload sent per segment. UDP mode does not
+// negotiate an MSS, so this is the local segment limit.
+func (c *Conn) SendMSS() int {
+	maxSegment := tunables.MaxSegmentSize
+	if maxSegment <= 0 || maxSegment > MaxPayloadSize {
+		maxSegment = MaxPayloadSize
+	}
+	return maxSegment
+}
+
 // WritePacket sends data with fake TCP header
 func (c *Conn) WritePacket(data []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	maxSegment := tunables.MaxSegmentSize
-	if maxSegment <= 0 || maxSegment > MaxPayloadSize {
-		maxSegment = MaxPayloadSize
-	}
+	maxSegment := c.SendMSS()
 	return c.writePacketInternalLocked(data, maxSegment)
 }
 
-// WriteBatch sends multiple packets efficiently
+// WriteBatch sends multiple packets with a single sendmmsg call. With write
+// pacing configured or the congestion controller spacing segments out, they
+// are sent one by one so the delays still apply.
 func (c *Conn) WriteBatch(packets [][]byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	maxSegment := tunables.MaxSegmentSize
-	if maxSegment <= 0 || maxSegment > MaxPayloadSize {
-		maxSegment = MaxPayloadSize
+	maxSegment := c.SendMSS()
+
+	if tunables.WritePacingMinDelay > 0 || c.ecn.pacingGap() > 0 {
+		for _, pkt := range packets {
+			if err := c.writePacketInternalLocked(pkt, maxSegment); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
+	var segments [][]byte
 	for _, pkt := range packets {
-		if err := c.writePacketInternalLocked(pkt, maxSegment); err != nil {
-			return err
+		if len(pkt) > MaxPayloadSize {
+			return fmt.Errorf("payload size %d exceeds maximum %d bytes", len(pkt), MaxPayloadSize)
 		}
+		for sent := 0; sent < len(pkt); sent += maxSegment {
+			end := sent + maxSegment
+			if end > len(pkt) {
+				end = len(pkt)
+			}
+			segments = append(segments, c.buildSegmentLocked(pkt[sent:end]))
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	to := c.remoteAddr
+	if c.isConnected {
+		to = nil
+	}
+	if err := sendmmsg(c.sock(), segments, to); err != nil {
+		return fmt.Errorf("failed to send packet batch: %v", err)
+	}
+	if duplicate.Copies > 1 {
+		repeatSegments(len(segments), func() error {
+			if atomic.LoadInt32(&c.closed) != 0 {
+				return net.ErrClosed
+			}
+			return sendmmsg(c.sock(), segments, to)
+		})
 	}
 	return nil
 }
 
+// buildSegmentLocked prepends the fake TCP header to seg and advances the
+// sequence number
+func (c *Conn) buildSegmentLocked(seg []byte) []byte {
+	tcpHeader := c.buildTCPHeader(len(seg))
+	headerBytes := c.serializeTCPHeader(tcpHeader)
+
+	packet := make([]byte, len(headerBytes)+len(seg))
+	copy(packet[:len(headerBytes)], headerBytes)
+	copy(packet[len(headerBytes):], seg)
+	c.seqNum += uint32(len(seg))
+	c.traceSegment(true, packet)
+	return packet
+}
+
 func (c *Conn) writePacketInternalLocked(data []byte, maxSegment int) error {
 	if len(data) > MaxPayloadSize {
 		return fmt.Errorf("payload size %d exceeds maximum %d bytes", len(data), MaxPayloadSize)
@@ -512,26 +686,23 @@ func (c *Conn) writePacketInternalLocked(data []byte, maxSegment int) error {
 			segLen = remaining
 		}
 
-		seg := data[sent : sent+segLen]
-		tcpHeader := c.buildTCPHeader(len(seg))
-		headerBytes := c.serializeTCPHeader(tcpHeader)
+		packet := c.buildSegmentLocked(data[sent : sent+segLen])
 
-		packet := make([]byte, len(headerBytes)+len(seg))
-		copy(packet[:len(headerBytes)], headerBytes)
-		copy(packet[len(headerBytes):], seg)
-
-		var err error
-		if c.isConnected {
-			_, err = c.udpConn.Write(packet)
-		} else {
-			_, err = c.udpConn.WriteToUDP(packet, c.remoteAddr)
-		}
-		if err != nil {
+		if err := c.writeSegment(packet); err != nil {
 			return fmt.Errorf("failed to send packet: %v", err)
 		}
+		if duplicate.Copies > 1 {
+			repeatSegments(1, func() error {
+				if atomic.LoadInt32(&c.closed) != 0 {
+					return net.ErrClosed
+				}
+				return c.writeSegment(packet)
+			})
+		}
+		if gap := c.ecn.pacingGap(); gap > 0 {
+			time.Sleep(gap)
+		}
 
-		// Update sequence number and counters
-		c.seqNum += uint32(len(seg))
 		sent += segLen
 
 		// Calculate pacing duration - similar to raw socket logic
@@ -551,22 +722,35 @@ func (c *Conn) writePacketInternalLocked(data []byte, maxSegment int) error {
 	return nil
 }
 
+// writeSegment sends a segment built by buildSegmentLocked
+func (c *Conn) writeSegment(packet []byte) error {
+	var err error
+	if c.isConnected {
+		_, err = c.sock().Write(packet)
+	} else {
+		_, err = c.udpConn.WriteToUDP(packet, c.remoteAddr)
+	}
+	udpSyscalls.Add(1)
+	return err
+}
+
 // ReadPacket receives data and strips fake TCP header
 func (c *Conn) ReadPacket() ([]byte, error) {
 	if !c.isConnected {
 		// Listener connection - read from queue with proper closed check
 		select {
-		case payload, ok := <-c.recvQueue:
+		case payload, ok := <-c.recvQueue.ch:
 			if !ok {
 				return nil, fmt.Errorf("connection closed")
 			}
+			c.recvQueue.received()
 			return payload, nil
 		case <-time.After(ListenerReadTimeout):
 			// Check if closed during timeout (using atomic read)
 			if atomic.LoadInt32(&c.closed) != 0 {
 				return nil, fmt.Errorf("connection closed")
 			}
-			return nil, &net.OpError{Op: "read", Net: "udp", Err: fmt.Errorf("timeout")}
+			return nil, &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
 		}
 	}
 
@@ -578,8 +762,13 @@ func (c *Conn) ReadPacket() ([]byte, error) {
 	defer readBufPool.Put(bufPtr)
 	buf := bufPtr
 
-	n, err := c.udpConn.Read(buf)
+	sock := c.sock()
+	n, err := sock.Read(buf)
+	udpSyscalls.Add(1)
 	if err != nil {
+		if sock != c.sock() && !c.isClosed() {
+			return []byte{}, nil // Moved to a new source port; readers skip empty packets
+		}
 		// Check if it's a closed error
 		if opErr, ok := err.(*net.OpError); ok && !opErr.Temporary() {
 			return nil, fmt.Errorf("connection closed")
@@ -590,9 +779,20 @@ func (c *Conn) ReadPacket() ([]byte, error) {
 		}
 		return nil, err
 	}
+	return c.segmentPayload(buf[:n])
+}
+
+// segmentPayload strips the fake TCP header from a received datagram, updating
+// the acknowledgment number, and returns a copy of the payload
+func (c *Conn) segmentPayload(buf []byte) ([]byte, error) {
+	n := len(buf)
 	if n < TCPHeaderSize {
 		return nil, fmt.Errorf("packet too small: %d bytes", n)
 	}
+	c.traceSegment(false, buf)
+	if dropMalformedSegment(buf) {
+		return []byte{}, nil // Readers skip empty packets
+	}
 
 	// Parse full header (may include options)
 	tcpHeader := parseTCPHeader(buf[:n])
@@ -600,6 +800,16 @@ func (c *Conn) ReadPacket() ([]byte, error) {
 		return nil, fmt.Errorf("failed to parse tcp header")
 	}
 
+	if kind, token, ok := parseRotate(tcpHeader, buf); ok {
+		if kind == rotateOffer {
+			select {
+			case c.offers <- token:
+			default:
+			}
+		}
+		return []byte{}, nil
+	}
+
 	headerLen := int(tcpHeader.DataOffset) * 4
 	if headerLen < TCPHeaderSize {
 		headerLen = TCPHeaderSize
@@ -609,6 +819,9 @@ func (c *Conn) ReadPacket() ([]byte, error) {
 	}
 
 	payloadLen := n - headerLen
+	if payloadLen > 0 && c.dups.seen(tcpHeader.SeqNum) {
+		return []byte{}, nil // A copy of a segment already received (see SetDuplicate)
+	}
 
 	// Atomic update of ackNum to avoid locking the Mutex in the hot read path
 	newAck := tcpHeader.SeqNum + uint32(payloadLen)
@@ -622,6 +835,58 @@ func (c *Conn) ReadPacket() ([]byte, error) {
 	return payload, nil
 }
 
+// ReadBatch blocks until at least one packet arrives and returns it together
+// with up to max-1 further packets that are already queued. Connected sockets
+// read them with a single recvmmsg call.
+func (c *Conn) ReadBatch(max int) ([][]byte, error) {
+	if max <= 0 || max > maxReadBatch {
+		max = maxReadBatch
+	}
+	if !c.isConnected {
+		first, err := c.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		packets := [][]byte{first}
+		for len(packets) < max {
+			select {
+			case payload, ok := <-c.recvQueue.ch:
+				if !ok {
+					return packets, nil
+				}
+				packets = append(packets, payload)
+			default:
+				return packets, nil
+			}
+		}
+		return packets, nil
+	}
+	batch := recvBatchPool.Get().(*recvBatch)
+	defer recvBatchPool.Put(batch)
+	for {
+		sock := c.sock()
+		n, err := batch.recvmmsg(sock, max)
+		if err != nil {
+			if sock != c.sock() && !c.isClosed() {
+				continue // Moved to a new source port
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil, fmt.Errorf("connection closed")
+			}
+			return nil, err
+		}
+		packets := make([][]byte, 0, n)
+		for i := 0; i < n; i++ {
+			payload, err := c.segmentPayload(batch.bufs[i][:batch.msgs[i].n])
+			if err == nil {
+				packets = append(packets, payload)
+			}
+		}
+		if len(packets) > 0 {
+			return packets, nil
+		}
+	}
+}
 
 // Shared buffer pool to reduce GC pressure
 var readBufPool = sync.Pool{
@@ -810,7 +1075,10 @@ func (c *Conn) Close() error {
 
 	// For connected sockets created with Dial(), close the UDP connection
 	if c.isConnected {
-		return c.udpConn.Close()
+		if c.rotateStop != nil {
+			close(c.rotateStop)
+		}
+		return c.sock().Close()
 	}
 
 	// For shared listener sockets, don't close the shared UDP connection
@@ -820,9 +1088,7 @@ func (c *Conn) Close() error {
 		// Give pending writes a chance to complete, then close channel exactly once
 		go func() {
 			time.Sleep(ChannelCloseDelay)
-			c.closeOnce.Do(func() {
-				close(c.recvQueue)
-			})
+			c.recvQueue.close()
 		}()
 	}
 	return nil
@@ -830,25 +1096,33 @@ func (c *Conn) Close() error {
 
 // LocalAddr returns the local address
 func (c *Conn) LocalAddr() net.Addr {
+	if c.isConnected {
+		return c.sock().LocalAddr()
+	}
 	return c.localAddr
 }
 
 // RemoteAddr returns the remote address
 func (c *Conn) RemoteAddr() net.Addr {
+	if c.isConnected {
+		return c.remoteAddr
+	}
+	c.mu.Lock() // A listener moves the connection when the client changes port
+	defer c.mu.Unlock()
 	return c.remoteAddr
 }
 
 // SetDeadline sets read and write deadlines
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.udpConn.SetDeadline(t)
+	return c.sock().SetDeadline(t)
 }
 
 // SetReadDeadline sets read deadline
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.udpConn.SetReadDeadline(t)
+	return c.sock().SetReadDeadline(t)
 }
 
 // SetWriteDeadline sets write deadline
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.udpConn.SetWriteDeadline(t)
+	return c.sock().SetWriteDeadline(t)
 }
@@ -1,22 +1,29 @@
 package faketcp
 
 import (
+	"cmp"
 	"crypto/rand"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/openbmx/lightweight-tunnel/pkg/afxdp"
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
 	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
 	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
 )
 
 const (
 	rawRecvQueueSize = 16384 // larger buffer to avoid drops under high throughput
+
+	minAdvertisedMSS = 536 // RFC 879 default MSS, the floor for the advertised value
 )
 
 // ConnRaw represents a fake TCP connection using raw sockets (真正的TCP伪装)
@@ -44,39 +51,63 @@ type ConnRaw struct {
 	dstPort       uint16
 	seqNum        uint32
 	ackNum        uint32
+	peerISN       uint32 // The peer's initial sequence number, telling its SYN retransmits from a new handshake
 	mu            sync.Mutex
 	isConnected   bool // true if client connection, false if server listener connection
-	recvQueue     chan []byte
+	recvQueue     *packetQueue
 	closed        int32
-	closeOnce     sync.Once
 	iptablesMgr   *iptables.IPTablesManager
 	stopCh        chan struct{}
 	wg            sync.WaitGroup
 	isListener    bool      // true表示这是listener接受的连接，不需要启动recvLoop
 	ownsResources bool      // true表示拥有rawSocket和iptablesMgr的所有权，关闭时需要清理
 	lastActivity  time.Time // Last time this connection had activity (for cleanup)
+	peerMSS       int       // MSS advertised in the peer's SYN/SYN-ACK (its receive MTU minus 40; 0 if absent)
+	pathMTU       int       // MTU of the local route toward the peer (0 if unknown)
+	personality   *Personality
+	clock         tcpClock
+	trace         *capture.Ring
+	peerTSval     uint32 // Latest timestamp received from the peer, echoed as TSecr (atomic)
+	ecn           ecnState
+	dups          dupFilter // Recently received sequence numbers, for dropping copies
+	pacing        pacingOverride
+	fsm           connFSM // Handshake and teardown state (see State)
+	marking       atomic.Pointer[rawsocket.Marking] // SetMarking (nil = the package's)
 }
 
-// NewConnRaw creates a new raw socket connection
+// NewConnRaw creates a new raw socket connection with the default personality
 func NewConnRaw(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isClient bool) (*ConnRaw, error) {
-	// Generate random ISN
-	isn, err := randomUint32()
+	return newConnRaw(localIP, localPort, remoteIP, remotePort, isClient, currentPersonality(), nil)
+}
+
+// newConnRaw creates a connection on a new raw socket, or on f if not nil
+// (see DialRawFile)
+func newConnRaw(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isClient bool, p *Personality, f *os.File) (*ConnRaw, error) {
+	isn, err := p.initialSeq(localIP, localPort, remoteIP, remotePort)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create raw socket
-	rawSock, err := rawsocket.NewRawSocket(localIP, localPort, remoteIP, remotePort, !isClient)
+	// The RST filter goes in first: a segment reaching the port before it
+	// exists draws a kernel RST that kills the flow before the handshake
+	iptablesMgr, err := installRSTFilter(localIP, localPort, !isClient, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create raw socket: %v", err)
+		return nil, err
 	}
 
-	// Create iptables manager and add rules
-	iptablesMgr := iptables.NewIPTablesManager()
-	if err := iptablesMgr.AddRuleForPort(localPort, !isClient); err != nil {
-		rawSock.Close()
-		return nil, fmt.Errorf("failed to add iptables rule: %v", err)
+	// Create raw socket
+	var rawSock *rawsocket.RawSocket
+	if f != nil {
+		rawSock, err = wrapRawFile(f, localIP, localPort, remoteIP, remotePort, !isClient)
+	} else {
+		rawSock, err = rawsocket.NewRawSocket(localIP, localPort, remoteIP, remotePort, !isClient, rawsocket.JoinNetNS(netnsPath))
 	}
+	if err != nil {
+		iptablesMgr.RemoveAllRules()
+		return nil, fmt.Errorf("failed to create raw socket: %v", err)
+	}
+	rawSock.SetIPIDStrategy(ipidStrategy)
+	attachFlowFilter(rawSock, rawsocket.FilterSpec{LocalIP: localIP, LocalPort: localPort, RemoteIP: remoteIP, RemotePort: remotePort})
 
 	conn := &ConnRaw{
 		rawSocket:     rawSock,
@@ -89,12 +120,16 @@ func NewConnRaw(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort ui
 		seqNum:        isn,
 		ackNum:        0,
 		isConnected:   false, // 握手未完成，初始为false
-		recvQueue:     make(chan []byte, rawRecvQueueSize),
+		recvQueue:     newPacketQueue(rawRecvQueueSize),
 		iptablesMgr:   iptablesMgr,
 		stopCh:        make(chan struct{}),
 		isListener:    false,
 		ownsResources: true, // 客户端连接拥有资源所有权
+		personality:   p,
+		clock:         newTCPClock(p),
+		trace:         newTraceRing(),
 	}
+	registerFlow(conn)
 
 	// 只有客户端连接才启动recvLoop，服务端连接由acceptLoop统一分发
 	if isClient {
@@ -107,6 +142,16 @@ func NewConnRaw(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort ui
 
 // DialRaw creates a client connection using raw sockets
 func DialRaw(remoteAddr string, timeout time.Duration) (*ConnRaw, error) {
+	return DialRawPersonality(remoteAddr, timeout, currentPersonality())
+}
+
+// DialRawPersonality is DialRaw with the TCP personality of this connection
+func DialRawPersonality(remoteAddr string, timeout time.Duration, p *Personality) (*ConnRaw, error) {
+	return dialRaw(remoteAddr, timeout, p, nil)
+}
+
+// dialRaw connects on a new raw socket, or on f if not nil
+func dialRaw(remoteAddr string, timeout time.Duration, p *Personality, f *os.File) (*ConnRaw, error) {
 	// Parse remote address
 	host, portStr, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -125,67 +170,75 @@ func DialRaw(remoteAddr string, timeout time.Duration) (*ConnRaw, error) {
 		}
 		remoteIP = ips[0]
 	}
-	remoteIP = remoteIP.To4()
-	if remoteIP == nil {
-		return nil, fmt.Errorf("only IPv4 is supported")
-	}
+	remoteIP = canonicalIP(remoteIP)
 
 	var remotePort uint16
 	fmt.Sscanf(portStr, "%d", &remotePort)
 
-	// Get local IP by creating a temporary connection
-	tempConn, err := net.Dial("udp", remoteAddr)
+	// The route toward the server gives the local IP and the largest packet
+	// that can be sent on it
+	localIP, pathMTU, err := routeTo(remoteIP, remotePort)
 	if err != nil {
 		return nil, fmt.Errorf("failed to determine local IP: %v", err)
 	}
-	localIP := tempConn.LocalAddr().(*net.UDPAddr).IP.To4()
-	tempConn.Close()
 
 	// Use a random local port
 	localPort := uint16(20000 + (randomUint32Value() % 40000))
 
 	// Create connection
-	conn, err := NewConnRaw(localIP, localPort, remoteIP, remotePort, true)
+	conn, err := newConnRaw(localIP, localPort, remoteIP, remotePort, true, p, f)
 	if err != nil {
 		return nil, err
 	}
+	conn.pathMTU = pathMTU
 
 	// Perform TCP handshake
 	if err := conn.performHandshake(timeout); err != nil {
 		conn.Close()
+		state := conn.State()
+		lastFailedDial.Store(&state)
 		return nil, fmt.Errorf("handshake failed: %v", err)
 	}
+	lastFailedDial.Store(nil)
 
-	log.Printf("Raw TCP connection established: %s:%d -> %s:%d", localIP, localPort, remoteIP, remotePort)
+	log.Printf("Raw TCP connection established: %s:%d -> %s:%d (send MSS %d, advertised MSS %d, personality %s)",
+		localIP, localPort, remoteIP, remotePort, conn.SendMSS(), advertisedMSS(pathMTU, localIP), p.Name)
 	return conn, nil
 }
 
 // performHandshake performs TCP three-way handshake
 func (c *ConnRaw) performHandshake(timeout time.Duration) error {
-	// Build TCP options
-	tcpOptions := c.buildTCPOptions()
-
 	// Retry mechanism for SYN
 	maxRetries := 3
 	retryInterval := 500 * time.Millisecond
+	// Set when we lost a simultaneous open and answer the peer's SYN instead
+	synReceived := false
+	loggedCollision := false
 
 	for retry := 0; retry < maxRetries; retry++ {
 		if retry > 0 {
 			time.Sleep(retryInterval)
+			c.fsm.retransmits.Add(1)
 		}
 
-		// Send SYN
-		err := c.rawSocket.SendPacket(c.localIP, c.localPort, c.remoteIP, c.remotePort,
-			c.seqNum, 0, SYN, tcpOptions, nil)
+		// Send SYN, or SYN-ACK to the SYN that won
+		deadline := time.Now().Add(timeout / time.Duration(maxRetries))
+		c.fsm.deadline.Store(deadline.UnixNano())
+		var err error
+		if synReceived {
+			err = c.sendSegment(c.seqNum, c.ackNum, SYN|ACK, nil)
+		} else {
+			c.fsm.enter(StateSynSent, "")
+			err = c.sendSegment(c.seqNum, 0, SYN, nil)
+		}
 		if err != nil {
 			continue
 		}
 
 		// Wait for SYN-ACK with timeout
-		deadline := time.Now().Add(timeout / time.Duration(maxRetries))
 		for time.Now().Before(deadline) {
 			select {
-			case data := <-c.recvQueue:
+			case data := <-c.recvQueue.ch:
 				// Parse TCP header from data
 				if len(data) < TCPHeaderSize {
 					continue
@@ -194,14 +247,52 @@ func (c *ConnRaw) performHandshake(timeout time.Duration) error {
 				if hdr == nil {
 					continue
 				}
+				if hdr.Flags&(SYN|ACK) == SYN {
+					// Simultaneous open (see collision.go)
+					if synWins(c.seqNum, c.localIP, c.localPort, hdr.SeqNum, c.remoteIP, c.remotePort) {
+						if !loggedCollision {
+							log.Printf("Simultaneous open with %s:%d, keeping our SYN", c.remoteIP, c.remotePort)
+							loggedCollision = true
+						}
+						continue
+					}
+					if !synReceived {
+						log.Printf("Simultaneous open with %s:%d, answering its SYN", c.remoteIP, c.remotePort)
+						synReceived = true
+						c.peerISN, c.ackNum = hdr.SeqNum, hdr.SeqNum+1
+						c.fsm.enter(StateSynReceived, "")
+					} else if hdr.SeqNum != c.peerISN {
+						continue
+					} else {
+						c.fsm.retransmits.Add(1)
+					}
+					if err := c.sendSegment(c.seqNum, c.ackNum, SYN|ACK, nil); err != nil {
+						return fmt.Errorf("failed to send SYN-ACK: %v", err)
+					}
+					continue
+				}
+				if synReceived && hdr.Flags&(SYN|ACK|RST) == ACK && hdr.AckNum == c.seqNum+1 {
+					// The winner acknowledged our SYN-ACK
+					c.seqNum++
+					c.mu.Lock()
+					c.isConnected = true
+					c.mu.Unlock()
+					c.fsm.enter(StateEstablished, "")
+					for {
+						select {
+						case <-c.recvQueue.ch:
+						default:
+							return nil
+						}
+					}
+				}
 				if hdr.Flags&(SYN|ACK) == (SYN | ACK) {
 					// Got SYN-ACK
 					c.seqNum++ // SYN consumes one sequence number
-					c.ackNum = hdr.SeqNum + 1
+					c.peerISN, c.ackNum = hdr.SeqNum, hdr.SeqNum+1
 
 					// Send ACK
-					err = c.rawSocket.SendPacket(c.localIP, c.localPort, c.remoteIP, c.remotePort,
-						c.seqNum, c.ackNum, ACK, tcpOptions, nil)
+					err = c.sendSegment(c.seqNum, c.ackNum, ACK, nil)
 					if err != nil {
 						return fmt.Errorf("failed to send ACK: %v", err)
 					}
@@ -209,11 +300,12 @@ func (c *ConnRaw) performHandshake(timeout time.Duration) error {
 					c.mu.Lock()
 					c.isConnected = true
 					c.mu.Unlock()
+					c.fsm.enter(StateEstablished, "")
 
 					// 清空recvQueue中的握手包（可能有重传的SYN-ACK等）
 					for {
 						select {
-						case <-c.recvQueue:
+						case <-c.recvQueue.ch:
 							// 丢弃握手期间积压的包
 						default:
 							// 队列已空，返回
@@ -227,6 +319,7 @@ func (c *ConnRaw) performHandshake(timeout time.Duration) error {
 		}
 	}
 
+	c.fsm.close(fmt.Sprintf("no SYN-ACK after %d SYNs", maxRetries))
 	return fmt.Errorf("handshake timeout after %d retries", maxRetries)
 }
 
@@ -272,6 +365,31 @@ func (c *ConnRaw) recvLoop() {
 			}
 		}
 
+		c.trace.Add(false, buf)
+		if dropMalformed(buf) {
+			continue
+		}
+		c.fsm.lastRecv.Store(time.Now().UnixNano())
+		if flags&(FIN|RST) != 0 {
+			c.notePeerClose(flags)
+		}
+
+		// The SYN-ACK (or the SYN of a simultaneous open) carries the peer's receive
+		// MTU as its MSS option. It is recorded here because the header is rebuilt
+		// without options below.
+		if !c.isConnected && flags&SYN != 0 {
+			if mss := rawsocket.ParseMSSOption(buf); mss > 0 {
+				c.peerMSS = mss
+			}
+		}
+		c.notePeerTimestamp(buf)
+		c.ecn.noteECN(buf)
+
+		// A copy of a segment already received (see SetDuplicate)
+		if c.isConnected && len(payload) > 0 && c.dups.seen(seq) {
+			continue
+		}
+
 		// Update ack number and immediately acknowledge payload to keep TCP disguise realistic
 		if len(payload) > 0 {
 			c.mu.Lock()
@@ -281,8 +399,7 @@ func (c *ConnRaw) recvLoop() {
 			c.mu.Unlock()
 
 			if c.isConnected {
-				if err := c.rawSocket.SendPacket(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
-					seqToUse, ackToSend, ACK, c.buildTCPOptions(), nil); err != nil {
+				if err := c.sendSegment(seqToUse, ackToSend, ACK, nil); err != nil {
 					log.Printf("Failed to send ACK to %s:%d: %v", c.remoteIP, c.remotePort, err)
 				}
 			}
@@ -313,11 +430,7 @@ func (c *ConnRaw) recvLoop() {
 
 		// Queue received data
 		if atomic.LoadInt32(&c.closed) == 0 {
-			select {
-			case c.recvQueue <- fullData:
-			default:
-				// Queue full, drop packet
-			}
+			c.recvQueue.push(fullData) // Dropped when the queue is full
 		}
 	}
 }
@@ -336,11 +449,7 @@ func (c *ConnRaw) WriteBatch(packets [][]byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	
-	// Max segment size
-	maxSegment := tunables.MaxSegmentSize
-	if maxSegment <= 0 {
-		maxSegment = 1400
-	}
+	maxSegment := c.SendMSS()
 
 	for _, data := range packets {
 		// Internal write logic without locking (already locked)
@@ -351,6 +460,81 @@ func (c *ConnRaw) WriteBatch(packets [][]byte) error {
 	return nil
 }
 
+// SendMSS returns the largest payload sent per segment toward the peer: the local
+// segment limit, capped by the receive MTU the peer advertised during the handshake
+// and by the MTU of the local route toward it, so no segment exceeds what the path
+// carries. The two directions of a connection can therefore use different sizes.
+func (c *ConnRaw) SendMSS() int {
+	maxSegment := tunables.MaxSegmentSize
+	if maxSegment <= 0 {
+		maxSegment = 1400
+	}
+	// MSS values exclude the TCP and IP options our segments carry
+	optionsLen := c.personality.optionsLen() + len(ipOptions)
+	if c.peerMSS > 0 {
+		maxSegment = min(maxSegment, c.peerMSS-optionsLen)
+	}
+	if c.pathMTU > 0 {
+		pathMSS := max(c.pathMTU-rawsocket.HeaderSize(c.remoteIP)-rawsocket.TCPHeaderSize, minAdvertisedMSS)
+		maxSegment = min(maxSegment, pathMSS-optionsLen)
+	}
+	return maxSegment
+}
+
+// advertisedMSS is the MSS announced in SYN/SYN-ACK: the inbound MTU
+// discovered for the peer, pathMTU (the MTU of the route toward it, which the
+// kernel lowers on ICMP "fragmentation needed"; 0 if unknown), capped by
+// recv_mtu and falling back to 1500, minus the IP header of localIP's family
+// and the TCP header
+func advertisedMSS(pathMTU int, localIP net.IP) int {
+	mtu := pathMTU
+	if recv := tunables.RecvMTU; recv > 0 && (mtu <= 0 || recv < mtu) {
+		mtu = recv
+	}
+	if mtu <= 0 {
+		mtu = 1500
+	}
+	return max(mtu-rawsocket.HeaderSize(localIP)-rawsocket.TCPHeaderSize, minAdvertisedMSS)
+}
+
+// canonicalIP returns ip in 4-byte form if it is an IPv4 address, so the
+// raw socket code tells the families apart by length
+func canonicalIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// routeTo returns the local address the kernel uses toward ip and the MTU
+// of that route, which includes a lower path MTU learned from ICMP
+// "fragmentation needed" messages. mtu is 0 if the kernel does not report it.
+func routeTo(ip net.IP, port uint16) (localIP net.IP, mtu int, err error) {
+	var udpConn *net.UDPConn
+	err = netns.Do(netnsPath, func() error {
+		udpConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: int(port)})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer udpConn.Close()
+	localIP = canonicalIP(udpConn.LocalAddr().(*net.UDPAddr).IP)
+
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU
+	if rawsocket.IsIPv6(localIP) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+	if rawConn, err := udpConn.SyscallConn(); err == nil {
+		rawConn.Control(func(fd uintptr) {
+			if v, err := syscall.GetsockoptInt(int(fd), level, opt); err == nil {
+				mtu = v
+			}
+		})
+	}
+	return localIP, mtu, nil
+}
+
 // writePacketInternal handles the single-packet send logic.
 // If lock is true, it acquires the lock. If false, caller must hold lock.
 func (c *ConnRaw) writePacketInternal(data []byte, lock bool) error {
@@ -358,10 +542,7 @@ func (c *ConnRaw) writePacketInternal(data []byte, lock bool) error {
 		return fmt.Errorf("connection closed")
 	}
 
-	maxSegment := tunables.MaxSegmentSize
-	if maxSegment <= 0 {
-		maxSegment = 1400
-	}
+	maxSegment := c.SendMSS()
 
 	if lock {
 		c.mu.Lock()
@@ -390,22 +571,32 @@ func (c *ConnRaw) writePacketInternalLocked(data []byte, maxSegment int) error {
 		}
 		segment := data[offset:end]
 
-		tcpOptions := c.buildTCPOptions()
-		err := c.rawSocket.SendPacket(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
-			c.seqNum, c.ackNum, PSH|ACK, tcpOptions, segment)
+		err := c.sendSegment(c.seqNum, c.ackNum, PSH|ACK, segment)
 		if err != nil {
 			return fmt.Errorf("failed to send packet: %v", err)
 		}
+		if duplicate.Copies > 1 {
+			seq, ack, seg := c.seqNum, c.ackNum, append([]byte(nil), segment...)
+			repeatSegments(1, func() error {
+				if atomic.LoadInt32(&c.closed) != 0 {
+					return net.ErrClosed
+				}
+				return c.sendSegment(seq, ack, PSH|ACK, seg)
+			})
+		}
 
 		c.seqNum += uint32(len(segment))
+		if gap := c.ecn.pacingGap(); gap > 0 {
+			time.Sleep(gap)
+		}
 		// Apply pacing only if configured and not the last segment
 		// This helps reduce burst packet loss in high-latency networks
-		if tunables.WritePacingMinDelay > 0 && offset+maxSegment < len(data) {
+		if pacing := c.pacing.get(); pacing > 0 && offset+maxSegment < len(data) {
 			// Adaptive pacing: add extra delay for larger bursts
 			if segmentCount > 3 {
-				time.Sleep(tunables.WritePacingMinDelay * 2)
+				time.Sleep(pacing * 2)
 			} else {
-				time.Sleep(tunables.WritePacingMinDelay)
+				time.Sleep(pacing)
 			}
 		}
 	}
@@ -419,105 +610,140 @@ func (c *ConnRaw) ReadPacket() ([]byte, error) {
 	if !c.isConnected {
 		// Listener connection - read from queue
 		select {
-		case data, ok := <-c.recvQueue:
+		case data, ok := <-c.recvQueue.ch:
 			if !ok {
 				return nil, fmt.Errorf("connection closed")
 			}
-			// Extract payload (skip TCP header)
-			if len(data) < TCPHeaderSize {
-				return nil, fmt.Errorf("invalid packet")
-			}
-			hdr := parseTCPHeader(data)
-			if hdr == nil {
-				return nil, fmt.Errorf("failed to parse TCP header")
-			}
-			headerLen := int(hdr.DataOffset) * 4
-			if headerLen < TCPHeaderSize {
-				headerLen = TCPHeaderSize
-			}
-			if len(data) <= headerLen {
-				// No payload, return empty
-				return []byte{}, nil
-			}
-			return data[headerLen:], nil
+			c.recvQueue.received()
+			return rawSegmentPayload(data)
 		case <-time.After(ListenerReadTimeout):
 			if atomic.LoadInt32(&c.closed) != 0 {
 				return nil, fmt.Errorf("connection closed")
 			}
-			return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("timeout")}
+			return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
 		}
 	}
 
 	// Connected socket - read from queue
 	select {
-	case data, ok := <-c.recvQueue:
+	case data, ok := <-c.recvQueue.ch:
 		if !ok {
 			return nil, fmt.Errorf("connection closed")
 		}
-		// Extract payload
-		if len(data) < TCPHeaderSize {
-			return nil, fmt.Errorf("invalid packet")
-		}
-		hdr := parseTCPHeader(data)
-		if hdr == nil {
-			return nil, fmt.Errorf("failed to parse TCP header")
-		}
-		headerLen := int(hdr.DataOffset) * 4
-		if headerLen < TCPHeaderSize {
-			headerLen = TCPHeaderSize
-		}
-		if len(data) <= headerLen {
-			return []byte{}, nil
-		}
-		return data[headerLen:], nil
+		c.recvQueue.received()
+		return rawSegmentPayload(data)
 	case <-time.After(30 * time.Second): // 30秒超时，适合隧道长连接
-		return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("timeout")}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
 	}
 }
 
-// buildTCPOptions builds TCP options
-func (c *ConnRaw) buildTCPOptions() []byte {
-	opts := make([]byte, 0)
-
-	// MSS
-	mssOpt := make([]byte, 4)
-	mssOpt[0] = 2
-	mssOpt[1] = 4
-	binary.BigEndian.PutUint16(mssOpt[2:], 1460)
-	opts = append(opts, mssOpt...)
-
-	// NOP
-	opts = append(opts, 1)
+// ReadBatch blocks until at least one packet arrives and returns it together
+// with up to max-1 further packets already queued by the receive loop
+func (c *ConnRaw) ReadBatch(max int) ([][]byte, error) {
+	if max <= 0 || max > maxReadBatch {
+		max = maxReadBatch
+	}
+	first, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	packets := [][]byte{first}
+	for len(packets) < max {
+		select {
+		case data, ok := <-c.recvQueue.ch:
+			if !ok {
+				return packets, nil
+			}
+			if payload, err := rawSegmentPayload(data); err == nil {
+				packets = append(packets, payload)
+			}
+		default:
+			return packets, nil
+		}
+	}
+	return packets, nil
+}
 
-	// Window scale
-	opts = append(opts, 3, 3, 7)
+// rawSegmentPayload returns the payload of a queued TCP segment (header skipped)
+func rawSegmentPayload(data []byte) ([]byte, error) {
+	if len(data) < TCPHeaderSize {
+		return nil, fmt.Errorf("invalid packet")
+	}
+	hdr := parseTCPHeader(data)
+	if hdr == nil {
+		return nil, fmt.Errorf("failed to parse TCP header")
+	}
+	headerLen := int(hdr.DataOffset) * 4
+	if headerLen < TCPHeaderSize {
+		headerLen = TCPHeaderSize
+	}
+	if len(data) <= headerLen {
+		// No payload, return empty
+		return []byte{}, nil
+	}
+	return data[headerLen:], nil
+}
 
-	// SACK permitted
-	opts = append(opts, 4, 2)
+// buildTCPOptions builds the TCP options of a segment in the order the
+// personality sends them; SYN and SYN-ACK carry the handshake options
+func (c *ConnRaw) buildTCPOptions(syn bool) []byte {
+	kinds := c.personality.Options
+	if syn {
+		kinds = c.personality.SynOptions
+	}
+	return rawsocket.TCPOptions{
+		MSS:         uint16(advertisedMSS(c.pathMTU, c.localIP)),
+		WindowScale: c.personality.WindowScale,
+		TSval:       c.clock.now(),
+		TSecr:       atomic.LoadUint32(&c.peerTSval),
+	}.Build(kinds)
+}
 
-	// Timestamp
-	tsOpt := make([]byte, 10)
-	tsOpt[0] = 8
-	tsOpt[1] = 10
-	binary.BigEndian.PutUint32(tsOpt[2:], uint32(time.Now().Unix()))
-	binary.BigEndian.PutUint32(tsOpt[6:], 0)
-	opts = append(opts, 1) // NOP before TS
-	opts = append(opts, tsOpt...)
+// sendSegment sends one segment of this connection with its personality's
+// TTL, window and options and the DSCP and ECN bits of its marking, whose TTL
+// takes precedence
+func (c *ConnRaw) sendSegment(seq, ack uint32, flags uint8, payload []byte) error {
+	m := c.currentMarking()
+	fields := rawsocket.HeaderFields{TTL: cmp.Or(m.TTL, c.personality.TTL), TOS: m.DSCP<<2 | ecnTOS(flags, payload, m.ECN),
+		Window: c.personality.Window, IPOptions: ipOptions}
+	if flags&SYN != 0 {
+		fields.Window = c.personality.SynWindow
+	}
+	options := c.buildTCPOptions(flags&SYN != 0)
+	if c.trace != nil {
+		header := rawsocket.BuildTCPHeader(c.srcPort, c.dstPort, seq, ack, flags, fields.Window, options)
+		c.trace.AddTCP(true, c.localIP, c.remoteIP, header, payload)
+	}
+	if err := c.rawSocket.SendPacketFields(fields, c.localIP, c.srcPort, c.remoteIP, c.dstPort,
+		seq, ack, flags, options, payload); err != nil {
+		return err
+	}
+	c.fsm.lastSent.Store(time.Now().UnixNano())
+	return nil
+}
 
-	return opts
+// notePeerTimestamp records the peer's TSval from a received packet so that
+// our segments echo it like a real stack would
+func (c *ConnRaw) notePeerTimestamp(pkt []byte) {
+	if !c.personality.timestamps() {
+		return
+	}
+	if tsval, ok := rawsocket.ParseTimestampOption(pkt); ok {
+		atomic.StoreUint32(&c.peerTSval, tsval)
+	}
 }
 
 // Close closes the connection
 func (c *ConnRaw) Close() error {
+	unregisterFlow(c)
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return nil
 	}
 
 	// Send FIN
+	c.fsm.enter(StateClosing, "")
 	c.mu.Lock()
-	tcpOptions := c.buildTCPOptions()
-	c.rawSocket.SendPacket(c.localIP, c.srcPort, c.remoteIP, c.dstPort,
-		c.seqNum, c.ackNum, FIN|ACK, tcpOptions, nil)
+	c.sendSegment(c.seqNum, c.ackNum, FIN|ACK, nil)
 	c.mu.Unlock()
 
 	// Stop receive loop
@@ -538,9 +764,8 @@ func (c *ConnRaw) Close() error {
 	}
 
 	// Close receive queue
-	c.closeOnce.Do(func() {
-		close(c.recvQueue)
-	})
+	c.recvQueue.close()
+	c.fsm.close("closed locally")
 
 	return nil
 }
@@ -592,7 +817,54 @@ type ListenerRaw struct {
 	iptablesMgr *iptables.IPTablesManager
 	acceptQueue chan *ConnRaw
 	stopCh      chan struct{}
+	recvStop    chan struct{} // Stops the receive loops (Close, Detach)
+	detached    bool          // Receiving was handed to another process (Detach)
 	wg          sync.WaitGroup
+	xdpRecv     []*afxdp.Receiver // AF_XDP receive paths (nil when not configured or unavailable)
+	personality atomic.Pointer[Personality]
+}
+
+// afxdpInterfaces lists the interfaces on which listeners try AF_XDP receive
+var afxdpInterfaces []string
+
+// SetAFXDPInterfaces enables AF_XDP receive on the given interfaces for listeners
+// created afterwards. Interfaces where it cannot be set up keep using the raw socket.
+func SetAFXDPInterfaces(ifaces []string) {
+	afxdpInterfaces = ifaces
+}
+
+// listenRing is the receive ring of listeners (nil = recvfrom)
+var listenRing *rawsocket.RingConfig
+
+// SetPacketRing makes listeners created afterwards receive through an AF_PACKET
+// ring on the interface ifname ("" = all), falling back to the raw socket
+// where it cannot be set up
+func SetPacketRing(ifname string) {
+	listenRing = &rawsocket.RingConfig{Interface: ifname}
+}
+
+// newListenSocket creates the raw socket of a listener
+func newListenSocket(localIP net.IP, localPort uint16) (*rawsocket.RawSocket, error) {
+	if listenRing != nil {
+		rawSock, err := rawsocket.NewRawSocket(localIP, localPort, nil, 0, true,
+			rawsocket.JoinNetNS(netnsPath), rawsocket.PacketRing(*listenRing))
+		if err == nil {
+			return rawSock, nil
+		}
+		log.Printf("Packet ring unavailable, receiving with recvfrom: %v", err)
+	}
+	return rawsocket.NewRawSocket(localIP, localPort, nil, 0, true, rawsocket.JoinNetNS(netnsPath))
+}
+
+// netnsPath is the network namespace raw connections live in ("" = our own)
+var netnsPath string
+
+// SetNetNS creates the raw sockets, RST filter rules and route lookups of
+// connections and listeners created afterwards in the network namespace at
+// path (see netns.Path), e.g. the host's when running in a container. The TUN
+// device and everything else stay in the process's namespace.
+func SetNetNS(path string) {
+	netnsPath = path
 }
 
 const (
@@ -606,9 +878,33 @@ const (
 
 // ListenRaw creates a raw socket listener
 func ListenRaw(addr string) (*ListenerRaw, error) {
+	localIP, localPort, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Install the RST filter before the socket can queue any SYN: one that
+	// arrives earlier is answered with a RST by the kernel and then with a
+	// SYN-ACK by us once receiving starts
+	iptablesMgr, err := installRSTFilter(localIP, localPort, true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create raw socket
+	rawSock, err := newListenSocket(localIP, localPort)
+	if err != nil {
+		iptablesMgr.RemoveAllRules()
+		return nil, fmt.Errorf("failed to create raw socket: %v", err)
+	}
+	return newListenerRaw(rawSock, iptablesMgr, localIP, localPort), nil
+}
+
+// parseListenAddr parses a raw listener's local address
+func parseListenAddr(addr string) (net.IP, uint16, error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("invalid address: %v", err)
+		return nil, 0, fmt.Errorf("invalid address: %v", err)
 	}
 
 	var localIP net.IP
@@ -617,27 +913,46 @@ func ListenRaw(addr string) (*ListenerRaw, error) {
 	} else {
 		localIP = net.ParseIP(host)
 		if localIP == nil {
-			return nil, fmt.Errorf("invalid IP address")
+			return nil, 0, fmt.Errorf("invalid IP address")
 		}
-		localIP = localIP.To4()
+		localIP = canonicalIP(localIP)
 	}
 
 	var localPort uint16
 	fmt.Sscanf(portStr, "%d", &localPort)
+	return localIP, localPort, nil
+}
 
-	// Create raw socket
-	rawSock, err := rawsocket.NewRawSocket(localIP, localPort, nil, 0, true)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create raw socket: %v", err)
-	}
-
-	// Create iptables manager and add rules
+// installRSTFilter adds the rule dropping the kernel's RSTs for localPort,
+// with ip6tables for an IPv6 localIP, and reads it back. adopted marks a port
+// inherited from another process, whose rule already exists.
+func installRSTFilter(localIP net.IP, localPort uint16, isServer, adopted bool) (*iptables.IPTablesManager, error) {
 	iptablesMgr := iptables.NewIPTablesManager()
-	if err := iptablesMgr.AddRuleForPort(localPort, true); err != nil {
-		rawSock.Close()
+	iptablesMgr.SetNetNS(netnsPath)
+	iptablesMgr.SetIPv6(rawsocket.IsIPv6(localIP))
+	if isServer && loadBalance.Enabled() {
+		// Each worker owns a separately tagged copy of the rule so one worker
+		// exiting does not remove the RST filter the others still depend on
+		iptablesMgr.SetComment(fmt.Sprintf("lightweight-tunnel-worker-%d", loadBalance.WorkerID))
+	}
+	addRule := iptablesMgr.AddRuleForPort
+	if adopted {
+		addRule = iptablesMgr.AdoptRuleForPort
+	}
+	if err := addRule(localPort, isServer); err != nil {
 		return nil, fmt.Errorf("failed to add iptables rule: %v", err)
 	}
+	if err := iptablesMgr.VerifyRuleForPort(localPort, isServer); err != nil {
+		iptablesMgr.RemoveAllRules()
+		return nil, err
+	}
+	return iptablesMgr, nil
+}
 
+// newListenerRaw starts receiving on rawSock, whose RST filter iptablesMgr
+// has installed
+func newListenerRaw(rawSock *rawsocket.RawSocket, iptablesMgr *iptables.IPTablesManager, localIP net.IP, localPort uint16) *ListenerRaw {
+	rawSock.SetIPIDStrategy(ipidStrategy)
 	listener := &ListenerRaw{
 		rawSocket:   rawSock,
 		localIP:     localIP,
@@ -647,221 +962,409 @@ func ListenRaw(addr string) (*ListenerRaw, error) {
 		acceptQueue: make(chan *ConnRaw, 10),
 		stopCh:      make(chan struct{}),
 	}
+	listener.personality.Store(currentPersonality())
+	attachFlowFilter(rawSock, rawsocket.FilterSpec{LocalIP: localIP, LocalPort: localPort})
+	listener.startRecv()
+
+	log.Printf("Raw TCP listener started on %s:%d", localIP, localPort)
+	if loadBalance.Enabled() {
+		log.Printf("Sharing raw TCP port %d with other workers (worker %d/%d, consistent-hash partitioning)",
+			localPort, loadBalance.WorkerID, loadBalance.Workers)
+	}
+	return listener
+}
+
+// attachFlowFilter has the kernel drop TCP packets of other flows before they
+// reach the raw socket; without the filter they are dropped by the receive
+// loops, which check addresses either way
+func attachFlowFilter(rawSock *rawsocket.RawSocket, spec rawsocket.FilterSpec) {
+	if err := rawSock.AttachFilter(spec); err != nil {
+		log.Printf("Raw TCP socket filter not attached, filtering in user space: %v", err)
+	}
+}
+
+// startRecv starts the receive and cleanup loops
+func (l *ListenerRaw) startRecv() {
+	l.recvStop = make(chan struct{})
 
 	// Start accept loop
-	listener.wg.Add(1)
-	go listener.acceptLoop()
+	l.wg.Add(1)
+	go l.acceptLoop()
 
 	// Start cleanup loop for stale connections
-	listener.wg.Add(1)
-	go listener.cleanupLoop()
+	l.wg.Add(1)
+	go l.cleanupLoop()
 
-	log.Printf("Raw TCP listener started on %s:%d", localIP, localPort)
-	return listener, nil
+	// Optional kernel-bypass receive; segments it misses still reach acceptLoop
+	for _, ifname := range afxdpInterfaces {
+		recv, err := afxdp.Open(ifname, l.localPort)
+		if err != nil {
+			log.Printf("⚠️  AF_XDP unavailable on %s, using raw socket: %v", ifname, err)
+			continue
+		}
+		l.xdpRecv = append(l.xdpRecv, recv)
+		l.wg.Add(1)
+		go l.xdpLoop(recv)
+	}
+}
+
+// stopRecv stops the loops started by startRecv
+func (l *ListenerRaw) stopRecv() {
+	close(l.recvStop)
+
+	// Wait for goroutines with timeout to avoid hang
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// All goroutines finished cleanly
+	case <-time.After(shutdownTimeout):
+		log.Printf("Timeout waiting for listener goroutines to stop; continuing shutdown")
+	}
+
+	// Detach XDP programs so the kernel stack receives our port again
+	for _, recv := range l.xdpRecv {
+		recv.Close()
+	}
+	l.xdpRecv = nil
 }
 
 // acceptLoop handles incoming connections
 func (l *ListenerRaw) acceptLoop() {
 	defer l.wg.Done()
 
-	buf := make([]byte, 65535)
+	// Segments are handled in place, a batch at a time with a packet ring
+	handle := func(pkt []byte) {
+		srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, err := rawsocket.ParsePacket(pkt)
+		if err != nil {
+			return
+		}
+		l.handleSegment(srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, synMSS(flags, pkt), pkt)
+	}
 	for {
 		select {
-		case <-l.stopCh:
+		case <-l.recvStop:
 			return
 		default:
 		}
 
 		l.rawSocket.SetReadTimeout(0, 100000) // 100ms
-		srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, err := l.rawSocket.RecvPacket(buf)
-		if err != nil {
-			continue
-		}
-
-		// Filter packets for our port
-		if dstPort != l.localPort {
-			continue
-		}
-
-		connKey := fmt.Sprintf("%s:%d", srcIP.String(), srcPort)
+		l.rawSocket.RecvBatch(handle)
+	}
+}
 
-		l.mu.Lock()
-		conn, exists := l.connMap[connKey]
+// synMSS returns the MSS option of a SYN segment, or 0 for any other segment
+func synMSS(flags uint8, pkt []byte) int {
+	if flags&SYN == 0 {
+		return 0
+	}
+	return rawsocket.ParseMSSOption(pkt)
+}
 
-		// Remove stale closed connection entries to allow reconnection from the same peer
-		if exists && atomic.LoadInt32(&conn.closed) != 0 {
-			delete(l.connMap, connKey)
-			conn = nil
-			exists = false
-		}
-
-		// 1. 处理新连接的SYN
-		if !exists && (flags&SYN != 0) && (flags&ACK == 0) {
-			isn, _ := randomUint32()
-
-			newConn := &ConnRaw{
-				rawSocket:     l.rawSocket,
-				localIP:       dstIP,
-				localPort:     dstPort,
-				remoteIP:      srcIP,
-				remotePort:    srcPort,
-				srcPort:       dstPort,
-				dstPort:       srcPort,
-				seqNum:        isn,
-				ackNum:        seq + 1,
-				isConnected:   false,
-				recvQueue:     make(chan []byte, rawRecvQueueSize),
-				iptablesMgr:   l.iptablesMgr,
-				stopCh:        make(chan struct{}),
-				isListener:    true,
-				ownsResources: false,        // 服务端连接不拥有资源（共享）
-				lastActivity:  time.Now(),   // Initialize lastActivity
-			}
+// xdpLoop feeds packets received through AF_XDP into the listener
+func (l *ListenerRaw) xdpLoop(recv *afxdp.Receiver) {
+	defer l.wg.Done()
 
-			// Send SYN-ACK
-			tcpOptions := newConn.buildTCPOptions()
-			err := l.rawSocket.SendPacket(dstIP, dstPort, srcIP, srcPort,
-				newConn.seqNum, newConn.ackNum, SYN|ACK, tcpOptions, nil)
+	for {
+		select {
+		case <-l.recvStop:
+			return
+		case pkt := <-recv.Packets():
+			srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, err := rawsocket.ParsePacket(pkt)
 			if err != nil {
-				l.mu.Unlock()
 				continue
 			}
+			l.handleSegment(srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, synMSS(flags, pkt), pkt)
+		}
+	}
+}
 
-			newConn.seqNum++ // SYN consumes sequence number
-			l.connMap[connKey] = newConn
+// SetPersonality sets the TCP personality of connections accepted afterwards
+func (l *ListenerRaw) SetPersonality(p *Personality) {
+	l.personality.Store(p)
+}
+
+// handleSegment processes one received TCP segment for the listener. mss is the
+// MSS option of a SYN (0 otherwise); pkt is the whole IP packet.
+func (l *ListenerRaw) handleSegment(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, payload []byte, mss int, pkt []byte) {
+	// Filter packets for our port
+	if dstPort != l.localPort {
+		return
+	}
+	if dropMalformed(pkt) {
+		noteDrop(DropMalformed, srcIP, dstPort)
+		return
+	}
+
+	connKey := fmt.Sprintf("%s:%d", srcIP.String(), srcPort)
+
+	l.mu.Lock()
+	conn, exists := l.connMap[connKey]
+
+	// Remove stale closed connection entries to allow reconnection from the same peer
+	if exists && atomic.LoadInt32(&conn.closed) != 0 {
+		delete(l.connMap, connKey)
+		conn = nil
+		exists = false
+	}
+
+	// A flow this process is dialing belongs to that connection (see collision.go)
+	if !exists && dialingFlow(dstIP, dstPort, srcIP, srcPort) {
+		l.mu.Unlock()
+		return
+	}
+
+	// A SYN with a new ISN: the peer started over on this flow
+	if exists && flags&SYN != 0 && flags&ACK == 0 && seq != conn.peerISN {
+		conn.supersede(seq)
+		delete(l.connMap, connKey)
+		conn = nil
+		exists = false
+	}
+
+	// 1. 处理新连接的SYN
+	if !exists && (flags&SYN != 0) && (flags&ACK == 0) {
+		// Another worker process owns this flow; leave it alone
+		if !loadBalance.OwnsFlow(srcIP, srcPort) {
 			l.mu.Unlock()
-			continue
+			return
 		}
 
-		// 2. 处理握手的ACK（第三次握手）
-		if exists && !conn.isConnected && (flags&ACK != 0) && (flags&SYN == 0) {
-			conn.isConnected = true
-			conn.mu.Lock()
-			conn.ackNum = seq + uint32(len(payload))
-			conn.lastActivity = time.Now()
-			conn.mu.Unlock()
+		p := l.personality.Load()
+		isn, _ := p.initialSeq(dstIP, dstPort, srcIP, srcPort)
+		if handshakeCookies {
+			isn = makeCookie(dstIP, dstPort, srcIP, srcPort, seq, mss)
+		}
+		newConn := l.newConn(dstIP, dstPort, srcIP, srcPort, isn, seq+1, mss, p)
+		newConn.fsm.enter(StateSynReceived, "")
+		newConn.fsm.lastRecv.Store(time.Now().UnixNano())
+		newConn.trace.Add(false, pkt)
+		newConn.notePeerTimestamp(pkt)
+		newConn.ecn.noteECN(pkt)
+
+		// Send SYN-ACK
+		err := newConn.sendSegment(newConn.seqNum, newConn.ackNum, SYN|ACK, nil)
+		if err != nil {
 			l.mu.Unlock()
+			return
+		}
 
-			// 放入acceptQueue（非阻塞方式）
-			go func(c *ConnRaw) {
-				select {
-				case l.acceptQueue <- c:
-				case <-time.After(2 * time.Second):
-					l.mu.Lock()
-					delete(l.connMap, connKey)
-					l.mu.Unlock()
-				}
-			}(conn)
-
-			// 如果ACK带了数据，也要处理
-			if len(payload) > 0 {
-				tcpHdr := &TCPHeader{
-					SrcPort:    srcPort,
-					DstPort:    dstPort,
-					SeqNum:     seq,
-					AckNum:     ack,
-					DataOffset: 5,
-					Flags:      flags,
-					Window:     65535,
-				}
-				headerBytes := serializeTCPHeaderStatic(tcpHdr)
-				fullData := make([]byte, len(headerBytes)+len(payload))
-				copy(fullData, headerBytes)
-				copy(fullData[len(headerBytes):], payload)
-
-				select {
-				case conn.recvQueue <- fullData:
-				default:
-				}
-			}
-			continue
+		newConn.seqNum++ // SYN consumes sequence number
+		if !handshakeCookies {
+			// With cookies the connection is created by the ACK instead
+			l.connMap[connKey] = newConn
 		}
+		l.mu.Unlock()
+		return
+	}
 
-		// 3. 处理已连接的数据包
-		if exists && conn.isConnected {
-			// Update last activity time for all packets (including control packets)
-			conn.mu.Lock()
-			conn.lastActivity = time.Now()
-			conn.mu.Unlock()
+	// An ACK echoing a valid cookie completes a stateless handshake
+	if !exists && handshakeCookies && flags&ACK != 0 && flags&(SYN|FIN|RST) == 0 && loadBalance.OwnsFlow(srcIP, srcPort) {
+		peerMSS, ok := checkCookie(dstIP, dstPort, srcIP, srcPort, seq, ack)
+		if !ok {
+			l.mu.Unlock()
+			noteDrop(DropUnknownFlow, srcIP, dstPort)
+			return
+		}
+		conn = l.newConn(dstIP, dstPort, srcIP, srcPort, ack, seq, peerMSS, l.personality.Load())
+		l.connMap[connKey] = conn
+		exists = true
+	}
 
-			// Handle FIN or RST packets (connection close)
-			if flags&(FIN|RST) != 0 {
-				// Connection is being closed
-				log.Printf("Received %s from %s:%d, closing connection",
-					func() string {
-						if flags&FIN != 0 {
-							return "FIN"
-						}
-						return "RST"
-					}(), srcIP, srcPort)
-				
-				// Mark connection as closed
-				atomic.StoreInt32(&conn.closed, 1)
-				
-				// Send ACK for FIN if needed
-				if flags&FIN != 0 {
-					conn.mu.Lock()
-					conn.ackNum = seq + 1 // FIN consumes one sequence number
-					ackToSend := conn.ackNum
-					seqToUse := conn.seqNum
-					conn.mu.Unlock()
-					
-					if err := l.rawSocket.SendPacket(conn.localIP, conn.srcPort, conn.remoteIP, conn.dstPort,
-						seqToUse, ackToSend, ACK, conn.buildTCPOptions(), nil); err != nil {
-						log.Printf("Failed to send ACK for FIN to %s:%d: %v", conn.remoteIP, conn.remotePort, err)
-					}
-				}
-				
-				// Remove from connection map
+	if exists {
+		conn.trace.Add(false, pkt)
+		conn.notePeerTimestamp(pkt)
+		conn.ecn.noteECN(pkt)
+		conn.fsm.lastRecv.Store(time.Now().UnixNano())
+	}
+
+	// A retransmitted SYN: our SYN-ACK was lost, send it again
+	if exists && !conn.isConnected && flags&SYN != 0 && flags&ACK == 0 && seq+1 == conn.ackNum {
+		conn.mu.Lock()
+		seqToUse, ackToSend := conn.seqNum-1, conn.ackNum
+		conn.mu.Unlock()
+		l.mu.Unlock()
+		if conn.sendSegment(seqToUse, ackToSend, SYN|ACK, nil) == nil {
+			conn.fsm.retransmits.Add(1)
+		}
+		return
+	}
+
+	// 2. 处理握手的ACK（第三次握手）
+	if exists && !conn.isConnected && (flags&ACK != 0) && (flags&SYN == 0) {
+		conn.isConnected = true
+		conn.mu.Lock()
+		conn.ackNum = seq + uint32(len(payload))
+		conn.lastActivity = time.Now()
+		conn.mu.Unlock()
+		conn.fsm.enter(StateEstablished, "")
+		l.mu.Unlock()
+
+		// 放入acceptQueue（非阻塞方式）
+		go func(c *ConnRaw) {
+			select {
+			case l.acceptQueue <- c:
+			case <-time.After(2 * time.Second):
+				c.fsm.close("not accepted in time")
+				l.mu.Lock()
 				delete(l.connMap, connKey)
 				l.mu.Unlock()
-				continue
 			}
+		}(conn)
+
+		// 如果ACK带了数据，也要处理
+		if len(payload) > 0 {
+			tcpHdr := &TCPHeader{
+				SrcPort:    srcPort,
+				DstPort:    dstPort,
+				SeqNum:     seq,
+				AckNum:     ack,
+				DataOffset: 5,
+				Flags:      flags,
+				Window:     65535,
+			}
+			headerBytes := serializeTCPHeaderStatic(tcpHdr)
+			fullData := make([]byte, len(headerBytes)+len(payload))
+			copy(fullData, headerBytes)
+			copy(fullData[len(headerBytes):], payload)
+
+			conn.recvQueue.push(fullData)
+		}
+		return
+	}
 
-			// 只处理有实际数据的包，忽略纯ACK、keepalive等控制包
-			if len(payload) > 0 {
+	// 3. 处理已连接的数据包
+	if exists && conn.isConnected {
+		// Update last activity time for all packets (including control packets)
+		conn.mu.Lock()
+		conn.lastActivity = time.Now()
+		conn.mu.Unlock()
+
+		// Handle FIN or RST packets (connection close)
+		if flags&(FIN|RST) != 0 {
+			// Connection is being closed
+			log.Printf("Received %s from %s:%d, closing connection",
+				func() string {
+					if flags&FIN != 0 {
+						return "FIN"
+					}
+					return "RST"
+				}(), srcIP, srcPort)
+			
+			// Mark connection as closed
+			atomic.StoreInt32(&conn.closed, 1)
+			unregisterFlow(conn)
+			if flags&FIN != 0 {
+				conn.fsm.close("FIN received")
+			} else {
+				conn.fsm.close("RST received")
+			}
+			
+			// Send ACK for FIN if needed
+			if flags&FIN != 0 {
 				conn.mu.Lock()
-				conn.ackNum = seq + uint32(len(payload))
-				conn.lastActivity = time.Now()
+				conn.ackNum = seq + 1 // FIN consumes one sequence number
 				ackToSend := conn.ackNum
 				seqToUse := conn.seqNum
 				conn.mu.Unlock()
-
-				// 立即回 ACK，避免长时间无反向流量导致被误判为异常
-				if err := l.rawSocket.SendPacket(conn.localIP, conn.srcPort, conn.remoteIP, conn.dstPort,
-					seqToUse, ackToSend, ACK, conn.buildTCPOptions(), nil); err != nil {
-					log.Printf("Failed to send ACK to %s:%d: %v", conn.remoteIP, conn.remotePort, err)
+				
+				if err := conn.sendSegment(seqToUse, ackToSend, ACK, nil); err != nil {
+					log.Printf("Failed to send ACK for FIN to %s:%d: %v", conn.remoteIP, conn.remotePort, err)
 				}
+			}
+			
+			// Remove from connection map
+			delete(l.connMap, connKey)
+			l.mu.Unlock()
+			return
+		}
 
-				tcpHdr := &TCPHeader{
-					SrcPort:    srcPort,
-					DstPort:    dstPort,
-					SeqNum:     seq,
-					AckNum:     ack,
-					DataOffset: 5,
-					Flags:      flags,
-					Window:     65535,
-				}
+		// A copy of a segment already received (see SetDuplicate)
+		if len(payload) > 0 && conn.dups.seen(seq) {
+			l.mu.Unlock()
+			return
+		}
+
+		// 只处理有实际数据的包，忽略纯ACK、keepalive等控制包
+		if len(payload) > 0 {
+			conn.mu.Lock()
+			conn.ackNum = seq + uint32(len(payload))
+			conn.lastActivity = time.Now()
+			ackToSend := conn.ackNum
+			seqToUse := conn.seqNum
+			conn.mu.Unlock()
 
-				headerBytes := serializeTCPHeaderStatic(tcpHdr)
-				fullData := make([]byte, len(headerBytes)+len(payload))
-				copy(fullData, headerBytes)
-				copy(fullData[len(headerBytes):], payload)
+			// 立即回 ACK，避免长时间无反向流量导致被误判为异常
+			if err := conn.sendSegment(seqToUse, ackToSend, ACK, nil); err != nil {
+				log.Printf("Failed to send ACK to %s:%d: %v", conn.remoteIP, conn.remotePort, err)
+			}
 
-				select {
-				case conn.recvQueue <- fullData:
-				default:
-					// 队列满，丢弃
-				}
+			tcpHdr := &TCPHeader{
+				SrcPort:    srcPort,
+				DstPort:    dstPort,
+				SeqNum:     seq,
+				AckNum:     ack,
+				DataOffset: 5,
+				Flags:      flags,
+				Window:     65535,
 			}
-			// FIN/RST包不需要放入queue，连接关闭会由其他机制处理
-			l.mu.Unlock()
-			continue
-		}
 
-		// 其他情况：未知连接或无效状态的包，直接忽略
+			headerBytes := serializeTCPHeaderStatic(tcpHdr)
+			fullData := make([]byte, len(headerBytes)+len(payload))
+			copy(fullData, headerBytes)
+			copy(fullData[len(headerBytes):], payload)
+
+			conn.recvQueue.push(fullData) // 队列满时丢弃
+		}
+		// FIN/RST包不需要放入queue，连接关闭会由其他机制处理
 		l.mu.Unlock()
+		return
+	}
+
+	// 其他情况：未知连接或无效状态的包，直接忽略
+	l.mu.Unlock()
+	if !exists && loadBalance.OwnsFlow(srcIP, srcPort) {
+		noteDrop(DropUnknownFlow, srcIP, dstPort)
+	}
+}
+
+// newConn creates a connection accepted from remoteIP:remotePort; isn is the
+// sequence number of the SYN-ACK answering it and ackNum the next one
+// expected from the peer
+func (l *ListenerRaw) newConn(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16,
+	isn, ackNum uint32, peerMSS int, p *Personality) *ConnRaw {
+	_, pathMTU, _ := routeTo(remoteIP, remotePort)
+	conn := &ConnRaw{
+		rawSocket:     l.rawSocket,
+		localIP:       localIP,
+		localPort:     localPort,
+		remoteIP:      remoteIP,
+		remotePort:    remotePort,
+		srcPort:       localPort,
+		dstPort:       remotePort,
+		seqNum:        isn,
+		ackNum:        ackNum,
+		peerISN:       ackNum - 1,
+		isConnected:   false,
+		recvQueue:     newPacketQueue(rawRecvQueueSize),
+		iptablesMgr:   l.iptablesMgr,
+		stopCh:        make(chan struct{}),
+		isListener:    true,
+		ownsResources: false,        // 服务端连接不拥有资源（共享）
+		lastActivity:  time.Now(),   // Initialize lastActivity
+		peerMSS:       peerMSS,
+		pathMTU:       pathMTU,
+		personality:   p,
+		clock:         newTCPClock(p),
+		trace:         newTraceRing(),
 	}
+	registerFlow(conn)
+	return conn
 }
 
 // Accept accepts a new connection
@@ -871,7 +1374,7 @@ func (l *ListenerRaw) Accept() (*ConnRaw, error) {
 		// 清空握手期间积压的控制包
 		for {
 			select {
-			case <-conn.recvQueue:
+			case <-conn.recvQueue.ch:
 				// 丢弃
 			default:
 				return conn, nil
@@ -891,7 +1394,7 @@ func (l *ListenerRaw) cleanupLoop() {
 
 	for {
 		select {
-		case <-l.stopCh:
+		case <-l.recvStop:
 			return
 		case <-ticker.C:
 			l.cleanupStaleConnections()
@@ -940,6 +1443,8 @@ func (l *ListenerRaw) cleanupStaleConnections() {
 				if !lastActivity.IsZero() && now.Sub(lastActivity) > staleConnectionTimeout {
 					// Close the stale connection
 					atomic.StoreInt32(&conn.closed, 1)
+					unregisterFlow(conn)
+					conn.fsm.close("idle timeout")
 					delete(l.connMap, key)
 					log.Printf("Cleaned up stale connection from %s (idle for %v)", key, now.Sub(lastActivity))
 				}
@@ -953,19 +1458,14 @@ func (l *ListenerRaw) cleanupStaleConnections() {
 func (l *ListenerRaw) Close() error {
 	close(l.stopCh)
 
-	// Wait for goroutines with timeout to avoid hang
-	done := make(chan struct{})
-	go func() {
-		l.wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		// All goroutines finished cleanly
-	case <-time.After(shutdownTimeout):
-		log.Printf("Timeout waiting for listener goroutines to stop; continuing shutdown")
+	// A detached listener's port and RST filter now belong to another process
+	l.mu.RLock()
+	detached := l.detached
+	l.mu.RUnlock()
+	if detached {
+		return l.rawSocket.Close()
 	}
+	l.stopRecv()
 
 	// Remove iptables rules
 	if err := l.iptablesMgr.RemoveAllRules(); err != nil {
@@ -983,3 +1483,23 @@ func (l *ListenerRaw) Addr() net.Addr {
 		Port: int(l.localPort),
 	}
 }
+
+// FirewallRules reports whether the listener's iptables rules are installed
+func (l *ListenerRaw) FirewallRules() []iptables.RuleState {
+	return l.iptablesMgr.CheckRules()
+}
+
+// RemoveFirewallRules removes the listener's iptables rules while it keeps
+// receiving; without the RST filter the kernel resets its connections
+func (l *ListenerRaw) RemoveFirewallRules() error {
+	return l.iptablesMgr.RemoveAllRules()
+}
+
+// FirewallRules reports whether the iptables rules this connection installed
+// are in place (none for connections accepted by a listener)
+func (c *ConnRaw) FirewallRules() []iptables.RuleState {
+	if !c.ownsResources || c.iptablesMgr == nil {
+		return nil
+	}
+	return c.iptablesMgr.CheckRules()
+}
@@ -0,0 +1,254 @@
+package faketcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// Listener handoff lets a new process continue an old process's connections
+// without the peers noticing: the old process detaches its listener, passes a
+// duplicate of the socket and a Session per established connection, and the
+// new process rebuilds the listener on that socket and adopts the sessions.
+// Sequence numbers resume from the snapshot; segments the old process still
+// sends afterwards reuse a few of them, which the receivers tolerate.
+
+// Session is the transport state of an established connection on a listener
+type Session struct {
+	RemoteAddr string `json:"remote_addr"`
+	LocalIP    string `json:"local_ip,omitempty"` // Address the peer connected to (raw mode)
+	Seq        uint32 `json:"seq"`
+	Ack        uint32 `json:"ack"`
+	PeerMSS    int    `json:"peer_mss,omitempty"`
+	PeerISN    uint32 `json:"peer_isn,omitempty"` // Tells a late copy of the peer's SYN from a new handshake (raw mode)
+	// TCP personality and its timestamp clock, so the peer sees no jump
+	Personality string `json:"personality,omitempty"`
+	TSval       uint32 `json:"tsval,omitempty"`
+	PeerTSval   uint32 `json:"peer_tsval,omitempty"`
+}
+
+// HandoffListener is a listener whose socket and connections can be handed
+// to another process
+type HandoffListener interface {
+	ListenerAdapter
+	// Detach stops receiving and returns a duplicate of the listening socket
+	// and the established sessions. Accept keeps blocking; Close afterwards
+	// releases only this process's descriptor.
+	Detach() (*os.File, []Session, error)
+	// Resume receives again after a Detach whose handoff failed
+	Resume() error
+	// Adopt continues a session received from another process
+	Adopt(s Session) (ConnAdapter, error)
+}
+
+var (
+	_ HandoffListener = (*RawListener)(nil)
+	_ HandoffListener = (*UDPListener)(nil)
+)
+
+// ListenFromFile rebuilds a listener on a socket detached by another process.
+// It takes ownership of f.
+func ListenFromFile(addr string, mode Mode, f *os.File) (HandoffListener, error) {
+	defer f.Close()
+	if mode == ModeRaw {
+		localIP, localPort, err := parseListenAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to duplicate inherited socket: %v", err)
+		}
+		rawSock := rawsocket.NewRawSocketFromFD(fd, localIP, localPort, true)
+		// The previous process's rule is in place; it is only taken over
+		iptablesMgr, err := installRSTFilter(localIP, localPort, true, true)
+		if err != nil {
+			rawSock.Close()
+			return nil, err
+		}
+		return &RawListener{newListenerRaw(rawSock, iptablesMgr, localIP, localPort)}, nil
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited socket: %v", err)
+	}
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("inherited socket is not a UDP socket")
+	}
+	l := &Listener{
+		udpConn:      udpConn,
+		connMap:      make(map[string]*Conn),
+		newConnCh:    make(chan *Conn, tunables.ListenerQueueSize),
+		dispatchDone: make(chan struct{}),
+	}
+	go l.dispatch()
+	return &UDPListener{l}, nil
+}
+
+// Detach stops receiving on the raw socket (see HandoffListener)
+func (l *RawListener) Detach() (*os.File, []Session, error) {
+	fd, err := syscall.Dup(l.rawSocket.GetFD())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to duplicate raw socket: %v", err)
+	}
+	l.stopRecv()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.detached = true
+	sessions := make([]Session, 0, len(l.connMap))
+	for _, conn := range l.connMap {
+		if !conn.isConnected || atomic.LoadInt32(&conn.closed) != 0 {
+			continue
+		}
+		conn.mu.Lock()
+		sessions = append(sessions, Session{
+			RemoteAddr:  conn.RemoteAddr().String(),
+			LocalIP:     conn.localIP.String(),
+			Seq:         conn.seqNum,
+			Ack:         conn.ackNum,
+			PeerMSS:     conn.peerMSS,
+			PeerISN:     conn.peerISN,
+			Personality: conn.personality.Name,
+			TSval:       conn.clock.now(),
+			PeerTSval:   atomic.LoadUint32(&conn.peerTSval),
+		})
+		conn.mu.Unlock()
+	}
+	return os.NewFile(uintptr(fd), "raw-listener"), sessions, nil
+}
+
+// Resume restarts receiving on the raw socket after Detach
+func (l *RawListener) Resume() error {
+	l.mu.Lock()
+	l.detached = false
+	l.mu.Unlock()
+	l.startRecv()
+	return nil
+}
+
+// Adopt registers a session received from another process
+func (l *RawListener) Adopt(s Session) (ConnAdapter, error) {
+	remote, err := net.ResolveTCPAddr("tcp", s.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session address %q: %v", s.RemoteAddr, err)
+	}
+	localIP := canonicalIP(net.ParseIP(s.LocalIP))
+	if localIP == nil {
+		return nil, fmt.Errorf("invalid session local address %q", s.LocalIP)
+	}
+	remotePort := uint16(remote.Port)
+	_, pathMTU, _ := routeTo(remote.IP, remotePort)
+	p := l.personality.Load()
+	if s.Personality != "" {
+		if p, err = LookupPersonality(s.Personality); err != nil {
+			return nil, err
+		}
+	}
+
+	conn := &ConnRaw{
+		rawSocket:     l.rawSocket,
+		localIP:       localIP,
+		localPort:     l.localPort,
+		remoteIP:      canonicalIP(remote.IP),
+		remotePort:    remotePort,
+		srcPort:       l.localPort,
+		dstPort:       remotePort,
+		seqNum:        s.Seq,
+		ackNum:        s.Ack,
+		peerISN:       s.PeerISN,
+		isConnected:   true,
+		recvQueue:     newPacketQueue(rawRecvQueueSize),
+		iptablesMgr:   l.iptablesMgr,
+		stopCh:        make(chan struct{}),
+		isListener:    true,
+		ownsResources: false,
+		lastActivity:  time.Now(),
+		peerMSS:       s.PeerMSS,
+		pathMTU:       pathMTU,
+		personality:   p,
+		clock:         resumeTCPClock(p, s.TSval),
+		trace:         newTraceRing(),
+		peerTSval:     s.PeerTSval,
+	}
+
+	l.mu.Lock()
+	l.connMap[net.JoinHostPort(conn.remoteIP.String(), strconv.Itoa(remote.Port))] = conn
+	l.mu.Unlock()
+	registerFlow(conn)
+	return conn, nil
+}
+
+// Detach stops receiving on the UDP socket (see HandoffListener)
+func (l *UDPListener) Detach() (*os.File, []Session, error) {
+	f, err := l.udpConn.File()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to duplicate UDP socket: %v", err)
+	}
+	atomic.StoreInt32(&l.detached, 1)
+	l.udpConn.SetReadDeadline(time.Now())
+	<-l.dispatchDone
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	sessions := make([]Session, 0, len(l.connMap))
+	for _, conn := range l.connMap {
+		if atomic.LoadInt32(&conn.closed) != 0 {
+			continue
+		}
+		conn.mu.Lock()
+		sessions = append(sessions, Session{
+			RemoteAddr: conn.remoteAddr.String(),
+			Seq:        conn.seqNum,
+			Ack:        conn.ackNum,
+		})
+		conn.mu.Unlock()
+	}
+	return f, sessions, nil
+}
+
+// Resume restarts receiving on the UDP socket after Detach
+func (l *UDPListener) Resume() error {
+	if err := l.udpConn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.detached, 0)
+	l.dispatchDone = make(chan struct{})
+	go l.dispatch()
+	return nil
+}
+
+// Adopt registers a session received from another process
+func (l *UDPListener) Adopt(s Session) (ConnAdapter, error) {
+	remote, err := net.ResolveUDPAddr("udp", s.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session address %q: %v", s.RemoteAddr, err)
+	}
+	localAddr := l.udpConn.LocalAddr().(*net.UDPAddr)
+	conn := &Conn{
+		udpConn:     l.udpConn,
+		localAddr:   localAddr,
+		remoteAddr:  remote,
+		srcPort:     uint16(localAddr.Port),
+		dstPort:     uint16(remote.Port),
+		seqNum:      s.Seq,
+		ackNum:      s.Ack,
+		isConnected: false,
+		recvQueue:   newPacketQueue(tunables.RecvQueueSize),
+		trace:       newTraceRing(),
+	}
+
+	l.mu.Lock()
+	l.connMap[remote.String()] = conn
+	l.mu.Unlock()
+	return conn, nil
+}
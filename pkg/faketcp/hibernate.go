@@ -0,0 +1,132 @@
+package faketcp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A connection's receive queue is sized for bursts at full rate, which makes it
+// most of what an idle session costs a server with many clients. Hibernate
+// swaps the queue for a small one; Wake, or packets piling up in the small
+// queue, swaps a full-size one back. Only the reading goroutine receives from
+// the queue and replaces it, so no reader is left waiting on a queue that was
+// swapped out, and senders hold the read lock so none sends into the old queue
+// while its packets are moved over.
+
+// hibernateQueueSize is the receive queue capacity of a hibernating connection
+const hibernateQueueSize = 64
+
+// Hibernator is implemented by connections that can release their receive
+// buffers while idle. Both methods must be called from the goroutine that
+// reads the connection.
+type Hibernator interface {
+	// Hibernate shrinks the receive queue and reports whether the connection
+	// is hibernating; it fails while more packets are queued than fit.
+	Hibernate() bool
+	// Wake restores the full-size receive queue
+	Wake()
+}
+
+// packetQueue is a receive queue that can shrink while its connection is idle
+type packetQueue struct {
+	mu          sync.RWMutex
+	ch          chan []byte // Replaced only by the reader, under mu
+	size        int         // Capacity when awake
+	closed      bool
+	hibernating atomic.Bool
+}
+
+func newPacketQueue(size int) *packetQueue {
+	return &packetQueue{ch: make(chan []byte, size), size: size}
+}
+
+// push queues a packet without blocking, reporting false when the queue is
+// full or closed
+func (q *packetQueue) push(pkt []byte) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.ch <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends the queue; the reader still receives the packets already queued
+func (q *packetQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// resize moves the queued packets to a new channel of the given capacity
+func (q *packetQueue) resize(size int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.ch) > size {
+		return false
+	}
+	ch := make(chan []byte, size)
+	for len(q.ch) > 0 {
+		ch <- <-q.ch
+	}
+	q.ch = ch
+	return true
+}
+
+func (q *packetQueue) hibernate() bool {
+	if q.hibernating.Load() {
+		return true
+	}
+	if !q.resize(hibernateQueueSize) {
+		return false
+	}
+	q.hibernating.Store(true)
+	return true
+}
+
+func (q *packetQueue) wake() {
+	if q.hibernating.Load() && q.resize(q.size) {
+		q.hibernating.Store(false)
+	}
+}
+
+// received is called by the reader after each packet; a hibernating queue
+// that fills up is a burst the small queue would drop
+func (q *packetQueue) received() {
+	if q.hibernating.Load() && len(q.ch) >= hibernateQueueSize/2 {
+		q.wake()
+	}
+}
+
+var _ Hibernator = (*Conn)(nil)
+var _ Hibernator = (*ConnRaw)(nil)
+
+// Hibernate shrinks the receive queue of a listener connection
+func (c *Conn) Hibernate() bool {
+	return c.recvQueue != nil && c.recvQueue.hibernate()
+}
+
+// Wake restores the full-size receive queue
+func (c *Conn) Wake() {
+	if c.recvQueue != nil {
+		c.recvQueue.wake()
+	}
+}
+
+// Hibernate shrinks the receive queue
+func (c *ConnRaw) Hibernate() bool {
+	return c.recvQueue.hibernate()
+}
+
+// Wake restores the full-size receive queue
+func (c *ConnRaw) Wake() {
+	c.recvQueue.wake()
+}
@@ -0,0 +1,40 @@
+package faketcp
+
+import "testing"
+
+// TestPacketQueueHibernate checks that resizing keeps queued packets in order
+// and that a hibernating queue grows back under load
+func TestPacketQueueHibernate(t *testing.T) {
+	q := newPacketQueue(1024)
+	for i := 0; i < 3; i++ {
+		q.push([]byte{byte(i)})
+	}
+	if !q.hibernate() || cap(q.ch) != hibernateQueueSize {
+		t.Fatalf("hibernate: capacity %d, want %d", cap(q.ch), hibernateQueueSize)
+	}
+	for i := 0; i < 3; i++ {
+		if pkt := <-q.ch; pkt[0] != byte(i) {
+			t.Fatalf("packet %d read as %d after hibernating", i, pkt[0])
+		}
+	}
+
+	for i := 0; i < hibernateQueueSize/2+1; i++ {
+		q.push([]byte{byte(i)})
+	}
+	<-q.ch
+	q.received()
+	if q.hibernating.Load() || cap(q.ch) != 1024 {
+		t.Fatalf("queue did not wake under load: capacity %d", cap(q.ch))
+	}
+
+	for i := 0; i < 1024; i++ {
+		q.push(nil)
+	}
+	if q.hibernate() {
+		t.Fatal("hibernated with more packets queued than fit")
+	}
+	q.close()
+	if q.push(nil) {
+		t.Fatal("push succeeded on a closed queue")
+	}
+}
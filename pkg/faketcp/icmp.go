@@ -0,0 +1,199 @@
+package faketcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// The kernel has no socket for the forged flows, so ICMP errors about them
+// (fragmentation needed, unreachable, TTL exceeded) would go unnoticed. An
+// ICMPListener reads all ICMP messages the host receives and passes on those
+// quoting a segment of a live raw connection: its addresses and ports and a
+// sequence number it sent recently, so a forged error has to guess the flow
+// and its sequence space (RFC 5927). UDP mode does not need one; the kernel
+// handles ICMP errors for its socket.
+
+// ICMPKind classifies the ICMP errors passed to the handler
+type ICMPKind int
+
+const (
+	ICMPFragNeeded   ICMPKind = iota + 1 // Destination unreachable, fragmentation needed (code 4)
+	ICMPUnreachable                      // Destination unreachable, any other code
+	ICMPTimeExceeded                     // TTL exceeded in transit
+)
+
+func (k ICMPKind) String() string {
+	switch k {
+	case ICMPFragNeeded:
+		return "frag-needed"
+	case ICMPUnreachable:
+		return "unreachable"
+	case ICMPTimeExceeded:
+		return "ttl-exceeded"
+	}
+	return "unknown"
+}
+
+// ICMPError is an ICMP error about a segment of a connection
+type ICMPError struct {
+	Kind ICMPKind
+	Type uint8
+	Code uint8
+	From net.IP // Router or host that sent the error
+	MTU  int    // Next-hop MTU (ICMPFragNeeded; 0 if the router left it out)
+	MSS  int    // Largest segment payload that fits MTU (0 if MTU is 0)
+}
+
+// icmpSeqWindow is how far behind the next sequence number a quoted segment
+// may be; older ones are taken to be forged or stale
+const icmpSeqWindow = 4 << 20
+
+// flowKey identifies a raw connection as seen in the headers it sends
+type flowKey struct {
+	local, remote         [4]byte
+	localPort, remotePort uint16
+}
+
+func newFlowKey(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) flowKey {
+	var k flowKey
+	copy(k.local[:], localIP.To4())
+	copy(k.remote[:], remoteIP.To4())
+	k.localPort, k.remotePort = localPort, remotePort
+	return k
+}
+
+// flows are the live raw connections, for correlating ICMP errors
+var flows sync.Map // flowKey -> *ConnRaw
+
+func registerFlow(c *ConnRaw) {
+	flows.Store(newFlowKey(c.localIP, c.localPort, c.remoteIP, c.remotePort), c)
+}
+
+func unregisterFlow(c *ConnRaw) {
+	flows.CompareAndDelete(newFlowKey(c.localIP, c.localPort, c.remoteIP, c.remotePort), c)
+}
+
+// parseICMPError decodes an ICMPv4 error message (without the outer IP
+// header) quoting a TCP segment: the error, the flow of the quoted segment
+// and its sequence number
+func parseICMPError(msg []byte) (e ICMPError, flow flowKey, seq uint32, ok bool) {
+	if len(msg) < 8 {
+		return e, flow, 0, false
+	}
+	e.Type, e.Code = msg[0], msg[1]
+	switch {
+	case e.Type == 3 && e.Code == 4:
+		e.Kind = ICMPFragNeeded
+		e.MTU = int(binary.BigEndian.Uint16(msg[6:8]))
+	case e.Type == 3:
+		e.Kind = ICMPUnreachable
+	case e.Type == 11 && e.Code == 0:
+		e.Kind = ICMPTimeExceeded
+	default:
+		return e, flow, 0, false
+	}
+
+	// The quoted IP header and at least the first 8 bytes of the segment:
+	// ports and sequence number
+	quoted := msg[8:]
+	if len(quoted) < rawsocket.IPHeaderSize || quoted[0]>>4 != 4 || quoted[9] != syscall.IPPROTO_TCP {
+		return e, flow, 0, false
+	}
+	ihl := int(quoted[0]&0x0f) * 4
+	if ihl < rawsocket.IPHeaderSize || len(quoted) < ihl+8 {
+		return e, flow, 0, false
+	}
+	tcp := quoted[ihl:]
+	flow = newFlowKey(net.IP(quoted[12:16]), binary.BigEndian.Uint16(tcp[0:2]),
+		net.IP(quoted[16:20]), binary.BigEndian.Uint16(tcp[2:4]))
+	return e, flow, binary.BigEndian.Uint32(tcp[4:8]), true
+}
+
+// ICMPListener delivers ICMP errors about raw connections to a handler
+type ICMPListener struct {
+	conn    net.PacketConn
+	handler func(*ConnRaw, ICMPError)
+	done    chan struct{}
+
+	received atomic.Uint64 // ICMP errors about live connections
+	ignored  atomic.Uint64 // Errors quoting an unknown flow or sequence number
+}
+
+// ListenICMP starts passing ICMP errors about raw connections to handler,
+// which runs on the listener's goroutine and should not block. It needs the
+// same privileges as the raw sockets and opens its socket in their network
+// namespace (SetNetNS).
+func ListenICMP(handler func(conn *ConnRaw, e ICMPError)) (*ICMPListener, error) {
+	var pc net.PacketConn
+	err := netns.Do(netnsPath, func() error {
+		var err error
+		pc, err = net.ListenPacket("ip4:icmp", "0.0.0.0")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	l := &ICMPListener{conn: pc, handler: handler, done: make(chan struct{})}
+	go l.loop()
+	return l, nil
+}
+
+func (l *ICMPListener) loop() {
+	defer close(l.done)
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		e, flow, seq, ok := parseICMPError(buf[:n])
+		if !ok {
+			continue
+		}
+		v, found := flows.Load(flow)
+		if !found {
+			l.ignored.Add(1)
+			continue
+		}
+		c := v.(*ConnRaw)
+		if atomic.LoadInt32(&c.closed) != 0 || !c.sentRecently(seq) {
+			l.ignored.Add(1)
+			continue
+		}
+		if ip, ok := addr.(*net.IPAddr); ok {
+			e.From = ip.IP
+		}
+		if e.MTU > 0 {
+			e.MSS = max(e.MTU-rawsocket.IPHeaderSize-rawsocket.TCPHeaderSize-c.personality.optionsLen()-len(ipOptions), 1)
+		}
+		l.received.Add(1)
+		l.handler(c, e)
+	}
+}
+
+// Counts returns the errors delivered to the handler and those ignored
+func (l *ICMPListener) Counts() (received, ignored uint64) {
+	return l.received.Load(), l.ignored.Load()
+}
+
+// Close stops the listener
+func (l *ICMPListener) Close() error {
+	err := l.conn.Close()
+	<-l.done
+	return err
+}
+
+// sentRecently reports whether seq lies in the sequence space the connection
+// sent lately
+func (c *ConnRaw) sentRecently(seq uint32) bool {
+	c.mu.Lock()
+	next := c.seqNum
+	c.mu.Unlock()
+	return next-seq <= icmpSeqWindow
+}
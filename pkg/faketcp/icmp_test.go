@@ -0,0 +1,65 @@
+package faketcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// icmpQuoting builds an ICMP error of the given type and code quoting a TCP
+// segment of the flow local:lport -> remote:rport with sequence number seq
+func icmpQuoting(typ, code uint8, mtu uint16, local net.IP, lport uint16, remote net.IP, rport uint16, seq uint32) []byte {
+	msg := make([]byte, 8+20+8)
+	msg[0], msg[1] = typ, code
+	binary.BigEndian.PutUint16(msg[6:8], mtu)
+	ip := msg[8:]
+	ip[0] = 0x45
+	ip[9] = 6
+	copy(ip[12:16], local.To4())
+	copy(ip[16:20], remote.To4())
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], lport)
+	binary.BigEndian.PutUint16(tcp[2:4], rport)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	return msg
+}
+
+// TestParseICMPError checks that errors are classified and matched to the
+// flow and sequence number of the segment they quote
+func TestParseICMPError(t *testing.T) {
+	local, remote := net.IPv4(10, 0, 0, 2), net.IPv4(203, 0, 113, 1)
+	want := newFlowKey(local, 40000, remote, 443)
+
+	for _, tc := range []struct {
+		typ, code uint8
+		mtu       uint16
+		kind      ICMPKind
+	}{
+		{3, 4, 1280, ICMPFragNeeded},
+		{3, 1, 0, ICMPUnreachable},
+		{3, 13, 0, ICMPUnreachable},
+		{11, 0, 0, ICMPTimeExceeded},
+	} {
+		e, flow, seq, ok := parseICMPError(icmpQuoting(tc.typ, tc.code, tc.mtu, local, 40000, remote, 443, 12345))
+		if !ok || e.Kind != tc.kind || e.MTU != int(tc.mtu) || flow != want || seq != 12345 {
+			t.Errorf("type %d code %d: got %v %+v %v %d", tc.typ, tc.code, ok, e, flow == want, seq)
+		}
+	}
+
+	if _, _, _, ok := parseICMPError(icmpQuoting(8, 0, 0, local, 40000, remote, 443, 1)); ok {
+		t.Error("echo request parsed as an error")
+	}
+	udp := icmpQuoting(3, 3, 0, local, 40000, remote, 443, 1)
+	udp[8+9] = 17
+	if _, _, _, ok := parseICMPError(udp); ok {
+		t.Error("error quoting a UDP datagram accepted")
+	}
+	if _, _, _, ok := parseICMPError(icmpQuoting(3, 4, 1280, local, 40000, remote, 443, 1)[:30]); ok {
+		t.Error("truncated quote accepted")
+	}
+
+	c := &ConnRaw{seqNum: icmpSeqWindow + 100}
+	if !c.sentRecently(icmpSeqWindow+50) || !c.sentRecently(100) || c.sentRecently(icmpSeqWindow+101) || c.sentRecently(99) {
+		t.Error("sequence window check failed")
+	}
+}
@@ -0,0 +1,79 @@
+package faketcp
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// Some DPI boxes flag flows whose headers never vary in fields that real
+// traffic occasionally uses. Raw connections can pad their IP headers with NOP
+// options, which every router forwards unchanged (though some drop any packet
+// with options, RFC 7126), so the header length is not fixed at 20 bytes.
+//
+// The urgent pointer is handled like the stacks the personalities imitate:
+// Linux, Windows and macOS only send it with URG, which nothing here does, so
+// every forged segment has URG clear and a zero pointer. Urgent data received
+// from the peer is delivered inline with the rest of the payload, as with
+// SO_OOBINLINE, and strict validation drops segments carrying a pointer
+// without URG, which no stack sends.
+
+var ipOptions []byte
+
+// ipidStrategy numbers the IPv4 packets of raw sockets (nil = rawsocket's
+// shared per-flow counter)
+var ipidStrategy rawsocket.IPIDStrategy
+
+// SetIPIDStrategy picks how the raw sockets of connections and listeners
+// created afterwards fill the IP Identification field: counter, random or
+// kernel (see rawsocket.IPIDStrategy)
+func SetIPIDStrategy(name string) error {
+	s, err := rawsocket.ParseIPIDStrategy(name)
+	if err != nil {
+		return err
+	}
+	ipidStrategy = s
+	return nil
+}
+
+// marking is the TTL, DSCP and ECN codepoint of raw segments; zero fields
+// keep the personality's TTL, no class and SetECN's ECT(0)
+var marking rawsocket.Marking
+
+// SetMarking sets the TTL, DSCP and ECN codepoint of the raw segments of every
+// connection that has none of its own (see ConnRaw.SetMarking). The ECN
+// codepoint only marks data segments, and unlike SetECN leaves the pacing off.
+func SetMarking(m rawsocket.Marking) {
+	marking = m
+}
+
+// SetMarking gives this connection's segments m instead of the marking set
+// with the package's SetMarking, from the next segment on
+func (c *ConnRaw) SetMarking(m rawsocket.Marking) {
+	c.marking.Store(&m)
+}
+
+// currentMarking returns the marking of the connection's segments
+func (c *ConnRaw) currentMarking() rawsocket.Marking {
+	if m := c.marking.Load(); m != nil {
+		return *m
+	}
+	return marking
+}
+
+// SetIPOptions pads the IP header of every raw segment with n bytes of NOP
+// options (a multiple of 4 up to 40; 0 sends none). It applies to segments
+// sent afterwards; set it before connections are created so their MSS
+// accounts for it.
+func SetIPOptions(n int) error {
+	if n < 0 || n > rawsocket.MaxIPOptionsSize || n%4 != 0 {
+		return fmt.Errorf("IP options must be a multiple of 4 between 0 and %d bytes", rawsocket.MaxIPOptionsSize)
+	}
+	if n == 0 {
+		ipOptions = nil
+		return nil
+	}
+	ipOptions = bytes.Repeat([]byte{1}, n) // IPOPT_NOP
+	return nil
+}
@@ -0,0 +1,92 @@
+package faketcp
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"syscall"
+)
+
+// LoadBalance describes this process' share of a server port that is shared by
+// several server processes on the same host.
+//
+// UDP mode: every process binds the port with SO_REUSEPORT and the kernel hashes
+// each 4-tuple to one socket, so a session stays on the same process as long as
+// the set of processes does not change.
+//
+// Raw mode: every raw socket sees every segment, so processes partition the
+// client 4-tuples cooperatively. A flow is owned by the worker chosen by a jump
+// consistent hash of the client address; other workers ignore its SYN and never
+// create state for it. Changing the worker count only moves ~1/N of the flows.
+type LoadBalance struct {
+	WorkerID int // This process' index in [0, Workers)
+	Workers  int // Total number of server processes sharing the port (<=1 disables)
+}
+
+var loadBalance LoadBalance
+
+// SetLoadBalance configures port sharing for listeners created afterwards
+func SetLoadBalance(lb LoadBalance) {
+	loadBalance = lb
+}
+
+// GetLoadBalance returns the current port sharing configuration
+func GetLoadBalance() LoadBalance {
+	return loadBalance
+}
+
+// Enabled reports whether the port is shared with other processes
+func (lb LoadBalance) Enabled() bool {
+	return lb.Workers > 1
+}
+
+// OwnsFlow reports whether the client flow ip:port belongs to this worker
+func (lb LoadBalance) OwnsFlow(ip net.IP, port uint16) bool {
+	if !lb.Enabled() {
+		return true
+	}
+	return FlowWorker(ip, port, lb.Workers) == lb.WorkerID
+}
+
+// FlowWorker maps a client address to a worker index using jump consistent hashing
+func FlowWorker(ip net.IP, port uint16, workers int) int {
+	if workers <= 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	if v4 := ip.To4(); v4 != nil {
+		h.Write(v4)
+	} else {
+		h.Write(ip.To16())
+	}
+	var p [2]byte
+	binary.BigEndian.PutUint16(p[:], port)
+	h.Write(p[:])
+	return jumpHash(h.Sum64(), workers)
+}
+
+// jumpHash is Lamping & Veach's jump consistent hash
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// reusePortControl sets SO_REUSEPORT on a listening socket before bind
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// soReusePort is SO_REUSEPORT on Linux (not exported by package syscall)
+const soReusePort = 0xf
@@ -0,0 +1,42 @@
+package faketcp
+
+import (
+	"net"
+	"testing"
+)
+
+// TestFlowWorkerConsistency verifies that growing the worker set only moves
+// flows onto the new worker, keeping existing sessions sticky
+func TestFlowWorkerConsistency(t *testing.T) {
+	const flows = 5000
+	moved := 0
+	for i := 0; i < flows; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		port := uint16(1024 + i%50000)
+
+		before := FlowWorker(ip, port, 4)
+		after := FlowWorker(ip, port, 5)
+		if before < 0 || before >= 4 || after < 0 || after >= 5 {
+			t.Fatalf("worker out of range: %d -> %d", before, after)
+		}
+		if before != after {
+			if after != 4 {
+				t.Fatalf("flow %s:%d moved between existing workers (%d -> %d)", ip, port, before, after)
+			}
+			moved++
+		}
+	}
+
+	// Roughly 1/5 of the flows should move to the new worker
+	if moved < flows/10 || moved > flows*3/10 {
+		t.Errorf("unexpected number of moved flows: %d of %d", moved, flows)
+	}
+}
+
+// TestOwnsFlowDisabled verifies that every flow is accepted when load balancing is off
+func TestOwnsFlowDisabled(t *testing.T) {
+	lb := LoadBalance{}
+	if !lb.OwnsFlow(net.IPv4(192, 0, 2, 1), 40000) {
+		t.Fatal("flow rejected with load balancing disabled")
+	}
+}
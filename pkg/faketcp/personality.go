@@ -0,0 +1,194 @@
+package faketcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// A Personality makes the segments of a raw connection look like those of a
+// particular operating system's TCP stack: how the ISN is chosen, the TTL,
+// the advertised window and scale, which options are sent in which order, and
+// how fast the timestamp clock runs. The default personality is the layout
+// earlier versions sent, so both ends need not agree on one.
+
+// ISNPattern selects how a connection's initial sequence number is chosen
+type ISNPattern int
+
+const (
+	// ISNRandom draws every ISN independently
+	ISNRandom ISNPattern = iota
+	// ISNClock is RFC 6528: a 4µs clock plus a keyed hash of the connection
+	// tuple, so successive connections between the same endpoints increase
+	ISNClock
+)
+
+// TCP option kinds understood in Personality option lists
+const (
+	optEOL       = rawsocket.TCPOptEOL
+	optNOP       = rawsocket.TCPOptNOP
+	optMSS       = rawsocket.TCPOptMSS
+	optWScale    = rawsocket.TCPOptWScale
+	optSACKPerm  = rawsocket.TCPOptSACKPerm
+	optTimestamp = rawsocket.TCPOptTimestamp
+)
+
+// Personality describes the TCP/IP fingerprint of forged segments
+type Personality struct {
+	Name        string
+	TTL         uint8
+	SynWindow   uint16     // Window in SYN and SYN-ACK (never scaled)
+	Window      uint16     // Window after the handshake, as written in the header
+	WindowScale uint8      // Shift announced in the window scale option
+	SynOptions  []byte     // Option kinds of SYN and SYN-ACK, in order
+	Options     []byte     // Option kinds of every later segment, in order
+	TSHz        int        // Timestamp clock rate in ticks per second
+	TSRandom    bool       // Start the timestamp clock at a random value per connection (false = Unix time)
+	ISN         ISNPattern // How the initial sequence number is chosen
+}
+
+var (
+	// PersonalityDefault is the segment layout of earlier versions
+	PersonalityDefault = &Personality{
+		Name: "default", TTL: 64, SynWindow: 65535, Window: 65535, WindowScale: 7,
+		SynOptions: []byte{optMSS, optNOP, optWScale, optSACKPerm, optNOP, optTimestamp},
+		Options:    []byte{optMSS, optNOP, optWScale, optSACKPerm, optNOP, optTimestamp},
+		TSHz:       1,
+	}
+	// PersonalityLinux resembles a Linux 5.x/6.x stack
+	PersonalityLinux = &Personality{
+		Name: "linux", TTL: 64, SynWindow: 64240, Window: 502, WindowScale: 7,
+		SynOptions: rawsocket.LinuxSynOptions,
+		Options:    rawsocket.LinuxOptions,
+		TSHz:       1000, TSRandom: true, ISN: ISNClock,
+	}
+	// PersonalityWindows resembles Windows 10/11, which sends no timestamps
+	PersonalityWindows = &Personality{
+		Name: "windows", TTL: 128, SynWindow: 64240, Window: 1026, WindowScale: 8,
+		SynOptions: []byte{optMSS, optNOP, optWScale, optNOP, optNOP, optSACKPerm},
+		Options:    []byte{},
+	}
+	// PersonalityMacOS resembles macOS
+	PersonalityMacOS = &Personality{
+		Name: "macos", TTL: 64, SynWindow: 65535, Window: 2058, WindowScale: 6,
+		SynOptions: []byte{optMSS, optNOP, optWScale, optNOP, optNOP, optTimestamp, optSACKPerm, optEOL, optEOL},
+		Options:    []byte{optNOP, optNOP, optTimestamp},
+		TSHz:       1000, TSRandom: true,
+	}
+)
+
+var personalities = map[string]*Personality{
+	PersonalityDefault.Name: PersonalityDefault,
+	PersonalityLinux.Name:   PersonalityLinux,
+	PersonalityWindows.Name: PersonalityWindows,
+	PersonalityMacOS.Name:   PersonalityMacOS,
+}
+
+// LookupPersonality returns the personality with the given name ("" = default)
+func LookupPersonality(name string) (*Personality, error) {
+	if name == "" {
+		return PersonalityDefault, nil
+	}
+	if p, ok := personalities[strings.ToLower(name)]; ok {
+		return p, nil
+	}
+	names := make([]string, 0, len(personalities))
+	for n := range personalities {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown TCP personality %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// defaultPersonality is used by DialRaw and new listeners
+var defaultPersonality atomic.Pointer[Personality]
+
+// SetPersonality sets the personality of raw connections dialed and
+// listeners created afterwards (nil = PersonalityDefault)
+func SetPersonality(p *Personality) {
+	defaultPersonality.Store(p)
+}
+
+func currentPersonality() *Personality {
+	if p := defaultPersonality.Load(); p != nil {
+		return p
+	}
+	return PersonalityDefault
+}
+
+// optionsLen is the padded length of the options of established segments
+func (p *Personality) optionsLen() int {
+	return (rawsocket.TCPOptionsLen(p.Options) + 3) &^ 3
+}
+
+func (p *Personality) timestamps() bool {
+	for _, kind := range p.SynOptions {
+		if kind == optTimestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// isnSecret keys the ISNClock hash
+var isnSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// isnEpoch anchors the ISNClock timer
+var isnEpoch = time.Now()
+
+// initialSeq picks the ISN for a connection from local to remote
+func (p *Personality) initialSeq(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) (uint32, error) {
+	if p.ISN != ISNClock {
+		return randomUint32()
+	}
+	mac := hmac.New(sha256.New, isnSecret)
+	mac.Write(canonicalIP(localIP))
+	mac.Write(canonicalIP(remoteIP))
+	binary.Write(mac, binary.BigEndian, [2]uint16{localPort, remotePort})
+	hash := binary.BigEndian.Uint32(mac.Sum(nil))
+	return hash + uint32(time.Since(isnEpoch)/(4*time.Microsecond)), nil
+}
+
+// tcpClock is a connection's timestamp clock
+type tcpClock struct {
+	hz     int
+	base   time.Time
+	offset uint32
+}
+
+// newTCPClock starts a timestamp clock for p; a clock at the Unix epoch
+// reproduces the default personality's timestamps
+func newTCPClock(p *Personality) tcpClock {
+	if !p.TSRandom {
+		return tcpClock{hz: p.TSHz, base: time.Unix(0, 0)}
+	}
+	return tcpClock{hz: p.TSHz, base: time.Now(), offset: randomUint32Value()}
+}
+
+// resumeTCPClock continues a clock that read tsval a moment ago (handoff)
+func resumeTCPClock(p *Personality, tsval uint32) tcpClock {
+	if !p.TSRandom {
+		return newTCPClock(p)
+	}
+	return tcpClock{hz: p.TSHz, base: time.Now(), offset: tsval}
+}
+
+func (c tcpClock) now() uint32 {
+	if c.hz <= 0 {
+		return 0
+	}
+	return c.offset + uint32(uint64(time.Since(c.base))*uint64(c.hz)/uint64(time.Second))
+}
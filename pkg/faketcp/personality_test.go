@@ -0,0 +1,58 @@
+package faketcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// TestPersonalityOptions checks that the built option lists parse back and
+// that the send MSS accounts for their length
+func TestPersonalityOptions(t *testing.T) {
+	for name, p := range personalities {
+		c := &ConnRaw{personality: p, clock: newTCPClock(p), peerTSval: 0x01020304}
+		for _, syn := range []bool{true, false} {
+			opts := c.buildTCPOptions(syn)
+			kinds := p.Options
+			if syn {
+				kinds = p.SynOptions
+			}
+			if len(opts) != rawsocket.TCPOptionsLen(kinds) {
+				t.Errorf("%s (syn=%v): %d option bytes, want %d", name, syn, len(opts), rawsocket.TCPOptionsLen(kinds))
+			}
+			if !syn && (len(opts)+3)&^3 != p.optionsLen() {
+				t.Errorf("%s: optionsLen %d does not match %d option bytes", name, p.optionsLen(), len(opts))
+			}
+			if i := bytes.Index(opts, []byte{optTimestamp, 10}); i >= 0 {
+				if echo := binary.BigEndian.Uint32(opts[i+6:]); echo != 0x01020304 {
+					t.Errorf("%s: TSecr = %#x, want the peer's TSval", name, echo)
+				}
+			}
+		}
+	}
+
+	// The default personality keeps the layout older peers were built against
+	c := &ConnRaw{personality: PersonalityDefault, clock: newTCPClock(PersonalityDefault)}
+	opts := c.buildTCPOptions(false)
+	if want := []byte{optMSS, 4}; !bytes.HasPrefix(opts, want) || len(opts) != 21 || PersonalityDefault.optionsLen() != 24 {
+		t.Errorf("default options %x changed layout", opts)
+	}
+	if ts := binary.BigEndian.Uint32(opts[13:]); int64(ts) < time.Now().Unix()-1 {
+		t.Errorf("default timestamp %d is not Unix time", ts)
+	}
+}
+
+// TestClockISN checks that clock-based ISNs increase for the same tuple
+func TestClockISN(t *testing.T) {
+	local, remote := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	first, _ := PersonalityLinux.initialSeq(local, 40000, remote, 443)
+	time.Sleep(time.Millisecond)
+	second, _ := PersonalityLinux.initialSeq(local, 40000, remote, 443)
+	if d := second - first; d < 200 || d > 1<<20 {
+		t.Errorf("ISN advanced by %d over 1ms, want about 250", d)
+	}
+}
@@ -0,0 +1,271 @@
+package faketcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Some ISPs shape a UDP flow once it has carried traffic for a while. In UDP
+// mode a dialed connection can move to a new local port without a new
+// handshake: it asks the listener for a token over the current flow, sends
+// the token from a new socket, and the listener moves the connection to the
+// new address when the token matches. Sequence numbers and the accepted
+// connection carry on, so the application above sees neither a reconnect
+// nor a new connection. The token is random and used once, so hosts that
+// cannot see the flow cannot move it. With Tuning.SourcePortRotate set,
+// dialed connections move on their own at that interval.
+//
+// The exchange uses segments flagged URG|ACK with rotateMarker as urgent
+// pointer, carrying [kind:1][token:8]:
+//
+//	request  client -> listener, current flow
+//	offer    listener -> client, current flow, with the token
+//	move     client -> listener, from the new port, with the token
+//	moved    listener -> client, to the new port (also answers resent moves)
+//
+// Listeners without support pass the request up as a 9-byte payload, which
+// the tunnel drops as undecryptable; the client then keeps its port.
+
+const (
+	rotateFlags      = URG | ACK
+	rotateMarker     = 0x5250
+	rotatePayloadLen = 1 + 8
+
+	rotateRequest = 1
+	rotateOffer   = 2
+	rotateMove    = 3
+	rotateMoved   = 4
+
+	// Packets still arriving at the old address go to the connection this long
+	rotateGrace = 5 * time.Second
+)
+
+// ErrRotateUnsupported is returned by RotateSourcePort when the listener
+// offered no token
+var ErrRotateUnsupported = errors.New("listener does not move connections to a new source port")
+
+// parseRotate returns the kind and token of a port rotation segment
+func parseRotate(h *TCPHeader, seg []byte) (byte, uint64, bool) {
+	if h.Flags != rotateFlags || h.UrgentPtr != rotateMarker {
+		return 0, 0, false
+	}
+	headerLen := max(int(h.DataOffset)*4, TCPHeaderSize)
+	if len(seg)-headerLen != rotatePayloadLen {
+		return 0, 0, false
+	}
+	payload := seg[headerLen:]
+	return payload[0], binary.BigEndian.Uint64(payload[1:]), true
+}
+
+// rotateSegmentLocked builds a port rotation segment sent from srcPort
+func (c *Conn) rotateSegmentLocked(srcPort uint16, kind byte, token uint64) []byte {
+	h := c.buildTCPHeader(rotatePayloadLen)
+	h.SrcPort = srcPort
+	h.Flags = rotateFlags
+	h.UrgentPtr = rotateMarker
+	seg := append(c.serializeTCPHeader(h), kind)
+	seg = binary.BigEndian.AppendUint64(seg, token)
+	c.traceSegment(true, seg)
+	return seg
+}
+
+// writeRotate sends a port rotation segment on the connection's flow
+func (c *Conn) writeRotate(kind byte, token uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeSegment(c.rotateSegmentLocked(c.srcPort, kind, token))
+}
+
+// sock returns the socket of the connection, replaced when a dialed
+// connection moves to a new source port
+func (c *Conn) sock() *net.UDPConn {
+	if s := c.rotated.Load(); s != nil {
+		return s
+	}
+	return c.udpConn
+}
+
+// RotateSourcePort moves a dialed connection to a new local port, waiting up
+// to timeout for each step. The listener's offer is read by ReadPacket or
+// ReadBatch, so the connection must be read meanwhile. The connection keeps
+// working on its current port if this fails.
+func (c *Conn) RotateSourcePort(timeout time.Duration) error {
+	if !c.isConnected {
+		return fmt.Errorf("only dialed connections have a source port of their own")
+	}
+	select {
+	case <-c.offers: // Left over from an earlier attempt
+	default:
+	}
+	if err := c.writeRotate(rotateRequest, 0); err != nil {
+		return err
+	}
+	var token uint64
+	select {
+	case token = <-c.offers:
+	case <-time.After(timeout):
+		return ErrRotateUnsupported
+	}
+
+	sock, err := net.DialUDP("udp", nil, c.remoteAddr)
+	if err != nil {
+		return err
+	}
+	const bufferSize = 4 * 1024 * 1024 // As Dial sets
+	_ = sock.SetReadBuffer(bufferSize)
+	_ = sock.SetWriteBuffer(bufferSize)
+	local := sock.LocalAddr().(*net.UDPAddr)
+
+	buf := make([]byte, MaxPacketSize)
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		c.mu.Lock()
+		move := c.rotateSegmentLocked(uint16(local.Port), rotateMove, token)
+		c.mu.Unlock()
+		if _, err := sock.Write(move); err != nil {
+			sock.Close()
+			return err
+		}
+		sock.SetReadDeadline(time.Now().Add(ReadTimeoutDuration))
+		n, err := sock.Read(buf)
+		if err != nil {
+			continue
+		}
+		h := parseTCPHeader(buf[:n])
+		if h == nil {
+			continue
+		}
+		if kind, got, ok := parseRotate(h, buf[:n]); !ok || kind != rotateMoved || got != token {
+			continue
+		}
+		c.traceSegment(false, buf[:n])
+		sock.SetReadDeadline(time.Time{})
+
+		c.mu.Lock()
+		old := c.sock()
+		c.rotated.Store(sock)
+		c.localAddr = local
+		c.srcPort = uint16(local.Port)
+		c.mu.Unlock()
+		// Readers blocked on the old socket move to the new one
+		old.Close()
+		if c.isClosed() {
+			sock.Close()
+		}
+		return nil
+	}
+	sock.Close()
+	return fmt.Errorf("no answer from the listener on the new port")
+}
+
+// rotateLoop moves a dialed connection to a new source port every interval
+// until it is closed
+func (c *Conn) rotateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.rotateStop:
+			return
+		case <-ticker.C:
+		}
+		port := c.SourcePort()
+		err := c.RotateSourcePort(HandshakeTimeout)
+		switch {
+		case errors.Is(err, ErrRotateUnsupported):
+			log.Printf("%v; keeping source port %d", err, port)
+			return
+		case err != nil:
+			if !c.isClosed() {
+				log.Printf("⚠️  Source port rotation failed, keeping port %d: %v", port, err)
+			}
+		default:
+			log.Printf("Moved from source port %d to %d", port, c.SourcePort())
+		}
+	}
+}
+
+// SourcePort returns the local port of the connection
+func (c *Conn) SourcePort() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.srcPort)
+}
+
+// handleRotate answers a port rotation segment from remoteAddr; conn is the
+// connection of that address, if any
+func (l *Listener) handleRotate(conn *Conn, remoteAddr *net.UDPAddr, kind byte, token uint64) {
+	switch {
+	case kind == rotateRequest && conn != nil:
+		token, err := randomUint64()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		for t, c := range l.tokens {
+			if c == conn || c.isClosed() {
+				delete(l.tokens, t)
+			}
+		}
+		l.tokens[token] = conn
+		l.mu.Unlock()
+		conn.writeRotate(rotateOffer, token)
+	case kind == rotateMove && conn != nil:
+		conn.mu.Lock()
+		resent := conn.movedWith == token
+		conn.mu.Unlock()
+		if resent {
+			conn.writeRotate(rotateMoved, token) // Our answer was lost
+		}
+	case kind == rotateMove:
+		l.mu.Lock()
+		conn = l.tokens[token]
+		delete(l.tokens, token)
+		if conn == nil || conn.isClosed() {
+			l.mu.Unlock()
+			return
+		}
+		conn.mu.Lock()
+		oldKey := conn.remoteAddr.String()
+		conn.remoteAddr = remoteAddr
+		conn.dstPort = uint16(remoteAddr.Port)
+		conn.movedWith = token
+		conn.mu.Unlock()
+		l.connMap[remoteAddr.String()] = conn
+		l.mu.Unlock()
+		time.AfterFunc(rotateGrace, func() {
+			l.mu.Lock()
+			if l.connMap[oldKey] == conn {
+				delete(l.connMap, oldKey)
+			}
+			l.mu.Unlock()
+		})
+		conn.writeRotate(rotateMoved, token)
+	}
+}
+
+func (c *Conn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+func randomUint64() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// startRotation moves a newly dialed connection to a new source port
+// periodically when Tuning.SourcePortRotate is set
+func (c *Conn) startRotation() {
+	if interval := tunables.SourcePortRotate; interval > 0 {
+		c.rotateStop = make(chan struct{})
+		go c.rotateLoop(interval)
+	}
+}
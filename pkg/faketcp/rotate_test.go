@@ -0,0 +1,85 @@
+package faketcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRotateSourcePort checks that a dialed connection moves to a new local
+// port and that the accepted connection follows it in both directions
+func TestRotateSourcePort(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.WritePacket([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			p, err := client.ReadPacket()
+			if err != nil {
+				return
+			}
+			if len(p) > 0 {
+				received <- p
+			}
+		}
+	}()
+
+	oldPort := client.SourcePort()
+	if err := client.RotateSourcePort(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if client.SourcePort() == oldPort {
+		t.Fatalf("still on source port %d", oldPort)
+	}
+	if got := server.RemoteAddr().(*net.UDPAddr).Port; got != client.SourcePort() {
+		t.Fatalf("listener sends to port %d, client moved to %d", got, client.SourcePort())
+	}
+
+	if err := server.WritePacket([]byte("moved")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if !bytes.Equal(p, []byte("moved")) {
+			t.Fatalf("client read %q", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received on the new port")
+	}
+
+	if err := client.WritePacket([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		p, err := server.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(p, []byte("again")) {
+			break
+		}
+	}
+	select {
+	case c := <-l.newConnCh:
+		t.Fatalf("listener accepted a new connection from %v", c.RemoteAddr())
+	default:
+	}
+}
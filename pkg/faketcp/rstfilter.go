@@ -0,0 +1,109 @@
+package faketcp
+
+import (
+	"fmt"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+)
+
+// Every raw listener normally installs the RST filter rule of its port when it
+// is created and removes it when closed, two or three iptables calls each. A
+// server that opens and closes listeners all the time (port hopping) instead
+// keeps the rules of all its ports in one RSTFilter, which applies each change
+// of the port set as one batch, and creates the listeners with
+// ListenWithModeUnfiltered.
+
+// RSTFilter maintains the RST filter rules of a set of listening ports. It is
+// not safe for concurrent use.
+type RSTFilter struct {
+	mgr   *iptables.IPTablesManager
+	ports map[uint16]bool
+}
+
+// NewRSTFilter creates a filter without ports, in the namespace set with
+// SetNetNS
+func NewRSTFilter() *RSTFilter {
+	mgr := iptables.NewIPTablesManager()
+	mgr.SetNetNS(netnsPath)
+	if loadBalance.Enabled() {
+		mgr.SetComment(fmt.Sprintf("lightweight-tunnel-worker-%d", loadBalance.WorkerID))
+	}
+	return &RSTFilter{mgr: mgr, ports: make(map[uint16]bool)}
+}
+
+// SetPorts installs the rules of ports and removes those of ports no longer
+// wanted in one batch, then reads the new rules back. On error Has still
+// reports the previous set; calling again retries what is missing.
+func (f *RSTFilter) SetPorts(ports []uint16) error {
+	want := make(map[uint16]bool, len(ports))
+	batch := f.mgr.NewBatch()
+	var added []uint16
+	for _, port := range ports {
+		want[port] = true
+		if !f.ports[port] {
+			batch.AddRuleForPort(port, true)
+			added = append(added, port)
+		}
+	}
+	for port := range f.ports {
+		if !want[port] {
+			batch.RemoveRuleForPort(port, true)
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := batch.Apply(); err != nil {
+		return err
+	}
+	for _, port := range added {
+		if err := f.mgr.VerifyRuleForPort(port, true); err != nil {
+			return err
+		}
+	}
+	f.ports = want
+	return nil
+}
+
+// Has reports whether the rule of port is installed
+func (f *RSTFilter) Has(port uint16) bool {
+	return f.ports[port]
+}
+
+// FirewallRules reports whether the filter's rules are installed
+func (f *RSTFilter) FirewallRules() []iptables.RuleState {
+	return f.mgr.CheckRules()
+}
+
+// Close removes all of the filter's rules
+func (f *RSTFilter) Close() error {
+	f.ports = make(map[uint16]bool)
+	return f.mgr.RemoveAllRules()
+}
+
+// ListenRawUnfiltered is ListenRaw for a port whose RST filter rule the caller
+// maintains, e.g. with an RSTFilter; the listener neither adds nor removes it
+func ListenRawUnfiltered(addr string) (*ListenerRaw, error) {
+	localIP, localPort, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	rawSock, err := newListenSocket(localIP, localPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raw socket: %v", err)
+	}
+	return newListenerRaw(rawSock, iptables.NewIPTablesManager(), localIP, localPort), nil
+}
+
+// ListenWithModeUnfiltered is ListenWithMode with ListenRawUnfiltered in raw
+// mode; UDP listeners need no filter
+func ListenWithModeUnfiltered(addr string, mode Mode) (ListenerAdapter, error) {
+	if mode != ModeRaw {
+		return ListenWithMode(addr, mode)
+	}
+	listener, err := ListenRawUnfiltered(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RawListener{listener}, nil
+}
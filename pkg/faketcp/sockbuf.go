@@ -0,0 +1,117 @@
+package faketcp
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The tunnel resizes the buffers of its sockets as the traffic changes
+// instead of keeping the sizes Dial, Listen and the raw sockets start with.
+// Without CAP_NET_ADMIN the kernel caps what a socket may ask for at
+// net.core.rmem_max and wmem_max; with it, SO_RCVBUFFORCE and SO_SNDBUFFORCE
+// go past them.
+
+// MaxSocketBuffer bounds the buffers asked for past the kernel's limits
+const MaxSocketBuffer = 64 << 20
+
+// BufferSizer is implemented by connections and listeners whose socket
+// buffers can be resized while they run
+type BufferSizer interface {
+	// SocketStats returns the kernel's figures for the socket
+	SocketStats() (SocketStats, error)
+	// SetSocketBuffers asks for receive and send buffers of recv and send
+	// bytes (0 keeps one). The kernel reports twice the size asked for, the
+	// rest being its bookkeeping, and grants no more than SocketBufferLimits.
+	SetSocketBuffers(recv, send int) error
+}
+
+var _ BufferSizer = (*Conn)(nil)
+var _ BufferSizer = (*Listener)(nil)
+var _ BufferSizer = (*ConnRaw)(nil)
+var _ BufferSizer = (*ListenerRaw)(nil)
+
+// SocketBufferLimits returns the largest receive and send buffers a socket
+// may ask for: MaxSocketBuffer when the process may force them, else
+// net.core.rmem_max and wmem_max
+func SocketBufferLimits() (recv, send int) {
+	if canForceBuffers() {
+		return MaxSocketBuffer, MaxSocketBuffer
+	}
+	return readSysctlInt("/proc/sys/net/core/rmem_max"), readSysctlInt("/proc/sys/net/core/wmem_max")
+}
+
+// canForceBuffers tries SO_RCVBUFFORCE on a throwaway socket
+func canForceBuffers() bool {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, 1<<20) == nil
+}
+
+func readSysctlInt(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
+
+// setSocketBuffers resizes the buffers of socket fd, past the kernel's
+// limits where the process may
+func setSocketBuffers(fd, recv, send int) error {
+	for _, b := range []struct{ size, force, opt int }{
+		{recv, syscall.SO_RCVBUFFORCE, syscall.SO_RCVBUF},
+		{send, syscall.SO_SNDBUFFORCE, syscall.SO_SNDBUF},
+	} {
+		if b.size <= 0 {
+			continue
+		}
+		if syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, b.force, b.size) == nil {
+			continue
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, b.opt, b.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSocketBuffers resizes the buffers of the connection's UDP socket
+func (c *Conn) SetSocketBuffers(recv, send int) error {
+	return udpSetBuffers(c.sock(), recv, send)
+}
+
+// SetSocketBuffers resizes the buffers of the listener's UDP socket
+func (l *Listener) SetSocketBuffers(recv, send int) error {
+	return udpSetBuffers(l.udpConn, recv, send)
+}
+
+// SetSocketBuffers resizes the buffers of the connection's raw socket, that
+// of its listener for an accepted connection
+func (c *ConnRaw) SetSocketBuffers(recv, send int) error {
+	return setSocketBuffers(c.rawSocket.GetFD(), recv, send)
+}
+
+// SetSocketBuffers resizes the buffers of the listener's raw socket
+func (l *ListenerRaw) SetSocketBuffers(recv, send int) error {
+	return setSocketBuffers(l.rawSocket.GetFD(), recv, send)
+}
+
+func udpSetBuffers(uc syscall.Conn, recv, send int) error {
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	if err := raw.Control(func(fd uintptr) {
+		setErr = setSocketBuffers(int(fd), recv, send)
+	}); err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,138 @@
+package faketcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// Daemons embedding the tunnel often create sockets themselves: systemd socket
+// activation, a supervisor passing descriptors across a restart, tests handing
+// in fakes. The functions below take such a socket instead of opening one.
+// Everything else (handshake, RST filter rule in raw mode) is as in Dial and
+// Listen. Each takes ownership of the socket it is given, also on error.
+
+// ListenRawFile is ListenRaw on a raw TCP socket created by the caller (see
+// rawsocket.WrapFD). addr is the local address the listener answers on.
+func ListenRawFile(addr string, f *os.File) (*ListenerRaw, error) {
+	defer f.Close()
+	localIP, localPort, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	iptablesMgr, err := installRSTFilter(localIP, localPort, true, false)
+	if err != nil {
+		return nil, err
+	}
+	rawSock, err := wrapRawFile(f, localIP, localPort, nil, 0, true)
+	if err != nil {
+		iptablesMgr.RemoveAllRules()
+		return nil, err
+	}
+	return newListenerRaw(rawSock, iptablesMgr, localIP, localPort), nil
+}
+
+// DialRawFile is DialRaw on a raw TCP socket created by the caller
+func DialRawFile(remoteAddr string, timeout time.Duration, f *os.File) (*ConnRaw, error) {
+	defer f.Close()
+	return dialRaw(remoteAddr, timeout, currentPersonality(), f)
+}
+
+// wrapRawFile wraps a duplicate of f's descriptor, leaving f to its owner
+func wrapRawFile(f *os.File, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isServer bool) (*rawsocket.RawSocket, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate socket: %v", err)
+	}
+	rawSock, err := rawsocket.WrapFD(fd, localIP, localPort, remoteIP, remotePort, isServer)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return rawSock, nil
+}
+
+// udpConnFromFile turns f into a UDP socket
+func udpConnFromFile(f *os.File) (*net.UDPConn, error) {
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket: %v", err)
+	}
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("socket is not a UDP socket")
+	}
+	return udpConn, nil
+}
+
+// ListenFileWithMode is ListenWithMode on a socket created by the caller: a
+// raw TCP socket in raw mode, a UDP socket bound to addr otherwise
+func ListenFileWithMode(addr string, mode Mode, f *os.File) (ListenerAdapter, error) {
+	if mode == ModeRaw {
+		listener, err := ListenRawFile(addr, f)
+		if err != nil {
+			return nil, err
+		}
+		return &RawListener{listener}, nil
+	}
+	defer f.Close()
+	udpConn, err := udpConnFromFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPListener{ListenUDPConn(udpConn)}, nil
+}
+
+// DialFileWithMode is DialWithMode on a socket created by the caller. A UDP
+// socket that is not yet connected is connected to remoteAddr.
+func DialFileWithMode(remoteAddr string, timeout time.Duration, mode Mode, f *os.File) (ConnAdapter, error) {
+	if mode == ModeRaw {
+		return DialRawFile(remoteAddr, timeout, f)
+	}
+	defer f.Close()
+	udpConn, err := udpConnFromFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if udpConn.RemoteAddr() == nil {
+		if udpConn, err = connectUDP(udpConn, remoteAddr); err != nil {
+			return nil, err
+		}
+	}
+	return DialUDPConn(udpConn, timeout)
+}
+
+// connectUDP connects an unconnected UDP socket to remoteAddr. The returned
+// socket replaces udpConn, which is closed.
+func connectUDP(udpConn *net.UDPConn, remoteAddr string) (*net.UDPConn, error) {
+	defer udpConn.Close()
+	raddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	var sa syscall.Sockaddr
+	if ip4 := raddr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: raddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: raddr.Port}
+		copy(sa6.Addr[:], raddr.IP.To16())
+		sa = sa6
+	}
+
+	f, err := udpConn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Connect(int(f.Fd()), sa); err != nil {
+		return nil, fmt.Errorf("failed to connect UDP socket to %s: %v", remoteAddr, err)
+	}
+	return udpConnFromFile(f)
+}
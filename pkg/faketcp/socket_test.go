@@ -0,0 +1,65 @@
+package faketcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestFileSockets runs a UDP-mode connection over sockets created by the
+// caller: the listener's bound socket and an unconnected client socket passed
+// as files
+func TestFileSockets(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverFile, err := server.File()
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.LocalAddr().String()
+	listener, err := ListenFileWithMode(addr, ModeUDP, serverFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if listener.Addr().String() != addr {
+		t.Fatalf("listener address %s, want %s", listener.Addr(), addr)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFile, err := client.File()
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialFileWithMode(addr, time.Second, ModeUDP, clientFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := []byte("through a caller's socket")
+	if err := conn.WritePacket(want); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	accepted.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := accepted.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
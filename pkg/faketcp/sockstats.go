@@ -0,0 +1,194 @@
+package faketcp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SocketStats are the kernel's figures for the socket under a connection or
+// listener. Connections a listener accepted share its socket, so theirs cover
+// every connection on it (Shared).
+type SocketStats struct {
+	RecvQueued int    // Bytes waiting in the receive buffer, with kernel overhead (/proc/net)
+	SendQueued int    // Bytes not yet sent (SIOCOUTQ)
+	RecvBuffer int    // Receive buffer size (SO_RCVBUF)
+	SendBuffer int    // Send buffer size (SO_SNDBUF)
+	Drops      uint64 // Packets dropped on a full receive buffer (/proc/net)
+	Shared     bool
+}
+
+// Tuner is implemented by connections whose knobs can be changed while they
+// run
+type Tuner interface {
+	// SocketStats returns the kernel's figures for the connection's socket
+	SocketStats() (SocketStats, error)
+	// WritePacing returns the delay left between segments of a write
+	WritePacing() time.Duration
+	// SetWritePacing overrides the tuning's WritePacingMinDelay for this
+	// connection; 0 turns pacing off and a negative delay restores the tuning
+	SetWritePacing(d time.Duration)
+}
+
+var _ Tuner = (*Conn)(nil)
+var _ Tuner = (*ConnRaw)(nil)
+
+// pacingOverride is a connection's write pacing: 0 follows the tuning,
+// otherwise the delay plus one nanosecond (atomic)
+type pacingOverride struct {
+	v atomic.Int64
+}
+
+func (p *pacingOverride) get() time.Duration {
+	if v := p.v.Load(); v > 0 {
+		return time.Duration(v - 1)
+	}
+	return tunables.WritePacingMinDelay
+}
+
+func (p *pacingOverride) set(d time.Duration) {
+	if d < 0 {
+		p.v.Store(0)
+		return
+	}
+	p.v.Store(int64(d) + 1)
+}
+
+// SocketStats returns the kernel's figures for the connection's UDP socket
+func (c *Conn) SocketStats() (SocketStats, error) {
+	s, err := udpSocketStats(c)
+	s.Shared = !c.isConnected
+	return s, err
+}
+
+// WritePacing returns the delay the tunnel leaves after a batch written to
+// the connection (UDP mode sends each write as one datagram)
+func (c *Conn) WritePacing() time.Duration {
+	return c.pacing.get()
+}
+
+// SetWritePacing overrides the write pacing for this connection
+func (c *Conn) SetWritePacing(d time.Duration) {
+	c.pacing.set(d)
+}
+
+// SocketStats returns the kernel's figures for the listener's UDP socket
+func (l *Listener) SocketStats() (SocketStats, error) {
+	s, err := udpSocketStats(l)
+	s.Shared = true
+	return s, err
+}
+
+// SocketStats returns the kernel's figures for the connection's raw socket
+func (c *ConnRaw) SocketStats() (SocketStats, error) {
+	s, err := fdSocketStats(c.rawSocket.GetFD(), "raw")
+	s.Shared = c.isListener
+	return s, err
+}
+
+// WritePacing returns the delay left between segments of a write
+func (c *ConnRaw) WritePacing() time.Duration {
+	return c.pacing.get()
+}
+
+// SetWritePacing overrides the write pacing for this connection
+func (c *ConnRaw) SetWritePacing(d time.Duration) {
+	c.pacing.set(d)
+}
+
+// SocketStats returns the kernel's figures for the listener's raw socket
+func (l *ListenerRaw) SocketStats() (SocketStats, error) {
+	s, err := fdSocketStats(l.rawSocket.GetFD(), "raw")
+	s.Shared = true
+	return s, err
+}
+
+// udpSocketStats reads the figures of the UDP socket of c or l
+func udpSocketStats(v interface{}) (SocketStats, error) {
+	var uc syscall.Conn
+	switch v := v.(type) {
+	case *Conn:
+		uc = v.sock()
+	case *Listener:
+		uc = v.udpConn
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return SocketStats{}, err
+	}
+	var s SocketStats
+	var statsErr error
+	if err := raw.Control(func(fd uintptr) {
+		s, statsErr = fdSocketStats(int(fd), "udp", "udp6")
+	}); err != nil {
+		return SocketStats{}, err
+	}
+	return s, statsErr
+}
+
+// fdSocketStats reads the figures of socket fd, looking it up by inode in
+// /proc/net/<table>. A socket created in another network namespace is not
+// listed there; its queue and drop figures are then left at zero.
+func fdSocketStats(fd int, tables ...string) (SocketStats, error) {
+	var s SocketStats
+	var err error
+	if s.RecvBuffer, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+		return s, err
+	}
+	if s.SendBuffer, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF); err != nil {
+		return s, err
+	}
+	var outq int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&outq))); errno != 0 {
+		return s, fmt.Errorf("SIOCOUTQ: %v", errno)
+	}
+	s.SendQueued = int(outq)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return s, err
+	}
+	for _, table := range tables {
+		if found, err := readProcNetSocket("/proc/net/"+table, st.Ino, &s); found || err != nil {
+			return s, err
+		}
+	}
+	return s, fmt.Errorf("socket not listed in /proc/net/%s (other network namespace?)", strings.Join(tables, ", /proc/net/"))
+}
+
+// readProcNetSocket fills the receive queue and drops of the socket with the
+// given inode from a /proc/net table such as /proc/net/udp:
+//
+//	sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+func readProcNetSocket(path string, inode uint64, s *SocketStats) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	want := strconv.FormatUint(inode, 10)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 13 || fields[9] != want {
+			continue
+		}
+		if _, rx, ok := strings.Cut(fields[4], ":"); ok {
+			if n, err := strconv.ParseUint(rx, 16, 64); err == nil {
+				s.RecvQueued = int(n)
+			}
+		}
+		s.Drops, _ = strconv.ParseUint(fields[12], 10, 64)
+		return true, nil
+	}
+	return false, sc.Err()
+}
@@ -0,0 +1,57 @@
+package faketcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSocketStats checks that datagrams left unread show up in the receive
+// queue read from /proc/net/udp and that pacing overrides the tuning
+func TestSocketStats(t *testing.T) {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	sender, err := net.DialUDP("udp4", nil, sock.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for i := 0; i < 4; i++ {
+		sender.Write(make([]byte, 500))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	c := &Conn{udpConn: sock, isConnected: true}
+	s, err := c.SocketStats()
+	if err != nil {
+		t.Skipf("socket stats unavailable: %v", err)
+	}
+	if s.RecvBuffer <= 0 || s.SendBuffer <= 0 {
+		t.Errorf("buffer sizes %d/%d", s.RecvBuffer, s.SendBuffer)
+	}
+	if s.RecvQueued < 4*500 {
+		t.Errorf("receive queue %d bytes, want at least %d", s.RecvQueued, 4*500)
+	}
+	if s.Shared {
+		t.Error("connected socket reported as shared")
+	}
+
+	if c.WritePacing() != tunables.WritePacingMinDelay {
+		t.Errorf("pacing %v before an override", c.WritePacing())
+	}
+	c.SetWritePacing(0)
+	if c.WritePacing() != 0 {
+		t.Errorf("pacing %v, want off", c.WritePacing())
+	}
+	c.SetWritePacing(300 * time.Microsecond)
+	if c.WritePacing() != 300*time.Microsecond {
+		t.Errorf("pacing %v, want 300µs", c.WritePacing())
+	}
+	c.SetWritePacing(-1)
+	if c.WritePacing() != tunables.WritePacingMinDelay {
+		t.Errorf("pacing %v after restoring the tuning", c.WritePacing())
+	}
+}
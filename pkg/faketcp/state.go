@@ -0,0 +1,167 @@
+package faketcp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Raw mode connections track where their fake TCP handshake and teardown
+// stand, so a client stuck connecting can be told apart from one whose SYNs
+// go unanswered, one answered by RSTs, or a server holding half-open
+// connections. State reports it for one connection, Handshakes for every
+// raw connection not established yet plus the last dial that failed.
+
+// ConnState is a state of the fake TCP state machine, named like TCP's
+type ConnState int32
+
+const (
+	StateClosed      ConnState = iota // Not connected yet, or gone
+	StateSynSent                      // SYN sent, waiting for the SYN-ACK (client)
+	StateSynReceived                  // SYN-ACK sent, waiting for the ACK (server)
+	StateEstablished                  // Handshake completed
+	StateCloseWait                    // The peer sent a FIN or RST, we have not closed (client)
+	StateClosing                      // Close sent a FIN and is releasing the connection
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateClosed:
+		return "CLOSED"
+	case StateSynSent:
+		return "SYN_SENT"
+	case StateSynReceived:
+		return "SYN_RECEIVED"
+	case StateEstablished:
+		return "ESTABLISHED"
+	case StateCloseWait:
+		return "CLOSE_WAIT"
+	case StateClosing:
+		return "CLOSING"
+	}
+	return fmt.Sprintf("STATE_%d", int32(s))
+}
+
+// StateInfo is a snapshot of a connection's state machine
+type StateInfo struct {
+	Local          string
+	Remote         string
+	State          ConnState
+	Since          time.Time     // When State was entered
+	Handshake      time.Duration // From the first SYN to ESTABLISHED (0 before)
+	Deadline       time.Time     // SYN_SENT: when the SYN is sent again or the dial gives up
+	SYNRetransmits int           // SYNs (client) or SYN-ACKs (server) sent again
+	LastSent       time.Time
+	LastReceived   time.Time
+	Reason         string // Why the connection is closing or closed
+}
+
+// connFSM is the state machine of a ConnRaw; its fields are atomic
+type connFSM struct {
+	state       atomic.Int32
+	since       atomic.Int64 // Unix nanoseconds
+	started     atomic.Int64 // First SYN sent or received
+	handshake   atomic.Int64
+	deadline    atomic.Int64
+	retransmits atomic.Int32
+	lastSent    atomic.Int64
+	lastRecv    atomic.Int64
+	reason      atomic.Pointer[string]
+}
+
+// enter moves to s; reason, if not empty, says why
+func (f *connFSM) enter(s ConnState, reason string) {
+	now := time.Now().UnixNano()
+	switch s {
+	case StateSynSent, StateSynReceived:
+		f.started.CompareAndSwap(0, now)
+	case StateEstablished:
+		if started := f.started.Load(); started != 0 {
+			f.handshake.Store(now - started)
+		}
+		f.deadline.Store(0)
+	}
+	if reason != "" {
+		f.reason.Store(&reason)
+	}
+	f.state.Store(int32(s))
+	f.since.Store(now)
+}
+
+// close moves to CLOSED unless already there, keeping an earlier reason
+func (f *connFSM) close(reason string) {
+	if ConnState(f.state.Load()) == StateClosed && f.since.Load() != 0 {
+		return
+	}
+	if f.reason.Load() != nil {
+		reason = ""
+	}
+	f.enter(StateClosed, reason)
+}
+
+func (f *connFSM) current() ConnState {
+	return ConnState(f.state.Load())
+}
+
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// State returns where the connection's handshake or teardown stands, its
+// timers and how often it retransmitted the handshake
+func (c *ConnRaw) State() StateInfo {
+	info := StateInfo{
+		Local:          c.LocalAddr().String(),
+		Remote:         c.RemoteAddr().String(),
+		State:          c.fsm.current(),
+		Since:          unixTime(c.fsm.since.Load()),
+		Handshake:      time.Duration(c.fsm.handshake.Load()),
+		Deadline:       unixTime(c.fsm.deadline.Load()),
+		SYNRetransmits: int(c.fsm.retransmits.Load()),
+		LastSent:       unixTime(c.fsm.lastSent.Load()),
+		LastReceived:   unixTime(c.fsm.lastRecv.Load()),
+	}
+	if r := c.fsm.reason.Load(); r != nil {
+		info.Reason = *r
+	}
+	return info
+}
+
+// notePeerClose records a FIN or RST received on a dialed connection
+func (c *ConnRaw) notePeerClose(flags uint8) {
+	reason := "FIN received"
+	if flags&RST != 0 {
+		reason = "RST received"
+	}
+	switch c.fsm.current() {
+	case StateEstablished:
+		c.fsm.enter(StateCloseWait, reason)
+	case StateSynSent:
+		// Refused; the SYN is still retried until the dial gives up
+		c.fsm.reason.Store(&reason)
+	}
+}
+
+// lastFailedDial is the state of the last dial whose handshake failed
+var lastFailedDial atomic.Pointer[StateInfo]
+
+// Handshakes returns the raw connections of the process that are not
+// established yet (dials in progress, half-open connections of listeners)
+// and, first, the last dial that failed
+func Handshakes() []StateInfo {
+	var states []StateInfo
+	if failed := lastFailedDial.Load(); failed != nil {
+		states = append(states, *failed)
+	}
+	flows.Range(func(_, v any) bool {
+		c := v.(*ConnRaw)
+		if s := c.fsm.current(); s == StateSynSent || s == StateSynReceived {
+			states = append(states, c.State())
+		}
+		return true
+	})
+	return states
+}
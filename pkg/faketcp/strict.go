@@ -0,0 +1,99 @@
+package faketcp
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// Strict validation checks every received segment before it reaches a
+// connection and drops malformed ones: raw mode verifies the IP and TCP
+// checksums, header lengths and flags; UDP mode, whose fake TCP checksums are
+// not meaningful, the data offset and flags. It costs a pass over each packet,
+// so it is off unless enabled with SetStrictValidation.
+
+var strictValidation bool
+
+// malformed counts packets dropped by strict validation, by reason
+var malformed struct {
+	ipHeader, ipChecksum, tcpHeader, tcpChecksum, tcpFlags atomic.Uint64
+}
+
+// MalformedCounts are the packets dropped by strict validation
+type MalformedCounts struct {
+	IPHeader    uint64
+	IPChecksum  uint64
+	TCPHeader   uint64
+	TCPChecksum uint64
+	TCPFlags    uint64
+}
+
+// Total is the number of dropped packets
+func (m MalformedCounts) Total() uint64 {
+	return m.IPHeader + m.IPChecksum + m.TCPHeader + m.TCPChecksum + m.TCPFlags
+}
+
+// SetStrictValidation enables strict validation of received segments
+func SetStrictValidation(on bool) {
+	strictValidation = on
+}
+
+// StrictValidation reports whether strict validation is enabled
+func StrictValidation() bool {
+	return strictValidation
+}
+
+// Malformed returns the packets dropped by strict validation so far
+func Malformed() MalformedCounts {
+	return MalformedCounts{
+		IPHeader:    malformed.ipHeader.Load(),
+		IPChecksum:  malformed.ipChecksum.Load(),
+		TCPHeader:   malformed.tcpHeader.Load(),
+		TCPChecksum: malformed.tcpChecksum.Load(),
+		TCPFlags:    malformed.tcpFlags.Load(),
+	}
+}
+
+// dropMalformed validates a received IPv4 packet (raw mode) and reports
+// whether it must be dropped
+func dropMalformed(pkt []byte) bool {
+	if !strictValidation {
+		return false
+	}
+	return countMalformed(rawsocket.ValidatePacket(pkt))
+}
+
+// dropMalformedSegment validates a received segment (UDP mode) and reports
+// whether it must be dropped
+func dropMalformedSegment(seg []byte) bool {
+	if !strictValidation {
+		return false
+	}
+	return countMalformed(rawsocket.ValidateSegment(seg))
+}
+
+// countMalformed counts a validation failure; the first of each kind is logged
+func countMalformed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var counter *atomic.Uint64
+	switch {
+	case errors.Is(err, rawsocket.ErrIPHeader):
+		counter = &malformed.ipHeader
+	case errors.Is(err, rawsocket.ErrIPChecksum):
+		counter = &malformed.ipChecksum
+	case errors.Is(err, rawsocket.ErrTCPHeader):
+		counter = &malformed.tcpHeader
+	case errors.Is(err, rawsocket.ErrTCPChecksum):
+		counter = &malformed.tcpChecksum
+	default:
+		counter = &malformed.tcpFlags
+	}
+	if counter.Add(1) == 1 {
+		log.Printf("⚠️  Strict validation: dropping malformed packets (%v)", err)
+	}
+	return true
+}
@@ -0,0 +1,8 @@
+package faketcp
+
+// sendmmsg(2) and recvmmsg(2) syscall numbers, missing from the frozen
+// syscall package on 386
+const (
+	sysSendmmsg = 345
+	sysRecvmmsg = 337
+)
@@ -0,0 +1,7 @@
+package faketcp
+
+// sendmmsg(2) and recvmmsg(2) syscall numbers
+const (
+	sysSendmmsg = 307
+	sysRecvmmsg = 299
+)
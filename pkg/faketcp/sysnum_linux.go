@@ -0,0 +1,11 @@
+//go:build linux && !amd64 && !386
+
+package faketcp
+
+import "syscall"
+
+// sendmmsg(2) and recvmmsg(2) syscall numbers
+const (
+	sysSendmmsg = syscall.SYS_SENDMMSG
+	sysRecvmmsg = syscall.SYS_RECVMMSG
+)
@@ -0,0 +1,70 @@
+package faketcp
+
+import (
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
+)
+
+// Connection traces keep each connection's recent segments, handshake, FIN
+// and RST included, in a ring the tunnel writes out as pcapng when a session
+// fails or an administrator asks for it. UDP mode segments get a synthesized
+// IPv4 header so both modes read as a TCP conversation.
+
+// traceRecords bounds the segments a connection's ring holds regardless of age
+const traceRecords = 2048
+
+// Trace configures connection traces
+type Trace struct {
+	Seconds int  // Age of the oldest segment kept (0 disables tracing)
+	Payload bool // Keep payloads, not just the IP and TCP headers
+}
+
+var traceConfig Trace
+
+// SetTrace configures tracing for connections created afterwards
+func SetTrace(t Trace) {
+	traceConfig = t
+}
+
+// newTraceRing returns the ring of a new connection, nil when tracing is off
+func newTraceRing() *capture.Ring {
+	if traceConfig.Seconds <= 0 {
+		return nil
+	}
+	return capture.NewRing(time.Duration(traceConfig.Seconds)*time.Second, traceRecords, traceConfig.Payload)
+}
+
+// Tracer is implemented by connections that keep a trace ring
+type Tracer interface {
+	// TraceRing returns the connection's ring, nil when tracing is off
+	TraceRing() *capture.Ring
+}
+
+var _ Tracer = (*Conn)(nil)
+var _ Tracer = (*ConnRaw)(nil)
+
+// TraceRing returns the connection's trace ring
+func (c *Conn) TraceRing() *capture.Ring {
+	return c.trace
+}
+
+// TraceRing returns the connection's trace ring
+func (c *ConnRaw) TraceRing() *capture.Ring {
+	return c.trace
+}
+
+// traceSegment records a segment (fake TCP header and payload) of a UDP mode
+// connection
+func (c *Conn) traceSegment(outbound bool, seg []byte) {
+	if c.trace == nil || len(seg) < TCPHeaderSize {
+		return
+	}
+	headerLen := min(max(int(seg[12]>>4)*4, TCPHeaderSize), len(seg))
+	local, remote := c.localAddr.IP, c.remoteAddr.IP
+	if outbound {
+		c.trace.AddTCP(true, local, remote, seg[:headerLen], seg[headerLen:])
+	} else {
+		c.trace.AddTCP(false, remote, local, seg[:headerLen], seg[headerLen:])
+	}
+}
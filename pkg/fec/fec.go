@@ -2,10 +2,58 @@ package fec
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/klauspost/reedsolomon"
 )
 
+// Codec selects how parity shards are computed. Both ends must use the same one.
+type Codec byte
+
+const (
+	// ReedSolomon recovers as many lost shards as there are parity shards
+	ReedSolomon Codec = 1
+	// XOR has a single parity shard, the XOR of the data shards. It recovers
+	// one lost shard per group, needs no Galois field tables and is the
+	// cheapest to compute on small CPUs.
+	XOR Codec = 2
+)
+
+func (c Codec) String() string {
+	switch c {
+	case ReedSolomon:
+		return "reed-solomon"
+	case XOR:
+		return "xor"
+	}
+	return fmt.Sprintf("codec %d", byte(c))
+}
+
+// ParseCodec returns the codec with the given name ("" is Reed-Solomon)
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "reed-solomon", "rs":
+		return ReedSolomon, nil
+	case "xor":
+		return XOR, nil
+	}
+	return 0, fmt.Errorf("unknown FEC codec %q (use reed-solomon or xor)", name)
+}
+
+// newEncoder returns the encoder of a codec
+func newEncoder(codec Codec, dataShards, parityShards int) (reedsolomon.Encoder, error) {
+	switch codec {
+	case ReedSolomon:
+		return reedsolomon.New(dataShards, parityShards)
+	case XOR:
+		if parityShards != 1 {
+			return nil, fmt.Errorf("the xor codec has exactly one parity shard, not %d", parityShards)
+		}
+		return reedsolomon.New(dataShards, 1, reedsolomon.WithFastOneParityMatrix())
+	}
+	return nil, fmt.Errorf("unsupported FEC codec %d", byte(codec))
+}
+
 // ErrIncomplete indicates that not enough shards are present yet to reconstruct the data
 var ErrIncomplete = errors.New("not enough shards to reconstruct data")
 
@@ -17,13 +65,19 @@ type FEC struct {
 	dataShards   int
 	parityShards int
 	shardSize    int
+	codec        Codec
 	encoder      reedsolomon.Encoder
 }
 
-// NewFEC creates a new FEC encoder/decoder
+// NewFEC creates a new Reed-Solomon FEC encoder/decoder
 // dataShards: number of data shards
 // parityShards: number of parity shards for error correction
 func NewFEC(dataShards, parityShards, shardSize int) (*FEC, error) {
+	return NewFECWithCodec(ReedSolomon, dataShards, parityShards, shardSize)
+}
+
+// NewFECWithCodec creates a new FEC encoder/decoder using codec
+func NewFECWithCodec(codec Codec, dataShards, parityShards, shardSize int) (*FEC, error) {
 	if dataShards <= 0 || parityShards <= 0 {
 		return nil, errors.New("dataShards and parityShards must be positive")
 	}
@@ -31,7 +85,7 @@ func NewFEC(dataShards, parityShards, shardSize int) (*FEC, error) {
 		return nil, errors.New("shardSize must be positive")
 	}
 
-	enc, err := reedsolomon.New(dataShards, parityShards)
+	enc, err := newEncoder(codec, dataShards, parityShards)
 	if err != nil {
 		return nil, err
 	}
@@ -40,6 +94,7 @@ func NewFEC(dataShards, parityShards, shardSize int) (*FEC, error) {
 		dataShards:   dataShards,
 		parityShards: parityShards,
 		shardSize:    shardSize,
+		codec:        codec,
 		encoder:      enc,
 	}, nil
 }
@@ -161,14 +216,19 @@ func (f *FEC) ParityShards() int {
 func (f *FEC) TotalShards() int {
 	return f.dataShards + f.parityShards
 }
+
+// Codec returns the codec computing the parity shards
+func (f *FEC) Codec() Codec {
+	return f.codec
+}
 // EncodeShards uses the pre-configured encoder to encode shards.
 func (f *FEC) EncodeShards(shards [][]byte) error {
 	return f.encoder.Encode(shards)
 }
-// EncodeShards encodes data+parity shards using Reed-Solomon.
+// EncodeShards encodes data+parity shards using codec.
 // shards length must be dataShards+parityShards and each shard must be the same size.
-func EncodeShards(shards [][]byte, dataShards, parityShards int) error {
-	enc, err := reedsolomon.New(dataShards, parityShards)
+func EncodeShards(codec Codec, shards [][]byte, dataShards, parityShards int) error {
+	enc, err := newEncoder(codec, dataShards, parityShards)
 	if err != nil {
 		return err
 	}
@@ -186,9 +246,9 @@ func EncodeShards(shards [][]byte, dataShards, parityShards int) error {
 // ReconstructShards reconstructs missing shards in-place.
 // This function creates a NEW encoder every time which is VERY expensive (CPU heavy).
 // It should be deprecated in favor of a method on the *FEC struct that reuses the encoder.
-func ReconstructShards(shards [][]byte, dataShards, parityShards int) error {
+func ReconstructShards(codec Codec, shards [][]byte, dataShards, parityShards int) error {
 	// WARNING: This is a performance bottleneck if called frequently!
-	enc, err := reedsolomon.New(dataShards, parityShards)
+	enc, err := newEncoder(codec, dataShards, parityShards)
 	if err != nil {
 		return err
 	}
@@ -214,3 +214,34 @@ func TestDecodeLargeData(t *testing.T) {
 		t.Errorf("Decoded large data doesn't match original")
 	}
 }
+
+// TestXORCodec checks that the xor codec's parity is the XOR of the data
+// shards and that it recovers one lost shard
+func TestXORCodec(t *testing.T) {
+	if _, err := NewFECWithCodec(XOR, 4, 2, 8); err == nil {
+		t.Fatal("xor codec accepted two parity shards")
+	}
+	f, err := NewFECWithCodec(XOR, 4, 1, 8)
+	if err != nil {
+		t.Fatalf("NewFECWithCodec: %v", err)
+	}
+	data := []byte("0123456789abcdefghijklmnopqrstuv")
+	shards, err := f.Encode(data)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	for i := range shards[4] {
+		if x := shards[0][i] ^ shards[1][i] ^ shards[2][i] ^ shards[3][i]; shards[4][i] != x {
+			t.Fatalf("parity byte %d is %#x, want %#x", i, shards[4][i], x)
+		}
+	}
+
+	present := []bool{true, true, false, true, true}
+	decoded, err := f.Decode(shards, present)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("decoded %q, want %q", decoded, data)
+	}
+}
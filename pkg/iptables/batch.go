@@ -0,0 +1,208 @@
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
+)
+
+// Batch collects rule changes that Apply makes with one iptables-restore
+// call instead of two or three iptables calls per rule. The kernel commits
+// each restored table in one step (a single transaction with the nft
+// backend), so its changes take effect together or not at all.
+type Batch struct {
+	m       *IPTablesManager
+	adds    []string
+	removes []string
+}
+
+// NewBatch starts a set of changes to the manager's rules
+func (m *IPTablesManager) NewBatch() *Batch {
+	return &Batch{m: m}
+}
+
+// AddRuleForPort queues the RST-dropping rule for port (see AddRuleForPort)
+func (b *Batch) AddRuleForPort(port uint16, isServer bool) {
+	b.m.mu.Lock()
+	defer b.m.mu.Unlock()
+	b.adds = append(b.adds, b.m.portRule(port, isServer))
+}
+
+// RemoveRuleForPort queues the removal of the RST-dropping rule for port
+func (b *Batch) RemoveRuleForPort(port uint16, isServer bool) {
+	b.m.mu.Lock()
+	defer b.m.mu.Unlock()
+	b.removes = append(b.removes, b.m.portRule(port, isServer))
+}
+
+// AddCustomRule queues a custom rule (see AddCustomRule)
+func (b *Batch) AddCustomRule(rule string) {
+	b.adds = append(b.adds, rule)
+}
+
+// RemoveCustomRule queues the removal of a custom rule added before
+func (b *Batch) RemoveCustomRule(rule string) {
+	b.removes = append(b.removes, rule)
+}
+
+// Len returns the number of queued changes
+func (b *Batch) Len() int {
+	return len(b.adds) + len(b.removes)
+}
+
+// Apply makes the queued changes and empties the batch. Removals come first.
+// Rules the manager already owns are not added again and rules it does not
+// own are not removed, so applying the same changes twice is harmless. When
+// iptables-restore is missing or rejects the batch (e.g. a rule to remove was
+// deleted by a firewall reload), the changes are made one by one instead.
+func (b *Batch) Apply() error {
+	m := b.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owned := make(map[string]bool, len(m.rules))
+	for _, rule := range m.rules {
+		owned[rule] = true
+	}
+	var adds, removes []string
+	for _, rule := range b.removes {
+		if owned[rule] {
+			removes = append(removes, rule)
+			delete(owned, rule)
+		}
+	}
+	for _, rule := range b.adds {
+		if !owned[rule] {
+			adds = append(adds, rule)
+			owned[rule] = true
+		}
+	}
+	b.adds, b.removes = nil, nil
+	if len(adds)+len(removes) == 0 {
+		return nil
+	}
+
+	output, err := m.restore(restoreScript(adds, removes))
+	if err != nil {
+		if !errors.Is(err, exec.ErrNotFound) {
+			log.Printf("iptables-restore failed (%v: %s), applying %d rule changes one by one",
+				err, strings.TrimSpace(string(output)), len(adds)+len(removes))
+		}
+		return m.applyEach(adds, removes)
+	}
+	m.rules = append(withoutRules(m.rules, removes), adds...)
+	for _, rule := range removes {
+		log.Printf("Removed iptables rule: iptables -D %s", rule)
+	}
+	for _, rule := range adds {
+		log.Printf("Added iptables rule: iptables -A %s", rule)
+	}
+	return nil
+}
+
+// applyEach makes the changes of a batch with one iptables call per rule; the
+// caller holds m.mu
+func (m *IPTablesManager) applyEach(adds, removes []string) error {
+	var errs []string
+	var removed []string
+	for _, rule := range removes {
+		if output, err := m.iptables(append([]string{"-D"}, strings.Split(rule, " ")...)...); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to remove rule '%s': %v, output: %s", rule, err, output))
+			continue
+		}
+		log.Printf("Removed iptables rule: iptables -D %s", rule)
+		removed = append(removed, rule)
+	}
+	m.rules = withoutRules(m.rules, removed)
+	for _, rule := range adds {
+		if output, err := m.iptables(append([]string{"-A"}, strings.Split(rule, " ")...)...); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to add rule '%s': %v, output: %s", rule, err, output))
+			continue
+		}
+		log.Printf("Added iptables rule: iptables -A %s", rule)
+		m.rules = append(m.rules, rule)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("errors applying rules: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// restore feeds script to iptables-restore in the manager's network namespace,
+// leaving rules not in the script alone
+func (m *IPTablesManager) restore(script string) ([]byte, error) {
+	var output []byte
+	err := netns.Do(m.netns, func() error {
+		cmd := exec.Command("iptables-restore", "--noflush")
+		cmd.Stdin = strings.NewReader(script)
+		var err error
+		output, err = cmd.CombinedOutput()
+		return err
+	})
+	return output, err
+}
+
+// restoreScript renders removals and additions in iptables-restore format,
+// one section per table. Rules name their table with -t (default filter).
+func restoreScript(adds, removes []string) string {
+	var tables []string
+	lines := make(map[string][]string)
+	queue := func(op, rule string) {
+		table, spec := splitTable(rule)
+		if _, ok := lines[table]; !ok {
+			tables = append(tables, table)
+		}
+		lines[table] = append(lines[table], op+" "+spec)
+	}
+	for _, rule := range removes {
+		queue("-D", rule)
+	}
+	for _, rule := range adds {
+		queue("-A", rule)
+	}
+
+	var sb strings.Builder
+	for _, table := range tables {
+		sb.WriteString("*" + table + "\n")
+		for _, line := range lines[table] {
+			sb.WriteString(line + "\n")
+		}
+		sb.WriteString("COMMIT\n")
+	}
+	return sb.String()
+}
+
+// splitTable separates the -t option from a rule
+func splitTable(rule string) (table, spec string) {
+	fields := strings.Split(rule, " ")
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-t" {
+			table = fields[i+1]
+			fields = append(fields[:i:i], fields[i+2:]...)
+			return table, strings.Join(fields, " ")
+		}
+	}
+	return "filter", rule
+}
+
+// withoutRules returns rules without those in removed
+func withoutRules(rules, removed []string) []string {
+	if len(removed) == 0 {
+		return rules
+	}
+	drop := make(map[string]bool, len(removed))
+	for _, rule := range removed {
+		drop[rule] = true
+	}
+	kept := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if !drop[rule] {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
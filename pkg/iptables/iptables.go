@@ -6,35 +6,72 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
 )
 
 // IPTablesManager manages iptables rules for raw socket TCP
 type IPTablesManager struct {
-	rules []string
-	mu    sync.Mutex
+	rules   []string
+	comment string // Optional rule comment, makes rules distinct per owner
+	netns   string // Network namespace the rules apply to ("" = our own)
+	command string // iptables, or ip6tables for IPv6 rules
+	mu      sync.Mutex
 }
 
 // NewIPTablesManager creates a new iptables manager
 func NewIPTablesManager() *IPTablesManager {
 	return &IPTablesManager{
-		rules: make([]string, 0),
+		rules:   make([]string, 0),
+		command: "iptables",
+	}
+}
+
+// SetIPv6 manages IPv6 rules (ip6tables) instead of IPv4 ones from now on
+func (m *IPTablesManager) SetIPv6(ipv6 bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.command = "iptables"
+	if ipv6 {
+		m.command = "ip6tables"
 	}
 }
 
+// SetComment tags rules added afterwards with an iptables comment (no spaces).
+// Tagged rules are distinct from identical rules added by other processes.
+func (m *IPTablesManager) SetComment(comment string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.comment = strings.ReplaceAll(comment, " ", "-")
+}
+
+// SetNetNS applies rules added afterwards in the network namespace at path
+// (see netns.Path) instead of the process's own, e.g. the namespace the raw
+// sockets were created in
+func (m *IPTablesManager) SetNetNS(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.netns = path
+}
+
+// iptables runs iptables (or ip6tables) in the manager's network namespace
+func (m *IPTablesManager) iptables(args ...string) ([]byte, error) {
+	var output []byte
+	err := netns.Do(m.netns, func() error {
+		var err error
+		output, err = exec.Command(m.command, args...).CombinedOutput()
+		return err
+	})
+	return output, err
+}
+
 // AddRuleForPort adds an iptables rule to drop RST packets for a specific port
 // This is essential for raw socket TCP to work properly
 func (m *IPTablesManager) AddRuleForPort(port uint16, isServer bool) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	var rule string
-	if isServer {
-		// Server: drop RST packets sent by kernel for incoming connections on this port
-		rule = fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port)
-	} else {
-		// Client: drop RST packets sent by kernel for outgoing connections on this port
-		rule = fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port)
-	}
+	rule := m.portRule(port, isServer)
 
 	// Check if rule already exists
 	if m.ruleExists(rule) {
@@ -46,8 +83,7 @@ func (m *IPTablesManager) AddRuleForPort(port uint16, isServer bool) error {
 	args := strings.Split(rule, " ")
 	args = append([]string{"-A"}, args...)
 	
-	cmd := exec.Command("iptables", args...)
-	output, err := cmd.CombinedOutput()
+	output, err := m.iptables(args...)
 	if err != nil {
 		return fmt.Errorf("failed to add iptables rule: %v, output: %s", err, output)
 	}
@@ -57,6 +93,56 @@ func (m *IPTablesManager) AddRuleForPort(port uint16, isServer bool) error {
 	return nil
 }
 
+// VerifyRuleForPort reads the RST-dropping rule for port back from the
+// kernel's ruleset and fails if it is not there. iptables can exit successfully
+// without the rule taking effect (e.g. an nft backend that lost a race with a
+// firewall reload), so callers check before sending the first packet.
+func (m *IPTablesManager) VerifyRuleForPort(port uint16, isServer bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rule := m.portRule(port, isServer)
+	if !m.ruleExists(rule) {
+		return fmt.Errorf("iptables rule not found after adding it: %s", rule)
+	}
+	return nil
+}
+
+// portRule returns the RST-dropping rule for port; the caller holds m.mu
+func (m *IPTablesManager) portRule(port uint16, isServer bool) string {
+	var rule string
+	if isServer {
+		// Server: drop RST packets sent by kernel for incoming connections on this port
+		rule = fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port)
+	} else {
+		// Client: drop RST packets sent by kernel for outgoing connections on this port
+		rule = fmt.Sprintf("OUTPUT -p tcp --tcp-flags RST RST --sport %d -j DROP", port)
+	}
+	if m.comment != "" {
+		rule = strings.Replace(rule, " -j DROP", " -m comment --comment "+m.comment+" -j DROP", 1)
+	}
+	return rule
+}
+
+// AdoptRuleForPort is AddRuleForPort for a port taken over from another
+// process: a rule that already exists is owned from now on and removed by
+// RemoveAllRules
+func (m *IPTablesManager) AdoptRuleForPort(port uint16, isServer bool) error {
+	if err := m.AddRuleForPort(port, isServer); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rule := m.portRule(port, isServer)
+	for _, r := range m.rules {
+		if r == rule {
+			return nil
+		}
+	}
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
 // AddRuleForConnection adds iptables rules for a specific connection (both directions)
 func (m *IPTablesManager) AddRuleForConnection(localIP string, localPort uint16, remoteIP string, remotePort uint16, isServer bool) error {
 	m.mu.Lock()
@@ -89,8 +175,7 @@ func (m *IPTablesManager) AddRuleForConnection(localIP string, localPort uint16,
 		args := strings.Split(rule, " ")
 		args = append([]string{"-A"}, args...)
 		
-		cmd := exec.Command("iptables", args...)
-		output, err := cmd.CombinedOutput()
+		output, err := m.iptables(args...)
 		if err != nil {
 			return fmt.Errorf("failed to add iptables rule: %v, output: %s", err, output)
 		}
@@ -102,33 +187,20 @@ func (m *IPTablesManager) AddRuleForConnection(localIP string, localPort uint16,
 	return nil
 }
 
-// RemoveAllRules removes all iptables rules added by this manager
+// RemoveAllRules removes all iptables rules added by this manager, in one
+// batch. The manager forgets them even if some could not be removed.
 func (m *IPTablesManager) RemoveAllRules() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	var errors []string
-	
-	for _, rule := range m.rules {
-		args := strings.Split(rule, " ")
-		args = append([]string{"-D"}, args...)
-		
-		cmd := exec.Command("iptables", args...)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("failed to remove rule '%s': %v, output: %s", rule, err, output))
-			continue
-		}
-		
-		log.Printf("Removed iptables rule: iptables -D %s", rule)
-	}
+	batch := m.NewBatch()
+	batch.removes = m.GetRules()
+	err := batch.Apply()
 
+	m.mu.Lock()
 	m.rules = make([]string, 0)
+	m.mu.Unlock()
 
-	if len(errors) > 0 {
-		return fmt.Errorf("errors removing rules: %s", strings.Join(errors, "; "))
+	if err != nil {
+		return fmt.Errorf("errors removing rules: %v", err)
 	}
-
 	return nil
 }
 
@@ -137,8 +209,7 @@ func (m *IPTablesManager) ruleExists(rule string) bool {
 	args := strings.Split(rule, " ")
 	args = append([]string{"-C"}, args...)
 	
-	cmd := exec.Command("iptables", args...)
-	err := cmd.Run()
+	_, err := m.iptables(args...)
 	return err == nil
 }
 
@@ -207,8 +278,35 @@ func (m *IPTablesManager) GetRules() []string {
 	return rules
 }
 
+// RuleState reports whether a managed rule is installed
+type RuleState struct {
+	Rule    string `json:"rule"`
+	Present bool   `json:"present"`
+}
+
+// CheckRules reports for each managed rule whether it is still installed, so
+// rules removed by a firewall reload or another tool can be spotted
+func (m *IPTablesManager) CheckRules() []RuleState {
+	rules := m.GetRules()
+	states := make([]RuleState, len(rules))
+	for i, rule := range rules {
+		states[i] = RuleState{Rule: rule, Present: m.ruleExists(rule)}
+	}
+	return states
+}
+
 // AddCustomRule adds a custom iptables rule
 func (m *IPTablesManager) AddCustomRule(rule string) error {
+	return m.addCustomRule("-A", rule)
+}
+
+// InsertCustomRule adds a custom iptables rule at the top of its chain, ahead
+// of the rules already there
+func (m *IPTablesManager) InsertCustomRule(rule string) error {
+	return m.addCustomRule("-I", rule)
+}
+
+func (m *IPTablesManager) addCustomRule(op, rule string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -217,10 +315,9 @@ func (m *IPTablesManager) AddCustomRule(rule string) error {
 	}
 
 	args := strings.Split(rule, " ")
-	args = append([]string{"-A"}, args...)
+	args = append([]string{op}, args...)
 	
-	cmd := exec.Command("iptables", args...)
-	output, err := cmd.CombinedOutput()
+	output, err := m.iptables(args...)
 	if err != nil {
 		return fmt.Errorf("failed to add custom rule: %v, output: %s", err, output)
 	}
@@ -0,0 +1,649 @@
+// Package kcp implements the KCP ARQ protocol (github.com/skywind3000/kcp) in
+// message mode: reliable, in-order delivery of datagrams over a lossy packet
+// transport, trading some bandwidth for much lower latency than TCP. Segments
+// use the ikcp wire format, so either end may be another KCP implementation
+// with the same conversation id.
+//
+// A KCP does no I/O and reads no clock. The owner feeds it received segments
+// with Input, queues messages with Send, calls Update with the current time in
+// milliseconds (when Check says so) and sends what the output function gets.
+// It is not safe for concurrent use.
+package kcp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Overhead is the size of a segment header
+const Overhead = 24
+
+const (
+	cmdPush = 81 // Data
+	cmdAck  = 82 // Acknowledgement
+	cmdWask = 83 // Window probe (ask)
+	cmdWins = 84 // Window size (tell)
+
+	askSend = 1 // Need to send cmdWask
+	askTell = 2 // Need to send cmdWins
+
+	rtoNoDelay = 30 // Minimum RTO with nodelay
+	rtoMin     = 100
+	rtoDefault = 200
+	rtoMax     = 60000
+
+	wndSnd      = 32
+	wndRcv      = 128 // At least the maximum fragment count
+	mtuDefault  = 1400
+	intervalDef = 100
+	deadLink    = 20 // Transmissions of one segment after which the link counts as dead
+	threshInit  = 2
+	threshMin   = 2
+	probeInit   = 7000   // Initial window probe interval (ms)
+	probeLimit  = 120000 // Maximum window probe interval (ms)
+	fastLimit   = 5      // Maximum fast retransmissions of one segment
+)
+
+var (
+	ErrMessageSize = errors.New("kcp: message needs more fragments than the receive window holds")
+	ErrConv        = errors.New("kcp: segment of another conversation")
+	ErrSegment     = errors.New("kcp: malformed segment")
+	ErrMTU         = errors.New("kcp: MTU too small")
+)
+
+type segment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+	data     []byte
+}
+
+func (s *segment) encode(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, s.conv)
+	b = append(b, s.cmd, s.frg)
+	b = binary.LittleEndian.AppendUint16(b, s.wnd)
+	b = binary.LittleEndian.AppendUint32(b, s.ts)
+	b = binary.LittleEndian.AppendUint32(b, s.sn)
+	b = binary.LittleEndian.AppendUint32(b, s.una)
+	return binary.LittleEndian.AppendUint32(b, uint32(len(s.data)))
+}
+
+type ackItem struct {
+	sn, ts uint32
+}
+
+// KCP is one end of a conversation
+type KCP struct {
+	conv, mtu, mss     uint32
+	sndUna, sndNxt     uint32
+	rcvNxt             uint32
+	ssthresh           uint32
+	rxRttval, rxSrtt   int32
+	rxRto, rxMinrto    uint32
+	sndWnd, rcvWnd     uint32
+	rmtWnd, cwnd, incr uint32
+	probe              uint32
+	current, interval  uint32
+	tsFlush            uint32
+	nodelay            uint32
+	updated            bool
+	tsProbe, probeWait uint32
+	fastresend         uint32
+	nocwnd             bool
+	dead               bool
+	xmit               uint64
+	sndQueue, rcvQueue []segment
+	sndBuf, rcvBuf     []segment
+	acklist            []ackItem
+	buffer             []byte
+	output             func([]byte)
+}
+
+// New creates one end of conversation conv. output is called with each
+// datagram to send; the slice is reused once it returns.
+func New(conv uint32, output func([]byte)) *KCP {
+	k := &KCP{
+		conv:     conv,
+		sndWnd:   wndSnd,
+		rcvWnd:   wndRcv,
+		rmtWnd:   wndRcv,
+		rxRto:    rtoDefault,
+		rxMinrto: rtoMin,
+		interval: intervalDef,
+		tsFlush:  intervalDef,
+		ssthresh: threshInit,
+		output:   output,
+	}
+	k.SetMTU(mtuDefault)
+	k.cwnd, k.incr = 1, k.mss
+	return k
+}
+
+// SetMTU sets the largest datagram passed to output, headers included
+func (k *KCP) SetMTU(mtu int) error {
+	if mtu < 50 {
+		return ErrMTU
+	}
+	k.mtu = uint32(mtu)
+	k.mss = k.mtu - Overhead
+	k.buffer = make([]byte, 0, mtu)
+	return nil
+}
+
+// NoDelay tunes latency against bandwidth, like ikcp_nodelay. nodelay 1 lowers
+// the minimum RTO and backs off retransmissions by 1.5 instead of 2 (2 backs
+// off from the current RTO estimate); interval is the flush period in ms
+// (10-5000); resend enables fast retransmission after that many later
+// segments were acknowledged (0 disables); nc turns congestion control off,
+// leaving only the windows. Negative values keep the current setting.
+func (k *KCP) NoDelay(nodelay, interval, resend int, nc bool) {
+	if nodelay >= 0 {
+		k.nodelay = uint32(nodelay)
+		if nodelay != 0 {
+			k.rxMinrto = rtoNoDelay
+		} else {
+			k.rxMinrto = rtoMin
+		}
+	}
+	if interval >= 0 {
+		k.interval = uint32(min(max(interval, 10), 5000))
+	}
+	if resend >= 0 {
+		k.fastresend = uint32(resend)
+	}
+	k.nocwnd = nc
+}
+
+// WndSize sets the send and receive windows in segments; values below 1 keep
+// the current one, and the receive window is at least 128
+func (k *KCP) WndSize(snd, rcv int) {
+	if snd > 0 {
+		k.sndWnd = uint32(snd)
+	}
+	if rcv > 0 {
+		k.rcvWnd = uint32(max(rcv, wndRcv))
+	}
+}
+
+// WaitSnd returns the number of segments queued or awaiting acknowledgement
+func (k *KCP) WaitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// Dead reports whether a segment went unacknowledged for deadLink
+// transmissions
+func (k *KCP) Dead() bool {
+	return k.dead
+}
+
+// Retransmissions returns the number of segments sent again after their RTO
+// expired
+func (k *KCP) Retransmissions() uint64 {
+	return k.xmit
+}
+
+// SRTT returns the smoothed round-trip time in ms, 0 before the first sample
+func (k *KCP) SRTT() int {
+	return int(k.rxSrtt)
+}
+
+// Send queues a message; it is copied
+func (k *KCP) Send(msg []byte) error {
+	count := 1
+	if len(msg) > int(k.mss) {
+		count = (len(msg) + int(k.mss) - 1) / int(k.mss)
+	}
+	if count >= wndRcv {
+		return ErrMessageSize
+	}
+	for i := 0; i < count; i++ {
+		size := min(len(msg), int(k.mss))
+		data := make([]byte, size)
+		copy(data, msg)
+		msg = msg[size:]
+		k.sndQueue = append(k.sndQueue, segment{frg: uint8(count - i - 1), data: data})
+	}
+	return nil
+}
+
+// PeekSize returns the size of the next complete message, or -1 if there is
+// none
+func (k *KCP) PeekSize() int {
+	if len(k.rcvQueue) == 0 {
+		return -1
+	}
+	seg := &k.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+	if len(k.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+	length := 0
+	for i := range k.rcvQueue {
+		length += len(k.rcvQueue[i].data)
+		if k.rcvQueue[i].frg == 0 {
+			break
+		}
+	}
+	return length
+}
+
+// Recv returns the next complete message, or nil if there is none
+func (k *KCP) Recv() []byte {
+	size := k.PeekSize()
+	if size < 0 {
+		return nil
+	}
+	wasFull := len(k.rcvQueue) >= int(k.rcvWnd)
+	msg := make([]byte, 0, size)
+	count := 0
+	for i := range k.rcvQueue {
+		msg = append(msg, k.rcvQueue[i].data...)
+		count++
+		if k.rcvQueue[i].frg == 0 {
+			break
+		}
+	}
+	k.rcvQueue = removeFront(k.rcvQueue, count)
+	k.moveRcvBuf()
+	if len(k.rcvQueue) < int(k.rcvWnd) && wasFull {
+		k.probe |= askTell // Tell the peer the window opened again
+	}
+	return msg
+}
+
+// Input processes a datagram received from the peer
+func (k *KCP) Input(data []byte) error {
+	prevUna := k.sndUna
+	var maxack uint32
+	ackSeen := false
+	if len(data) < Overhead {
+		return ErrSegment
+	}
+	for len(data) >= Overhead {
+		conv := binary.LittleEndian.Uint32(data)
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[Overhead:]
+		if conv != k.conv {
+			return ErrConv
+		}
+		if uint32(len(data)) < length {
+			return ErrSegment
+		}
+		if cmd != cmdPush && cmd != cmdAck && cmd != cmdWask && cmd != cmdWins {
+			return ErrSegment
+		}
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+		switch cmd {
+		case cmdAck:
+			if rtt := timediff(k.current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !ackSeen || timediff(sn, maxack) > 0 {
+				ackSeen = true
+				maxack = sn
+			}
+		case cmdPush:
+			if timediff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, ackItem{sn, ts})
+				if timediff(sn, k.rcvNxt) >= 0 {
+					payload := make([]byte, length)
+					copy(payload, data)
+					k.parseData(segment{conv: conv, cmd: cmd, frg: frg, wnd: wnd, ts: ts, sn: sn, una: una, data: payload})
+				}
+			}
+		case cmdWask:
+			k.probe |= askTell
+		}
+		data = data[length:]
+	}
+	if ackSeen {
+		k.parseFastack(maxack)
+	}
+
+	if timediff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			if k.incr < mss {
+				k.incr = mss
+			}
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+// Update advances the clock to current (ms, any epoch) and flushes when the
+// interval elapsed
+func (k *KCP) Update(current uint32) {
+	k.current = current
+	if !k.updated {
+		k.updated = true
+		k.tsFlush = current
+	}
+	slap := timediff(current, k.tsFlush)
+	if slap >= 10000 || slap < -10000 {
+		k.tsFlush = current
+		slap = 0
+	}
+	if slap >= 0 {
+		k.tsFlush += k.interval
+		if timediff(current, k.tsFlush) >= 0 {
+			k.tsFlush = current + k.interval
+		}
+		k.Flush()
+	}
+}
+
+// Check returns when Update should be called next, at most one interval after
+// current
+func (k *KCP) Check(current uint32) uint32 {
+	if !k.updated {
+		return current
+	}
+	tsFlush := k.tsFlush
+	if d := timediff(current, tsFlush); d >= 10000 || d < -10000 {
+		tsFlush = current
+	}
+	if timediff(current, tsFlush) >= 0 {
+		return current
+	}
+	next := timediff(tsFlush, current)
+	for i := range k.sndBuf {
+		diff := timediff(k.sndBuf[i].resendts, current)
+		if diff <= 0 {
+			return current
+		}
+		next = min(next, diff)
+	}
+	return current + uint32(min(next, int32(k.interval)))
+}
+
+// Flush sends pending acknowledgements, window probes and the segments the
+// windows allow. Update calls it; calling it right after Send saves up to an
+// interval of latency.
+func (k *KCP) Flush() {
+	if !k.updated {
+		return
+	}
+	current := k.current
+	seg := segment{conv: k.conv, cmd: cmdAck, wnd: k.wndUnused(), una: k.rcvNxt}
+	buf := k.buffer[:0]
+	makeSpace := func(space int) {
+		if len(buf)+space > int(k.mtu) {
+			k.output(buf)
+			buf = buf[:0]
+		}
+	}
+
+	for _, ack := range k.acklist {
+		makeSpace(Overhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		buf = seg.encode(buf)
+	}
+	k.acklist = k.acklist[:0]
+	seg.sn, seg.ts = 0, 0
+
+	// Probe a zero remote window
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = probeInit
+			k.tsProbe = current + k.probeWait
+		} else if timediff(current, k.tsProbe) >= 0 {
+			k.probeWait = min(max(k.probeWait, probeInit)*3/2, probeLimit)
+			k.tsProbe = current + k.probeWait
+			k.probe |= askSend
+		}
+	} else {
+		k.tsProbe, k.probeWait = 0, 0
+	}
+	if k.probe&askSend != 0 {
+		seg.cmd = cmdWask
+		makeSpace(Overhead)
+		buf = seg.encode(buf)
+	}
+	if k.probe&askTell != 0 {
+		seg.cmd = cmdWins
+		makeSpace(Overhead)
+		buf = seg.encode(buf)
+	}
+	k.probe = 0
+
+	cwnd := min(k.sndWnd, k.rmtWnd)
+	if !k.nocwnd {
+		cwnd = min(k.cwnd, cwnd)
+	}
+	for timediff(k.sndNxt, k.sndUna+cwnd) < 0 && len(k.sndQueue) > 0 {
+		s := k.sndQueue[0]
+		k.sndQueue = removeFront(k.sndQueue, 1)
+		s.conv = k.conv
+		s.cmd = cmdPush
+		s.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, s)
+	}
+
+	resent := k.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	var rtomin uint32
+	if k.nodelay == 0 {
+		rtomin = k.rxRto >> 3
+	}
+	change, lost := false, false
+	for i := range k.sndBuf {
+		s := &k.sndBuf[i]
+		send := false
+		switch {
+		case s.xmit == 0:
+			send = true
+			s.rto = k.rxRto
+			s.resendts = current + s.rto + rtomin
+		case timediff(current, s.resendts) >= 0:
+			send = true
+			k.xmit++
+			switch k.nodelay {
+			case 0:
+				s.rto += max(s.rto, k.rxRto)
+			case 1:
+				s.rto += s.rto / 2
+			default:
+				s.rto += k.rxRto / 2
+			}
+			s.resendts = current + s.rto
+			lost = true
+		case s.fastack >= resent && s.xmit <= fastLimit:
+			send = true
+			s.fastack = 0
+			s.resendts = current + s.rto
+			change = true
+		}
+		if !send {
+			continue
+		}
+		s.xmit++
+		s.ts = current
+		s.wnd = seg.wnd
+		s.una = k.rcvNxt
+		makeSpace(Overhead + len(s.data))
+		buf = s.encode(buf)
+		buf = append(buf, s.data...)
+		if s.xmit >= deadLink {
+			k.dead = true
+		}
+	}
+	if len(buf) > 0 {
+		k.output(buf)
+	}
+	k.buffer = buf[:0]
+
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = max(inflight/2, threshMin)
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = max(k.cwnd/2, threshMin)
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
+
+func (k *KCP) wndUnused() uint16 {
+	if len(k.rcvQueue) < int(k.rcvWnd) {
+		return uint16(min(k.rcvWnd-uint32(len(k.rcvQueue)), 0xffff))
+	}
+	return 0
+}
+
+func (k *KCP) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = max((7*k.rxSrtt+rtt)/8, 1)
+	}
+	rto := uint32(k.rxSrtt) + max(k.interval, uint32(4*k.rxRttval))
+	k.rxRto = min(max(rto, k.rxMinrto), rtoMax)
+}
+
+func (k *KCP) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *KCP) parseAck(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		if sn == k.sndBuf[i].sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			return
+		}
+		if timediff(sn, k.sndBuf[i].sn) < 0 {
+			return
+		}
+	}
+}
+
+func (k *KCP) parseUna(una uint32) {
+	count := 0
+	for i := range k.sndBuf {
+		if timediff(una, k.sndBuf[i].sn) <= 0 {
+			break
+		}
+		count++
+	}
+	k.sndBuf = removeFront(k.sndBuf, count)
+}
+
+// parseFastack counts an acknowledgement beyond each earlier unacknowledged
+// segment
+func (k *KCP) parseFastack(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		if timediff(sn, k.sndBuf[i].sn) < 0 {
+			break
+		}
+		if sn != k.sndBuf[i].sn {
+			k.sndBuf[i].fastack++
+		}
+	}
+}
+
+func (k *KCP) parseData(s segment) {
+	if timediff(s.sn, k.rcvNxt+k.rcvWnd) >= 0 || timediff(s.sn, k.rcvNxt) < 0 {
+		return
+	}
+	i := len(k.rcvBuf) - 1
+	for ; i >= 0; i-- {
+		if k.rcvBuf[i].sn == s.sn {
+			return // Duplicate
+		}
+		if timediff(s.sn, k.rcvBuf[i].sn) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, segment{})
+	copy(k.rcvBuf[i+2:], k.rcvBuf[i+1:])
+	k.rcvBuf[i+1] = s
+	k.moveRcvBuf()
+}
+
+// moveRcvBuf moves segments that arrived in order to the receive queue
+func (k *KCP) moveRcvBuf() {
+	count := 0
+	for count < len(k.rcvBuf) {
+		s := &k.rcvBuf[count]
+		if s.sn != k.rcvNxt || len(k.rcvQueue) >= int(k.rcvWnd) {
+			break
+		}
+		k.rcvQueue = append(k.rcvQueue, *s)
+		k.rcvNxt++
+		count++
+	}
+	k.rcvBuf = removeFront(k.rcvBuf, count)
+}
+
+// removeFront drops the first n segments, reusing the array
+func removeFront(q []segment, n int) []segment {
+	if n == 0 {
+		return q
+	}
+	rest := copy(q, q[n:])
+	for i := rest; i < len(q); i++ {
+		q[i] = segment{} // Release the data
+	}
+	return q[:rest]
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
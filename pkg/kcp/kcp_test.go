@@ -0,0 +1,113 @@
+package kcp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// link connects two ends through a channel that drops and reorders datagrams
+type link struct {
+	rng     *rand.Rand
+	loss    float64
+	pending [][]byte
+}
+
+func (l *link) output(b []byte) {
+	if l.rng.Float64() < l.loss {
+		return
+	}
+	l.pending = append(l.pending, append([]byte(nil), b...))
+}
+
+// deliver hands the queued datagrams to k in a shuffled order
+func (l *link) deliver(t *testing.T, k *KCP) {
+	l.rng.Shuffle(len(l.pending), func(i, j int) {
+		l.pending[i], l.pending[j] = l.pending[j], l.pending[i]
+	})
+	for _, b := range l.pending {
+		if err := k.Input(b); err != nil {
+			t.Fatalf("Input: %v", err)
+		}
+	}
+	l.pending = l.pending[:0]
+}
+
+// TestReliableDelivery checks that every message arrives once and in order
+// over a link losing a fifth of the datagrams, including messages split into
+// several segments
+func TestReliableDelivery(t *testing.T) {
+	for _, nodelay := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("nodelay=%d", nodelay), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			ab := &link{rng: rng, loss: 0.2}
+			ba := &link{rng: rng, loss: 0.2}
+			a := New(7, ab.output)
+			b := New(7, ba.output)
+			for _, k := range []*KCP{a, b} {
+				k.SetMTU(200)
+				k.NoDelay(nodelay, 10, 2, false)
+				k.WndSize(64, 128)
+			}
+
+			var sent [][]byte
+			for i := 0; i < 300; i++ {
+				msg := bytes.Repeat([]byte{byte(i)}, 1+rng.Intn(500))
+				sent = append(sent, msg)
+				if err := a.Send(msg); err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+			}
+
+			var received [][]byte
+			for now := uint32(0); now < 120000 && len(received) < len(sent); now += 10 {
+				a.Update(now)
+				b.Update(now)
+				ab.deliver(t, b)
+				ba.deliver(t, a)
+				for msg := b.Recv(); msg != nil; msg = b.Recv() {
+					received = append(received, msg)
+				}
+			}
+			if len(received) != len(sent) {
+				t.Fatalf("received %d of %d messages", len(received), len(sent))
+			}
+			for i := range sent {
+				if !bytes.Equal(received[i], sent[i]) {
+					t.Fatalf("message %d: got %d bytes of %d, want %d bytes of %d",
+						i, len(received[i]), received[i][0], len(sent[i]), sent[i][0])
+				}
+			}
+			if a.Dead() {
+				t.Error("link reported dead")
+			}
+		})
+	}
+}
+
+// TestInputRejects checks that segments of another conversation and
+// truncated segments are refused
+func TestInputRejects(t *testing.T) {
+	var out []byte
+	a := New(1, func(b []byte) { out = append([]byte(nil), b...) })
+	a.Send([]byte("hello"))
+	a.Update(0)
+	if len(out) != Overhead+5 {
+		t.Fatalf("output %d bytes, want %d", len(out), Overhead+5)
+	}
+
+	if err := New(2, func([]byte) {}).Input(out); err != ErrConv {
+		t.Errorf("other conversation: got %v, want ErrConv", err)
+	}
+	if err := New(1, func([]byte) {}).Input(out[:len(out)-1]); err != ErrSegment {
+		t.Errorf("truncated: got %v, want ErrSegment", err)
+	}
+	b := New(1, func([]byte) {})
+	if err := b.Input(out); err != nil {
+		t.Fatalf("Input: %v", err)
+	}
+	if msg := b.Recv(); string(msg) != "hello" {
+		t.Errorf("received %q, want hello", msg)
+	}
+}
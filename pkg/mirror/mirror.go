@@ -0,0 +1,267 @@
+// Package mirror copies tunneled IP packets to a monitoring target, such as an
+// intrusion detection system, without slowing down the forwarding path: packets
+// are queued and sent by a separate goroutine, and those over the rate limit or
+// beyond a full queue are dropped and counted.
+//
+// Each packet is framed as Ethernet so it can be fed to the usual tools. The
+// source MAC tells the direction: 02:00:00:00:00:01 for packets a client sent,
+// 02:00:00:00:00:02 for packets sent to it. Targets are given as URLs:
+//
+//	vxlan://collector:4789?vni=42   VXLAN over UDP (port defaults to 4789, VNI to 1)
+//	packet://eth1                   written to a local interface with a packet socket
+package mirror
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Direction of a mirrored packet relative to the session's client
+type Direction int
+
+const (
+	FromClient Direction = iota
+	ToClient
+)
+
+const (
+	// DefaultRateMbps limits mirrored traffic when no rate is given
+	DefaultRateMbps = 100
+	// VXLANPort is the IANA-assigned VXLAN port
+	VXLANPort = 4789
+
+	queueLen      = 1024
+	ethHeaderLen  = 14
+	vxlanHeadLen  = 8
+	burstDuration = 100 * time.Millisecond
+	minBurst      = 64 * 1024
+)
+
+var (
+	dstMAC  = []byte{0x02, 0, 0, 0, 0, 0xff}
+	srcMACs = [...][]byte{
+		FromClient: {0x02, 0, 0, 0, 0, 0x01},
+		ToClient:   {0x02, 0, 0, 0, 0, 0x02},
+	}
+)
+
+// sender writes one framed packet to the target
+type sender interface {
+	send(frame []byte) error
+	Close() error
+}
+
+// Mirror sends packets to a monitoring target
+type Mirror struct {
+	target string
+	out    sender
+	header int // Bytes the sender needs in front of the Ethernet frame
+	queue  chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// New opens the target (see the package comment) and starts sending at most
+// rateMbps megabits per second (DefaultRateMbps if not positive)
+func New(target string, rateMbps int) (*Mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror target %q: %v", target, err)
+	}
+	m := &Mirror{target: target, queue: make(chan []byte, queueLen), done: make(chan struct{})}
+	switch u.Scheme {
+	case "vxlan":
+		m.out, err = dialVXLAN(u)
+		m.header = vxlanHeadLen
+	case "packet":
+		m.out, err = openPacket(u.Host)
+	default:
+		return nil, fmt.Errorf("invalid mirror target %q: scheme must be vxlan:// or packet://", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rateMbps <= 0 {
+		rateMbps = DefaultRateMbps
+	}
+	m.rate = float64(rateMbps) * 1e6 / 8
+	m.burst = max(m.rate*burstDuration.Seconds(), minBurst)
+	m.tokens = m.burst
+	m.last = time.Now()
+	go m.run()
+	return m, nil
+}
+
+// Target returns the target the mirror was opened with
+func (m *Mirror) Target() string {
+	return m.target
+}
+
+// Packet queues a copy of the IP packet pkt; the caller may reuse the buffer
+func (m *Mirror) Packet(pkt []byte, dir Direction) {
+	if len(pkt) == 0 || !m.allow(len(pkt)) {
+		m.dropped.Add(1)
+		return
+	}
+	frame := make([]byte, m.header+ethHeaderLen+len(pkt))
+	eth := frame[m.header:]
+	copy(eth[0:6], dstMAC)
+	copy(eth[6:12], srcMACs[dir])
+	etherType := uint16(syscall.ETH_P_IP)
+	if pkt[0]>>4 == 6 {
+		etherType = syscall.ETH_P_IPV6
+	}
+	eth[12], eth[13] = byte(etherType>>8), byte(etherType)
+	copy(eth[ethHeaderLen:], pkt)
+	select {
+	case m.queue <- frame:
+	default:
+		m.dropped.Add(1)
+	}
+}
+
+// allow takes n bytes from the token bucket
+func (m *Mirror) allow(n int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.tokens = min(m.tokens+now.Sub(m.last).Seconds()*m.rate, m.burst)
+	m.last = now
+	if m.tokens < float64(n) {
+		return false
+	}
+	m.tokens -= float64(n)
+	return true
+}
+
+func (m *Mirror) run() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case frame := <-m.queue:
+			if err := m.out.send(frame); err != nil {
+				m.errors.Add(1)
+				continue
+			}
+			m.sent.Add(1)
+		}
+	}
+}
+
+// Counts are the packets handled by a mirror
+type Counts struct {
+	Sent    uint64 // Packets delivered to the target
+	Dropped uint64 // Packets over the rate limit or beyond a full queue
+	Errors  uint64 // Packets the target refused
+}
+
+// Stats returns the packets handled so far
+func (m *Mirror) Stats() Counts {
+	return Counts{
+		Sent:    m.sent.Load(),
+		Dropped: m.dropped.Load(),
+		Errors:  m.errors.Load(),
+	}
+}
+
+// Close stops the mirror; queued packets are discarded
+func (m *Mirror) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.out.Close()
+	})
+	return err
+}
+
+// vxlanSender encapsulates frames in VXLAN (RFC 7348)
+type vxlanSender struct {
+	conn *net.UDPConn
+	vni  uint32
+}
+
+func dialVXLAN(u *url.URL) (*vxlanSender, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), strconv.Itoa(VXLANPort))
+	}
+	vni := uint64(1)
+	if v := u.Query().Get("vni"); v != "" {
+		var err error
+		if vni, err = strconv.ParseUint(v, 10, 24); err != nil {
+			return nil, fmt.Errorf("invalid VXLAN VNI %q", v)
+		}
+	}
+	raddr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &vxlanSender{conn: conn, vni: uint32(vni)}, nil
+}
+
+func (s *vxlanSender) send(frame []byte) error {
+	h := frame[:vxlanHeadLen]
+	h[0] = 0x08 // VNI present
+	h[1], h[2], h[3] = 0, 0, 0
+	h[4], h[5], h[6] = byte(s.vni>>16), byte(s.vni>>8), byte(s.vni)
+	h[7] = 0
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+func (s *vxlanSender) Close() error {
+	return s.conn.Close()
+}
+
+// packetSender writes frames to an interface, e.g. a dummy or veth interface
+// an IDS listens on
+type packetSender struct {
+	fd   int
+	addr syscall.SockaddrLinklayer
+}
+
+func openPacket(name string) (*packetSender, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("mirror interface %s: %v", name, err)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create packet socket: %v", err)
+	}
+	return &packetSender{fd: fd, addr: syscall.SockaddrLinklayer{Ifindex: iface.Index, Halen: 6}}, nil
+}
+
+func (s *packetSender) send(frame []byte) error {
+	addr := s.addr
+	addr.Protocol = binary.NativeEndian.Uint16(frame[12:14]) // Kept in network byte order
+	copy(addr.Addr[:], frame[0:6])
+	return syscall.Sendto(s.fd, frame, 0, &addr)
+}
+
+func (s *packetSender) Close() error {
+	return syscall.Close(s.fd)
+}
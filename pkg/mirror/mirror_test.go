@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestVXLAN checks the encapsulation of a mirrored packet and that traffic
+// over the rate limit is dropped rather than queued
+func TestVXLAN(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	m, err := New("vxlan://"+collector.LocalAddr().String()+"?vni=42", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	pkt := make([]byte, 1000)
+	pkt[0] = 0x45
+	m.Packet(pkt, ToClient)
+
+	buf := make([]byte, 2048)
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := collector.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0x08, 0, 0, 0, 0, 0, 42, 0}, dstMAC...)
+	want = append(want, srcMACs[ToClient]...)
+	want = append(want, 0x08, 0x00)
+	want = append(want, pkt...)
+	if !bytes.Equal(buf[:n], want) {
+		t.Fatalf("frame = % x..., want % x...", buf[:min(n, 24)], want[:24])
+	}
+
+	// 1 Mbit/s allows a burst of 64 KiB
+	for i := 0; i < 100; i++ {
+		m.Packet(pkt, FromClient)
+	}
+	if c := m.Stats(); c.Dropped < 30 {
+		t.Errorf("dropped %d of 100 packets over the rate limit, want at least 30", c.Dropped)
+	}
+}
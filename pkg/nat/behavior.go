@@ -0,0 +1,269 @@
+package nat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mapping and filtering behaviors (RFC 4787). A Reflector has one address,
+// so a mapping that changes with the server port is reported as
+// address_and_port_dependent, and filtering that lets the other port's
+// answers through as address_dependent, though it may be more permissive.
+const (
+	BehaviorNone                    = "none" // No NAT
+	BehaviorEndpointIndependent     = "endpoint_independent"
+	BehaviorAddressDependent        = "address_dependent"
+	BehaviorAddressAndPortDependent = "address_and_port_dependent"
+)
+
+// lifetimeSteps are the idle periods after which mappings are tested
+var lifetimeSteps = []time.Duration{15 * time.Second, 30 * time.Second, 60 * time.Second, 120 * time.Second, 300 * time.Second}
+
+// Behavior is what DiscoverBehavior learned about the NAT in front of this
+// host. Empty strings and zero durations are unknown.
+type Behavior struct {
+	LocalAddr     *net.UDPAddr
+	MappedAddr    *net.UDPAddr
+	Mapping       string
+	Filtering     string
+	PortPreserved bool
+	Hairpinning   *bool
+	LifetimeAlive time.Duration // Longest idle period a mapping survived
+	LifetimeGone  time.Duration // Shortest idle period after which a mapping was gone
+}
+
+// Type classifies the behavior in the NATType terms the P2P code uses
+func (b *Behavior) Type() NATType {
+	switch {
+	case b.Mapping == BehaviorNone:
+		return NATNone
+	case b.Mapping == BehaviorAddressAndPortDependent:
+		return NATSymmetric
+	case b.Mapping != BehaviorEndpointIndependent:
+		return NATUnknown
+	case b.Filtering == BehaviorAddressDependent:
+		return NATRestrictedCone
+	case b.Filtering == BehaviorAddressAndPortDependent:
+		return NATPortRestrictedCone
+	}
+	return NATUnknown
+}
+
+// DiscoverBehavior probes the NAT of this host with the Reflector at server,
+// waiting up to timeout for each answer. Mappings are left idle for up to
+// maxIdle to measure their lifetime (0 skips that test).
+func DiscoverBehavior(server string, timeout, maxIdle time.Duration) (*Behavior, error) {
+	primary, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	other := &net.UDPAddr{IP: primary.IP, Port: primary.Port + 1}
+	b := &Behavior{}
+
+	// The address the route to the server leaves from
+	probe, err := net.DialUDP("udp4", nil, primary)
+	if err != nil {
+		return nil, err
+	}
+	localIP := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+
+	// Mapping: the same socket to both ports of the reflector
+	a, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	b.LocalAddr = &net.UDPAddr{IP: localIP, Port: a.LocalAddr().(*net.UDPAddr).Port}
+	if b.MappedAddr, err = bindingQuery(a, primary, false, 0, timeout); err != nil {
+		return nil, fmt.Errorf("no answer from reflector %s: %v", primary, err)
+	}
+	b.PortPreserved = b.MappedAddr.Port == b.LocalAddr.Port
+	switch mapped2, err := bindingQuery(a, other, false, 0, timeout); {
+	case b.MappedAddr.IP.Equal(localIP) && b.PortPreserved:
+		b.Mapping, b.Filtering = BehaviorNone, BehaviorNone
+	case err != nil:
+		// The other port is not answering: leave the mapping unknown
+	case mapped2.String() == b.MappedAddr.String():
+		b.Mapping = BehaviorEndpointIndependent
+	default:
+		b.Mapping = BehaviorAddressAndPortDependent
+	}
+
+	// Filtering: a fresh socket asks for the answer from the port it did
+	// not send to
+	if b.Filtering == "" {
+		f, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := bindingQuery(f, primary, true, 0, timeout); err == nil {
+			b.Filtering = BehaviorAddressDependent
+		} else {
+			b.Filtering = BehaviorAddressAndPortDependent
+		}
+		f.Close()
+	}
+
+	if b.Mapping != BehaviorNone {
+		b.Hairpinning = hairpinning(primary, timeout)
+	}
+	if maxIdle > 0 {
+		b.LifetimeAlive, b.LifetimeGone = mappingLifetime(primary, timeout, maxIdle)
+	}
+	return b, nil
+}
+
+// hairpinning reports whether a packet to a mapped address from behind the
+// same NAT reaches the socket it belongs to
+func hairpinning(server *net.UDPAddr, timeout time.Duration) *bool {
+	target, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil
+	}
+	defer target.Close()
+	mapped, err := bindingQuery(target, server, false, 0, timeout)
+	if err != nil {
+		return nil
+	}
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil
+	}
+	defer sender.Close()
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		sender.WriteToUDP(token, mapped)
+		target.SetReadDeadline(time.Now().Add(timeout / 4))
+		n, _, err := target.ReadFromUDP(buf)
+		if err == nil && string(buf[:n]) == string(token) {
+			ok := true
+			return &ok
+		}
+	}
+	ok := false
+	return &ok
+}
+
+// mappingLifetime leaves one mapping idle per step up to maxIdle, in
+// parallel, then has the reflector answer to each mapped port from another
+// socket. It returns the longest idle period a mapping survived and the
+// shortest after which one was gone.
+func mappingLifetime(server *net.UDPAddr, timeout, maxIdle time.Duration) (alive, gone time.Duration) {
+	// Steps only tell something if an answer to another socket's request
+	// gets through at all
+	steps := []time.Duration{0}
+	for _, step := range lifetimeSteps {
+		if step <= maxIdle {
+			steps = append(steps, step)
+		}
+	}
+	results := make([]bool, len(steps))
+	var wg sync.WaitGroup
+	for i, idle := range steps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = mappingAlive(server, timeout, idle)
+		}()
+	}
+	wg.Wait()
+	if !results[0] {
+		return 0, 0
+	}
+	for i, step := range steps[1:] {
+		if results[i+1] {
+			alive = step
+		} else if gone == 0 {
+			gone = step
+		}
+	}
+	return alive, gone
+}
+
+// mappingAlive opens a mapping, leaves it idle and checks whether an answer
+// requested by another socket still reaches it
+func mappingAlive(server *net.UDPAddr, timeout, idle time.Duration) bool {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	mapped, err := bindingQuery(conn, server, false, 0, timeout)
+	if err != nil {
+		return false
+	}
+	time.Sleep(idle)
+
+	requester, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return false
+	}
+	defer requester.Close()
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		txID, req := bindingRequest(false, mapped.Port)
+		requester.WriteToUDP(req, server)
+		conn.SetReadDeadline(time.Now().Add(timeout / 4))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if _, err := (&STUNClient{}).parseBindingResponse(buf[:n], txID); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bindingQuery sends binding requests from conn to server until one is
+// answered or timeout passes, and returns the mapped address
+func bindingQuery(conn *net.UDPConn, server *net.UDPAddr, changePort bool, responsePort int, timeout time.Duration) (*net.UDPAddr, error) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		txID, req := bindingRequest(changePort, responsePort)
+		if _, err := conn.WriteToUDP(req, server); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout / 4))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if result, err := (&STUNClient{}).parseBindingResponse(buf[:n], txID); err == nil {
+				return result.MappedAddr, nil
+			}
+		}
+	}
+	return nil, ErrSTUNTimeout
+}
+
+// bindingRequest builds a binding request with a new transaction ID,
+// asking for the answer from the other port and to responsePort (0 = the
+// source port) as given
+func bindingRequest(changePort bool, responsePort int) ([]byte, []byte) {
+	txID := make([]byte, 12)
+	rand.Read(txID)
+	req := (&STUNClient{}).buildBindingRequest(txID, false, changePort)
+	if responsePort != 0 {
+		req = binary.BigEndian.AppendUint16(req, stunAttrResponsePort)
+		req = binary.BigEndian.AppendUint16(req, 2)
+		req = binary.BigEndian.AppendUint16(req, uint16(responsePort))
+		req = append(req, 0, 0) // Padding
+		binary.BigEndian.PutUint16(req[2:4], uint16(len(req)-stunHeaderSize))
+	}
+	return txID, req
+}
@@ -0,0 +1,152 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Reflector answers STUN binding requests (RFC 5389) on two adjacent UDP
+// ports, so a client can learn how its NAT maps and filters with nothing but
+// the tunnel server: the port given and the next one. Besides the mapped
+// address it honors
+//
+//	CHANGE-REQUEST  change port: answer from the other port (requests to
+//	                change the IP go unanswered, there is one address)
+//	RESPONSE-PORT   answer to this port of the request's source IP
+//	                (RFC 5780), which shows whether another mapping of that
+//	                host is still open
+//
+// Answers only go to the address a request came from, or another port of it.
+type Reflector struct {
+	conns [2]*net.UDPConn
+	wg    sync.WaitGroup
+}
+
+const (
+	stunAttrResponsePort = 0x0027
+	changeIPFlag         = 0x04
+	changePortFlag       = 0x02
+)
+
+// NewReflector listens on addr and the port after it
+func NewReflector(addr string) (*Reflector, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	alt := *primary.LocalAddr().(*net.UDPAddr)
+	alt.Port++
+	other, err := net.ListenUDP("udp4", &alt)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	r := &Reflector{conns: [2]*net.UDPConn{primary, other}}
+	for i := range r.conns {
+		r.wg.Add(1)
+		go r.serve(i)
+	}
+	return r, nil
+}
+
+// Addr returns the primary address; the other port is the next one
+func (r *Reflector) Addr() *net.UDPAddr {
+	return r.conns[0].LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops answering
+func (r *Reflector) Close() error {
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.wg.Wait()
+	return nil
+}
+
+func (r *Reflector) serve(i int) {
+	defer r.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := r.conns[i].ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		r.answer(i, buf[:n], from)
+	}
+}
+
+// answer replies to a binding request received on conns[i]
+func (r *Reflector) answer(i int, req []byte, from *net.UDPAddr) {
+	if len(req) < stunHeaderSize || binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest ||
+		binary.BigEndian.Uint32(req[4:8]) != stunMagicCookie || from.IP.To4() == nil {
+		return
+	}
+	end := stunHeaderSize + int(binary.BigEndian.Uint16(req[2:4]))
+	if end > len(req) {
+		return
+	}
+	out, to := i, from
+	for off := stunHeaderSize; off+4 <= end; {
+		attrType := binary.BigEndian.Uint16(req[off:])
+		attrLen := int(binary.BigEndian.Uint16(req[off+2:]))
+		value := req[off+4:]
+		if off+4+attrLen > end {
+			return
+		}
+		switch {
+		case attrType == stunAttrChangeRequest && attrLen >= 4:
+			flags := binary.BigEndian.Uint32(value)
+			if flags&changeIPFlag != 0 {
+				return
+			}
+			if flags&changePortFlag != 0 {
+				out = 1 - i
+			}
+		case attrType == stunAttrResponsePort && attrLen >= 2:
+			port := binary.BigEndian.Uint16(value)
+			if port == 0 {
+				return
+			}
+			to = &net.UDPAddr{IP: from.IP, Port: int(port)}
+		}
+		off += 4 + (attrLen+3)&^3
+	}
+
+	resp := make([]byte, stunHeaderSize, 80)
+	binary.BigEndian.PutUint16(resp[0:2], stunBindingResponse)
+	binary.BigEndian.PutUint32(resp[4:8], stunMagicCookie)
+	copy(resp[8:20], req[8:20])
+	resp = appendAddress(resp, stunAttrXorMappedAddress, from, true)
+	resp = appendAddress(resp, stunAttrMappedAddress, from, false)
+	if origin := r.conns[out].LocalAddr().(*net.UDPAddr); !origin.IP.IsUnspecified() {
+		resp = appendAddress(resp, stunAttrResponseOrigin, origin, false)
+		resp = appendAddress(resp, stunAttrOtherAddress, r.conns[1-out].LocalAddr().(*net.UDPAddr), false)
+	}
+	binary.BigEndian.PutUint16(resp[2:4], uint16(len(resp)-stunHeaderSize))
+	r.conns[out].WriteToUDP(resp, to)
+}
+
+// appendAddress appends an IPv4 address attribute, XORed with the magic
+// cookie for XOR-MAPPED-ADDRESS
+func appendAddress(b []byte, attrType uint16, addr *net.UDPAddr, xor bool) []byte {
+	ip := binary.BigEndian.Uint32(addr.IP.To4())
+	port := uint16(addr.Port)
+	if xor {
+		ip ^= stunMagicCookie
+		port ^= uint16(stunMagicCookie >> 16)
+	}
+	b = binary.BigEndian.AppendUint16(b, attrType)
+	b = binary.BigEndian.AppendUint16(b, 8)
+	b = append(b, 0, 0x01) // Reserved, IPv4
+	b = binary.BigEndian.AppendUint16(b, port)
+	return binary.BigEndian.AppendUint32(b, ip)
+}
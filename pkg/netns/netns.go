@@ -0,0 +1,38 @@
+// Package netns runs code in another network namespace. A socket keeps the
+// namespace it was created in, so a process inside a container can send and
+// receive on the host's network (or the reverse) by creating its sockets
+// there, and a command started from inside, like iptables, applies to that
+// namespace too.
+package netns
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrUnsupported is returned where setns(2) is not available
+var ErrUnsupported = errors.New("network namespaces are not supported on this platform")
+
+// Path returns the namespace file of name: a path is used as is, a bare name
+// refers to a namespace created with "ip netns add"
+func Path(name string) string {
+	if name == "" || strings.Contains(name, "/") {
+		return name
+	}
+	return "/var/run/netns/" + name
+}
+
+// Check verifies that the namespace at path exists and can be entered
+func Check(path string) error {
+	return Do(path, func() error { return nil })
+}
+
+// Do runs fn on a thread switched into the network namespace at path ("" runs
+// fn in place). Sockets fn creates and processes it starts belong to that
+// namespace. fn must not start goroutines that expect to share it.
+func Do(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	return doIn(path, fn)
+}
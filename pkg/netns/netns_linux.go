@@ -0,0 +1,47 @@
+//go:build linux
+
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// doIn runs fn on a thread switched into the network namespace at path
+func doIn(path string, fn func() error) error {
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %v", err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer orig.Close()
+
+	if err := setns(target.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %v", path, err)
+	}
+	fnErr := fn()
+	if err := setns(orig.Fd()); err != nil {
+		// The thread stays locked and exits with the goroutine rather than
+		// running other goroutines in the wrong namespace
+		return fmt.Errorf("failed to leave network namespace %s: %v", path, err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+func setns(fd uintptr) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, fd, syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package netns
+
+// doIn fails: setns(2) exists only on Linux
+func doIn(path string, fn func() error) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,4 @@
+package netns
+
+// setns(2) syscall number, missing from the frozen syscall package on 386
+const sysSetns = 346
@@ -0,0 +1,4 @@
+package netns
+
+// setns(2) syscall number
+const sysSetns = 308
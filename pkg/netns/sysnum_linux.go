@@ -0,0 +1,8 @@
+//go:build linux && !amd64 && !386
+
+package netns
+
+import "syscall"
+
+// setns(2) syscall number
+const sysSetns = syscall.SYS_SETNS
@@ -722,6 +722,18 @@ func (m *Manager) GetLocalPort() int {
 	return m.localPort
 }
 
+// Peers returns a copy of every known peer
+func (m *Manager) Peers() []*PeerInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	peers := make([]*PeerInfo, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer.Clone())
+	}
+	return peers
+}
+
 // isPeerConnected checks if a peer is actually connected (handshake complete)
 // Must be called with m.mu held (read or write lock)
 func (m *Manager) isPeerConnected(ipStr string) bool {
@@ -0,0 +1,288 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrExpired indicates the peer certificate is outside its validity period
+	ErrExpired = errors.New("certificate expired or not yet valid")
+	// ErrRevoked indicates the peer certificate serial is listed in the CRL
+	ErrRevoked = errors.New("certificate revoked")
+	// ErrUntrusted indicates the peer certificate does not chain to a configured CA
+	ErrUntrusted = errors.New("certificate not signed by a trusted CA")
+)
+
+// Identity holds the local certificate and private key presented during the handshake
+type Identity struct {
+	cert   *x509.Certificate
+	raw    []byte
+	signer crypto.Signer
+}
+
+// LoadIdentity loads a PEM certificate and its private key
+func LoadIdentity(certFile, keyFile string) (*Identity, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	if len(pair.Certificate) == 0 {
+		return nil, errors.New("certificate file contains no certificates")
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return &Identity{cert: cert, raw: pair.Certificate[0], signer: signer}, nil
+}
+
+// Raw returns the DER encoded leaf certificate
+func (id *Identity) Raw() []byte {
+	return id.raw
+}
+
+// Certificate returns the parsed leaf certificate
+func (id *Identity) Certificate() *x509.Certificate {
+	return id.cert
+}
+
+// Sign signs msg with the identity's private key
+func (id *Identity) Sign(msg []byte) ([]byte, error) {
+	if _, ok := id.signer.Public().(ed25519.PublicKey); ok {
+		return id.signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return id.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// VerifySignature checks that sig over msg was produced by the key in cert
+func VerifySignature(cert *x509.Certificate, msg, sig []byte) error {
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	default:
+		return errors.New("unsupported public key type")
+	}
+	return cert.CheckSignature(algo, msg, sig)
+}
+
+// Verifier validates peer certificates against a CA bundle and optional CRL
+type Verifier struct {
+	roots   *x509.CertPool
+	cas     []*x509.Certificate
+	crlFile string
+
+	mu       sync.RWMutex
+	revoked  map[string]struct{}
+	crlMtime time.Time
+}
+
+// NewVerifier creates a verifier from a PEM CA bundle and an optional CRL file (PEM or DER)
+func NewVerifier(caFile, crlFile string) (*Verifier, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+
+	v := &Verifier{
+		roots:   x509.NewCertPool(),
+		crlFile: crlFile,
+		revoked: make(map[string]struct{}),
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+		}
+		v.roots.AddCert(ca)
+		v.cas = append(v.cas, ca)
+	}
+	if len(v.cas) == 0 {
+		return nil, errors.New("CA bundle contains no certificates")
+	}
+
+	if crlFile != "" {
+		if err := v.reloadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Verify parses a DER certificate and checks expiry, chain of trust, key usage and revocation
+func (v *Verifier) Verify(der []byte, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, ErrExpired
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:       v.roots,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{usage},
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUntrusted, err)
+	}
+
+	if v.IsRevoked(cert) {
+		return nil, ErrRevoked
+	}
+	return cert, nil
+}
+
+// IsRevoked reports whether cert is listed in the CRL, reloading the CRL if the file changed
+func (v *Verifier) IsRevoked(cert *x509.Certificate) bool {
+	if v.crlFile == "" {
+		return false
+	}
+	if info, err := os.Stat(v.crlFile); err == nil {
+		v.mu.RLock()
+		stale := info.ModTime().After(v.crlMtime)
+		v.mu.RUnlock()
+		if stale {
+			// Keep the previous list on reload failure rather than failing open
+			_ = v.reloadCRL()
+		}
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	_, revoked := v.revoked[cert.SerialNumber.String()]
+	return revoked
+}
+
+func (v *Verifier) reloadCRL() error {
+	info, err := os.Stat(v.crlFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat CRL: %v", err)
+	}
+	data, err := os.ReadFile(v.crlFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CRL: %v", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse CRL: %v", err)
+	}
+
+	signed := false
+	for _, ca := range v.cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("CRL is not signed by a configured CA")
+	}
+
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+
+	v.mu.Lock()
+	v.revoked = revoked
+	v.crlMtime = info.ModTime()
+	v.mu.Unlock()
+	return nil
+}
+
+// AllowsIP reports whether cert may be used for the tunnel address ip. A
+// certificate that carries IP SANs is bound to those addresses; one without
+// them may be used for any.
+func AllowsIP(cert *x509.Certificate, ip net.IP) bool {
+	if len(cert.IPAddresses) == 0 {
+		return true
+	}
+	for _, san := range cert.IPAddresses {
+		if san.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identify returns a human readable identity for logs (CN, falling back to serial)
+func Identify(cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return "serial:" + cert.SerialNumber.String()
+}
+
+// Fingerprint returns the hex SHA-256 of the certificate's public key. It
+// stays the same when a certificate is reissued for the same key.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReplayCache remembers the nonces of accepted signed handshakes until the
+// handshake's timestamp leaves the accepted window, so that a captured
+// handshake cannot be accepted a second time
+type ReplayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Nonce -> when it can no longer be replayed
+}
+
+// NewReplayCache creates an empty replay cache
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// Fresh records nonce until expires and reports whether it was not recorded
+// before. Nonces whose time has passed are forgotten.
+func (c *ReplayCache) Fresh(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
@@ -0,0 +1,171 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a self-signed CA that issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// verifier returns a Verifier trusting only this CA
+func (ca *testCA) verifier(t *testing.T) *Verifier {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// issue signs a client certificate valid from notBefore to notAfter
+func (ca *testCA) issue(t *testing.T, serial int64, notBefore, notAfter time.Time, ips ...net.IP) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// TestVerify checks that a certificate is accepted only when it chains to the
+// configured CA, is within its validity period and has the requested usage
+func TestVerify(t *testing.T) {
+	ca := newTestCA(t, "tunnel CA")
+	v := ca.verifier(t)
+	now := time.Now()
+
+	valid := ca.issue(t, 2, now.Add(-time.Minute), now.Add(time.Hour))
+	cert, err := v.Verify(valid, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatalf("certificate issued by the CA: %v", err)
+	}
+	if id := Identify(cert); id != "client" {
+		t.Errorf("identity %q, want %q", id, "client")
+	}
+	if _, err := v.Verify(valid, x509.ExtKeyUsageServerAuth); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("client certificate used as server: got %v, want ErrUntrusted", err)
+	}
+
+	expired := ca.issue(t, 3, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if _, err := v.Verify(expired, x509.ExtKeyUsageClientAuth); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired certificate: got %v, want ErrExpired", err)
+	}
+
+	other := newTestCA(t, "other CA")
+	foreign := other.issue(t, 2, now.Add(-time.Minute), now.Add(time.Hour))
+	if _, err := v.Verify(foreign, x509.ExtKeyUsageClientAuth); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("certificate of another CA: got %v, want ErrUntrusted", err)
+	}
+
+	if _, err := v.Verify([]byte("not a certificate"), x509.ExtKeyUsageClientAuth); err == nil {
+		t.Error("garbage accepted as a certificate")
+	}
+}
+
+// TestAllowsIP checks that IP SANs bind a certificate to its tunnel addresses
+func TestAllowsIP(t *testing.T) {
+	ca := newTestCA(t, "tunnel CA")
+	now := time.Now()
+	parse := func(der []byte) *x509.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	bound := parse(ca.issue(t, 2, now, now.Add(time.Hour), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")))
+	if !AllowsIP(bound, net.ParseIP("10.0.0.3")) {
+		t.Error("address listed in the IP SANs refused")
+	}
+	if AllowsIP(bound, net.ParseIP("10.0.0.4")) {
+		t.Error("address missing from the IP SANs allowed")
+	}
+
+	unbound := parse(ca.issue(t, 3, now, now.Add(time.Hour)))
+	if !AllowsIP(unbound, net.ParseIP("10.0.0.4")) {
+		t.Error("certificate without IP SANs refused an address")
+	}
+}
+
+// TestReplayCache checks that a nonce is accepted once until it expires
+func TestReplayCache(t *testing.T) {
+	c := NewReplayCache()
+	now := time.Unix(1000, 0)
+	expires := now.Add(5 * time.Minute)
+
+	if !c.Fresh("nonce-a", expires, now) {
+		t.Fatal("first use of a nonce refused")
+	}
+	if c.Fresh("nonce-a", expires, now.Add(time.Minute)) {
+		t.Error("replayed nonce accepted")
+	}
+	if !c.Fresh("nonce-b", expires, now.Add(time.Minute)) {
+		t.Error("another nonce refused")
+	}
+	if !c.Fresh("nonce-a", now.Add(20*time.Minute), now.Add(10*time.Minute)) {
+		t.Error("nonce refused after it expired")
+	}
+	if len(c.seen) != 1 {
+		t.Errorf("%d nonces kept, want only the live one", len(c.seen))
+	}
+}
@@ -0,0 +1,172 @@
+// Package ratelimit caps the traffic a tunnel sends while sharing the cap
+// between three traffic classes. Each class has a token bucket refilled at its
+// share of the rate, and classes borrow in a fixed hierarchy:
+//
+//	control      always gets through: it uses its own tokens, then the
+//	             interactive and bulk ones, and when all are empty it passes
+//	             anyway and the bulk bucket goes into debt
+//	interactive  uses its own tokens, then borrows from bulk
+//	bulk         is assured the rest of the rate and also receives the
+//	             tokens the other classes leave unused, so it gets whatever
+//	             they do not need
+//
+// Packets that find no tokens are dropped (policing rather than queuing), so
+// the flows inside the tunnel back off as they would on a slower link.
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Class is the traffic class of a packet
+type Class int
+
+const (
+	Control Class = iota
+	Interactive
+	Bulk
+	numClasses
+)
+
+func (c Class) String() string {
+	switch c {
+	case Control:
+		return "control"
+	case Interactive:
+		return "interactive"
+	}
+	return "bulk"
+}
+
+// Classes lists the classes in borrowing order
+var Classes = []Class{Control, Interactive, Bulk}
+
+const (
+	burstDuration = 100 * time.Millisecond
+	minBurst      = 64 * 1024
+	// minClassBurst lets a class with a tiny share still pass a full packet
+	// from its own bucket
+	minClassBurst = 2 * 1500
+)
+
+// lenders are the buckets a class may take tokens from, own bucket first
+var lenders = [numClasses][]Class{
+	Control:     {Control, Interactive, Bulk},
+	Interactive: {Interactive, Bulk},
+	Bulk:        {Bulk},
+}
+
+type bucket struct {
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+}
+
+// Counters are the traffic of one class
+type Counters struct {
+	Bytes   uint64 // Bytes let through
+	Packets uint64 // Packets let through
+	Dropped uint64 // Packets dropped for lack of tokens
+}
+
+// Limiter is a rate cap shared by the traffic classes
+type Limiter struct {
+	mu       sync.Mutex
+	rate     float64
+	last     time.Time
+	buckets  [numClasses]bucket
+	counters [numClasses]Counters
+}
+
+// New returns a limiter capping traffic at bytesPerSec, of which the fractions
+// control and interactive are assured to those classes and the rest to bulk
+func New(bytesPerSec float64, control, interactive float64) (*Limiter, error) {
+	if bytesPerSec <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+	if control < 0 || interactive < 0 || control+interactive > 1 {
+		return nil, fmt.Errorf("class shares %.2f (control) and %.2f (interactive) must be non-negative and add up to at most 1", control, interactive)
+	}
+	total := max(bytesPerSec*burstDuration.Seconds(), minBurst)
+	l := &Limiter{rate: bytesPerSec, last: time.Now()}
+	shares := [numClasses]float64{Control: control, Interactive: interactive, Bulk: 1 - control - interactive}
+	for c, share := range shares {
+		b := &l.buckets[c]
+		b.rate = bytesPerSec * share
+		b.burst = max(total*share, minClassBurst)
+		if Class(c) == Bulk {
+			b.burst = total // Holds what the other classes leave unused
+		}
+		b.tokens = b.burst
+	}
+	return l, nil
+}
+
+// Rate returns the cap in bytes per second
+func (l *Limiter) Rate() float64 {
+	return l.rate
+}
+
+// Allow reports whether a packet of n bytes in class c may be sent now and
+// takes its tokens if so. Control packets are always allowed.
+func (l *Limiter) Allow(c Class, n int) bool {
+	if c < 0 || c >= numClasses {
+		c = Bulk
+	}
+	need := float64(n)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+
+	available := 0.0
+	for _, from := range lenders[c] {
+		available += max(l.buckets[from].tokens, 0)
+	}
+	if available < need && c != Control {
+		l.counters[c].Dropped++
+		return false
+	}
+	for _, from := range lenders[c] {
+		b := &l.buckets[from]
+		take := min(max(b.tokens, 0), need)
+		b.tokens -= take
+		need -= take
+	}
+	if need > 0 {
+		// Control beyond every bucket: bulk repays it, within one burst
+		bulk := &l.buckets[Bulk]
+		bulk.tokens = max(bulk.tokens-need, -bulk.burst)
+	}
+	l.counters[c].Bytes += uint64(n)
+	l.counters[c].Packets++
+	return true
+}
+
+// refill adds the tokens earned since the last call; tokens a class cannot
+// hold flow to bulk (l.mu held)
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	l.last = now
+	bulk := &l.buckets[Bulk]
+	for _, c := range Classes {
+		b := &l.buckets[c]
+		b.tokens += elapsed * b.rate
+		if c != Bulk && b.tokens > b.burst {
+			bulk.tokens += b.tokens - b.burst
+			b.tokens = b.burst
+		}
+	}
+	bulk.tokens = min(bulk.tokens, bulk.burst)
+}
+
+// Counters returns the traffic of class c so far
+func (l *Limiter) Counters(c Class) Counters {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counters[c]
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import "testing"
+
+// fill sends 1000-byte packets of class c until one is dropped or max passed,
+// returning how many passed
+func fill(l *Limiter, c Class, max int) int {
+	for i := 0; i < max; i++ {
+		if !l.Allow(c, 1000) {
+			return i
+		}
+	}
+	return max
+}
+
+// TestBorrowing checks the hierarchy on the initial bursts; the rate is low
+// enough that refills during the test do not matter
+func TestBorrowing(t *testing.T) {
+	l, err := New(10000, 0.1, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bulk has the whole burst and no lender
+	if n := fill(l, Bulk, 1000); n != 65 {
+		t.Errorf("bulk passed %d packets, want 65", n)
+	}
+	// Interactive still has its own bucket (and bulk's last 536 bytes)
+	if n := fill(l, Interactive, 1000); n != 20 {
+		t.Errorf("interactive passed %d packets after bulk ran dry, want 20", n)
+	}
+	// Control gets through with every bucket empty
+	if n := fill(l, Control, 100); n != 100 {
+		t.Errorf("control passed %d of 100 packets", n)
+	}
+	if c := l.Counters(Bulk); c.Packets != 65 || c.Dropped != 1 {
+		t.Errorf("bulk counters %+v", c)
+	}
+	if fill(l, Bulk, 1) != 0 {
+		t.Error("bulk passed while repaying control's debt")
+	}
+
+	// Interactive borrows from bulk, bulk does not borrow from interactive
+	l, _ = New(10000, 0.1, 0.3)
+	if n := fill(l, Interactive, 1000); n != 85 {
+		t.Errorf("interactive passed %d packets, want 85 with bulk's tokens", n)
+	}
+	if fill(l, Bulk, 1) != 0 {
+		t.Error("bulk passed after interactive borrowed its tokens")
+	}
+
+	if _, err := New(10000, 0.6, 0.6); err == nil {
+		t.Error("shares above 1 accepted")
+	}
+}
@@ -0,0 +1,205 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
+)
+
+// Packets are serialized in one pass into a single buffer, IP header, TCP
+// header and payload, with the checksums computed in place. A PacketBuilder
+// owns such a buffer and the destination address handed to the kernel, so
+// building and sending with it allocates nothing once the buffer has grown
+// to the largest packet; at 100k packets per second the per-packet headers,
+// checksum scratch space and packet copies SendPacket used to allocate kept
+// the garbage collector busy. SendPacketFields takes its builders from a
+// pool; a sender with a goroutine of its own can keep one and call
+// SendPacketInto.
+
+const (
+	defaultBuilderSize = 2048
+	maxPooledBuilder   = 64 << 10 // Larger buffers are left to the GC
+	maxTCPOptionsSize  = 40
+)
+
+// PacketBuilder serializes packets into a buffer it reuses. It is not safe
+// for concurrent use.
+type PacketBuilder struct {
+	buf []byte
+	sa4 syscall.SockaddrInet4
+	sa6 syscall.SockaddrInet6
+}
+
+var builderPool = sync.Pool{New: func() any { return NewPacketBuilder(nil) }}
+
+// NewPacketBuilder returns a builder serializing into buf, which it grows
+// when a packet does not fit, or into a buffer of its own if buf is nil
+func NewPacketBuilder(buf []byte) *PacketBuilder {
+	if buf == nil {
+		buf = make([]byte, 0, defaultBuilderSize)
+	}
+	return &PacketBuilder{buf: buf[:0]}
+}
+
+// GetPacketBuilder takes a builder from a shared pool
+func GetPacketBuilder() *PacketBuilder {
+	return builderPool.Get().(*PacketBuilder)
+}
+
+// PutPacketBuilder returns a builder to the pool; packets it built must no
+// longer be used
+func PutPacketBuilder(b *PacketBuilder) {
+	if cap(b.buf) <= maxPooledBuilder {
+		builderPool.Put(b)
+	}
+}
+
+// Build serializes a packet like SendPacketFields sends it. The packet is
+// valid until the next call.
+func (b *PacketBuilder) Build(fields HeaderFields, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, tcpOptions, payload []byte) ([]byte, error) {
+	buf, err := AppendPacket(b.buf[:0], fields, srcIP, srcPort, dstIP, dstPort, seq, ack, flags, tcpOptions, payload)
+	if err != nil {
+		return nil, err
+	}
+	b.buf = buf
+	return buf, nil
+}
+
+// AppendPacket appends a whole packet, IPv4 or IPv6 after dstIP, to dst and
+// returns the extended slice. Zero fields take DefaultTTL and DefaultWindow;
+// TCP options are padded to a multiple of 4 bytes.
+func AppendPacket(dst []byte, fields HeaderFields, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, tcpOptions, payload []byte) ([]byte, error) {
+	if fields.TTL == 0 {
+		fields.TTL = DefaultTTL
+	}
+	if fields.Window == 0 {
+		fields.Window = DefaultWindow
+	}
+	optLen := (len(tcpOptions) + 3) &^ 3
+	if optLen > maxTCPOptionsSize {
+		return dst, fmt.Errorf("TCP options too long: %d bytes", len(tcpOptions))
+	}
+	v6 := IsIPv6(dstIP)
+	ipLen := IPHeaderSize + len(fields.IPOptions)
+	if v6 {
+		if len(fields.IPOptions) > 0 {
+			return dst, fmt.Errorf("IP options are not supported over IPv6")
+		}
+		ipLen = IPv6HeaderSize
+	}
+	tcpLen := TCPHeaderSize + optLen + len(payload)
+
+	start := len(dst)
+	dst = slices.Grow(dst, ipLen+tcpLen)[:start+ipLen+tcpLen]
+	pkt := dst[start:]
+	if v6 {
+		putIPv6Header(pkt, srcIP, dstIP, IPPROTO_TCP, tcpLen, fields.TTL, fields.TOS)
+	} else {
+		putIPHeader(pkt[:ipLen], srcIP, dstIP, IPPROTO_TCP, tcpLen, fields.TTL, fields.TOS, fields.ID, fields.IPOptions)
+	}
+
+	seg := pkt[ipLen:]
+	putTCPHeader(seg, srcPort, dstPort, seq, ack, flags, fields.Window, tcpOptions, optLen)
+	copy(seg[TCPHeaderSize+optLen:], payload)
+	binary.BigEndian.PutUint16(seg[16:18], ^uint16(checksumSum(pseudoHeaderSum(srcIP, dstIP, tcpLen), seg)))
+	return dst, nil
+}
+
+// pseudoHeaderSum is the checksum sum of the pseudo header TCP checksums
+// cover, of IPv6 for IPv6 addresses
+func pseudoHeaderSum(srcIP, dstIP net.IP, tcpLen int) uint32 {
+	var sum uint32
+	if IsIPv6(srcIP) || IsIPv6(dstIP) {
+		sum = checksumSum(checksumSum(0, srcIP.To16()), dstIP.To16())
+		return sum + uint32(tcpLen)>>16 + uint32(tcpLen)&0xFFFF + IPPROTO_TCP
+	}
+	sum = checksumSum(checksumSum(0, srcIP.To4()), dstIP.To4())
+	return sum + IPPROTO_TCP + uint32(tcpLen)
+}
+
+// putIPHeader writes an IPv4 header, len(header) bytes including options,
+// for a payload of payloadLen bytes
+func putIPHeader(header []byte, srcIP, dstIP net.IP, protocol uint8, payloadLen int, ttl, tos uint8, id uint16, options []byte) {
+	copy(header[IPHeaderSize:], options)
+
+	// Version (4 bits) + IHL (4 bits)
+	header[0] = 0x40 | byte(len(header)/4) // Version 4, IHL 5 (20 bytes) without options
+
+	// Type of Service
+	header[1] = tos
+
+	// Total Length
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+payloadLen))
+
+	binary.BigEndian.PutUint16(header[4:6], id)
+
+	// Flags (3 bits) + Fragment Offset (13 bits)
+	binary.BigEndian.PutUint16(header[6:8], IP_DF) // Don't fragment
+
+	header[8] = ttl
+	header[9] = protocol
+
+	// Checksum, computed below over the header with the field zeroed
+	header[10] = 0
+	header[11] = 0
+
+	copy(header[12:16], srcIP.To4())
+	copy(header[16:20], dstIP.To4())
+
+	binary.BigEndian.PutUint16(header[10:12], CalculateChecksum(header))
+}
+
+// putTCPHeader writes a TCP header with a zero checksum and its options
+// padded to optLen bytes
+func putTCPHeader(header []byte, srcPort, dstPort uint16, seq, ack uint32, flags uint8, window uint16, options []byte, optLen int) {
+	binary.BigEndian.PutUint16(header[0:2], srcPort)
+	binary.BigEndian.PutUint16(header[2:4], dstPort)
+	binary.BigEndian.PutUint32(header[4:8], seq)
+	binary.BigEndian.PutUint32(header[8:12], ack)
+
+	// Data offset (4 bits) + Reserved (4 bits)
+	header[12] = uint8((TCPHeaderSize+optLen)/4) << 4
+	header[13] = flags
+	binary.BigEndian.PutUint16(header[14:16], window)
+
+	// Checksum and urgent pointer
+	clear(header[16:20])
+
+	n := copy(header[TCPHeaderSize:TCPHeaderSize+optLen], options)
+	clear(header[TCPHeaderSize+n : TCPHeaderSize+optLen])
+}
+
+// SendPacketInto is SendPacketFields serializing the packet into b
+func (rs *RawSocket) SendPacketInto(b *PacketBuilder, fields HeaderFields, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, tcpOptions, payload []byte) error {
+	rs.marking.apply(&fields)
+	if fields.ID == 0 && !IsIPv6(dstIP) {
+		fields.ID = rs.ipidStrategy().NextID(srcIP, dstIP, srcPort, dstPort)
+	}
+	packet, err := b.Build(fields, srcIP, srcPort, dstIP, dstPort, seq, ack, flags, tcpOptions, payload)
+	if err != nil {
+		return err
+	}
+
+	// The port is in the TCP header
+	var to syscall.Sockaddr
+	if IsIPv6(dstIP) {
+		copy(b.sa6.Addr[:], dstIP.To16())
+		to = &b.sa6
+	} else {
+		copy(b.sa4.Addr[:], dstIP.To4())
+		to = &b.sa4
+	}
+	if err := syscall.Sendto(rs.fd, packet, 0, to); err != nil {
+		return fmt.Errorf("failed to send packet: %v", err)
+	}
+	capture.Outer.Packet(packet)
+	return nil
+}
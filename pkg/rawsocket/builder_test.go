@@ -0,0 +1,113 @@
+package rawsocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// TestPacketBuilder checks that built packets match the ones assembled from
+// the separate headers, IPv6 ones validate and options are padded
+func TestPacketBuilder(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	payload := []byte("hello, tunnel")
+	b := NewPacketBuilder(nil)
+	for _, flags := range []uint8{0x02, 0x12, 0x18} {
+		pkt, err := b.Build(HeaderFields{}, src, 40000, dst, 443, 1000, 2000, flags, []byte{1, 1, 1, 1}, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := buildTestPacket(flags, payload); !bytes.Equal(pkt, want) {
+			t.Fatalf("flags %#02x: built\n%x\nwant\n%x", flags, pkt, want)
+		}
+	}
+
+	// Odd payload and options needing padding
+	pkt, err := b.Build(HeaderFields{TTL: 3, TOS: ECNECT0}, src, 40000, dst, 443, 1, 2, 0x18, []byte{1, 1, 1}, payload[:5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidatePacket(pkt); err != nil {
+		t.Fatalf("padded packet rejected: %v", err)
+	}
+	if pkt[8] != 3 || pkt[1] != ECNECT0 || pkt[IPHeaderSize+12]>>4 != 6 || pkt[IPHeaderSize+TCPHeaderSize+3] != 0 {
+		t.Fatalf("header fields not applied: %x", pkt[:IPHeaderSize+24])
+	}
+
+	src6, dst6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	pkt, err = b.Build(HeaderFields{}, src6, 40000, dst6, 443, 1000, 2000, 0x18, nil, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidatePacket(pkt); err != nil {
+		t.Fatalf("IPv6 packet rejected: %v", err)
+	}
+	tcp := pkt[IPv6HeaderSize:]
+	if got, want := binary.BigEndian.Uint16(tcp[16:18]), checksumOf(src6, dst6, tcp); got != want {
+		t.Fatalf("IPv6 checksum %#04x, want %#04x", got, want)
+	}
+
+	if _, err := b.Build(HeaderFields{IPOptions: []byte{1, 1, 1, 1}}, src6, 1, dst6, 2, 0, 0, 0x10, nil, nil); err == nil {
+		t.Fatal("IP options accepted over IPv6")
+	}
+	if _, err := b.Build(HeaderFields{}, src, 1, dst, 2, 0, 0, 0x10, make([]byte, 41), nil); err == nil {
+		t.Fatal("41 bytes of TCP options accepted")
+	}
+}
+
+// checksumOf recomputes the checksum of a built segment with CalculateTCPChecksum
+func checksumOf(src, dst net.IP, seg []byte) uint16 {
+	header := append([]byte(nil), seg[:TCPHeaderSize]...)
+	header[16], header[17] = 0, 0
+	return CalculateTCPChecksum(src, dst, header, seg[TCPHeaderSize:])
+}
+
+// TestPacketBuilderAllocs checks that building into a builder allocates
+// nothing once its buffer is large enough
+func TestPacketBuilderAllocs(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	options := []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}
+	payload := make([]byte, 1400)
+	b := NewPacketBuilder(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := b.Build(HeaderFields{}, src, 40000, dst, 443, 1000, 2000, 0x18, options, payload); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("Build allocated %v times per packet", allocs)
+	}
+}
+
+// BenchmarkBuildPacket compares assembling a packet from separately built
+// headers, as SendPacket used to, with building it into a PacketBuilder
+func BenchmarkBuildPacket(b *testing.B) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	options := []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}
+	payload := make([]byte, 1400)
+
+	b.Run("headers", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			tcp := BuildTCPHeader(40000, 443, uint32(i), 2000, 0x18, DefaultWindow, options)
+			binary.BigEndian.PutUint16(tcp[16:18], CalculateTCPChecksum(src, dst, tcp, payload))
+			ip := buildIPHeader(src, dst, IPPROTO_TCP, len(tcp)+len(payload), DefaultTTL, 0, 0, nil)
+			packet := make([]byte, len(ip)+len(tcp)+len(payload))
+			copy(packet, ip)
+			copy(packet[len(ip):], tcp)
+			copy(packet[len(ip)+len(tcp):], payload)
+		}
+	})
+	b.Run("builder", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		pb := NewPacketBuilder(nil)
+		for i := 0; i < b.N; i++ {
+			if _, err := pb.Build(HeaderFields{}, src, 40000, dst, 443, uint32(i), 2000, 0x18, options, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
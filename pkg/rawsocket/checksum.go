@@ -0,0 +1,116 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+)
+
+// The Internet checksum (RFC 1071) is summed in place over the slices a packet
+// is made of, never over a copy, eight bytes at a time with the carries folded
+// back in (RFC 1071 section 2(B): the sum does not depend on the word size, so
+// 64-bit words fold down to the same 16-bit result). The loop handles 32 bytes
+// per iteration; on amd64 that is about five times the speed of adding 16-bit
+// words one by one (BenchmarkChecksum), which matters once every forged
+// segment and, with strict validation, every received one is summed.
+//
+// Checksum offload does not apply: raw IP_HDRINCL packets leave the TCP
+// checksum to the sender, and received ones are summed only when validated.
+
+// Checksum is a running Internet checksum over data added piece by piece. The
+// pieces need not be of even length. The zero value is an empty sum.
+type Checksum struct {
+	sum uint64
+	odd bool // An odd number of bytes was added; the next byte is a low byte
+}
+
+// Add adds data to the sum
+func (c *Checksum) Add(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if c.odd {
+		c.sum = add64(c.sum, uint64(data[0]))
+		data = data[1:]
+		c.odd = false
+	}
+	c.sum = add64(c.sum, uint64(sumWords(data)))
+	if len(data)%2 == 1 {
+		c.odd = true
+	}
+}
+
+// AddUint16 adds a 16-bit word, aligned like an even number of bytes before it
+func (c *Checksum) AddUint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	c.Add(b[:])
+}
+
+// AddPseudoHeader adds the pseudo header of a transport segment of length
+// bytes and the given protocol between srcIP and dstIP, that of IPv6 for IPv6
+// addresses; it must come first or after an even number of bytes
+func (c *Checksum) AddPseudoHeader(srcIP, dstIP net.IP, protocol uint8, length int) {
+	if IsIPv6(srcIP) || IsIPv6(dstIP) {
+		c.Add(srcIP.To16())
+		c.Add(dstIP.To16())
+		c.sum = add64(c.sum, uint64(uint32(length))+uint64(protocol))
+		return
+	}
+	c.Add(srcIP.To4())
+	c.Add(dstIP.To4())
+	c.sum = add64(c.sum, uint64(protocol)+uint64(length))
+}
+
+// Sum16 returns the folded ones' complement sum; data whose checksum is right
+// sums to 0xFFFF
+func (c *Checksum) Sum16() uint16 {
+	return uint16(fold(c.sum))
+}
+
+// Final returns the checksum to write into a header: the complement of Sum16
+func (c *Checksum) Final() uint16 {
+	return ^c.Sum16()
+}
+
+// add64 is ones' complement addition of 64-bit words
+func add64(a, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	return sum + carry
+}
+
+// fold folds a 64-bit ones' complement sum to 16 bits
+func fold(sum uint64) uint32 {
+	sum = sum&0xFFFFFFFF + sum>>32
+	sum = sum&0xFFFFFFFF + sum>>32
+	s := uint32(sum)
+	s = s&0xFFFF + s>>16
+	return s&0xFFFF + s>>16
+}
+
+// sumWords returns the ones' complement sum of data, 16-bit words in network
+// order with an odd last byte as the high byte of a word, folded to 16 bits
+func sumWords(data []byte) uint32 {
+	var sum, carry uint64
+	for len(data) >= 32 {
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(data), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(data[8:]), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(data[16:]), carry)
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(data[24:]), carry)
+		data = data[32:]
+	}
+	for len(data) >= 8 {
+		sum, carry = bits.Add64(sum, binary.BigEndian.Uint64(data), carry)
+		data = data[8:]
+	}
+	sum = add64(sum, carry)
+	var tail uint64
+	for len(data) >= 2 {
+		tail += uint64(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		tail += uint64(data[0]) << 8
+	}
+	return fold(add64(sum, tail))
+}
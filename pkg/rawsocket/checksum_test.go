@@ -0,0 +1,91 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"testing"
+)
+
+// referenceSum adds 16-bit words one at a time, as the checksum used to be
+func referenceSum(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return sum
+}
+
+// TestChecksum compares the word-at-a-time sum with 16-bit summation over
+// random data, added whole and in pieces of any length
+func TestChecksum(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, 2048)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	for i := range 64 {
+		data[i] = 0xFF // Carries out of every word
+	}
+	for n := range len(data) {
+		buf := data[:n]
+		want := referenceSum(0, buf)
+		if got := sumWords(buf); got != want {
+			t.Fatalf("%d bytes: sum %#x, want %#x", n, got, want)
+		}
+		if got := CalculateChecksum(buf); got != ^uint16(want) {
+			t.Fatalf("%d bytes: checksum %#x, want %#x", n, got, ^uint16(want))
+		}
+		var c Checksum
+		for len(buf) > 0 {
+			k := min(r.IntN(40), len(buf))
+			c.Add(buf[:k])
+			buf = buf[k:]
+		}
+		if got := c.Sum16(); uint32(got) != want && !(got == 0xFFFF && want == 0) {
+			t.Fatalf("%d bytes in pieces: sum %#x, want %#x", n, got, want)
+		}
+	}
+
+	// The pseudo header matches the one the builder sums
+	for _, ips := range [][2]net.IP{
+		{net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")},
+	} {
+		var c Checksum
+		c.AddPseudoHeader(ips[0], ips[1], IPPROTO_TCP, 70000)
+		if got, want := c.Sum16(), uint16(referenceSum(pseudoHeaderSum(ips[0], ips[1], 70000), nil)); got != want {
+			t.Errorf("%v pseudo header: sum %#x, want %#x", ips[0], got, want)
+		}
+	}
+}
+
+// BenchmarkChecksum sums segments of typical sizes 16 bits at a time and
+// eight bytes at a time
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range []int{64, 576, 1460, 9000} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		b.Run(fmt.Sprintf("words16/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for range b.N {
+				referenceSum(0, data)
+			}
+		})
+		b.Run(fmt.Sprintf("words64/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for range b.N {
+				sumWords(data)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package rawsocket
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// WrapFD uses a raw socket created by the caller (passed in by a supervisor,
+// received over a Unix socket, a test fake) instead of creating one. fd must
+// be an AF_INET, or for an IPv6 localIP AF_INET6, SOCK_RAW socket for
+// IPPROTO_TCP. IP_HDRINCL (IPV6_HDRINCL and the control messages RecvPacket
+// uses) is set and the socket is put in blocking mode; its binding and buffer sizes are left as the
+// caller chose. The RawSocket owns fd on success; on error fd stays open.
+func WrapFD(fd int, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isServer bool) (*RawSocket, error) {
+	ipv6 := IsIPv6(localIP)
+	domain, domainName := syscall.AF_INET, "AF_INET"
+	if ipv6 {
+		domain, domainName = syscall.AF_INET6, "AF_INET6"
+	}
+	for _, want := range []struct {
+		opt, value int
+		name       string
+	}{
+		{syscall.SO_DOMAIN, domain, domainName},
+		{syscall.SO_TYPE, syscall.SOCK_RAW, "SOCK_RAW"},
+		{syscall.SO_PROTOCOL, syscall.IPPROTO_TCP, "IPPROTO_TCP"},
+	} {
+		v, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, want.opt)
+		if err != nil {
+			return nil, fmt.Errorf("fd %d is not a socket: %v", fd, err)
+		}
+		if v != want.value {
+			return nil, fmt.Errorf("fd %d is not an %s raw TCP socket (not %s)", fd, domainName, want.name)
+		}
+	}
+
+	if ipv6 {
+		if err := setupIPv6(fd); err != nil {
+			return nil, err
+		}
+	} else if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1); err != nil {
+		return nil, fmt.Errorf("failed to set IP_HDRINCL: %v", err)
+	}
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		return nil, fmt.Errorf("failed to set blocking mode: %v", err)
+	}
+
+	return &RawSocket{
+		fd:         fd,
+		localIP:    localIP,
+		localPort:  localPort,
+		remoteIP:   remoteIP,
+		remotePort: remotePort,
+		isServer:   isServer,
+		ipv6:       ipv6,
+	}, nil
+}
@@ -0,0 +1,24 @@
+package rawsocket
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// TestWrapFDRejectsOtherSockets checks that only raw TCP sockets are accepted
+// and that a rejected descriptor is left open for the caller
+func TestWrapFDRejectsOtherSockets(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	if _, err := WrapFD(fd, net.IPv4(127, 0, 0, 1), 9000, nil, 0, true); err == nil {
+		t.Fatal("UDP socket accepted")
+	}
+	if _, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE); err != nil {
+		t.Fatalf("rejected fd was closed: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// A raw TCP socket is handed every TCP packet the host receives, so a busy
+// host's SSH, HTTP and database traffic is copied to the tunnel and thrown
+// away in RecvPacket's callers. AttachFilter installs a classic BPF program
+// (SO_ATTACH_FILTER) matching the addresses and ports of the tunnel's flow so
+// that the kernel drops everything else before it is queued on the socket.
+// Callers keep checking addresses themselves: packets queued before the
+// filter was attached are still delivered.
+//
+// An IPv4 raw socket's filter sees the packet from its IP header on; an IPv6
+// one sees the TCP segment, and its IPv6 header through the SKF_NET_OFF
+// offsets.
+
+// FilterSpec selects the packets a raw socket receives by the flow they belong
+// to. Unset fields (nil or unspecified IPs, zero ports) match anything.
+type FilterSpec struct {
+	LocalIP    net.IP // Destination address of received packets
+	LocalPort  uint16
+	RemoteIP   net.IP // Source address of received packets
+	RemotePort uint16
+}
+
+// skfNetOff is SKF_NET_OFF: loads at skfNetOff+k read the network header
+const skfNetOff = -0x100000
+
+// Classic BPF opcodes used by the filters
+const (
+	bpfLdW    = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfLdH    = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS
+	bpfLdB    = syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS
+	bpfLdHInd = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND
+	bpfLdxMsh = syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH // X = 4*(pkt[k]&0xf)
+	bpfJeq    = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfRet    = syscall.BPF_RET | syscall.BPF_K
+)
+
+// CompileFilter returns the program AttachFilter attaches to an IPv4 or, if
+// ipv6, an IPv6 raw socket
+func CompileFilter(spec FilterSpec, ipv6 bool) ([]syscall.SockFilter, error) {
+	return compileFilter(spec, ipv6, false)
+}
+
+// compileFilter returns the filter of a raw socket or, if packet, of the
+// AF_PACKET socket of a receive ring, which sees the IP header of every
+// protocol (IPv6 packets with extension headers are dropped)
+func compileFilter(spec FilterSpec, ipv6, packet bool) ([]syscall.SockFilter, error) {
+	var prog []syscall.SockFilter
+	// Every comparison jumps to the drop at the end when it fails; the
+	// offsets are filled in once the length is known
+	match := func(load uint16, k int32, value uint32) {
+		prog = append(prog,
+			syscall.SockFilter{Code: load, K: uint32(k)},
+			syscall.SockFilter{Code: bpfJeq, K: value})
+	}
+	matchIP := func(ip net.IP, offset int32) error {
+		if ip == nil || ip.IsUnspecified() {
+			return nil
+		}
+		addr := ip.To4()
+		if ipv6 {
+			addr = ip.To16()
+			if !packet {
+				offset += skfNetOff
+			}
+		}
+		if addr == nil || (ipv6 && ip.To4() != nil) {
+			return fmt.Errorf("address %s does not match the socket's family", ip)
+		}
+		for i := 0; i < len(addr); i += 4 {
+			match(bpfLdW, offset+int32(i), binary.BigEndian.Uint32(addr[i:]))
+		}
+		return nil
+	}
+
+	srcOff, dstOff := int32(12), int32(16)
+	if ipv6 {
+		srcOff, dstOff = 8, 24
+	}
+	if packet {
+		protoOff := int32(9) // IPv4 protocol, IPv6 next header
+		if ipv6 {
+			protoOff = 6
+		}
+		match(bpfLdB, protoOff, IPPROTO_TCP)
+	}
+	if err := matchIP(spec.LocalIP, dstOff); err != nil {
+		return nil, err
+	}
+	if err := matchIP(spec.RemoteIP, srcOff); err != nil {
+		return nil, err
+	}
+
+	// Ports are read behind the IP header (IPv4 and rings) or at the start
+	// (IPv6 raw sockets)
+	portLoad, portOff := uint16(bpfLdH), int32(0)
+	switch {
+	case spec.LocalPort == 0 && spec.RemotePort == 0:
+	case !ipv6:
+		prog = append(prog, syscall.SockFilter{Code: bpfLdxMsh, K: 0})
+		portLoad = bpfLdHInd
+	case packet:
+		portOff = IPv6HeaderSize
+	}
+	if spec.LocalPort != 0 {
+		match(portLoad, portOff+2, uint32(spec.LocalPort))
+	}
+	if spec.RemotePort != 0 {
+		match(portLoad, portOff, uint32(spec.RemotePort))
+	}
+
+	prog = append(prog,
+		syscall.SockFilter{Code: bpfRet, K: 0xFFFFFFFF}, // Accept the whole packet
+		syscall.SockFilter{Code: bpfRet, K: 0})          // Drop
+	drop := len(prog) - 1
+	for i := range prog {
+		if prog[i].Code == bpfJeq {
+			prog[i].Jf = uint8(drop - i - 1)
+		}
+	}
+	return prog, nil
+}
+
+// AttachFilter makes the kernel deliver only packets matching spec to the
+// socket, or its receive ring, replacing any filter attached before
+func (rs *RawSocket) AttachFilter(spec FilterSpec) error {
+	if rs.ring != nil {
+		return rs.ring.attachFilter(spec, rs.ipv6)
+	}
+	prog, err := CompileFilter(spec, rs.ipv6)
+	if err != nil {
+		return err
+	}
+	return attachFilter(rs.fd, prog)
+}
+
+func attachFilter(fd int, prog []syscall.SockFilter) error {
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	err := setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, unsafe.Pointer(&fprog), unsafe.Sizeof(fprog))
+	runtime.KeepAlive(prog) // fprog's copy hides the pointer from the collector
+	if err != nil {
+		return fmt.Errorf("failed to attach socket filter: %v", err)
+	}
+	return nil
+}
+
+// setsockopt sets a socket option to the size bytes at p. The syscall package
+// has no form taking a raw pointer, and SYS_SETSOCKOPT does not exist on 386,
+// where socket calls go through socketcall(2); SetsockoptString copies the
+// value and uses the right call on every architecture.
+func setsockopt(fd, level, opt int, p unsafe.Pointer, size uintptr) error {
+	return syscall.SetsockoptString(fd, level, opt, unsafe.String((*byte)(p), size))
+}
+
+// DetachFilter removes the filter attached by AttachFilter; a receive ring
+// goes back to receiving all TCP packets
+func (rs *RawSocket) DetachFilter() error {
+	if rs.ring != nil {
+		return rs.ring.attachFilter(FilterSpec{}, rs.ipv6)
+	}
+	if err := syscall.SetsockoptInt(rs.fd, syscall.SOL_SOCKET, syscall.SO_DETACH_FILTER, 0); err != nil {
+		return fmt.Errorf("failed to detach socket filter: %v", err)
+	}
+	return nil
+}
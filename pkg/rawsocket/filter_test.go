@@ -0,0 +1,64 @@
+package rawsocket
+
+import (
+	"net"
+	"testing"
+)
+
+// TestAttachFilter sends segments of the filtered flow and of neighbouring
+// ones over loopback and checks that only the flow's reach the socket
+func TestAttachFilter(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	const local, remote = 47001, 47002
+	rs, err := NewRawSocket(lo, local, lo, remote, false)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer rs.Close()
+	sender, err := NewRawSocket(lo, remote, lo, local, false)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer sender.Close()
+
+	if err := rs.AttachFilter(FilterSpec{LocalIP: lo, LocalPort: local, RemoteIP: lo, RemotePort: remote}); err != nil {
+		t.Fatal(err)
+	}
+	// The filter does not apply to packets queued before it was attached
+	rs.SetReadTimeout(0, 1000)
+	buf := make([]byte, 2048)
+	for {
+		if _, _, _, _, _, _, _, _, err := rs.RecvPacket(buf); err != nil {
+			break
+		}
+	}
+
+	send := func(srcPort, dstPort uint16, seq uint32) {
+		if err := sender.SendPacket(lo, srcPort, lo, dstPort, seq, 0, 0x18, nil, []byte("filter")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(remote, local+10, 1)
+	send(remote+10, local, 2)
+	send(remote, local, 3)
+
+	rs.SetReadTimeout(0, 200000)
+	var got []uint32
+	for {
+		_, srcPort, _, dstPort, seq, _, _, _, err := rs.RecvPacket(buf)
+		if err != nil {
+			break
+		}
+		if srcPort != remote || dstPort != local {
+			t.Errorf("segment %d:%d passed the filter", srcPort, dstPort)
+		}
+		got = append(got, seq)
+	}
+	if len(got) != 1 || got[0] != 3 {
+		t.Fatalf("received segments %v, want [3]", got)
+	}
+
+	if _, err := CompileFilter(FilterSpec{LocalIP: net.ParseIP("2001:db8::1")}, false); err == nil {
+		t.Fatal("IPv6 address accepted for an IPv4 socket")
+	}
+}
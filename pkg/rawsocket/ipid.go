@@ -0,0 +1,155 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Identification field of IPv4 packets is where a fixed value stands out
+// most: no stack sends every packet with the same ID, so DPI can match a
+// constant one alone. A RawSocket takes the ID of each packet it sends from an
+// IPIDStrategy:
+//
+//	counter  one counter per flow starting at a random value and counting
+//	         packets, as Linux does for TCP on a connected socket (default)
+//	random   a random ID per packet, as OpenBSD and FreeBSD (net.inet.ip.random_id) do
+//	kernel   Linux's ip_idents: counters shared by the flows hashing to a bucket,
+//	         jumping ahead by a random amount after idle periods, as the
+//	         kernel numbers packets without a socket
+//
+// IPv6 headers have no Identification field.
+
+// IPIDStrategy chooses the Identification field of the IPv4 packets of a flow.
+// It must be safe for concurrent use.
+type IPIDStrategy interface {
+	NextID(srcIP, dstIP net.IP, srcPort, dstPort uint16) uint16
+}
+
+// IPIDStrategies names the strategies ParseIPIDStrategy accepts
+var IPIDStrategies = []string{"counter", "random", "kernel"}
+
+// ParseIPIDStrategy returns a new strategy by name ("" = counter)
+func ParseIPIDStrategy(name string) (IPIDStrategy, error) {
+	switch name {
+	case "", "counter":
+		return NewCounterIPID(), nil
+	case "random":
+		return RandomIPID{}, nil
+	case "kernel":
+		return NewKernelIPID(), nil
+	}
+	return nil, fmt.Errorf("unknown IP ID strategy %q (want counter, random or kernel)", name)
+}
+
+// defaultIPID numbers the packets of sockets without a strategy of their own
+var defaultIPID = sync.OnceValue(func() IPIDStrategy { return NewCounterIPID() })
+
+// WithIPID numbers the packets the socket sends with s instead of the shared
+// per-flow counter
+func WithIPID(s IPIDStrategy) Option {
+	return func(o *socketOptions) {
+		o.ipid = s
+	}
+}
+
+// SetIPIDStrategy is WithIPID for a socket not made by NewRawSocket; it must
+// be called before the socket sends
+func (rs *RawSocket) SetIPIDStrategy(s IPIDStrategy) {
+	rs.ipid = s
+}
+
+func (rs *RawSocket) ipidStrategy() IPIDStrategy {
+	if rs.ipid != nil {
+		return rs.ipid
+	}
+	return defaultIPID()
+}
+
+// RandomIPID gives every packet a random ID
+type RandomIPID struct{}
+
+// NextID implements IPIDStrategy
+func (RandomIPID) NextID(srcIP, dstIP net.IP, srcPort, dstPort uint16) uint16 {
+	return uint16(rand.Uint32())
+}
+
+// ipidBuckets is the number of counters of the hashed strategies; flows
+// sharing one still see increasing IDs
+const ipidBuckets = 2048
+
+// ipidTable is a set of counters indexed by a keyed hash of the flow
+type ipidTable struct {
+	seed maphash.Seed
+	ids  [ipidBuckets]atomic.Uint32
+}
+
+func (t *ipidTable) init() {
+	t.seed = maphash.MakeSeed()
+	for i := range t.ids {
+		t.ids[i].Store(rand.Uint32())
+	}
+}
+
+// bucket hashes the addresses and, unless ports is false, the ports
+func (t *ipidTable) bucket(srcIP, dstIP net.IP, srcPort, dstPort uint16, ports bool) int {
+	var key [36]byte
+	copy(key[0:16], srcIP.To16())
+	copy(key[16:32], dstIP.To16())
+	n := 32
+	if ports {
+		binary.BigEndian.PutUint16(key[32:], srcPort)
+		binary.BigEndian.PutUint16(key[34:], dstPort)
+		n = 36
+	}
+	return int(maphash.Bytes(t.seed, key[:n]) % ipidBuckets)
+}
+
+// CounterIPID numbers the packets of each flow consecutively from a random
+// start
+type CounterIPID struct {
+	table ipidTable
+}
+
+// NewCounterIPID returns a per-flow counter
+func NewCounterIPID() *CounterIPID {
+	c := &CounterIPID{}
+	c.table.init()
+	return c
+}
+
+// NextID implements IPIDStrategy
+func (c *CounterIPID) NextID(srcIP, dstIP net.IP, srcPort, dstPort uint16) uint16 {
+	return uint16(c.table.ids[c.table.bucket(srcIP, dstIP, srcPort, dstPort, true)].Add(1))
+}
+
+// KernelIPID numbers packets like Linux's ip_select_ident: one counter per
+// address pair bucket, advanced by a random amount up to the milliseconds it
+// was idle so that its rate cannot be read off the IDs
+type KernelIPID struct {
+	table ipidTable
+	stamp [ipidBuckets]atomic.Int64 // Millisecond of each bucket's last use
+}
+
+// NewKernelIPID returns a kernel-like strategy
+func NewKernelIPID() *KernelIPID {
+	k := &KernelIPID{}
+	k.table.init()
+	return k
+}
+
+// NextID implements IPIDStrategy
+func (k *KernelIPID) NextID(srcIP, dstIP net.IP, srcPort, dstPort uint16) uint16 {
+	i := k.table.bucket(srcIP, dstIP, 0, 0, false)
+	now := time.Now().UnixMilli()
+	delta := uint32(1)
+	if old := k.stamp[i].Load(); old != now && k.stamp[i].CompareAndSwap(old, now) && now > old {
+		delta += rand.Uint32N(uint32(min(now-old, 1<<16)))
+	}
+	return uint16(k.table.ids[i].Add(delta))
+}
@@ -0,0 +1,91 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// TestIPIDStrategies checks that the counter numbers each flow's packets
+// consecutively, the kernel-like strategy never goes back and random IDs vary
+func TestIPIDStrategies(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+
+	c := NewCounterIPID()
+	first := c.NextID(src, dst, 40000, 443)
+	for i := uint16(1); i < 5; i++ {
+		if id := c.NextID(src, dst, 40000, 443); id != first+i {
+			t.Fatalf("counter packet %d has ID %d, want %d", i, id, first+i)
+		}
+	}
+
+	k := NewKernelIPID()
+	prev := k.NextID(src, dst, 40000, 443)
+	for i := 0; i < 100; i++ {
+		id := k.NextID(src, dst, 40000, 443)
+		if d := id - prev; d == 0 || d > 1<<15 {
+			t.Fatalf("kernel-like ID went from %d to %d", prev, id)
+		}
+		prev = id
+	}
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < 16; i++ {
+		seen[RandomIPID{}.NextID(src, dst, 40000, 443)] = true
+	}
+	if len(seen) < 8 {
+		t.Fatalf("16 random IDs took only %d values", len(seen))
+	}
+
+	for _, name := range append([]string{""}, IPIDStrategies...) {
+		if _, err := ParseIPIDStrategy(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ParseIPIDStrategy("fixed"); err == nil {
+		t.Fatal("unknown strategy accepted")
+	}
+}
+
+// TestSendIPID sends packets over loopback and checks that their IDs come
+// from the socket's strategy
+func TestSendIPID(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	const local, remote = 47021, 47022
+	rs, err := NewRawSocket(lo, local, lo, remote, false)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer rs.Close()
+	sender, err := NewRawSocket(lo, remote, lo, local, false, WithIPID(NewCounterIPID()))
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer sender.Close()
+	if err := rs.AttachFilter(FilterSpec{LocalIP: lo, LocalPort: local, RemoteIP: lo, RemotePort: remote}); err != nil {
+		t.Fatal(err)
+	}
+
+	for seq := uint32(1); seq <= 3; seq++ {
+		if err := sender.SendPacket(lo, remote, lo, local, seq, 0, 0x18, nil, []byte("ipid")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sender.SendPacketFields(HeaderFields{ID: 7}, lo, remote, lo, local, 4, 0, 0x18, nil, []byte("ipid")); err != nil {
+		t.Fatal(err)
+	}
+
+	rs.SetReadTimeout(0, 200000)
+	var ids []uint16
+	buf := make([]byte, 2048)
+	for len(ids) < 4 {
+		_, err := rs.recv(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, binary.BigEndian.Uint16(buf[4:6]))
+	}
+	if ids[1] != ids[0]+1 || ids[2] != ids[1]+1 || ids[3] != 7 {
+		t.Fatalf("received IDs %v, want three consecutive ones and 7", ids)
+	}
+}
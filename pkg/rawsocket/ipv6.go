@@ -0,0 +1,195 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// IPv6: NewRawSocket opens an AF_INET6 socket when the local or remote
+// address it is given is an IPv6 one, so the tunnel runs on hosts without
+// IPv4. Headers are still built here (IPV6_HDRINCL), but received segments
+// come without theirs: RecvPacket rebuilds the IPv6 header from the source
+// address and the IPV6_PKTINFO, IPV6_HOPLIMIT and IPV6_TCLASS control
+// messages, so callers see whole packets of either family and ParsePacket,
+// ValidatePacket and the option parsers take both. Extension headers are
+// neither sent nor accepted.
+
+const (
+	// IPv6HeaderSize is the size of the fixed IPv6 header
+	IPv6HeaderSize = 40
+
+	ipv6HdrIncl = 36 // IPV6_HDRINCL, not in package syscall
+)
+
+// IsIPv6 reports whether ip is an IPv6 address rather than an IPv4 one
+// (IPv4-mapped addresses count as IPv4)
+func IsIPv6(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() == nil
+}
+
+// HeaderSize returns the size of the IP header, without options, of packets
+// to or from ip
+func HeaderSize(ip net.IP) int {
+	if IsIPv6(ip) {
+		return IPv6HeaderSize
+	}
+	return IPHeaderSize
+}
+
+// BuildIPv6Header constructs an IPv6 header
+func BuildIPv6Header(srcIP, dstIP net.IP, nextHeader uint8, payloadLen int) []byte {
+	return buildIPv6Header(srcIP, dstIP, nextHeader, payloadLen, DefaultTTL, 0)
+}
+
+func buildIPv6Header(srcIP, dstIP net.IP, nextHeader uint8, payloadLen int, hopLimit, trafficClass uint8) []byte {
+	header := make([]byte, IPv6HeaderSize)
+	putIPv6Header(header, srcIP, dstIP, nextHeader, payloadLen, hopLimit, trafficClass)
+	return header
+}
+
+func putIPv6Header(header []byte, srcIP, dstIP net.IP, nextHeader uint8, payloadLen int, hopLimit, trafficClass uint8) {
+	// Version (4 bits) + traffic class (8 bits) + flow label (20 bits, unused)
+	binary.BigEndian.PutUint32(header[0:4], 6<<28|uint32(trafficClass)<<20)
+	binary.BigEndian.PutUint16(header[4:6], uint16(payloadLen))
+	header[6] = nextHeader
+	header[7] = hopLimit
+	copy(header[8:24], srcIP.To16())
+	copy(header[24:40], dstIP.To16())
+}
+
+// pseudoHeaderIPv6 builds the pseudo header the TCP checksum covers over
+// IPv6 (RFC 8200 section 8.1)
+func pseudoHeaderIPv6(srcIP, dstIP net.IP, tcpLen int) []byte {
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:16], srcIP.To16())
+	copy(pseudo[16:32], dstIP.To16())
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(tcpLen))
+	pseudo[39] = IPPROTO_TCP
+	return pseudo
+}
+
+// TrafficClass returns the type of service byte of an IPv4 packet or the
+// traffic class of an IPv6 one, which carry DSCP and the ECN bits alike
+func TrafficClass(pkt []byte) uint8 {
+	if len(pkt) < 2 {
+		return 0
+	}
+	if pkt[0]>>4 == 6 {
+		return pkt[0]<<4 | pkt[1]>>4
+	}
+	return pkt[1]
+}
+
+// ipHeaderLen returns the length of the IP header of a packet carrying TCP,
+// or 0 if it is malformed or not TCP
+func ipHeaderLen(pkt []byte) int {
+	if len(pkt) == 0 {
+		return 0
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if ihl := int(pkt[0]&0x0F) * 4; ihl >= IPHeaderSize && len(pkt) >= ihl {
+			return ihl
+		}
+	case 6:
+		if len(pkt) >= IPv6HeaderSize && pkt[6] == IPPROTO_TCP {
+			return IPv6HeaderSize
+		}
+	}
+	return 0
+}
+
+// setupIPv6 has an AF_INET6 raw socket take our headers and report what
+// RecvPacket needs to rebuild those of received segments
+func setupIPv6(fd int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6HdrIncl, 1); err != nil {
+		return fmt.Errorf("failed to set IPV6_HDRINCL: %v", err)
+	}
+	for _, opt := range []int{syscall.IPV6_RECVPKTINFO, syscall.IPV6_RECVHOPLIMIT, syscall.IPV6_RECVTCLASS} {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, opt, 1); err != nil {
+			return fmt.Errorf("failed to enable IPv6 control messages: %v", err)
+		}
+	}
+	return nil
+}
+
+// recvIPv6 receives a segment into buf behind room for its IPv6 header,
+// rebuilds the header and returns the length of the packet
+func (rs *RawSocket) recvIPv6(buf []byte) (int, error) {
+	if len(buf) < IPv6HeaderSize+TCPHeaderSize {
+		return 0, fmt.Errorf("buffer too small: %d bytes", len(buf))
+	}
+	var oob [128]byte
+	n, oobn, _, from, err := syscall.Recvmsg(rs.fd, buf[IPv6HeaderSize:], oob[:], 0)
+	if err != nil {
+		return 0, err
+	}
+	src, ok := from.(*syscall.SockaddrInet6)
+	if !ok {
+		return 0, fmt.Errorf("unexpected source address %T", from)
+	}
+
+	dst := rs.localIP
+	var hopLimit, trafficClass uint8
+	msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IPV6 {
+			continue
+		}
+		switch {
+		case m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= net.IPv6len:
+			dst = net.IP(append([]byte(nil), m.Data[:net.IPv6len]...))
+		case m.Header.Type == syscall.IPV6_HOPLIMIT && len(m.Data) >= 4:
+			hopLimit = uint8(binary.NativeEndian.Uint32(m.Data))
+		case m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4:
+			trafficClass = uint8(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+	copy(buf, buildIPv6Header(net.IP(src.Addr[:]), dst, IPPROTO_TCP, n, hopLimit, trafficClass))
+	return IPv6HeaderSize + n, nil
+}
+
+// parsePacketIPv6 is ParsePacket for an IPv6 packet
+func parsePacketIPv6(pkt []byte) (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, payload []byte, err error) {
+
+	if len(pkt) < IPv6HeaderSize+TCPHeaderSize {
+		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small: %d bytes", len(pkt))
+	}
+	if pkt[6] != IPPROTO_TCP {
+		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("not a TCP packet")
+	}
+	n := IPv6HeaderSize + int(binary.BigEndian.Uint16(pkt[4:6]))
+	if n > len(pkt) {
+		n = len(pkt)
+	}
+	srcIP = net.IP(append([]byte(nil), pkt[8:24]...))
+	dstIP = net.IP(append([]byte(nil), pkt[24:40]...))
+	srcPort, dstPort, seq, ack, flags, payload, err = parseSegment(pkt[IPv6HeaderSize:n])
+	if err != nil {
+		return nil, 0, nil, 0, 0, 0, 0, nil, err
+	}
+	return srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, nil
+}
+
+// validatePacketIPv6 is ValidatePacket for an IPv6 packet, which has no
+// header checksum
+func validatePacketIPv6(pkt []byte) error {
+	if len(pkt) < IPv6HeaderSize || pkt[6] != IPPROTO_TCP {
+		return ErrIPHeader
+	}
+	total := IPv6HeaderSize + int(binary.BigEndian.Uint16(pkt[4:6]))
+	if total < IPv6HeaderSize+TCPHeaderSize || total > len(pkt) {
+		return ErrIPHeader
+	}
+	seg := pkt[IPv6HeaderSize:total]
+	if err := ValidateSegment(seg); err != nil {
+		return err
+	}
+	if checksumSum(checksumSum(0, pseudoHeaderIPv6(pkt[8:24], pkt[24:40], len(seg))), seg) != 0xFFFF {
+		return ErrTCPChecksum
+	}
+	return nil
+}
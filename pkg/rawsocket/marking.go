@@ -0,0 +1,90 @@
+package rawsocket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Marking is the TTL and type of service of the packets a socket sends. Each
+// packet takes them from its HeaderFields when set there: a zero TTL, a zero
+// DSCP and a zero ECN codepoint in the fields fall back to the socket's, so
+// a packet cannot clear a class the socket sets.
+type Marking struct {
+	TTL  uint8 // 0 = DefaultTTL
+	DSCP uint8 // Differentiated services codepoint, 0-63
+	ECN  uint8 // ECN codepoint: 0 (Not-ECT), ECNECT1, ECNECT0 or ECNCE
+}
+
+// TOS returns the type of service byte (IPv4) or traffic class (IPv6) of m
+func (m Marking) TOS() uint8 {
+	return m.DSCP<<2 | m.ECN&ECNMask
+}
+
+// apply fills the fields a packet leaves zero from m
+func (m Marking) apply(fields *HeaderFields) {
+	if fields.TTL == 0 {
+		fields.TTL = m.TTL
+	}
+	if fields.TOS&^ECNMask == 0 {
+		fields.TOS |= m.DSCP << 2
+	}
+	if fields.TOS&ECNMask == 0 {
+		fields.TOS |= m.ECN & ECNMask
+	}
+}
+
+// WithMarking gives the packets the socket sends m's TTL, DSCP and ECN
+// codepoint where their HeaderFields do not set them
+func WithMarking(m Marking) Option {
+	return func(o *socketOptions) {
+		o.marking = m
+	}
+}
+
+// SetMarking is WithMarking for a socket not made by NewRawSocket; it must be
+// called before the socket sends
+func (rs *RawSocket) SetMarking(m Marking) {
+	rs.marking = m
+}
+
+// dscpClasses are the per-hop behaviour names of RFC 2474, 2597, 3246 and 8622
+var dscpClasses = map[string]uint8{
+	"default": 0, "be": 0, "le": 1, "ef": 46, "va": 44,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+}
+
+// ParseDSCP parses a DSCP class name such as EF, AF41 or CS1, or a number
+// from 0 to 63 ("" = 0)
+func ParseDSCP(s string) (uint8, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if v, ok := dscpClasses[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || n > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q (want a class such as ef, af41 or cs1, or 0-63)", s)
+	}
+	return uint8(n), nil
+}
+
+// ParseECN parses an ECN codepoint: not-ect, ect0, ect1 or ce ("" = not-ect)
+func ParseECN(s string) (uint8, error) {
+	switch strings.ToLower(s) {
+	case "", "not-ect":
+		return 0, nil
+	case "ect0":
+		return ECNECT0, nil
+	case "ect1":
+		return ECNECT1, nil
+	case "ce":
+		return ECNCE, nil
+	}
+	return 0, fmt.Errorf("invalid ECN codepoint %q (want not-ect, ect0, ect1 or ce)", s)
+}
@@ -0,0 +1,73 @@
+package rawsocket
+
+import (
+	"net"
+	"testing"
+)
+
+// TestParseMarking checks DSCP class names and numbers and the ECN codepoints
+func TestParseMarking(t *testing.T) {
+	for s, want := range map[string]uint8{"": 0, "EF": 46, "af41": 34, "cs1": 8, "le": 1, "46": 46, "0x2e": 46} {
+		if got, err := ParseDSCP(s); err != nil || got != want {
+			t.Errorf("ParseDSCP(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"64", "af44", "-1"} {
+		if _, err := ParseDSCP(s); err == nil {
+			t.Errorf("ParseDSCP(%q) accepted", s)
+		}
+	}
+	for s, want := range map[string]uint8{"": 0, "not-ect": 0, "ect0": ECNECT0, "ECT1": ECNECT1, "ce": ECNCE} {
+		if got, err := ParseECN(s); err != nil || got != want {
+			t.Errorf("ParseECN(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	if _, err := ParseECN("ect2"); err == nil {
+		t.Error("ParseECN accepted ect2")
+	}
+}
+
+// TestSendMarking sends packets over loopback and checks that the socket's
+// marking applies where the packet's fields leave it to the socket
+func TestSendMarking(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	const local, remote = 47031, 47032
+	rs, err := NewRawSocket(lo, local, lo, remote, false)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer rs.Close()
+	sender, err := NewRawSocket(lo, remote, lo, local, false, WithMarking(Marking{TTL: 9, DSCP: 46, ECN: ECNECT1}))
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer sender.Close()
+	if err := rs.AttachFilter(FilterSpec{LocalIP: lo, LocalPort: local, RemoteIP: lo, RemotePort: remote}); err != nil {
+		t.Fatal(err)
+	}
+
+	sends := []struct {
+		fields   HeaderFields
+		ttl, tos uint8
+	}{
+		{HeaderFields{}, 9, 46<<2 | ECNECT1},
+		{HeaderFields{TTL: 200, TOS: ECNCE}, 200, 46<<2 | ECNCE},
+		{HeaderFields{TOS: 8 << 2}, 9, 8<<2 | ECNECT1},
+	}
+	for i, s := range sends {
+		if err := sender.SendPacketFields(s.fields, lo, remote, lo, local, uint32(i+1), 0, 0x18, nil, []byte("mark")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs.SetReadTimeout(0, 200000)
+	buf := make([]byte, 2048)
+	for i, s := range sends {
+		if _, err := rs.recv(buf); err != nil {
+			t.Fatal(err)
+		}
+		if ttl, tos := buf[8], buf[1]; ttl != s.ttl || tos != s.tos {
+			t.Errorf("packet %d has TTL %d TOS %#x, want %d and %#x", i, ttl, tos, s.ttl, s.tos)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package rawsocket
+
+// Option configures NewRawSocket
+type Option func(*socketOptions)
+
+type socketOptions struct {
+	netns   string
+	ring    *RingConfig
+	ipid    IPIDStrategy
+	marking Marking
+}
+
+// JoinNetNS creates the socket in the network namespace at path (see
+// netns.Path), e.g. the host's /proc/1/ns/net bind-mounted into a container.
+// The socket sends and receives there for its lifetime; binding and routing
+// follow that namespace's addresses and routes.
+func JoinNetNS(path string) Option {
+	return func(o *socketOptions) {
+		o.netns = path
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"net"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
 )
 
 const (
@@ -30,21 +34,49 @@ type RawSocket struct {
 	remoteIP   net.IP
 	remotePort uint16
 	isServer   bool
+	ipv6       bool // AF_INET6 socket (see ipv6.go)
+
+	ipid        IPIDStrategy  // Numbers IPv4 packets (nil = the shared per-flow counter)
+	marking     Marking       // TTL and TOS of packets that do not set their own
+	ring        *packetRing   // Receive ring replacing recvfrom (see ring.go)
+	readTimeout time.Duration // SetReadTimeout, for the ring
+	batchBuf    []byte        // RecvBatch without a ring
 }
 
-// NewRawSocket creates a new raw socket
-func NewRawSocket(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isServer bool) (*RawSocket, error) {
+// NewRawSocket creates a new raw socket, for IPv6 if localIP or remoteIP
+// is an IPv6 address
+func NewRawSocket(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16, isServer bool, opts ...Option) (*RawSocket, error) {
+	var o socketOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ipv6 := IsIPv6(localIP) || IsIPv6(remoteIP)
+	family := syscall.AF_INET
+	if ipv6 {
+		family = syscall.AF_INET6
+	}
+
 	// Create raw socket (IPPROTO_RAW for sending, IPPROTO_TCP for receiving)
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	fd := -1
+	err := netns.Do(o.netns, func() error {
+		var err error
+		fd, err = syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create raw socket: %v (需要root权限)", err)
 	}
 
 	// Set IP_HDRINCL to indicate we will provide IP header
-	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1)
+	if ipv6 {
+		err = setupIPv6(fd)
+	} else if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1); err != nil {
+		err = fmt.Errorf("failed to set IP_HDRINCL: %v", err)
+	}
 	if err != nil {
 		syscall.Close(fd)
-		return nil, fmt.Errorf("failed to set IP_HDRINCL: %v", err)
+		return nil, err
 	}
 
 	// Set socket to non-blocking mode for better control
@@ -53,19 +85,27 @@ func NewRawSocket(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort
 		return nil, fmt.Errorf("failed to set non-blocking: %v", err)
 	}
 
-	// Increase socket buffers to 16MB to handle high-throughput bursts (e.g. FEC batches)
-	// Ignore errors as some systems might restrict max buffer size
-	_ = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 16*1024*1024)
-	_ = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 16*1024*1024)
+	// Increase socket buffers to 16MB to handle high-throughput bursts (e.g. FEC batches)
+	// Ignore errors as some systems might restrict max buffer size
+	_ = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 16*1024*1024)
+	_ = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 16*1024*1024)
 
 	// Bind to local address if server
 	if isServer && localIP != nil {
-		addr := syscall.SockaddrInet4{
-			Port: int(localPort),
+		var addr syscall.Sockaddr
+		if ipv6 {
+			addr6 := &syscall.SockaddrInet6{}
+			copy(addr6.Addr[:], localIP.To16())
+			addr = addr6
+		} else {
+			addr4 := &syscall.SockaddrInet4{
+				Port: int(localPort),
+			}
+			copy(addr4.Addr[:], localIP.To4())
+			addr = addr4
 		}
-		copy(addr.Addr[:], localIP.To4())
 		
-		if err := syscall.Bind(fd, &addr); err != nil {
+		if err := syscall.Bind(fd, addr); err != nil {
 			syscall.Close(fd)
 			return nil, fmt.Errorf("failed to bind socket: %v", err)
 		}
@@ -78,202 +118,172 @@ func NewRawSocket(localIP net.IP, localPort uint16, remoteIP net.IP, remotePort
 		remoteIP:   remoteIP,
 		remotePort: remotePort,
 		isServer:   isServer,
+		ipv6:       ipv6,
+		ipid:       o.ipid,
+		marking:    o.marking,
+	}
+
+	if o.ring != nil {
+		if rs.ring, err = newPacketRing(*o.ring, ipv6, o.netns); err == nil {
+			// The ring receives; this socket only sends
+			err = attachFilter(fd, []syscall.SockFilter{{Code: bpfRet, K: 0}})
+		}
+		if err != nil {
+			rs.Close()
+			return nil, err
+		}
 	}
 
 	return rs, nil
 }
 
-// BuildIPHeader constructs an IPv4 header
-func BuildIPHeader(srcIP, dstIP net.IP, protocol uint8, payloadLen int) []byte {
-	header := make([]byte, IPHeaderSize)
-
-	// Version (4 bits) + IHL (4 bits)
-	header[0] = 0x45 // Version 4, IHL 5 (20 bytes)
-
-	// Type of Service
-	header[1] = 0
-
-	// Total Length
-	totalLen := IPHeaderSize + payloadLen
-	binary.BigEndian.PutUint16(header[2:4], uint16(totalLen))
-
-	// Identification (can be random or incremental)
-	binary.BigEndian.PutUint16(header[4:6], uint16(12345)) // Simple ID
-
-	// Flags (3 bits) + Fragment Offset (13 bits)
-	binary.BigEndian.PutUint16(header[6:8], IP_DF) // Don't fragment
-
-	// TTL
-	header[8] = 64
+// NewRawSocketFromFD wraps a raw socket inherited from another process. The
+// socket must have been created by NewRawSocket with the same local address.
+func NewRawSocketFromFD(fd int, localIP net.IP, localPort uint16, isServer bool) *RawSocket {
+	return &RawSocket{
+		fd:        fd,
+		localIP:   localIP,
+		localPort: localPort,
+		isServer:  isServer,
+		ipv6:      IsIPv6(localIP),
+	}
+}
 
-	// Protocol
-	header[9] = protocol
+// DefaultTTL and DefaultWindow are the header values SendPacket uses
+const (
+	DefaultTTL    = 64
+	DefaultWindow = 65535
+)
 
-	// Checksum (will be calculated later)
-	header[10] = 0
-	header[11] = 0
+// HeaderFields are IP and TCP header values chosen per packet. Zero fields
+// take the sending socket's Marking, then DefaultTTL and DefaultWindow.
+type HeaderFields struct {
+	TTL       uint8
+	TOS       uint8  // Type of service byte: DSCP and the ECN bits (ECT0, CE)
+	Window    uint16 // As written in the header, i.e. after window scaling
+	ID        uint16 // IPv4 Identification; when 0 the sending socket's IPIDStrategy picks it
+	IPOptions []byte // Appended to the IP header: a multiple of 4 bytes, at most MaxIPOptionsSize
+}
 
-	// Source IP
-	copy(header[12:16], srcIP.To4())
+// MaxIPOptionsSize is the most option bytes an IPv4 header can hold
+const MaxIPOptionsSize = 40
 
-	// Destination IP
-	copy(header[16:20], dstIP.To4())
+// ECN codepoints in the low bits of the type of service byte
+const (
+	ECNMask = 0x03
+	ECNECT1 = 0x01
+	ECNECT0 = 0x02
+	ECNCE   = 0x03
+)
 
-	// Calculate and set checksum
-	checksum := CalculateChecksum(header)
-	binary.BigEndian.PutUint16(header[10:12], checksum)
+// BuildIPHeader constructs an IPv4 header
+func BuildIPHeader(srcIP, dstIP net.IP, protocol uint8, payloadLen int) []byte {
+	return buildIPHeader(srcIP, dstIP, protocol, payloadLen, DefaultTTL, 0, RandomIPID{}.NextID(srcIP, dstIP, 0, 0), nil)
+}
 
+func buildIPHeader(srcIP, dstIP net.IP, protocol uint8, payloadLen int, ttl, tos uint8, id uint16, options []byte) []byte {
+	header := make([]byte, IPHeaderSize+len(options))
+	putIPHeader(header, srcIP, dstIP, protocol, payloadLen, ttl, tos, id, options)
 	return header
 }
 
 // BuildTCPHeader constructs a TCP header
 func BuildTCPHeader(srcPort, dstPort uint16, seq, ack uint32, flags uint8, window uint16, options []byte) []byte {
-	// Calculate header length including options
-	optLen := len(options)
 	// Pad options to 4-byte boundary
-	if optLen%4 != 0 {
-		padding := 4 - (optLen % 4)
-		options = append(options, make([]byte, padding)...)
-		optLen = len(options)
-	}
-
-	headerLen := TCPHeaderSize + optLen
-	header := make([]byte, headerLen)
-
-	// Source port
-	binary.BigEndian.PutUint16(header[0:2], srcPort)
-
-	// Destination port
-	binary.BigEndian.PutUint16(header[2:4], dstPort)
-
-	// Sequence number
-	binary.BigEndian.PutUint32(header[4:8], seq)
-
-	// Acknowledgment number
-	binary.BigEndian.PutUint32(header[8:12], ack)
-
-	// Data offset (4 bits) + Reserved (4 bits)
-	dataOffset := uint8(headerLen / 4)
-	header[12] = dataOffset << 4
-
-	// Flags
-	header[13] = flags
-
-	// Window size
-	binary.BigEndian.PutUint16(header[14:16], window)
-
-	// Checksum (will be calculated later)
-	header[16] = 0
-	header[17] = 0
-
-	// Urgent pointer
-	header[18] = 0
-	header[19] = 0
-
-	// Options
-	if optLen > 0 {
-		copy(header[TCPHeaderSize:], options)
-	}
-
+	optLen := (len(options) + 3) &^ 3
+	header := make([]byte, TCPHeaderSize+optLen)
+	putTCPHeader(header, srcPort, dstPort, seq, ack, flags, window, options, optLen)
 	return header
 }
 
-// CalculateTCPChecksum calculates TCP checksum with pseudo header
+// CalculateTCPChecksum calculates TCP checksum with pseudo header, that of
+// IPv6 for IPv6 addresses
 func CalculateTCPChecksum(srcIP, dstIP net.IP, tcpHeader, payload []byte) uint16 {
-	// Build pseudo header
-	pseudoHeader := make([]byte, 12)
-	copy(pseudoHeader[0:4], srcIP.To4())
-	copy(pseudoHeader[4:8], dstIP.To4())
-	pseudoHeader[8] = 0
-	pseudoHeader[9] = IPPROTO_TCP
-	tcpLen := len(tcpHeader) + len(payload)
-	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(tcpLen))
-
-	// Combine pseudo header + TCP header + payload
-	data := make([]byte, len(pseudoHeader)+len(tcpHeader)+len(payload))
-	copy(data[0:], pseudoHeader)
-	copy(data[len(pseudoHeader):], tcpHeader)
-	copy(data[len(pseudoHeader)+len(tcpHeader):], payload)
-
-	return CalculateChecksum(data)
+	var c Checksum
+	c.AddPseudoHeader(srcIP, dstIP, IPPROTO_TCP, len(tcpHeader)+len(payload))
+	c.Add(tcpHeader)
+	c.Add(payload)
+	return c.Final()
 }
 
 // CalculateChecksum calculates Internet checksum
 func CalculateChecksum(data []byte) uint16 {
-	var sum uint32
-
-	// Add 16-bit words
-	for i := 0; i < len(data)-1; i += 2 {
-		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
-	}
-
-	// Add odd byte if present
-	if len(data)%2 == 1 {
-		sum += uint32(data[len(data)-1]) << 8
-	}
-
-	// Fold 32-bit sum to 16 bits
-	for sum>>16 != 0 {
-		sum = (sum & 0xFFFF) + (sum >> 16)
-	}
-
-	// Return one's complement
-	return ^uint16(sum)
+	return ^uint16(sumWords(data))
 }
 
 // SendPacket sends a raw IP packet with TCP header and payload
 func (rs *RawSocket) SendPacket(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, 
 	seq, ack uint32, flags uint8, tcpOptions, payload []byte) error {
+	return rs.SendPacketFields(HeaderFields{}, srcIP, srcPort, dstIP, dstPort, seq, ack, flags, tcpOptions, payload)
+}
 
-	// Build TCP header (without checksum)
-	tcpHeader := BuildTCPHeader(srcPort, dstPort, seq, ack, flags, 65535, tcpOptions)
-
-	// Calculate TCP checksum
-	checksum := CalculateTCPChecksum(srcIP, dstIP, tcpHeader, payload)
-	binary.BigEndian.PutUint16(tcpHeader[16:18], checksum)
-
-	// Build IP header
-	ipHeader := BuildIPHeader(srcIP, dstIP, IPPROTO_TCP, len(tcpHeader)+len(payload))
+// SendPacketFields is SendPacket with the TTL, TOS and window taken from fields
+func (rs *RawSocket) SendPacketFields(fields HeaderFields, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, tcpOptions, payload []byte) error {
+	b := GetPacketBuilder()
+	defer PutPacketBuilder(b)
+	return rs.SendPacketInto(b, fields, srcIP, srcPort, dstIP, dstPort, seq, ack, flags, tcpOptions, payload)
+}
 
-	// Combine IP header + TCP header + payload
-	packet := make([]byte, len(ipHeader)+len(tcpHeader)+len(payload))
-	copy(packet[0:], ipHeader)
-	copy(packet[len(ipHeader):], tcpHeader)
-	copy(packet[len(ipHeader)+len(tcpHeader):], payload)
+// RecvPacket receives a raw IP packet and extracts TCP header and payload
+func (rs *RawSocket) RecvPacket(buf []byte) (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+	seq, ack uint32, flags uint8, payload []byte, err error) {
 
-	// Send packet
-	addr := syscall.SockaddrInet4{
-		Port: 0, // Port is in TCP header
+	n, err := rs.recv(buf)
+	if err != nil {
+		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("failed to receive packet: %v", err)
 	}
-	copy(addr.Addr[:], dstIP.To4())
+	return ParsePacket(buf[:n])
+}
 
-	err := syscall.Sendto(rs.fd, packet, 0, &addr)
-	if err != nil {
-		return fmt.Errorf("failed to send packet: %v", err)
+// recv receives a packet into buf, from the ring if there is one
+func (rs *RawSocket) recv(buf []byte) (n int, err error) {
+	switch {
+	case rs.ring != nil:
+		var pkt []byte
+		if pkt, err = rs.ring.packet(rs.readTimeout); err == nil {
+			n = copy(buf, pkt)
+		}
+	case rs.ipv6:
+		n, err = rs.recvIPv6(buf)
+	default:
+		n, _, err = syscall.Recvfrom(rs.fd, buf, 0)
 	}
+	if err == nil && capture.Outer.Active() && rs.isLocalDestination(buf[:n]) {
+		capture.Outer.Packet(buf[:n])
+	}
+	return n, err
+}
 
-	return nil
+// isLocalDestination reports whether a received TCP packet is addressed to
+// this socket's port; a raw socket sees every TCP packet on the host
+func (rs *RawSocket) isLocalDestination(pkt []byte) bool {
+	ihl := ipHeaderLen(pkt)
+	return ihl > 0 && len(pkt) >= ihl+4 && binary.BigEndian.Uint16(pkt[ihl+2:]) == rs.localPort
 }
 
-// RecvPacket receives a raw IP packet and extracts TCP header and payload
-func (rs *RawSocket) RecvPacket(buf []byte) (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
+// ParsePacket extracts the TCP header fields and a copy of the payload from an IPv4 or IPv6 packet.
+// Trailing bytes beyond the IP total length (e.g. Ethernet padding) are ignored.
+func ParsePacket(pkt []byte) (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16,
 	seq, ack uint32, flags uint8, payload []byte, err error) {
 
-	n, _, err := syscall.Recvfrom(rs.fd, buf, 0)
-	if err != nil {
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("failed to receive packet: %v", err)
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		return parsePacketIPv6(pkt)
 	}
-
+	n := len(pkt)
 	if n < IPHeaderSize+TCPHeaderSize {
 		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small: %d bytes", n)
 	}
 
 	// Parse IP header
-	ipHeader := buf[:IPHeaderSize]
+	ipHeader := pkt[:IPHeaderSize]
 	ihl := (ipHeader[0] & 0x0F) * 4
 	if int(ihl) > n {
 		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("invalid IP header length")
 	}
+	if totalLen := int(binary.BigEndian.Uint16(ipHeader[2:4])); totalLen >= int(ihl) && totalLen < n {
+		n = totalLen
+	}
 
 	protocol := ipHeader[9]
 	if protocol != IPPROTO_TCP {
@@ -283,50 +293,105 @@ func (rs *RawSocket) RecvPacket(buf []byte) (srcIP net.IP, srcPort uint16, dstIP
 	srcIP = net.IPv4(ipHeader[12], ipHeader[13], ipHeader[14], ipHeader[15])
 	dstIP = net.IPv4(ipHeader[16], ipHeader[17], ipHeader[18], ipHeader[19])
 
-	// Parse TCP header
-	tcpStart := int(ihl)
-	if n < tcpStart+TCPHeaderSize {
-		return nil, 0, nil, 0, 0, 0, 0, nil, fmt.Errorf("packet too small for TCP header")
+	srcPort, dstPort, seq, ack, flags, payload, err = parseSegment(pkt[ihl:n])
+	if err != nil {
+		return nil, 0, nil, 0, 0, 0, 0, nil, err
 	}
+	return srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, nil
+}
 
-	tcpHeader := buf[tcpStart : tcpStart+TCPHeaderSize]
+// parseSegment extracts the header fields and a copy of the payload from a
+// TCP segment
+func parseSegment(seg []byte) (srcPort, dstPort uint16, seq, ack uint32, flags uint8, payload []byte, err error) {
+	if len(seg) < TCPHeaderSize {
+		return 0, 0, 0, 0, 0, nil, fmt.Errorf("packet too small for TCP header")
+	}
+
+	tcpHeader := seg[:TCPHeaderSize]
 	srcPort = binary.BigEndian.Uint16(tcpHeader[0:2])
 	dstPort = binary.BigEndian.Uint16(tcpHeader[2:4])
 	seq = binary.BigEndian.Uint32(tcpHeader[4:8])
 	ack = binary.BigEndian.Uint32(tcpHeader[8:12])
-	dataOffset := (tcpHeader[12] >> 4) * 4
+	dataOffset := int(tcpHeader[12]>>4) * 4
 	flags = tcpHeader[13]
 
 	// Extract payload
-	payloadStart := tcpStart + int(dataOffset)
-	if payloadStart < n {
-		payload = make([]byte, n-payloadStart)
-		copy(payload, buf[payloadStart:n])
+	if dataOffset < len(seg) {
+		payload = make([]byte, len(seg)-dataOffset)
+		copy(payload, seg[dataOffset:])
 	}
 
-	return srcIP, srcPort, dstIP, dstPort, seq, ack, flags, payload, nil
+	return srcPort, dstPort, seq, ack, flags, payload, nil
+}
+
+// ParseMSSOption returns the MSS option carried in the TCP header of an IP
+// packet, or 0 if the packet is malformed or does not carry one.
+func ParseMSSOption(pkt []byte) int {
+	if opt := findTCPOption(pkt, TCPOptMSS, 4); opt != nil {
+		return int(binary.BigEndian.Uint16(opt[2:4]))
+	}
+	return 0
+}
+
+// ParseTimestampOption returns the TSval of the timestamp option carried in
+// the TCP header of an IP packet; ok is false if there is none.
+func ParseTimestampOption(pkt []byte) (tsval uint32, ok bool) {
+	if opt := findTCPOption(pkt, TCPOptTimestamp, 10); opt != nil {
+		return binary.BigEndian.Uint32(opt[2:6]), true
+	}
+	return 0, false
+}
+
+// findTCPOption returns the TCP option of the given kind and length, or nil
+// if the packet is malformed or does not carry it
+func findTCPOption(pkt []byte, kind, length byte) []byte {
+	tcpStart := ipHeaderLen(pkt)
+	if tcpStart == 0 || len(pkt) < tcpStart+TCPHeaderSize {
+		return nil
+	}
+	tcpEnd := tcpStart + int(pkt[tcpStart+12]>>4)*4
+	if tcpEnd > len(pkt) {
+		return nil
+	}
+
+	opts := pkt[tcpStart+TCPHeaderSize : tcpEnd]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0: // End of option list
+			return nil
+		case 1: // NOP
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return nil
+		}
+		if opts[i] == kind && opts[i+1] == length {
+			return opts[i : i+int(length)]
+		}
+		i += int(opts[i+1])
+	}
+	return nil
 }
 
 // SetReadTimeout sets read timeout for the socket
 func (rs *RawSocket) SetReadTimeout(sec, usec int64) error {
-	tv := syscall.Timeval{
-		Sec:  sec,
-		Usec: usec,
-	}
+	tv := syscall.NsecToTimeval(sec*1e9 + usec*1e3)
+	rs.readTimeout = time.Duration(tv.Nano())
 	return syscall.SetsockoptTimeval(rs.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
 }
 
 // SetWriteTimeout sets write timeout for the socket
 func (rs *RawSocket) SetWriteTimeout(sec, usec int64) error {
-	tv := syscall.Timeval{
-		Sec:  sec,
-		Usec: usec,
-	}
+	tv := syscall.NsecToTimeval(sec*1e9 + usec*1e3)
 	return syscall.SetsockoptTimeval(rs.fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
 }
 
 // Close closes the raw socket
 func (rs *RawSocket) Close() error {
+	if rs.ring != nil {
+		rs.ring.close()
+	}
 	return syscall.Close(rs.fd)
 }
 
@@ -0,0 +1,293 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
+)
+
+// At high packet rates a recvfrom per packet on the SOCK_RAW socket keeps a
+// core busy with system calls and copies. With the PacketRing option packets
+// are received through an AF_PACKET socket instead, whose TPACKET_V3 ring is
+// shared with the kernel: it fills blocks of packets and hands each over when
+// it is full or BlockTimeout has passed, and one poll covers a whole block.
+// RecvBatch reads packets in place in the ring; RecvPacket still copies them
+// into the caller's buffer. The SOCK_RAW socket only sends then; a filter
+// dropping everything keeps it from queueing the packets a second time.
+//
+// The AF_PACKET socket sees every IP packet of the interface, so it always
+// has a filter letting only TCP through, narrowed further by AttachFilter.
+// Packets the host sends are skipped.
+
+// TPACKET_V3 constants missing from package syscall
+const (
+	packetVersion        = 10 // PACKET_VERSION
+	packetIgnoreOutgoing = 23 // PACKET_IGNORE_OUTGOING (Linux 4.20)
+	tpacketV3            = 2
+	tpStatusUser         = 1 // TP_STATUS_USER: the block belongs to us
+	tpStatusKernel       = 0
+
+	tpacket3HdrLen = 48 // TPACKET_ALIGN(sizeof(struct tpacket3_hdr))
+	pollIn         = 0x1
+	pollErr        = 0x8
+)
+
+// Ring defaults
+const (
+	defaultRingBlockSize    = 256 << 10
+	defaultRingBlocks       = 32
+	defaultRingBlockTimeout = time.Millisecond
+	ringFrameSize           = 2048
+)
+
+// RingConfig sizes the receive ring of the PacketRing option. Zero fields take
+// the defaults: 32 blocks of 256 KiB handed over after at most 1ms.
+type RingConfig struct {
+	Interface    string        // Receive on this interface only (empty = all)
+	BlockSize    int           // Bytes per block, a multiple of the page size
+	Blocks       int           // Blocks in the ring, which takes BlockSize*Blocks of kernel memory
+	BlockTimeout time.Duration // How long a block fills before it is handed over partly full; adds that much latency at low rates
+}
+
+// PacketRing receives through an AF_PACKET TPACKET_V3 mmap ring instead of the
+// SOCK_RAW socket (see RecvBatch)
+func PacketRing(cfg RingConfig) Option {
+	return func(o *socketOptions) {
+		o.ring = &cfg
+	}
+}
+
+// packetRing is the receive ring of a RawSocket; it is not safe for
+// concurrent use
+type packetRing struct {
+	fd        int
+	mem       []byte
+	blockSize int
+	blocks    int
+	block     int  // Block being read
+	open      bool // The block is ours and next/left are valid
+	next      int  // Offset of the next packet in the block
+	left      int  // Packets left in the block
+}
+
+// htons converts a protocol number to network byte order as sockaddr_ll and
+// socket(2) expect it
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
+
+// newPacketRing opens an AF_PACKET socket with a receive ring for IPv4 or,
+// if ipv6, IPv6 packets, in the network namespace at nsPath
+func newPacketRing(cfg RingConfig, ipv6 bool, nsPath string) (*packetRing, error) {
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = defaultRingBlockSize
+	}
+	if cfg.Blocks <= 0 {
+		cfg.Blocks = defaultRingBlocks
+	}
+	if cfg.BlockTimeout <= 0 {
+		cfg.BlockTimeout = defaultRingBlockTimeout
+	}
+	if cfg.BlockSize%syscall.Getpagesize() != 0 || cfg.BlockSize < ringFrameSize {
+		return nil, fmt.Errorf("ring block size %d is not a multiple of the page size", cfg.BlockSize)
+	}
+	proto := uint16(syscall.ETH_P_IP)
+	if ipv6 {
+		proto = syscall.ETH_P_IPV6
+	}
+
+	fd, ifindex := -1, 0
+	err := netns.Do(nsPath, func() error {
+		if cfg.Interface != "" {
+			iface, err := net.InterfaceByName(cfg.Interface)
+			if err != nil {
+				return err
+			}
+			ifindex = iface.Index
+		}
+		var err error
+		fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(proto)))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create packet socket: %v", err)
+	}
+	r := &packetRing{fd: fd, blockSize: cfg.BlockSize, blocks: cfg.Blocks}
+	if err := r.setup(cfg, ipv6, proto, ifindex); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *packetRing) setup(cfg RingConfig, ipv6 bool, proto uint16, ifindex int) error {
+	// Only TCP from the start; the socket receives as soon as it exists
+	if err := r.attachFilter(FilterSpec{}, ipv6); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(r.fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return fmt.Errorf("TPACKET_V3 not supported: %v", err)
+	}
+	_ = syscall.SetsockoptInt(r.fd, syscall.SOL_PACKET, packetIgnoreOutgoing, 1) // Packets are checked too
+
+	req := struct {
+		blockSize, blockNr, frameSize, frameNr uint32
+		retireBlkTov, sizeofPriv, featureReq   uint32
+	}{
+		blockSize:    uint32(cfg.BlockSize),
+		blockNr:      uint32(cfg.Blocks),
+		frameSize:    ringFrameSize,
+		frameNr:      uint32(cfg.BlockSize / ringFrameSize * cfg.Blocks),
+		retireBlkTov: uint32(max(cfg.BlockTimeout/time.Millisecond, 1)),
+	}
+	if err := setsockopt(r.fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return fmt.Errorf("failed to set up receive ring: %v", err)
+	}
+	mem, err := syscall.Mmap(r.fd, 0, cfg.BlockSize*cfg.Blocks, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to map receive ring: %v", err)
+	}
+	r.mem = mem
+
+	if err := syscall.Bind(r.fd, &syscall.SockaddrLinklayer{Protocol: htons(proto), Ifindex: ifindex}); err != nil {
+		return fmt.Errorf("failed to bind packet socket: %v", err)
+	}
+	return nil
+}
+
+func (r *packetRing) attachFilter(spec FilterSpec, ipv6 bool) error {
+	prog, err := compileFilter(spec, ipv6, true)
+	if err != nil {
+		return err
+	}
+	return attachFilter(r.fd, prog)
+}
+
+// blockStatus returns the status word of the current block, shared with the
+// kernel
+func (r *packetRing) blockStatus() *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.mem[r.block*r.blockSize+8]))
+}
+
+// release hands the current block back to the kernel and moves to the next
+func (r *packetRing) release() {
+	atomic.StoreUint32(r.blockStatus(), tpStatusKernel)
+	r.block = (r.block + 1) % r.blocks
+	r.open = false
+}
+
+// packet returns the next packet received, from the network header on, as a
+// slice of the ring valid until the next call. It waits up to timeout for
+// one (0 = no limit) and then fails with EAGAIN like a timed out recvfrom.
+func (r *packetRing) packet(timeout time.Duration) ([]byte, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		if pkt, ok := r.take(); ok {
+			return pkt, nil
+		}
+		if r.open {
+			r.release()
+		}
+		if atomic.LoadUint32(r.blockStatus())&tpStatusUser == 0 {
+			if err := r.wait(deadline); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		base := r.block * r.blockSize
+		r.left = int(binary.NativeEndian.Uint32(r.mem[base+12:]))
+		r.next = base + int(binary.NativeEndian.Uint32(r.mem[base+16:]))
+		r.open = true
+	}
+}
+
+// take returns the next packet of the block being read, skipping those the
+// host sent, or false when the block is used up
+func (r *packetRing) take() ([]byte, bool) {
+	for r.open && r.left > 0 {
+		hdr := r.mem[r.next:]
+		r.left--
+		r.next += int(binary.NativeEndian.Uint32(hdr[0:4]))
+		if hdr[tpacket3HdrLen+10] == syscall.PACKET_OUTGOING { // sockaddr_ll.sll_pkttype
+			continue
+		}
+		snaplen := int(binary.NativeEndian.Uint32(hdr[12:16]))
+		netOff := int(binary.NativeEndian.Uint16(hdr[26:28]))
+		return hdr[netOff : netOff+snaplen], true
+	}
+	return nil, false
+}
+
+// wait polls until a block is handed over or the deadline passes
+func (r *packetRing) wait(deadline time.Time) error {
+	pfd := struct {
+		fd              int32
+		events, revents int16
+	}{fd: int32(r.fd), events: pollIn | pollErr}
+	var ts *syscall.Timespec
+	if !deadline.IsZero() {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return syscall.EAGAIN
+		}
+		t := syscall.NsecToTimespec(left.Nanoseconds())
+		ts = &t
+	}
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(ts)), 0, 0, 0)
+	switch {
+	case errno == syscall.EINTR:
+		return nil
+	case errno != 0:
+		return errno
+	case n == 0:
+		return syscall.EAGAIN
+	}
+	return nil
+}
+
+func (r *packetRing) close() error {
+	if r.mem != nil {
+		syscall.Munmap(r.mem)
+		r.mem = nil
+	}
+	return syscall.Close(r.fd)
+}
+
+// RecvBatch calls fn for the packets received, IP header first, without
+// copying them: fn must not keep pkt. It waits for the first packet up to the
+// read timeout, then passes on those already received, a ring block at a time,
+// and returns how many it passed. Without a packet ring it receives one packet.
+func (rs *RawSocket) RecvBatch(fn func(pkt []byte)) (int, error) {
+	if rs.ring == nil {
+		if rs.batchBuf == nil {
+			rs.batchBuf = make([]byte, 65536)
+		}
+		n, err := rs.recv(rs.batchBuf)
+		if err != nil {
+			return 0, fmt.Errorf("failed to receive packet: %v", err)
+		}
+		fn(rs.batchBuf[:n])
+		return 1, nil
+	}
+
+	pkt, err := rs.ring.packet(rs.readTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to receive packet: %v", err)
+	}
+	fn(pkt)
+	count := 1
+	for pkt, ok := rs.ring.take(); ok; pkt, ok = rs.ring.take() {
+		fn(pkt)
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,71 @@
+package rawsocket
+
+import (
+	"net"
+	"testing"
+)
+
+// TestPacketRing receives segments over loopback through a receive ring, one
+// with RecvPacket and the rest in a batch, and checks that the flow filter
+// applies to the ring
+func TestPacketRing(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1)
+	const local, remote = 47011, 47012
+	rs, err := NewRawSocket(lo, local, lo, remote, false, PacketRing(RingConfig{Interface: "lo", BlockSize: 1 << 16, Blocks: 4}))
+	if err != nil {
+		t.Skipf("packet ring unavailable: %v", err)
+	}
+	defer rs.Close()
+	sender, err := NewRawSocket(lo, remote, lo, local, false)
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer sender.Close()
+
+	if err := rs.AttachFilter(FilterSpec{LocalIP: lo, LocalPort: local, RemoteIP: lo, RemotePort: remote}); err != nil {
+		t.Fatal(err)
+	}
+	rs.SetReadTimeout(0, 1000)
+	for {
+		if _, err := rs.RecvBatch(func([]byte) {}); err != nil {
+			break
+		}
+	}
+
+	send := func(srcPort, dstPort uint16, seq uint32) {
+		if err := sender.SendPacket(lo, srcPort, lo, dstPort, seq, 0, 0x18, nil, []byte("ring")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(remote, local+10, 1)
+	for seq := uint32(2); seq <= 5; seq++ {
+		send(remote, local, seq)
+	}
+
+	rs.SetReadTimeout(0, 200000)
+	buf := make([]byte, 2048)
+	_, srcPort, _, dstPort, seq, _, _, payload, err := rs.RecvPacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcPort != remote || dstPort != local || seq != 2 || string(payload) != "ring" {
+		t.Fatalf("received %d:%d seq %d %q, want %d:%d seq 2", srcPort, dstPort, seq, payload, remote, local)
+	}
+
+	got := []uint32{}
+	for len(got) < 3 {
+		_, err := rs.RecvBatch(func(pkt []byte) {
+			_, srcPort, _, dstPort, seq, _, _, _, err := ParsePacket(pkt)
+			if err != nil || srcPort != remote || dstPort != local {
+				t.Errorf("unexpected packet %d:%d (%v)", srcPort, dstPort, err)
+			}
+			got = append(got, seq)
+		})
+		if err != nil {
+			break
+		}
+	}
+	if len(got) != 3 || got[0] != 3 || got[2] != 5 {
+		t.Fatalf("batches received segments %v, want [3 4 5]", got)
+	}
+}
@@ -0,0 +1,101 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// Real TCP stacks put options in every SYN (MSS, window scale, SACK
+// permitted, timestamps) and timestamps in every later segment, so a bare
+// 20-byte header stands out. TCPOptions serializes them from a list of option
+// kinds, in the order a stack sends them; NOP and EOL kinds in the list are
+// written as they are, which is how stacks align their options.
+
+// TCP option kinds
+const (
+	TCPOptEOL       = 0
+	TCPOptNOP       = 1
+	TCPOptMSS       = 2
+	TCPOptWScale    = 3
+	TCPOptSACKPerm  = 4
+	TCPOptTimestamp = 8
+)
+
+var (
+	// LinuxSynOptions is the option layout of a Linux SYN and SYN-ACK
+	LinuxSynOptions = []byte{TCPOptMSS, TCPOptSACKPerm, TCPOptTimestamp, TCPOptNOP, TCPOptWScale}
+	// LinuxOptions is the option layout of later Linux segments
+	LinuxOptions = []byte{TCPOptNOP, TCPOptNOP, TCPOptTimestamp}
+)
+
+// TCPOptions are the values of the options a segment carries
+type TCPOptions struct {
+	MSS         uint16 // Maximum segment size announced in SYN and SYN-ACK
+	WindowScale uint8  // Shift count announced in SYN and SYN-ACK
+	TSval       uint32 // Sender's timestamp clock
+	TSecr       uint32 // Latest TSval received from the peer
+}
+
+// tsEpoch starts DefaultTCPOptions' timestamp clock at a random value, as
+// Linux since 4.10 does for each connection
+var tsEpoch = time.Now().Add(-time.Duration(rand.Uint32()%(1<<30)) * time.Millisecond)
+
+// DefaultTCPOptions returns plausible options for a path of the given MTU to
+// dstIP: the MSS that fills it, Linux's default window scale of 7 and a 1 kHz
+// timestamp clock. TSecr is left for the caller to echo.
+func DefaultTCPOptions(mtu int, dstIP net.IP) TCPOptions {
+	mss := min(max(mtu-HeaderSize(dstIP)-TCPHeaderSize, 536), 65535)
+	return TCPOptions{
+		MSS:         uint16(mss),
+		WindowScale: 7,
+		TSval:       uint32(time.Since(tsEpoch).Milliseconds()),
+	}
+}
+
+// Append appends the options listed in kinds to dst, unpadded
+func (o TCPOptions) Append(dst, kinds []byte) []byte {
+	for _, kind := range kinds {
+		switch kind {
+		case TCPOptMSS:
+			dst = binary.BigEndian.AppendUint16(append(dst, TCPOptMSS, 4), o.MSS)
+		case TCPOptWScale:
+			dst = append(dst, TCPOptWScale, 3, o.WindowScale)
+		case TCPOptSACKPerm:
+			dst = append(dst, TCPOptSACKPerm, 2)
+		case TCPOptTimestamp:
+			dst = append(dst, TCPOptTimestamp, 10)
+			dst = binary.BigEndian.AppendUint32(dst, o.TSval)
+			dst = binary.BigEndian.AppendUint32(dst, o.TSecr)
+		default:
+			dst = append(dst, kind)
+		}
+	}
+	return dst
+}
+
+// Build returns the options listed in kinds, unpadded
+func (o TCPOptions) Build(kinds []byte) []byte {
+	return o.Append(make([]byte, 0, TCPOptionsLen(kinds)), kinds)
+}
+
+// TCPOptionsLen returns the length of the options listed in kinds, unpadded
+func TCPOptionsLen(kinds []byte) int {
+	n := 0
+	for _, kind := range kinds {
+		switch kind {
+		case TCPOptMSS:
+			n += 4
+		case TCPOptWScale:
+			n += 3
+		case TCPOptSACKPerm:
+			n += 2
+		case TCPOptTimestamp:
+			n += 10
+		default:
+			n++
+		}
+	}
+	return n
+}
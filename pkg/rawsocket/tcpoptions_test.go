@@ -0,0 +1,44 @@
+package rawsocket
+
+import (
+	"net"
+	"testing"
+)
+
+// TestTCPOptions checks that built options have the listed length and parse
+// back from a packet, and that the default MSS fills the MTU
+func TestTCPOptions(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	o := DefaultTCPOptions(1500, dst)
+	if o.MSS != 1460 || o.WindowScale != 7 {
+		t.Errorf("IPv4 defaults: MSS %d scale %d, want 1460 and 7", o.MSS, o.WindowScale)
+	}
+	if mss := DefaultTCPOptions(1500, net.ParseIP("2001:db8::2")).MSS; mss != 1440 {
+		t.Errorf("IPv6 MSS %d, want 1440", mss)
+	}
+	if mss := DefaultTCPOptions(100, dst).MSS; mss != 536 {
+		t.Errorf("MSS on a tiny MTU %d, want 536", mss)
+	}
+
+	o.TSecr = 0x01020304
+	for _, kinds := range [][]byte{LinuxSynOptions, LinuxOptions} {
+		opts := o.Build(kinds)
+		if len(opts) != TCPOptionsLen(kinds) {
+			t.Fatalf("%v: %d option bytes, want %d", kinds, len(opts), TCPOptionsLen(kinds))
+		}
+		pkt, err := AppendPacket(nil, HeaderFields{}, src, 40000, dst, 443, 1, 0, 0x02, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tsval, ok := ParseTimestampOption(pkt); !ok || tsval != o.TSval {
+			t.Errorf("%v: TSval %d (%v), want %d", kinds, tsval, ok, o.TSval)
+		}
+		wantMSS := 0
+		if kinds[0] == TCPOptMSS {
+			wantMSS = 1460
+		}
+		if mss := ParseMSSOption(pkt); mss != wantMSS {
+			t.Errorf("%v: MSS %d, want %d", kinds, mss, wantMSS)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Reasons ValidatePacket and ValidateSegment reject a packet for. Checksum
+// errors on an otherwise well-formed packet usually point to a middlebox
+// rewriting it; inconsistent lengths and flags more often to a bug in the
+// sender.
+var (
+	ErrIPHeader    = errors.New("inconsistent IP header or total length")
+	ErrIPChecksum  = errors.New("bad IP header checksum")
+	ErrTCPHeader   = errors.New("inconsistent TCP data offset")
+	ErrTCPChecksum = errors.New("bad TCP checksum")
+	ErrTCPFlags    = errors.New("invalid TCP flag combination or urgent pointer")
+)
+
+// TCP flags checked by ValidFlags
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagACK = 0x10
+	flagURG = 0x20
+)
+
+// IP option kinds that take no length byte
+const (
+	ipOptEOL = 0
+	ipOptNOP = 1
+)
+
+// ValidatePacket checks an IPv4 packet carrying TCP: header and total
+// lengths, the layout of IP options, both checksums, the flag combination and
+// the urgent pointer; and the same but the IP checksum of an IPv6 packet. pkt
+// may be followed by unused buffer space.
+func ValidatePacket(pkt []byte) error {
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		return validatePacketIPv6(pkt)
+	}
+	if len(pkt) < IPHeaderSize || pkt[0]>>4 != 4 {
+		return ErrIPHeader
+	}
+	ihl := int(pkt[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if ihl < IPHeaderSize || total < ihl+TCPHeaderSize || total > len(pkt) || pkt[9] != IPPROTO_TCP {
+		return ErrIPHeader
+	}
+	if checksumSum(0, pkt[:ihl]) != 0xFFFF {
+		return ErrIPChecksum
+	}
+	if !validIPOptions(pkt[IPHeaderSize:ihl]) {
+		return ErrIPHeader
+	}
+
+	seg := pkt[ihl:total]
+	if err := ValidateSegment(seg); err != nil {
+		return err
+	}
+	var pseudo [12]byte
+	copy(pseudo[0:8], pkt[12:20])
+	pseudo[9] = IPPROTO_TCP
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(seg)))
+	if checksumSum(checksumSum(0, pseudo[:]), seg) != 0xFFFF {
+		return ErrTCPChecksum
+	}
+	return nil
+}
+
+// ValidateSegment checks the data offset, flags and urgent pointer of a TCP
+// segment without an IP header (UDP mode, whose fake checksums are not
+// verifiable). An urgent pointer without URG is sent by neither the tunnel nor
+// the stacks its personalities imitate, which all zero the field.
+func ValidateSegment(seg []byte) error {
+	if len(seg) < TCPHeaderSize {
+		return ErrTCPHeader
+	}
+	if off := int(seg[12]>>4) * 4; off < TCPHeaderSize || off > len(seg) {
+		return ErrTCPHeader
+	}
+	if !ValidFlags(seg[13]) {
+		return ErrTCPFlags
+	}
+	if seg[13]&flagURG == 0 && binary.BigEndian.Uint16(seg[18:20]) != 0 {
+		return ErrTCPFlags
+	}
+	return nil
+}
+
+// validIPOptions reports whether IPv4 options are well formed: single-byte
+// EOL and NOP, and kind-length-value options that fit in the header
+func validIPOptions(opts []byte) bool {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case ipOptEOL:
+			return true // The rest is padding
+		case ipOptNOP:
+			opts = opts[1:]
+		default:
+			if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+				return false
+			}
+			opts = opts[opts[1]:]
+		}
+	}
+	return true
+}
+
+// ValidFlags reports whether a TCP flag combination can occur in a real
+// connection: every segment but the first SYN and a RST acknowledges, and SYN,
+// FIN and RST exclude each other
+func ValidFlags(flags uint8) bool {
+	switch {
+	case flags&flagSYN != 0 && flags&(flagFIN|flagRST) != 0:
+		return false
+	case flags&flagFIN != 0 && flags&flagRST != 0:
+		return false
+	case flags&flagACK == 0 && flags&(flagSYN|flagRST) == 0:
+		return false
+	}
+	return true
+}
+
+// checksumSum adds data to a ones' complement sum; a header or segment whose
+// checksum is right sums to 0xFFFF
+func checksumSum(sum uint32, data []byte) uint32 {
+	return fold(uint64(sum) + uint64(sumWords(data)))
+}
@@ -0,0 +1,75 @@
+package rawsocket
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildTestPacket builds a packet the way SendPacketFields does
+func buildTestPacket(flags uint8, payload []byte) []byte {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	tcp := BuildTCPHeader(40000, 443, 1000, 2000, flags, DefaultWindow, []byte{1, 1, 1, 1})
+	binary.BigEndian.PutUint16(tcp[16:18], CalculateTCPChecksum(src, dst, tcp, payload))
+	pkt := buildIPHeader(src, dst, IPPROTO_TCP, len(tcp)+len(payload), DefaultTTL, 0, 0, nil)
+	return append(append(pkt, tcp...), payload...)
+}
+
+// TestValidatePacket checks that well-formed packets pass and each kind of
+// damage is reported as its own reason
+func TestValidatePacket(t *testing.T) {
+	payload := []byte("hello, tunnel")
+	if err := ValidatePacket(append(buildTestPacket(0x18, payload), 0, 0, 0)); err != nil {
+		t.Fatalf("valid packet rejected: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		damage func(pkt []byte) []byte
+		want   error
+	}{
+		{"payload byte", func(p []byte) []byte { p[len(p)-1] ^= 0x20; return p }, ErrTCPChecksum},
+		{"ttl", func(p []byte) []byte { p[8]--; return p }, ErrIPChecksum},
+		{"truncated", func(p []byte) []byte { return p[:len(p)-4] }, ErrIPHeader},
+		{"data offset", func(p []byte) []byte { p[IPHeaderSize+12] = 15 << 4; return p }, ErrTCPHeader},
+		{"syn fin", func(p []byte) []byte { p[IPHeaderSize+13] = 0x03; return p }, ErrTCPFlags},
+		{"null scan", func(p []byte) []byte { p[IPHeaderSize+13] = 0; return p }, ErrTCPFlags},
+		{"urgent pointer", func(p []byte) []byte { p[IPHeaderSize+19] = 1; return p }, ErrTCPFlags},
+	}
+	for _, c := range cases {
+		if err := ValidatePacket(c.damage(buildTestPacket(0x18, payload))); err != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	for _, flags := range []uint8{0x02, 0x12, 0x04, 0x14, 0x11, 0x10} {
+		if !ValidFlags(flags) {
+			t.Errorf("flags %#02x rejected", flags)
+		}
+	}
+}
+
+// TestIPOptions checks that IP options are carried in the header length and
+// checksum, and that options overrunning the header are rejected
+func TestIPOptions(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 2)
+	payload := []byte("hello, tunnel")
+	build := func(options []byte) []byte {
+		tcp := BuildTCPHeader(40000, 443, 1000, 2000, 0x18, DefaultWindow, nil)
+		binary.BigEndian.PutUint16(tcp[16:18], CalculateTCPChecksum(src, dst, tcp, payload))
+		pkt := buildIPHeader(src, dst, IPPROTO_TCP, len(tcp)+len(payload), DefaultTTL, 0, 0, options)
+		return append(append(pkt, tcp...), payload...)
+	}
+
+	pkt := build([]byte{1, 1, 1, 1, 1, 1, 1, 1})
+	if err := ValidatePacket(pkt); err != nil {
+		t.Fatalf("packet with NOP options rejected: %v", err)
+	}
+	_, _, _, _, _, _, _, got, err := ParsePacket(pkt)
+	if err != nil || string(got) != string(payload) {
+		t.Fatalf("parsed payload %q (%v), want %q", got, err, payload)
+	}
+	if err := ValidatePacket(build([]byte{1, 0x44, 8, 5})); err != ErrIPHeader {
+		t.Errorf("overrunning option: got %v, want %v", err, ErrIPHeader)
+	}
+}
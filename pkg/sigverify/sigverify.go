@@ -0,0 +1,129 @@
+// Package sigverify checks Ed25519 signatures of artifacts the program loads
+// or installs from outside its own binary: release binaries for -self-update
+// and anything loaded at run time later on. An artifact is accepted only if
+// one of the trusted keys signed it; keys are listed so that a new signing key
+// can be rolled out while releases signed with the old one still verify.
+//
+// The trusted keys are normally embedded at build time:
+//
+//	go build -ldflags "-X github.com/openbmx/lightweight-tunnel/pkg/sigverify.embeddedKeys=<base64 key>[,<base64 key>...]"
+//
+// A signature is the 64-byte Ed25519 signature of the artifact's contents,
+// raw or base64 encoded, conventionally stored next to it as <artifact>.sig.
+package sigverify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignatureSuffix is appended to an artifact's name to name its signature
+const SignatureSuffix = ".sig"
+
+// embeddedKeys are the base64 keys trusted by Embedded, separated by commas
+var embeddedKeys = ""
+
+var (
+	// ErrNoKeys is returned when there is no key to verify with; callers must
+	// treat it as a failed verification, not as a reason to skip it
+	ErrNoKeys = errors.New("no signing key configured")
+	// ErrMalformedSignature is returned for a signature that is neither 64
+	// raw bytes nor their base64 encoding
+	ErrMalformedSignature = errors.New("malformed signature")
+	// ErrBadSignature is returned when none of the keys signed the artifact
+	ErrBadSignature = errors.New("signature verification failed")
+)
+
+// Verifier checks signatures against a set of trusted keys
+type Verifier struct {
+	keys []ed25519.PublicKey
+}
+
+// ParseKeys returns a verifier trusting the base64 Ed25519 public keys in s,
+// separated by commas or white space
+func ParseKeys(s string) (*Verifier, error) {
+	v := &Verifier{}
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid signing key %q: expected base64 Ed25519 public key", field)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(key))
+	}
+	return v, nil
+}
+
+// Embedded returns a verifier trusting the keys embedded at build time
+func Embedded() (*Verifier, error) {
+	return ParseKeys(embeddedKeys)
+}
+
+// Load returns a verifier trusting keys, or the embedded keys if keys is
+// empty: the usual way to let a command line key override the built-in ones
+func Load(keys string) (*Verifier, error) {
+	if strings.TrimSpace(keys) == "" {
+		return Embedded()
+	}
+	return ParseKeys(keys)
+}
+
+// Keys returns the number of trusted keys
+func (v *Verifier) Keys() int {
+	return len(v.keys)
+}
+
+// ParseSignature decodes a signature stored raw or base64 encoded
+func ParseSignature(data []byte) ([]byte, error) {
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, ErrMalformedSignature
+	}
+	return sig, nil
+}
+
+// Verify checks that one of the trusted keys signed artifact; sig is raw or
+// base64 encoded
+func (v *Verifier) Verify(artifact, sig []byte) error {
+	if len(v.keys) == 0 {
+		return ErrNoKeys
+	}
+	sig, err := ParseSignature(sig)
+	if err != nil {
+		return err
+	}
+	for _, key := range v.keys {
+		if ed25519.Verify(key, artifact, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// ReadFile reads the artifact at path and returns its contents only if its
+// signature, path+SignatureSuffix, verifies. The contents returned are the
+// ones verified, so callers load those instead of reading the file again.
+func (v *Verifier) ReadFile(path string) ([]byte, error) {
+	if len(v.keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := os.ReadFile(path + SignatureSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("no signature for %s: %v", path, err)
+	}
+	if err := v.Verify(data, sig); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,87 @@
+package sigverify
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T) (string, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), priv
+}
+
+// TestVerify checks raw and base64 signatures, key rotation and rejection of
+// tampered artifacts and unknown signers
+func TestVerify(t *testing.T) {
+	oldKey, oldPriv := newKey(t)
+	rolledKey, rolledPriv := newKey(t)
+	_, otherPriv := newKey(t)
+	v, err := ParseKeys(oldKey + ", " + rolledKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact := []byte("release binary")
+
+	raw := ed25519.Sign(rolledPriv, artifact)
+	if err := v.Verify(artifact, raw); err != nil {
+		t.Errorf("raw signature: %v", err)
+	}
+	encoded := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(oldPriv, artifact)) + "\n")
+	if err := v.Verify(artifact, encoded); err != nil {
+		t.Errorf("base64 signature by the old key: %v", err)
+	}
+	if err := v.Verify([]byte("release binarY"), raw); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered artifact: got %v, want ErrBadSignature", err)
+	}
+	if err := v.Verify(artifact, ed25519.Sign(otherPriv, artifact)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("unknown signer: got %v, want ErrBadSignature", err)
+	}
+	if err := v.Verify(artifact, []byte("not a signature")); !errors.Is(err, ErrMalformedSignature) {
+		t.Errorf("malformed signature: got %v, want ErrMalformedSignature", err)
+	}
+	if err := (&Verifier{}).Verify(artifact, raw); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("no keys: got %v, want ErrNoKeys", err)
+	}
+	if _, err := ParseKeys("c2hvcnQ="); err == nil {
+		t.Error("a short key was accepted")
+	}
+}
+
+// TestReadFile checks that a file is only returned with a valid signature
+// next to it
+func TestReadFile(t *testing.T) {
+	key, priv := newKey(t)
+	v, err := ParseKeys(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plugin.so")
+	artifact := []byte("plugin")
+	if err := os.WriteFile(path, artifact, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.ReadFile(path); err == nil {
+		t.Fatal("a file without signature was accepted")
+	}
+	if err := os.WriteFile(path+SignatureSuffix, ed25519.Sign(priv, artifact), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := v.ReadFile(path)
+	if err != nil || string(data) != "plugin" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	if err := os.WriteFile(path, []byte("pluGin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.ReadFile(path); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("modified file: got %v, want ErrBadSignature", err)
+	}
+}
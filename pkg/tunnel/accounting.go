@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"log"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/accounting"
+)
+
+// Usage accounting (accounting_sink, server mode) reports every
+// accounting_interval seconds the bytes and packets each session moved since
+// its previous report, and once more when the session ends. Reports are kept
+// in accounting_spool until the sink accepts them, so an unreachable sink or a
+// restart delays them instead of losing them; only the traffic since the last
+// checkpoint is lost if the process dies without stopping. Stopping and
+// handing sessions to a new process checkpoint every session first.
+
+// usageMark is where a session's counters stood at its last report
+type usageMark struct {
+	bytesIn, bytesOut, packetsIn, packetsOut uint64
+	at                                       time.Time
+	ended                                    bool // Final report made
+}
+
+func (t *Tunnel) accountingInterval() time.Duration {
+	if t.config.AccountingInterval > 0 {
+		return time.Duration(t.config.AccountingInterval) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// startAccounting opens config.AccountingSink and starts reporting (server mode)
+func (t *Tunnel) startAccounting() error {
+	sink, err := accounting.NewSink(t.config.AccountingSink)
+	if err != nil {
+		return err
+	}
+	cp, err := accounting.NewCheckpointer(sink, t.config.AccountingSpool)
+	if err != nil {
+		sink.Close()
+		return err
+	}
+	if n := cp.Pending(); n > 0 {
+		log.Printf("Usage accounting: %d reports from an earlier run waiting for delivery", n)
+	}
+
+	stop := make(chan struct{})
+	t.usageMux.Lock()
+	t.accounting = cp
+	t.usageMarks = make(map[*ClientConnection]usageMark)
+	t.usageSince = time.Now()
+	t.usageStop = stop
+	t.usageMux.Unlock()
+
+	t.wg.Add(1)
+	go t.accountingLoop(cp, stop)
+	log.Printf("Usage accounting: reporting every %v to %s", t.accountingInterval(), t.config.AccountingSink)
+	return nil
+}
+
+func (t *Tunnel) accountingLoop(cp *accounting.Checkpointer, stop <-chan struct{}) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.accountingInterval())
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		t.usageMux.Lock()
+		records := t.usageReports(false)
+		t.usageMux.Unlock()
+		if err := cp.Add(records...); err != nil {
+			log.Printf("⚠️  Usage accounting: failed to spool reports: %v", err)
+		}
+		err := cp.Flush()
+		switch {
+		case err != nil && !failing:
+			log.Printf("⚠️  Usage accounting: delivery failed, %d reports kept for retry: %v", cp.Pending(), err)
+		case err == nil && failing:
+			log.Printf("Usage accounting: delivery recovered")
+		}
+		failing = err != nil
+	}
+}
+
+// usageReports returns the reports of all sessions since their last one
+// (t.usageMux held)
+func (t *Tunnel) usageReports(final bool) []accounting.Usage {
+	t.allClientsMux.RLock()
+	clients := make(map[*ClientConnection]bool, len(t.allClients))
+	for client := range t.allClients {
+		clients[client] = true
+	}
+	t.allClientsMux.RUnlock()
+
+	now := time.Now()
+	var records []accounting.Usage
+	for client := range clients {
+		if rec, ok := t.usageReport(client, now, final); ok {
+			records = append(records, rec)
+		}
+	}
+	for client := range t.usageMarks {
+		if !clients[client] {
+			delete(t.usageMarks, client)
+		}
+	}
+	return records
+}
+
+// usageReport returns the traffic of client since its last report and moves
+// the mark; without traffic there is nothing to report unless the session
+// ended (t.usageMux held)
+func (t *Tunnel) usageReport(client *ClientConnection, now time.Time, final bool) (accounting.Usage, bool) {
+	mark, ok := t.usageMarks[client]
+	if mark.ended {
+		return accounting.Usage{}, false
+	}
+	if !ok {
+		client.mu.RLock()
+		mark.at = client.connectedAt
+		client.mu.RUnlock()
+		if mark.at.Before(t.usageSince) {
+			mark.at = t.usageSince // Resumed after a handoff, or connected before accounting started
+		}
+	}
+	cur := usageMark{
+		bytesIn:    client.bytesIn.Load(),
+		bytesOut:   client.bytesOut.Load(),
+		packetsIn:  client.packetsIn.Load(),
+		packetsOut: client.packetsOut.Load(),
+		at:         now,
+	}
+	if final {
+		t.usageMarks[client] = usageMark{ended: true}
+	} else {
+		t.usageMarks[client] = cur
+	}
+	if !final && cur.packetsIn == mark.packetsIn && cur.packetsOut == mark.packetsOut {
+		return accounting.Usage{}, false
+	}
+
+	rec := accounting.Usage{
+		Time:       now,
+		Session:    client.sessionID,
+		RemoteAddr: client.conn.RemoteAddr().String(),
+		Interval:   now.Sub(mark.at).Seconds(),
+		BytesIn:    cur.bytesIn - mark.bytesIn,
+		BytesOut:   cur.bytesOut - mark.bytesOut,
+		PacketsIn:  cur.packetsIn - mark.packetsIn,
+		PacketsOut: cur.packetsOut - mark.packetsOut,
+		Final:      final,
+	}
+	t.clientsMux.RLock()
+	if client.clientIP != nil {
+		rec.TunnelIP = client.clientIP.String()
+	}
+	t.clientsMux.RUnlock()
+	client.mu.RLock()
+	rec.Identity = client.identity
+	client.mu.RUnlock()
+	return rec, true
+}
+
+// accountDisconnect spools the final report of a session that ended
+func (t *Tunnel) accountDisconnect(client *ClientConnection) {
+	t.usageMux.Lock()
+	defer t.usageMux.Unlock()
+	if t.accounting == nil {
+		return
+	}
+	rec, ok := t.usageReport(client, time.Now(), true)
+	if !ok {
+		return
+	}
+	if err := t.accounting.Add(rec); err != nil {
+		client.logf("⚠️  Usage accounting: failed to spool final report: %v", err)
+	}
+}
+
+// stopAccounting reports every session, final unless the sessions continue
+// in another process, and delivers what it can before closing the sink
+func (t *Tunnel) stopAccounting(final bool) {
+	t.usageMux.Lock()
+	cp := t.accounting
+	if cp == nil {
+		t.usageMux.Unlock()
+		return
+	}
+	records := t.usageReports(final)
+	t.accounting = nil
+	close(t.usageStop)
+	t.usageMux.Unlock()
+
+	if err := cp.Add(records...); err != nil {
+		log.Printf("⚠️  Usage accounting: failed to spool reports: %v", err)
+	}
+	if err := cp.Flush(); err != nil {
+		log.Printf("⚠️  Usage accounting: %d reports left in %s for the next run: %v", cp.Pending(), t.config.AccountingSpool, err)
+	}
+	cp.Close()
+}
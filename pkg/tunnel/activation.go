@@ -0,0 +1,36 @@
+package tunnel
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart is the first descriptor systemd passes (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// activatedSocket returns the socket systemd passed for socket activation
+// (LISTEN_PID and LISTEN_FDS), or nil. A .socket unit with ListenDatagram=
+// provides the UDP-mode socket; raw sockets can be handed over the same way by
+// any supervisor setting these variables.
+func activatedSocket() *os.File {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil
+	}
+	// Not for our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+	}
+	if n > 1 {
+		log.Printf("⚠️  %d sockets passed by socket activation, using the first", n)
+	}
+	return os.NewFile(uintptr(listenFDsStart), "activated-socket")
+}
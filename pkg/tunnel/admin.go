@@ -0,0 +1,354 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// The admin API is a small HTTP/JSON interface to a running tunnel. Without
+// admin_token it has no authentication, so admin_listen should stay on
+// loopback or a management network; with a token every request needs an
+// "Authorization: Bearer <token>" header, and admin_tls_cert/admin_tls_key
+// serve it over HTTPS so the token can cross untrusted networks.
+//
+//	GET    /status   tunnel, session, FEC and firewall rule state
+//	GET    /peers    connected clients and P2P peers
+//	GET    /config   running configuration, secrets redacted
+//	GET    /capture  stream matching packets as pcap (point, filter, count, seconds, snaplen)
+//	GET    /trace    a connection's recent segments as pcapng (session=remote address on servers)
+//	GET    /impair   active impairment and fault counters
+//	PUT    /impair   set the impairment (JSON Impairment body)
+//	DELETE /impair   stop injecting faults
+//	POST   /sessions/{ip}/disconnect  end the session of the client with tunnel IP ip (optional message parameter)
+//	GET    /profile  receive path stage timings
+//	PUT    /profile  start or stop stage timing ({"enabled": true|false})
+//	GET    /conn     a connection's socket figures, pacing, FEC parity and fake TCP state (session=remote address or ID on servers)
+//	PUT    /conn     change its pacing or parity (JSON ConnTuning body, same session parameter)
+//	GET    /loglevel current log level
+//	PUT    /loglevel set the log level ({"level": "info"|"trace"}); trace logs every frame
+//	GET    /debug/pprof/...  Go runtime profiles (net/http/pprof)
+
+// startAdmin serves the admin API on config.AdminListen
+func (t *Tunnel) startAdmin() error {
+	mux := t.adminMux()
+	addPprof(mux)
+	server, err := serveAdmin(t.config, mux)
+	if err != nil {
+		return err
+	}
+	t.adminServer = server
+	return nil
+}
+
+// adminMux routes the admin API requests of the tunnel
+func (t *Tunnel) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", t.handleGetStatus)
+	mux.HandleFunc("GET /peers", t.handleGetPeers)
+	mux.HandleFunc("GET /config", t.handleGetConfig)
+	mux.HandleFunc("GET /capture", t.handleCapture)
+	mux.HandleFunc("GET /trace", t.handleTrace)
+	mux.HandleFunc("GET /impair", t.handleGetImpair)
+	mux.HandleFunc("PUT /impair", t.handleSetImpair)
+	mux.HandleFunc("POST /impair", t.handleSetImpair)
+	mux.HandleFunc("DELETE /impair", t.handleClearImpair)
+	mux.HandleFunc("POST /sessions/{ip}/disconnect", t.handleDisconnectSession)
+	mux.HandleFunc("GET /profile", t.handleGetProfile)
+	mux.HandleFunc("PUT /profile", t.handleSetProfile)
+	mux.HandleFunc("POST /profile", t.handleSetProfile)
+	mux.HandleFunc("GET /conn", t.handleGetConn)
+	mux.HandleFunc("PUT /conn", t.handleTuneConn)
+	mux.HandleFunc("POST /conn", t.handleTuneConn)
+	mux.HandleFunc("POST /firewall/confirm", t.handleConfirmFirewall)
+	mux.HandleFunc("GET /loglevel", t.handleGetLogLevel)
+	mux.HandleFunc("PUT /loglevel", t.handleSetLogLevel)
+	mux.HandleFunc("POST /loglevel", t.handleSetLogLevel)
+	mux.HandleFunc("GET /frames", t.handleGetFrames)
+	mux.HandleFunc("GET /logs", t.handleGetLogs)
+	return mux
+}
+
+// addPprof adds the Go runtime profiles, which cover the whole process
+func addPprof(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+}
+
+// serveAdmin serves handler on cfg.AdminListen with the token and TLS
+// settings of cfg
+func serveAdmin(cfg *config.Config, handler http.Handler) (*http.Server, error) {
+	var tlsConfig *tls.Config
+	if cfg.AdminTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.AdminTLSCert, cfg.AdminTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	ln, err := net.Listen("tcp", cfg.AdminListen)
+	if err != nil {
+		return nil, err
+	}
+	if host, _, err := net.SplitHostPort(ln.Addr().String()); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			switch {
+			case cfg.AdminToken == "":
+				log.Printf("⚠️  Admin API on %s is reachable from the network and unauthenticated", ln.Addr())
+			case tlsConfig == nil:
+				log.Printf("⚠️  Admin API on %s is reachable from the network without TLS; the token is sent in clear text", ln.Addr())
+			}
+		}
+	}
+
+	server := &http.Server{
+		Handler:           requireToken(cfg.AdminToken, handler),
+		ReadHeaderTimeout: 5 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}()
+	log.Printf("Admin API listening on %s://%s", scheme, ln.Addr())
+	return server, nil
+}
+
+// requireToken rejects requests without the bearer token (if one is set)
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lightweight-tunnel"`)
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *Tunnel) stopAdmin() {
+	if t.adminServer != nil {
+		t.adminServer.Close()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, api.Error{Error: err.Error()})
+}
+
+func (t *Tunnel) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, t.Status())
+}
+
+func (t *Tunnel) handleGetPeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, t.Peers())
+}
+
+// redacted replaces secrets in the configuration served at GET /config
+const redacted = "***"
+
+func (t *Tunnel) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := *t.config
+	if cfg.Key != "" {
+		cfg.Key = redacted
+	}
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = redacted
+	}
+	writeJSON(w, http.StatusOK, &cfg)
+}
+
+type impairResponse struct {
+	Impairment *Impairment     `json:"impairment"` // null while no faults are injected
+	Stats      ImpairmentStats `json:"stats"`
+}
+
+func (t *Tunnel) handleGetImpair(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, impairResponse{Impairment: t.Impairment(), Stats: t.ImpairmentStats()})
+}
+
+func (t *Tunnel) handleSetImpair(w http.ResponseWriter, r *http.Request) {
+	var imp Impairment
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&imp); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := t.SetImpairment(&imp); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if cur := t.Impairment(); cur != nil {
+		log.Printf("⚠️  Impairment injection enabled: %+v", *cur)
+	} else {
+		log.Printf("Impairment injection disabled")
+	}
+	t.handleGetImpair(w, r)
+}
+
+func (t *Tunnel) handleClearImpair(w http.ResponseWriter, r *http.Request) {
+	t.SetImpairment(nil)
+	log.Printf("Impairment injection disabled")
+	t.handleGetImpair(w, r)
+}
+
+func (t *Tunnel) handleDisconnectSession(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid tunnel IP %q", r.PathValue("ip")))
+		return
+	}
+	message := r.URL.Query().Get("message")
+	if len(message) > 200 {
+		message = message[:200] // The notice must fit one packet
+	}
+	if err := t.DisconnectClient(ip, DisconnectAdminKick, message); err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *Tunnel) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, t.StageTimings())
+}
+
+func (t *Tunnel) handleSetProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Enabled == nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("enabled is required"))
+		return
+	}
+	t.SetStageTiming(*req.Enabled)
+	if *req.Enabled {
+		log.Printf("Receive stage timing enabled")
+	} else {
+		log.Printf("Receive stage timing disabled")
+	}
+	t.handleGetProfile(w, r)
+}
+
+// connSession returns the session parameter of a /conn request, required on
+// servers
+func (t *Tunnel) connSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	session := r.URL.Query().Get("session")
+	if t.config.Mode == "server" && session == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("session (client remote address or session ID) is required"))
+		return "", false
+	}
+	return session, true
+}
+
+func (t *Tunnel) handleGetConn(w http.ResponseWriter, r *http.Request) {
+	session, ok := t.connSession(w, r)
+	if !ok {
+		return
+	}
+	s, err := t.ConnStatus(session)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (t *Tunnel) handleTuneConn(w http.ResponseWriter, r *http.Request) {
+	session, ok := t.connSession(w, r)
+	if !ok {
+		return
+	}
+	var tuning ConnTuning
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&tuning); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := t.TuneConn(session, tuning); err != nil {
+		status := http.StatusBadRequest
+		if err == errNoConn {
+			status = http.StatusNotFound
+		}
+		writeJSONError(w, status, err)
+		return
+	}
+	s, err := t.ConnStatus(session)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Printf("Connection %s tuned: pacing %dµs, FEC parity %d", s.Remote, s.PacingUs, s.FECParity)
+	writeJSON(w, http.StatusOK, s)
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+func (t *Tunnel) handleConfirmFirewall(w http.ResponseWriter, r *http.Request) {
+	guard, err := t.ConfirmFirewall()
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, guard)
+}
+
+func (t *Tunnel) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelRequest{Level: t.LogLevel()})
+}
+
+func (t *Tunnel) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := t.SetLogLevel(req.Level); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("Log level set to %s", req.Level)
+	t.handleGetLogLevel(w, r)
+}
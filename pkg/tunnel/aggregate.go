@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Frame aggregation packs several small inner packets that are queued within a
+// short delay budget into one wire packet, so interactive traffic (VoIP, games)
+// pays the TCP/IP and encryption overhead once per burst instead of per packet.
+//
+// Aggregate layout: [PacketTypeAggregate]([length:2][inner packet])...
+// With FEC an aggregate occupies one data shard of the batch.
+
+// aggregateMaxFrame is the largest inner packet that is held back for aggregation.
+// Larger packets are sent on their own without waiting.
+const aggregateMaxFrame = 512
+
+// aggregateRaiseAfter is how long a higher send MTU must hold before aggregates
+// grow to it
+const aggregateRaiseAfter = 5 * time.Second
+
+// aggregateLimit follows the send MTU for the aggregates of one writer. A lower
+// MTU (ICMP, a failed probe, a server push) applies to the next aggregate, so
+// none exceeds what the path carries; a higher one only once it held for
+// aggregateRaiseAfter, so an MTU that flaps does not make aggregate sizes flap.
+// Only the writer goroutine uses it.
+type aggregateLimit struct {
+	limit   int       // Plaintext limit of the aggregates (0 = not set yet)
+	raiseAt time.Time // When a higher MTU was first seen (zero = none pending)
+}
+
+// next returns the plaintext limit for the next aggregate given the current
+// send MTU
+func (a *aggregateLimit) next(mtu int, now time.Time) int {
+	want := mtu + 1 // Type byte and a full inner packet, as for a data packet
+	switch {
+	case a.limit == 0 || want < a.limit:
+		a.limit = want
+		a.raiseAt = time.Time{}
+	case want == a.limit:
+		a.raiseAt = time.Time{}
+	case a.raiseAt.IsZero():
+		a.raiseAt = now
+	case now.Sub(a.raiseAt) >= aggregateRaiseAfter:
+		a.limit = want
+		a.raiseAt = time.Time{}
+	}
+	return a.limit
+}
+
+// aggregationEnabled reports whether small packets are aggregated before sending
+func (t *Tunnel) aggregationEnabled() bool {
+	return t.config.AggregateDelayUs > 0
+}
+
+// aggregatable reports whether packet may be held back for aggregation.
+// Priority and QUIC packets are never held back.
+func (t *Tunnel) aggregatable(packet []byte) bool {
+	return t.aggregationEnabled() && len(packet) <= aggregateMaxFrame && !isTunnelFrame(packet) &&
+		!t.isPriorityPacket(packet) && !t.isQUICPacket(packet)
+}
+
+// collectAggregate packs first and the packets arriving on queue within the delay
+// budget into one plaintext of at most limit bytes. Consumed packet buffers are
+// released. A packet that does not fit is returned as carry for the caller to send
+// next; added is the inner byte count packed after first and joined the number
+// of those packets.
+func (t *Tunnel) collectAggregate(first []byte, queue <-chan []byte, limit int) (plaintext, carry []byte, added, joined int) {
+	buf := make([]byte, 1, limit)
+	buf[0] = PacketTypeAggregate
+	buf = appendFrame(buf, first)
+	t.releasePacketBuffer(first)
+	frames := 1
+
+	timer := time.NewTimer(time.Duration(t.config.AggregateDelayUs) * time.Microsecond)
+	defer timer.Stop()
+
+collect:
+	for len(buf)+2+IPv4MinHeaderLen <= limit {
+		select {
+		case packet := <-queue:
+			if !t.aggregatable(packet) || len(buf)+2+len(packet) > limit {
+				carry = packet
+				break collect
+			}
+			if t.overRate(packet) {
+				continue
+			}
+			buf = appendFrame(buf, packet)
+			added += len(packet)
+			frames++
+			t.releasePacketBuffer(packet)
+		case <-timer.C:
+			break collect
+		}
+	}
+
+	if frames == 1 {
+		// Nothing joined: send a plain data packet, reusing the low length byte
+		// as the packet type
+		buf[2] = PacketTypeData
+		return buf[2:], carry, added, 0
+	}
+	return buf, carry, added, frames - 1
+}
+
+// batchElement converts collectAggregate output into an FEC batch element.
+// Batches hold inner packets untyped; aggregates and fragments keep their type byte.
+func batchElement(plaintext []byte) []byte {
+	if plaintext[0] == PacketTypeData {
+		return plaintext[1:]
+	}
+	return plaintext
+}
+
+// typedPacket returns the plaintext sent for a queued element: inner packets get
+// the data type prepended, tunnel frames already carry their type
+func typedPacket(pkt []byte) []byte {
+	if isTunnelFrame(pkt) {
+		return pkt
+	}
+	fullPacket, _ := prependPacketType(pkt, PacketTypeData)
+	return fullPacket
+}
+
+func appendFrame(buf, packet []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(packet)))
+	return append(buf, packet...)
+}
+
+// forEachAggregateFrame calls fn with each inner packet of an aggregate payload,
+// prefixed with PacketTypeData so it can go through the regular data path. The
+// prefix overwrites the low length byte in place. Iteration stops when fn returns
+// false or the payload is truncated.
+func forEachAggregateFrame(payload []byte, fn func(packet []byte) bool) bool {
+	for len(payload) >= 2 {
+		n := int(binary.BigEndian.Uint16(payload[0:2]))
+		if len(payload) < 2+n {
+			return true
+		}
+		packet := payload[1 : 2+n]
+		packet[0] = PacketTypeData
+		if !fn(packet) {
+			return false
+		}
+		payload = payload[2+n:]
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+)
+
+// smallPacket returns an IPv4 UDP packet of n bytes
+func smallPacket(n int) []byte {
+	p := make([]byte, n)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:4], uint16(n))
+	p[IPv4ProtocolOffset] = 17
+	return p
+}
+
+// TestAggregateFollowsMTU shrinks the send MTU in the middle of a stream of
+// small packets and checks that the next aggregate already fits it, that no
+// packet is lost or reordered, and that aggregates grow back only once a
+// higher MTU held for aggregateRaiseAfter
+func TestAggregateFollowsMTU(t *testing.T) {
+	tun := &Tunnel{config: &config.Config{AggregateDelayUs: 1000}}
+	queue := make(chan []byte, 256)
+	const total = 200
+	for i := 0; i < total; i++ {
+		p := smallPacket(100 + i%7*50)
+		binary.BigEndian.PutUint16(p[4:6], uint16(i)) // IP ID numbers the packets
+		queue <- p
+	}
+
+	var limit aggregateLimit
+	now := time.Unix(1000, 0)
+	mtu := 1400
+	next, sent := 0, 0
+	var packet []byte
+	var raisedAt time.Time
+	for sent < total {
+		now = now.Add(100 * time.Millisecond)
+		switch {
+		case sent >= 120 && mtu == 600:
+			mtu = 1400 // Raised again, but not trusted yet
+			raisedAt = now
+		case sent >= 60 && sent < 120:
+			mtu = 600 // Lowered mid-stream, e.g. by ICMP
+		}
+		if packet == nil {
+			packet = <-queue
+		}
+		plaintext, carry, _, _ := tun.collectAggregate(packet, queue, limit.next(mtu, now))
+		packet = carry
+
+		want := mtu + 1
+		if !raisedAt.IsZero() && now.Sub(raisedAt) < aggregateRaiseAfter {
+			want = 601 // Higher MTU seen less than aggregateRaiseAfter ago
+		}
+		if len(plaintext) > want {
+			t.Fatalf("after %d packets: wire packet of %d bytes exceeds the limit of %d (mtu %d)", sent, len(plaintext), want, mtu)
+		}
+
+		var inner [][]byte
+		switch plaintext[0] {
+		case PacketTypeData:
+			inner = [][]byte{plaintext[1:]}
+		case PacketTypeAggregate:
+			for rest := plaintext[1:]; len(rest) > 0; {
+				n := int(binary.BigEndian.Uint16(rest))
+				inner = append(inner, rest[2:2+n])
+				rest = rest[2+n:]
+			}
+		default:
+			t.Fatalf("unexpected packet type %#x", plaintext[0])
+		}
+		for _, p := range inner {
+			if id := int(binary.BigEndian.Uint16(p[4:6])); id != next {
+				t.Fatalf("got packet %d, want %d", id, next)
+			}
+			next++
+		}
+		sent += len(inner)
+	}
+
+	if raisedAt.IsZero() {
+		t.Fatal("MTU never raised")
+	}
+	if got := limit.next(1400, raisedAt.Add(aggregateRaiseAfter)); got != 1401 {
+		t.Errorf("limit %d after the higher MTU held, want 1401", got)
+	}
+}
+
+// TestAggregateLimitHysteresis checks that a lower MTU applies at once and a
+// higher one only after it held without interruption
+func TestAggregateLimitHysteresis(t *testing.T) {
+	var a aggregateLimit
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	for _, step := range []struct {
+		mtu  int
+		at   time.Duration
+		want int
+	}{
+		{1400, 0, 1401},
+		{1200, time.Second, 1201},
+		{1400, 2 * time.Second, 1201},
+		{1200, 4 * time.Second, 1201}, // Dip restarts the wait
+		{1400, 5 * time.Second, 1201},
+		{1400, 9 * time.Second, 1201},
+		{1400, 10 * time.Second, 1401},
+		{576, 10 * time.Second, 577},
+	} {
+		if got := a.next(step.mtu, at(step.at)); got != step.want {
+			t.Errorf("mtu %d at %v: limit %d, want %d", step.mtu, step.at, got, step.want)
+		}
+	}
+}
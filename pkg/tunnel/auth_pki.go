@@ -0,0 +1,208 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/pki"
+)
+
+// Auth response status codes used in PKI mode (in addition to OK/INVALID/EXPIRED)
+const (
+	AuthStatusCertExpired   = "CERT_EXPIRED"
+	AuthStatusCertRevoked   = "CERT_REVOKED"
+	AuthStatusCertUntrusted = "CERT_UNTRUSTED"
+	AuthStatusCertRequired  = "CERT_REQUIRED"
+)
+
+// AuthenticationResponse is the structured auth response sent by a PKI-enabled server.
+// Legacy servers answer with a bare status string instead.
+type AuthenticationResponse struct {
+	Status      string `json:"status"`
+	Timestamp   int64  `json:"timestamp"`
+	Certificate []byte `json:"certificate,omitempty"` // DER server certificate
+	Signature   []byte `json:"signature,omitempty"`   // Server signature over the client's nonce
+}
+
+// loadPKI loads the local identity and CA verifier when certificate mode is configured.
+// Without a CA only the identity is loaded: a server then proves its key to
+// clients that pin it, without requiring client certificates.
+func loadPKI(caFile, certFile, keyFile, crlFile string) (*pki.Identity, *pki.Verifier, error) {
+	if caFile == "" {
+		if certFile == "" || keyFile == "" {
+			return nil, nil, nil
+		}
+		identity, err := pki.LoadIdentity(certFile, keyFile)
+		return identity, nil, err
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("cert_file and cert_key are required when ca_cert is set")
+	}
+	identity, err := pki.LoadIdentity(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier, err := pki.NewVerifier(caFile, crlFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return identity, verifier, nil
+}
+
+// pkiEnabled reports whether certificate authentication is active.
+func (t *Tunnel) pkiEnabled() bool {
+	return t.pkiVerifier != nil && t.pkiIdentity != nil
+}
+
+// authHandshakeRequired reports whether the client must complete the auth handshake
+// before exchanging data (encrypt_after_auth mode, PKI mode or a pinned server key).
+func (t *Tunnel) authHandshakeRequired() bool {
+	return (t.config.EncryptAfterAuth && t.config.Key != "") || t.pkiEnabled() || t.pinsServerKey()
+}
+
+// authSigningPayload builds the byte string both sides sign. The role prevents a
+// signature produced by one side from being replayed as the other.
+func authSigningPayload(role string, timestamp int64, tunnelIP, nonce string) []byte {
+	return []byte(fmt.Sprintf("lightweight-tunnel-auth|%s|%d|%s|%s", role, timestamp, tunnelIP, nonce))
+}
+
+func newAuthNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signAuthRequest attaches the client certificate and proof of key possession.
+func (t *Tunnel) signAuthRequest(req *AuthenticationRequest) error {
+	nonce, err := newAuthNonce()
+	if err != nil {
+		return fmt.Errorf("failed to generate auth nonce: %v", err)
+	}
+	sig, err := t.pkiIdentity.Sign(authSigningPayload("client", req.Timestamp, req.TunnelIP, nonce))
+	if err != nil {
+		return fmt.Errorf("failed to sign auth request: %v", err)
+	}
+	req.Nonce = nonce
+	req.Certificate = t.pkiIdentity.Raw()
+	req.Signature = sig
+
+	t.authMux.Lock()
+	t.authNonce = nonce
+	t.authMux.Unlock()
+	return nil
+}
+
+// verifyClientCertificate validates the certificate in an auth request. It returns
+// the client certificate on success or an auth status code on failure.
+func (t *Tunnel) verifyClientCertificate(req *AuthenticationRequest, tunnelIP net.IP) (*x509.Certificate, string) {
+	if len(req.Certificate) == 0 || len(req.Signature) == 0 || req.Nonce == "" {
+		return nil, AuthStatusCertRequired
+	}
+
+	cert, err := t.pkiVerifier.Verify(req.Certificate, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, pkiStatus(err)
+	}
+
+	if err := pki.VerifySignature(cert, authSigningPayload("client", req.Timestamp, req.TunnelIP, req.Nonce), req.Signature); err != nil {
+		return nil, "INVALID"
+	}
+
+	if !pki.AllowsIP(cert, tunnelIP) {
+		return nil, AuthStatusCertUntrusted
+	}
+
+	return cert, ""
+}
+
+// buildPKIAuthResponse builds the signed success response proving the server identity.
+func (t *Tunnel) buildPKIAuthResponse(req *AuthenticationRequest) ([]byte, error) {
+	resp := AuthenticationResponse{
+		Status:      "OK",
+		Timestamp:   time.Now().Unix(),
+		Certificate: t.pkiIdentity.Raw(),
+	}
+	sig, err := t.pkiIdentity.Sign(authSigningPayload("server", resp.Timestamp, req.TunnelIP, req.Nonce))
+	if err != nil {
+		return nil, err
+	}
+	resp.Signature = sig
+	return json.Marshal(resp)
+}
+
+// verifyServerAuthResponse validates the server certificate and signature (client mode).
+func (t *Tunnel) verifyServerAuthResponse(resp *AuthenticationResponse) error {
+	t.authMux.RLock()
+	nonce := t.authNonce
+	t.authMux.RUnlock()
+
+	cert, err := t.pkiVerifier.Verify(resp.Certificate, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return fmt.Errorf("server certificate rejected (%s): %v", pkiStatus(err), err)
+	}
+	payload := authSigningPayload("server", resp.Timestamp, t.myTunnelIP.String(), nonce)
+	if err := pki.VerifySignature(cert, payload, resp.Signature); err != nil {
+		return fmt.Errorf("server certificate rejected (%s): bad signature", AuthStatusCertUntrusted)
+	}
+	log.Printf("✅ Server identity verified: %s", pki.Identify(cert))
+	return nil
+}
+
+// parseAuthResponse decodes either a structured or legacy auth response payload.
+func parseAuthResponse(payload []byte) AuthenticationResponse {
+	var resp AuthenticationResponse
+	if len(payload) > 0 && payload[0] == '{' && json.Unmarshal(payload, &resp) == nil {
+		return resp
+	}
+	return AuthenticationResponse{Status: string(payload)}
+}
+
+func pkiStatus(err error) string {
+	switch {
+	case errors.Is(err, pki.ErrExpired):
+		return AuthStatusCertExpired
+	case errors.Is(err, pki.ErrRevoked):
+		return AuthStatusCertRevoked
+	default:
+		return AuthStatusCertUntrusted
+	}
+}
+
+// enforceClientAuthDeadline disconnects clients that do not complete the PKI
+// handshake in time, so unauthenticated connections cannot hold a slot.
+func (t *Tunnel) enforceClientAuthDeadline(client *ClientConnection) {
+	// The client retries up to three times with backoff; allow for all attempts
+	timer := time.NewTimer(3*AuthenticationTimeout + 7*time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-client.stopCh:
+		return
+	case <-t.stopCh:
+		return
+	}
+
+	client.mu.RLock()
+	authenticated := client.authenticated
+	client.mu.RUnlock()
+	if authenticated {
+		return
+	}
+
+	client.logf("Client %s did not present a valid certificate in time, disconnecting", client.conn.RemoteAddr())
+	client.setDisconnectReason("authentication timeout")
+	client.stopOnce.Do(func() {
+		client.conn.Close()
+		close(client.stopCh)
+	})
+}
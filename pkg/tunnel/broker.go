@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/broker"
+)
+
+// With broker_socket set, local programs share this tunnel through the
+// broker in pkg/broker. Streams are connected from a socket bound to the TUN
+// device, so they always leave through the tunnel, whatever the routing
+// table says about their target. The socket is created with mode 0660: the
+// daemon's user and group may use it.
+
+// startBroker serves the broker on broker_socket
+func (t *Tunnel) startBroker() error {
+	path := t.config.BrokerSocket
+	os.Remove(path) // Left behind by a previous run
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return err
+	}
+	t.broker = &broker.Server{Dial: t.dialThroughTunnel}
+	go t.broker.Serve(ln)
+	log.Printf("Broker listening on %s", path)
+	return nil
+}
+
+func (t *Tunnel) stopBroker() {
+	if t.broker != nil {
+		t.broker.Close()
+		os.Remove(t.config.BrokerSocket)
+	}
+}
+
+// dialThroughTunnel connects a broker stream over the TUN device
+func (t *Tunnel) dialThroughTunnel(network, address string) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout: broker.DialTimeout,
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, t.tunName)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("bind to %s: %v", t.tunName, err)
+			}
+			return nil
+		},
+	}
+	return d.Dial(network, address)
+}
+
+// brokerStatus reports the programs sharing the tunnel
+func (t *Tunnel) brokerStatus() *api.BrokerStatus {
+	if t.broker == nil {
+		return nil
+	}
+	s := t.broker.Stats()
+	return &api.BrokerStatus{
+		Socket:   t.config.BrokerSocket,
+		Sessions: s.Sessions,
+		Streams:  s.Streams,
+		Refused:  s.Refused,
+	}
+}
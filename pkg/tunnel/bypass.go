@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+)
+
+// Bypass rules (client mode) send selected inner destinations straight out of
+// the physical interface instead of through the tunnel. A rule is either
+//
+//	CIDR                      e.g. 192.168.1.0/24
+//	proto:port[-port][@CIDR]  e.g. udp:3478-3479, tcp:443@203.0.113.0/24
+//
+// CIDR rules become routes via the gateway used to reach the server. Port rules
+// mark matching locally generated traffic and route the mark through a
+// dedicated table, masquerading it to the physical address. Packets that still
+// reach the TUN device (sockets opened before the rules existed) are counted
+// by the classifier and tunneled as usual.
+
+const (
+	bypassMark  = 0x4c57 // fwmark for port-based bypass traffic
+	bypassTable = 19543  // routing table holding the physical default route
+	bypassLabel = "lightweight-tunnel-bypass"
+)
+
+type bypassRule struct {
+	network  *net.IPNet // nil = any destination
+	proto    uint8      // 0 = any protocol (CIDR rules)
+	portLow  uint16
+	portHigh uint16
+}
+
+func (r bypassRule) portBased() bool {
+	return r.proto != 0
+}
+
+// matches reports whether an inner IPv4 packet falls under the rule
+func (r bypassRule) matches(packet []byte) bool {
+	dst := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+	if r.network != nil && !r.network.Contains(dst) {
+		return false
+	}
+	if !r.portBased() {
+		return true
+	}
+	if packet[IPv4ProtocolOffset] != r.proto {
+		return false
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if len(packet) < ihl+4 {
+		return false
+	}
+	port := uint16(packet[ihl+2])<<8 | uint16(packet[ihl+3])
+	return port >= r.portLow && port <= r.portHigh
+}
+
+// parseBypassRules parses the bypass configuration entries
+func parseBypassRules(entries []string) ([]bypassRule, error) {
+	var rules []bypassRule
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rule, err := parseBypassRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bypass rule %q: %v", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseBypassRule(entry string) (bypassRule, error) {
+	var rule bypassRule
+	spec, cidr, hasCIDR := strings.Cut(entry, "@")
+	protoStr, portStr, isPort := strings.Cut(spec, ":")
+	if !isPort {
+		if hasCIDR {
+			return rule, fmt.Errorf("@CIDR requires proto:port")
+		}
+		cidr, hasCIDR = spec, true
+	}
+	if hasCIDR {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil || ipNet.IP.To4() == nil {
+			return rule, fmt.Errorf("expected IPv4 CIDR, got %q", cidr)
+		}
+		rule.network = ipNet
+	}
+	if !isPort {
+		return rule, nil
+	}
+
+	switch strings.ToLower(protoStr) {
+	case "tcp":
+		rule.proto = 6
+	case "udp":
+		rule.proto = 17
+	default:
+		return rule, fmt.Errorf("protocol must be tcp or udp")
+	}
+	lowStr, highStr, isRange := strings.Cut(portStr, "-")
+	if !isRange {
+		highStr = lowStr
+	}
+	low, err1 := strconv.ParseUint(lowStr, 10, 16)
+	high, err2 := strconv.ParseUint(highStr, 10, 16)
+	if err1 != nil || err2 != nil || low == 0 || low > high {
+		return rule, fmt.Errorf("invalid port range %q", portStr)
+	}
+	rule.portLow, rule.portHigh = uint16(low), uint16(high)
+	return rule, nil
+}
+
+// isBypassPacket reports whether an inner packet read from TUN matches a bypass
+// rule. Decisions are cached per flow.
+func (t *Tunnel) isBypassPacket(packet []byte) bool {
+	if t.bypassClassifier == nil {
+		return false
+	}
+	return t.bypassClassifier.Classify(packet, func(pkt []byte) bool {
+		for _, rule := range t.bypassRules {
+			if rule.matches(pkt) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// noteBypassLeak counts a bypassed flow that still entered the tunnel
+func (t *Tunnel) noteBypassLeak(packet []byte) {
+	if t.statBypassLeak.Add(1) == 1 {
+		log.Printf("⚠️  Packet to %s matches a bypass rule but was routed into the tunnel (connection opened before the rule?); forwarding it through the tunnel",
+			net.IP(packet[IPv4DstIPOffset:IPv4DstIPOffset+4]))
+	}
+}
+
+// installBypass applies the bypass rules through the gateway that carries the
+// tunnel connection (client mode)
+func (t *Tunnel) installBypass() error {
+	if len(t.bypassRules) == 0 || t.conn == nil {
+		return nil
+	}
+	serverIP := remoteIP(t.conn.RemoteAddr())
+	if serverIP == nil {
+		return fmt.Errorf("unknown server address")
+	}
+	gateway, dev, err := physicalRoute(serverIP)
+	if err != nil {
+		return err
+	}
+	via := []string{"dev", dev}
+	if gateway != "" {
+		via = append([]string{"via", gateway}, via...)
+	}
+
+	hasPortRules := false
+	for _, rule := range t.bypassRules {
+		if rule.portBased() {
+			hasPortRules = true
+			continue
+		}
+		route := rule.network.String()
+		args := append([]string{"route", "replace", route}, via...)
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to add bypass route %s: %v (output: %s)", route, err, strings.TrimSpace(string(output)))
+		}
+		t.bypassRoutes = append(t.bypassRoutes, route)
+		log.Printf("Bypass route %s via %s", route, strings.Join(via, " "))
+	}
+	if !hasPortRules {
+		return nil
+	}
+
+	args := append([]string{"route", "replace", "default"}, via...)
+	args = append(args, "table", strconv.Itoa(bypassTable))
+	if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set up bypass table: %v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	mark := fmt.Sprintf("0x%x", bypassMark)
+	_ = exec.Command("ip", "rule", "del", "fwmark", mark, "table", strconv.Itoa(bypassTable)).Run()
+	if output, err := exec.Command("ip", "rule", "add", "fwmark", mark, "table", strconv.Itoa(bypassTable)).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add bypass policy rule: %v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	t.bypassPolicy = true
+
+	t.bypassIPT = iptables.NewIPTablesManager()
+	comment := "-m comment --comment " + bypassLabel
+	for _, rule := range t.bypassRules {
+		if !rule.portBased() {
+			continue
+		}
+		proto := "tcp"
+		if rule.proto == 17 {
+			proto = "udp"
+		}
+		spec := fmt.Sprintf("OUTPUT -t mangle -p %s --dport %d:%d", proto, rule.portLow, rule.portHigh)
+		if rule.network != nil {
+			spec += " -d " + rule.network.String()
+		}
+		if err := t.bypassIPT.AddCustomRule(spec + " " + comment + " -j MARK --set-mark " + mark); err != nil {
+			return err
+		}
+		log.Printf("Bypass %s ports %d-%d via %s", proto, rule.portLow, rule.portHigh, strings.Join(via, " "))
+	}
+	return t.bypassIPT.AddCustomRule(fmt.Sprintf("POSTROUTING -t nat -o %s -m mark --mark %s %s -j MASQUERADE", dev, mark, comment))
+}
+
+// removeBypass undoes installBypass
+func (t *Tunnel) removeBypass() {
+	for _, route := range t.bypassRoutes {
+		_ = exec.Command("ip", "route", "del", route).Run()
+	}
+	t.bypassRoutes = nil
+	if t.bypassIPT != nil {
+		if err := t.bypassIPT.RemoveAllRules(); err != nil {
+			log.Printf("Failed to remove bypass iptables rules: %v", err)
+		}
+	}
+	if t.bypassPolicy {
+		_ = exec.Command("ip", "rule", "del", "fwmark", fmt.Sprintf("0x%x", bypassMark), "table", strconv.Itoa(bypassTable)).Run()
+		_ = exec.Command("ip", "route", "flush", "table", strconv.Itoa(bypassTable)).Run()
+		t.bypassPolicy = false
+	}
+}
+
+// physicalRoute returns the gateway (empty when on-link) and device the kernel
+// uses to reach dst
+func physicalRoute(dst net.IP) (gateway, dev string, err error) {
+	output, err := exec.Command("ip", "route", "get", dst.String()).CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to look up route to %s: %v (output: %s)", dst, err, strings.TrimSpace(string(output)))
+	}
+	fields := strings.Fields(string(output))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			gateway = fields[i+1]
+		case "dev":
+			dev = fields[i+1]
+		}
+	}
+	if dev == "" {
+		return "", "", fmt.Errorf("no route to %s", dst)
+	}
+	return gateway, dev, nil
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
+)
+
+// Captures stream pcap from the admin API until the packet count or the
+// duration is reached or the client hangs up, e.g.
+//
+//	curl -sN 'http://127.0.0.1:9100/capture?filter=tcp[tcpflags]%26tcp-syn!=0' | tcpdump -nr -
+
+const (
+	captureDefaultCount   = 1000
+	captureDefaultSeconds = 60
+	captureMaxSeconds     = 3600
+	captureQueue          = 4096
+	captureMaxSnapLen     = 65535
+)
+
+// captureParams are the query parameters of GET /capture
+type captureParams struct {
+	tap      *capture.Tap
+	point    string
+	filter   string
+	program  capture.Program
+	count    int
+	duration time.Duration
+	snapLen  int
+}
+
+func parseCaptureParams(r *http.Request) (*captureParams, error) {
+	q := r.URL.Query()
+	p := &captureParams{point: q.Get("point"), filter: q.Get("filter")}
+	switch p.point {
+	case "", "outer":
+		p.point, p.tap = "outer", capture.Outer
+	case "inner":
+		p.tap = capture.Inner
+	default:
+		return nil, fmt.Errorf("point must be outer or inner")
+	}
+
+	var err error
+	if p.program, err = capture.Compile(p.filter); err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+	intParam := func(name string, def, lo, hi int) (int, error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("%s must be between %d and %d", name, lo, hi)
+		}
+		return n, nil
+	}
+	if p.count, err = intParam("count", captureDefaultCount, 0, 1<<30); err != nil {
+		return nil, err
+	}
+	seconds, err := intParam("seconds", captureDefaultSeconds, 1, captureMaxSeconds)
+	if err != nil {
+		return nil, err
+	}
+	p.duration = time.Duration(seconds) * time.Second
+	if p.snapLen, err = intParam("snaplen", captureMaxSnapLen, 1, captureMaxSnapLen); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handleCapture streams the packets of a tap that match the filter as pcap
+func (t *Tunnel) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if t.config.Profile == config.ProfileSmall {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("captures are disabled in the %s profile", config.ProfileSmall))
+		return
+	}
+	p, err := parseCaptureParams(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c := p.tap.Start(p.program, p.snapLen, captureQueue)
+	defer c.Stop()
+	log.Printf("Capture started on %s tap (filter %q) for %s", p.point, p.filter, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	pw, err := capture.NewWriter(w, p.snapLen)
+	if err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	timer := time.NewTimer(p.duration)
+	defer timer.Stop()
+	written := 0
+loop:
+	for p.count == 0 || written < p.count {
+		select {
+		case pkt := <-c.Packets():
+			if err := pw.WritePacket(pkt.Time, pkt.Data, pkt.Length); err != nil {
+				log.Printf("Capture on %s tap aborted: %v", p.point, err)
+				return
+			}
+			written++
+			if flusher != nil && len(c.Packets()) == 0 {
+				flusher.Flush()
+			}
+		case <-timer.C:
+			break loop
+		case <-r.Context().Done():
+			break loop
+		case <-t.stopCh:
+			break loop
+		}
+	}
+	log.Printf("Capture on %s tap ended: %d packets written, %d dropped", p.point, written, c.Dropped())
+}
@@ -0,0 +1,231 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+)
+
+// Client push lets the server hand a client the settings it decides for it:
+// a static tunnel address, routes, nameservers, MTU and keepalive interval.
+// The server sends them right after announcing its version, when the session
+// starts (after authentication in PKI mode). Entries of client_push are keyed
+// by certificate identity, so per-client entries need PKI; the "*" entry goes
+// to every client. Clients without push support ignore the packet.
+//
+// Layout: [PacketTypeClientPush][JSON config.ClientPush]
+
+// validateClientPush checks the client_push entries of a server configuration
+func validateClientPush(cfg *config.Config) error {
+	if len(cfg.ClientPush) == 0 {
+		return nil
+	}
+	serverIP, subnet, err := net.ParseCIDR(cfg.TunnelAddr)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel address %s: %v", cfg.TunnelAddr, err)
+	}
+
+	assigned := make(map[string]string)
+	for name, push := range cfg.ClientPush {
+		if push.TunnelAddr != "" {
+			if name == "*" {
+				return fmt.Errorf("client_push[*]: tunnel_addr must be set per client")
+			}
+			ip, _, err := net.ParseCIDR(push.TunnelAddr)
+			if err != nil {
+				return fmt.Errorf("client_push[%s]: invalid tunnel_addr %q", name, push.TunnelAddr)
+			}
+			if !subnet.Contains(ip) || ip.Equal(serverIP) {
+				return fmt.Errorf("client_push[%s]: tunnel_addr %s is not a client address in %s", name, push.TunnelAddr, subnet)
+			}
+			if other, ok := assigned[ip.String()]; ok {
+				return fmt.Errorf("client_push[%s]: tunnel_addr %s is also assigned to %s", name, ip, other)
+			}
+			assigned[ip.String()] = name
+		}
+		for _, route := range push.Routes {
+			if _, _, err := net.ParseCIDR(route); err != nil {
+				return fmt.Errorf("client_push[%s]: invalid route %q", name, route)
+			}
+		}
+		if _, err := parseDNSServers(push.DNSServers); err != nil {
+			return fmt.Errorf("client_push[%s]: %v", name, err)
+		}
+		if push.MTU != 0 && push.MTU < minMTU {
+			return fmt.Errorf("client_push[%s]: mtu must be at least %d", name, minMTU)
+		}
+		if push.Keepalive < 0 {
+			return fmt.Errorf("client_push[%s]: keepalive must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// clientPushFor returns the settings for a client with the given certificate
+// identity: the "*" entry overridden field by field by the client's own
+func (t *Tunnel) clientPushFor(identity string) (config.ClientPush, bool) {
+	push, ok := t.config.ClientPush["*"]
+	own, found := t.config.ClientPush[identity]
+	if identity == "" || !found {
+		return push, ok
+	}
+	if own.TunnelAddr != "" {
+		push.TunnelAddr = own.TunnelAddr
+	}
+	if len(own.Routes) > 0 {
+		push.Routes = own.Routes
+	}
+	if len(own.DNSServers) > 0 {
+		push.DNSServers = own.DNSServers
+		push.DNSDomains = own.DNSDomains
+	}
+	if own.MTU > 0 {
+		push.MTU = own.MTU
+	}
+	if own.Keepalive > 0 {
+		push.Keepalive = own.Keepalive
+	}
+	return push, true
+}
+
+// pushClientSettings sends a client its client_push settings (server mode).
+// A static address is registered for the client right away, so packets it
+// still sends from another address are dropped.
+func (t *Tunnel) pushClientSettings(client *ClientConnection) {
+	client.mu.RLock()
+	identity := client.identity
+	client.mu.RUnlock()
+
+	push, ok := t.clientPushFor(identity)
+	if !ok {
+		return
+	}
+	if push.MTU > 0 && push.MTU < int(atomic.LoadInt32(&client.sendMTU)) {
+		atomic.StoreInt32(&client.sendMTU, int32(push.MTU))
+	}
+	if push.TunnelAddr != "" {
+		ip, _, _ := net.ParseCIDR(push.TunnelAddr)
+		t.addClient(client, ip)
+	}
+
+	payload, err := json.Marshal(push)
+	if err != nil {
+		return
+	}
+	encrypted, err := t.encryptForClient(client, append([]byte{PacketTypeClientPush}, payload...))
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to push settings to %s: %v", client.conn.RemoteAddr(), err)
+		return
+	}
+	client.logf("Pushed settings to %s: %s", client.conn.RemoteAddr(), payload)
+}
+
+// handleClientPush applies settings pushed by the server (client mode). Each
+// is applied again after a reconnect, so unchanged values are left alone.
+func (t *Tunnel) handleClientPush(payload []byte) {
+	var push config.ClientPush
+	if err := json.Unmarshal(payload, &push); err != nil {
+		log.Printf("Failed to parse pushed settings: %v", err)
+		return
+	}
+
+	if push.TunnelAddr != "" {
+		if err := t.setTunnelAddr(push.TunnelAddr); err != nil {
+			log.Printf("⚠️  Failed to apply tunnel address %s pushed by the server: %v", push.TunnelAddr, err)
+		}
+	}
+	if push.MTU > 0 {
+		t.applyPushedMTU(push.MTU)
+	}
+	if push.Keepalive > 0 {
+		if old := atomic.SwapInt32(&t.keepaliveSecs, int32(push.Keepalive)); old != int32(push.Keepalive) {
+			log.Printf("Keepalive interval set by server: %ds", push.Keepalive)
+		}
+	}
+	if len(push.Routes) > 0 {
+		t.handleRouteInfoPayload([]byte(strings.Join(push.Routes, ",")))
+	}
+	if len(push.DNSServers) > 0 {
+		servers, err := parseDNSServers(push.DNSServers)
+		if err != nil {
+			log.Printf("⚠️  Ignoring nameservers pushed by the server: %v", err)
+			return
+		}
+		t.configMux.RLock()
+		unchanged := slices.Equal(servers, t.config.DNSServers) && slices.Equal(push.DNSDomains, t.config.DNSDomains)
+		t.configMux.RUnlock()
+		if !unchanged {
+			if err := t.replaceDNS(servers, push.DNSDomains); err != nil {
+				log.Printf("⚠️  Failed to configure nameservers pushed by the server: %v", err)
+			}
+		}
+	}
+}
+
+// setTunnelAddr moves the TUN device to a new address (client mode)
+func (t *Tunnel) setTunnelAddr(addr string) error {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		return err
+	}
+	t.configMux.RLock()
+	old := t.config.TunnelAddr
+	t.configMux.RUnlock()
+	if addr == old {
+		return nil
+	}
+
+	// The old address goes first: removing a primary address also removes the
+	// secondaries in its subnet
+	if output, err := exec.Command("ip", "addr", "del", old, "dev", t.tunName).CombinedOutput(); err != nil {
+		log.Printf("⚠️  Failed to remove old tunnel address %s: %v (output: %s)", old, err, strings.TrimSpace(string(output)))
+	}
+	if output, err := exec.Command("ip", "addr", "replace", addr, "dev", t.tunName).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	t.configMux.Lock()
+	t.config.TunnelAddr = addr
+	t.myTunnelIP = ip
+	t.configMux.Unlock()
+	log.Printf("Tunnel address assigned by server: %s (was %s)", addr, old)
+	return nil
+}
+
+// applyPushedMTU lowers the TUN MTU to one pushed by the server; the pushed
+// value also caps later path MTU probing (client mode)
+func (t *Tunnel) applyPushedMTU(mtu int) {
+	mtu = max(mtu, minMTU)
+	atomic.StoreInt32(&t.pushedMTU, int32(mtu))
+	current := t.tunMTU()
+	if mtu >= current {
+		return
+	}
+	if err := setLinkMTU(t.tunName, mtu); err != nil {
+		log.Printf("⚠️  Failed to set TUN MTU %d pushed by the server: %v", mtu, err)
+		return
+	}
+	atomic.StoreInt32(&t.pathMTU, int32(mtu))
+	t.setMTUSource(MTUSourceServer)
+	log.Printf("TUN MTU set by server: %d -> %d", current, mtu)
+}
+
+// keepaliveInterval returns the keepalive interval pushed by the server, or
+// the configured one (client mode)
+func (t *Tunnel) keepaliveInterval() time.Duration {
+	if secs := atomic.LoadInt32(&t.keepaliveSecs); secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return time.Duration(t.config.KeepaliveInterval) * time.Second
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// The wall clocks of routers and phones are often minutes off. When the
+// server announces a session, the client measures the offset between their
+// clocks with an NTP-style exchange of clockSyncSamples requests (Unix
+// nanoseconds):
+//
+//	request [PacketTypeClockSync][0][t1:8][estimate:8]
+//	reply   [PacketTypeClockSync][1][t1:8][t2:8][t3:8]
+//
+// t1 is the client's send time, t2 and t3 the server's receive and send
+// times, t4 the client's receive time. The reply with the least round-trip
+// delay gives the offset (server clock minus client clock) and the one-way
+// delays in each direction:
+//
+//	offset = ((t2-t1) + (t3-t4)) / 2    up = t2-t1-offset    down = t4-t3+offset
+//
+// The client then reads the port hopping schedule and the timestamps of its
+// authentication requests off the server's clock, so a skewed clock neither
+// makes it dial the wrong port nor fails its authentication as a replay. The
+// first authentication of a run comes before any exchange; reconnects use the
+// offset measured before. Requests carry the client's estimate so far (0
+// before the first reply), which the server reports for the session. Older
+// peers ignore the packet.
+
+const (
+	clockSyncRequest = 0
+	clockSyncReply   = 1
+	clockRequestLen  = 1 + 8 + 8
+	clockReplyLen    = 1 + 8 + 8 + 8
+
+	clockSyncSamples = 4
+	clockSyncSpacing = 250 * time.Millisecond
+	clockSkewWarn    = time.Second // Offsets beyond this are logged
+)
+
+// clockSync is the client's measurement of the server's clock
+type clockSync struct {
+	offset atomic.Int64 // Server clock minus ours (ns)
+
+	mu        sync.Mutex
+	known     bool          // A reply was received
+	delay     time.Duration // Round trip of the sample in use
+	up, down  time.Duration
+	samples   int  // Replies received
+	roundBest bool // The current round has a sample
+}
+
+// peerNow returns the time on the server's clock (client mode)
+func (t *Tunnel) peerNow() time.Time {
+	return time.Now().Add(time.Duration(t.clock.offset.Load()))
+}
+
+// syncClock measures the server's clock at the start of a session (client mode)
+func (t *Tunnel) syncClock() {
+	t.clock.mu.Lock()
+	t.clock.roundBest = false
+	t.clock.mu.Unlock()
+
+	for i := 0; i < clockSyncSamples; i++ {
+		if i > 0 {
+			select {
+			case <-t.stopCh:
+				return
+			case <-time.After(clockSyncSpacing):
+			}
+		}
+		req := make([]byte, 1+clockRequestLen)
+		req[0] = PacketTypeClockSync
+		req[1] = clockSyncRequest
+		binary.BigEndian.PutUint64(req[2:], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(req[10:], uint64(t.clock.offset.Load()))
+		if encrypted, err := t.encryptPacket(req); err == nil {
+			t.control.push(encrypted)
+		}
+	}
+
+	select {
+	case <-t.stopCh:
+		return
+	case <-time.After(clockSyncSpacing):
+	}
+	t.clock.mu.Lock()
+	known, offset, delay := t.clock.known, time.Duration(t.clock.offset.Load()), t.clock.delay
+	t.clock.mu.Unlock()
+	if known && (offset > clockSkewWarn || offset < -clockSkewWarn) {
+		log.Printf("⚠️  Server clock is %v off ours (measured over a %v round trip); following the server's clock for port hopping and authentication",
+			offset.Round(time.Millisecond), delay.Round(time.Millisecond))
+	}
+}
+
+// handleClockSyncReply records a reply from the server (client mode)
+func (t *Tunnel) handleClockSyncReply(payload []byte) {
+	t4 := time.Now().UnixNano()
+	if len(payload) != clockReplyLen || payload[0] != clockSyncReply {
+		return
+	}
+	t1 := int64(binary.BigEndian.Uint64(payload[1:]))
+	t2 := int64(binary.BigEndian.Uint64(payload[9:]))
+	t3 := int64(binary.BigEndian.Uint64(payload[17:]))
+	delay := time.Duration((t4 - t1) - (t3 - t2))
+	if delay < 0 || t3 < t2 || t4 < t1 {
+		return
+	}
+	offset := ((t2 - t1) + (t3 - t4)) / 2
+
+	c := &t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples++
+	if c.roundBest && delay >= c.delay {
+		return
+	}
+	c.known, c.roundBest = true, true
+	c.delay = delay
+	c.up = time.Duration(t2 - t1 - offset)
+	c.down = time.Duration(t4 - t3 + offset)
+	c.offset.Store(offset)
+}
+
+// handleClientClockSync answers a request from a client (server mode)
+func (t *Tunnel) handleClientClockSync(client *ClientConnection, payload []byte) {
+	t2 := time.Now().UnixNano()
+	if len(payload) != clockRequestLen || payload[0] != clockSyncRequest {
+		return
+	}
+	// The client's estimate is the server clock minus its own
+	if estimate := int64(binary.BigEndian.Uint64(payload[9:])); estimate != 0 {
+		client.clockOffset.Store(-estimate)
+	}
+	reply := make([]byte, 1+clockReplyLen)
+	reply[0] = PacketTypeClockSync
+	reply[1] = clockSyncReply
+	copy(reply[2:10], payload[1:9])
+	binary.BigEndian.PutUint64(reply[10:], uint64(t2))
+	binary.BigEndian.PutUint64(reply[18:], uint64(time.Now().UnixNano()))
+	if encrypted, err := t.encryptForClient(client, reply); err == nil {
+		client.control.push(encrypted)
+	}
+}
+
+// clockStatus reports the measured server clock (client mode)
+func (t *Tunnel) clockStatus() *api.ClockStatus {
+	c := &t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.known {
+		return nil
+	}
+	return &api.ClockStatus{
+		OffsetMs: durationMs(time.Duration(c.offset.Load())),
+		UpMs:     durationMs(c.up),
+		DownMs:   durationMs(c.down),
+		Samples:  c.samples,
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
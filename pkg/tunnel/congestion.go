@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// A receiver whose queues overflow tells the sender with a drop report: the
+// running total of packets it dropped, sent at most every dropReportInterval
+// while the total grows, so a lost report is made up for by the next one. Each
+// report with new drops raises the sender's congestion level by one, and every
+// congestionRelax without new drops lowers it again. What the sender does
+// while congested is chosen per deployment with congestion_response; by
+// default it keeps sending as before. Peers without support ignore the report.
+//
+// Layout: [PacketTypeDropReport][receive queue drops:8]
+
+const (
+	dropReportInterval = 100 * time.Millisecond
+	maxCongestionLevel = 4
+	congestionRelax    = time.Second
+)
+
+// Congestion responses (congestion_response), which can be combined
+const (
+	CongestionPace = "pace" // Space out segments with the connection's faketcp.CongestionController
+	CongestionFEC  = "fec"  // Halve the FEC group per level, so the parity covers fewer packets
+	CongestionShed = "shed" // Drop low-priority packets (DSCP CS1 and LE) while congested
+)
+
+// DSCP values of traffic that asked to be dropped first (RFC 3662, RFC 8622)
+const (
+	dscpCS1 = 8
+	dscpLE  = 1
+)
+
+// congestionPolicy is the parsed congestion_response
+type congestionPolicy struct {
+	pace, fec, shed bool
+}
+
+// ValidCongestionResponse reports whether name is a known congestion response
+func ValidCongestionResponse(name string) bool {
+	switch strings.ToLower(name) {
+	case CongestionPace, CongestionFEC, CongestionShed:
+		return true
+	}
+	return false
+}
+
+func parseCongestionPolicy(names []string) congestionPolicy {
+	var p congestionPolicy
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case CongestionPace:
+			p.pace = true
+		case CongestionFEC:
+			p.fec = true
+		case CongestionShed:
+			p.shed = true
+		}
+	}
+	return p
+}
+
+// dropReporter rate limits the drop reports sent to one peer
+type dropReporter struct {
+	reported atomic.Uint64 // Total last reported
+	at       time.Time
+}
+
+// congestionState is what the sender knows about one peer's drops
+type congestionState struct {
+	raised   int32        // Level at raisedAt (atomic)
+	raisedAt atomic.Int64 // UnixNano
+
+	mu        sync.Mutex
+	conn      faketcp.ConnAdapter // Connection the reports belong to
+	peerDrops uint64              // Total last reported on conn
+}
+
+// level returns the current congestion level, 0 when the peer reported no
+// drops for maxCongestionLevel*congestionRelax
+func (s *congestionState) level() int {
+	lvl := int(atomic.LoadInt32(&s.raised))
+	if lvl == 0 {
+		return 0
+	}
+	elapsed := time.Since(time.Unix(0, s.raisedAt.Load()))
+	return max(0, lvl-int(elapsed/congestionRelax))
+}
+
+// onReport records a drop total reported on conn and returns the number of
+// new drops. The first report on a connection only sets the baseline, since
+// the peer's total may include drops of an earlier connection.
+func (s *congestionState) onReport(conn faketcp.ConnAdapter, total uint64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		s.conn = conn
+		s.peerDrops = total
+		return 0
+	}
+	if total <= s.peerDrops {
+		return 0 // Reordered or repeated report
+	}
+	delta := total - s.peerDrops
+	s.peerDrops = total
+	atomic.StoreInt32(&s.raised, int32(min(s.level()+1, maxCongestionLevel)))
+	s.raisedAt.Store(time.Now().UnixNano())
+	return delta
+}
+
+// reportDrops queues on lane a report of the receive drops the peer caused, if
+// they grew since the last report; encrypt is the encryption for that peer
+func (t *Tunnel) reportDrops(lane *controlLane, r *dropReporter, drops uint64, encrypt func([]byte) ([]byte, error)) {
+	if drops == r.reported.Load() || time.Since(r.at) < dropReportInterval {
+		return
+	}
+	r.reported.Store(drops)
+	r.at = time.Now()
+	report := binary.BigEndian.AppendUint64([]byte{PacketTypeDropReport}, drops)
+	if encrypted, err := encrypt(report); err == nil && lane.push(encrypted) {
+		t.statDropReportsSent.Add(1)
+	}
+}
+
+// handleDropReport applies the configured response to a drop report received
+// on conn
+func (t *Tunnel) handleDropReport(conn faketcp.ConnAdapter, s *congestionState, payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	wasCongested := s.level() > 0
+	delta := s.onReport(conn, binary.BigEndian.Uint64(payload))
+	if delta == 0 {
+		return
+	}
+	t.statPeerDrops.Add(delta)
+	if !wasCongested && len(t.config.CongestionResponse) > 0 {
+		log.Printf("Peer %s reports %d receive queue drops, responding with %s",
+			conn.RemoteAddr(), delta, strings.Join(t.config.CongestionResponse, ","))
+	}
+	if t.congestionPolicy.pace {
+		if ic, ok := conn.(*impairedConn); ok {
+			conn = ic.ConnAdapter
+		}
+		if cc, ok := conn.(faketcp.CongestionConn); ok {
+			cc.OnCongestion(delta)
+		}
+	}
+}
+
+// fecGroupSize is the number of packets per FEC group toward a peer
+func (t *Tunnel) fecGroupSize(s *congestionState) int {
+	size := t.config.FECDataShards
+	if t.congestionPolicy.fec {
+		if lvl := s.level(); lvl > 0 {
+			size = max(2, size>>lvl)
+		}
+	}
+	return size
+}
+
+// shedPacket drops a queued packet marked low priority while the peer is
+// congested, releasing its buffer, and reports whether it did
+func (t *Tunnel) shedPacket(s *congestionState, packet []byte) bool {
+	if !t.congestionPolicy.shed || isTunnelFrame(packet) || len(packet) < IPv4MinHeaderLen {
+		return false
+	}
+	if dscp := packet[1] >> 2; dscp != dscpCS1 && dscp != dscpLE {
+		return false
+	}
+	if s.level() == 0 {
+		return false
+	}
+	t.statShed.Add(1)
+	t.releasePacketBuffer(packet)
+	return true
+}
@@ -0,0 +1,158 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/fec"
+)
+
+// GET /conn reports the kernel's figures for a connection's socket (queued
+// bytes, buffer sizes, drops on a full receive buffer) together with its
+// write pacing, FEC parity and, in raw mode, fake TCP state; PUT /conn changes the last two for that
+// connection alone, e.g. to give a client on a lossy link more parity without
+// restarting the server. Nothing is saved: pacing lasts as long as the
+// connection, parity as long as the session (a client's own, until restart).
+// The peer must accept the parity asked for; it drops groups with more
+// parity shards than its fec_max_parity.
+
+var errNoConn = errors.New("no such connection")
+
+// ConnTuning changes a connection's knobs; fields left out are kept
+type ConnTuning struct {
+	PacingUs  *int64 `json:"pacing_us,omitempty"`  // Write pacing in µs; 0 turns it off, -1 restores faketcp_pacing_us
+	FECParity *int   `json:"fec_parity,omitempty"` // Parity shards per full FEC group; 0 restores fec_parity
+}
+
+// sessionConn returns the connection of session, a client's remote address or
+// session ID (server mode), or the connection to the server
+func (t *Tunnel) sessionConn(session string) (faketcp.ConnAdapter, *ClientConnection) {
+	if t.config.Mode != "server" {
+		t.connMux.Lock()
+		defer t.connMux.Unlock()
+		return t.conn, nil
+	}
+	t.allClientsMux.RLock()
+	defer t.allClientsMux.RUnlock()
+	for client := range t.allClients {
+		if client.conn.RemoteAddr().String() == session || client.sessionID == session {
+			return client.conn, client
+		}
+	}
+	return nil, nil
+}
+
+// unwrapImpaired returns the connection behind an impairment wrapper
+func unwrapImpaired(conn faketcp.ConnAdapter) faketcp.ConnAdapter {
+	if ic, ok := conn.(*impairedConn); ok {
+		return ic.ConnAdapter
+	}
+	return conn
+}
+
+// connTuner returns the knobs of conn, seen through an impairment wrapper
+func connTuner(conn faketcp.ConnAdapter) faketcp.Tuner {
+	tuner, _ := unwrapImpaired(conn).(faketcp.Tuner)
+	return tuner
+}
+
+// writePacing returns the delay to leave after a batch written to conn
+func writePacing(conn faketcp.ConnAdapter) time.Duration {
+	if tuner := connTuner(conn); tuner != nil {
+		return tuner.WritePacing()
+	}
+	return faketcp.GetTuning().WritePacingMinDelay
+}
+
+// parityShards returns the parity shards of a full FEC group sent to a peer
+// whose override is given
+func (t *Tunnel) parityShards(override *int32) int {
+	if n := atomic.LoadInt32(override); n > 0 {
+		return int(n)
+	}
+	return t.config.FECParityShards
+}
+
+// ConnStatus reports a connection's socket and knobs; session selects a
+// client on servers (remote address or session ID)
+func (t *Tunnel) ConnStatus(session string) (*api.ConnStatus, error) {
+	conn, client := t.sessionConn(session)
+	if conn == nil {
+		return nil, errNoConn
+	}
+	override := &t.parityOverride
+	s := &api.ConnStatus{Remote: conn.RemoteAddr().String(), SessionID: t.SessionID()}
+	if client != nil {
+		override = &client.parityOverride
+		s.SessionID = client.sessionID
+	}
+	if t.fecEnabled {
+		s.FECParity = t.parityShards(override)
+		s.FECParityOverride = atomic.LoadInt32(override) > 0
+	}
+	if sr, ok := unwrapImpaired(conn).(stateReporter); ok {
+		state := tcpState(sr.State())
+		s.TCP = &state
+	}
+	tuner := connTuner(conn)
+	if tuner == nil {
+		return s, nil
+	}
+	s.PacingUs = tuner.WritePacing().Microseconds()
+	stats, err := tuner.SocketStats()
+	if err != nil {
+		s.SocketError = err.Error()
+	}
+	if stats.RecvBuffer > 0 {
+		s.Socket = &api.SocketStatus{
+			RecvQueued: stats.RecvQueued,
+			SendQueued: stats.SendQueued,
+			RecvBuffer: stats.RecvBuffer,
+			SendBuffer: stats.SendBuffer,
+			Drops:      stats.Drops,
+			Shared:     stats.Shared,
+		}
+	}
+	return s, nil
+}
+
+// TuneConn changes a connection's knobs as ConnTuning describes
+func (t *Tunnel) TuneConn(session string, tuning ConnTuning) error {
+	conn, client := t.sessionConn(session)
+	if conn == nil {
+		return errNoConn
+	}
+	if p := tuning.FECParity; p != nil {
+		switch {
+		case !t.fecEnabled:
+			return fmt.Errorf("FEC is not enabled")
+		case *p < 0 || *p > t.config.FECMaxParityShards:
+			return fmt.Errorf("fec_parity must be between 0 and %d (fec_max_parity)", t.config.FECMaxParityShards)
+		case *p > 1 && t.parityCodec == fec.XOR:
+			return fmt.Errorf("the %s codec sends one parity shard", t.parityCodec)
+		}
+	}
+	tuner := connTuner(conn)
+	if tuning.PacingUs != nil {
+		if tuner == nil {
+			return fmt.Errorf("connection has no write pacing")
+		}
+		d := time.Duration(*tuning.PacingUs) * time.Microsecond
+		if *tuning.PacingUs < 0 {
+			d = -1
+		}
+		tuner.SetWritePacing(d)
+	}
+	if p := tuning.FECParity; p != nil {
+		override := &t.parityOverride
+		if client != nil {
+			override = &client.parityOverride
+		}
+		atomic.StoreInt32(override, int32(*p))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+)
+
+// A client in a container with its own network namespace (Docker's default
+// bridge network, a Kubernetes pod) sends its forged segments from the
+// container's private address; the host masquerades them, so they reach the
+// server only while the host's connection tracking accepts them, and the RST
+// filter it installs covers the container but not the host. Running with the
+// host network, or with netns pointing at the host's namespace, avoids the
+// translation.
+
+// inContainer reports whether the process appears to run in a container
+func inContainer() bool {
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	if os.Getenv("container") != "" || os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return true
+	}
+	cgroup, _ := os.ReadFile("/proc/1/cgroup")
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "libpod", "lxc"} {
+		if strings.Contains(string(cgroup), runtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// containerNAT returns the private address a containerized client reaches a
+// public server from, nil when there is no container NAT in the way
+func containerNAT(remoteAddr string) net.IP {
+	if !inContainer() {
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp4", remoteAddr)
+	if err != nil || raddr.IP.IsPrivate() || raddr.IP.IsLoopback() {
+		return nil
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if local := conn.LocalAddr().(*net.UDPAddr).IP; local.IsPrivate() {
+		return local
+	}
+	return nil
+}
+
+// checkContainerNAT warns a client whose raw connection is translated on its
+// way out of a container
+func checkContainerNAT(remoteAddr string) {
+	if local := containerNAT(remoteAddr); local != nil {
+		log.Printf("⚠️  Running in a container that reaches %s from %s through the host's NAT: forged segments pass only while the host's connection tracking accepts them. If the handshake stalls, use the host network or set netns to the host's namespace", remoteAddr, local)
+	}
+}
+
+// Linux capability bits (linux/capability.h)
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+	capSysAdmin = 21
+)
+
+// capability is one the tunnel needs, and what for
+type capability struct {
+	bit        uint
+	name, used string
+}
+
+// effectiveCapabilities returns the process' effective capability set
+func effectiveCapabilities() (uint64, bool) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if hex, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(hex), 16, 64)
+			return caps, err == nil
+		}
+	}
+	return 0, false
+}
+
+// checkCapabilities fails with what to change when the process lacks the
+// capabilities or the TUN device it needs, as is common for an unprivileged
+// container (Linux only)
+func checkCapabilities(cfg *config.Config) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	caps, ok := effectiveCapabilities()
+	if !ok {
+		return nil
+	}
+	required := []capability{
+		{capNetRaw, "NET_RAW", "forging TCP segments"},
+		{capNetAdmin, "NET_ADMIN", "configuring the TUN device, routes and firewall rules"},
+	}
+	if cfg.NetNS != "" {
+		required = append(required, capability{capSysAdmin, "SYS_ADMIN", "entering the netns"})
+	}
+	var missing, uses []string
+	for _, c := range required {
+		if caps&(1<<c.bit) == 0 {
+			missing = append(missing, c.name)
+			uses = append(uses, c.name+" for "+c.used)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing capabilities (%s): run as root, or grant them (docker run --cap-add %s; Kubernetes: securityContext.capabilities.add: [%s])",
+			strings.Join(uses, ", "), strings.Join(missing, " --cap-add "), strings.Join(missing, ", "))
+	}
+	if !cfg.Takeover && !WireGuardPassthrough(cfg) {
+		if _, err := os.Stat("/dev/net/tun"); err != nil {
+			return fmt.Errorf("TUN device unavailable (%v): load the tun module on the host, or pass it into the container (docker run --device /dev/net/tun; Kubernetes: a hostPath volume for /dev/net/tun of type CharDevice)", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/ratelimit"
+)
+
+// Control packets (keepalives and their echoes, drop reports, ECN echoes) are
+// tiny but decide whether the peer considers the link alive. Written straight
+// to the connection they would wait for its write lock behind every data
+// batch the send workers have lined up, which under heavy load can delay them
+// past the peer's timeouts. They take a control lane instead: a short queue
+// drained by its own writer and, ahead of each data write, by the data
+// writers themselves, so a control packet waits at most for the write in
+// progress. Data writers take at most controlBurst control packets per data
+// write, so a flood of control packets cannot starve data. A full lane drops
+// the packet, as a full data queue does.
+
+const (
+	controlQueueSize = 64
+	controlBurst     = 4
+)
+
+// controlLane queues encrypted control packets for one connection
+type controlLane struct {
+	queue   chan []byte
+	drops   *atomic.Uint64     // Counts packets dropped on a full lane
+	limiter *ratelimit.Limiter // Charged for control packets, which it always lets through (nil = no limit)
+}
+
+func newControlLane(drops *atomic.Uint64, limiter *ratelimit.Limiter) *controlLane {
+	return &controlLane{queue: make(chan []byte, controlQueueSize), drops: drops, limiter: limiter}
+}
+
+// push queues an encrypted control packet, reporting false if the lane is full
+func (l *controlLane) push(packet []byte) bool {
+	select {
+	case l.queue <- packet:
+		if l.limiter != nil {
+			l.limiter.Allow(ratelimit.Control, len(packet))
+		}
+		return true
+	default:
+		l.drops.Add(1)
+		return false
+	}
+}
+
+// drain writes up to max queued control packets to conn ahead of a data write.
+// Errors are left to the data write that follows.
+func (l *controlLane) drain(conn faketcp.ConnAdapter, max int) {
+	for i := 0; i < max; i++ {
+		select {
+		case packet := <-l.queue:
+			if conn.WritePacket(packet) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// controlWriter writes control packets to the server while no data writer
+// picks them up; a failed write closes the connection so netReader
+// reconnects (client mode)
+func (t *Tunnel) controlWriter() {
+	defer t.wg.Done()
+	for {
+		var packet []byte
+		select {
+		case <-t.stopCh:
+			return
+		case packet = <-t.control.queue:
+		}
+		conn := t.conn
+		if conn == nil {
+			continue
+		}
+		if err := conn.WritePacket(packet); err != nil && !t.connReplaced(conn) {
+			select {
+			case <-t.stopCh:
+				return
+			default:
+			}
+			log.Printf("Control packet write error: %v, reconnecting...", err)
+			t.connMux.Lock()
+			if t.conn == conn {
+				_ = conn.Close()
+			}
+			t.connMux.Unlock()
+		}
+	}
+}
+
+// clientControlWriter writes control packets to a client while no data writer
+// picks them up; a failed write ends the session (server mode)
+func (t *Tunnel) clientControlWriter(client *ClientConnection) {
+	defer client.wg.Done()
+	for {
+		var packet []byte
+		select {
+		case <-t.stopCh:
+			return
+		case <-client.stopCh:
+			return
+		case packet = <-client.control.queue:
+		}
+		if err := client.conn.WritePacket(packet); err != nil {
+			select {
+			case <-t.stopCh:
+			case <-client.stopCh:
+			default:
+				client.logf("Client control packet write error to %s: %v", client.conn.RemoteAddr(), err)
+			}
+			client.setDisconnectReason("write error")
+			client.stopOnce.Do(func() {
+				close(client.stopCh)
+			})
+			return
+		}
+	}
+}
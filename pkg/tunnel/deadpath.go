@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// A path can fail in one direction only. When our packets are dropped but the
+// peer's still arrive, the idle timeout never fires and the tunnel would stay
+// "connected" while nothing gets through; the reverse case is caught by the
+// idle timeout on our side. Keepalive echoes measure the send direction: once
+// the peer has echoed a probe, a probe left unanswered for
+// IdleConnectionTimeout while the peer is still heard means our packets no
+// longer reach it. The client then moves to a new connection (new source
+// port, so NATs and load balancers may pick another path) and reconnects if
+// that fails; the server ends the session so it stops counting as connected
+// and the client reconnects. Data carries no feedback, so a probe is sent
+// despite traffic once no echo arrived for two keepalive intervals. Peers that
+// have not echoed on the current connection (older versions) are not checked.
+
+// pathProbe tracks the keepalive probes sent in one direction
+type pathProbe struct {
+	pending  atomic.Int64 // When the oldest unanswered probe was sent (unix ns, 0 = none)
+	lastEcho atomic.Int64 // When the peer last echoed a probe (unix ns, 0 = never)
+}
+
+// sent records a probe sent at now
+func (p *pathProbe) sent(now time.Time) {
+	p.pending.CompareAndSwap(0, now.UnixNano())
+}
+
+// echoed records an echo of one of our probes
+func (p *pathProbe) echoed(now time.Time) {
+	p.lastEcho.Store(now.UnixNano())
+	p.pending.Store(0)
+}
+
+// reset starts over on a new connection, which may lead to a peer that does
+// not echo
+func (p *pathProbe) reset() {
+	p.pending.Store(0)
+	p.lastEcho.Store(0)
+}
+
+// due reports whether a probe must be sent even though traffic flows: the
+// first one on a connection, to learn whether the peer echoes, and then one
+// whenever echoes are overdue
+func (p *pathProbe) due(now time.Time, interval time.Duration) bool {
+	last := p.lastEcho.Load()
+	if last == 0 {
+		return p.pending.Load() == 0
+	}
+	return now.Sub(time.Unix(0, last)) >= 2*interval
+}
+
+// dead reports whether the send direction is dead given when the peer was
+// last heard, and how long the oldest probe has gone unanswered
+func (p *pathProbe) dead(now, lastRecv time.Time) (time.Duration, bool) {
+	pending := p.pending.Load()
+	if pending == 0 || p.lastEcho.Load() == 0 {
+		return 0, false
+	}
+	waited := now.Sub(time.Unix(0, pending))
+	return waited, waited > IdleConnectionTimeout && now.Sub(lastRecv) < IdleConnectionTimeout
+}
+
+// checkSendPath moves to a new connection when the server no longer receives
+// what we send (client mode)
+func (t *Tunnel) checkSendPath() {
+	t.lastRecvMux.Lock()
+	lastRecv := t.lastRecvTime
+	t.lastRecvMux.Unlock()
+	waited, dead := t.sendPath.dead(time.Now(), lastRecv)
+	if !dead || t.conn == nil {
+		return
+	}
+	t.sendPath.reset()
+	t.statDeadPath.Add(1)
+	log.Printf("⚠️  Server still heard but no keepalive echo for %v: our packets are not getting through, moving to a new connection",
+		waited.Round(time.Second))
+	if err := t.redialServer("Dead path"); err != nil {
+		log.Printf("Dead path: %v, reconnecting", err)
+		t.connMux.Lock()
+		if t.conn != nil {
+			_ = t.conn.Close() // netReader reconnects
+		}
+		t.connMux.Unlock()
+	}
+}
+
+// clientSendPathDead reports whether a client no longer receives what we send
+// to it; the session is then ended (server mode)
+func (t *Tunnel) clientSendPathDead(client *ClientConnection) bool {
+	client.mu.RLock()
+	lastRecv := client.lastRecvTime
+	client.mu.RUnlock()
+	waited, dead := client.sendPath.dead(time.Now(), lastRecv)
+	if !dead {
+		return false
+	}
+	t.statDeadPath.Add(1)
+	client.logf("⚠️  Client %s still heard but no keepalive echo for %v: our packets are not getting through, closing the session",
+		client.conn.RemoteAddr(), waited.Round(time.Second))
+	return true
+}
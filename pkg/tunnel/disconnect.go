@@ -0,0 +1,230 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// DisconnectReason is the reason code carried by a server-initiated disconnect
+type DisconnectReason uint8
+
+const (
+	DisconnectServerShutdown DisconnectReason = 1 // Server is stopping; reconnecting later is expected to work
+	DisconnectAdminKick      DisconnectReason = 2 // An administrator terminated the session
+	DisconnectAuthRevoked    DisconnectReason = 3 // Client credentials were revoked or expired
+	DisconnectQuotaExceeded  DisconnectReason = 4 // Client exceeded its traffic quota
+	DisconnectReplaced       DisconnectReason = 5 // Another connection claimed the same tunnel IP
+	DisconnectFECMismatch    DisconnectReason = 6 // Client FEC parameters are outside the server's allowed ranges
+	DisconnectSessionExpired DisconnectReason = 7 // Session exceeded max_session_duration without renewing; reconnecting starts a new one
+	DisconnectServerFull     DisconnectReason = 8 // Server refused a new connection at max_clients; a later attempt may find room
+	DisconnectAuthFailed     DisconnectReason = 9 // Server rejected the authentication request or certificate
+)
+
+// revocationCheckInterval controls how often connected clients' certificates are re-checked (PKI mode)
+const revocationCheckInterval = 30 * time.Second
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectServerShutdown:
+		return "server shutdown"
+	case DisconnectAdminKick:
+		return "kicked by administrator"
+	case DisconnectAuthRevoked:
+		return "authorization revoked"
+	case DisconnectQuotaExceeded:
+		return "quota exceeded"
+	case DisconnectReplaced:
+		return "replaced by new connection"
+	case DisconnectFECMismatch:
+		return "incompatible FEC parameters"
+	case DisconnectSessionExpired:
+		return "session lifetime exceeded"
+	case DisconnectServerFull:
+		return "server full"
+	case DisconnectAuthFailed:
+		return "authentication failed"
+	default:
+		return fmt.Sprintf("unknown reason %d", uint8(r))
+	}
+}
+
+// Retryable reports whether a client should reconnect after this disconnect
+func (r DisconnectReason) Retryable() bool {
+	return r == DisconnectServerShutdown || r == DisconnectSessionExpired || r == DisconnectServerFull
+}
+
+// DisconnectError describes a session terminated by the server
+type DisconnectError struct {
+	Reason  DisconnectReason
+	Message string
+	Session string // Session ID the server announced, if any
+}
+
+func (e *DisconnectError) Error() string {
+	msg := fmt.Sprintf("disconnected by server: %s", e.Reason)
+	if e.Message != "" {
+		msg += fmt.Sprintf(" (%s)", e.Message)
+	}
+	if e.Session != "" {
+		msg += fmt.Sprintf(" [session %s]", e.Session)
+	}
+	return msg
+}
+
+// encodeDisconnect builds a disconnect packet: [type][reason][message]
+func encodeDisconnect(reason DisconnectReason, message string) []byte {
+	packet := make([]byte, 2+len(message))
+	packet[0] = PacketTypeDisconnect
+	packet[1] = byte(reason)
+	copy(packet[2:], message)
+	return packet
+}
+
+// parseDisconnect decodes a disconnect payload (without the packet type byte)
+func parseDisconnect(payload []byte) *DisconnectError {
+	if len(payload) < 1 {
+		return &DisconnectError{}
+	}
+	return &DisconnectError{Reason: DisconnectReason(payload[0]), Message: string(payload[1:])}
+}
+
+// sendDisconnect notifies a client that the server is ending its session. Best effort.
+func (t *Tunnel) sendDisconnect(client *ClientConnection, reason DisconnectReason, message string) {
+	encrypted, err := t.encryptForClient(client, encodeDisconnect(reason, message))
+	if err != nil {
+		client.logf("Failed to encrypt disconnect notice for %s: %v", client.conn.RemoteAddr(), err)
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send disconnect notice to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// rejectConnection tells a client why the server refuses its new connection,
+// then closes it. The notice is only sent sealed with the tunnel key: the
+// connection has not proven anything yet, and a client must not give up on a
+// notice anyone could have sent.
+func (t *Tunnel) rejectConnection(conn faketcp.ConnAdapter, reason DisconnectReason, message string) {
+	t.cipherMux.RLock()
+	c := t.cipher
+	t.cipherMux.RUnlock()
+	if c != nil {
+		if encrypted, err := c.Encrypt(encodeDisconnect(reason, message)); err == nil {
+			_ = conn.WritePacket(encrypted)
+		}
+	}
+	conn.Close()
+}
+
+// disconnectClient sends a disconnect notice and closes the client session
+func (t *Tunnel) disconnectClient(client *ClientConnection, reason DisconnectReason, message string) {
+	t.sendDisconnect(client, reason, message)
+	client.setDisconnectReason(reason.String())
+	client.stopOnce.Do(func() {
+		if err := client.conn.Close(); err != nil {
+			client.logf("Error closing client connection: %v", err)
+		}
+		close(client.stopCh)
+	})
+}
+
+// DisconnectClient terminates the session of the client owning tunnelIP (server mode)
+func (t *Tunnel) DisconnectClient(tunnelIP net.IP, reason DisconnectReason, message string) error {
+	client := t.getClientByIP(tunnelIP)
+	if client == nil {
+		return fmt.Errorf("no client with tunnel IP %s", tunnelIP)
+	}
+	client.logf("Disconnecting client %s (%s): %s", tunnelIP, client.conn.RemoteAddr(), reason)
+	t.disconnectClient(client, reason, message)
+	return nil
+}
+
+// Done returns a channel that is closed once the tunnel has stopped
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.stopCh
+}
+
+// Err returns what stopped the tunnel, if anything but Stop did: a server
+// disconnect (client mode) or a data loop that kept panicking
+func (t *Tunnel) Err() error {
+	t.disconnectMux.Lock()
+	defer t.disconnectMux.Unlock()
+	if t.disconnectErr == nil {
+		return nil
+	}
+	return t.disconnectErr
+}
+
+// handleServerDisconnect processes a disconnect notice from the server (client mode).
+// It returns true when the tunnel should stop instead of reconnecting.
+func (t *Tunnel) handleServerDisconnect(payload []byte) bool {
+	derr := parseDisconnect(payload)
+	derr.Session = t.SessionID()
+	// An authentication in progress fails with the reason rather than timing out
+	t.authMux.Lock()
+	authenticating := t.authResponseChan != nil && !t.authenticated
+	t.authMux.Unlock()
+	if authenticating {
+		select {
+		case t.authResponseChan <- derr:
+		default:
+		}
+	}
+	if derr.Reason.Retryable() {
+		log.Printf("⚠️  %v - will reconnect", derr)
+		t.connMux.Lock()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+		t.connMux.Unlock()
+		return false
+	}
+
+	log.Printf("❌ %v - not reconnecting", derr)
+	t.disconnectMux.Lock()
+	t.disconnectErr = derr
+	t.disconnectMux.Unlock()
+	go t.Stop()
+	return true
+}
+
+// revocationCheckLoop disconnects authenticated clients whose certificate has been
+// revoked or has expired since they connected (server, PKI mode).
+func (t *Tunnel) revocationCheckLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(revocationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		var revoked []*ClientConnection
+		t.allClientsMux.RLock()
+		for client := range t.allClients {
+			client.mu.RLock()
+			cert := client.cert
+			client.mu.RUnlock()
+			if cert == nil {
+				continue
+			}
+			if t.pkiVerifier.IsRevoked(cert) || time.Now().After(cert.NotAfter) {
+				revoked = append(revoked, client)
+			}
+		}
+		t.allClientsMux.RUnlock()
+
+		for _, client := range revoked {
+			log.Printf("Certificate of client %s is no longer valid, disconnecting", client.conn.RemoteAddr())
+			t.disconnectClient(client, DisconnectAuthRevoked, "certificate revoked or expired")
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// DNS configuration (client mode) points the system resolver at the
+// nameservers in dns_servers while the tunnel is up. With systemd-resolved the
+// servers are attached to the TUN link through resolvectl, so resolved removes
+// them by itself when the link goes away; otherwise /etc/resolv.conf is
+// replaced and the original is restored on Stop. The original is kept next to
+// it so a tunnel that was killed restores it on its next start.
+
+const (
+	resolvConf       = "/etc/resolv.conf"
+	resolvConfBackup = "/etc/resolv.conf.lightweight-tunnel"
+	resolvedStub     = "/run/systemd/resolve/stub-resolv.conf"
+)
+
+// dnsManager applies and reverts the system DNS configuration
+type dnsManager struct {
+	backend string // "resolved" or "resolvconf"
+	link    string // TUN device (resolved)
+}
+
+// parseDNSServers validates the dns_servers entries
+func parseDNSServers(servers []string) ([]string, error) {
+	out := make([]string, 0, len(servers))
+	for _, s := range servers {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS server %q", s)
+		}
+		out = append(out, ip.String())
+	}
+	return out, nil
+}
+
+// usesResolved reports whether /etc/resolv.conf is managed by systemd-resolved
+func usesResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	target, err := os.Readlink(resolvConf)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(target, "/systemd/resolve/")
+}
+
+// installDNS applies dns_servers and dns_domains (client mode)
+func (t *Tunnel) installDNS() error {
+	t.dnsMux.Lock()
+	defer t.dnsMux.Unlock()
+	return t.installDNSLocked()
+}
+
+func (t *Tunnel) installDNSLocked() error {
+	if len(t.config.DNSServers) == 0 {
+		return nil
+	}
+	servers, err := parseDNSServers(t.config.DNSServers)
+	if err != nil {
+		return err
+	}
+	restoreResolvConf()
+
+	m := &dnsManager{link: t.tunName}
+	if usesResolved() {
+		m.backend = "resolved"
+		err = m.applyResolved(servers, t.config.DNSDomains)
+	} else {
+		m.backend = "resolvconf"
+		err = m.applyResolvConf(servers, t.config.DNSDomains)
+	}
+	if err != nil {
+		return err
+	}
+	t.dns = m
+	log.Printf("DNS via tunnel: %s (%s)", strings.Join(servers, ", "), m.backend)
+	return nil
+}
+
+// removeDNS undoes installDNS
+func (t *Tunnel) removeDNS() {
+	t.dnsMux.Lock()
+	defer t.dnsMux.Unlock()
+	t.removeDNSLocked()
+}
+
+func (t *Tunnel) removeDNSLocked() {
+	if t.dns == nil {
+		return
+	}
+	switch t.dns.backend {
+	case "resolved":
+		if output, err := exec.Command("resolvectl", "revert", t.dns.link).CombinedOutput(); err != nil {
+			log.Printf("Failed to revert DNS on %s: %v (output: %s)", t.dns.link, err, strings.TrimSpace(string(output)))
+		}
+	case "resolvconf":
+		restoreResolvConf()
+	}
+	t.dns = nil
+}
+
+// replaceDNS switches to other nameservers while the tunnel is up, e.g. ones
+// pushed by the server. Nothing is installed once the tunnel is stopping.
+func (t *Tunnel) replaceDNS(servers, domains []string) error {
+	t.dnsMux.Lock()
+	defer t.dnsMux.Unlock()
+	select {
+	case <-t.stopCh:
+		return nil
+	default:
+	}
+	t.removeDNSLocked()
+	t.configMux.Lock()
+	t.config.DNSServers = servers
+	t.config.DNSDomains = domains
+	t.configMux.Unlock()
+	return t.installDNSLocked()
+}
+
+// applyResolved sets the link's nameservers and makes it the default route
+// for queries; without domains every query goes through the tunnel ("~.")
+func (m *dnsManager) applyResolved(servers, domains []string) error {
+	if len(domains) == 0 {
+		domains = []string{"~."}
+	}
+	commands := [][]string{
+		append([]string{"dns", m.link}, servers...),
+		append([]string{"domain", m.link}, domains...),
+		{"default-route", m.link, "true"},
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvectl %s failed: %v (output: %s)", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// applyResolvConf moves /etc/resolv.conf aside and writes one that lists only
+// the tunnel's nameservers. A symlinked resolv.conf is moved as the link.
+func (m *dnsManager) applyResolvConf(servers, domains []string) error {
+	if err := os.Rename(resolvConf, resolvConfBackup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to back up %s: %v", resolvConf, err)
+	}
+	var b strings.Builder
+	b.WriteString("# Generated by lightweight-tunnel; the original is restored when the tunnel stops\n")
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	var search []string
+	for _, d := range domains {
+		if d = strings.TrimPrefix(d, "~"); d != "" && d != "." {
+			search = append(search, d)
+		}
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if err := os.WriteFile(resolvConf, []byte(b.String()), 0644); err != nil {
+		restoreResolvConf()
+		return fmt.Errorf("failed to write %s: %v", resolvConf, err)
+	}
+	return nil
+}
+
+// restoreResolvConf puts back a resolv.conf moved aside by applyResolvConf,
+// including one left behind by an instance that did not stop cleanly
+func restoreResolvConf() {
+	if _, err := os.Lstat(resolvConfBackup); err != nil {
+		return
+	}
+	if err := os.Rename(resolvConfBackup, resolvConf); err != nil {
+		log.Printf("Failed to restore %s from %s: %v", resolvConf, resolvConfBackup, err)
+	}
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+)
+
+// Close stops the tunnel like Stop, but first gives what is already on its
+// way out up to shutdown_drain_ms (default 2 s) to leave: the send queues,
+// FEC groups still being collected or encoded and, with reliability kcp,
+// data the peer has not acknowledged. Short-lived use, a single curl through
+// the tunnel, then does not lose the tail of the transfer. The TUN device is
+// still read while draining, so what applications send meanwhile goes out
+// too. ForceClose ends a drain in progress, or skips it.
+
+const (
+	defaultShutdownDrain = 2 * time.Second
+	drainPollInterval    = 10 * time.Millisecond
+)
+
+// Close drains the tunnel, then stops it. The error tells how much was left
+// unsent if the drain timed out; the tunnel is stopped either way.
+func (t *Tunnel) Close() error {
+	err := t.drain(t.shutdownDrain())
+	t.Stop()
+	return err
+}
+
+// ForceClose stops the tunnel without waiting for queued packets, also
+// cutting short a Close that is draining
+func (t *Tunnel) ForceClose() {
+	t.forceOnce.Do(func() { close(t.forceCh) })
+	t.Stop()
+}
+
+// shutdownDrain returns how long Close waits (0 = not at all)
+func (t *Tunnel) shutdownDrain() time.Duration {
+	switch ms := t.config.ShutdownDrainMs; {
+	case ms < 0:
+		return 0
+	case ms > 0:
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultShutdownDrain
+}
+
+// drain waits until nothing is left to send, the tunnel stops or is forced
+// to, or timeout passes
+func (t *Tunnel) drain(timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		n := t.unsent()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-t.stopCh:
+			return nil
+		case <-t.forceCh:
+			return nil
+		case <-deadline.C:
+			return fmt.Errorf("%d packets still unsent after %v", n, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// unsent counts the packets waiting in send queues and FEC groups, and the
+// KCP segments not acknowledged yet. Connections that are gone or whose
+// peer stopped acknowledging are left out, there is nothing to wait for.
+func (t *Tunnel) unsent() int {
+	n := len(t.sendQueue) + int(t.heldPackets.Load())
+
+	t.kcpMux.Lock()
+	if t.kcpSession != nil {
+		n += t.kcpSession.waitSnd()
+	}
+	t.kcpMux.Unlock()
+
+	t.clientsMux.RLock()
+	defer t.clientsMux.RUnlock()
+	for _, client := range t.clients {
+		select {
+		case <-client.stopCh:
+			continue
+		default:
+		}
+		n += len(client.sendQueue)
+		client.mu.RLock()
+		s := client.kcp
+		client.mu.RUnlock()
+		if s != nil {
+			n += s.waitSnd()
+		}
+	}
+	return n
+}
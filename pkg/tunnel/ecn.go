@@ -0,0 +1,54 @@
+package tunnel
+
+import (
+	"encoding/binary"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Congestion marks (see faketcp.SetECN) are echoed to the sender as a running
+// total, so a lost echo is made up for by the next one. Both sides echo what
+// they receive, whether or not they mark their own segments; peers without
+// ECN support ignore the packet.
+//
+// Layout: [PacketTypeECNEcho][CE-marked segments received:8]
+
+// ecnConn returns the ECN bookkeeping of a connection under any fault
+// injection wrapper, nil when it has none (UDP mode)
+func ecnConn(conn faketcp.ConnAdapter) faketcp.ECNConn {
+	if ic, ok := conn.(*impairedConn); ok {
+		conn = ic.ConnAdapter
+	}
+	if ec, ok := conn.(faketcp.ECNConn); ok {
+		return ec
+	}
+	return nil
+}
+
+// echoECN tells the peer about new congestion marks on conn, rate limited;
+// encrypt is the encryption for that peer
+func echoECN(conn faketcp.ConnAdapter, lane *controlLane, encrypt func([]byte) ([]byte, error)) {
+	ec := ecnConn(conn)
+	if ec == nil {
+		return
+	}
+	marks, ok := ec.PendingECNEcho()
+	if !ok {
+		return
+	}
+	echo := binary.BigEndian.AppendUint64([]byte{PacketTypeECNEcho}, marks)
+	if encrypted, err := encrypt(echo); err == nil {
+		lane.push(encrypted)
+	}
+}
+
+// handleECNEcho passes the marks the peer reported to conn's congestion
+// controller
+func handleECNEcho(conn faketcp.ConnAdapter, payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	if ec := ecnConn(conn); ec != nil {
+		ec.OnECNEcho(binary.BigEndian.Uint64(payload))
+	}
+}
@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Reed-Solomon treats every shard it is given as correct, so a shard corrupted
+// in transit (rather than lost) corrupts the whole reconstructed batch. When both
+// peers negotiated it, shards carry a CRC-32C of the shard packet and a shard
+// that fails the check is dropped, leaving parity to recover it like a loss.
+//
+// Checked layout: [PacketTypeFECShardChecked][crc32c:4][FEC shard header][shard data]
+
+const fecChecksumLen = 4
+
+// fecFlagShardChecksum in the negotiated FEC flags: the peer verifies shard checksums
+const fecFlagShardChecksum = 0x01
+
+var shardCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// buildShardPacket assembles one shard packet, with a checksum when checked is set
+func buildShardPacket(sessionID uint32, index, dataShards, parityShards int, shard []byte, checked bool) []byte {
+	offset := 0
+	if checked {
+		offset = fecChecksumLen
+	}
+	packet := make([]byte, offset+fecShardHeaderLen+len(shard))
+	hdr := packet[offset:]
+	hdr[0] = PacketTypeFECShard
+	binary.BigEndian.PutUint32(hdr[1:5], sessionID)
+	binary.BigEndian.PutUint16(hdr[5:7], uint16(index))
+	binary.BigEndian.PutUint16(hdr[7:9], uint16(dataShards))
+	binary.BigEndian.PutUint16(hdr[9:11], uint16(parityShards))
+	binary.BigEndian.PutUint16(hdr[11:13], uint16(len(shard)))
+	copy(hdr[fecShardHeaderLen:], shard)
+	if checked {
+		packet[0] = PacketTypeFECShardChecked
+		binary.BigEndian.PutUint32(packet[1:5], crc32.Checksum(hdr[1:], shardCRCTable))
+	}
+	return packet
+}
+
+// verifyShard checks a PacketTypeFECShardChecked packet and returns it as a
+// plain PacketTypeFECShard packet (rewritten in place), or false when the
+// checksum does not match.
+func (t *Tunnel) verifyShard(packet []byte) ([]byte, bool) {
+	if len(packet) < 1+fecChecksumLen+fecShardHeaderLen-1 {
+		return nil, false
+	}
+	sum := binary.BigEndian.Uint32(packet[1:5])
+	if crc32.Checksum(packet[1+fecChecksumLen:], shardCRCTable) != sum {
+		t.statFECShardCorrupt.Add(1)
+		return nil, false
+	}
+	packet = packet[fecChecksumLen:]
+	packet[0] = PacketTypeFECShard
+	return packet, true
+}
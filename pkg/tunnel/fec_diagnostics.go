@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// FEC group diagnostics: when enabled, every group that could not be
+// reconstructed is recorded in a fixed-size ring so users can tell losses caused
+// by the reorder timeout (the receiver had already moved past the group while
+// its shards were still arriving) from genuine path loss (shards never came).
+
+const (
+	FECGroupExpired           = "expired"            // Too few shards arrived before the group timed out
+	FECGroupReconstructFailed = "reconstruct_failed" // All shards arrived but Reed-Solomon reconstruction failed
+)
+
+// FECGroupDiagnostic describes one unrecoverable FEC group
+type FECGroupDiagnostic struct {
+	Time          time.Time `json:"time"`
+	Peer          string    `json:"peer"`
+	SessionID     uint32    `json:"session_id"`
+	Reason        string    `json:"reason"`
+	DataShards    int       `json:"data_shards"`
+	ParityShards  int       `json:"parity_shards"`
+	ShardSize     int       `json:"shard_size"`
+	Present       []int     `json:"present"`        // Indices of the shards that arrived
+	FirstShard    time.Time `json:"first_shard"`    // Arrival of the first shard
+	LastShard     time.Time `json:"last_shard"`     // Arrival of the last shard
+	ReorderNext   uint32    `json:"reorder_next"`   // Next group the peer's reorder buffer was waiting for
+	ReorderPassed bool      `json:"reorder_passed"` // The reorder buffer had already skipped past this group
+}
+
+// fecDiagRing keeps the most recent diagnostics
+type fecDiagRing struct {
+	mu      sync.Mutex
+	entries []FECGroupDiagnostic
+	next    int
+	full    bool
+}
+
+func newFECDiagRing(size int) *fecDiagRing {
+	if size <= 0 {
+		return nil
+	}
+	return &fecDiagRing{entries: make([]FECGroupDiagnostic, size)}
+}
+
+func (r *fecDiagRing) add(d FECGroupDiagnostic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = d
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// snapshot returns the recorded diagnostics, oldest first
+func (r *fecDiagRing) snapshot() []FECGroupDiagnostic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]FECGroupDiagnostic(nil), r.entries[:r.next]...)
+	}
+	out := make([]FECGroupDiagnostic, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+// recordFECGroup adds an unrecoverable group to the diagnostics ring, if enabled
+func (t *Tunnel) recordFECGroup(peer string, sessionID uint32, s *fecRecvSession, reason string) {
+	if t.fecDiag == nil {
+		return
+	}
+	d := FECGroupDiagnostic{
+		Time:         time.Now(),
+		Peer:         peer,
+		SessionID:    sessionID,
+		Reason:       reason,
+		DataShards:   s.dataShards,
+		ParityShards: s.parityShards,
+		ShardSize:    s.expectedShardSize,
+		FirstShard:   s.firstUpdate,
+		LastShard:    s.lastUpdate,
+	}
+	for i, present := range s.shardPresent {
+		if present {
+			d.Present = append(d.Present, i)
+		}
+	}
+	if next, ok := t.reorderPosition(peer); ok {
+		d.ReorderNext = next
+		d.ReorderPassed = seqBefore(sessionID, next)
+	}
+	t.fecDiag.add(d)
+}
+
+// FECDiagnostics returns the most recent unrecoverable FEC groups, oldest
+// first. It returns nil when diagnostics are disabled (fec_diagnostics = 0).
+func (t *Tunnel) FECDiagnostics() []FECGroupDiagnostic {
+	if t.fecDiag == nil {
+		return nil
+	}
+	return t.fecDiag.snapshot()
+}
+
+// WriteFECDiagnostics writes FECDiagnostics to w as JSON lines
+func (t *Tunnel) WriteFECDiagnostics(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, d := range t.FECDiagnostics() {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/fec"
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// FEC parameters are exchanged right after the connection is established (after
+// authentication in PKI mode): the server announces the parameters it sends with,
+// the client checks them against its own limits and answers with its parameters,
+// and the server disconnects the client with DisconnectFECMismatch if they fall
+// outside its allowed ranges. Peers without negotiation support ignore the packet.
+//
+// Layout: [PacketTypeFECParams][dataShards:2][parityShards:2][maxShardSize:2][codec:1][flags:1]
+// The flags byte is optional; senders that omit it support no optional features.
+
+const (
+	fecParamsLen = 1 + 2 + 2 + 2 + 1 + 1
+
+	// fecShardHeaderLen is the shard packet header that precedes the shard data
+	fecShardHeaderLen = 1 + 4 + 2 + 2 + 2 + 2
+)
+
+// fecParams describes the FEC batches one side sends
+type fecParams struct {
+	dataShards   int
+	parityShards int
+	shardSize    int // largest shard (length prefix + encrypted packet)
+	codec        byte
+	flags        byte // fecFlag* features the sender supports
+}
+
+func (p fecParams) String() string {
+	return fmt.Sprintf("%d+%d shards, shard size %d, codec %d", p.dataShards, p.parityShards, p.shardSize, p.codec)
+}
+
+// localFECParams returns the parameters this side sends with
+func (t *Tunnel) localFECParams() fecParams {
+	overhead := 0
+	t.cipherMux.RLock()
+	if t.cipher != nil {
+		overhead = t.cipher.Overhead()
+	}
+	t.cipherMux.RUnlock()
+	return fecParams{
+		dataShards:   t.config.FECDataShards,
+		parityShards: t.config.FECParityShards,
+		shardSize:    2 + 1 + t.config.MTU + overhead,
+		codec:        byte(t.parityCodec),
+		flags:        fecFlagShardChecksum,
+	}
+}
+
+// fecSegmentOptions is the room the TCP options carried by every segment take
+const fecSegmentOptions = 24
+
+// maxFECShardSize is the largest shard that fits the segments this side
+// advertised it can receive from peerIP, whose family sets the IP header size
+func (t *Tunnel) maxFECShardSize(peerIP net.IP) int {
+	recvMTU := t.config.RecvMTU
+	if recvMTU <= 0 {
+		recvMTU = 1500
+	}
+	headers := rawsocket.HeaderSize(peerIP) + rawsocket.TCPHeaderSize + fecSegmentOptions
+	return recvMTU - headers - fecShardHeaderLen - fecChecksumLen
+}
+
+// checkPeerFECParams reports why the parameters of the peer at peerIP cannot
+// be received, or nil
+func (t *Tunnel) checkPeerFECParams(p fecParams, peerIP net.IP) error {
+	switch {
+	case p.codec != byte(t.parityCodec):
+		return fmt.Errorf("FEC codec %v differs from ours (%v, fec_codec)", fec.Codec(p.codec), t.parityCodec)
+	case p.dataShards < 1 || p.dataShards > t.config.FECMaxDataShards:
+		return fmt.Errorf("%d data shards outside allowed range 1-%d", p.dataShards, t.config.FECMaxDataShards)
+	case p.parityShards < 1 || p.parityShards > t.config.FECMaxParityShards:
+		return fmt.Errorf("%d parity shards outside allowed range 1-%d", p.parityShards, t.config.FECMaxParityShards)
+	case p.shardSize > t.maxFECShardSize(peerIP):
+		return fmt.Errorf("shard size %d exceeds receivable %d", p.shardSize, t.maxFECShardSize(peerIP))
+	}
+	return nil
+}
+
+func encodeFECParams(p fecParams) []byte {
+	packet := make([]byte, fecParamsLen)
+	packet[0] = PacketTypeFECParams
+	binary.BigEndian.PutUint16(packet[1:3], uint16(p.dataShards))
+	binary.BigEndian.PutUint16(packet[3:5], uint16(p.parityShards))
+	binary.BigEndian.PutUint16(packet[5:7], uint16(p.shardSize))
+	packet[7] = p.codec
+	packet[8] = p.flags
+	return packet
+}
+
+// parseFECParams decodes a payload without the packet type byte
+func parseFECParams(payload []byte) (fecParams, bool) {
+	if len(payload) < fecParamsLen-2 {
+		return fecParams{}, false
+	}
+	p := fecParams{
+		dataShards:   int(binary.BigEndian.Uint16(payload[0:2])),
+		parityShards: int(binary.BigEndian.Uint16(payload[2:4])),
+		shardSize:    int(binary.BigEndian.Uint16(payload[4:6])),
+		codec:        payload[6],
+	}
+	if len(payload) >= fecParamsLen-1 {
+		p.flags = payload[7]
+	}
+	return p, true
+}
+
+// offerFECParams announces the server's FEC parameters to a client
+func (t *Tunnel) offerFECParams(client *ClientConnection) {
+	if !t.fecEnabled {
+		return
+	}
+	encrypted, err := t.encryptForClient(client, encodeFECParams(t.localFECParams()))
+	if err != nil {
+		client.logf("Failed to encrypt FEC parameters for %s: %v", client.conn.RemoteAddr(), err)
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send FEC parameters to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// handleServerFECParams checks the server's parameters and answers with ours
+// (client mode). An incompatible server stops the tunnel, since reconnecting
+// cannot fix a configuration mismatch.
+func (t *Tunnel) handleServerFECParams(payload []byte) bool {
+	server, ok := parseFECParams(payload)
+	if !ok || !t.fecEnabled {
+		return false
+	}
+	var serverIP net.IP
+	if conn := t.conn; conn != nil {
+		serverIP = remoteIP(conn.RemoteAddr())
+	}
+	if err := t.checkPeerFECParams(server, serverIP); err != nil {
+		derr := &DisconnectError{Reason: DisconnectFECMismatch, Message: "server sends " + err.Error()}
+		log.Printf("❌ FEC negotiation failed: %s (server: %s) - not reconnecting", derr.Message, server)
+		t.disconnectMux.Lock()
+		t.disconnectErr = derr
+		t.disconnectMux.Unlock()
+		go t.Stop()
+		return true
+	}
+
+	local := t.localFECParams()
+	log.Printf("FEC negotiated: sending %s, server sends %s", local, server)
+	if server.flags&fecFlagShardChecksum != 0 {
+		atomic.StoreUint32(&t.shardChecksum, 1)
+	}
+
+	conn := t.conn
+	if conn == nil {
+		return false
+	}
+	encrypted, err := t.encryptPacket(encodeFECParams(local))
+	if err != nil {
+		return false
+	}
+	if err := conn.WritePacket(encrypted); err != nil {
+		log.Printf("Failed to send FEC parameters: %v", err)
+	}
+	return false
+}
+
+// handleClientFECParams validates a client's answer (server mode). It returns
+// false when the client was disconnected.
+func (t *Tunnel) handleClientFECParams(client *ClientConnection, payload []byte) bool {
+	params, ok := parseFECParams(payload)
+	if !ok {
+		return true
+	}
+	if err := t.checkPeerFECParams(params, remoteIP(client.conn.RemoteAddr())); err != nil {
+		client.logf("Rejecting client %s: FEC %s (client: %s)", client.conn.RemoteAddr(), err, params)
+		t.disconnectClient(client, DisconnectFECMismatch, err.Error())
+		return false
+	}
+	client.logf("FEC negotiated with %s: client sends %s", client.conn.RemoteAddr(), params)
+	if params.flags&fecFlagShardChecksum != 0 {
+		atomic.StoreUint32(&client.shardChecksum, 1)
+	}
+	return true
+}
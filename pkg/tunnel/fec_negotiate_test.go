@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/fec"
+)
+
+// TestFECParamsRoundTrip encodes parameters and decodes them again, with and
+// without the optional flags byte
+func TestFECParamsRoundTrip(t *testing.T) {
+	for _, p := range []fecParams{
+		{dataShards: 10, parityShards: 3, shardSize: 1420, codec: byte(fec.ReedSolomon), flags: fecFlagShardChecksum},
+		{dataShards: 1, parityShards: 1, shardSize: 0, codec: byte(fec.XOR)},
+		{dataShards: 0xFFFF, parityShards: 0xFFFF, shardSize: 0xFFFF, codec: 0xFF, flags: 0xFF},
+	} {
+		packet := encodeFECParams(p)
+		if len(packet) != fecParamsLen || packet[0] != PacketTypeFECParams {
+			t.Fatalf("%v: encoded %x", p, packet)
+		}
+		got, ok := parseFECParams(packet[1:])
+		if !ok || got != p {
+			t.Errorf("round trip of %+v: %+v, %v", p, got, ok)
+		}
+
+		// Peers that predate the flags byte omit it
+		old, ok := parseFECParams(packet[1 : fecParamsLen-1])
+		want := p
+		want.flags = 0
+		if !ok || old != want {
+			t.Errorf("without flags %+v: %+v, %v", want, old, ok)
+		}
+	}
+
+	for n := range fecParamsLen - 2 {
+		if _, ok := parseFECParams(make([]byte, n)); ok {
+			t.Errorf("%d-byte payload accepted", n)
+		}
+	}
+}
+
+// TestCheckPeerFECParams runs the peer parameters through every rejection
+func TestCheckPeerFECParams(t *testing.T) {
+	tun := &Tunnel{
+		config:      &config.Config{RecvMTU: 1500, FECMaxDataShards: 20, FECMaxParityShards: 10},
+		parityCodec: fec.ReedSolomon,
+	}
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	maxV4 := 1500 - 20 - 20 - fecSegmentOptions - fecShardHeaderLen - fecChecksumLen
+	if got := tun.maxFECShardSize(v4); got != maxV4 {
+		t.Fatalf("IPv4 shard limit %d, want %d", got, maxV4)
+	}
+	if got := tun.maxFECShardSize(v6); got != maxV4-20 {
+		t.Fatalf("IPv6 shard limit %d, want %d", got, maxV4-20)
+	}
+
+	ok := fecParams{dataShards: 10, parityShards: 3, shardSize: maxV4, codec: byte(fec.ReedSolomon)}
+	cases := []struct {
+		name   string
+		modify func(*fecParams)
+		peer   net.IP
+		reason string // Substring of the error, "" if accepted
+	}{
+		{"accepted", func(*fecParams) {}, v4, ""},
+		{"limits", func(p *fecParams) { p.dataShards, p.parityShards = 20, 10 }, v4, ""},
+		{"codec", func(p *fecParams) { p.codec = byte(fec.XOR) }, v4, "codec"},
+		{"no data shards", func(p *fecParams) { p.dataShards = 0 }, v4, "data shards"},
+		{"too many data shards", func(p *fecParams) { p.dataShards = 21 }, v4, "data shards"},
+		{"no parity shards", func(p *fecParams) { p.parityShards = 0 }, v4, "parity shards"},
+		{"too many parity shards", func(p *fecParams) { p.parityShards = 11 }, v4, "parity shards"},
+		{"shard size", func(p *fecParams) { p.shardSize++ }, v4, "shard size"},
+		{"shard size over IPv6", func(*fecParams) {}, v6, "shard size"},
+	}
+	for _, c := range cases {
+		p := ok
+		c.modify(&p)
+		err := tun.checkPeerFECParams(p, c.peer)
+		switch {
+		case c.reason == "" && err != nil:
+			t.Errorf("%s: rejected: %v", c.name, err)
+		case c.reason != "" && (err == nil || !strings.Contains(err.Error(), c.reason)):
+			t.Errorf("%s: got %v, want an error about %s", c.name, err, c.reason)
+		}
+	}
+}
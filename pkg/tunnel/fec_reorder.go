@@ -0,0 +1,199 @@
+package tunnel
+
+import (
+	"time"
+)
+
+// Reconstructed FEC groups are delivered in session order by the sequencer of
+// their peer (sequencer.go). A group that arrives ahead of a missing one is
+// held until the gap fills or the reorder hold time passes, after which the
+// missing groups are declared lost and skipped.
+//
+// The hold time is either fixed (fec_reorder_hold_ms) or adapted to the path:
+// auto mode tracks how long filled gaps actually took and grows quickly when a
+// group shows up after it was already skipped.
+
+const (
+	defaultFECReorderWindow  = 256
+	defaultFECGroupTimeoutMs = 2000
+	defaultFECReorderMaxMs   = 200
+
+	reorderHoldMin     = 2 * time.Millisecond
+	reorderDelayStart  = 10 * time.Millisecond // Initial auto estimate, close to the former fixed 20ms hold
+	reorderLateBackoff = 500 * time.Microsecond
+)
+
+type fecReorderBuffer struct {
+	next       uint32
+	pending    map[uint32][][]byte
+	lastUpdate time.Time
+	gapSince   time.Time
+	client     *ClientConnection // Owner of the groups (server mode)
+}
+
+func newFECReorderBuffer(first uint32, client *ClientConnection) *fecReorderBuffer {
+	return &fecReorderBuffer{
+		next:       first,
+		pending:    make(map[uint32][][]byte),
+		lastUpdate: time.Now(),
+		client:     client,
+	}
+}
+
+// seqBefore reports whether session a precedes b, allowing for wraparound
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// push adds a reconstructed group and returns the packets now deliverable in
+// order. late is set when the buffer had already skipped past the group; the
+// caller delivers those packets itself. skipped counts groups declared lost
+// because the group was beyond the window, the groups held behind them are
+// delivered; filled is how long a gap that this group closed had been open.
+func (b *fecReorderBuffer) push(sessionID uint32, pkts [][]byte, window int, now time.Time) (ready [][]byte, late bool, skipped uint64, filled time.Duration) {
+	if seqBefore(sessionID, b.next) {
+		return nil, true, 0, 0
+	}
+	b.lastUpdate = now
+
+	for !seqBefore(sessionID, b.next+uint32(window)) {
+		// Beyond the window: give up on the missing groups before this one,
+		// delivering those held behind them
+		lowest, ok := b.oldest()
+		if !ok || !seqBefore(lowest, sessionID) {
+			skipped += uint64(sessionID - b.next)
+			b.next = sessionID
+			break
+		}
+		skipped += uint64(lowest - b.next)
+		b.next = lowest
+		ready = append(ready, b.drain()...)
+		b.gapSince = time.Time{}
+	}
+	b.pending[sessionID] = pkts
+
+	gapOpen := !b.gapSince.IsZero()
+	ready = append(ready, b.drain()...)
+	if gapOpen && len(ready) > 0 {
+		filled = now.Sub(b.gapSince)
+	}
+	b.updateGap(now, len(ready) > 0)
+	return ready, false, skipped, filled
+}
+
+// expire skips the gap once it has been open for hold, returning the packets
+// that become deliverable and the number of groups declared lost
+func (b *fecReorderBuffer) expire(now time.Time, hold time.Duration) (ready [][]byte, skipped uint64) {
+	lowest, ok := b.oldest()
+	if !ok || b.gapSince.IsZero() || now.Sub(b.gapSince) < hold {
+		return nil, 0
+	}
+	skipped = uint64(lowest - b.next)
+	b.next = lowest
+	ready = b.drain()
+	b.updateGap(now, true)
+	return ready, skipped
+}
+
+// oldest returns the first of the held groups
+func (b *fecReorderBuffer) oldest() (lowest uint32, ok bool) {
+	for sid := range b.pending {
+		if !ok || seqBefore(sid, lowest) {
+			lowest, ok = sid, true
+		}
+	}
+	return lowest, ok
+}
+
+// drain removes the consecutive groups starting at next
+func (b *fecReorderBuffer) drain() [][]byte {
+	var ready [][]byte
+	for {
+		pkts, ok := b.pending[b.next]
+		if !ok {
+			return ready
+		}
+		ready = append(ready, pkts...)
+		delete(b.pending, b.next)
+		b.next++
+	}
+}
+
+// updateGap restarts the gap clock when groups are still waiting on a missing one
+func (b *fecReorderBuffer) updateGap(now time.Time, advanced bool) {
+	switch {
+	case len(b.pending) == 0:
+		b.gapSince = time.Time{}
+	case advanced || b.gapSince.IsZero():
+		b.gapSince = now
+	}
+}
+
+// fecReorderWindow is the number of groups that may be outstanding behind a gap
+func (t *Tunnel) fecReorderWindow() int {
+	if t.config.FECReorderWindow > 0 {
+		return t.config.FECReorderWindow
+	}
+	return defaultFECReorderWindow
+}
+
+// fecGroupTimeout is how long an incomplete group waits for more shards
+func (t *Tunnel) fecGroupTimeout() time.Duration {
+	if t.config.FECGroupTimeoutMs > 0 {
+		return time.Duration(t.config.FECGroupTimeoutMs) * time.Millisecond
+	}
+	return defaultFECGroupTimeoutMs * time.Millisecond
+}
+
+func (t *Tunnel) reorderHoldMax() time.Duration {
+	if t.config.FECReorderMaxMs > 0 {
+		return time.Duration(t.config.FECReorderMaxMs) * time.Millisecond
+	}
+	return defaultFECReorderMaxMs * time.Millisecond
+}
+
+// reorderHold is how long a gap is held open before the missing groups are skipped
+func (t *Tunnel) reorderHold() time.Duration {
+	if t.config.FECReorderHoldMs > 0 {
+		return time.Duration(t.config.FECReorderHoldMs) * time.Millisecond
+	}
+	delay := time.Duration(t.reorderDelay.Load())
+	if delay == 0 {
+		delay = reorderDelayStart
+	}
+	hold := 2*delay + reorderHoldMin
+	if max := t.reorderHoldMax(); hold > max {
+		hold = max
+	}
+	return hold
+}
+
+// sampleReorderDelay feeds how long a filled gap was open into the auto estimate
+func (t *Tunnel) sampleReorderDelay(filled time.Duration) {
+	if t.config.FECReorderHoldMs > 0 {
+		return
+	}
+	delay := t.reorderDelay.Load()
+	if delay == 0 {
+		delay = int64(reorderDelayStart)
+	}
+	t.reorderDelay.Store(delay - delay/8 + int64(filled)/8)
+}
+
+// noteLateGroup grows the auto estimate after a group arrived behind a skip,
+// since the hold was too short for this path
+func (t *Tunnel) noteLateGroup() {
+	t.statFECLateBatchDrop.Add(1)
+	if t.config.FECReorderHoldMs > 0 {
+		return
+	}
+	delay := t.reorderDelay.Load()
+	if delay == 0 {
+		delay = int64(reorderDelayStart)
+	}
+	delay = delay*3/2 + int64(reorderLateBackoff)
+	if ceiling := int64(t.reorderHoldMax() / 2); delay > ceiling {
+		delay = ceiling
+	}
+	t.reorderDelay.Store(delay)
+}
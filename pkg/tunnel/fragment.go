@@ -0,0 +1,324 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
+)
+
+// Inner packets larger than the tunnel MTU (jumbo frames on the TUN side, or a
+// path MTU that shrank while packets were queued) are split at the tunnel layer
+// instead of being dropped. The receiver reassembles the original packet, so the
+// inner IP header including DF is delivered unchanged.
+//
+// Fragment layout: [PacketTypeFragment][id:4][index:1][count:1][data]
+//
+// Peers that predate tunnel fragments drop them, so they are only sent to a
+// peer that announced its version (PacketTypeVersion came later than
+// fragments, so every peer announcing one reassembles them). Until then, and
+// for older peers, oversized IPv4 packets are split into IPv4 fragments as
+// before, for the receiving host to reassemble.
+
+const (
+	fragmentHeaderLen = 7
+	// maxFragments bounds the number of pieces per inner packet
+	maxFragments = 64
+	// fragmentReassemblyTimeout is how long an incomplete packet is kept
+	fragmentReassemblyTimeout = 3 * time.Second
+	// maxPendingReassemblies caps the reassembly table per sender
+	maxPendingReassemblies = 256
+)
+
+// isTunnelFrame reports whether a queued element already carries a tunnel packet
+// type. Inner IP packets start with version 4 or 6, tunnel types are all below.
+func isTunnelFrame(pkt []byte) bool {
+	return len(pkt) > 0 && pkt[0]>>4 < IPv4Version
+}
+
+// fragmentFrame splits packet into tunnel fragments whose plaintext fits the
+// same limit as a data packet for mtu. Fragments are freshly allocated and
+// already typed, so the writers send them as is.
+func (t *Tunnel) fragmentFrame(packet []byte, mtu int) ([][]byte, error) {
+	chunk := mtu + 1 - fragmentHeaderLen
+	if chunk <= 0 {
+		return nil, fmt.Errorf("MTU %d too small for fragmentation", mtu)
+	}
+	count := (len(packet) + chunk - 1) / chunk
+	if count > maxFragments {
+		return nil, fmt.Errorf("needs %d fragments at MTU %d (max %d)", count, mtu, maxFragments)
+	}
+
+	id := atomic.AddUint32(&t.fragmentID, 1)
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(packet) {
+			end = len(packet)
+		}
+		data := packet[i*chunk : end]
+		frag := make([]byte, fragmentHeaderLen+len(data))
+		frag[0] = PacketTypeFragment
+		binary.BigEndian.PutUint32(frag[1:5], id)
+		frag[5] = byte(i)
+		frag[6] = byte(count)
+		copy(frag[fragmentHeaderLen:], data)
+		fragments = append(fragments, frag)
+	}
+	return fragments, nil
+}
+
+// fragmentIPv4Packet splits an IPv4 packet into MTU-sized fragments.
+// Returns fragments with updated headers and checksums.
+func fragmentIPv4Packet(packet []byte, mtu int) ([][]byte, error) {
+	if len(packet) < IPv4MinHeaderLen {
+		return nil, errors.New("packet too small for IPv4")
+	}
+	if packet[0]>>4 != IPv4Version {
+		return nil, errors.New("not IPv4 packet")
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if ihl < IPv4MinHeaderLen || ihl > len(packet) {
+		return nil, errors.New("invalid IPv4 header length")
+	}
+	if mtu <= ihl+8 {
+		return nil, errors.New("MTU too small for fragmentation")
+	}
+
+	payload := packet[ihl:]
+	maxPayload := mtu - ihl
+	maxPayload &= ^7 // must be multiple of 8
+	if maxPayload <= 0 {
+		return nil, errors.New("invalid fragment payload size")
+	}
+
+	flagsOffset := binary.BigEndian.Uint16(packet[6:8])
+	reserved := flagsOffset & 0x8000
+	ident := packet[4:6]
+
+	var fragments [][]byte
+	for offset := 0; offset < len(payload); offset += maxPayload {
+		end := offset + maxPayload
+		if end > len(payload) {
+			end = len(payload)
+		}
+		fragPayload := payload[offset:end]
+
+		frag := make([]byte, ihl+len(fragPayload))
+		copy(frag[:ihl], packet[:ihl])
+		copy(frag[ihl:], fragPayload)
+
+		// Total length
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		// Identification
+		copy(frag[4:6], ident)
+
+		// Flags + Fragment offset
+		offsetUnits := uint16(offset / 8)
+		flagBits := reserved
+		if end < len(payload) {
+			flagBits |= 0x2000 // MF
+		}
+		binary.BigEndian.PutUint16(frag[6:8], flagBits|offsetUnits)
+
+		// Clear checksum and recalc
+		frag[10] = 0
+		frag[11] = 0
+		checksum := rawsocket.CalculateChecksum(frag[:ihl])
+		binary.BigEndian.PutUint16(frag[10:12], checksum)
+
+		fragments = append(fragments, frag)
+	}
+
+	return fragments, nil
+}
+
+// fragmentFor splits an oversized packet into tunnel fragments if the peer
+// reassembles them, otherwise into IPv4 fragments
+func (t *Tunnel) fragmentFor(packet []byte, mtu int, peerReassembles bool) ([][]byte, error) {
+	if peerReassembles {
+		return t.fragmentFrame(packet, mtu)
+	}
+	return fragmentIPv4Packet(packet, mtu)
+}
+
+// reassemblesFragments reports whether the client announced a version, and so
+// understands tunnel fragments
+func (c *ClientConnection) reassemblesFragments() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version != ""
+}
+
+// sendFragmentsToClient fragments an oversized packet read from TUN (server
+// mode) and queues the pieces for the client that owns its destination.
+func (t *Tunnel) sendFragmentsToClient(packet []byte, mtu int) {
+	if packet[0]>>4 != IPv4Version {
+		// Clients are addressed by IPv4 only; the packet could not be
+		// delivered at any size, but it is counted where users look
+		t.statOversizedDrop.Add(1)
+		return
+	}
+	dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+	client := t.getClientByIP(dstIP)
+	if client == nil {
+		client = t.findRouteClient(dstIP)
+	}
+	if client == nil {
+		return
+	}
+
+	fragments, err := t.fragmentFor(packet, mtu, client.reassemblesFragments())
+	if err != nil {
+		t.statOversizedDrop.Add(1)
+		log.Printf("⚠️  Failed to fragment oversized packet (%d bytes): %v", len(packet), err)
+		return
+	}
+	t.statFragmentsGenerated.Add(uint64(len(fragments)))
+
+	for _, frag := range fragments {
+		// CRITICAL FIX: Never block indefinitely on fragment forwarding
+		if !enqueueWithClientPolicy(client.sendQueue, frag, t.stopCh, client.stopCh, false) {
+			t.statQueueDropClientSend.Add(1)
+			log.Printf("⚠️  Client send queue full for %s after timeout, dropping fragment", dstIP)
+			return
+		}
+	}
+}
+
+// noteOversized warns the first time an inner packet exceeds the tunnel MTU,
+// since a steady stream of them usually means the TUN MTU or a route MTU is set
+// higher than the tunnel can carry.
+func (t *Tunnel) noteOversized(size, mtu int) {
+	if atomic.CompareAndSwapUint32(&t.oversizeWarned, 0, 1) {
+		log.Printf("⚠️  Inner packet of %d bytes exceeds tunnel MTU %d, fragmenting inside the tunnel (check the TUN/route MTU; see fragments= in Stats)", size, mtu)
+	}
+}
+
+// pendingFrame collects the fragments of one inner packet
+type pendingFrame struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// fragmentReassembler rebuilds inner packets from the fragments of one sender
+type fragmentReassembler struct {
+	mu        sync.Mutex
+	pending   map[uint32]*pendingFrame
+	lastSweep time.Time
+}
+
+func newFragmentReassembler() *fragmentReassembler {
+	return &fragmentReassembler{pending: make(map[uint32]*pendingFrame)}
+}
+
+// release drops the table of a sender with nothing pending; maps keep their
+// size after entries are deleted, so this frees what a burst grew (hibernation)
+func (r *fragmentReassembler) release() {
+	r.mu.Lock()
+	if len(r.pending) == 0 {
+		r.pending = nil
+	}
+	r.mu.Unlock()
+}
+
+// add stores one fragment (the payload after the packet type). When it completes
+// a packet, the packet is returned prefixed with PacketTypeData. expired is the
+// number of incomplete packets discarded by this call.
+func (r *fragmentReassembler) add(payload []byte, now time.Time) (packet []byte, expired int) {
+	if len(payload) < fragmentHeaderLen-1 {
+		return nil, 0
+	}
+	id := binary.BigEndian.Uint32(payload[0:4])
+	index := int(payload[4])
+	count := int(payload[5])
+	data := payload[fragmentHeaderLen-1:]
+	if count == 0 || count > maxFragments || index >= count {
+		return nil, 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) >= time.Second || len(r.pending) >= maxPendingReassemblies {
+		expired = r.sweep(now)
+	}
+
+	pf := r.pending[id]
+	if pf == nil {
+		if len(r.pending) >= maxPendingReassemblies {
+			return nil, expired + 1
+		}
+		pf = &pendingFrame{parts: make([][]byte, count), started: now}
+		if r.pending == nil {
+			r.pending = make(map[uint32]*pendingFrame)
+		}
+		r.pending[id] = pf
+	}
+	if len(pf.parts) != count {
+		delete(r.pending, id)
+		return nil, expired + 1
+	}
+	if pf.parts[index] != nil {
+		return nil, expired // duplicate
+	}
+	pf.parts[index] = append([]byte(nil), data...)
+	pf.received++
+	pf.size += len(data)
+	if pf.received < count {
+		return nil, expired
+	}
+
+	delete(r.pending, id)
+	packet = make([]byte, 1, 1+pf.size)
+	packet[0] = PacketTypeData
+	for _, part := range pf.parts {
+		packet = append(packet, part...)
+	}
+	return packet, expired
+}
+
+// sweep drops packets that did not complete within fragmentReassemblyTimeout.
+// When the table is still full, the oldest entry is dropped to make room.
+func (r *fragmentReassembler) sweep(now time.Time) int {
+	r.lastSweep = now
+	dropped := 0
+	var oldestID uint32
+	var oldest time.Time
+	for id, pf := range r.pending {
+		if now.Sub(pf.started) > fragmentReassemblyTimeout {
+			delete(r.pending, id)
+			dropped++
+			continue
+		}
+		if oldest.IsZero() || pf.started.Before(oldest) {
+			oldestID, oldest = id, pf.started
+		}
+	}
+	if len(r.pending) >= maxPendingReassemblies {
+		delete(r.pending, oldestID)
+		dropped++
+	}
+	return dropped
+}
+
+// reassembleFragment feeds a fragment into r and returns the completed packet,
+// if any, prefixed with PacketTypeData
+func (t *Tunnel) reassembleFragment(r *fragmentReassembler, payload []byte) []byte {
+	packet, expired := r.add(payload, time.Now())
+	if expired > 0 {
+		t.statFragmentsExpired.Add(uint64(expired))
+	}
+	if packet != nil {
+		t.statFragmentsReassembled.Add(1)
+	}
+	return packet
+}
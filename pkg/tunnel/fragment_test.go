@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// payloads strips the packet type from fragments, as the receivers do
+func payloads(fragments [][]byte) [][]byte {
+	out := make([][]byte, len(fragments))
+	for i, f := range fragments {
+		out[i] = f[1:]
+	}
+	return out
+}
+
+// TestFragmentReassembly splits a packet and feeds the pieces back in reverse
+// order with a duplicate in between
+func TestFragmentReassembly(t *testing.T) {
+	tun := &Tunnel{}
+	packet := smallPacket(5000)
+	for i := IPv4MinHeaderLen; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+	fragments, err := tun.fragmentFrame(packet, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 4 {
+		t.Fatalf("%d fragments, want 4", len(fragments))
+	}
+	for _, f := range fragments {
+		if len(f) > 1400+1 {
+			t.Fatalf("fragment of %d bytes exceeds a data packet at MTU 1400", len(f))
+		}
+	}
+
+	r := newFragmentReassembler()
+	now := time.Unix(1000, 0)
+	parts := payloads(fragments)
+	for i := len(parts) - 1; i > 0; i-- {
+		if got, _ := r.add(parts[i], now); got != nil {
+			t.Fatalf("packet completed early at piece %d", i)
+		}
+		if got, _ := r.add(parts[i], now); got != nil {
+			t.Fatal("duplicate completed the packet")
+		}
+	}
+	got, expired := r.add(parts[0], now)
+	if expired != 0 || got == nil || got[0] != PacketTypeData || !bytes.Equal(got[1:], packet) {
+		t.Fatalf("reassembled %d bytes (expired %d), want the original %d", len(got), expired, len(packet))
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("%d reassemblies left pending", len(r.pending))
+	}
+}
+
+// TestFragmentExpiry drops a packet that misses a piece for longer than
+// fragmentReassemblyTimeout, so a late piece starts over
+func TestFragmentExpiry(t *testing.T) {
+	tun := &Tunnel{}
+	fragments, err := tun.fragmentFrame(smallPacket(3000), 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := payloads(fragments)
+	r := newFragmentReassembler()
+	now := time.Unix(1000, 0)
+	r.add(parts[0], now)
+	r.add(parts[1], now)
+
+	now = now.Add(fragmentReassemblyTimeout + time.Second)
+	got, expired := r.add(parts[2], now)
+	if got != nil || expired != 1 {
+		t.Fatalf("late piece: packet %v, expired %d; want none and 1", got != nil, expired)
+	}
+}
+
+// TestFragmentPendingLimit fills the table and checks that the oldest
+// incomplete packet makes room for a new one
+func TestFragmentPendingLimit(t *testing.T) {
+	r := newFragmentReassembler()
+	now := time.Unix(1000, 0)
+	piece := func(id uint32, index, count byte) []byte {
+		p := make([]byte, fragmentHeaderLen-1+10)
+		binary.BigEndian.PutUint32(p[0:4], id)
+		p[4], p[5] = index, count
+		return p
+	}
+	for id := range uint32(maxPendingReassemblies) {
+		if _, expired := r.add(piece(id, 0, 2), now.Add(time.Duration(id)*time.Millisecond)); expired != 0 {
+			t.Fatalf("entry %d expired another below the limit", id)
+		}
+	}
+	_, expired := r.add(piece(maxPendingReassemblies, 0, 2), now.Add(time.Second))
+	if expired != 1 || len(r.pending) != maxPendingReassemblies {
+		t.Fatalf("over the limit: expired %d, %d pending", expired, len(r.pending))
+	}
+	if r.pending[0] != nil || r.pending[maxPendingReassemblies] == nil {
+		t.Error("the oldest entry was not the one dropped")
+	}
+}
+
+// TestMaxFragments refuses packets that need more than maxFragments pieces,
+// on both ends
+func TestMaxFragments(t *testing.T) {
+	tun := &Tunnel{}
+	const mtu = 100
+	chunk := mtu + 1 - fragmentHeaderLen
+	if _, err := tun.fragmentFrame(make([]byte, chunk*maxFragments), mtu); err != nil {
+		t.Fatalf("%d pieces refused: %v", maxFragments, err)
+	}
+	if _, err := tun.fragmentFrame(make([]byte, chunk*maxFragments+1), mtu); err == nil {
+		t.Fatalf("%d pieces accepted", maxFragments+1)
+	}
+
+	r := newFragmentReassembler()
+	bad := make([]byte, fragmentHeaderLen-1+10)
+	bad[4], bad[5] = 0, maxFragments+1
+	if got, _ := r.add(bad, time.Unix(1000, 0)); got != nil || len(r.pending) != 0 {
+		t.Error("piece of a packet with too many fragments was kept")
+	}
+}
+
+// TestFragmentIPv4 checks the fallback for peers without tunnel fragments
+func TestFragmentIPv4(t *testing.T) {
+	packet := smallPacket(3000)
+	fragments, err := fragmentIPv4Packet(packet, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for i, f := range fragments {
+		if len(f) > 1400 {
+			t.Errorf("fragment %d has %d bytes", i, len(f))
+		}
+		flags := binary.BigEndian.Uint16(f[6:8])
+		if more := flags&0x2000 != 0; more != (i < len(fragments)-1) {
+			t.Errorf("fragment %d: MF %v", i, more)
+		}
+		if int(flags&0x1FFF)*8 != total {
+			t.Errorf("fragment %d at offset %d, want %d", i, int(flags&0x1FFF)*8, total)
+		}
+		total += len(f) - IPv4MinHeaderLen
+	}
+	if total != len(packet)-IPv4MinHeaderLen {
+		t.Errorf("fragments carry %d bytes, want %d", total, len(packet)-IPv4MinHeaderLen)
+	}
+}
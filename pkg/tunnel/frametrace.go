@@ -0,0 +1,235 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// At log level trace (log_level, or PUT /loglevel on a running tunnel) every
+// tunnel frame this end sends or receives is logged, decoded, so protocol
+// problems can be watched live without a capture and a dissector:
+//
+//	TRACE -> 203.0.113.7:40112 [4f1c2a9b03de] fec_shard len=1313 group=0x6a1f03c2 index=3/4+2 shard=1300
+//	TRACE <- 198.51.100.1:443 data len=85 udp 10.0.0.2 -> 10.0.0.1 inner=84
+//
+// Frames are shown in plaintext: before encryption when sent, after
+// decryption when received. FEC shards, whose header is not encrypted, are
+// shown as written and read, and the packets they carry once more as data
+// frames. At most traceLinesPerSecond lines are logged; the number left out
+// is added to the next line.
+
+const (
+	LogLevelInfo  = "info"
+	LogLevelTrace = "trace"
+)
+
+const traceLinesPerSecond = 200
+
+// frameTracer decides which frames are traced
+type frameTracer struct {
+	enabled    atomic.Bool
+	mu         sync.Mutex
+	window     time.Time // Start of the current second
+	lines      int       // Lines logged in the current second
+	suppressed int       // Lines left out since the last one logged
+}
+
+// allow reports whether a line may be logged now and how many were left out
+// before it
+func (f *frameTracer) allow(now time.Time) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.window) >= time.Second {
+		f.window = now
+		f.lines = 0
+	}
+	if f.lines >= traceLinesPerSecond {
+		f.suppressed++
+		return 0, false
+	}
+	f.lines++
+	suppressed := f.suppressed
+	f.suppressed = 0
+	return suppressed, true
+}
+
+// LogLevel returns the current log level
+func (t *Tunnel) LogLevel() string {
+	if t.frameTrace.enabled.Load() {
+		return LogLevelTrace
+	}
+	return LogLevelInfo
+}
+
+// SetLogLevel changes the log level; trace turns on frame tracing
+func (t *Tunnel) SetLogLevel(level string) error {
+	switch level {
+	case LogLevelInfo:
+		t.frameTrace.enabled.Store(false)
+	case LogLevelTrace:
+		t.frameTrace.enabled.Store(true)
+	default:
+		return fmt.Errorf("unknown log level %q (use %s or %s)", level, LogLevelInfo, LogLevelTrace)
+	}
+	return nil
+}
+
+// traceFrame logs a frame sent to or received from client, or the server when
+// client is nil, at log level trace
+func (t *Tunnel) traceFrame(sent bool, client *ClientConnection, frame []byte) {
+	t.noteFirstFrame(sent, client, frame)
+	if !t.frameTrace.enabled.Load() {
+		return
+	}
+	suppressed, ok := t.frameTrace.allow(time.Now())
+	if !ok {
+		return
+	}
+	dir := "<-"
+	if sent {
+		dir = "->"
+	}
+	peer, session := t.config.RemoteAddr, t.SessionID()
+	if client != nil {
+		peer, session = client.conn.RemoteAddr().String(), client.sessionID
+	}
+	if session != "" {
+		peer += " [" + session + "]"
+	}
+	line := fmt.Sprintf("TRACE %s %s %s", dir, peer, describeFrame(frame))
+	if suppressed > 0 {
+		line += fmt.Sprintf(" (%d trace lines suppressed)", suppressed)
+	}
+	log.Print(line)
+}
+
+var frameTypeNames = map[byte]string{
+	PacketTypeData:            "data",
+	PacketTypeKeepalive:       "keepalive",
+	PacketTypePeerInfo:        "peer_info",
+	PacketTypeRouteInfo:       "route_info",
+	PacketTypePublicAddr:      "public_addr",
+	PacketTypePunch:           "punch",
+	PacketTypeConfigUpdate:    "config_update",
+	PacketTypeP2PRequest:      "p2p_request",
+	PacketTypeFECShard:        "fec_shard",
+	PacketTypeAuth:            "auth",
+	PacketTypeAuthResponse:    "auth_response",
+	PacketTypeDisconnect:      "disconnect",
+	PacketTypeMTUProbe:        "mtu_probe",
+	PacketTypeMTUProbeAck:     "mtu_probe_ack",
+	PacketTypeAggregate:       "aggregate",
+	PacketTypeFragment:        "fragment",
+	PacketTypeFECParams:       "fec_params",
+	PacketTypeFECShardChecked: "fec_shard_checked",
+	PacketTypeVersion:         "version",
+	PacketTypePeerHello:       "peer_hello",
+	PacketTypeClientPush:      "client_push",
+	PacketTypeServerList:      "server_list",
+	PacketTypeECNEcho:         "ecn_echo",
+	PacketTypeDropReport:      "drop_report",
+	PacketTypeKCP:             "kcp",
+	PacketTypeSessionID:       "session_id",
+	PacketTypeRenew:           "renew",
+	PacketTypeClockSync:       "clock_sync",
+	PacketTypePortHop:         "port_hop",
+}
+
+// describeFrame decodes the headers of a plaintext tunnel frame
+func describeFrame(frame []byte) string {
+	if len(frame) == 0 {
+		return "empty"
+	}
+	var b strings.Builder
+	if name, ok := frameTypeNames[frame[0]]; ok {
+		b.WriteString(name)
+	} else {
+		fmt.Fprintf(&b, "type=%#02x", frame[0])
+	}
+	fmt.Fprintf(&b, " len=%d", len(frame))
+	body := frame[1:]
+
+	switch frame[0] {
+	case PacketTypeData:
+		b.WriteString(describeInner(body))
+	case PacketTypeAggregate:
+		var sizes []string
+		for rest := body; len(rest) >= 2; {
+			n := int(binary.BigEndian.Uint16(rest))
+			if len(rest) < 2+n {
+				sizes = append(sizes, "truncated")
+				break
+			}
+			sizes = append(sizes, fmt.Sprint(n))
+			rest = rest[2+n:]
+		}
+		fmt.Fprintf(&b, " packets=%d sizes=%s", len(sizes), strings.Join(sizes, ","))
+	case PacketTypeFragment:
+		if len(body) >= 6 {
+			fmt.Fprintf(&b, " id=%d index=%d/%d data=%d", binary.BigEndian.Uint32(body), body[4], body[5], len(body)-6)
+		}
+	case PacketTypeFECShardChecked, PacketTypeFECShard:
+		if frame[0] == PacketTypeFECShardChecked {
+			if len(body) < fecChecksumLen {
+				break
+			}
+			body = body[fecChecksumLen:] // The CRC replaces the shard type
+		}
+		if len(body) >= fecShardHeaderLen-1 {
+			fmt.Fprintf(&b, " group=%#08x index=%d/%d+%d shard=%d",
+				binary.BigEndian.Uint32(body), binary.BigEndian.Uint16(body[4:]),
+				binary.BigEndian.Uint16(body[6:]), binary.BigEndian.Uint16(body[8:]),
+				binary.BigEndian.Uint16(body[10:]))
+		}
+	case PacketTypeKeepalive:
+		if len(body) == keepaliveRTTLen {
+			kind := "probe"
+			if body[0] == keepaliveEcho {
+				kind = "echo"
+			}
+			fmt.Fprintf(&b, " %s clock=%d", kind, binary.BigEndian.Uint64(body[1:]))
+		}
+	case PacketTypeKCP:
+		// First segment of the ikcp header: conv:4 cmd:1 frg:1 wnd:2 ts:4 sn:4 una:4 len:4
+		if len(body) >= 24 {
+			fmt.Fprintf(&b, " conv=%d cmd=%d sn=%d una=%d data=%d",
+				binary.LittleEndian.Uint32(body), body[4], binary.LittleEndian.Uint32(body[12:]),
+				binary.LittleEndian.Uint32(body[16:]), binary.LittleEndian.Uint32(body[20:]))
+		}
+	case PacketTypeDropReport, PacketTypeECNEcho:
+		if len(body) == 8 {
+			fmt.Fprintf(&b, " count=%d", binary.BigEndian.Uint64(body))
+		}
+	case PacketTypeDisconnect:
+		if len(body) >= 1 {
+			fmt.Fprintf(&b, " reason=%q", DisconnectReason(body[0]).String())
+		}
+	case PacketTypeSessionID, PacketTypeVersion, PacketTypeRenew:
+		fmt.Fprintf(&b, " %q", body[:min(len(body), 64)])
+	}
+	return b.String()
+}
+
+// describeInner summarizes the inner IPv4 packet of a data frame
+func describeInner(packet []byte) string {
+	if len(packet) < IPv4MinHeaderLen || packet[0]>>4 != IPv4Version {
+		return fmt.Sprintf(" inner=%d", len(packet))
+	}
+	proto := fmt.Sprintf("proto=%d", packet[IPv4ProtocolOffset])
+	switch packet[IPv4ProtocolOffset] {
+	case 1:
+		proto = "icmp"
+	case 6:
+		proto = "tcp"
+	case 17:
+		proto = "udp"
+	}
+	return fmt.Sprintf(" %s %s -> %s inner=%d", proto,
+		net.IP(packet[IPv4SrcIPOffset:IPv4SrcIPOffset+4]), net.IP(packet[IPv4DstIPOffset:IPv4DstIPOffset+4]), len(packet))
+}
@@ -0,0 +1,318 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Servers sharing clients, e.g. behind DNS round-robin, tell each other they
+// are alive: every gossipInterval each server sends the servers in
+// gossip_peers a datagram on gossip_listen with the address clients reach it
+// at and its client count, authenticated with the tunnel key:
+//
+//	[HMAC-SHA256 of JSON:32][JSON gossipMessage]
+//
+// A client with server_failover asks its server which of the others are alive
+// (a PacketTypeServerList request without payload) and, when its server stops
+// answering, dials those instead of waiting for remote_addr to come back.
+// The answer lists the live servers with room for clients, least loaded
+// first:
+//
+//	[PacketTypeServerList][JSON []api.ServerHealth]
+//
+// Servers without gossip support ignore the request.
+
+const (
+	gossipInterval    = 5 * time.Second
+	gossipTimeout     = 3 * gossipInterval // A server not heard from for this long is down
+	gossipMaxSkew     = 30 * time.Second   // Older (replayed) or future messages are dropped
+	maxGossipSize     = 1024
+	serverListRefresh = 30 * time.Second
+)
+
+// gossipMessage is one server's liveness announcement
+type gossipMessage struct {
+	Addr       string `json:"addr"` // Tunnel address; the host is the datagram's source when empty
+	Clients    int    `json:"clients"`
+	MaxClients int    `json:"max_clients"`
+	Time       int64  `json:"time"` // Unix seconds
+}
+
+// gossipPeer is what a server last heard from another one
+type gossipPeer struct {
+	addr       string
+	clients    int
+	maxClients int
+	lastSeen   time.Time
+}
+
+// gossipState is the liveness exchange of a server
+type gossipState struct {
+	conn  net.PacketConn
+	mu    sync.Mutex
+	peers map[string]*gossipPeer // By gossip address
+}
+
+// gossipMAC authenticates a gossip message with the current tunnel key
+func (t *Tunnel) gossipMAC(data []byte) []byte {
+	t.configMux.RLock()
+	key := t.config.Key
+	t.configMux.RUnlock()
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// startGossip starts the liveness exchange on gossip_listen (server mode)
+func (t *Tunnel) startGossip() error {
+	conn, err := net.ListenPacket("udp", t.config.GossipListen)
+	if err != nil {
+		return err
+	}
+	g := &gossipState{conn: conn, peers: make(map[string]*gossipPeer)}
+	t.gossipMux.Lock()
+	if old := t.gossip; old != nil {
+		g.peers = old.peers // Resumed after a failed handoff
+	}
+	t.gossip = g
+	t.gossipMux.Unlock()
+	log.Printf("Exchanging liveness with %d servers on %s", len(t.config.GossipPeers), conn.LocalAddr())
+
+	go t.gossipReceiver(g)
+	t.wg.Add(1)
+	go t.gossipSender(g)
+	return nil
+}
+
+// stopGossip closes the gossip socket; its goroutines exit
+func (t *Tunnel) stopGossip() {
+	t.gossipMux.Lock()
+	defer t.gossipMux.Unlock()
+	if t.gossip != nil {
+		t.gossip.conn.Close()
+	}
+}
+
+func (t *Tunnel) gossipSender(g *gossipState) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.sendGossip(g); errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendGossip announces this server to every gossip peer
+func (t *Tunnel) sendGossip(g *gossipState) error {
+	msg := gossipMessage{Addr: t.config.AdvertiseAddr, MaxClients: t.config.MaxClients, Time: time.Now().Unix()}
+	if msg.Addr == "" {
+		msg.Addr = fmt.Sprintf(":%d", t.outerPort)
+	}
+	t.clientsMux.RLock()
+	msg.Clients = len(t.clients)
+	t.clientsMux.RUnlock()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	packet := append(t.gossipMAC(data), data...)
+
+	for _, peer := range t.config.GossipPeers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			log.Printf("⚠️  Failed to resolve gossip peer %s: %v", peer, err)
+			continue
+		}
+		if _, err := g.conn.WriteTo(packet, addr); errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tunnel) gossipReceiver(g *gossipState) {
+	buf := make([]byte, maxGossipSize)
+	for {
+		n, from, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n <= sha256.Size || !hmac.Equal(buf[:sha256.Size], t.gossipMAC(buf[sha256.Size:n])) {
+			continue
+		}
+		var msg gossipMessage
+		if err := json.Unmarshal(buf[sha256.Size:n], &msg); err != nil {
+			continue
+		}
+		if skew := time.Since(time.Unix(msg.Time, 0)); skew > gossipMaxSkew || skew < -gossipMaxSkew {
+			continue
+		}
+		host, port, err := net.SplitHostPort(msg.Addr)
+		if err != nil {
+			continue
+		}
+		if host == "" {
+			host = from.(*net.UDPAddr).IP.String()
+		}
+
+		g.mu.Lock()
+		peer, ok := g.peers[from.String()]
+		if !ok {
+			peer = &gossipPeer{}
+			g.peers[from.String()] = peer
+		}
+		if time.Since(peer.lastSeen) > gossipTimeout {
+			log.Printf("Server %s is alive (%d clients)", net.JoinHostPort(host, port), msg.Clients)
+		}
+		peer.addr = net.JoinHostPort(host, port)
+		peer.clients = msg.Clients
+		peer.maxClients = msg.MaxClients
+		peer.lastSeen = time.Now()
+		g.mu.Unlock()
+	}
+}
+
+// gossipPeers returns what this server knows about the others (server mode)
+func (t *Tunnel) gossipPeers() []api.ServerHealth {
+	t.gossipMux.Lock()
+	g := t.gossip
+	t.gossipMux.Unlock()
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	servers := make([]api.ServerHealth, 0, len(g.peers))
+	for _, p := range g.peers {
+		servers = append(servers, api.ServerHealth{
+			Addr:       p.addr,
+			Alive:      time.Since(p.lastSeen) <= gossipTimeout,
+			Clients:    p.clients,
+			MaxClients: p.maxClients,
+			LastSeen:   p.lastSeen,
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Addr < servers[j].Addr })
+	return servers
+}
+
+// handleServerListRequest answers a client with the live servers that have
+// room for it (server mode)
+func (t *Tunnel) handleServerListRequest(client *ClientConnection) {
+	alive := []api.ServerHealth{}
+	for _, s := range t.gossipPeers() {
+		if s.Alive && (s.MaxClients <= 0 || s.Clients < s.MaxClients) {
+			alive = append(alive, s)
+		}
+	}
+	sort.SliceStable(alive, func(i, j int) bool { return alive[i].Clients < alive[j].Clients })
+	payload, err := json.Marshal(alive)
+	if err != nil {
+		return
+	}
+	encrypted, err := t.encryptForClient(client, append([]byte{PacketTypeServerList}, payload...))
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send server list to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// serverListLoop asks the server for the live alternatives now and then
+// (client mode with server_failover)
+func (t *Tunnel) serverListLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(serverListRefresh)
+	defer ticker.Stop()
+	for {
+		t.connMux.Lock()
+		conn := t.conn
+		t.connMux.Unlock()
+		if conn != nil {
+			if encrypted, err := t.encryptPacket([]byte{PacketTypeServerList}); err == nil {
+				conn.WritePacket(encrypted)
+			}
+		}
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleServerList records the live alternatives the server reported (client mode)
+func (t *Tunnel) handleServerList(payload []byte) {
+	var servers []api.ServerHealth
+	if err := json.Unmarshal(payload, &servers); err != nil {
+		log.Printf("Failed to parse server list: %v", err)
+		return
+	}
+	t.altServers.Store(servers)
+}
+
+// alternativeServers returns the live servers last reported (client mode)
+func (t *Tunnel) alternativeServers() []api.ServerHealth {
+	servers, _ := t.altServers.Load().([]api.ServerHealth)
+	return servers
+}
+
+// dialServer dials remote_addr and, with server_failover, the live
+// alternatives when that fails. They go first once the server stopped
+// answering, as dialing it may still succeed (UDP mode).
+func (t *Tunnel) dialServer(timeout time.Duration, mode faketcp.Mode) (faketcp.ConnAdapter, error) {
+	if !t.config.ServerFailover {
+		return t.dialRemote(timeout, mode)
+	}
+	if t.serverSilent.Swap(false) {
+		if conn, err := t.dialAlternative(timeout, mode); err == nil {
+			return conn, nil
+		}
+	}
+	conn, err := t.dialRemote(timeout, mode)
+	if err == nil {
+		return conn, nil
+	}
+	log.Printf("Failed to reach %s: %v", t.config.RemoteAddr, err)
+	return t.dialAlternative(timeout, mode)
+}
+
+// dialAlternative dials the servers reported alive, least loaded first, and
+// returns the first that answers (client mode with server_failover)
+func (t *Tunnel) dialAlternative(timeout time.Duration, mode faketcp.Mode) (faketcp.ConnAdapter, error) {
+	servers := t.alternativeServers()
+	if len(servers) == 0 {
+		return nil, errors.New("no alternative server known to be alive")
+	}
+	for _, s := range servers {
+		log.Printf("Failing over to server %s (%d clients)", s.Addr, s.Clients)
+		conn, err := faketcp.DialWithMode(s.Addr, timeout, mode)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("Failover to %s failed: %v", s.Addr, err)
+	}
+	return nil, errors.New("no alternative server answered")
+}
@@ -0,0 +1,360 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// A configuration with a tunnels object runs several tunnels in one process.
+// Each section is a complete configuration with its own listener or server,
+// TUN device, sessions and counters, and can be stopped and started again
+// without touching the others. The forged TCP segments are configured for
+// the whole process (see configureFakeTCP), so the sections must agree on
+// those settings. The admin API of the top-level admin_listen serves:
+//
+//	GET  /tunnels                  the tunnels, running or not
+//	POST /tunnels/{name}/start     start a stopped tunnel
+//	POST /tunnels/{name}/stop      stop a running tunnel
+//	POST /tunnels/{name}/restart   stop it and start it again
+//	     /tunnels/{name}/...       the tunnel's own admin API (/status, /peers, /conn, ...)
+//	GET  /debug/pprof/...          Go runtime profiles of the process
+
+var errTunnelNotRunning = errors.New("tunnel is not running")
+
+// Group runs the named tunnels of a configuration
+type Group struct {
+	config *config.Config
+	names  []string // Sorted
+
+	mu          sync.Mutex
+	members     map[string]*groupMember
+	adminServer *http.Server
+}
+
+type groupMember struct {
+	config  *config.Config
+	tun     *Tunnel // nil while stopped
+	mux     *http.ServeMux
+	started time.Time
+	err     error // Why the tunnel last failed to start or ended on its own
+}
+
+// processWide returns the settings applied to the whole process, which the
+// tunnels of a group must share
+func processWide(cfg *config.Config) map[string]any {
+	return map[string]any{
+		"netns":                cfg.NetNS,
+		"tcp_personality":      cfg.TCPPersonality,
+		"trace_seconds":        cfg.TraceSeconds,
+		"trace_payload":        cfg.TracePayload,
+		"ip_options":           cfg.IPOptions,
+		"ip_id":                cfg.IPID,
+		"strict_validation":    cfg.StrictValidation,
+		"ecn":                  cfg.ECN,
+		"ttl":                  cfg.TTL,
+		"dscp":                 cfg.DSCP,
+		"ecn_codepoint":        cfg.ECNCodepoint,
+		"handshake_cookies":    cfg.HandshakeCookies,
+		"duplicate":            cfg.Duplicate,
+		"duplicate_spacing_us": cfg.DuplicateSpacingUs,
+		"faketcp_pacing_us":    cfg.FakeTCPWritePacingUs,
+		"faketcp_max_segment":  cfg.FakeTCPMaxSegment,
+		"recv_mtu":             cfg.RecvMTU,
+		"lb_workers":           cfg.LBWorkers,
+		"lb_worker_id":         cfg.LBWorkerID,
+		"afxdp_interfaces":     cfg.AFXDPInterfaces,
+		"packet_ring":          cfg.PacketRing,
+		"enable_kernel_tune":   cfg.EnableKernelTune,
+	}
+}
+
+// exclusive returns the resources a tunnel holds alone (empty = none)
+func exclusive(cfg *config.Config) map[string]string {
+	r := map[string]string{
+		"tun_name":         cfg.TunName,
+		"admin_listen":     cfg.AdminListen,
+		"health_listen":    cfg.HealthListen,
+		"broker_socket":    cfg.BrokerSocket,
+		"state_cache":      cfg.StateCacheFile,
+		"audit_log":        cfg.AuditLog,
+		"accounting_spool": cfg.AccountingSpool,
+	}
+	if cfg.Mode != "client" {
+		r["local_addr"] = cfg.LocalAddr
+	}
+	if cfg.NATReflector != "" {
+		r["nat_reflector"] = cfg.NATReflector
+	}
+	if cfg.P2PEnabled && cfg.P2PPort != 0 {
+		r["p2p_port"] = fmt.Sprint(cfg.P2PPort)
+	}
+	return r
+}
+
+// NewGroup checks that the tunnels of cfg can run side by side
+func NewGroup(cfg *config.Config) (*Group, error) {
+	g := &Group{config: cfg, members: make(map[string]*groupMember)}
+	for name := range cfg.Tunnels {
+		g.names = append(g.names, name)
+	}
+	slices.Sort(g.names)
+	if len(g.names) == 0 {
+		return nil, fmt.Errorf("no tunnels configured")
+	}
+
+	first := cfg.Tunnels[g.names[0]]
+	shared := processWide(first)
+	held := make(map[string]string) // "setting=value" -> tunnel
+	var networks []*net.IPNet
+	var networkOwners []string
+	for _, name := range g.names {
+		c := cfg.Tunnels[name]
+		if c.UpgradeSocket != "" {
+			return nil, fmt.Errorf("tunnel %s: hitless upgrades (upgrade_socket) are not supported with named tunnels", name)
+		}
+		if WireGuardPassthrough(c) {
+			return nil, fmt.Errorf("tunnel %s: WireGuard passthrough is not supported with named tunnels", name)
+		}
+		for key, value := range processWide(c) {
+			if !reflect.DeepEqual(value, shared[key]) {
+				return nil, fmt.Errorf("tunnels %s and %s differ in %s, which applies to the whole process", g.names[0], name, key)
+			}
+		}
+		for key, value := range exclusive(c) {
+			if value == "" {
+				continue
+			}
+			if other, ok := held[key+"="+value]; ok {
+				return nil, fmt.Errorf("tunnels %s and %s both use %s %s", other, name, key, value)
+			}
+			held[key+"="+value] = name
+		}
+		if _, network, err := net.ParseCIDR(c.TunnelAddr); err == nil {
+			for i, n := range networks {
+				if n.Contains(network.IP) || network.Contains(n.IP) {
+					return nil, fmt.Errorf("tunnel networks of %s (%s) and %s (%s) overlap", networkOwners[i], n, name, network)
+				}
+			}
+			networks = append(networks, network)
+			networkOwners = append(networkOwners, name)
+		}
+		g.members[name] = &groupMember{config: c}
+	}
+	return g, nil
+}
+
+// Names returns the names of the tunnels, sorted
+func (g *Group) Names() []string {
+	return g.names
+}
+
+// Tunnel returns the named tunnel, nil if it is not running
+func (g *Group) Tunnel(name string) *Tunnel {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m := g.members[name]; m != nil {
+		return m.tun
+	}
+	return nil
+}
+
+// Start starts every tunnel and the admin API; if one fails, those started
+// are stopped again
+func (g *Group) Start() error {
+	for _, name := range g.names {
+		if err := g.StartTunnel(name); err != nil {
+			g.Stop()
+			return fmt.Errorf("tunnel %s: %v", name, err)
+		}
+	}
+	if g.config.AdminListen != "" {
+		server, err := serveAdmin(g.config, g.adminMux())
+		if err != nil {
+			g.Stop()
+			return fmt.Errorf("failed to start admin API: %v", err)
+		}
+		g.mu.Lock()
+		g.adminServer = server
+		g.mu.Unlock()
+	}
+	return nil
+}
+
+// StartTunnel starts the named tunnel with its configuration
+func (g *Group) StartTunnel(name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := g.members[name]
+	if m == nil {
+		return fmt.Errorf("no tunnel named %q", name)
+	}
+	if m.tun != nil {
+		return fmt.Errorf("tunnel %s is running", name)
+	}
+
+	log.Printf("Starting tunnel %s (%s mode)", name, m.config.Mode)
+	cfg := *m.config // NewTunnel adjusts its configuration; a restart starts from the file's
+	tun, err := NewTunnel(&cfg, "")
+	if err == nil {
+		if err = tun.Start(); err != nil {
+			tun.Stop()
+		}
+	}
+	if err != nil {
+		m.err = err
+		return err
+	}
+	m.tun, m.mux, m.started, m.err = tun, tun.adminMux(), time.Now(), nil
+	go g.watch(name, tun)
+	return nil
+}
+
+// watch notes a tunnel that ended on its own, e.g. a client the server told
+// not to reconnect
+func (g *Group) watch(name string, tun *Tunnel) {
+	<-tun.Done()
+	g.mu.Lock()
+	m := g.members[name]
+	ended := m.tun == tun
+	if ended {
+		m.tun, m.mux = nil, nil
+		m.err = tun.Err()
+	}
+	g.mu.Unlock()
+	if ended {
+		tun.Stop() // Tears down what is left, as the command line does
+		if err := tun.Err(); err != nil {
+			log.Printf("⚠️  Tunnel %s stopped: %v", name, err)
+		} else {
+			log.Printf("Tunnel %s stopped", name)
+		}
+	}
+}
+
+// StopTunnel stops the named tunnel; the others keep running
+func (g *Group) StopTunnel(name string) error {
+	g.mu.Lock()
+	m := g.members[name]
+	if m == nil {
+		g.mu.Unlock()
+		return fmt.Errorf("no tunnel named %q", name)
+	}
+	tun := m.tun
+	m.tun, m.mux = nil, nil
+	g.mu.Unlock()
+	if tun == nil {
+		return errTunnelNotRunning
+	}
+	log.Printf("Stopping tunnel %s", name)
+	tun.Stop()
+	return nil
+}
+
+// Stop stops the admin API and every tunnel
+func (g *Group) Stop() {
+	g.mu.Lock()
+	if g.adminServer != nil {
+		g.adminServer.Close()
+		g.adminServer = nil
+	}
+	g.mu.Unlock()
+	for _, name := range g.names {
+		_ = g.StopTunnel(name)
+	}
+}
+
+// Status describes the tunnels of the group, served at GET /tunnels
+func (g *Group) Status() []api.TunnelInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	infos := make([]api.TunnelInfo, 0, len(g.names))
+	for _, name := range g.names {
+		m := g.members[name]
+		info := api.TunnelInfo{Name: name, Mode: m.config.Mode, Running: m.tun != nil}
+		if m.tun != nil {
+			info.Started = m.started
+		}
+		if m.err != nil {
+			info.Error = m.err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// adminMux routes the group's admin API requests
+func (g *Group) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, g.Status())
+	})
+	mux.HandleFunc("POST /tunnels/{name}/{action}", g.handleLifecycle)
+	mux.HandleFunc("/tunnels/{name}/", g.handleTunnel)
+	addPprof(mux)
+	return mux
+}
+
+func (g *Group) handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var err error
+	switch r.PathValue("action") {
+	case "start":
+		err = g.StartTunnel(name)
+	case "stop":
+		err = g.StopTunnel(name)
+	case "restart":
+		if err = g.StopTunnel(name); err == nil || err == errTunnelNotRunning {
+			err = g.StartTunnel(name)
+		}
+	default:
+		g.handleTunnel(w, r) // e.g. POST /tunnels/{name}/impair
+		return
+	}
+	if err != nil {
+		status := http.StatusConflict
+		if g.members[name] == nil {
+			status = http.StatusNotFound
+		}
+		writeJSONError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.Status())
+}
+
+// handleTunnel passes a request to the admin API of the named tunnel
+func (g *Group) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	g.mu.Lock()
+	m := g.members[name]
+	var mux *http.ServeMux
+	if m != nil {
+		mux = m.mux
+	}
+	g.mu.Unlock()
+	switch {
+	case m == nil:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no tunnel named %q", name))
+	case mux == nil:
+		writeJSONError(w, http.StatusConflict, errTunnelNotRunning)
+	default:
+		http.StripPrefix("/tunnels/"+name, mux).ServeHTTP(w, r)
+	}
+}
+
+// tunnelPrefix prefixes a named tunnel's periodic log lines
+func (t *Tunnel) tunnelPrefix() string {
+	if t.config.Name == "" {
+		return ""
+	}
+	return "[" + t.config.Name + "] "
+}
@@ -0,0 +1,435 @@
+package tunnel
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// A server upgrades without dropping its clients by handing everything they
+// depend on to the new binary. The running server listens on upgrade_socket;
+// the new process, started with -takeover, connects to it. After checking the
+// peer's credentials (SO_PEERCRED: same user or root) the old server stops
+// receiving and sends, in one message, the TUN device and listening socket as
+// SCM_RIGHTS descriptors followed by the session state as JSON:
+//
+//	[length:4][state JSON]   + SCM_RIGHTS [tun fd, listener fd]
+//
+// The new process adopts the sessions, starts serving and answers with one
+// ack byte, upon which the old process exits without tearing anything down.
+// Without an ack the old process resumes receiving and keeps serving.
+
+const (
+	handoffFormat     = 1
+	handoffAck        = 'K'
+	handoffAckTimeout = 30 * time.Second
+	maxHandoffState   = 64 << 20
+)
+
+// handoffState is the server state passed to the successor
+type handoffState struct {
+	Format   int             `json:"format"`
+	Version  string          `json:"version"`
+	RawMode  bool            `json:"raw_mode"`
+	TunName  string          `json:"tun_name"`
+	Key      string          `json:"key,omitempty"` // Current key, which may have rotated since startup
+	Sessions []handoffClient `json:"sessions"`
+	Sysctl   map[string]int  `json:"sysctl,omitempty"` // Kernel settings changed by fix_sysctl, with their original values
+}
+
+// handoffClient is one client session
+type handoffClient struct {
+	Transport     faketcp.Session `json:"transport"`
+	TunnelIP      string          `json:"tunnel_ip,omitempty"`
+	Authenticated bool            `json:"authenticated,omitempty"`
+	Identity      string          `json:"identity,omitempty"`
+	CertDER       []byte          `json:"cert_der,omitempty"`
+	ShardChecksum uint32          `json:"shard_checksum,omitempty"`
+	Version       string          `json:"version,omitempty"`
+	FECSessionID  uint32          `json:"fec_session_id"`
+	PeerInfo      string          `json:"peer_info,omitempty"`
+	Routes        []string        `json:"routes,omitempty"`
+	ConnectedAt   time.Time       `json:"connected_at"`
+	SessionID     string          `json:"session_id,omitempty"`
+}
+
+// takeoverState is a received handoff waiting for startServer to resume it
+type takeoverState struct {
+	conn  *net.UnixConn
+	state handoffState
+}
+
+// HandedOff returns a channel that is closed once a new process took over the
+// sessions; the caller should then exit without calling Stop
+func (t *Tunnel) HandedOff() <-chan struct{} {
+	return t.handedOff
+}
+
+// listenUpgradeSocket accepts successor processes on upgrade_socket
+func (t *Tunnel) listenUpgradeSocket() error {
+	path := t.config.UpgradeSocket
+	// A predecessor that handed off leaves its socket file behind
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	t.upgradeListener = ln
+	log.Printf("Accepting upgrades on %s", path)
+
+	go func() {
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				return
+			}
+			err = t.handOff(conn)
+			conn.Close()
+			if err != nil {
+				log.Printf("⚠️  Upgrade handoff failed, continuing to serve: %v", err)
+				continue
+			}
+			return
+		}
+	}()
+	return nil
+}
+
+func (t *Tunnel) stopUpgradeSocket() {
+	if t.upgradeListener != nil {
+		t.upgradeListener.Close()
+	}
+}
+
+// checkPeerCred accepts only a process of the same user or root
+func checkPeerCred(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("SO_PEERCRED: %v", credErr)
+	}
+	if cred.Uid != 0 && int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("refusing process %d of uid %d", cred.Pid, cred.Uid)
+	}
+	return nil
+}
+
+// handOff passes the sessions to the process on conn (server mode)
+func (t *Tunnel) handOff(conn *net.UnixConn) error {
+	if err := checkPeerCred(conn); err != nil {
+		return err
+	}
+	listener, ok := t.listener.(faketcp.HandoffListener)
+	if !ok {
+		return errors.New("listener does not support handoff")
+	}
+	tunFile, err := t.tunFile.dupFile()
+	if err != nil {
+		return fmt.Errorf("failed to duplicate TUN descriptor: %v", err)
+	}
+	defer tunFile.Close()
+
+	log.Printf("Handing sessions to new process")
+	// The successor binds the admin, health and gossip addresses itself
+	t.stopAdmin()
+	t.stopHealth()
+	t.stopGossip()
+	// The successor reports the sessions' traffic from here on
+	t.stopAccounting(false)
+	listenerFile, sessions, err := listener.Detach()
+	if err != nil {
+		t.resumeAfterHandoff(listener)
+		return err
+	}
+	defer listenerFile.Close()
+
+	err = sendHandoff(conn, t.handoffState(sessions), tunFile, listenerFile)
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(handoffAckTimeout))
+		ack := make([]byte, 1)
+		if _, err = io.ReadFull(conn, ack); err == nil && ack[0] != handoffAck {
+			err = errors.New("unexpected acknowledgement")
+		}
+	}
+	if err != nil {
+		t.resumeAfterHandoff(listener)
+		return err
+	}
+	log.Printf("✅ New process took over %d sessions", len(sessions))
+	close(t.handedOff)
+	return nil
+}
+
+// resumeAfterHandoff restores serving after a failed handoff
+func (t *Tunnel) resumeAfterHandoff(listener faketcp.HandoffListener) {
+	if err := listener.Resume(); err != nil {
+		log.Printf("❌ Failed to resume listener: %v", err)
+	}
+	if t.config.AdminListen != "" {
+		if err := t.startAdmin(); err != nil {
+			log.Printf("⚠️  Failed to restart admin API: %v", err)
+		}
+	}
+	if t.config.HealthListen != "" {
+		if err := t.startHealth(); err != nil {
+			log.Printf("⚠️  Failed to restart health endpoints: %v", err)
+		}
+	}
+	if t.config.GossipListen != "" {
+		if err := t.startGossip(); err != nil {
+			log.Printf("⚠️  Failed to restart server gossip: %v", err)
+		}
+	}
+	if t.config.AccountingSink != "" {
+		if err := t.startAccounting(); err != nil {
+			log.Printf("⚠️  Failed to restart usage accounting: %v", err)
+		}
+	}
+}
+
+// handoffState collects the state of the clients owning sessions
+func (t *Tunnel) handoffState(sessions []faketcp.Session) handoffState {
+	state := handoffState{
+		Format:  handoffFormat,
+		Version: Version,
+		RawMode: faketcp.GetMode() == faketcp.ModeRaw,
+		TunName: t.tunName,
+		Sysctl:  t.savedSysctls(),
+	}
+	t.configMux.RLock()
+	state.Key = t.config.Key
+	t.configMux.RUnlock()
+
+	byAddr := make(map[string]*ClientConnection)
+	t.allClientsMux.RLock()
+	for client := range t.allClients {
+		byAddr[client.conn.RemoteAddr().String()] = client
+	}
+	t.allClientsMux.RUnlock()
+
+	for _, session := range sessions {
+		client, ok := byAddr[session.RemoteAddr]
+		if !ok {
+			continue // Still handshaking
+		}
+		hc := handoffClient{
+			Transport:     session,
+			ShardChecksum: atomic.LoadUint32(&client.shardChecksum),
+			FECSessionID:  atomic.LoadUint32(&client.fecSessionID),
+		}
+		client.mu.RLock()
+		hc.Authenticated = client.authenticated
+		hc.Identity = client.identity
+		if client.cert != nil {
+			hc.CertDER = client.cert.Raw
+		}
+		hc.Version = client.version
+		hc.PeerInfo = client.lastPeerInfo
+		hc.ConnectedAt = client.connectedAt
+		hc.SessionID = client.sessionID
+		client.mu.RUnlock()
+		t.clientsMux.RLock()
+		if client.clientIP != nil {
+			hc.TunnelIP = client.clientIP.String()
+		}
+		t.clientsMux.RUnlock()
+		t.routeMux.RLock()
+		hc.Routes = append([]string(nil), t.clientRoutes[client]...)
+		t.routeMux.RUnlock()
+		state.Sessions = append(state.Sessions, hc)
+	}
+	return state
+}
+
+func sendHandoff(conn *net.UnixConn, state handoffState, tunFile, listenerFile *os.File) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	rights := syscall.UnixRights(int(tunFile.Fd()), int(listenerFile.Fd()))
+	if _, _, err := conn.WriteMsgUnix(header, rights, nil); err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func recvHandoff(conn *net.UnixConn) (state handoffState, tunFile, listenerFile *os.File, err error) {
+	header := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return state, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return state, nil, nil, errors.New("missing descriptors")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return state, nil, nil, err
+	}
+	if len(fds) != 2 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return state, nil, nil, fmt.Errorf("expected 2 descriptors, got %d", len(fds))
+	}
+	tunFile = os.NewFile(uintptr(fds[0]), "/dev/net/tun")
+	listenerFile = os.NewFile(uintptr(fds[1]), "listener")
+	fail := func(err error) (handoffState, *os.File, *os.File, error) {
+		tunFile.Close()
+		listenerFile.Close()
+		return state, nil, nil, err
+	}
+
+	if _, err := io.ReadFull(conn, header[n:]); err != nil {
+		return fail(err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxHandoffState {
+		return fail(fmt.Errorf("state too large (%d bytes)", size))
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return fail(err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fail(err)
+	}
+	if state.Format != handoffFormat {
+		return fail(fmt.Errorf("unsupported state format %d", state.Format))
+	}
+	return state, tunFile, listenerFile, nil
+}
+
+// takeOver receives the TUN device, listener and sessions of the instance on
+// upgrade_socket; startServer resumes the sessions
+func (t *Tunnel) takeOver() error {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: t.config.UpgradeSocket, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		conn.Close()
+		return err
+	}
+	if err := checkPeerCred(conn); err != nil {
+		return fail(err)
+	}
+	state, tunFile, listenerFile, err := recvHandoff(conn)
+	if err != nil {
+		return fail(fmt.Errorf("failed to receive state: %v", err))
+	}
+	if rawMode := faketcp.GetMode() == faketcp.ModeRaw; rawMode != state.RawMode {
+		tunFile.Close()
+		listenerFile.Close()
+		return fail(errors.New("running instance uses a different transport mode"))
+	}
+	listener, err := faketcp.ListenFromFile(t.config.LocalAddr, faketcp.GetMode(), listenerFile)
+	if err != nil {
+		tunFile.Close()
+		return fail(err)
+	}
+
+	if state.Key != "" && t.config.Key != "" && state.Key != t.config.Key {
+		cipher, err := crypto.NewCipher(state.Key)
+		if err != nil {
+			tunFile.Close()
+			listener.Close()
+			return fail(err)
+		}
+		t.configMux.Lock()
+		t.config.Key = state.Key
+		t.configMux.Unlock()
+		t.cipherMux.Lock()
+		t.cipher = cipher
+		t.cipherMux.Unlock()
+		log.Printf("Using the key rotated by the running instance")
+	}
+
+	t.tunFile = newTunDeviceFromFile(tunFile, state.TunName)
+	t.tunName = state.TunName
+	t.listener = listener
+	t.takeover = &takeoverState{conn: conn, state: state}
+	log.Printf("Taking over %s and %d sessions from version %s", t.tunName, len(state.Sessions), state.Version)
+	return nil
+}
+
+// resumeSessions serves the sessions received in takeOver and releases the
+// predecessor (server mode)
+func (t *Tunnel) resumeSessions() error {
+	defer t.takeover.conn.Close()
+	listener := t.listener.(faketcp.HandoffListener)
+	for _, hc := range t.takeover.state.Sessions {
+		conn, err := listener.Adopt(hc.Transport)
+		if err != nil {
+			log.Printf("⚠️  Dropping session %s: %v", hc.Transport.RemoteAddr, err)
+			continue
+		}
+		go t.resumeClient(conn, hc)
+	}
+	if _, err := t.takeover.conn.Write([]byte{handoffAck}); err != nil {
+		return fmt.Errorf("failed to release running instance: %v", err)
+	}
+	t.takeover = nil
+	return nil
+}
+
+// resumeClient serves a session taken over from the predecessor
+func (t *Tunnel) resumeClient(conn faketcp.ConnAdapter, hc handoffClient) {
+	client := t.newClientConnection(conn)
+	client.authenticated = hc.Authenticated
+	client.identity = hc.Identity
+	if len(hc.CertDER) > 0 {
+		if cert, err := x509.ParseCertificate(hc.CertDER); err == nil {
+			client.cert = cert
+		}
+	}
+	client.shardChecksum = hc.ShardChecksum
+	client.version = hc.Version
+	client.fecSessionID = hc.FECSessionID
+	client.lastPeerInfo = hc.PeerInfo
+	if !hc.ConnectedAt.IsZero() {
+		client.connectedAt = hc.ConnectedAt
+	}
+	if hc.SessionID != "" {
+		client.sessionID = hc.SessionID
+	}
+
+	t.trackClientConnection(client)
+	if ip := net.ParseIP(hc.TunnelIP); ip != nil {
+		t.addClient(client, ip.To4())
+	}
+	t.registerClientRoutes(client, hc.Routes)
+	if t.pkiEnabled() && !hc.Authenticated {
+		go t.enforceClientAuthDeadline(client)
+	}
+	t.serveClient(client)
+}
@@ -0,0 +1,221 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// The health endpoints answer orchestrator probes (Kubernetes liveness and
+// readiness, load balancer checks) on health_listen. They take no token and
+// reveal nothing beyond a one-line reason, so unlike the admin API they can
+// listen on the pod address.
+//
+//	GET /healthz   200 while the tunnel runs
+//	GET /readyz    200 once traffic can flow: a client is connected (and
+//	               authenticated, if required) and has heard from the server
+//	               recently; a server is accepting connections
+//	GET /health    200 if the raw socket is open, every firewall rule is in
+//	               place and a handshake completed (within
+//	               health_handshake_age seconds, if set); one plaintext
+//	               "check: ok|fail (detail)" line per check either way
+
+// startHealth serves the health endpoints on config.HealthListen
+func (t *Tunnel) startHealth() error {
+	ln, err := net.Listen("tcp", t.config.HealthListen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", t.handleHealthz)
+	mux.HandleFunc("GET /readyz", t.handleReadyz)
+	mux.HandleFunc("GET /health", t.handleHealth)
+	t.healthServer = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := t.healthServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Health endpoints stopped: %v", err)
+		}
+	}()
+	log.Printf("Health endpoints listening on http://%s (/healthz, /readyz, /health)", ln.Addr())
+	return nil
+}
+
+func (t *Tunnel) stopHealth() {
+	if t.healthServer != nil {
+		t.healthServer.Close()
+	}
+}
+
+func (t *Tunnel) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-t.stopCh:
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func (t *Tunnel) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := t.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ready returns why the tunnel cannot carry traffic yet, nil if it can
+func (t *Tunnel) ready() error {
+	select {
+	case <-t.stopCh:
+		return errors.New("stopping")
+	case <-t.handedOff:
+		return errors.New("handed off to a new process")
+	default:
+	}
+
+	if t.config.Mode == "server" {
+		if t.listener == nil {
+			return errors.New("not listening")
+		}
+		return nil
+	}
+
+	t.connMux.Lock()
+	connected := t.conn != nil
+	t.connMux.Unlock()
+	if !connected {
+		return fmt.Errorf("not connected to %s", t.config.RemoteAddr)
+	}
+	if t.authHandshakeRequired() {
+		t.authMux.RLock()
+		authenticated := t.authenticated
+		t.authMux.RUnlock()
+		if !authenticated {
+			return errors.New("not authenticated")
+		}
+	}
+	t.lastRecvMux.Lock()
+	silent := time.Since(t.lastRecvTime)
+	t.lastRecvMux.Unlock()
+	if silent > IdleConnectionTimeout {
+		return fmt.Errorf("nothing received from the server for %v", silent.Round(time.Second))
+	}
+	return nil
+}
+
+// noteHandshake records a completed handshake: that of a new connection, or
+// the authentication following it when one is required
+func (t *Tunnel) noteHandshake(authenticated bool) {
+	if authenticated || !t.authHandshakeRequired() {
+		t.lastHandshake.Store(time.Now().UnixNano())
+	}
+}
+
+// healthCheck is one line of the /health report
+type healthCheck struct {
+	name   string
+	ok     bool
+	detail string
+}
+
+func (t *Tunnel) handleHealth(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{t.checkSocket(), t.checkFirewall(), t.checkHandshake()}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	for _, c := range checks {
+		result := "ok"
+		if !c.ok {
+			result = "fail"
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", c.name, result, c.detail)
+	}
+}
+
+// checkSocket reports whether the server's listener or the client's
+// connection is open
+func (t *Tunnel) checkSocket() healthCheck {
+	c := healthCheck{name: "raw_socket"}
+	if faketcp.GetMode() != faketcp.ModeRaw {
+		c.name = "socket"
+	}
+	select {
+	case <-t.stopCh:
+		c.detail = "stopping"
+		return c
+	case <-t.handedOff:
+		c.detail = "handed off to a new process"
+		return c
+	default:
+	}
+
+	if t.config.Mode == "server" {
+		if t.listener == nil {
+			c.detail = "not listening"
+			return c
+		}
+		c.ok, c.detail = true, "listening on "+t.listener.Addr().String()
+		return c
+	}
+	t.connMux.Lock()
+	conn := t.conn
+	t.connMux.Unlock()
+	if conn == nil {
+		c.detail = "not connected to " + t.config.RemoteAddr
+		return c
+	}
+	c.ok, c.detail = true, "connected to "+conn.RemoteAddr().String()
+	return c
+}
+
+// checkFirewall reports whether the iptables rules installed for the fake
+// TCP flows are all still in place
+func (t *Tunnel) checkFirewall() healthCheck {
+	c := healthCheck{name: "firewall"}
+	rules := t.firewallRules()
+	missing := 0
+	for _, rule := range rules {
+		if !rule.Present {
+			missing++
+		}
+	}
+	switch {
+	case missing > 0:
+		c.detail = fmt.Sprintf("%d of %d rules missing", missing, len(rules))
+	case len(rules) == 0:
+		c.ok, c.detail = true, "no rules installed"
+	default:
+		c.ok, c.detail = true, fmt.Sprintf("%d rules", len(rules))
+		if len(rules) == 1 {
+			c.detail = "1 rule"
+		}
+	}
+	return c
+}
+
+// checkHandshake reports when a handshake last completed; with
+// health_handshake_age set it must be that recent
+func (t *Tunnel) checkHandshake() healthCheck {
+	c := healthCheck{name: "handshake"}
+	last := t.lastHandshake.Load()
+	if last == 0 {
+		c.detail = "none yet"
+		return c
+	}
+	age := time.Since(time.Unix(0, last)).Round(time.Second)
+	c.detail = fmt.Sprintf("last %v ago", age)
+	maxAge := time.Duration(t.config.HealthHandshakeAge) * time.Second
+	c.ok = maxAge == 0 || age <= maxAge
+	return c
+}
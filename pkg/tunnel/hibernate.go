@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// A server with thousands of mostly idle clients spends most of its memory on
+// buffers sized for sessions at full rate. After hibernate_after seconds in
+// which a session carried no data (keepalives do not count), its connection's
+// receive queue is shrunk and its fragment reassembly table dropped; both are
+// reallocated when data flows again. The session keeps its keys, address and
+// counters, so nothing is renegotiated. FEC groups and reorder buffers are
+// already discarded by the ingress workers a few seconds after a peer goes
+// quiet, and the send queue is bounded by send_queue_size.
+
+// hibernation tracks a session's data activity; it belongs to the session's
+// reader goroutine, which is the one allowed to resize the receive queue
+type hibernation struct {
+	traffic    activityTracker
+	lastActive time.Time
+	asleep     bool
+}
+
+// checkHibernation hibernates an idle session and wakes it once data flows
+// again (server mode). Called by the client's reader before every read; reads
+// of an idle session return every faketcp.ListenerReadTimeout.
+func (t *Tunnel) checkHibernation(client *ClientConnection, h *hibernation) {
+	if t.config.HibernateAfter <= 0 {
+		return
+	}
+	now := time.Now()
+	if h.traffic.advanced(client.bytesIn.Load()+client.bytesOut.Load()) || h.lastActive.IsZero() {
+		h.lastActive = now
+		if h.asleep {
+			h.asleep = false
+			if conn, ok := hibernator(client.conn); ok {
+				conn.Wake()
+			}
+			atomic.StoreUint32(&client.hibernating, 0)
+		}
+		return
+	}
+	if h.asleep || now.Sub(h.lastActive) < time.Duration(t.config.HibernateAfter)*time.Second {
+		return
+	}
+
+	if conn, ok := hibernator(client.conn); ok && !conn.Hibernate() {
+		return // Packets still queued; try again before the next read
+	}
+	client.fragments.release()
+	h.asleep = true
+	atomic.StoreUint32(&client.hibernating, 1)
+}
+
+// hibernator returns the connection under any fault injection wrapper if it
+// can release its buffers
+func hibernator(conn faketcp.ConnAdapter) (faketcp.Hibernator, bool) {
+	if ic, ok := conn.(*impairedConn); ok {
+		conn = ic.ConnAdapter
+	}
+	h, ok := conn.(faketcp.Hibernator)
+	return h, ok
+}
+
+// hibernatingSessions counts the sessions whose buffers are released
+func (t *Tunnel) hibernatingSessions() int {
+	t.allClientsMux.RLock()
+	defer t.allClientsMux.RUnlock()
+	n := 0
+	for client := range t.allClients {
+		if atomic.LoadUint32(&client.hibernating) != 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// ICMP errors about a fake TCP flow (raw mode) are handled by kind:
+//
+//	frag-needed   the send MTU toward that peer drops by the amount the
+//	              reported next-hop MTU falls short; a client lowers its TUN
+//	              MTU and probes upward again later
+//	unreachable,  the path may be down: once nothing has been received from
+//	ttl-exceeded  the peer for a keepalive interval, a client reconnects
+//	              (trying failover servers first) and a server ends the
+//	              session instead of waiting for the idle timeout
+//
+// Every error is counted in the status; logging is rate limited per kind.
+
+const icmpLogInterval = 10 * time.Second
+
+// icmpStats counts the ICMP errors by kind (atomic)
+type icmpStats struct {
+	fragNeeded, unreachable, timeExceeded atomic.Uint64
+	loggedAt                              [faketcp.ICMPTimeExceeded + 1]atomic.Int64 // Last log per kind, Unix nanoseconds
+}
+
+// startICMP listens for ICMP errors about the fake TCP flows (raw mode)
+func (t *Tunnel) startICMP() {
+	if faketcp.GetMode() != faketcp.ModeRaw {
+		return
+	}
+	l, err := faketcp.ListenICMP(t.handleICMPError)
+	if err != nil {
+		log.Printf("⚠️  Not listening for ICMP errors (path MTU and unreachable reports are ignored): %v", err)
+		return
+	}
+	t.icmp = l
+}
+
+func (t *Tunnel) stopICMP() {
+	if t.icmp != nil {
+		t.icmp.Close()
+	}
+}
+
+// handleICMPError reacts to an ICMP error about a segment of conn
+func (t *Tunnel) handleICMPError(conn *faketcp.ConnRaw, e faketcp.ICMPError) {
+	switch e.Kind {
+	case faketcp.ICMPFragNeeded:
+		t.icmpStats.fragNeeded.Add(1)
+	case faketcp.ICMPUnreachable:
+		t.icmpStats.unreachable.Add(1)
+	case faketcp.ICMPTimeExceeded:
+		t.icmpStats.timeExceeded.Add(1)
+	}
+	t.logICMPError(conn, e)
+
+	var client *ClientConnection
+	if t.config.Mode == "server" || t.listener != nil {
+		client = t.clientByConnAddr(conn)
+	}
+	if e.Kind == faketcp.ICMPFragNeeded {
+		t.applyICMPPathMTU(conn, client, e)
+		return
+	}
+	if client != nil {
+		t.icmpSessionDown(client, e)
+	} else if t.config.Mode != "server" {
+		t.icmpServerDown(conn, e)
+	}
+}
+
+func (t *Tunnel) logICMPError(conn *faketcp.ConnRaw, e faketcp.ICMPError) {
+	now := time.Now().UnixNano()
+	last := &t.icmpStats.loggedAt[e.Kind]
+	prev := last.Load()
+	if now-prev < int64(icmpLogInterval) || !last.CompareAndSwap(prev, now) {
+		return
+	}
+	detail := ""
+	if e.Kind == faketcp.ICMPFragNeeded {
+		detail = fmt.Sprintf(", next-hop MTU %d", e.MTU)
+	}
+	log.Printf("ICMP %s (type %d code %d%s) from %s about %s -> %s",
+		e.Kind, e.Type, e.Code, detail, e.From, conn.LocalAddr(), conn.RemoteAddr())
+}
+
+// clientByConnAddr returns the session whose connection has conn's peer
+// address (server mode)
+func (t *Tunnel) clientByConnAddr(conn *faketcp.ConnRaw) *ClientConnection {
+	remote := conn.RemoteAddr().String()
+	t.allClientsMux.RLock()
+	defer t.allClientsMux.RUnlock()
+	for client := range t.allClients {
+		if client.conn.RemoteAddr().String() == remote {
+			return client
+		}
+	}
+	return nil
+}
+
+// applyICMPPathMTU lowers the send MTU toward the peer by the shortfall of
+// the reported next-hop MTU
+func (t *Tunnel) applyICMPPathMTU(conn *faketcp.ConnRaw, client *ClientConnection, e faketcp.ICMPError) {
+	shortfall := conn.SendMSS() - e.MSS
+	if e.MTU == 0 || shortfall <= 0 {
+		return
+	}
+	if client != nil {
+		current := int(atomic.LoadInt32(&client.sendMTU))
+		if mtu := max(current-shortfall, minMTU); mtu < current {
+			client.logf("Send MTU toward %s lowered by ICMP: %d -> %d", conn.RemoteAddr(), current, mtu)
+			atomic.StoreInt32(&client.sendMTU, int32(mtu))
+		}
+		return
+	}
+
+	current := t.clientSendMTU()
+	mtu := max(current-shortfall, minMTU)
+	if mtu >= current {
+		return
+	}
+	if err := setLinkMTU(t.tunName, mtu); err != nil {
+		log.Printf("⚠️  Failed to lower TUN MTU to %d: %v", mtu, err)
+		return
+	}
+	atomic.StoreInt32(&t.pathMTU, int32(mtu))
+	t.setMTUSource(MTUSourceICMP)
+	storeCachedMTU(t.config.StateCacheFile, t.config.RemoteAddr, mtu)
+	log.Printf("⚠️  路径MTU因ICMP分片需求下调: %d -> %d (下一跳 MTU %d)", current, mtu, e.MTU)
+	t.startMTUProbing()
+}
+
+// icmpServerDown reconnects when the server stopped answering and the path
+// toward it reports errors (client mode)
+func (t *Tunnel) icmpServerDown(conn *faketcp.ConnRaw, e faketcp.ICMPError) {
+	t.lastRecvMux.Lock()
+	silent := time.Since(t.lastRecvTime)
+	t.lastRecvMux.Unlock()
+	if silent < t.keepaliveInterval() {
+		return
+	}
+	log.Printf("Server %s unreachable (ICMP %s from %s, nothing received for %v), reconnecting...",
+		conn.RemoteAddr(), e.Kind, e.From, silent.Round(time.Second))
+	t.serverSilent.Store(true)
+	// netReader sees the read error and reconnects
+	conn.Close()
+}
+
+// icmpSessionDown ends a session whose client stopped answering and whose
+// path reports errors (server mode)
+func (t *Tunnel) icmpSessionDown(client *ClientConnection, e faketcp.ICMPError) {
+	client.mu.RLock()
+	silent := time.Since(client.lastRecvTime)
+	client.mu.RUnlock()
+	if silent < time.Duration(t.config.KeepaliveInterval)*time.Second {
+		return
+	}
+	client.logf("Client %s unreachable (ICMP %s from %s, nothing received for %v), closing session",
+		client.conn.RemoteAddr(), e.Kind, e.From, silent.Round(time.Second))
+	client.setDisconnectReason("ICMP " + e.Kind.String())
+	client.stopOnce.Do(func() {
+		client.conn.Close()
+		close(client.stopCh)
+	})
+}
+
+// icmpStatus returns the ICMP error counters (nil without a listener)
+func (t *Tunnel) icmpStatus() *api.ICMPStatus {
+	if t.icmp == nil {
+		return nil
+	}
+	_, ignored := t.icmp.Counts()
+	return &api.ICMPStatus{
+		FragNeeded:   t.icmpStats.fragNeeded.Load(),
+		Unreachable:  t.icmpStats.unreachable.Load(),
+		TimeExceeded: t.icmpStats.timeExceeded.Load(),
+		Ignored:      ignored,
+	}
+}
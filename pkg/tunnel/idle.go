@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Data already tells the peer that we are alive, so a keepalive is only sent
+// after an interval in which we sent no data, and the upward MTU probes wait
+// for a pause in the traffic. Activity is read from the byte counters at each
+// tick, which keeps timestamps off the data path.
+
+// defaultIdleAfter is how long a client sees no data before it counts as idle
+const defaultIdleAfter = 30 * time.Second
+
+// activityTracker remembers a byte counter between ticks
+type activityTracker struct {
+	last uint64
+}
+
+// advanced reports whether counter moved since the previous call
+func (a *activityTracker) advanced(counter uint64) bool {
+	moved := counter != a.last
+	a.last = counter
+	return moved
+}
+
+// idleNotifier reports transitions between active and idle to the handler set
+// with SetIdleHandler (client mode)
+type idleNotifier struct {
+	mu         sync.Mutex
+	handler    func(idle bool)
+	traffic    activityTracker
+	idle       bool
+	lastActive time.Time
+}
+
+// SetIdleHandler registers a function called with true once the tunnel has
+// carried no data for idle_after seconds and with false when data flows again
+// (client mode). Mobile embedders can use it to let the radio sleep. Activity
+// is sampled at the keepalive interval, so transitions lag by up to one.
+func (t *Tunnel) SetIdleHandler(handler func(idle bool)) {
+	t.idleNotify.mu.Lock()
+	t.idleNotify.handler = handler
+	t.idleNotify.mu.Unlock()
+}
+
+// sampleIdle updates the idle state from the data counters (client mode)
+func (t *Tunnel) sampleIdle() {
+	n := &t.idleNotify
+	total := t.statBytesIn.Load() + t.statBytesOut.Load()
+	idleAfter := defaultIdleAfter
+	if t.config.IdleAfter > 0 {
+		idleAfter = time.Duration(t.config.IdleAfter) * time.Second
+	}
+
+	n.mu.Lock()
+	now := time.Now()
+	if n.lastActive.IsZero() || n.traffic.advanced(total) {
+		n.lastActive = now
+	}
+	idle := now.Sub(n.lastActive) >= idleAfter
+	changed := idle != n.idle
+	n.idle = idle
+	handler := n.handler
+	n.mu.Unlock()
+
+	if changed && handler != nil {
+		handler(idle)
+	}
+}
+
+// suppressKeepalive reports whether data sent since the last tick made the
+// keepalive redundant; sent is the caller's tracker of its bytes-out counter
+func (t *Tunnel) suppressKeepalive(sent *activityTracker, bytesOut *atomic.Uint64) bool {
+	if !sent.advanced(bytesOut.Load()) || t.config.KeepaliveAlways {
+		return false
+	}
+	t.statKeepaliveSuppressed.Add(1)
+	return true
+}
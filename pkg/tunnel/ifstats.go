@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/ratelimit"
+)
+
+// The tunnel reports its traffic the way a router reports an interface's,
+// so SNMP and collectd based monitoring can graph it next to the physical
+// ports (see -ifstats). The TUN device has kernel counters of its own, but
+// they miss what the tunnel drops between the device and the network: full
+// queues, oversized packets, shedding, the rate limit and failed sends.
+
+// interfaceCounters returns the tunnel's interface counters; bytesIn and
+// bytesOut are the totals of Status, which include the connected clients
+func (t *Tunnel) interfaceCounters(bytesIn, bytesOut uint64, clients []*ClientConnection) api.InterfaceCounters {
+	c := api.InterfaceCounters{
+		InOctets:   bytesIn,
+		InPackets:  t.statPacketsIn.Load(),
+		InErrors:   t.statTUNWriteErrors.Load(),
+		InDiscards: t.statQueueDropRecv.Load() + t.statQueueDropForward.Load(),
+		OutOctets:  bytesOut,
+		OutPackets: t.statPacketsOut.Load(),
+		OutErrors:  t.statSendErrors.Load(),
+		OutDiscards: t.statQueueDropSend.Load() + t.statQueueDropClientSend.Load() +
+			t.statQueueDropRouteSend.Load() + t.statOversizedDrop.Load() +
+			t.statShed.Load(),
+	}
+	if t.limiter != nil {
+		for _, class := range ratelimit.Classes {
+			c.OutDiscards += t.limiter.Counters(class).Dropped
+		}
+	}
+	for _, client := range clients {
+		c.InPackets += client.packetsIn.Load()
+		c.OutPackets += client.packetsOut.Load()
+	}
+	return c
+}
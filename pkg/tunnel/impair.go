@@ -0,0 +1,285 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// The impairment injector degrades the packets this endpoint sends so FEC and
+// reorder settings can be validated against realistic loss on demand. It acts
+// on the wire packets after encryption and FEC encoding, so a dropped or
+// corrupted packet costs exactly one shard. Enable it on both endpoints to
+// impair both directions.
+
+const (
+	maxImpairReorderDepth = 64
+	maxImpairDelayMs      = 10000
+	// impairHoldMax bounds how long a reordered packet waits for later packets
+	impairHoldMax = 100 * time.Millisecond
+	// defaultSpikeLengthMs is the longest default spike; shorter intervals spike half the time
+	defaultSpikeLengthMs = 1000
+)
+
+// Impairment configures the faults injected into sent packets. The zero value
+// injects nothing.
+type Impairment struct {
+	DropPercent      float64 `json:"drop_percent"`      // Packets silently dropped
+	DuplicatePercent float64 `json:"duplicate_percent"` // Packets sent twice
+	CorruptPercent   float64 `json:"corrupt_percent"`   // Packets sent with one bit flipped
+	ReorderPercent   float64 `json:"reorder_percent"`   // Packets held back behind later ones
+	ReorderDepth     int     `json:"reorder_depth"`     // Number of later packets a held packet waits for
+	DelayMs          int     `json:"delay_ms"`          // Fixed added latency
+	JitterMs         int     `json:"jitter_ms"`         // Uniform random latency in [-jitter, +jitter]
+	SpikeMs          int     `json:"spike_ms"`          // Extra latency during a spike
+	SpikeEveryMs     int     `json:"spike_every_ms"`    // Interval between spike starts
+	SpikeLengthMs    int     `json:"spike_length_ms"`   // Spike duration (default 1000, at most half the interval)
+}
+
+// ImpairmentStats counts the faults injected since the tunnel started
+type ImpairmentStats struct {
+	Dropped    uint64 `json:"dropped"`
+	Duplicated uint64 `json:"duplicated"`
+	Corrupted  uint64 `json:"corrupted"`
+	Reordered  uint64 `json:"reordered"`
+	Delayed    uint64 `json:"delayed"`
+}
+
+func (imp *Impairment) validate() error {
+	for name, pct := range map[string]float64{
+		"drop_percent":      imp.DropPercent,
+		"duplicate_percent": imp.DuplicatePercent,
+		"corrupt_percent":   imp.CorruptPercent,
+		"reorder_percent":   imp.ReorderPercent,
+	} {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("%s must be between 0 and 100", name)
+		}
+	}
+	if imp.ReorderDepth < 0 || imp.ReorderDepth > maxImpairReorderDepth {
+		return fmt.Errorf("reorder_depth must be between 0 and %d", maxImpairReorderDepth)
+	}
+	if imp.ReorderPercent > 0 && imp.ReorderDepth == 0 {
+		return fmt.Errorf("reorder_percent requires reorder_depth")
+	}
+	for name, ms := range map[string]int{
+		"delay_ms":        imp.DelayMs,
+		"jitter_ms":       imp.JitterMs,
+		"spike_ms":        imp.SpikeMs,
+		"spike_every_ms":  imp.SpikeEveryMs,
+		"spike_length_ms": imp.SpikeLengthMs,
+	} {
+		if ms < 0 || ms > maxImpairDelayMs {
+			return fmt.Errorf("%s must be between 0 and %d", name, maxImpairDelayMs)
+		}
+	}
+	if imp.SpikeMs > 0 && imp.SpikeEveryMs == 0 {
+		return fmt.Errorf("spike_ms requires spike_every_ms")
+	}
+	if imp.SpikeLengthMs > 0 && imp.SpikeLengthMs >= imp.SpikeEveryMs {
+		return fmt.Errorf("spike_length_ms must be shorter than spike_every_ms")
+	}
+	return nil
+}
+
+// impairState is an active impairment; its start anchors the spike schedule
+type impairState struct {
+	cfg   Impairment
+	start time.Time
+}
+
+// SetImpairment starts injecting the given faults into sent packets, replacing
+// any previous impairment. A nil or zero impairment turns injection off.
+func (t *Tunnel) SetImpairment(imp *Impairment) error {
+	if imp == nil || *imp == (Impairment{}) {
+		t.impair.Store(nil)
+		return nil
+	}
+	if err := imp.validate(); err != nil {
+		return err
+	}
+	cfg := *imp
+	if cfg.SpikeMs > 0 && cfg.SpikeLengthMs == 0 {
+		cfg.SpikeLengthMs = min(defaultSpikeLengthMs, cfg.SpikeEveryMs/2)
+	}
+	t.impair.Store(&impairState{cfg: cfg, start: time.Now()})
+	return nil
+}
+
+// Impairment returns the active impairment, or nil when none is injected
+func (t *Tunnel) Impairment() *Impairment {
+	s := t.impair.Load()
+	if s == nil {
+		return nil
+	}
+	cfg := s.cfg
+	return &cfg
+}
+
+// ImpairmentStats returns the fault counters
+func (t *Tunnel) ImpairmentStats() ImpairmentStats {
+	return ImpairmentStats{
+		Dropped:    t.statImpairDrop.Load(),
+		Duplicated: t.statImpairDup.Load(),
+		Corrupted:  t.statImpairCorrupt.Load(),
+		Reordered:  t.statImpairReorder.Load(),
+		Delayed:    t.statImpairDelay.Load(),
+	}
+}
+
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// delay returns the latency to add to a packet sent at now
+func (s *impairState) delay(now time.Time) time.Duration {
+	ms := s.cfg.DelayMs
+	if s.cfg.JitterMs > 0 {
+		ms += rand.IntN(2*s.cfg.JitterMs+1) - s.cfg.JitterMs
+	}
+	if s.cfg.SpikeMs > 0 {
+		every := time.Duration(s.cfg.SpikeEveryMs) * time.Millisecond
+		if now.Sub(s.start)%every < time.Duration(s.cfg.SpikeLengthMs)*time.Millisecond {
+			ms += s.cfg.SpikeMs
+		}
+	}
+	return time.Duration(max(ms, 0)) * time.Millisecond
+}
+
+// impairedConn applies the tunnel's active impairment to packets written to
+// conn, and its transforms (transform.go) to packets written and read
+type impairedConn struct {
+	faketcp.ConnAdapter
+	t *Tunnel
+
+	mu   sync.Mutex
+	held []heldPacket // Reordered packets waiting for later ones
+}
+
+type heldPacket struct {
+	data  []byte
+	left  int // Later packets still to be sent before this one
+	since time.Time
+}
+
+// impairConn wraps conn so it honours SetImpairment and AddTransform; packets
+// pass straight through while neither is in use
+func (t *Tunnel) impairConn(conn faketcp.ConnAdapter) faketcp.ConnAdapter {
+	return &impairedConn{ConnAdapter: conn, t: t}
+}
+
+func (c *impairedConn) WritePacket(data []byte) error {
+	if len(c.t.transforms) > 0 {
+		if data = c.t.transformFrame(data, Outbound); data == nil {
+			return nil
+		}
+	}
+	s := c.t.impair.Load()
+	if s == nil {
+		return c.ConnAdapter.WritePacket(data)
+	}
+	return c.send(s, data)
+}
+
+func (c *impairedConn) WriteBatch(packets [][]byte) error {
+	if len(c.t.transforms) > 0 {
+		if packets = c.t.transformBatch(packets, Outbound); len(packets) == 0 {
+			return nil
+		}
+	}
+	s := c.t.impair.Load()
+	if s == nil {
+		return c.ConnAdapter.WriteBatch(packets)
+	}
+	var firstErr error
+	for _, pkt := range packets {
+		if err := c.send(s, pkt); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *impairedConn) send(s *impairState, data []byte) error {
+	t := c.t
+	if chance(s.cfg.DropPercent) {
+		t.statImpairDrop.Add(1)
+		return nil
+	}
+	if chance(s.cfg.CorruptPercent) && len(data) > 0 {
+		data = append([]byte(nil), data...)
+		data[rand.IntN(len(data))] ^= 1 << rand.IntN(8)
+		t.statImpairCorrupt.Add(1)
+	}
+	copies := 1
+	if chance(s.cfg.DuplicatePercent) {
+		copies = 2
+		t.statImpairDup.Add(1)
+	}
+	if chance(s.cfg.ReorderPercent) {
+		t.statImpairReorder.Add(1)
+		c.hold(data, s.cfg.ReorderDepth)
+		return nil
+	}
+
+	var err error
+	for i := 0; i < copies; i++ {
+		if e := c.emit(s, data); e != nil {
+			err = e
+		}
+	}
+	for _, pkt := range c.release(false) {
+		c.emit(s, pkt)
+	}
+	return err
+}
+
+// emit writes data now or after the impairment's latency
+func (c *impairedConn) emit(s *impairState, data []byte) error {
+	d := s.delay(time.Now())
+	if d <= 0 {
+		return c.ConnAdapter.WritePacket(data)
+	}
+	c.t.statImpairDelay.Add(1)
+	buf := append([]byte(nil), data...)
+	time.AfterFunc(d, func() {
+		c.ConnAdapter.WritePacket(buf)
+	})
+	return nil
+}
+
+// hold queues data until depth later packets were sent, or impairHoldMax passed
+func (c *impairedConn) hold(data []byte, depth int) {
+	c.mu.Lock()
+	c.held = append(c.held, heldPacket{data: append([]byte(nil), data...), left: depth, since: time.Now()})
+	c.mu.Unlock()
+	time.AfterFunc(impairHoldMax, func() {
+		for _, pkt := range c.release(true) {
+			c.ConnAdapter.WritePacket(pkt)
+		}
+	})
+}
+
+// release counts one sent packet against the held ones and returns those now
+// due; expired returns only packets held for impairHoldMax instead
+func (c *impairedConn) release(expired bool) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var due [][]byte
+	kept := c.held[:0]
+	for _, h := range c.held {
+		if !expired {
+			h.left--
+		}
+		if h.left <= 0 || time.Since(h.since) >= impairHoldMax {
+			due = append(due, h.data)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	c.held = kept
+	return due
+}
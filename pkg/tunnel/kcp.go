@@ -0,0 +1,309 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/kcp"
+)
+
+// With reliability "kcp" the data packets of a client/server connection are
+// sent as messages of a KCP conversation instead of in FEC groups: lost ones
+// are retransmitted and the receiver delivers them in order, which suits a
+// single TCP stream inside the tunnel better than FEC's best effort, without
+// the stalls of TCP-in-TCP since KCP retransmits far more eagerly. Each
+// message is a typed data or fragment frame; control packets (keepalives,
+// handshakes, P2P) bypass KCP. Each connection has its own conversation, so a
+// reconnect starts a fresh one on both ends.
+//
+// Layout: [PacketTypeKCP][KCP segments, ikcp format]
+
+// Reliability modes (reliability)
+const (
+	ReliabilityFEC = "fec"
+	ReliabilityKCP = "kcp"
+)
+
+const kcpConv = 0x4c54554e // "LTUN"
+
+// kcpSession is the KCP conversation of one connection
+type kcpSession struct {
+	mu    sync.Mutex
+	kcp   *kcp.KCP
+	conn  faketcp.ConnAdapter
+	start time.Time
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+	dead  bool // Dead link already logged
+}
+
+func (t *Tunnel) kcpEnabled() bool {
+	return t.config.Reliability == ReliabilityKCP
+}
+
+// newKCPSession starts the conversation on conn; encrypt is the encryption
+// toward the peer and mtu the largest frame the connection carries. The
+// session ends with close or when stop is closed.
+func (t *Tunnel) newKCPSession(conn faketcp.ConnAdapter, mtu int, encrypt func([]byte) ([]byte, error), stop <-chan struct{}) *kcpSession {
+	s := &kcpSession{
+		conn:  conn,
+		start: time.Now(),
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	s.kcp = kcp.New(kcpConv, func(segments []byte) {
+		frame := make([]byte, 1+len(segments))
+		frame[0] = PacketTypeKCP
+		copy(frame[1:], segments)
+		encrypted, err := encrypt(frame)
+		if err != nil {
+			return
+		}
+		// Write errors are left to the retransmission timer and the
+		// connection's keepalive
+		_ = conn.WritePacket(encrypted)
+	})
+
+	cfg := t.config
+	interval := cfg.KCPInterval
+	if interval == 0 {
+		interval = 20
+	}
+	sndWnd, rcvWnd := cfg.KCPSendWindow, cfg.KCPRecvWindow
+	if sndWnd == 0 {
+		sndWnd = 128
+	}
+	if rcvWnd == 0 {
+		rcvWnd = 512
+	}
+	s.kcp.SetMTU(max(mtu-1, 50))
+	s.kcp.NoDelay(cfg.KCPNoDelay, interval, cfg.KCPResend, cfg.KCPNoCongestion)
+	s.kcp.WndSize(sndWnd, rcvWnd)
+	s.kcp.Update(s.now())
+
+	go s.run(stop)
+	return s
+}
+
+func (s *kcpSession) now() uint32 {
+	return uint32(time.Since(s.start) / time.Millisecond)
+}
+
+// run calls Update whenever Check asks for it
+func (s *kcpSession) run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		now := s.now()
+		s.kcp.Update(now)
+		next := s.kcp.Check(now)
+		dead := s.kcp.Dead() && !s.dead
+		s.dead = s.dead || dead
+		s.mu.Unlock()
+		if dead {
+			log.Printf("KCP: %s does not acknowledge data; is reliability kcp set on both ends?", s.conn.RemoteAddr())
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Duration(next-now) * time.Millisecond)
+	}
+}
+
+// send queues a packet and flushes what the windows allow. It reports false
+// when the packet was dropped because twice the send window is already
+// waiting, so a stalled peer cannot make the queue grow without bound.
+func (s *kcpSession) send(packet []byte, sndWnd int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kcp.WaitSnd() >= 2*sndWnd {
+		return false
+	}
+	if err := s.kcp.Send(packet); err != nil {
+		return false
+	}
+	s.kcp.Flush()
+	return true
+}
+
+// input processes a frame received from the peer, acknowledges it right
+// away and passes the packets that are now in order to deliver
+func (s *kcpSession) input(segments []byte, deliver func([]byte)) {
+	var ready [][]byte
+	s.mu.Lock()
+	if err := s.kcp.Input(segments); err == nil {
+		for msg := s.kcp.Recv(); msg != nil; msg = s.kcp.Recv() {
+			ready = append(ready, msg)
+		}
+		s.kcp.Flush()
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}: // Acknowledged segments may free the window
+	default:
+	}
+	for _, packet := range ready {
+		deliver(packet)
+	}
+}
+
+// waitSnd returns the number of segments not acknowledged yet, 0 once the
+// session ended or the peer stopped acknowledging
+func (s *kcpSession) waitSnd() int {
+	select {
+	case <-s.done:
+		return 0
+	default:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dead {
+		return 0
+	}
+	return s.kcp.WaitSnd()
+}
+
+func (s *kcpSession) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (t *Tunnel) kcpSendWindow() int {
+	if t.config.KCPSendWindow > 0 {
+		return t.config.KCPSendWindow
+	}
+	return 128
+}
+
+// clientKCP returns the conversation of conn, replacing that of an earlier
+// connection
+func (t *Tunnel) clientKCP(conn faketcp.ConnAdapter) *kcpSession {
+	t.kcpMux.Lock()
+	defer t.kcpMux.Unlock()
+	if s := t.kcpSession; s != nil && s.conn == conn {
+		return s
+	}
+	if t.kcpSession != nil {
+		t.kcpSession.close()
+	}
+	t.kcpSession = t.newKCPSession(conn, t.clientSendMTU()+1, t.encryptPacket, t.stopCh)
+	return t.kcpSession
+}
+
+// handleKCP passes the frames of a KCP frame from the server on to the
+// receive queue
+func (t *Tunnel) handleKCP(conn faketcp.ConnAdapter, payload []byte) {
+	t.clientKCP(conn).input(payload, func(frame []byte) {
+		if len(frame) == 0 {
+			return
+		}
+		var packet []byte
+		switch frame[0] {
+		case PacketTypeData:
+			packet = frame[1:]
+		case PacketTypeFragment:
+			if packet = t.reassembleFragment(t.fragments, frame[1:]); packet == nil {
+				return
+			}
+			packet = packet[1:]
+		default:
+			return
+		}
+		if !enqueueWithPolicy(t.recvQueue, packet, t.stopCh, false) {
+			t.statQueueDropRecv.Add(1)
+		}
+	})
+}
+
+// kcpNetWriter sends the client's packets over KCP, reconnecting like the
+// plain writer when there is no connection
+func (t *Tunnel) kcpNetWriter() {
+	sndWnd := t.kcpSendWindow()
+	for {
+		var packet []byte
+		select {
+		case <-t.stopCh:
+			return
+		case packet = <-t.sendQueue:
+		}
+		if t.shedPacket(&t.congestion, packet) || t.overRate(packet) {
+			continue
+		}
+		if t.conn == nil {
+			if err := t.reconnectToServer(); err != nil {
+				t.releasePacketBuffer(packet)
+				return
+			}
+		}
+		if !t.clientKCP(t.conn).send(typedPacket(packet), sndWnd) {
+			t.statQueueDropSend.Add(1)
+		}
+		t.releasePacketBuffer(packet)
+	}
+}
+
+// clientKCPNetWriter sends a server client's packets over KCP
+func (t *Tunnel) clientKCPNetWriter(client *ClientConnection) {
+	sndWnd := t.kcpSendWindow()
+	s := t.serverKCP(client)
+	for {
+		var packet []byte
+		select {
+		case <-t.stopCh:
+			return
+		case <-client.stopCh:
+			return
+		case packet = <-client.sendQueue:
+		}
+		if t.shedPacket(&client.congestion, packet) || t.overRate(packet) {
+			continue
+		}
+		client.bytesOut.Add(uint64(len(packet)))
+		client.packetsOut.Add(1)
+		if !s.send(typedPacket(packet), sndWnd) {
+			t.statQueueDropSend.Add(1)
+		}
+		t.releasePacketBuffer(packet)
+	}
+}
+
+// serverKCP returns the conversation of a server client, starting it on
+// first use
+func (t *Tunnel) serverKCP(client *ClientConnection) *kcpSession {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.kcp == nil {
+		client.kcp = t.newKCPSession(client.conn, int(atomic.LoadInt32(&client.sendMTU))+1, func(p []byte) ([]byte, error) {
+			return t.encryptForClient(client, p)
+		}, client.stopCh)
+	}
+	return client.kcp
+}
+
+// handleClientKCP passes the frames of a client's KCP frame on like those
+// received directly
+func (t *Tunnel) handleClientKCP(client *ClientConnection, payload []byte) {
+	t.serverKCP(client).input(payload, func(frame []byte) {
+		if len(frame) > 0 && frame[0] == PacketTypeData || frame[0] == PacketTypeFragment {
+			t.handleClientPacket(client, frame)
+		}
+	})
+}
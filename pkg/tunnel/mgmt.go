@@ -0,0 +1,298 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
+)
+
+// A server usually runs on a remote machine administered over the network it
+// firewalls, so its own rules must not be able to lock the operator out:
+//
+//   - Management traffic (management_bypass: SSH by default, plus the admin
+//     API's port when it is reachable from the network) is accepted at the top
+//     of the raw PREROUTING chain, ahead of the bans, and of the OUTPUT chain,
+//     ahead of the RST filter. Entries are proto:port[-port][@CIDR], like the
+//     client's bypass rules, or a CIDR of operator addresses, which are also
+//     never banned. A tunnel port that is also a management port is refused:
+//     the bypass would let the kernel reset the tunnel's connections, and the
+//     listener would answer SSH clients.
+//   - With firewall_confirm_timeout set, the rules are removed again that many
+//     seconds after the start unless POST /firewall/confirm confirms them, as
+//     iptables-apply does. Raw mode does not work without its RST filter, so a
+//     tunnel that was not confirmed keeps running degraded until restarted.
+
+const mgmtLabel = "lightweight-tunnel-mgmt"
+
+// defaultManagementBypass is the bypass when management_bypass is not set
+var defaultManagementBypass = []string{"tcp:22"}
+
+// firewallGuard keeps the server's firewall rules from cutting off management
+// traffic (server mode)
+type firewallGuard struct {
+	rules []bypassRule
+	ipt   *iptables.IPTablesManager // Bypass rules (nil until installed)
+
+	mu        sync.Mutex
+	timer     *time.Timer
+	revertAt  time.Time // Zero unless confirmation is pending
+	confirmed bool
+	reverted  bool
+}
+
+// newFirewallGuard parses the management bypass of cfg
+func newFirewallGuard(cfg *config.Config) (*firewallGuard, error) {
+	entries := cfg.ManagementBypass
+	if len(entries) == 0 {
+		entries = defaultManagementBypass
+	}
+	if len(entries) == 1 && entries[0] == "none" {
+		entries = nil
+	}
+	rules, err := parseBypassRules(entries)
+	if err != nil {
+		return nil, fmt.Errorf("management_bypass: %v", err)
+	}
+	// The admin API confirms the rules, so it must stay reachable too
+	if host, port, err := net.SplitHostPort(cfg.AdminListen); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil && p != 0 {
+				rules = append(rules, bypassRule{proto: 6, portLow: uint16(p), portHigh: uint16(p)})
+			}
+		}
+	}
+	return &firewallGuard{rules: rules}, nil
+}
+
+// protects reports whether ip is an operator address, which is never banned
+func (g *firewallGuard) protects(ip net.IP) bool {
+	if g == nil {
+		return false
+	}
+	for _, rule := range g.rules {
+		if !rule.portBased() && rule.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTunnelPorts fails if a port the tunnel listens on, low to high, is a
+// management port
+func (g *firewallGuard) checkTunnelPorts(proto uint8, low, high uint16) error {
+	for _, rule := range g.rules {
+		if rule.proto == proto && rule.portLow <= high && low <= rule.portHigh {
+			return fmt.Errorf("tunnel port %s overlaps management port %s (management_bypass); listen elsewhere or change the bypass",
+				portRange(low, high), portRange(rule.portLow, rule.portHigh))
+		}
+	}
+	return nil
+}
+
+func portRange(low, high uint16) string {
+	if low == high {
+		return strconv.Itoa(int(low))
+	}
+	return fmt.Sprintf("%d-%d", low, high)
+}
+
+// installManagementBypass checks the tunnel ports against the management ports
+// and accepts management traffic ahead of the rules the server is about to
+// install (server mode)
+func (t *Tunnel) installManagementBypass() error {
+	g := t.mgmt
+	proto := uint8(17)
+	if faketcp.GetMode() == faketcp.ModeRaw {
+		proto = 6
+	}
+	if _, portStr, err := net.SplitHostPort(t.config.LocalAddr); err == nil {
+		if port, err := strconv.ParseUint(portStr, 10, 16); err == nil && port != 0 {
+			if err := g.checkTunnelPorts(proto, uint16(port), uint16(port)); err != nil {
+				return err
+			}
+		}
+	}
+	if t.portHop != nil {
+		if err := g.checkTunnelPorts(proto, t.portHop.low, t.portHop.high); err != nil {
+			return err
+		}
+	}
+
+	// Only raw mode and bans install rules
+	if len(g.rules) == 0 || (proto != 6 && t.config.UnauthBanThreshold == 0) {
+		return nil
+	}
+	g.ipt = iptables.NewIPTablesManager()
+	if t.config.NetNS != "" {
+		g.ipt.SetNetNS(netns.Path(t.config.NetNS))
+	}
+	comment := "-m comment --comment " + mgmtLabel + " -j ACCEPT"
+	for _, rule := range g.rules {
+		var in, out string
+		if rule.portBased() {
+			name := "tcp"
+			if rule.proto == 17 {
+				name = "udp"
+			}
+			in = fmt.Sprintf("PREROUTING -t raw -p %s --dport %d:%d", name, rule.portLow, rule.portHigh)
+			out = fmt.Sprintf("OUTPUT -p %s --sport %d:%d", name, rule.portLow, rule.portHigh)
+			if rule.network != nil {
+				in += " -s " + rule.network.String()
+				out += " -d " + rule.network.String()
+			}
+		} else {
+			// Not OUTPUT: the RST filter must keep applying to an operator
+			// who is also a client
+			in = "PREROUTING -t raw -s " + rule.network.String()
+		}
+		for _, r := range []string{in, out} {
+			if r == "" {
+				continue
+			}
+			if err := g.ipt.InsertCustomRule(r + " " + comment); err != nil {
+				log.Printf("⚠️  Failed to install management bypass, firewall rules may cut off management traffic: %v", err)
+				return nil
+			}
+		}
+	}
+	log.Printf("Management traffic bypasses the firewall rules (%d rules)", len(g.ipt.GetRules()))
+	return nil
+}
+
+// startFirewallConfirm arms the safety timer of the firewall rules (server
+// mode with firewall_confirm_timeout)
+func (t *Tunnel) startFirewallConfirm() {
+	timeout := time.Duration(t.config.FirewallConfirmTimeout) * time.Second
+	if timeout == 0 {
+		return
+	}
+	g := t.mgmt
+	g.mu.Lock()
+	g.revertAt = time.Now().Add(timeout)
+	g.timer = time.AfterFunc(timeout, t.revertFirewall)
+	g.mu.Unlock()
+	log.Printf("⚠️  Firewall rules are removed in %v unless confirmed with POST /firewall/confirm on the admin API", timeout)
+}
+
+// ConfirmFirewall keeps the firewall rules past firewall_confirm_timeout
+func (t *Tunnel) ConfirmFirewall() (*api.FirewallGuard, error) {
+	g := t.mgmt
+	if g == nil || t.config.FirewallConfirmTimeout == 0 {
+		return nil, fmt.Errorf("no firewall rules await confirmation")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reverted {
+		return nil, fmt.Errorf("firewall rules were not confirmed in time and have been removed; restart to install them again")
+	}
+	if !g.confirmed {
+		g.confirmed = true
+		g.revertAt = time.Time{}
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		log.Printf("Firewall rules confirmed")
+	}
+	return g.statusLocked(), nil
+}
+
+// revertFirewall removes the server's firewall rules, except the management
+// bypass, when they were not confirmed in time
+func (t *Tunnel) revertFirewall() {
+	g := t.mgmt
+	g.mu.Lock()
+	if g.confirmed || g.reverted {
+		g.mu.Unlock()
+		return
+	}
+	g.reverted = true
+	g.revertAt = time.Time{}
+	g.mu.Unlock()
+	log.Printf("⚠️  Firewall rules not confirmed within %ds: removing them; the tunnel runs without them until restarted",
+		t.config.FirewallConfirmTimeout)
+
+	if l, ok := t.listener.(interface{ RemoveFirewallRules() error }); ok {
+		if err := l.RemoveFirewallRules(); err != nil {
+			log.Printf("Failed to remove listener firewall rules: %v", err)
+		}
+	}
+	if h := t.portHop; h != nil {
+		h.mu.Lock()
+		if h.filter != nil {
+			if err := h.filter.Close(); err != nil {
+				log.Printf("Failed to remove hop port firewall rules: %v", err)
+			}
+			h.filter = nil
+		}
+		h.mu.Unlock()
+	}
+	if u := t.unauth; u != nil {
+		u.mu.Lock()
+		u.threshold = 0 // No more bans
+		u.bans = make(map[string]time.Time)
+		u.mu.Unlock()
+		if u.ipt != nil {
+			if err := u.ipt.RemoveAllRules(); err != nil {
+				log.Printf("Failed to remove ban rules: %v", err)
+			}
+		}
+	}
+}
+
+// stopFirewallGuard disarms the safety timer and removes the management
+// bypass, after the other rules are gone
+func (t *Tunnel) stopFirewallGuard() {
+	g := t.mgmt
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.mu.Unlock()
+	if g.ipt != nil {
+		if err := g.ipt.RemoveAllRules(); err != nil {
+			log.Printf("Failed to remove management bypass rules: %v", err)
+		}
+	}
+}
+
+// firewallGuardStatus reports the safety timer for /status (nil when the
+// rules need no confirmation)
+func (t *Tunnel) firewallGuardStatus() *api.FirewallGuard {
+	g := t.mgmt
+	if g == nil || t.config.FirewallConfirmTimeout == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.statusLocked()
+}
+
+func (g *firewallGuard) statusLocked() *api.FirewallGuard {
+	s := &api.FirewallGuard{Confirmed: g.confirmed, Reverted: g.reverted}
+	if !g.revertAt.IsZero() {
+		revertAt := g.revertAt
+		s.RevertAt = &revertAt
+	}
+	return s
+}
+
+// mgmtFirewallRules reports the management bypass rules and whether each is
+// installed
+func (t *Tunnel) mgmtFirewallRules() []iptables.RuleState {
+	if t.mgmt == nil || t.mgmt.ipt == nil {
+		return nil
+	}
+	return t.mgmt.ipt.CheckRules()
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/audit"
+	"github.com/openbmx/lightweight-tunnel/pkg/mirror"
+)
+
+// A server can copy the decrypted traffic of selected sessions to an IDS.
+// Only sessions matching mirror_sessions (tunnel IP, CIDR or certificate
+// identity) are mirrored, each is announced in the log and the audit log when
+// its first packet is seen, and the copies are rate limited and dropped rather
+// than ever holding up forwarding.
+
+// Mirror decision of a session, cached in ClientConnection.mirrored
+const (
+	mirrorUndecided int32 = iota
+	mirrorOn
+	mirrorOff
+)
+
+// mirrorSelector holds the parsed mirror_sessions
+type mirrorSelector struct {
+	nets       []*net.IPNet
+	identities map[string]bool
+}
+
+func parseMirrorSessions(sessions []string) (*mirrorSelector, error) {
+	sel := &mirrorSelector{identities: make(map[string]bool)}
+	for _, s := range sessions {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case strings.Contains(s, "/"):
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mirror session %q: %v", s, err)
+			}
+			sel.nets = append(sel.nets, ipnet)
+		case net.ParseIP(s) != nil:
+			ip := net.ParseIP(s)
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			sel.nets = append(sel.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			sel.identities[s] = true
+		}
+	}
+	return sel, nil
+}
+
+func (sel *mirrorSelector) match(ip net.IP, identity string) bool {
+	if identity != "" && sel.identities[identity] {
+		return true
+	}
+	for _, ipnet := range sel.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// startMirror opens config.MirrorTarget (server mode)
+func (t *Tunnel) startMirror() error {
+	sel, err := parseMirrorSessions(t.config.MirrorSessions)
+	if err != nil {
+		return err
+	}
+	m, err := mirror.New(t.config.MirrorTarget, t.config.MirrorRateMbps)
+	if err != nil {
+		return fmt.Errorf("failed to open mirror target: %v", err)
+	}
+	t.mirror, t.mirrorSel = m, sel
+	log.Printf("⚠️  Mirroring the decrypted traffic of sessions %s to %s", strings.Join(t.config.MirrorSessions, ", "), t.config.MirrorTarget)
+	return nil
+}
+
+// mirrored reports whether the client's traffic is mirrored, deciding once its
+// tunnel IP is known
+func (t *Tunnel) mirrored(client *ClientConnection) bool {
+	switch atomic.LoadInt32(&client.mirrored) {
+	case mirrorOn:
+		return true
+	case mirrorOff:
+		return false
+	}
+	t.clientsMux.RLock()
+	ip := client.clientIP
+	t.clientsMux.RUnlock()
+	if ip == nil {
+		return false
+	}
+	client.mu.RLock()
+	identity := client.identity
+	client.mu.RUnlock()
+
+	decision := mirrorOff
+	if t.mirrorSel.match(ip, identity) {
+		decision = mirrorOn
+	}
+	if !atomic.CompareAndSwapInt32(&client.mirrored, mirrorUndecided, decision) || decision == mirrorOff {
+		return decision == mirrorOn
+	}
+	client.logf("Mirroring session %s (%s) to %s", ip, client.conn.RemoteAddr(), t.mirror.Target())
+	t.auditLog.Log(audit.Record{
+		Event:      audit.EventMirror,
+		RemoteAddr: client.conn.RemoteAddr().String(),
+		TunnelIP:   ip.String(),
+		Identity:   identity,
+		Result:     t.mirror.Target(),
+		Session:    client.sessionID,
+	})
+	return true
+}
+
+// mirrorFromClient copies a packet the client sent
+func (t *Tunnel) mirrorFromClient(client *ClientConnection, packet []byte) {
+	if t.mirror != nil && t.mirrored(client) {
+		t.mirror.Packet(packet, mirror.FromClient)
+	}
+}
+
+// mirrorToClient copies a packet on its way to a client
+func (t *Tunnel) mirrorToClient(client *ClientConnection, packet []byte) {
+	if t.mirror != nil && t.mirrored(client) {
+		t.mirror.Packet(packet, mirror.ToClient)
+	}
+}
+
+// mirrorRouted copies a packet read from the TUN device to the session it is
+// routed to
+func (t *Tunnel) mirrorRouted(packet []byte) {
+	if t.mirror == nil || len(packet) < IPv4MinHeaderLen || packet[0]>>4 != IPv4Version {
+		return
+	}
+	dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+	client := t.getClientByIP(dstIP)
+	if client == nil {
+		client = t.findRouteClient(dstIP)
+	}
+	if client != nil {
+		t.mirrorToClient(client, packet)
+	}
+}
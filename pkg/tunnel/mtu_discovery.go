@@ -90,13 +90,13 @@ const encryptionOverhead = 28
 safeMTU := optimal - ipHeaderSize - tcpHeaderSize - packetTypeOverhead - encryptionOverhead
 
 // Ensure we don't go below minimum
-if safeMTU < 500 {
-safeMTU = 500
+if safeMTU < minDiscoveredMTU {
+safeMTU = minDiscoveredMTU
 }
 
 // Cap at reasonable maximum for rawtcp mode
-if safeMTU > 1371 {
-safeMTU = 1371 // Safe maximum for rawtcp + encryption
+if safeMTU > rawTCPSafeMTU {
+safeMTU = rawTCPSafeMTU
 }
 
 log.Printf("✅ MTU探测完成")
@@ -136,20 +136,10 @@ return true
 
 // GetRecommendedMTU returns a recommended MTU based on common network types
 func GetRecommendedMTU(networkType string) int {
-switch networkType {
-case "ethernet":
-return 1371 // Safe for rawtcp + encryption over standard Ethernet
-case "pppoe":
-return 1343 // PPPoE reduces MTU by 8 bytes, then account for overhead
-case "mobile":
-return 1200 // Conservative for mobile networks
-case "vpn":
-return 1300 // Account for VPN overhead
-case "wifi":
-return 1371 // Usually same as Ethernet
-default:
-return 1371 // Safe default
+if mtu, ok := profileMTUs[networkType]; ok {
+return mtu
 }
+return rawTCPSafeMTU // Safe default
 }
 
 // AutoDetectNetworkType attempts to detect the network type
@@ -0,0 +1,250 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mtuProbeTimeout = 2 * time.Second // How long to wait for a probe to be acknowledged
+	mtuProbeMinStep = 16              // Stop the search once the remaining window is this narrow
+	mtuProbeHeader  = 1 + 4 + 2       // PacketType + probeID + probed MTU
+	mtuProbeMACLen  = 8               // Truncated HMAC after the header
+	mtuProbeToken   = mtuProbeHeader - 1 + mtuProbeMACLen
+)
+
+// A probe carries a token the server echoes verbatim: the probe ID, which is
+// the client's clock in milliseconds, the probed size and an HMAC of both
+// under a key only the client knows. The server answers from the probe alone
+// and keeps nothing per probe or per source, so probes arriving before the
+// handshake or from a source that never completes one cost it a single reply
+// no larger than the probe. The client checks the echoed token against its key
+// and the probe's age instead of trusting any ack that names the right ID.
+// Servers that echo only ID and size are still understood.
+
+// mtuProbeKey keys the probe tokens of this process
+var mtuProbeKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("mtu probe key: %v", err))
+	}
+	return key
+}()
+
+// mtuProbeMAC returns the MAC of a probe token (ID and size)
+func mtuProbeMAC(token []byte) []byte {
+	mac := hmac.New(sha256.New, mtuProbeKey)
+	mac.Write(token[:mtuProbeHeader-1])
+	return mac.Sum(nil)[:mtuProbeMACLen]
+}
+
+// mtuProbeAck is a probe acknowledgement received from the server
+type mtuProbeAck struct {
+	id   uint32
+	size int
+}
+
+// startMTUProbing runs mtuProbeLoop unless it is running already or probing
+// is disabled
+func (t *Tunnel) startMTUProbing() {
+	if t.config.MTUProbeInterval <= 0 || !t.mtuProbing.CompareAndSwap(false, true) {
+		return
+	}
+	t.wg.Add(1)
+	go t.mtuProbeLoop()
+}
+
+// mtuProbeLoop periodically probes above the current path MTU and raises it
+// again once the path carries larger packets (client mode). It exits when the
+// full tunnel MTU has been restored.
+func (t *Tunnel) mtuProbeLoop() {
+	defer t.wg.Done()
+	defer t.mtuProbing.Store(false)
+
+	ticker := time.NewTicker(time.Duration(t.config.MTUProbeInterval) * time.Second)
+	defer ticker.Stop()
+
+	log.Printf("MTU probing enabled: path MTU %d, ceiling %d, interval %ds",
+		atomic.LoadInt32(&t.pathMTU), t.config.MTU, t.config.MTUProbeInterval)
+
+	var traffic activityTracker
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+		// Wait for a pause in the traffic; probes would only compete with it
+		if traffic.advanced(t.statBytesIn.Load() + t.statBytesOut.Load()) {
+			continue
+		}
+
+		current := int(atomic.LoadInt32(&t.pathMTU))
+		if current == 0 {
+			return
+		}
+
+		ceiling := t.config.MTU
+		if sendMTU := int(atomic.LoadInt32(&t.serverSendMTU)); sendMTU > 0 && sendMTU < ceiling {
+			ceiling = sendMTU
+		}
+		if pushed := int(atomic.LoadInt32(&t.pushedMTU)); pushed > 0 && pushed < ceiling {
+			ceiling = pushed
+		}
+		if best := t.searchPathMTU(current, ceiling); best > current {
+			t.raisePathMTU(current, best)
+		}
+	}
+}
+
+// searchPathMTU returns the largest size in (low, high] acknowledged by the
+// server, or low if none is. The ceiling is tried first since a recovered path
+// usually carries the full MTU again.
+func (t *Tunnel) searchPathMTU(low, high int) int {
+	if high <= low {
+		return low
+	}
+	if t.probePathMTU(high) {
+		return high
+	}
+	high--
+	for high-low >= mtuProbeMinStep {
+		mid := (low + high + 1) / 2
+		if t.probePathMTU(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low
+}
+
+// probePathMTU sends one probe padded to the wire size of a size-byte inner
+// packet and reports whether the server acknowledged it
+func (t *Tunnel) probePathMTU(size int) bool {
+	conn := t.conn
+	if conn == nil {
+		return false
+	}
+
+	// Data packets carry a packet type byte, plus the shard header and length
+	// prefix in FEC mode
+	probeLen := 1 + size
+	if t.fecEnabled {
+		probeLen += fecShardHeaderLen + 2
+		if atomic.LoadUint32(&t.shardChecksum) != 0 {
+			probeLen += fecChecksumLen
+		}
+	}
+	probe := make([]byte, max(probeLen, 1+mtuProbeToken))
+	id := uint32(time.Now().UnixMilli())
+	probe[0] = PacketTypeMTUProbe
+	binary.BigEndian.PutUint32(probe[1:5], id)
+	binary.BigEndian.PutUint16(probe[5:7], uint16(size))
+	copy(probe[mtuProbeHeader:], mtuProbeMAC(probe[1:]))
+
+	encrypted, err := t.encryptPacket(probe)
+	if err != nil {
+		return false
+	}
+	if err := conn.WritePacket(encrypted); err != nil {
+		return false
+	}
+
+	timer := time.NewTimer(mtuProbeTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ack := <-t.mtuProbeAcks:
+			if ack.id == id && ack.size == size {
+				return true
+			}
+			// Late acknowledgement of an earlier probe
+		case <-timer.C:
+			return false
+		case <-t.stopCh:
+			return false
+		}
+	}
+}
+
+// raisePathMTU applies a larger probed path MTU to the TUN device
+func (t *Tunnel) raisePathMTU(from, to int) {
+	if err := setLinkMTU(t.tunName, to); err != nil {
+		log.Printf("⚠️  Failed to raise TUN MTU to %d: %v", to, err)
+		return
+	}
+	if to >= t.config.MTU {
+		atomic.StoreInt32(&t.pathMTU, 0)
+	} else {
+		atomic.StoreInt32(&t.pathMTU, int32(to))
+	}
+	t.setMTUSource(MTUSourceDiscovered)
+	storeCachedMTU(t.config.StateCacheFile, t.config.RemoteAddr, to)
+	log.Printf("✅ 路径MTU已恢复: %d -> %d", from, to)
+}
+
+// answerMTUProbe acknowledges a probe from a client by echoing its token
+// (server mode). Nothing is kept; a probe shorter than the size it claims to
+// probe is not acknowledged.
+func (t *Tunnel) answerMTUProbe(client *ClientConnection, payload []byte) {
+	if len(payload) < mtuProbeHeader-1 {
+		return
+	}
+	if size := int(binary.BigEndian.Uint16(payload[4:6])); len(payload) < size {
+		return
+	}
+	token := payload[:min(len(payload), mtuProbeToken)]
+	ack := make([]byte, 1+len(token))
+	ack[0] = PacketTypeMTUProbeAck
+	copy(ack[1:], token)
+
+	encrypted, err := t.encryptForClient(client, ack)
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to acknowledge MTU probe from %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// handleMTUProbeAck hands a probe acknowledgement to mtuProbeLoop (client mode)
+func (t *Tunnel) handleMTUProbeAck(payload []byte) {
+	if len(payload) < mtuProbeHeader-1 {
+		return
+	}
+	if len(payload) >= mtuProbeToken {
+		if !hmac.Equal(payload[mtuProbeHeader-1:mtuProbeToken], mtuProbeMAC(payload)) {
+			return
+		}
+		// IDs are the client's clock in milliseconds; an ack older than a
+		// probe can wait for is of no use
+		sent := binary.BigEndian.Uint32(payload[0:4])
+		if age := uint32(time.Now().UnixMilli()) - sent; age > uint32(mtuProbeTimeout.Milliseconds()) {
+			return
+		}
+	}
+	ack := mtuProbeAck{
+		id:   binary.BigEndian.Uint32(payload[0:4]),
+		size: int(binary.BigEndian.Uint16(payload[4:6])),
+	}
+	select {
+	case t.mtuProbeAcks <- ack:
+	default:
+	}
+}
+
+func setLinkMTU(ifname string, mtu int) error {
+	output, err := exec.Command("ip", "link", "set", "dev", ifname, "mtu", fmt.Sprintf("%d", mtu)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, output)
+	}
+	return nil
+}
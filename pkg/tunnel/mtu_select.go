@@ -0,0 +1,80 @@
+package tunnel
+
+import "log"
+
+// The tunnel MTU is taken from the first available source, in order:
+//
+//	config      mtu set explicitly
+//	cache       path MTU discovered on an earlier run (state_cache, client mode)
+//	discovered  path MTU discovery at startup (client mode with mtu = 0)
+//	profile     default for the detected network type
+//
+// The chosen value is then clamped so an encrypted packet (and an FEC shard)
+// fits one raw TCP segment; clamps never raise it.
+
+// MTU sources reported by MTUStatus
+const (
+	MTUSourceConfig     = "config"
+	MTUSourceCache      = "cache"
+	MTUSourceDiscovered = "discovered"
+	MTUSourceProfile    = "profile"
+	MTUSourceServer     = "server" // Pushed by the server (client_push)
+	MTUSourceICMP       = "icmp"   // Lowered by an ICMP fragmentation-needed error
+)
+
+const (
+	// defaultRawTCPSegment is the default fake TCP segment payload (faketcp.Tuning.MaxSegmentSize)
+	defaultRawTCPSegment = 1400
+	// gcmPacketOverhead is the packet type byte plus the AES-GCM nonce and tag
+	gcmPacketOverhead = 1 + 28
+	// rawTCPSafeMTU is the largest encrypted packet that fits a default segment
+	rawTCPSafeMTU = defaultRawTCPSegment - gcmPacketOverhead
+	// minDiscoveredMTU is the floor for an MTU derived from path discovery
+	minDiscoveredMTU = 500
+)
+
+// profileMTUs are the default tunnel MTUs per detected network type
+var profileMTUs = map[string]int{
+	"ethernet": rawTCPSafeMTU,
+	"wifi":     rawTCPSafeMTU,
+	"pppoe":    rawTCPSafeMTU - 28, // PPPoE header plus headroom for the access network
+	"mobile":   1200,               // Conservative for mobile networks
+	"vpn":      1300,               // Account for VPN overhead
+}
+
+// mtuSelection records how the tunnel MTU was chosen
+type mtuSelection struct {
+	source  string
+	clamped string // Why the source value was lowered, empty if it was not
+}
+
+func (s mtuSelection) String() string {
+	if s.clamped == "" {
+		return s.source
+	}
+	return s.source + ", clamped by " + s.clamped
+}
+
+// clamp lowers *mtu to limit, recording why
+func (s *mtuSelection) clamp(mtu *int, limit int, reason string) {
+	if *mtu <= limit {
+		return
+	}
+	log.Printf("⚠️  Adjusting MTU from %d to %d (%s)", *mtu, limit, reason)
+	*mtu = limit
+	s.clamped = reason
+}
+
+// MTUStatus returns the MTU currently used on the TUN device and where it came from
+func (t *Tunnel) MTUStatus() (mtu int, source string) {
+	t.mtuSelMux.Lock()
+	defer t.mtuSelMux.Unlock()
+	return t.tunMTU(), t.mtuSel.String()
+}
+
+// setMTUSource records a new MTU source after probing changed the MTU
+func (t *Tunnel) setMTUSource(source string) {
+	t.mtuSelMux.Lock()
+	t.mtuSel.source = source
+	t.mtuSelMux.Unlock()
+}
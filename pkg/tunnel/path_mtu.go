@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// connSendMTU returns the inner MTU usable toward the peer of conn.
+//
+// The tunnel MTU is sized so a packet fits the local segment limit after
+// encryption and FEC overhead. During the handshake each side advertises the
+// largest packet it can receive, so the send direction may be capped lower
+// than the receive direction; the shortfall is taken off this direction only.
+func (t *Tunnel) connSendMTU(conn faketcp.ConnAdapter) int {
+	mtu := t.config.MTU
+	if shortfall := faketcp.GetTuning().MaxSegmentSize - conn.SendMSS(); shortfall > 0 {
+		mtu = max(mtu-shortfall, minMTU)
+		if mtu < t.config.MTU {
+			log.Printf("⚠️  Asymmetric path MTU with %s: send MTU %d, receive MTU %d",
+				conn.RemoteAddr(), mtu, t.config.MTU)
+		}
+	}
+	return min(mtu, t.config.MTU)
+}
+
+// setClientSendMTU records the send MTU toward the server after (re)connecting
+func (t *Tunnel) setClientSendMTU(conn faketcp.ConnAdapter) {
+	atomic.StoreInt32(&t.serverSendMTU, int32(t.connSendMTU(conn)))
+}
+
+// clientSendMTU returns the inner MTU toward the server (client mode)
+func (t *Tunnel) clientSendMTU() int {
+	mtu := t.config.MTU
+	if sendMTU := atomic.LoadInt32(&t.serverSendMTU); sendMTU > 0 {
+		mtu = int(sendMTU)
+	}
+	if pathMTU := int(atomic.LoadInt32(&t.pathMTU)); pathMTU > 0 && pathMTU < mtu {
+		mtu = pathMTU
+	}
+	return mtu
+}
+
+// tunMTU returns the MTU configured on the TUN device: the probed path MTU
+// while it is below the tunnel MTU, otherwise the tunnel MTU
+func (t *Tunnel) tunMTU() int {
+	if pathMTU := atomic.LoadInt32(&t.pathMTU); pathMTU > 0 {
+		return int(pathMTU)
+	}
+	return t.config.MTU
+}
+
+// destSendMTU returns the inner MTU toward the client that will carry packet
+// (server mode), falling back to the tunnel MTU for unknown destinations.
+func (t *Tunnel) destSendMTU(packet []byte) int {
+	if len(packet) < IPv4MinHeaderLen || packet[0]>>4 != IPv4Version {
+		return t.config.MTU
+	}
+	dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+	client := t.getClientByIP(dstIP)
+	if client == nil {
+		client = t.findRouteClient(dstIP)
+	}
+	if client == nil || atomic.LoadInt32(&client.sendMTU) <= 0 {
+		return t.config.MTU
+	}
+	return int(atomic.LoadInt32(&client.sendMTU))
+}
@@ -0,0 +1,279 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// In peer mode both ends listen on local_addr and dial remote_addr at startup,
+// so the tunnel comes up whichever side's NAT or firewall lets a connection
+// through. Every connection that completes starts with a hello carrying a
+// random role token. The end with the larger token decides: after a short
+// grace period for the other direction it keeps the connection dialed by the
+// smaller token (or the only one that completed), marks it chosen and closes
+// the rest. Each end then runs as a client on the connection it dialed or as
+// a server on the one it accepted.
+//
+// Layout: [PacketTypePeerHello][token:8][chosen:1]
+
+const (
+	peerHelloLen = 1 + 8 + 1
+	// peerRaceGrace is how long the deciding end waits for the second direction
+	peerRaceGrace = 500 * time.Millisecond
+	// peerDialRetry is the pause between dial attempts while the peer is not up
+	peerDialRetry = 2 * time.Second
+	// peerWaitMin is the shortest time startup waits for the peer to come up
+	peerWaitMin = 60 * time.Second
+)
+
+// peerCandidate is a connection whose hello exchange completed
+type peerCandidate struct {
+	conn   faketcp.ConnAdapter
+	dialed bool   // We dialed it (client role if chosen)
+	token  uint64 // The peer's role token
+}
+
+// peerListener serves accepts from a channel so the role race and, in server
+// role, acceptClients can take turns reading the same listener
+type peerListener struct {
+	faketcp.ListenerAdapter
+	conns     chan faketcp.ConnAdapter
+	err       error
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeerListener(l faketcp.ListenerAdapter) *peerListener {
+	p := &peerListener{ListenerAdapter: l, conns: make(chan faketcp.ConnAdapter), stop: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				p.err = err
+				close(p.conns)
+				return
+			}
+			select {
+			case p.conns <- conn:
+			case <-p.stop:
+				conn.Close()
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *peerListener) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	return p.ListenerAdapter.Close()
+}
+
+func (p *peerListener) Accept() (faketcp.ConnAdapter, error) {
+	conn, ok := <-p.conns
+	if !ok {
+		return nil, p.err
+	}
+	return conn, nil
+}
+
+func encodePeerHello(token uint64, chosen bool) []byte {
+	buf := make([]byte, peerHelloLen)
+	buf[0] = PacketTypePeerHello
+	binary.BigEndian.PutUint64(buf[1:9], token)
+	if chosen {
+		buf[9] = 1
+	}
+	return buf
+}
+
+// readPeerHello reads one hello from conn before deadline
+func (t *Tunnel) readPeerHello(conn faketcp.ConnAdapter, deadline time.Time) (token uint64, chosen bool, err error) {
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		return 0, false, err
+	}
+	plain := packet
+	if t.cipher != nil {
+		if plain, err = t.decryptPacket(packet); err != nil {
+			return 0, false, fmt.Errorf("undecryptable hello (key mismatch?): %v", err)
+		}
+	}
+	if len(plain) != peerHelloLen || plain[0] != PacketTypePeerHello {
+		return 0, false, fmt.Errorf("unexpected packet during peer handshake")
+	}
+	return binary.BigEndian.Uint64(plain[1:9]), plain[9] == 1, nil
+}
+
+func (t *Tunnel) writePeerHello(conn faketcp.ConnAdapter, token uint64, chosen bool) error {
+	encrypted, err := t.encryptPacket(encodePeerHello(token, chosen))
+	if err != nil {
+		return err
+	}
+	return conn.WritePacket(encrypted)
+}
+
+// peerHandshake exchanges hellos on a new connection and reports whether it
+// completed. When the peer decides, it keeps waiting for the peer to mark this
+// connection chosen.
+func (t *Tunnel) peerHandshake(conn faketcp.ConnAdapter, dialed bool, token uint64, timeout time.Duration,
+	candidates, chosen chan<- peerCandidate, done <-chan struct{}) bool {
+	reject := func(err error) bool {
+		log.Printf("Peer handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return false
+	}
+	if err := t.writePeerHello(conn, token, false); err != nil {
+		return reject(err)
+	}
+	peerToken, _, err := t.readPeerHello(conn, time.Now().Add(timeout))
+	if err != nil {
+		return reject(err)
+	}
+	if peerToken == token {
+		return reject(fmt.Errorf("both ends drew the same role token"))
+	}
+	c := peerCandidate{conn: conn, dialed: dialed, token: peerToken}
+	select {
+	case candidates <- c:
+	case <-done:
+		conn.Close()
+		return true
+	}
+	if peerToken < token {
+		return true // We decide
+	}
+	if _, isChosen, err := t.readPeerHello(conn, time.Now().Add(timeout)); err != nil || !isChosen {
+		return true // Not chosen; the race closes it
+	}
+	select {
+	case chosen <- c:
+	case <-done:
+	}
+	return true
+}
+
+// resolvePeerRole races accepting and dialing the peer, then switches the
+// tunnel to client or server mode on the connection that won (peer mode)
+func (t *Tunnel) resolvePeerRole() error {
+	var tokenBuf [8]byte
+	if _, err := rand.Read(tokenBuf[:]); err != nil {
+		return err
+	}
+	token := binary.BigEndian.Uint64(tokenBuf[:])
+	timeout := time.Duration(t.config.Timeout) * time.Second
+
+	mode := faketcp.GetMode()
+	log.Printf("Peer mode: listening on %s and dialing %s using %s", t.config.LocalAddr, t.config.RemoteAddr, faketcp.ModeString(mode))
+	rawListener, err := faketcp.ListenWithMode(t.config.LocalAddr, mode)
+	if err != nil {
+		return err
+	}
+	listener := newPeerListener(rawListener)
+
+	candidates := make(chan peerCandidate)
+	chosenCh := make(chan peerCandidate)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			conn, err := faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+			if err == nil && t.peerHandshake(conn, true, token, peerDialRetry, candidates, chosenCh, done) {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(peerDialRetry):
+			}
+		}
+	}()
+
+	peerWait := max(timeout, peerWaitMin)
+	deadline := time.After(peerWait)
+	var (
+		pending  []peerCandidate
+		selected *peerCandidate
+		decideC  <-chan time.Time
+	)
+	for selected == nil {
+		select {
+		case conn, ok := <-listener.conns:
+			if !ok {
+				close(done)
+				return fmt.Errorf("peer listener closed: %v", listener.err)
+			}
+			go t.peerHandshake(conn, false, token, timeout, candidates, chosenCh, done)
+		case c := <-candidates:
+			direction := "accepted"
+			if c.dialed {
+				direction = "dialed"
+			}
+			log.Printf("Peer handshake completed with %s (%s)", c.conn.RemoteAddr(), direction)
+			pending = append(pending, c)
+			if c.token < token && decideC == nil {
+				decideC = time.After(peerRaceGrace)
+			}
+		case c := <-chosenCh:
+			selected = &c
+		case <-decideC:
+			// Prefer the direction dialed by the smaller token; we hold the larger one
+			best := 0
+			for i, c := range pending {
+				if !c.dialed {
+					best = i
+					break
+				}
+			}
+			c := pending[best]
+			if err := t.writePeerHello(c.conn, token, true); err != nil {
+				log.Printf("Failed to confirm peer connection: %v", err)
+				c.conn.Close()
+				pending = append(pending[:best], pending[best+1:]...)
+				decideC = nil
+				if len(pending) > 0 {
+					decideC = time.After(0)
+				}
+				continue
+			}
+			selected = &c
+		case <-deadline:
+			close(done)
+			for _, c := range pending {
+				c.conn.Close()
+			}
+			listener.Close()
+			return fmt.Errorf("no connection with %s within %v", t.config.RemoteAddr, peerWait)
+		}
+	}
+	close(done)
+	for _, c := range pending {
+		if c.conn != selected.conn {
+			c.conn.Close()
+		}
+	}
+
+	if selected.dialed {
+		listener.Close()
+		t.config.Mode = "client"
+		t.conn = t.impairConn(selected.conn)
+		t.setClientSendMTU(selected.conn)
+		t.setOuterEndpoint(selected.conn)
+		t.noteHandshake(false)
+		log.Printf("Peer mode: acting as client on %s -> %s", selected.conn.LocalAddr(), selected.conn.RemoteAddr())
+	} else {
+		t.config.Mode = "server"
+		t.listener = listener
+		t.peerConn = selected.conn
+		log.Printf("Peer mode: acting as server for %s", selected.conn.RemoteAddr())
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/pki"
+)
+
+// A client can pin the key its server proves in the auth handshake (a server
+// with cert_file and cert_key but no ca_cert signs the client's nonce, like in
+// PKI mode, without requiring client certificates). With server_fingerprint
+// the key must match it; with known_servers the first key seen for
+// remote_addr is recorded there, one line per server:
+//
+//	<remote_addr> <hex SHA-256 of the public key>
+//
+// and a different key later is refused until accept_new_server_key replaces
+// the entry. Servers sharing one address (DNS round-robin) must share a key.
+
+// pinsServerKey reports whether the client checks the server's key
+func (t *Tunnel) pinsServerKey() bool {
+	return t.config.Mode == "client" && (t.config.ServerFingerprint != "" || t.config.KnownServersFile != "")
+}
+
+// challengeServerKey adds the nonce the server must sign to an auth request
+func (t *Tunnel) challengeServerKey(req *AuthenticationRequest) error {
+	nonce, err := newAuthNonce()
+	if err != nil {
+		return fmt.Errorf("failed to generate auth nonce: %v", err)
+	}
+	req.Nonce = nonce
+	t.authMux.Lock()
+	t.authNonce = nonce
+	t.authMux.Unlock()
+	return nil
+}
+
+// normalizeFingerprint accepts fingerprints with colons and in any case
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// verifyPinnedServerKey checks that the server signed our nonce and that its
+// key is the pinned or, on first use, recorded one (client mode)
+func (t *Tunnel) verifyPinnedServerKey(resp *AuthenticationResponse) error {
+	if len(resp.Certificate) == 0 {
+		return fmt.Errorf("server key rejected (%s): the server presents no key; configure cert_file and cert_key on it", AuthStatusCertUntrusted)
+	}
+	cert, err := x509.ParseCertificate(resp.Certificate)
+	if err != nil {
+		return fmt.Errorf("server key rejected (%s): %v", AuthStatusCertUntrusted, err)
+	}
+	t.authMux.RLock()
+	nonce := t.authNonce
+	t.authMux.RUnlock()
+	payload := authSigningPayload("server", resp.Timestamp, t.myTunnelIP.String(), nonce)
+	if err := pki.VerifySignature(cert, payload, resp.Signature); err != nil {
+		return fmt.Errorf("server key rejected (%s): bad signature", AuthStatusCertUntrusted)
+	}
+
+	fp := pki.Fingerprint(cert)
+	if pinned := t.config.ServerFingerprint; pinned != "" {
+		if fp != normalizeFingerprint(pinned) {
+			return fmt.Errorf("server key rejected (%s): fingerprint %s does not match the pinned %s", AuthStatusCertUntrusted, fp, pinned)
+		}
+		log.Printf("✅ Server key matches the pinned fingerprint")
+		return nil
+	}
+
+	server := t.config.RemoteAddr
+	known, err := loadKnownServers(t.config.KnownServersFile)
+	if err != nil {
+		return fmt.Errorf("server key rejected (%s): %v", AuthStatusCertUntrusted, err)
+	}
+	switch prev, ok := known[server]; {
+	case ok && prev == fp:
+		log.Printf("✅ Server key matches the one recorded for %s", server)
+		return nil
+	case ok && !t.config.AcceptNewServerKey:
+		return fmt.Errorf("server key rejected (%s): the key of %s changed from %s to %s, which may mean someone is impersonating the server; if it was replaced on purpose, reconnect once with -accept-new-server-key",
+			AuthStatusCertUntrusted, server, prev, fp)
+	case ok:
+		log.Printf("⚠️  Key of %s changed from %s to %s, accepting it as requested", server, prev, fp)
+	default:
+		log.Printf("Trusting key %s of %s on first use", fp, server)
+	}
+	known[server] = fp
+	if err := storeKnownServers(t.config.KnownServersFile, known); err != nil {
+		log.Printf("⚠️  Failed to record server key in %s: %v", t.config.KnownServersFile, err)
+	}
+	return nil
+}
+
+// loadKnownServers reads a known_servers file; a missing file is empty
+func loadKnownServers(path string) (map[string]string, error) {
+	known := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line in %s: %q", path, line)
+		}
+		known[fields[0]] = normalizeFingerprint(fields[1])
+	}
+	return known, scanner.Err()
+}
+
+// storeKnownServers rewrites a known_servers file
+func storeKnownServers(path string, known map[string]string) error {
+	servers := make([]string, 0, len(known))
+	for server := range known {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	var b strings.Builder
+	b.WriteString("# Server keys trusted on first use by lightweight-tunnel\n")
+	for _, server := range servers {
+		fmt.Fprintf(&b, "%s %s\n", server, known[server])
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
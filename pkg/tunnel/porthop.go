@@ -0,0 +1,424 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+)
+
+// Port hopping moves the tunnel to a new server port every port_hop_interval
+// so that no flow lives long enough for policies that throttle a 5-tuple after
+// some volume. Both ends derive the port of each interval from a hop secret,
+// so the schedule cannot be predicted without it:
+//
+//	secret  = HMAC-SHA256(key, "port-hop-secret")
+//	port(n) = low + HMAC-SHA256(secret, "port-hop" | n) mod (high-low+1)
+//
+// where n counts intervals since the Unix epoch. Clients count them on the
+// server's clock as measured at the start of each session (clocksync.go); the
+// server listens on the ports of the previous, current and next interval,
+// which tolerates remaining clock skew of up to one interval, and closes the listener of an older one together
+// with its firewall rules. At each boundary the client dials the new port
+// from a new local port before closing the old connection, so the hop costs
+// a handshake rather than a reconnect.
+//
+// The secret is derived from the key each end starts with and does not follow
+// key rotation, which would otherwise move the server's listeners to the new
+// key's ports and end every session before its client could follow. The
+// server tells each session its secret when the session starts, sealed like
+// any other packet, so a client that started with a different (rotated and
+// persisted) key takes the server's schedule; until then it dials the port of
+// remote_addr, which the server always listens on, if the port of its own
+// schedule does not answer.
+//
+// Layout: [PacketTypePortHop][secret]
+
+const (
+	defaultPortHopInterval = 5 * time.Minute
+	portHopRetry           = 5 * time.Second // Wait after a failed hop before trying again
+)
+
+// portHopper holds the hopping schedule and its state
+type portHopper struct {
+	low, high uint16
+	interval  time.Duration
+	hops      atomic.Uint64 // Completed hops (client mode)
+	dialed    atomic.Int64  // Interval of the port last dialed, -1 to hop at once (client mode)
+	secret    atomic.Value  // Hop secret ([]byte); the server's once it announced it (client mode)
+
+	mu         sync.Mutex
+	listeners  map[uint16]faketcp.ListenerAdapter // Open hop ports (server mode)
+	listenErrs map[uint16]bool                    // Wanted ports that failed to open, logged once
+	filter     *faketcp.RSTFilter                 // RST filter rules of the hop ports (server in raw mode)
+	filterErr  bool                               // The last filter update failed, logged once
+}
+
+// ParsePortRange parses a port range such as "40000-40999"
+func ParsePortRange(s string) (low, high uint16, err error) {
+	lowStr, highStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q (want LOW-HIGH)", s)
+	}
+	l, err1 := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+	h, err2 := strconv.ParseUint(strings.TrimSpace(highStr), 10, 16)
+	if err1 != nil || err2 != nil || l == 0 || l > h {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(l), uint16(h), nil
+}
+
+// hopSecretLen is the length of a hop secret
+const hopSecretLen = sha256.Size
+
+// hopSecret derives the hop secret from a key
+func hopSecret(key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("port-hop-secret"))
+	return mac.Sum(nil)
+}
+
+func newPortHopper(portRange string, intervalSecs int, key string) (*portHopper, error) {
+	low, high, err := ParsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultPortHopInterval
+	if intervalSecs > 0 {
+		interval = time.Duration(intervalSecs) * time.Second
+	}
+	h := &portHopper{low: low, high: high, interval: interval, listeners: make(map[uint16]faketcp.ListenerAdapter), listenErrs: make(map[uint16]bool)}
+	h.secret.Store(hopSecret(key))
+	return h, nil
+}
+
+// epoch returns the number of the interval now falls in
+func (h *portHopper) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(h.interval)
+}
+
+// contains reports whether port is in the hopping range
+func (h *portHopper) contains(port uint16) bool {
+	return h != nil && port >= h.low && port <= h.high
+}
+
+// hopPort returns the server port of interval n
+func (t *Tunnel) hopPort(n int64) uint16 {
+	mac := hmac.New(sha256.New, t.portHop.secret.Load().([]byte))
+	mac.Write([]byte("port-hop"))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+	span := uint64(t.portHop.high-t.portHop.low) + 1
+	return t.portHop.low + uint16(binary.BigEndian.Uint64(mac.Sum(nil))%span)
+}
+
+// dialRemote dials remote_addr, at the port of the current interval when
+// hopping (client mode)
+func (t *Tunnel) dialRemote(timeout time.Duration, mode faketcp.Mode) (faketcp.ConnAdapter, error) {
+	if t.portHop == nil {
+		return faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+	}
+	host, _, err := net.SplitHostPort(t.config.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	n := t.portHop.epoch(t.peerNow())
+	port := t.hopPort(n)
+	conn, err := faketcp.DialWithMode(net.JoinHostPort(host, strconv.Itoa(int(port))), timeout, mode)
+	if err != nil {
+		// The server may hop on another schedule; the port of remote_addr
+		// always answers, and the session tells us the server's secret
+		var baseErr error
+		conn, baseErr = faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+		if baseErr != nil {
+			return nil, err
+		}
+		log.Printf("⚠️  Hop port %d did not answer (%v), connected to %s until the server announces its schedule", port, err, t.config.RemoteAddr)
+	}
+	t.portHop.dialed.Store(n)
+	return conn, nil
+}
+
+// announcePortHop tells a client the hop secret (server mode)
+func (t *Tunnel) announcePortHop(client *ClientConnection) {
+	if t.portHop == nil {
+		return
+	}
+	packet := append([]byte{PacketTypePortHop}, t.portHop.secret.Load().([]byte)...)
+	encrypted, err := t.encryptForClient(client, packet)
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send port hop schedule to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// handlePortHop adopts the hop secret the server announced and moves to its
+// schedule at once if it differs from ours (client mode)
+func (t *Tunnel) handlePortHop(payload []byte) {
+	if t.portHop == nil || len(payload) != hopSecretLen {
+		return
+	}
+	if hmac.Equal(payload, t.portHop.secret.Load().([]byte)) {
+		return
+	}
+	t.portHop.secret.Store(append([]byte(nil), payload...))
+	t.portHop.dialed.Store(-1)
+	log.Printf("Port hop schedule received from the server, moving to it")
+}
+
+// portHopClientLoop moves the connection to the next port at every interval
+// boundary (client mode)
+func (t *Tunnel) portHopClientLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var retryAt time.Time
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+		now := t.peerNow()
+		if t.portHop.epoch(now) == t.portHop.dialed.Load() || now.Before(retryAt) {
+			continue
+		}
+		if err := t.hopServerPort(); err != nil {
+			log.Printf("⚠️  Port hop failed, staying on the current port: %v", err)
+			retryAt = now.Add(portHopRetry)
+		}
+	}
+}
+
+// hopServerPort connects to the port of the current interval and replaces the
+// tunnel connection with it (client mode)
+func (t *Tunnel) hopServerPort() error {
+	t.connMux.Lock()
+	connected := t.conn != nil
+	t.connMux.Unlock()
+	if !connected {
+		return nil // Reconnecting, which dials the current port anyway
+	}
+
+	if err := t.redialServer("Port hop"); err != nil {
+		return err
+	}
+	t.portHop.hops.Add(1)
+	return nil
+}
+
+// portHopServerLoop keeps listeners open on the ports of the previous, current
+// and next interval (server mode)
+func (t *Tunnel) portHopServerLoop() {
+	defer t.wg.Done()
+
+	host, _, err := net.SplitHostPort(t.config.LocalAddr)
+	if err != nil {
+		log.Printf("⚠️  Port hopping disabled: %v", err)
+		return
+	}
+	if faketcp.GetMode() == faketcp.ModeRaw {
+		t.portHop.mu.Lock()
+		t.portHop.filter = faketcp.NewRSTFilter()
+		t.portHop.mu.Unlock()
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		n := t.portHop.epoch(time.Now())
+		want := make(map[uint16]bool, 3)
+		for _, i := range []int64{n - 1, n, n + 1} {
+			if port := t.hopPort(i); port != t.outerPort {
+				want[port] = true
+			}
+		}
+		t.updateHopListeners(host, want)
+
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateHopListeners opens the wanted ports and closes the others. In raw
+// mode the RST filter rules of a change are applied in one batch, after the
+// old listeners are closed and before the new ones are created.
+func (t *Tunnel) updateHopListeners(host string, want map[uint16]bool) {
+	h := t.portHop
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-t.stopCh:
+		want = nil // Stopping: close everything, open nothing
+	default:
+	}
+	for port := range h.listenErrs {
+		if !want[port] {
+			delete(h.listenErrs, port)
+		}
+	}
+	for port, listener := range h.listeners {
+		if !want[port] {
+			delete(h.listeners, port)
+			if err := listener.Close(); err != nil {
+				log.Printf("Error closing hop listener on port %d: %v", port, err)
+			}
+			t.endHopSessions(port)
+		}
+	}
+	if h.filter != nil {
+		ports := make([]uint16, 0, len(want))
+		for port := range want {
+			ports = append(ports, port)
+		}
+		if err := h.filter.SetPorts(ports); err != nil {
+			if !h.filterErr {
+				log.Printf("⚠️  Failed to update the RST filter of the hop ports: %v", err)
+			}
+			h.filterErr = true
+		} else {
+			h.filterErr = false
+		}
+	}
+	for port := range want {
+		if h.listeners[port] != nil || (h.filter != nil && !h.filter.Has(port)) {
+			continue
+		}
+		listener, err := faketcp.ListenWithModeUnfiltered(net.JoinHostPort(host, strconv.Itoa(int(port))), faketcp.GetMode())
+		if err != nil {
+			if !h.listenErrs[port] {
+				log.Printf("⚠️  Failed to listen on hop port %d: %v", port, err)
+				h.listenErrs[port] = true
+			}
+			continue
+		}
+		delete(h.listenErrs, port)
+		h.listeners[port] = listener
+		t.wg.Add(1)
+		go t.acceptClients(listener)
+	}
+}
+
+// endHopSessions closes the sessions accepted on a hop port whose listener was
+// closed; their clients moved on to a later port (server mode)
+func (t *Tunnel) endHopSessions(port uint16) {
+	var stale []*ClientConnection
+	t.allClientsMux.RLock()
+	for client := range t.allClients {
+		if ap, ok := addrPortOf(client.conn.LocalAddr()); ok && ap.Port() == port {
+			stale = append(stale, client)
+		}
+	}
+	t.allClientsMux.RUnlock()
+	for _, client := range stale {
+		client.setDisconnectReason("port hop")
+		client.stopOnce.Do(func() {
+			client.conn.Close()
+			close(client.stopCh)
+		})
+	}
+}
+
+// hopListenerActive reports whether listener is an open hop listener, as
+// opposed to one closed because its interval passed (server mode)
+func (t *Tunnel) hopListenerActive(listener faketcp.ListenerAdapter) bool {
+	if t.portHop == nil {
+		return false
+	}
+	t.portHop.mu.Lock()
+	defer t.portHop.mu.Unlock()
+	for _, l := range t.portHop.listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// closeHopListeners closes every hop listener (server mode)
+func (t *Tunnel) closeHopListeners() {
+	if t.portHop == nil {
+		return
+	}
+	t.updateHopListeners("", nil)
+}
+
+// hopListeners returns the open hop listeners ordered by port (server mode)
+func (t *Tunnel) hopListeners() []faketcp.ListenerAdapter {
+	if t.portHop == nil {
+		return nil
+	}
+	t.portHop.mu.Lock()
+	defer t.portHop.mu.Unlock()
+	ports := make([]uint16, 0, len(t.portHop.listeners))
+	for port := range t.portHop.listeners {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	listeners := make([]faketcp.ListenerAdapter, len(ports))
+	for i, port := range ports {
+		listeners[i] = t.portHop.listeners[port]
+	}
+	return listeners
+}
+
+// hopFirewallRules reports the RST filter rules of the hop ports (server in
+// raw mode)
+func (t *Tunnel) hopFirewallRules() []iptables.RuleState {
+	if t.portHop == nil {
+		return nil
+	}
+	t.portHop.mu.Lock()
+	defer t.portHop.mu.Unlock()
+	if t.portHop.filter == nil {
+		return nil
+	}
+	return t.portHop.filter.FirewallRules()
+}
+
+// portHopStatus describes the hopping schedule for /status
+func (t *Tunnel) portHopStatus() *api.PortHopStatus {
+	if t.portHop == nil {
+		return nil
+	}
+	h := t.portHop
+	now := t.peerNow()
+	n := h.epoch(now)
+	s := &api.PortHopStatus{
+		Range:       fmt.Sprintf("%d-%d", h.low, h.high),
+		IntervalSec: int(h.interval / time.Second),
+		Port:        t.hopPort(n),
+		NextHop:     time.Now().Add(time.Unix(0, (n+1)*int64(h.interval)).Sub(now)),
+		Hops:        h.hops.Load(),
+	}
+	for _, listener := range t.hopListeners() {
+		if ap, ok := addrPortOf(listener.Addr()); ok {
+			s.Listening = append(s.Listening, ap.Port())
+		}
+	}
+	return s
+}
+
+// connReplaced reports whether a port hop replaced conn as the tunnel
+// connection after the caller read it, so its errors are stale (client mode)
+func (t *Tunnel) connReplaced(conn faketcp.ConnAdapter) bool {
+	t.connMux.Lock()
+	defer t.connMux.Unlock()
+	return t.conn != nil && t.conn != conn
+}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+)
+
+// hoppingTunnel returns a tunnel hopping over 40000-40999 that started with key
+func hoppingTunnel(t *testing.T, key string) *Tunnel {
+	t.Helper()
+	h, err := newPortHopper("40000-40999", 60, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := crypto.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Tunnel{config: &config.Config{Key: key}, portHop: h, cipher: c}
+}
+
+// schedule returns the ports of intervals first to first+count-1
+func schedule(tun *Tunnel, first int64, count int) []uint16 {
+	ports := make([]uint16, count)
+	for i := range ports {
+		ports[i] = tun.hopPort(first + int64(i))
+	}
+	return ports
+}
+
+// TestPortHopSurvivesRekey rotates the key while hopping and checks that the
+// schedule, and so the ports the server listens on, stays the same
+func TestPortHopSurvivesRekey(t *testing.T) {
+	tun := hoppingTunnel(t, "initial-tunnel-key")
+	before := schedule(tun, 1000, 16)
+	if err := tun.rotateCipher("rotated-tunnel-key"); err != nil {
+		t.Fatal(err)
+	}
+	after := schedule(tun, 1000, 16)
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("interval %d moved from port %d to %d on rekey", 1000+i, before[i], after[i])
+		}
+	}
+
+	// A schedule derived from the new key differs; a client restarted with
+	// it must learn the server's
+	fresh := hoppingTunnel(t, "rotated-tunnel-key")
+	differs := false
+	for i, port := range schedule(fresh, 1000, 16) {
+		differs = differs || port != before[i]
+	}
+	if !differs {
+		t.Fatal("schedules of different keys agree")
+	}
+}
+
+// TestPortHopAnnouncement hands a client that started with another key the
+// server's secret and checks that it follows the server's schedule at once
+func TestPortHopAnnouncement(t *testing.T) {
+	server := hoppingTunnel(t, "initial-tunnel-key")
+	client := hoppingTunnel(t, "rotated-tunnel-key")
+	client.portHop.dialed.Store(1000)
+
+	client.handlePortHop([]byte("short"))
+	if client.portHop.dialed.Load() != 1000 {
+		t.Fatal("malformed announcement accepted")
+	}
+
+	client.handlePortHop(server.portHop.secret.Load().([]byte))
+	want := schedule(server, 1000, 16)
+	for i, port := range schedule(client, 1000, 16) {
+		if port != want[i] {
+			t.Fatalf("interval %d: client port %d, server port %d", 1000+i, port, want[i])
+		}
+	}
+	if dialed := client.portHop.dialed.Load(); dialed != -1 {
+		t.Errorf("client does not hop at once (dialed %d)", dialed)
+	}
+
+	// Announcing the same secret again does not make it hop
+	client.portHop.dialed.Store(1001)
+	client.handlePortHop(server.portHop.secret.Load().([]byte))
+	if dialed := client.portHop.dialed.Load(); dialed != 1001 {
+		t.Errorf("unchanged secret made the client hop (dialed %d)", dialed)
+	}
+}
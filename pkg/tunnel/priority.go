@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"log"
+)
+
+// The priority lane sends small latency-critical inner packets (DNS, TCP
+// SYN/SYN-ACK) as plain data packets right away instead of waiting for an FEC
+// group to fill, optionally repeating them to make up for the missing parity.
+// Receivers handle plain data packets regardless of FEC, so only the sender
+// needs to enable it.
+
+// priorityMaxSize is the largest inner packet the classifier marks as priority
+const priorityMaxSize = 512
+
+const (
+	tcpFlagSYN = 0x02
+	dnsPort    = 53
+)
+
+// isPriorityPacket reports whether a queued element should take the priority
+// lane. Tunnel frames (aggregates, fragments) never do.
+func (t *Tunnel) isPriorityPacket(packet []byte) bool {
+	if !t.config.PriorityLane || !t.fecEnabled || len(packet) > priorityMaxSize || isTunnelFrame(packet) {
+		return false
+	}
+	if len(packet) < IPv4MinHeaderLen || packet[0]>>4 != IPv4Version {
+		return false
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if len(packet) < ihl+4 {
+		return false
+	}
+	srcPort := uint16(packet[ihl])<<8 | uint16(packet[ihl+1])
+	dstPort := uint16(packet[ihl+2])<<8 | uint16(packet[ihl+3])
+
+	switch packet[IPv4ProtocolOffset] {
+	case 17:
+		return srcPort == dnsPort || dstPort == dnsPort
+	case 6:
+		// Flags live at offset 13 of the TCP header
+		return len(packet) > ihl+13 && packet[ihl+13]&tcpFlagSYN != 0
+	}
+	return false
+}
+
+// priorityCopies is how many times a priority packet is sent
+func (t *Tunnel) priorityCopies() int {
+	if t.config.PriorityDuplicate > 1 {
+		return t.config.PriorityDuplicate
+	}
+	return 1
+}
+
+// sendPriority sends a priority packet to the server outside FEC (client mode)
+// and releases its buffer
+func (t *Tunnel) sendPriority(packet []byte) {
+	if t.sendPlain(packet, t.priorityCopies()) {
+		t.statPrioritySent.Add(1)
+	}
+}
+
+// sendPriorityToClient sends a priority packet to a client outside FEC (server
+// mode) and releases its buffer. It returns the write error, if any.
+func (t *Tunnel) sendPriorityToClient(client *ClientConnection, packet []byte) error {
+	sent, err := t.sendPlainToClient(client, packet, t.priorityCopies())
+	if sent {
+		t.statPrioritySent.Add(1)
+	}
+	return err
+}
+
+// sendPlain sends copies of a packet to the server as a plain data packet
+// (client mode), releases its buffer and reports whether it went out
+func (t *Tunnel) sendPlain(packet []byte, copies int) bool {
+	defer t.releasePacketBuffer(packet)
+	encrypted, err := t.encryptPacket(typedPacket(packet))
+	if err != nil {
+		log.Printf("Encryption error: %v", err)
+		return false
+	}
+	conn := t.conn
+	if conn == nil {
+		return false
+	}
+	for i := 0; i < copies; i++ {
+		if err := conn.WritePacket(encrypted); err != nil {
+			// The FEC path notices broken connections and reconnects
+			return false
+		}
+	}
+	return true
+}
+
+// sendPlainToClient sends copies of a packet to a client as a plain data
+// packet (server mode) and releases its buffer. It returns the write error,
+// if any.
+func (t *Tunnel) sendPlainToClient(client *ClientConnection, packet []byte, copies int) (bool, error) {
+	defer t.releasePacketBuffer(packet)
+	encrypted, err := t.encryptForClient(client, typedPacket(packet))
+	if err != nil {
+		client.logf("Client encryption error: %v", err)
+		return false, nil
+	}
+	for i := 0; i < copies; i++ {
+		if err := client.conn.WritePacket(encrypted); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
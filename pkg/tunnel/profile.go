@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stage timing measures where the receive path spends its time so a slow
+// router can be diagnosed from the admin API without a profiling build. It is
+// off by default; while off, each stage costs one atomic load.
+//
+//	parse      checks and dispatch after a segment is read, up to decryption or the FEC queue
+//	decrypt    decryption of a packet, including the previous key during a rotation
+//	fec        handling of one FEC shard, including group reconstruction
+//	tun_write  writing one packet to the TUN device
+
+type recvStage int
+
+const (
+	stageParse recvStage = iota
+	stageDecrypt
+	stageFEC
+	stageTUNWrite
+	numRecvStages
+)
+
+var recvStageNames = [numRecvStages]string{"parse", "decrypt", "fec", "tun_write"}
+
+// recvStages accumulates the time spent in each receive stage
+type recvStages struct {
+	enabled atomic.Bool
+	since   atomic.Int64 // UnixNano when timing was last enabled
+	stages  [numRecvStages]struct {
+		count, nanos, max atomic.Uint64
+	}
+}
+
+// start returns the time a stage begins, or the zero time while disabled
+func (s *recvStages) start() time.Time {
+	if !s.enabled.Load() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// done records a stage begun at start
+func (s *recvStages) done(stage recvStage, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	d := uint64(time.Since(start))
+	st := &s.stages[stage]
+	st.count.Add(1)
+	st.nanos.Add(d)
+	for {
+		m := st.max.Load()
+		if d <= m || st.max.CompareAndSwap(m, d) {
+			return
+		}
+	}
+}
+
+// StageTiming summarizes one receive stage
+type StageTiming struct {
+	Count   uint64  `json:"count"`
+	TotalMs float64 `json:"total_ms"`
+	AvgUs   float64 `json:"avg_us"`
+	MaxUs   float64 `json:"max_us"`
+}
+
+// StageTimings is the receive path's stage timing state
+type StageTimings struct {
+	Enabled bool                   `json:"enabled"`
+	Since   *time.Time             `json:"since,omitempty"` // When the counters started (nil if never enabled)
+	Stages  map[string]StageTiming `json:"stages"`
+}
+
+// SetStageTiming turns receive stage timing on or off. Turning it on resets
+// the counters; turning it off keeps them for reading.
+func (t *Tunnel) SetStageTiming(enabled bool) {
+	if enabled == t.stages.enabled.Load() {
+		return
+	}
+	if enabled {
+		for i := range t.stages.stages {
+			st := &t.stages.stages[i]
+			st.count.Store(0)
+			st.nanos.Store(0)
+			st.max.Store(0)
+		}
+		t.stages.since.Store(time.Now().UnixNano())
+	}
+	t.stages.enabled.Store(enabled)
+}
+
+// StageTimings returns the receive stage timings recorded so far
+func (t *Tunnel) StageTimings() StageTimings {
+	res := StageTimings{
+		Enabled: t.stages.enabled.Load(),
+		Stages:  make(map[string]StageTiming, numRecvStages),
+	}
+	if since := t.stages.since.Load(); since != 0 {
+		ts := time.Unix(0, since)
+		res.Since = &ts
+	}
+	for i, name := range recvStageNames {
+		st := &t.stages.stages[i]
+		timing := StageTiming{
+			Count:   st.count.Load(),
+			TotalMs: float64(st.nanos.Load()) / 1e6,
+			MaxUs:   float64(st.max.Load()) / 1e3,
+		}
+		if timing.Count > 0 {
+			timing.AvgUs = timing.TotalMs * 1e3 / float64(timing.Count)
+		}
+		res.Stages[name] = timing
+	}
+	return res
+}
+
+// writeTUN writes a received packet to the TUN device
+func (t *Tunnel) writeTUN(packet []byte) (int, error) {
+	defer t.stages.done(stageTUNWrite, t.stages.start())
+	n, err := t.tunFile.Write(packet)
+	if err != nil {
+		t.statTUNWriteErrors.Add(1)
+	}
+	return n, err
+}
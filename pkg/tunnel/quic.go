@@ -0,0 +1,57 @@
+package tunnel
+
+import ()
+
+// QUIC (HTTP/3) recovers its own losses and paces itself, so holding its
+// packets back for aggregation or sending them in FEC groups only adds
+// latency and a second layer of redundancy. With quic set, inner UDP packets
+// to or from port 443 whose first payload byte carries the QUIC fixed bit
+// (RFC 9000 17.2 and 17.3, long and short headers alike) are never held for
+// aggregation and use the interactive share of the rate limit. quic_no_fec
+// also sends them as plain data packets outside FEC groups; receivers handle
+// those regardless, so only the sender needs the setting.
+
+const (
+	quicPort     = 443
+	quicFixedBit = 0x40
+	udpHeaderLen = 8
+)
+
+// quicEnabled reports whether QUIC packets get their own handling
+func (t *Tunnel) quicEnabled() bool {
+	return t.config.QUIC || t.config.QUICNoFEC
+}
+
+// isQUICPacket reports whether a queued element is an inner QUIC packet.
+// Tunnel frames (aggregates, fragments) never are.
+func (t *Tunnel) isQUICPacket(packet []byte) bool {
+	if !t.quicEnabled() || isTunnelFrame(packet) {
+		return false
+	}
+	if len(packet) < IPv4MinHeaderLen || packet[0]>>4 != IPv4Version || packet[IPv4ProtocolOffset] != 17 {
+		return false
+	}
+	if (uint16(packet[6])<<8|uint16(packet[7]))&0x1FFF != 0 {
+		return false // Later IP fragment, no UDP header
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if len(packet) <= ihl+udpHeaderLen {
+		return false
+	}
+	srcPort := uint16(packet[ihl])<<8 | uint16(packet[ihl+1])
+	dstPort := uint16(packet[ihl+2])<<8 | uint16(packet[ihl+3])
+	if srcPort != quicPort && dstPort != quicPort {
+		return false
+	}
+	return packet[ihl+udpHeaderLen]&quicFixedBit != 0
+}
+
+// quicSkipsFEC reports whether a queued element is a QUIC packet to send
+// outside FEC groups, counting the QUIC packets it sees
+func (t *Tunnel) quicSkipsFEC(packet []byte) bool {
+	if !t.isQUICPacket(packet) {
+		return false
+	}
+	t.statQUIC.Add(1)
+	return t.config.QUICNoFEC && t.fecEnabled
+}
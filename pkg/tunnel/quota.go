@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Per-client traffic quota (server mode)
+//
+// client_quota_mb limits the traffic a client may move in both directions
+// within client_quota_period. Usage is kept per client identity, the
+// certificate identity in PKI mode and the tunnel IP otherwise, so it carries
+// over reconnects: a client that comes back before the period ends continues
+// from where its last session stopped. A client at its quota is disconnected
+// with DisconnectQuotaExceeded, which clients do not retry.
+
+// quotaCheckInterval controls how often session traffic is charged and checked
+const quotaCheckInterval = 5 * time.Second
+
+// defaultQuotaPeriod applies when client_quota_period is not set
+const defaultQuotaPeriod = 24 * time.Hour
+
+// quotaUsage is the traffic charged to one identity in its current period
+type quotaUsage struct {
+	start time.Time
+	bytes uint64
+}
+
+// quotaTracker charges session traffic to client identities
+type quotaTracker struct {
+	limit  uint64
+	period time.Duration
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+func newQuotaTracker(limitMB, periodSecs int) *quotaTracker {
+	period := time.Duration(periodSecs) * time.Second
+	if period <= 0 {
+		period = defaultQuotaPeriod
+	}
+	return &quotaTracker{
+		limit:  uint64(limitMB) * 1024 * 1024,
+		period: period,
+		usage:  make(map[string]*quotaUsage),
+	}
+}
+
+// quotaKey returns the identity the traffic of a client registered under
+// tunnelIP is charged to
+func quotaKey(client *ClientConnection, tunnelIP string) string {
+	client.mu.RLock()
+	identity := client.identity
+	client.mu.RUnlock()
+	if identity != "" {
+		return "cert:" + identity
+	}
+	return "ip:" + tunnelIP
+}
+
+// charge adds the traffic a session moved since it was last charged to key
+// and returns the usage of key in its current period
+func (q *quotaTracker) charge(key string, client *ClientConnection, now time.Time) uint64 {
+	total := client.bytesIn.Load() + client.bytesOut.Load()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage[key]
+	if u == nil || now.Sub(u.start) >= q.period {
+		u = &quotaUsage{start: now}
+		q.usage[key] = u
+	}
+	u.bytes += total - client.quotaCharged
+	client.quotaCharged = total
+	return u.bytes
+}
+
+// expire forgets identities whose period has ended
+func (q *quotaTracker) expire(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key, u := range q.usage {
+		if now.Sub(u.start) >= q.period {
+			delete(q.usage, key)
+		}
+	}
+}
+
+// quotaLoop charges session traffic and disconnects clients that reached
+// their quota (server mode)
+func (t *Tunnel) quotaLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case now := <-ticker.C:
+			t.quota.expire(now)
+			t.enforceQuota(now)
+		}
+	}
+}
+
+// enforceQuota charges the traffic of registered clients and disconnects
+// those whose identity reached the quota
+func (t *Tunnel) enforceQuota(now time.Time) {
+	var over []*ClientConnection
+	t.clientsMux.RLock()
+	for ipStr, client := range t.clients {
+		select {
+		case <-client.stopCh:
+			continue // Already ending; chargeSession settles it
+		default:
+		}
+		if t.quota.charge(quotaKey(client, ipStr), client, now) >= t.quota.limit {
+			over = append(over, client)
+		}
+	}
+	t.clientsMux.RUnlock()
+
+	limitMB := t.quota.limit / 1024 / 1024
+	for _, client := range over {
+		log.Printf("Client %s reached its traffic quota of %d MB", client.conn.RemoteAddr(), limitMB)
+		t.disconnectClient(client, DisconnectQuotaExceeded, fmt.Sprintf("%d MB", limitMB))
+	}
+}
+
+// chargeSession charges the traffic an ended session moved since the last
+// check, so reconnecting does not skip it (server mode)
+func (t *Tunnel) chargeSession(client *ClientConnection) {
+	if t.quota == nil || client.clientIP == nil {
+		return
+	}
+	t.quota.charge(quotaKey(client, client.clientIP.String()), client, time.Now())
+}
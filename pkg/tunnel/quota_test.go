@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+// session returns a client connection that has moved in and out bytes
+func session(in, out uint64) *ClientConnection {
+	c := &ClientConnection{}
+	c.bytesIn.Store(in)
+	c.bytesOut.Store(out)
+	return c
+}
+
+// TestQuotaCarriesOverReconnects charges two sessions of one identity and
+// checks that the second continues from the first
+func TestQuotaCarriesOverReconnects(t *testing.T) {
+	q := newQuotaTracker(1, 3600)
+	now := time.Unix(1000, 0)
+
+	first := session(300*1024, 300*1024)
+	if got := q.charge("ip:10.0.0.2", first, now); got != 600*1024 {
+		t.Fatalf("first session charged %d bytes, want %d", got, 600*1024)
+	}
+	first.bytesIn.Add(100 * 1024)
+	if got := q.charge("ip:10.0.0.2", first, now); got != 700*1024 {
+		t.Fatalf("second check charged %d bytes in total, want %d", got, 700*1024)
+	}
+
+	second := session(0, 400*1024)
+	if got := q.charge("ip:10.0.0.2", second, now.Add(time.Minute)); got < q.limit {
+		t.Fatalf("reconnected session at %d bytes, below the %d byte quota", got, q.limit)
+	}
+	if got := q.charge("ip:10.0.0.3", session(1, 0), now); got != 1 {
+		t.Errorf("other identity charged %d bytes, want 1", got)
+	}
+
+	// Usage starts over once the period has passed
+	q.expire(now.Add(time.Hour))
+	third := session(10, 0)
+	if got := q.charge("ip:10.0.0.2", third, now.Add(time.Hour)); got != 10 {
+		t.Errorf("new period starts at %d bytes, want 10", got)
+	}
+}
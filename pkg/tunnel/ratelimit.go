@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/ratelimit"
+)
+
+// Rate limiting (rate_limit_mbps) caps the tunnel payload this end sends: a
+// client's upload, or a server's traffic to all of its clients together. The
+// cap is shared between traffic classes as described in pkg/ratelimit:
+// keepalives, echoes and reports are control; inner packets up to
+// interactiveMaxSize bytes (keystrokes, DNS, TCP handshakes and ACKs) or
+// marked DSCP EF are interactive, as are QUIC packets with quic set;
+// everything else, including fragments of larger packets, is bulk.
+
+// interactiveMaxSize is the largest inner packet classed as interactive
+const interactiveMaxSize = priorityMaxSize
+
+// dscpEF is Expedited Forwarding (RFC 3246), used by voice and games
+const dscpEF = 46
+
+// newRateLimiter returns the limiter configured by rate_limit_mbps, or nil
+func newRateLimiter(cfg *config.Config) (*ratelimit.Limiter, error) {
+	if cfg.RateLimitMbps <= 0 {
+		return nil, nil
+	}
+	l, err := ratelimit.New(float64(cfg.RateLimitMbps)*1e6/8, cfg.RateLimitControl, cfg.RateLimitInteractive)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %v", err)
+	}
+	log.Printf("Rate limit: %d Mbps (control %.0f%%, interactive %.0f%%, bulk the rest)",
+		cfg.RateLimitMbps, cfg.RateLimitControl*100, cfg.RateLimitInteractive*100)
+	return l, nil
+}
+
+// trafficClass returns the class of a queued packet
+func trafficClass(packet []byte) ratelimit.Class {
+	if isTunnelFrame(packet) || len(packet) < IPv4MinHeaderLen {
+		return ratelimit.Bulk
+	}
+	if len(packet) <= interactiveMaxSize || packet[1]>>2 == dscpEF {
+		return ratelimit.Interactive
+	}
+	return ratelimit.Bulk
+}
+
+// rateLimitStatus reports the traffic of each class under the cap
+func (t *Tunnel) rateLimitStatus() *api.RateLimitStatus {
+	shares := map[ratelimit.Class]float64{
+		ratelimit.Control:     t.config.RateLimitControl,
+		ratelimit.Interactive: t.config.RateLimitInteractive,
+		ratelimit.Bulk:        1 - t.config.RateLimitControl - t.config.RateLimitInteractive,
+	}
+	s := &api.RateLimitStatus{Mbps: t.config.RateLimitMbps}
+	for _, c := range ratelimit.Classes {
+		n := t.limiter.Counters(c)
+		s.Classes = append(s.Classes, api.RateClassStatus{
+			Class:   c.String(),
+			Share:   shares[c],
+			Bytes:   n.Bytes,
+			Packets: n.Packets,
+			Dropped: n.Dropped,
+		})
+	}
+	return s
+}
+
+// overRate drops a queued packet the rate limit does not let through,
+// releasing its buffer, and reports whether it did
+func (t *Tunnel) overRate(packet []byte) bool {
+	if t.limiter == nil {
+		return false
+	}
+	class := trafficClass(packet)
+	if class == ratelimit.Bulk && t.isQUICPacket(packet) {
+		class = ratelimit.Interactive
+	}
+	if t.limiter.Allow(class, len(packet)) {
+		return false
+	}
+	t.releasePacketBuffer(packet)
+	return true
+}
@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Every goroutine of the tunnel runs under a recover, so a bug reached by one
+// malformed packet cannot crash the process and every session with it. What
+// happens after a panic depends on whose goroutine it was:
+//
+//	session     a goroutine serving one client (reader, writer, keepalive,
+//	            announcements): only that session ends, with reason
+//	            "internal error", and the client reconnects
+//	data        a loop every packet passes through (TUN reader and writer,
+//	            network reader and writer, FEC and decryption workers, accept
+//	            loop, keepalive): restarted after restartDelay; a loop that
+//	            keeps panicking stops the tunnel, since it cannot pass traffic
+//	management  a periodic loop (routes, revocation, session policy, port
+//	            hopping, stats): restarted like a data loop, but left stopped
+//	            once it keeps panicking, as the tunnel still passes traffic
+//
+// Each panic is logged with its stack and, for sessions, the session ID and
+// peer address, and counted in the stats (panics=).
+
+const (
+	restartDelay  = time.Second
+	restartWindow = time.Minute
+)
+
+// restartPolicy says how often a loop is restarted after panics
+type restartPolicy struct {
+	maxRestarts int  // Restarts allowed within restartWindow
+	fatal       bool // Stop the tunnel when the restarts run out
+}
+
+var (
+	policyData       = restartPolicy{maxRestarts: 10, fatal: true}
+	policyManagement = restartPolicy{maxRestarts: 3}
+)
+
+// goSession runs fn in a goroutine; a panic in it ends only the client's
+// session (server mode)
+func (t *Tunnel) goSession(client *ClientConnection, name string, fn func()) {
+	go func() {
+		defer t.recoverSession(client, name)
+		fn()
+	}()
+}
+
+// recoverSession ends a client's session after a panic in one of its goroutines
+func (t *Tunnel) recoverSession(client *ClientConnection, name string) {
+	if r := recover(); r != nil {
+		t.endSessionAfterPanic(client, name, r)
+	}
+}
+
+// endSessionAfterPanic logs a panic in a session goroutine and ends the session
+func (t *Tunnel) endSessionAfterPanic(client *ClientConnection, name string, r interface{}) {
+	t.statPanics.Add(1)
+	client.logf("PANIC in %s for %s: %v - ending session\n%s", name, client.conn.RemoteAddr(), r, debug.Stack())
+	client.setDisconnectReason("internal error")
+	client.stopOnce.Do(func() {
+		close(client.stopCh)
+	})
+}
+
+// goLoop runs fn in a goroutine and restarts it after a panic as policy
+// allows. Like a plain go statement, it expects the caller to have added fn's
+// own t.wg.Done to the wait group.
+func (t *Tunnel) goLoop(policy restartPolicy, name string, fn func()) {
+	// Held across restarts so the group cannot drop to zero between a
+	// panicked run's Done and the next run's Add
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		var restarts []time.Time
+		for t.runRecovered(name, fn) {
+			now := time.Now()
+			for len(restarts) > 0 && now.Sub(restarts[0]) > restartWindow {
+				restarts = restarts[1:]
+			}
+			if len(restarts) >= policy.maxRestarts {
+				if policy.fatal {
+					err := fmt.Errorf("%s panicked %d times within %v", name, len(restarts)+1, restartWindow)
+					log.Printf("❌ %v - stopping the tunnel", err)
+					t.disconnectMux.Lock()
+					if t.disconnectErr == nil {
+						t.disconnectErr = err
+					}
+					t.disconnectMux.Unlock()
+					go t.Stop()
+				} else {
+					log.Printf("⚠️  %s panicked %d times within %v - leaving it stopped", name, len(restarts)+1, restartWindow)
+				}
+				return
+			}
+			select {
+			case <-t.stopCh:
+				return
+			case <-time.After(restartDelay):
+			}
+			restarts = append(restarts, time.Now())
+			log.Printf("Restarting %s after panic", name)
+			t.wg.Add(1) // Done by fn's deferred t.wg.Done, which ran during the panic
+		}
+	}()
+}
+
+// runRecovered runs fn and reports whether it panicked
+func (t *Tunnel) runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.statPanics.Add(1)
+			log.Printf("PANIC in %s: %v\n%s", name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Session policies bound how long one connection and one key stay in use
+// (server mode):
+//
+//	max_session_duration  a session older than this is asked to renew: the
+//	                      client completes the handshake of a new connection
+//	                      before it leaves the old one, then authenticates
+//	                      again if required, so traffic pauses only for the
+//	                      authentication instead of a reconnect. A session
+//	                      still open renewGrace after the request (clients
+//	                      without renewal support ignore it) is disconnected
+//	                      with a reason that makes the client reconnect.
+//	rekey_after_mb        once this much traffic has passed since the tunnel
+//	                      key was last rotated, it is rotated as with
+//	                      config_push_interval; the previous key is accepted
+//	                      for KeyRotationGracePeriod, so packets in flight
+//	                      still arrive.
+//
+// Layout: [PacketTypeRenew][reason]
+
+// renewGrace is how long a session asked to renew may stay open
+const renewGrace = 30 * time.Second
+
+// trafficTotal returns the tunnel payload bytes moved in both directions
+// since the tunnel started
+func (t *Tunnel) trafficTotal() uint64 {
+	total := t.statBytesIn.Load() + t.statBytesOut.Load()
+	t.allClientsMux.RLock()
+	for client := range t.allClients {
+		total += client.bytesIn.Load() + client.bytesOut.Load()
+	}
+	t.allClientsMux.RUnlock()
+	return total
+}
+
+// sessionPolicyLoop enforces max_session_duration and rekey_after_mb (server mode)
+func (t *Tunnel) sessionPolicyLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	maxAge := time.Duration(t.config.MaxSessionDuration) * time.Second
+	rekeyBytes := uint64(t.config.RekeyAfterMB) * 1024 * 1024
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		// A client leaving moves its bytes to the totals after it is
+		// untracked, so the total may briefly dip below the base
+		if total, base := t.trafficTotal(), t.rekeyBase.Load(); rekeyBytes > 0 && total > base && total-base >= rekeyBytes {
+			log.Printf("Rotating tunnel key after %d MB of traffic", (total-base)/1024/1024)
+			if err := t.pushConfigUpdate(); err != nil {
+				log.Printf("Failed to rotate key: %v", err)
+			}
+		}
+
+		if maxAge > 0 {
+			t.expireSessions(maxAge)
+		}
+	}
+}
+
+// expireSessions asks sessions older than maxAge to renew and disconnects
+// those that did not within renewGrace
+func (t *Tunnel) expireSessions(maxAge time.Duration) {
+	t.allClientsMux.RLock()
+	clients := make([]*ClientConnection, 0, len(t.allClients))
+	for client := range t.allClients {
+		clients = append(clients, client)
+	}
+	t.allClientsMux.RUnlock()
+
+	now := time.Now()
+	for _, client := range clients {
+		client.mu.Lock()
+		age := now.Sub(client.connectedAt)
+		requested := client.renewRequested
+		if age >= maxAge && requested.IsZero() {
+			client.renewRequested = now
+		}
+		client.mu.Unlock()
+
+		switch {
+		case age < maxAge:
+		case requested.IsZero():
+			client.logf("Session of %s open for %v, asking it to renew", client.conn.RemoteAddr(), age.Round(time.Second))
+			t.requestRenew(client, "session lifetime")
+		case now.Sub(requested) >= renewGrace:
+			client.logf("Session of %s did not renew within %v", client.conn.RemoteAddr(), renewGrace)
+			t.disconnectClient(client, DisconnectSessionExpired, "")
+		}
+	}
+}
+
+// requestRenew asks a client to move to a new connection
+func (t *Tunnel) requestRenew(client *ClientConnection, reason string) {
+	encrypted, err := t.encryptForClient(client, append([]byte{PacketTypeRenew}, reason...))
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send renewal request to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// handleRenewRequest moves to a new connection when the server asks for it
+// (client mode)
+func (t *Tunnel) handleRenewRequest(payload []byte) {
+	if !atomic.CompareAndSwapInt32(&t.renewing, 0, 1) {
+		return
+	}
+	reason := string(payload[:min(len(payload), 64)])
+	go func() {
+		defer atomic.StoreInt32(&t.renewing, 0)
+		log.Printf("Server asked to renew the session (%q)", reason)
+		if err := t.redialServer("Session renewal"); err != nil {
+			// The server disconnects the old session after the grace
+			// period and we reconnect then
+			log.Printf("⚠️  Session renewal failed, staying on the current connection: %v", err)
+		}
+	}()
+}
+
+// redialServer connects to the server again, replaces the tunnel connection
+// with the new one once its handshake completed and authenticates it if
+// required (client mode). label prefixes the log lines.
+func (t *Tunnel) redialServer(label string) error {
+	conn, err := t.dialRemote(time.Duration(t.config.Timeout)*time.Second, faketcp.GetMode())
+	if err != nil {
+		return err
+	}
+	t.connMux.Lock()
+	old := t.conn
+	t.conn = t.impairConn(conn)
+	t.setClientSendMTU(conn)
+	t.setOuterEndpoint(conn)
+	t.connMux.Unlock()
+	if old != nil {
+		_ = old.Close() // netReader moves on to the new connection
+	}
+	t.noteHandshake(false)
+	log.Printf("%s: now %s -> %s", label, conn.LocalAddr(), conn.RemoteAddr())
+
+	if t.authHandshakeRequired() && t.cipher != nil {
+		t.authMux.Lock()
+		t.authenticated = false
+		t.authMux.Unlock()
+		if err := t.performClientAuthentication(); err != nil {
+			log.Printf("❌ %s: authentication failed: %v", label, err)
+			t.connMux.Lock()
+			if t.conn != nil {
+				_ = t.conn.Close()
+			}
+			t.connMux.Unlock()
+			return nil // netReader reconnects
+		}
+	}
+	t.reannounceP2PInfoAfterReconnect()
+	return nil
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Go measures timeouts on CLOCK_MONOTONIC, which stands still while the
+// machine sleeps. After a laptop resumes, the idle timeout therefore starts
+// counting from where it stopped and the client sits on a session the server
+// ended long ago, behind a NAT mapping that expired, for up to
+// IdleConnectionTimeout. The client notices the sleep instead: CLOCK_BOOTTIME
+// keeps running during suspend, so a jump in BOOTTIME - MONOTONIC between two
+// checks is time spent asleep. Where systemd-logind runs, its PrepareForSleep
+// signal (read through dbus-monitor) reports the resume as well. Either way
+// the client sends a keepalive at once and, when the server does not answer
+// within resumeProbeTimeout, moves to a new connection and authenticates it.
+
+const (
+	resumeCheckInterval = time.Second
+	resumeMinSleep      = 3 * time.Second  // Shorter gaps are scheduling noise
+	resumeProbeTimeout  = 3 * time.Second  // Wait for the server after a resume
+	resumeDebounce      = 10 * time.Second // Both signals report the same resume
+)
+
+const clockBoottime = 7 // CLOCK_BOOTTIME
+
+// suspendedTime returns the time the machine has spent suspended since boot
+func suspendedTime() (time.Duration, bool) {
+	var boot, mono syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockBoottime, uintptr(unsafe.Pointer(&boot)), 0); errno != 0 {
+		return 0, false
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, 1 /* CLOCK_MONOTONIC */, uintptr(unsafe.Pointer(&mono)), 0); errno != 0 {
+		return 0, false
+	}
+	return time.Duration(boot.Nano() - mono.Nano()), true
+}
+
+// resumeWatchLoop probes the server whenever the machine resumes from sleep
+// (client mode)
+func (t *Tunnel) resumeWatchLoop() {
+	defer t.wg.Done()
+
+	resumed := make(chan time.Duration, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchLogind(ctx, resumed)
+
+	ticker := time.NewTicker(resumeCheckInterval)
+	defer ticker.Stop()
+	last, ok := suspendedTime()
+	var handled time.Time
+	for {
+		var slept time.Duration
+		select {
+		case <-t.stopCh:
+			return
+		case slept = <-resumed:
+		case <-ticker.C:
+			if !ok {
+				continue
+			}
+			now, _ := suspendedTime()
+			slept, last = now-last, now
+			if slept < resumeMinSleep {
+				continue
+			}
+		}
+		if !handled.IsZero() && time.Since(handled) < resumeDebounce {
+			continue
+		}
+		handled = time.Now()
+		t.probeAfterResume(slept)
+	}
+}
+
+// probeAfterResume checks the server is still there after sleeping for slept
+// (0 = unknown), and moves to a new connection if it is not
+func (t *Tunnel) probeAfterResume(slept time.Duration) {
+	t.statResumes.Add(1)
+	if slept > 0 {
+		log.Printf("Resumed after sleeping for %v, probing the server", slept.Round(time.Second))
+	} else {
+		log.Printf("Resumed from sleep, probing the server")
+	}
+	if t.conn == nil {
+		return // netReader is reconnecting already
+	}
+	probed := time.Now()
+	if encrypted, err := t.encryptPacket(newKeepalivePacket()); err == nil && t.control.push(encrypted) {
+		t.sendPath.sent(probed)
+	}
+	select {
+	case <-t.stopCh:
+		return
+	case <-time.After(resumeProbeTimeout):
+	}
+	t.lastRecvMux.Lock()
+	heard := t.lastRecvTime.After(probed)
+	t.lastRecvMux.Unlock()
+	if heard {
+		log.Printf("Server answered after resume, keeping the connection")
+		return
+	}
+	t.sendPath.reset()
+	if err := t.redialServer("Resume"); err != nil {
+		log.Printf("Resume: %v, reconnecting", err)
+		t.connMux.Lock()
+		if t.conn != nil {
+			_ = t.conn.Close() // netReader reconnects
+		}
+		t.connMux.Unlock()
+	}
+}
+
+// watchLogind reports resumes signalled by systemd-logind until ctx is done.
+// Without dbus-monitor or a system bus it returns and the clock check alone
+// detects resumes.
+func watchLogind(ctx context.Context, resumed chan<- time.Duration) {
+	cmd := exec.CommandContext(ctx, "dbus-monitor", "--system",
+		"type='signal',interface='org.freedesktop.login1.Manager',member='PrepareForSleep'")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	defer cmd.Wait()
+
+	// The signal's argument follows on its own line: true before sleeping,
+	// false after resuming
+	sc := bufio.NewScanner(out)
+	var inSignal bool
+	var asleep time.Time
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.Contains(line, "member=PrepareForSleep"):
+			inSignal = true
+		case inSignal && line == "boolean true":
+			inSignal = false
+			asleep = time.Now().Round(0) // Wall clock, which runs during sleep
+			log.Printf("System is going to sleep")
+		case inSignal && line == "boolean false":
+			inSignal = false
+			var slept time.Duration
+			if !asleep.IsZero() {
+				slept = time.Now().Round(0).Sub(asleep)
+			}
+			select {
+			case resumed <- slept:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Keepalives double as RTT probes: a keepalive carrying the sender's clock is
+// echoed back unchanged, and the echo yields a round-trip sample smoothed like
+// TCP's SRTT; it also shows the send direction still works (deadpath.go).
+// Older peers send the bare type byte and ignore the payload.
+//
+// Layout: [PacketTypeKeepalive][kind:1][sender clock:8]
+
+const (
+	keepaliveProbe  = 0
+	keepaliveEcho   = 1
+	keepaliveRTTLen = 1 + 8
+)
+
+// rttClock is the reference for keepalive timestamps
+var rttClock = time.Now()
+
+// newKeepalivePacket returns a keepalive that asks the peer for an echo
+func newKeepalivePacket() []byte {
+	buf := make([]byte, 1+keepaliveRTTLen)
+	buf[0] = PacketTypeKeepalive
+	buf[1] = keepaliveProbe
+	binary.BigEndian.PutUint64(buf[2:], uint64(time.Since(rttClock)))
+	return buf
+}
+
+// handleKeepalive returns the echo to send for a probe; for an echo it records
+// it in path, updates srtt (nanoseconds, atomic) and returns nil
+func handleKeepalive(payload []byte, srtt *atomic.Int64, path *pathProbe) []byte {
+	if len(payload) != keepaliveRTTLen {
+		return nil
+	}
+	if payload[0] == keepaliveProbe {
+		echo := make([]byte, 1+keepaliveRTTLen)
+		echo[0] = PacketTypeKeepalive
+		echo[1] = keepaliveEcho
+		copy(echo[2:], payload[1:])
+		return echo
+	}
+	path.echoed(time.Now())
+	sample := time.Since(rttClock) - time.Duration(binary.BigEndian.Uint64(payload[1:]))
+	if sample < 0 {
+		return nil
+	}
+	for {
+		old := srtt.Load()
+		next := int64(sample)
+		if old != 0 {
+			next = old - old/8 + int64(sample)/8
+		}
+		if srtt.CompareAndSwap(old, next) {
+			return nil
+		}
+	}
+}
+
+// handleServerKeepalive answers or records a keepalive from the server (client mode)
+func (t *Tunnel) handleServerKeepalive(payload []byte) {
+	echo := handleKeepalive(payload, &t.srtt, &t.sendPath)
+	if echo == nil {
+		return
+	}
+	if encrypted, err := t.encryptPacket(echo); err == nil {
+		t.control.push(encrypted)
+	}
+}
+
+// handleClientKeepalive answers or records a keepalive from a client (server mode)
+func (t *Tunnel) handleClientKeepalive(client *ClientConnection, payload []byte) {
+	echo := handleKeepalive(payload, &client.srtt, &client.sendPath)
+	if echo == nil {
+		return
+	}
+	if encrypted, err := t.encryptForClient(client, echo); err == nil {
+		client.control.push(encrypted)
+	}
+}
@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// A route through the tunnel that covers the tunnel's own outer endpoint (a
+// pushed 0.0.0.0/0 without an exception for the server, a client advertising
+// the subnet its public address lives in) hands the encrypted frames back to
+// the TUN device, where they are encapsulated again without end. The frames'
+// addressing is the marker: a TCP segment read from TUN that belongs to one of
+// the tunnel's own connections can only have been produced by this process.
+// Such packets are dropped and reported with the route to fix, and routes the
+// tunnel installs itself are checked against the endpoints up front.
+
+// selfEncapLogInterval rate-limits the self-encapsulation error
+const selfEncapLogInterval = 10 * time.Second
+
+func addrPortOf(addr net.Addr) (netip.AddrPort, bool) {
+	if addr == nil {
+		return netip.AddrPort{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// setOuterEndpoint records the server endpoint after (re)connecting and starts
+// send-path probing afresh (client mode)
+func (t *Tunnel) setOuterEndpoint(conn faketcp.ConnAdapter) {
+	t.sendPath.reset()
+	if ap, ok := addrPortOf(conn.RemoteAddr()); ok {
+		t.outerRemote.Store(&ap)
+	}
+}
+
+// setOuterPort records the port clients connect to (server mode)
+func (t *Tunnel) setOuterPort(listener faketcp.ListenerAdapter) {
+	if ap, ok := addrPortOf(listener.Addr()); ok {
+		t.outerPort = ap.Port()
+	}
+}
+
+// clientEndpoints returns the outer addresses of the connected clients (server mode)
+func (t *Tunnel) clientEndpoints() []netip.AddrPort {
+	t.allClientsMux.RLock()
+	defer t.allClientsMux.RUnlock()
+	endpoints := make([]netip.AddrPort, 0, len(t.allClients))
+	for client := range t.allClients {
+		if ap, ok := addrPortOf(client.conn.RemoteAddr()); ok {
+			endpoints = append(endpoints, ap)
+		}
+	}
+	return endpoints
+}
+
+// isSelfEncapsulated reports whether a packet read from TUN is one of the
+// tunnel's own outer segments
+func (t *Tunnel) isSelfEncapsulated(packet []byte) bool {
+	ihl := int(packet[0]&0x0f) * 4
+	if packet[IPv4ProtocolOffset] != 6 || len(packet) < ihl+4 {
+		return false
+	}
+	srcPort := binary.BigEndian.Uint16(packet[ihl : ihl+2])
+	dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte(packet[IPv4DstIPOffset:IPv4DstIPOffset+4])),
+		binary.BigEndian.Uint16(packet[ihl+2:ihl+4]))
+
+	if remote := t.outerRemote.Load(); remote != nil {
+		return dst == *remote
+	}
+	if t.outerPort == 0 || (srcPort != t.outerPort && !t.portHop.contains(srcPort)) {
+		return false
+	}
+	for _, endpoint := range t.clientEndpoints() {
+		if dst == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// noteSelfEncap counts a dropped self-encapsulated packet and explains the fix
+func (t *Tunnel) noteSelfEncap(packet []byte) {
+	count := t.statSelfEncap.Add(1)
+	now := time.Now().UnixNano()
+	last := t.selfEncapLogged.Load()
+	if now-last < int64(selfEncapLogInterval) || !t.selfEncapLogged.CompareAndSwap(last, now) {
+		return
+	}
+	dst := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
+	log.Printf("❌ Tunnel traffic to %s is routed back into %s (self-encapsulation, %d packets dropped so far). "+
+		"A route through the tunnel covers the tunnel's own endpoint: exclude it with a host route via the physical "+
+		"gateway (ip route add %s/32 via <gateway>) or narrow the routed CIDRs", dst, t.tunName, count, dst)
+}
+
+// checkRouteLoop rejects a tunnel route that covers an outer endpoint
+func (t *Tunnel) checkRouteLoop(ipNet *net.IPNet) error {
+	prefix, err := netip.ParsePrefix(ipNet.String())
+	if err != nil {
+		return nil
+	}
+	endpoints := t.clientEndpoints()
+	if remote := t.outerRemote.Load(); remote != nil {
+		endpoints = append(endpoints, *remote)
+	}
+	for _, endpoint := range endpoints {
+		if prefix.Contains(endpoint.Addr()) {
+			return fmt.Errorf("route %s covers tunnel endpoint %s and would loop tunnel traffic back into the tunnel; exclude the endpoint or narrow the route",
+				prefix, endpoint.Addr())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Received FEC shards are spread over fec_workers ingress workers by session
+// ID. Each worker reconstructs its groups and decrypts their packets, the
+// CPU-heavy part of receiving, in parallel with the others, so consecutive
+// groups of a peer finish on different workers and in any order. Workers
+// hand finished groups to the sequencer of their peer, which holds them in
+// the peer's reorder buffer (fec_reorder.go) and delivers them in session
+// order: to the client's packet handling on a server, to the receive queue
+// on a client. A peer always has the same sequencer and peers are spread over
+// as many sequencers as there are workers, so different peers are still
+// delivered in parallel. The receive queue is written to the TUN device by
+// tun_writers writers; with one, the default, packets reach the device in
+// the order they were sent.
+
+const sequencerCleanupInterval = 5 * time.Second
+
+// fecGroup is a reconstructed group on its way to the sequencer
+type fecGroup struct {
+	peer      string
+	client    *ClientConnection // Server mode: the client the group came from
+	sessionID uint32
+	frames    [][]byte // Decrypted
+}
+
+// fecSequencer restores the session order of the groups of its peers
+type fecSequencer struct {
+	groups chan *fecGroup
+	next   sync.Map // Peer -> *uint32: the group its reorder buffer waits for (diagnostics)
+}
+
+// fecWorkers returns the number of FEC ingress workers
+func (t *Tunnel) fecWorkers() int {
+	if t.config.FECWorkers > 0 {
+		return t.config.FECWorkers
+	}
+	return t.config.SendWorkers
+}
+
+// tunWriters returns the number of goroutines writing the receive queue to
+// the TUN device (client mode)
+func (t *Tunnel) tunWriters() int {
+	if t.config.TUNWriters > 0 {
+		return t.config.TUNWriters
+	}
+	return 1
+}
+
+func newFECSequencers(n, queueSize int) []*fecSequencer {
+	sequencers := make([]*fecSequencer, n)
+	for i := range sequencers {
+		sequencers[i] = &fecSequencer{groups: make(chan *fecGroup, queueSize)}
+	}
+	return sequencers
+}
+
+// sequencerFor returns the sequencer of a peer
+func (t *Tunnel) sequencerFor(peer string) *fecSequencer {
+	h := fnv.New32a()
+	h.Write([]byte(peer))
+	return t.sequencers[h.Sum32()%uint32(len(t.sequencers))]
+}
+
+// submitFECGroup hands a group to its sequencer; false means the tunnel is
+// stopping
+func (t *Tunnel) submitFECGroup(g *fecGroup) bool {
+	select {
+	case t.sequencerFor(g.peer).groups <- g:
+		return true
+	case <-t.stopCh:
+		return false
+	}
+}
+
+// reorderPosition returns the group the reorder buffer of peer waits for
+func (t *Tunnel) reorderPosition(peer string) (uint32, bool) {
+	if len(t.sequencers) == 0 {
+		return 0, false
+	}
+	next, ok := t.sequencerFor(peer).next.Load(peer)
+	if !ok {
+		return 0, false
+	}
+	return atomic.LoadUint32(next.(*uint32)), true
+}
+
+// startSequencers starts the sequencers
+func (t *Tunnel) startSequencers() {
+	for _, s := range t.sequencers {
+		t.wg.Add(1)
+		t.goLoop(policyData, "FEC sequencer", func() { t.runSequencer(s) })
+	}
+}
+
+// runSequencer delivers the groups of its peers in session order
+func (t *Tunnel) runSequencer(s *fecSequencer) {
+	defer t.wg.Done()
+
+	bufs := make(map[string]*fecReorderBuffer)
+	window := t.fecReorderWindow()
+	position := func(peer string, buf *fecReorderBuffer) {
+		if next, ok := s.next.Load(peer); ok {
+			atomic.StoreUint32(next.(*uint32), buf.next)
+			return
+		}
+		next := buf.next
+		s.next.Store(peer, &next)
+	}
+
+	// Fires when the oldest open gap reaches the reorder hold time
+	gapTimer := time.NewTimer(time.Hour)
+	gapTimer.Stop()
+	defer gapTimer.Stop()
+	armGapTimer := func() {
+		var oldest time.Time
+		for _, buf := range bufs {
+			if !buf.gapSince.IsZero() && (oldest.IsZero() || buf.gapSince.Before(oldest)) {
+				oldest = buf.gapSince
+			}
+		}
+		gapTimer.Stop()
+		if !oldest.IsZero() {
+			gapTimer.Reset(time.Until(oldest.Add(t.reorderHold())))
+		}
+	}
+
+	cleanupTicker := time.NewTicker(sequencerCleanupInterval)
+	defer cleanupTicker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-gapTimer.C:
+			// Declare the groups behind overdue gaps lost
+			now := time.Now()
+			hold := t.reorderHold()
+			for peer, buf := range bufs {
+				ready, skipped := buf.expire(now, hold)
+				t.statFECGapSkip.Add(skipped)
+				position(peer, buf)
+				t.deliverFECFrames(buf.client, ready)
+			}
+			armGapTimer()
+		case <-cleanupTicker.C:
+			now := time.Now()
+			for peer, buf := range bufs {
+				if now.Sub(buf.lastUpdate) > 2*sequencerCleanupInterval && len(buf.pending) == 0 {
+					delete(bufs, peer)
+					s.next.Delete(peer)
+				}
+			}
+		case g := <-s.groups:
+			buf := bufs[g.peer]
+			if buf == nil {
+				buf = newFECReorderBuffer(g.sessionID, g.client)
+				bufs[g.peer] = buf
+			}
+			buf.client = g.client
+
+			now := time.Now()
+			ready, late, skipped, filled := buf.push(g.sessionID, g.frames, window, now)
+			if late {
+				// The gap was skipped too early; deliver late packets anyway
+				t.noteLateGroup()
+				ready = g.frames
+			}
+			t.statFECGapSkip.Add(skipped)
+			if filled > 0 {
+				t.sampleReorderDelay(filled)
+			}
+			position(g.peer, buf)
+			t.deliverFECFrames(g.client, ready)
+			armGapTimer()
+		}
+	}
+}
+
+// deliverFECFrames passes the decrypted frames of reconstructed groups on: to
+// the client's packet handling in server mode, to the receive queue otherwise
+func (t *Tunnel) deliverFECFrames(client *ClientConnection, frames [][]byte) {
+	for _, frame := range frames {
+		if client != nil {
+			t.handleClientPacket(client, frame)
+			continue
+		}
+		switch frame[0] {
+		case PacketTypeData:
+			if !enqueueWithPolicy(t.recvQueue, frame[1:], t.stopCh, false) {
+				t.statQueueDropRecv.Add(1)
+			}
+		case PacketTypeAggregate:
+			forEachAggregateFrame(frame[1:], func(packet []byte) bool {
+				if !enqueueWithPolicy(t.recvQueue, packet[1:], t.stopCh, false) {
+					t.statQueueDropRecv.Add(1)
+				}
+				return true
+			})
+		case PacketTypeFragment:
+			if packet := t.reassembleFragment(t.fragments, frame[1:]); packet != nil {
+				if !enqueueWithPolicy(t.recvQueue, packet[1:], t.stopCh, false) {
+					t.statQueueDropRecv.Add(1)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+	"github.com/openbmx/lightweight-tunnel/pkg/fec"
+)
+
+const (
+	seqTestData     = 10
+	seqTestParity   = 3
+	seqTestFrameLen = 1200
+)
+
+// sequencerTunnel returns a client-mode tunnel with FEC ingress workers and
+// sequencers running; stop it with close(t.stopCh) and t.wg.Wait()
+func sequencerTunnel(tb testing.TB, workers int) *Tunnel {
+	cipher, err := crypto.NewCipher("sequencer-test-key")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	codec, err := fec.NewFECWithCodec(fec.ReedSolomon, seqTestData, seqTestParity, seqTestFrameLen)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	t := &Tunnel{
+		config: &config.Config{
+			FECWorkers:         workers,
+			FECMaxDataShards:   seqTestData,
+			FECMaxParityShards: seqTestParity,
+			FECReorderHoldMs:   1000, // Long enough that no group is skipped
+		},
+		cipher:      cipher,
+		fec:         codec,
+		parityCodec: fec.ReedSolomon,
+		stopCh:      make(chan struct{}),
+		recvQueue:   make(chan []byte, 4096),
+	}
+	t.fecIngressQueues = make([]chan *fecIngressWork, t.fecWorkers())
+	for i := range t.fecIngressQueues {
+		t.fecIngressQueues[i] = make(chan *fecIngressWork, 1024)
+		queue := t.fecIngressQueues[i]
+		t.wg.Add(1)
+		t.goLoop(policyData, "FEC ingress worker", func() { t.fecIngressWorker(queue) })
+	}
+	t.sequencers = newFECSequencers(len(t.fecIngressQueues), 1024)
+	t.startSequencers()
+	return t
+}
+
+// sequencerGroup encrypts n numbered data frames and returns the FEC shards
+// of the group as the network reader hands them to the ingress workers
+func sequencerGroup(tb testing.TB, t *Tunnel, sessionID uint32, first int) [][]byte {
+	shardSize := 2 + seqTestFrameLen + 64 // Room for the cipher overhead
+	shards := make([][]byte, seqTestData+seqTestParity)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i >= seqTestData {
+			continue
+		}
+		frame := make([]byte, seqTestFrameLen)
+		frame[0] = PacketTypeData
+		binary.BigEndian.PutUint32(frame[1:5], uint32(first+i))
+		enc, err := t.cipher.Encrypt(frame)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(shards[i][0:2], uint16(len(enc)))
+		copy(shards[i][2:], enc)
+	}
+	if err := fec.EncodeShards(fec.ReedSolomon, shards, seqTestData, seqTestParity); err != nil {
+		tb.Fatal(err)
+	}
+	packets := make([][]byte, 0, seqTestData)
+	for i, shard := range shards {
+		if i == 1 || i == 4 || i == 7 { // Lost on the way, so every group needs reconstruction
+			continue
+		}
+		packets = append(packets, buildShardPacket(sessionID, i, seqTestData, seqTestParity, shard, false)[1:])
+	}
+	return packets
+}
+
+// submitShards dispatches shards by session ID like the network reader
+func submitShards(t *Tunnel, sessionID uint32, shards [][]byte) {
+	queue := t.fecIngressQueues[sessionID%uint32(len(t.fecIngressQueues))]
+	for _, shard := range shards {
+		queue <- &fecIngressWork{remoteAddr: "server", packet: shard}
+	}
+}
+
+// TestFECSequencerOrder sends groups out of order over several workers and
+// checks that their packets reach the receive queue in the order they were
+// numbered
+func TestFECSequencerOrder(t *testing.T) {
+	tun := sequencerTunnel(t, 4)
+	defer func() {
+		close(tun.stopCh)
+		tun.wg.Wait()
+	}()
+
+	const groups = 64
+	shards := make([][][]byte, groups)
+	for g := range shards {
+		shards[g] = sequencerGroup(t, tun, uint32(100+g), g*seqTestData)
+	}
+	// The first group sets where the reorder buffer starts
+	submitShards(tun, 100, shards[0])
+	for want := 0; want < seqTestData; want++ {
+		<-tun.recvQueue
+	}
+	// Swap neighbouring groups and send the second one last
+	order := []int{}
+	for g := 2; g+1 < groups; g += 2 {
+		order = append(order, g+1, g)
+	}
+	order = append(order, 1)
+	for _, g := range order {
+		submitShards(tun, uint32(100+g), shards[g])
+	}
+
+	for want := seqTestData; want < groups*seqTestData; want++ {
+		packet := <-tun.recvQueue
+		if got := int(binary.BigEndian.Uint32(packet[0:4])); got != want {
+			t.Fatalf("packet %d delivered in place of %d", got, want)
+		}
+	}
+}
+
+// BenchmarkFECIngress reconstructs and decrypts groups of 10 packets, with
+// three shards of every group lost, on 1 to 8 workers and measures how fast
+// they reach the receive queue in order
+func BenchmarkFECIngress(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tun := sequencerTunnel(b, workers)
+			defer func() {
+				close(tun.stopCh)
+				tun.wg.Wait()
+			}()
+
+			const batch = 64
+			groups := make([][][]byte, batch)
+			for g := range groups {
+				groups[g] = sequencerGroup(b, tun, 0, g*seqTestData)
+			}
+
+			b.SetBytes(seqTestData * seqTestFrameLen)
+			b.ResetTimer()
+			done := make(chan struct{})
+			go func() {
+				// Packets dropped on a full receive queue count as delivered
+				ticker := time.NewTicker(time.Millisecond)
+				defer ticker.Stop()
+				for received := 0; received+int(tun.statQueueDropRecv.Load()) < b.N*seqTestData; {
+					select {
+					case <-tun.recvQueue:
+						received++
+					case <-ticker.C:
+					}
+				}
+				close(done)
+			}()
+			for i := 0; i < b.N; i++ {
+				sessionID := uint32(1 + i)
+				shards := make([][]byte, len(groups[i%batch]))
+				for j, shard := range groups[i%batch] {
+					shards[j] = append([]byte(nil), shard...)
+					binary.BigEndian.PutUint32(shards[j][0:4], sessionID)
+				}
+				submitShards(tun, sessionID, shards)
+			}
+			<-done
+		})
+	}
+}
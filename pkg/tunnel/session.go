@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// Every server session gets a random ID when its connection is accepted. The
+// server prefixes the session's log lines with it (handshake, authentication,
+// FEC negotiation, write errors, disconnect) and records it in audit entries
+// and the admin API, so one client can be followed through the log of a busy
+// server. The ID is announced to the client, which logs it, reports it in its
+// status and attaches it to disconnect errors, so users can quote it when
+// reporting a problem. A handoff to a new process keeps the ID. Clients
+// without support ignore the packet.
+//
+// Layout: [PacketTypeSessionID][ID, hex digits]
+
+// maxSessionIDLen bounds the session ID accepted from the server
+const maxSessionIDLen = 32
+
+func newSessionID() string {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// logf logs a line of the session, prefixed with its ID
+func (c *ClientConnection) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if c != nil && c.sessionID != "" {
+		msg = "[" + c.sessionID + "] " + msg
+	}
+	log.Output(2, msg)
+}
+
+// announceSessionID tells a client the ID of its session
+func (t *Tunnel) announceSessionID(client *ClientConnection) {
+	if client.sessionID == "" {
+		return
+	}
+	encrypted, err := t.encryptForClient(client, append([]byte{PacketTypeSessionID}, client.sessionID...))
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send session ID to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// handleServerSessionID records the ID the server gave the session (client mode)
+func (t *Tunnel) handleServerSessionID(payload []byte) {
+	if len(payload) == 0 || len(payload) > maxSessionIDLen {
+		return
+	}
+	if _, err := hex.DecodeString(string(payload)); err != nil {
+		return
+	}
+	id := string(payload)
+	t.sessionID.Store(id)
+	log.Printf("Server session ID: %s (quote it when reporting a problem)", id)
+	go t.syncClock()
+}
+
+// SessionID returns the ID the server gave the current session, or "" if it
+// has not announced one (client mode)
+func (t *Tunnel) SessionID() string {
+	id, _ := t.sessionID.Load().(string)
+	return id
+}
@@ -0,0 +1,226 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// Socket buffers follow the traffic rather than staying at a size picked for
+// a fast long path. Every sockBufInterval the buffers of the tunnel's sockets
+// (the connection to the server, or the listeners all clients share) are
+// sized to twice the bandwidth-delay product of the last interval: the tunnel
+// payload carried in each direction times the smoothed keepalive RTT, the
+// highest session's on servers. A receive buffer that overflowed since the
+// last look is doubled whatever the estimate says, so drops correct
+// themselves. Buffers grow at once and shrink only once the estimate falls
+// under a quarter of their size, never below sockBufMin nor above the
+// kernel's limit (net.core.rmem_max and wmem_max, or faketcp.MaxSocketBuffer
+// with CAP_NET_ADMIN) or socket_buffer_max. socket_buffer fixes both sizes.
+
+const (
+	sockBufInterval   = 5 * time.Second
+	sockBufStart      = 4 << 20 // Size before the first estimate, as Dial sets
+	sockBufMin        = 256 << 10
+	sockBufDefaultRTT = 100 * time.Millisecond // Until the first keepalive echo
+)
+
+// socketBuffers sizes the buffers of the tunnel's sockets
+type socketBuffers struct {
+	auto                 bool
+	recvLimit, sendLimit int
+
+	mu              sync.Mutex
+	recv, send      int // Sizes asked for
+	bdp             int
+	lastIn, lastOut uint64
+	lastTick        time.Time
+	drops           map[faketcp.BufferSizer]uint64 // Receive buffer drops last seen per socket
+	overflows       uint64
+	resizes         uint64
+}
+
+func newSocketBuffers(fixed, limit int) *socketBuffers {
+	b := &socketBuffers{drops: make(map[faketcp.BufferSizer]uint64)}
+	if fixed > 0 {
+		b.recv, b.send = fixed, fixed
+		b.recvLimit, b.sendLimit = fixed, fixed
+		return b
+	}
+	b.auto = true
+	b.recvLimit, b.sendLimit = faketcp.SocketBufferLimits()
+	if limit > 0 {
+		b.recvLimit, b.sendLimit = min(b.recvLimit, limit), min(b.sendLimit, limit)
+	}
+	b.recvLimit, b.sendLimit = atLeast(b.recvLimit, sockBufMin), atLeast(b.sendLimit, sockBufMin)
+	b.recv, b.send = min(sockBufStart, b.recvLimit), min(sockBufStart, b.sendLimit)
+	return b
+}
+
+// atLeast returns v raised to floor; 0 (limit unknown) is floor too
+func atLeast(v, floor int) int {
+	if v <= 0 {
+		return floor
+	}
+	return max(v, floor)
+}
+
+// socketBufferLoop keeps the buffers of the tunnel's sockets sized
+func (t *Tunnel) socketBufferLoop() {
+	t.sockBuf = newSocketBuffers(t.config.SocketBuffer, t.config.SocketBufferMax)
+	t.wg.Add(1)
+	t.goLoop(policyManagement, "socket buffer loop", func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(sockBufInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stopCh:
+				return
+			case now := <-ticker.C:
+				t.scaleSocketBuffers(now)
+			}
+		}
+	})
+}
+
+// bufferSockets returns the sockets whose buffers the tunnel sizes
+func (t *Tunnel) bufferSockets() []faketcp.BufferSizer {
+	var sockets []faketcp.BufferSizer
+	if t.config.Mode == "client" {
+		if conn := t.conn; conn != nil {
+			if s, ok := unwrapImpaired(conn).(faketcp.BufferSizer); ok {
+				sockets = append(sockets, s)
+			}
+		}
+		return sockets
+	}
+	if s, ok := t.listener.(faketcp.BufferSizer); ok {
+		sockets = append(sockets, s)
+	}
+	for _, listener := range t.hopListeners() {
+		if s, ok := listener.(faketcp.BufferSizer); ok {
+			sockets = append(sockets, s)
+		}
+	}
+	return sockets
+}
+
+// bufferTraffic returns the payload carried so far in each direction and the
+// RTT it took, the highest session's on servers
+func (t *Tunnel) bufferTraffic() (in, out uint64, rtt time.Duration) {
+	in, out = t.statBytesIn.Load(), t.statBytesOut.Load()
+	rtt = time.Duration(t.srtt.Load())
+	t.allClientsMux.RLock()
+	for client := range t.allClients {
+		in += client.bytesIn.Load()
+		out += client.bytesOut.Load()
+		rtt = max(rtt, time.Duration(client.srtt.Load()))
+	}
+	t.allClientsMux.RUnlock()
+	if rtt == 0 {
+		rtt = sockBufDefaultRTT
+	}
+	return in, out, rtt
+}
+
+// scaleSocketBuffers resizes the buffers to the traffic since the last call
+// and gives new sockets the current sizes
+func (t *Tunnel) scaleSocketBuffers(now time.Time) {
+	b := t.sockBuf
+	in, out, rtt := t.bufferTraffic()
+	sockets := t.bufferSockets()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elapsed := now.Sub(b.lastTick).Seconds()
+	first := b.lastTick.IsZero()
+	b.lastTick = now
+
+	// Overflows since the last look, and the sockets not sized yet
+	var fresh []faketcp.BufferSizer
+	var overflowed uint64
+	drops := make(map[faketcp.BufferSizer]uint64, len(sockets))
+	for _, s := range sockets {
+		stats, _ := s.SocketStats()
+		prev, seen := b.drops[s]
+		if !seen {
+			fresh = append(fresh, s)
+		} else if stats.Drops > prev {
+			overflowed += stats.Drops - prev
+		}
+		drops[s] = stats.Drops
+	}
+	b.drops = drops
+	b.overflows += overflowed
+
+	recv, send := b.recv, b.send
+	if b.auto && !first && elapsed > 0 && in >= b.lastIn && out >= b.lastOut {
+		recvBDP := int(float64(in-b.lastIn) / elapsed * rtt.Seconds())
+		sendBDP := int(float64(out-b.lastOut) / elapsed * rtt.Seconds())
+		b.bdp = max(recvBDP, sendBDP)
+		recv = resizeBuffer(recv, 2*recvBDP, b.recvLimit)
+		send = resizeBuffer(send, 2*sendBDP, b.sendLimit)
+		if overflowed > 0 && recv < b.recvLimit {
+			recv = min(max(recv, 2*b.recv), b.recvLimit)
+			log.Printf("%sSocket receive buffer overflowed (%d packets dropped), growing it to %d bytes",
+				t.tunnelPrefix(), overflowed, recv)
+		}
+	}
+	b.lastIn, b.lastOut = in, out
+
+	if recv != b.recv || send != b.send {
+		b.recv, b.send = recv, send
+		b.resizes++
+		fresh = sockets
+	}
+	for _, s := range fresh {
+		if err := s.SetSocketBuffers(b.recv, b.send); err != nil {
+			log.Printf("%sFailed to resize socket buffers to %d/%d bytes: %v", t.tunnelPrefix(), b.recv, b.send, err)
+		}
+	}
+}
+
+// resizeBuffer returns the size of a buffer of size cur for a target: larger
+// at once, smaller only below a quarter of it, within sockBufMin and limit
+func resizeBuffer(cur, target, limit int) int {
+	target = min(max(target, sockBufMin), limit)
+	if target > cur || target < cur/4 {
+		return target
+	}
+	return cur
+}
+
+// bufferStatus reports the socket buffers for /status
+func (t *Tunnel) bufferStatus() *api.BufferStatus {
+	b := t.sockBuf
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &api.BufferStatus{
+		Auto:      b.auto,
+		Recv:      b.recv,
+		Send:      b.send,
+		RecvLimit: b.recvLimit,
+		SendLimit: b.sendLimit,
+		BDP:       b.bdp,
+		Overflows: b.overflows,
+		Resizes:   b.resizes,
+	}
+}
+
+// socketBufferOverflows returns the receive buffer drops counted so far
+func (t *Tunnel) socketBufferOverflows() uint64 {
+	b := t.sockBuf
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.overflows
+}
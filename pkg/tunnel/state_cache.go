@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/nat"
+)
+
+// The state cache (state_cache, client mode) remembers per server address the
+// results of slow startup probing, so restarts and reconnects reuse them:
+//
+//	mtu       path MTU from discovery or upward probing, trusted for 7 days
+//	nat_type  NAT type from STUN detection, trusted for a day and only while
+//	          the server still sees the same public IP
+//
+// The file is JSON keyed by server address and is rewritten on every update.
+
+const (
+	mtuCacheMaxAge = 7 * 24 * time.Hour
+	natCacheMaxAge = 24 * time.Hour
+)
+
+// stateCacheEntry is one server address in the state cache file
+type stateCacheEntry struct {
+	MTU     int       `json:"mtu,omitempty"`
+	Updated time.Time `json:"updated,omitzero"` // When mtu was measured
+
+	NATType     nat.NATType `json:"nat_type,omitempty"`
+	NATPublicIP string      `json:"nat_public_ip,omitempty"` // Public IP the NAT type was detected behind
+	NATUpdated  time.Time   `json:"nat_updated,omitzero"`
+}
+
+var stateCacheMux sync.Mutex
+
+func readStateCache(path string) map[string]stateCacheEntry {
+	entries := make(map[string]stateCacheEntry)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entries
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("⚠️  Ignoring unreadable state cache %s: %v", path, err)
+	}
+	return entries
+}
+
+// lookupStateCache returns the cached state for remote
+func lookupStateCache(path, remote string) (stateCacheEntry, bool) {
+	if path == "" {
+		return stateCacheEntry{}, false
+	}
+	stateCacheMux.Lock()
+	defer stateCacheMux.Unlock()
+	entry, ok := readStateCache(path)[remote]
+	return entry, ok
+}
+
+// updateStateCache applies update to the cached state for remote
+func updateStateCache(path, remote string, update func(*stateCacheEntry)) {
+	if path == "" {
+		return
+	}
+	stateCacheMux.Lock()
+	defer stateCacheMux.Unlock()
+	entries := readStateCache(path)
+	entry := entries[remote]
+	update(&entry)
+	entries[remote] = entry
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to update state cache %s: %v", path, err)
+	}
+}
+
+// loadCachedMTU returns the cached path MTU toward remote, if recent enough
+func loadCachedMTU(path, remote string) (int, bool) {
+	entry, ok := lookupStateCache(path, remote)
+	if !ok || entry.MTU < minDiscoveredMTU || time.Since(entry.Updated) > mtuCacheMaxAge {
+		return 0, false
+	}
+	return entry.MTU, true
+}
+
+// storeCachedMTU records the path MTU toward remote
+func storeCachedMTU(path, remote string, mtu int) {
+	updateStateCache(path, remote, func(e *stateCacheEntry) {
+		e.MTU = mtu
+		e.Updated = time.Now()
+	})
+}
+
+// loadCachedNAT returns the NAT type cached for remote while behind publicIP
+func loadCachedNAT(path, remote, publicIP string) (nat.NATType, bool) {
+	entry, ok := lookupStateCache(path, remote)
+	if !ok || entry.NATType == nat.NATUnknown || entry.NATPublicIP != publicIP ||
+		time.Since(entry.NATUpdated) > natCacheMaxAge {
+		return nat.NATUnknown, false
+	}
+	return entry.NATType, true
+}
+
+// storeCachedNAT records the NAT type detected behind publicIP
+func storeCachedNAT(path, remote, publicIP string, natType nat.NATType) {
+	updateStateCache(path, remote, func(e *stateCacheEntry) {
+		e.NATType = natType
+		e.NATPublicIP = publicIP
+		e.NATUpdated = time.Now()
+	})
+}
+
+// detectNATType sets the P2P manager's NAT type from the state cache, running
+// detection against the server only on a miss (client mode)
+func (t *Tunnel) detectNATType(publicAddr string) {
+	publicIP := publicAddr
+	if host, _, err := net.SplitHostPort(publicAddr); err == nil {
+		publicIP = host
+	}
+	path := t.config.StateCacheFile
+	if natType, ok := loadCachedNAT(path, t.config.RemoteAddr, publicIP); ok {
+		log.Printf("Using cached NAT type for public IP %s", publicIP)
+		t.p2pManager.SetNATType(natType)
+		return
+	}
+	t.p2pManager.DetectNATType(t.config.RemoteAddr)
+	if natType := t.p2pManager.GetNATType(); natType != nat.NATUnknown {
+		storeCachedNAT(path, t.config.RemoteAddr, publicIP, natType)
+	}
+}
@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+)
+
+// firewallReporter is implemented by transports that install iptables rules
+type firewallReporter interface {
+	FirewallRules() []iptables.RuleState
+}
+
+// stateReporter is implemented by transports with a fake TCP state machine
+type stateReporter interface {
+	State() faketcp.StateInfo
+}
+
+func tcpState(s faketcp.StateInfo) api.TCPState {
+	return api.TCPState{
+		Local:          s.Local,
+		Remote:         s.Remote,
+		State:          s.State.String(),
+		Since:          s.Since,
+		HandshakeMs:    durationMs(s.Handshake),
+		Deadline:       s.Deadline,
+		SYNRetransmits: s.SYNRetransmits,
+		LastSent:       s.LastSent,
+		LastReceived:   s.LastReceived,
+		Reason:         s.Reason,
+	}
+}
+
+func rttMs(srtt *atomic.Int64) float64 {
+	return float64(srtt.Load()) / float64(time.Millisecond)
+}
+
+func appendFirewallRules(dst []api.FirewallRule, rules []iptables.RuleState) []api.FirewallRule {
+	for _, rule := range rules {
+		dst = append(dst, api.FirewallRule{Rule: rule.Rule, Present: rule.Present})
+	}
+	return dst
+}
+
+// firewallRules reports the rules of the connection, the listeners, the bans
+// and the bypasses and whether each is still installed
+func (t *Tunnel) firewallRules() []iptables.RuleState {
+	var rules []iptables.RuleState
+	if conn := t.conn; conn != nil {
+		if ic, ok := conn.(*impairedConn); ok {
+			conn = ic.ConnAdapter
+		}
+		if fw, ok := conn.(firewallReporter); ok {
+			rules = append(rules, fw.FirewallRules()...)
+		}
+	}
+	if fw, ok := t.listener.(firewallReporter); ok {
+		rules = append(rules, fw.FirewallRules()...)
+	}
+	rules = append(rules, t.hopFirewallRules()...)
+	rules = append(rules, t.unauthFirewallRules()...)
+	rules = append(rules, t.mgmtFirewallRules()...)
+	if t.bypassIPT != nil {
+		rules = append(rules, t.bypassIPT.CheckRules()...)
+	}
+	return rules
+}
+
+// Status returns a snapshot of the tunnel's state, served at GET /status
+func (t *Tunnel) Status() api.Status {
+	s := api.Status{
+		Name:     t.config.Name,
+		Mode:     t.config.Mode,
+		Version:  Version,
+		TunName:  t.tunName,
+		Uptime:   time.Since(t.started).Seconds(),
+		BytesIn:  t.statBytesIn.Load(),
+		BytesOut: t.statBytesOut.Load(),
+		FEC: api.FECStatus{
+			ShardsReceived:      t.statFECShardsRecv.Load(),
+			GroupsRecovered:     t.statFECSessionsRecovered.Load(),
+			GroupsUnrecoverable: t.statFECSessionsUnrecoverable.Load(),
+			PacketsRecovered:    t.statFECPacketsRecovered.Load(),
+			LateDrops:           t.statFECLateBatchDrop.Load(),
+			GapSkips:            t.statFECGapSkip.Load(),
+			CorruptShards:       t.statFECShardCorrupt.Load(),
+		},
+		Drops: t.statQueueDropSend.Load() + t.statQueueDropRecv.Load() +
+			t.statQueueDropClientSend.Load() + t.statQueueDropRouteSend.Load() +
+			t.statQueueDropForward.Load(),
+		DeadPaths: t.statDeadPath.Load(),
+		Panics:    t.statPanics.Load(),
+		Resumes:   t.statResumes.Load(),
+		Sessions:  []api.SessionStatus{},
+		Firewall:  []api.FirewallRule{},
+	}
+
+	if faketcp.StrictValidation() {
+		m := faketcp.Malformed()
+		s.Strict = &api.StrictStatus{
+			IPHeader:    m.IPHeader,
+			IPChecksum:  m.IPChecksum,
+			TCPHeader:   m.TCPHeader,
+			TCPChecksum: m.TCPChecksum,
+			TCPFlags:    m.TCPFlags,
+		}
+	}
+	if faketcp.HandshakeCookies() {
+		c := faketcp.Cookies()
+		s.Cookies = &api.CookieStatus{Sent: c.Sent, Accepted: c.Accepted, Rejected: c.Rejected}
+	}
+	if d := faketcp.Duplicates(); t.config.Duplicate > 1 || d.Dropped > 0 {
+		s.Duplicates = &api.DuplicateStatus{Copies: max(t.config.Duplicate, 1), Sent: d.Sent, Dropped: d.Dropped}
+	}
+	s.ICMP = t.icmpStatus()
+	s.PortHop = t.portHopStatus()
+	s.Broker = t.brokerStatus()
+	s.Transforms = t.transformStatus()
+	s.Unauth = t.unauthStatus()
+	peerDrops, reports := t.statPeerDrops.Load(), t.statDropReportsSent.Load()
+	if len(t.config.CongestionResponse) > 0 || peerDrops > 0 || reports > 0 {
+		s.Congestion = &api.CongestionStatus{
+			Response:    append([]string{}, t.config.CongestionResponse...),
+			Level:       t.congestion.level(),
+			PeerDrops:   peerDrops,
+			Shed:        t.statShed.Load(),
+			ReportsSent: reports,
+		}
+	}
+	if t.limiter != nil {
+		s.RateLimit = t.rateLimitStatus()
+	}
+	if t.mirror != nil {
+		c := t.mirror.Stats()
+		s.Mirror = &api.MirrorStatus{Target: t.mirror.Target(), Sent: c.Sent, Dropped: c.Dropped, Errors: c.Errors}
+	}
+
+	if conn := t.conn; conn != nil {
+		s.Server = conn.RemoteAddr().String()
+		s.SessionID = t.SessionID()
+		s.RTTMs = rttMs(&t.srtt)
+		s.Clock = t.clockStatus()
+	}
+	s.Firewall = appendFirewallRules(s.Firewall, t.firewallRules())
+	s.Guard = t.firewallGuardStatus()
+	s.Buffers = t.bufferStatus()
+	for _, h := range faketcp.Handshakes() {
+		s.Handshakes = append(s.Handshakes, tcpState(h))
+	}
+
+	t.allClientsMux.RLock()
+	clients := make([]*ClientConnection, 0, len(t.allClients))
+	for client := range t.allClients {
+		clients = append(clients, client)
+	}
+	t.allClientsMux.RUnlock()
+	for _, client := range clients {
+		session := api.SessionStatus{
+			RemoteAddr:    client.conn.RemoteAddr().String(),
+			SessionID:     client.sessionID,
+			BytesIn:       client.bytesIn.Load(),
+			BytesOut:      client.bytesOut.Load(),
+			RTTMs:         rttMs(&client.srtt),
+			SendMTU:       int(atomic.LoadInt32(&client.sendMTU)),
+			Hibernating:   atomic.LoadUint32(&client.hibernating) != 0,
+			Mirrored:      atomic.LoadInt32(&client.mirrored) == mirrorOn,
+			ClockOffsetMs: durationMs(time.Duration(client.clockOffset.Load())),
+		}
+		client.mu.RLock()
+		session.Identity = client.identity
+		session.Version = client.version
+		session.ConnectedAt = client.connectedAt
+		client.mu.RUnlock()
+		t.clientsMux.RLock()
+		if client.clientIP != nil {
+			session.TunnelIP = client.clientIP.String()
+		}
+		t.clientsMux.RUnlock()
+		s.BytesIn += session.BytesIn
+		s.BytesOut += session.BytesOut
+		if s.Congestion != nil {
+			s.Congestion.Level = max(s.Congestion.Level, client.congestion.level())
+		}
+		s.Sessions = append(s.Sessions, session)
+	}
+	sort.Slice(s.Sessions, func(i, j int) bool {
+		return s.Sessions[i].RemoteAddr < s.Sessions[j].RemoteAddr
+	})
+	s.Interface = t.interfaceCounters(s.BytesIn, s.BytesOut, clients)
+	if t.config.Mode == "server" {
+		s.Servers = t.gossipPeers()
+	} else {
+		s.Servers = t.alternativeServers()
+	}
+	return s
+}
+
+// Peers lists the tunnel's clients and P2P peers, served at GET /peers
+func (t *Tunnel) Peers() api.Peers {
+	status := t.Status()
+	peers := api.Peers{Server: status.Server, Sessions: status.Sessions, P2P: []api.P2PPeer{}}
+	if t.p2pManager == nil {
+		return peers
+	}
+	for _, peer := range t.p2pManager.Peers() {
+		peers.P2P = append(peers.P2P, api.P2PPeer{
+			TunnelIP:      peer.TunnelIP.String(),
+			PublicAddr:    peer.PublicAddr,
+			LocalAddr:     peer.LocalAddr,
+			NATType:       peer.NATType.String(),
+			Connected:     peer.Connected,
+			LocalNetwork:  peer.IsLocalConnection,
+			ThroughServer: peer.ThroughServer,
+			LatencyMs:     float64(peer.Latency) / float64(time.Millisecond),
+			PacketLoss:    peer.PacketLoss,
+			LastSeen:      peer.LastSeen,
+		})
+	}
+	sort.Slice(peers.P2P, func(i, j int) bool {
+		return peers.P2P[i].TunnelIP < peers.P2P[j].TunnelIP
+	})
+	return peers
+}
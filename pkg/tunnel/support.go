@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// A bug report needs the first frames of the connection that failed and the
+// log around it, which are usually gone by the time someone asks. With
+// first_frames set, the first frames sent and received on every connection
+// are logged decoded, whatever the log level, and the last frameHistorySize
+// of those records stay in memory for GET /frames. The process keeps its last
+// recentLogLines log lines for GET /logs. -support-bundle packs both with the
+// configuration, status and host settings into one archive.
+
+const (
+	frameHistorySize = 1024
+	recentLogLines   = 1000
+)
+
+// frameHistory keeps the latest first-frame records
+type frameHistory struct {
+	mu      sync.Mutex
+	records []api.FrameRecord
+	next    int // Oldest record once the history is full
+}
+
+func (h *frameHistory) add(r api.FrameRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) < frameHistorySize {
+		h.records = append(h.records, r)
+		return
+	}
+	h.records[h.next] = r
+	h.next = (h.next + 1) % frameHistorySize
+}
+
+// list returns the records, oldest first
+func (h *frameHistory) list() []api.FrameRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append(append([]api.FrameRecord{}, h.records[h.next:]...), h.records[:h.next]...)
+}
+
+// serverFrames counts the frames of one connection to the server
+type serverFrames struct {
+	conn faketcp.ConnAdapter
+	n    atomic.Int32
+}
+
+// noteFirstFrame logs and records a frame among the first first_frames of its
+// connection: that of client, or the client's to the server if nil
+func (t *Tunnel) noteFirstFrame(sent bool, client *ClientConnection, frame []byte) {
+	limit := t.config.FirstFrames
+	if limit <= 0 {
+		return
+	}
+	var n int32
+	if client != nil {
+		n = client.framesNoted.Add(1)
+	} else {
+		conn := t.conn
+		counter := t.serverFrames.Load()
+		for counter == nil || counter.conn != conn {
+			// A new connection starts counting again
+			if t.serverFrames.CompareAndSwap(counter, &serverFrames{conn: conn}) {
+				counter = t.serverFrames.Load()
+				break
+			}
+			counter = t.serverFrames.Load()
+		}
+		n = counter.n.Add(1)
+	}
+	if int(n) > limit {
+		return
+	}
+
+	r := api.FrameRecord{Time: time.Now(), Sent: sent, Peer: t.config.RemoteAddr, Session: t.SessionID(),
+		Index: int(n), Frame: describeFrame(frame)}
+	if client != nil {
+		r.Peer, r.Session = client.conn.RemoteAddr().String(), client.sessionID
+	}
+	dir := "<-"
+	if sent {
+		dir = "->"
+	}
+	peer := r.Peer
+	if r.Session != "" {
+		peer += " [" + r.Session + "]"
+	}
+	log.Printf("%sFRAME %d/%d %s %s %s", t.tunnelPrefix(), n, limit, dir, peer, r.Frame)
+	t.frameHistory.add(r)
+}
+
+// FirstFrames returns the latest first-frame records, oldest first
+func (t *Tunnel) FirstFrames() []api.FrameRecord {
+	return t.frameHistory.list()
+}
+
+func (t *Tunnel) handleGetFrames(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, t.FirstFrames())
+}
+
+// logRing keeps the last lines written to it
+type logRing struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	partial []byte // A line not yet ended
+}
+
+// RecentLog keeps the last recentLogLines lines the process logged; main
+// writes the standard logger to it as well as to stderr
+var RecentLog = &logRing{}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data := append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(data[:i])
+		if len(l.lines) < recentLogLines {
+			l.lines = append(l.lines, line)
+		} else {
+			l.lines[l.next] = line
+			l.next = (l.next + 1) % recentLogLines
+		}
+		data = data[i+1:]
+	}
+	l.partial = append(l.partial[:0], data...)
+	return len(p), nil
+}
+
+// Lines returns the lines kept, oldest first
+func (l *logRing) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append(append([]string{}, l.lines[l.next:]...), l.lines[:l.next]...)
+}
+
+func (t *Tunnel) handleGetLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	lines := RecentLog.Lines()
+	if len(lines) > 0 {
+		w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	}
+}
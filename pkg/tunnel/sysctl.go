@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The raw socket only sees packets the kernel accepted. With strict reverse
+// path filtering (rp_filter=1) a packet arriving on an interface its source is
+// not routed back through is dropped before that, which on asymmetric or
+// multi-homed hosts looks like a peer that never answers. Start checks the
+// interfaces the tunnel uses and warns; with fix_sysctl it sets
+//
+//	net.ipv4.conf.{all,<iface>}.rp_filter  2 (loose) where stricter
+//	net.ipv4.conf.<iface>.accept_local     1 (peer on the same host)
+//	net.ipv4.ip_forward                    1 (server, or client with routes)
+//
+// and Stop restores the previous values. A server handing off to a new
+// process passes them on with the sessions. Settings are written under
+// /proc/sys rather than through sysctl(8), whose dotted names cannot address
+// interfaces like eth0.100.
+
+const procSys = "/proc/sys/"
+
+// sysctlSetting is one wanted kernel setting
+type sysctlSetting struct {
+	key   string // Path below /proc/sys
+	value int
+	orOff bool // 0 (disabled) is fine too
+}
+
+func readSysctl(key string) (int, error) {
+	data, err := os.ReadFile(procSys + key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func writeSysctl(key string, value int) error {
+	return os.WriteFile(procSys+key, []byte(strconv.Itoa(value)+"\n"), 0644)
+}
+
+// sysctlInterfaces returns the interfaces carrying tunnel traffic: the one
+// toward the server (client) or owning local_addr (server; every interface
+// when it is unspecified), and the TUN device
+func (t *Tunnel) sysctlInterfaces() []string {
+	var addrs []net.IP
+	if t.config.Mode == "client" || t.config.Mode == "peer" {
+		if raddr, err := net.ResolveUDPAddr("udp", t.config.RemoteAddr); err == nil {
+			if conn, err := net.DialUDP("udp", nil, raddr); err == nil {
+				addrs = append(addrs, conn.LocalAddr().(*net.UDPAddr).IP)
+				conn.Close()
+			}
+		}
+	}
+	if t.config.Mode == "server" || t.config.Mode == "peer" {
+		host, _, _ := net.SplitHostPort(t.config.LocalAddr)
+		addrs = append(addrs, net.ParseIP(host)) // nil matches every interface
+	}
+
+	seen := map[string]bool{}
+	var names []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	ifaces, _ := net.Interfaces()
+	for _, ip := range addrs {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || (iface.Flags&net.FlagLoopback != 0 && !ip.IsLoopback()) {
+				continue
+			}
+			ifAddrs, _ := iface.Addrs()
+			for _, a := range ifAddrs {
+				if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && (ip == nil || ip.IsUnspecified() || ipnet.IP.Equal(ip)) {
+					add(iface.Name)
+					break
+				}
+			}
+		}
+	}
+	add(t.tunName)
+	return names
+}
+
+// wantedSysctls returns the settings the tunnel needs on ifaces
+func (t *Tunnel) wantedSysctls(ifaces []string) []sysctlSetting {
+	wanted := []sysctlSetting{{key: "net/ipv4/conf/all/rp_filter", value: 2, orOff: true}}
+	for _, name := range ifaces {
+		wanted = append(wanted, sysctlSetting{key: "net/ipv4/conf/" + name + "/rp_filter", value: 2, orOff: true})
+		if name != t.tunName {
+			wanted = append(wanted, sysctlSetting{key: "net/ipv4/conf/" + name + "/accept_local", value: 1})
+		}
+	}
+	if t.config.Mode == "server" || len(t.config.Routes) > 0 {
+		wanted = append(wanted, sysctlSetting{key: "net/ipv4/ip_forward", value: 1})
+	}
+	return wanted
+}
+
+// checkSysctls warns about strict reverse path filtering on the tunnel's
+// interfaces and, with fix_sysctl, adjusts the kernel settings it needs
+func (t *Tunnel) checkSysctls() {
+	ifaces := t.sysctlInterfaces()
+	if !t.config.FixSysctl {
+		all, _ := readSysctl("net/ipv4/conf/all/rp_filter")
+		for _, name := range ifaces {
+			// The kernel applies the stricter of "all" and the interface
+			if v, err := readSysctl("net/ipv4/conf/" + name + "/rp_filter"); err == nil && max(v, all) == 1 {
+				log.Printf("⚠️  Strict reverse path filtering on %s (rp_filter=1) can drop tunnel packets on asymmetric routes; set it to 2 or enable fix_sysctl", name)
+			}
+		}
+		return
+	}
+
+	orig := t.takeoverSysctls()
+	for _, s := range t.wantedSysctls(ifaces) {
+		v, err := readSysctl(s.key)
+		if err != nil {
+			log.Printf("⚠️  Failed to read %s: %v", s.key, err)
+			continue
+		}
+		if v == s.value || (s.orOff && v == 0) {
+			continue
+		}
+		if err := writeSysctl(s.key, s.value); err != nil {
+			log.Printf("⚠️  Failed to set %s=%d: %v", s.key, s.value, err)
+			continue
+		}
+		if _, ok := orig[s.key]; !ok {
+			orig[s.key] = v
+		}
+		log.Printf("Kernel setting %s=%d (was %d, restored on exit)", s.key, s.value, v)
+	}
+	t.sysctlMux.Lock()
+	t.sysctlOrig = orig
+	t.sysctlMux.Unlock()
+}
+
+// takeoverSysctls returns the original settings saved by the predecessor,
+// whose changes this process finds in place and must undo instead
+func (t *Tunnel) takeoverSysctls() map[string]int {
+	orig := make(map[string]int)
+	if t.takeover != nil {
+		for key, v := range t.takeover.state.Sysctl {
+			orig[key] = v
+		}
+	}
+	return orig
+}
+
+// savedSysctls returns the settings to restore, for a handoff
+func (t *Tunnel) savedSysctls() map[string]int {
+	t.sysctlMux.Lock()
+	defer t.sysctlMux.Unlock()
+	if len(t.sysctlOrig) == 0 {
+		return nil
+	}
+	saved := make(map[string]int, len(t.sysctlOrig))
+	for key, v := range t.sysctlOrig {
+		saved[key] = v
+	}
+	return saved
+}
+
+// restoreSysctls undoes checkSysctls. Settings of the TUN device are gone
+// with it and skipped.
+func (t *Tunnel) restoreSysctls() {
+	t.sysctlMux.Lock()
+	defer t.sysctlMux.Unlock()
+	keys := make([]string, 0, len(t.sysctlOrig))
+	for key := range t.sysctlOrig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := os.Stat(procSys + key); os.IsNotExist(err) {
+			continue
+		}
+		if err := writeSysctl(key, t.sysctlOrig[key]); err != nil {
+			log.Printf("⚠️  Failed to restore %s: %v", key, err)
+			continue
+		}
+		log.Printf("Restored kernel setting %s=%d", key, t.sysctlOrig[key])
+	}
+	t.sysctlOrig = nil
+}
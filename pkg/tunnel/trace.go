@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// With trace_seconds set, every connection keeps its recent TCP segments (see
+// faketcp.Trace). A session that ends on an error leaves them behind as a
+// pcapng file in trace_dir, so an intermittent disconnect can be looked at
+// after the fact; GET /trace returns the same dump for a live connection, e.g.
+//
+//	curl -s 'http://127.0.0.1:9100/trace?session=203.0.113.7:40112' | tshark -r -
+
+// traceDumpReasons are the session end reasons that leave a trace file
+var traceDumpReasons = map[string]bool{
+	"idle timeout": true,
+	"read error":   true,
+	"write error":  true,
+}
+
+// traceRing returns the trace ring of a connection under any fault injection
+// wrapper, nil when it has none
+func traceRing(conn faketcp.ConnAdapter) *capture.Ring {
+	if ic, ok := conn.(*impairedConn); ok {
+		conn = ic.ConnAdapter
+	}
+	if tr, ok := conn.(faketcp.Tracer); ok {
+		return tr.TraceRing()
+	}
+	return nil
+}
+
+// dumpTrace writes the trace of a connection whose session failed to
+// trace_dir. Best effort.
+func (t *Tunnel) dumpTrace(conn faketcp.ConnAdapter, reason string) {
+	ring := traceRing(conn)
+	if ring == nil {
+		return
+	}
+	dir := t.config.TraceDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	remote := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String())
+	path := filepath.Join(dir, fmt.Sprintf("lightweight-tunnel-%s-%s.pcapng", remote, time.Now().Format("20060102-150405")))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("⚠️  Failed to write connection trace: %v", err)
+		return
+	}
+	err = ring.Dump(f, conn.RemoteAddr().String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to write connection trace %s: %v", path, err)
+		return
+	}
+	log.Printf("Connection trace of %s (%s) written to %s", conn.RemoteAddr(), reason, path)
+}
+
+// handleTrace returns a connection's trace as pcapng: the session with the
+// given remote address on a server, the connection to the server on a client
+func (t *Tunnel) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if t.config.TraceSeconds <= 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("connection tracing is disabled (trace_seconds)"))
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if t.config.Mode == "server" && session == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("session (client remote address) is required"))
+		return
+	}
+	conn, _ := t.sessionConn(session)
+	ring := traceRing(conn)
+	if ring == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no traced connection"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	ring.Dump(w, conn.RemoteAddr().String())
+}
@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+)
+
+// Programs embedding the tunnel can register transforms that rewrite every
+// frame on the wire: a proprietary obfuscation layer, a telemetry stamp, a
+// capture hook. Frames are the encrypted (and FEC encoded) payloads of the
+// fake TCP segments, on every connection the tunnel uses (to the server, to
+// clients, to P2P peers). Sent frames pass the transforms in the order they
+// were added, received frames in the reverse order, so a peer registering
+// the same chain undoes them layer by layer. Transforms run on the packet
+// path and must be fast and safe for concurrent use.
+
+// Direction is the way a frame passes a transform
+type Direction int
+
+const (
+	Outbound Direction = iota // Frame about to be sent
+	Inbound                   // Frame just received
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// Transform rewrites a frame. Inbound frames may be modified in place; an
+// outbound frame may still be held by the sender (duplicates, KCP
+// retransmissions), so changes go to a new slice. Returning an empty frame or
+// an error drops it. Errors are counted
+// and logged at most once per transformErrorLogInterval per transform.
+type Transform func(frame []byte, dir Direction) ([]byte, error)
+
+const transformErrorLogInterval = 10 * time.Second
+
+// errTransformsStarted is returned when a transform is added to a running tunnel
+var errTransformsStarted = errors.New("transforms must be added before Start")
+
+type namedTransform struct {
+	name      string
+	fn        Transform
+	errLogged atomic.Int64 // Last error logged (unix ns)
+}
+
+// AddTransform appends a transform to the chain applied to every frame on the
+// wire. It must be called before Start; both peers need matching chains.
+func (t *Tunnel) AddTransform(name string, fn Transform) error {
+	if fn == nil {
+		return fmt.Errorf("transform %q is nil", name)
+	}
+	if !t.started.IsZero() {
+		return errTransformsStarted
+	}
+	t.transforms = append(t.transforms, &namedTransform{name: name, fn: fn})
+	return nil
+}
+
+// transformFrame passes frame through the chain in the direction given,
+// returning nil when a transform dropped it
+func (t *Tunnel) transformFrame(frame []byte, dir Direction) []byte {
+	n := len(t.transforms)
+	for i := 0; i < n && len(frame) > 0; i++ {
+		tr := t.transforms[i]
+		if dir == Inbound {
+			tr = t.transforms[n-1-i]
+		}
+		out, err := tr.fn(frame, dir)
+		if err != nil {
+			t.statTransformDrop.Add(1)
+			now := time.Now().UnixNano()
+			if last := tr.errLogged.Load(); now-last >= int64(transformErrorLogInterval) &&
+				tr.errLogged.CompareAndSwap(last, now) {
+				log.Printf("⚠️  Transform %s dropped an %s frame: %v", tr.name, dir, err)
+			}
+			return nil
+		}
+		frame = out
+	}
+	if len(frame) == 0 {
+		return nil
+	}
+	return frame
+}
+
+// transformBatch applies the chain to each frame of a batch, leaving out the
+// dropped ones
+func (t *Tunnel) transformBatch(frames [][]byte, dir Direction) [][]byte {
+	kept := frames[:0:0]
+	for _, f := range frames {
+		if f = t.transformFrame(f, dir); f != nil {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// transformStatus lists the registered transforms for /status
+func (t *Tunnel) transformStatus() *api.TransformStatus {
+	if len(t.transforms) == 0 {
+		return nil
+	}
+	s := &api.TransformStatus{Dropped: t.statTransformDrop.Load()}
+	for _, tr := range t.transforms {
+		s.Names = append(s.Names, tr.name)
+	}
+	return s
+}
+
+func (c *impairedConn) ReadPacket() ([]byte, error) {
+	packet, err := c.ConnAdapter.ReadPacket()
+	if err != nil || len(c.t.transforms) == 0 || len(packet) == 0 {
+		return packet, err
+	}
+	if packet = c.t.transformFrame(packet, Inbound); packet == nil {
+		return []byte{}, nil // Readers skip empty packets
+	}
+	return packet, nil
+}
+
+func (c *impairedConn) ReadBatch(max int) ([][]byte, error) {
+	packets, err := c.ConnAdapter.ReadBatch(max)
+	if err != nil || len(c.t.transforms) == 0 {
+		return packets, err
+	}
+	if packets = c.t.transformBatch(packets, Inbound); len(packets) == 0 {
+		return [][]byte{{}}, nil // Readers skip empty packets
+	}
+	return packets, nil
+}
@@ -7,6 +7,8 @@ import (
 	"syscall"
 	"time"
 	"unsafe"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/capture"
 )
 
 const (
@@ -91,6 +93,7 @@ func (t *TunDevice) Read(buf []byte) (int, error) {
 	for {
 		n, err := syscall.Read(t.fd, buf)
 		if err == nil {
+			capture.Inner.Packet(buf[:n])
 			return n, nil
 		}
 
@@ -134,6 +137,7 @@ func (t *TunDevice) Write(buf []byte) (int, error) {
 	for {
 		n, err := syscall.Write(t.fd, buf)
 		if err == nil {
+			capture.Inner.Packet(buf)
 			return n, nil
 		}
 
@@ -183,3 +187,22 @@ func (t *TunDevice) Close() error {
 func (t *TunDevice) Name() string {
 	return t.name
 }
+
+// newTunDeviceFromFile wraps a TUN device descriptor inherited from another
+// process. It takes ownership of f.
+func newTunDeviceFromFile(f *os.File, name string) *TunDevice {
+	return &TunDevice{
+		file: f,
+		fd:   int(f.Fd()),
+		name: name,
+	}
+}
+
+// dupFile returns a duplicate of the device descriptor for another process
+func (t *TunDevice) dupFile() (*os.File, error) {
+	fd, err := syscall.Dup(t.fd)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
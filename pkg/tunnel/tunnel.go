@@ -1,7 +1,9 @@
 package tunnel
 
 import (
+	"cmp"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -9,6 +11,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
 	"os/exec"
 	"path/filepath"
 	"strconv"
@@ -20,11 +24,19 @@ import (
 	"unicode"
 
 	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/accounting"
+	"github.com/openbmx/lightweight-tunnel/pkg/audit"
+	"github.com/openbmx/lightweight-tunnel/pkg/broker"
 	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
 	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
 	"github.com/openbmx/lightweight-tunnel/pkg/fec"
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+	"github.com/openbmx/lightweight-tunnel/pkg/mirror"
 	"github.com/openbmx/lightweight-tunnel/pkg/nat"
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
 	"github.com/openbmx/lightweight-tunnel/pkg/p2p"
+	"github.com/openbmx/lightweight-tunnel/pkg/pki"
+	"github.com/openbmx/lightweight-tunnel/pkg/ratelimit"
 	"github.com/openbmx/lightweight-tunnel/pkg/rawsocket"
 	"github.com/openbmx/lightweight-tunnel/pkg/routing"
 	"github.com/openbmx/lightweight-tunnel/pkg/xdp"
@@ -42,6 +54,24 @@ const (
 	PacketTypeFECShard     = 0x09 // FEC encoded shard
 	PacketTypeAuth         = 0x0A // Authentication handshake packet
 	PacketTypeAuthResponse = 0x0B // Authentication response packet
+	PacketTypeDisconnect   = 0x0C // Server-initiated session termination with reason code
+	PacketTypeMTUProbe     = 0x0D // Padded path MTU probe (client -> server)
+	PacketTypeMTUProbeAck  = 0x0E // Acknowledges a received MTU probe
+	PacketTypeAggregate    = 0x0F // Several length-prefixed data packets in one frame
+	PacketTypeFragment     = 0x10 // Piece of an inner packet larger than the tunnel MTU
+	PacketTypeFECParams    = 0x11 // FEC parameter negotiation
+	PacketTypeFECShardChecked = 0x12 // FEC encoded shard with CRC-32C
+	PacketTypeVersion      = 0x13 // Software version exchange
+	PacketTypePeerHello    = 0x14 // Role negotiation in peer mode, before the client/server protocol starts
+	PacketTypeClientPush   = 0x15 // Per-client settings pushed by the server at session start
+	PacketTypeServerList   = 0x16 // Live alternative servers (client request, server answer)
+	PacketTypeECNEcho      = 0x17 // Count of congestion-marked segments received
+	PacketTypeDropReport   = 0x18 // Count of packets dropped on full receive queues
+	PacketTypeKCP          = 0x19 // KCP segments carrying data frames (reliability kcp)
+	PacketTypeSessionID    = 0x1A // Server tells the client the ID of its session
+	PacketTypeRenew        = 0x1B // Server asks the client to move to a new connection
+	PacketTypeClockSync    = 0x1C // Clock offset measurement (request/reply)
+	PacketTypePortHop      = 0x1D // Server tells the client the secret of its port hopping schedule
 
 	// IPv4 constants
 	IPv4Version      = 4
@@ -147,24 +177,55 @@ func isFECEnabled(cfg *config.Config) bool {
 	if cfg == nil {
 		return false
 	}
-	return cfg.FECDataShards > 0 && cfg.FECParityShards > 0
+	return cfg.FECDataShards > 0 && cfg.FECParityShards > 0 && cfg.Reliability != ReliabilityKCP
 }
 
 // ClientConnection represents a single client connection
 type ClientConnection struct {
-	conn         faketcp.ConnAdapter // Changed to interface for both UDP and Raw socket modes
-	sendQueue    chan []byte
-	recvQueue    chan []byte
+	// Tunnel payload counters for the audit log and usage accounting (atomic, kept first for 64-bit alignment)
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	packetsIn   atomic.Uint64
+	packetsOut  atomic.Uint64
+	srtt        atomic.Int64  // Smoothed keepalive round-trip time in nanoseconds (0 = no sample yet)
+	sendPath    pathProbe     // Keepalive probes to this client, for dead-path detection
+	control     *controlLane  // Keepalives, echoes and reports, sent ahead of data
+	recvDrops   atomic.Uint64 // Packets from this client dropped on full receive queues
+	framesNoted atomic.Int32  // Frames of this client logged so far (first_frames)
+
+	conn             faketcp.ConnAdapter // Changed to interface for both UDP and Raw socket modes
+	sendQueue        chan []byte
 	clientIP     net.IP
 	stopCh       chan struct{}
-	stopOnce     sync.Once
+	stopOnce         sync.Once
 	wg           sync.WaitGroup
-	lastPeerInfo string // Last peer info string sent by this client
-	cipher       *crypto.Cipher
+	lastPeerInfo     string // Last peer info string sent by this client
+	cipher           *crypto.Cipher
 	cipherGen    uint64
-	lastRecvTime time.Time // Last time we received a packet from this client
-	authenticated bool     // Whether this client has been authenticated (for encrypt_after_auth mode)
-	mu           sync.RWMutex
+	lastRecvTime     time.Time            // Last time we received a packet from this client
+	authenticated    bool                 // Whether this client has been authenticated (for encrypt_after_auth mode)
+	identity         string               // Certificate identity presented during PKI authentication
+	cert             *x509.Certificate    // Certificate presented during PKI authentication
+	connectedAt      time.Time            // When the connection was accepted
+	sendMTU          int32                // Inner MTU toward this client, limited by the receive MTU it advertised (atomic)
+	aggLimit         aggregateLimit       // Size of the aggregates sent to this client, following sendMTU
+	fragments        *fragmentReassembler // Reassembles oversized packets sent by this client
+	shardChecksum    uint32               // Client verifies shard checksums (negotiated, atomic)
+	version          string               // Software version the client announced
+	fecSessionID     uint32               // FEC session IDs sent to this client, consecutive so its reorder buffer sees no gaps (atomic)
+	hibernating      uint32               // Set while the session's buffers are released (atomic)
+	disconnectReason string               // First recorded reason the session ended
+	quotaCharged     uint64               // Traffic of this session already charged to its quota (guarded by quotaTracker.mu)
+	mirrored         int32                // Mirror decision, mirrorUndecided until the tunnel IP is known (atomic)
+	congestion       congestionState      // Drops this client reported
+	dropReport       dropReporter         // Drops reported to this client
+	kcp              *kcpSession          // KCP conversation (reliability kcp), started on first use
+	sessionID        string               // Random ID prefixed to the session's log lines and announced to the client
+	renewRequested   time.Time            // When the session was asked to renew (max_session_duration)
+	parityOverride int32         // Parity shards per full FEC group set by PUT /conn (0 = fec_parity, atomic)
+	clockOffset      atomic.Int64         // Client clock minus ours as the client measured it, in ns
+	verified         uint32               // A packet from the client decrypted, so it holds the key (atomic)
+	mu               sync.RWMutex
 }
 
 // fecRecvSession tracks state for receiving FEC encoded packets
@@ -176,18 +237,12 @@ type fecRecvSession struct {
 	totalShards   int      // Total shards expected
 	receivedCount int      // Number of shards received so far
 	lastUpdate    time.Time // Last time a shard was received
+	firstUpdate   time.Time // When the first shard was received
 	originalSize  int      // Original packet size before FEC encoding
 	expectedShardSize int  // Expected shard size for this session
 	mu            sync.Mutex // Protects session state
 }
 
-type fecReorderBuffer struct {
-	next       uint32
-	pending    map[uint32][][]byte
-	lastUpdate time.Time
-	gapSince   time.Time
-}
-
 // ConfigUpdateMessage carries server-pushed configuration updates.
 type ConfigUpdateMessage struct {
 	Key    string   `json:"key"`
@@ -224,36 +279,134 @@ func (c *ClientConnection) getCipher() (*crypto.Cipher, uint64) {
 	return c.cipher, c.cipherGen
 }
 
+// setDisconnectReason records why the session is ending; only the first reason is kept.
+func (c *ClientConnection) setDisconnectReason(reason string) {
+	c.mu.Lock()
+	if c.disconnectReason == "" {
+		c.disconnectReason = reason
+	}
+	c.mu.Unlock()
+}
+
 // Tunnel represents a lightweight tunnel
 type Tunnel struct {
 	config         *config.Config
 	configFilePath string
 	fec            *fec.FEC
+	parityCodec    fec.Codec      // Codec of the FEC groups sent and received (fec_codec)
 	cipher         *crypto.Cipher // Encryption cipher (nil if no key)
 	cipherGen      uint64
 	prevCipher     *crypto.Cipher
 	prevCipherGen  uint64
 	prevCipherExp  time.Time
+	rekeyBase      atomic.Uint64 // trafficTotal when the key was last rotated
 	cipherMux      sync.RWMutex
 	configMux      sync.RWMutex
-	conn           faketcp.ConnAdapter          // Used in client mode (interface for both modes)
-	listener       faketcp.ListenerAdapter      // Used in server mode (interface for both modes)
-	clients        map[string]*ClientConnection // Used in server mode (key: IP address)
+	conn           faketcp.ConnAdapter // Used in client mode (interface for both modes)
+	serverSendMTU  int32               // Inner MTU toward the server (client mode, atomic; 0 until connected)
+	pathMTU        int32               // Probed path MTU below config.MTU (client mode, atomic; 0 = not limited)
+	pushedMTU      int32               // MTU pushed by the server (client mode, atomic; 0 = none)
+	keepaliveSecs  int32               // Keepalive interval pushed by the server (client mode, atomic; 0 = config)
+	mtuSel         mtuSelection        // Where the tunnel MTU came from, reported by MTUStatus
+	mtuSelMux      sync.Mutex
+	peerVersion    atomic.Value                   // Version announced by the server (client mode, string)
+	sessionID      atomic.Value                   // Session ID announced by the server (client mode, string)
+	renewing       int32                          // Set while moving to a new connection at the server's request (atomic)
+	altServers     atomic.Value                   // Live alternative servers reported by the server (client mode, []api.ServerHealth)
+	serverSilent   atomic.Bool                    // The server stopped answering; failover tries the alternatives first
+	mtuProbeAcks   chan mtuProbeAck               // Probe acknowledgements from netReader to mtuProbeLoop
+	mtuProbing     atomic.Bool                    // mtuProbeLoop is running
+	fragmentID     uint32                         // Last tunnel fragment ID sent (atomic)
+	fragments      *fragmentReassembler           // Reassembles oversized packets from the server (client mode)
+	oversizeWarned uint32                         // Set once the oversized-packet warning was logged
+	shardChecksum  uint32                         // Server verifies shard checksums (negotiated, client mode, atomic)
+	listener       faketcp.ListenerAdapter        // Used in server mode (interface for both modes)
+	peerConn       faketcp.ConnAdapter            // Connection accepted while resolving the peer-mode role (served once the server starts)
+	outerRemote    atomic.Pointer[netip.AddrPort] // Server endpoint of the tunnel connection (client mode)
+	outerPort      uint16                         // Port clients connect to (server mode)
+	clients        map[string]*ClientConnection   // Used in server mode (key: IP address)
 	clientsMux     sync.RWMutex
 	allClients     map[*ClientConnection]struct{} // Tracks all active clients (including those without registered tunnel IP)
 	allClientsMux  sync.RWMutex
 	tunName        string
 	tunFile        *TunDevice
 	stopCh         chan struct{}
-	stopOnce       sync.Once // Ensures Stop() is only executed once
+	stopOnce       sync.Once     // Ensures Stop() is only executed once
+	forceCh        chan struct{} // Closed by ForceClose to cut a Close drain short
+	forceOnce      sync.Once
 	wg             sync.WaitGroup
 	sendQueue      chan []byte // Used in client mode
 	recvQueue      chan []byte // Used in client mode
 
 	packetPool    *sync.Pool
+	packetFree    chan []byte // Bounded free list replacing packetPool when packet_pool_size is set
 	packetBufSize int
 
 	xdpAccel *xdp.Accelerator
+	fecDiag  *fecDiagRing // Unrecoverable FEC groups (nil = diagnostics disabled)
+
+	// Per-flow bypass (client mode)
+	bypassRules      []bypassRule
+	bypassClassifier *xdp.Accelerator
+	bypassIPT        *iptables.IPTablesManager
+	bypassRoutes     []string
+	bypassPolicy     bool
+	dns              *dnsManager // System DNS configuration (client mode)
+	dnsMux           sync.Mutex
+	sysctlOrig       map[string]int // Kernel settings changed by fix_sysctl, with their previous values
+	sysctlMux        sync.Mutex
+
+	auditLog *audit.Logger // Session audit log (server mode, nil if disabled)
+	quota    *quotaTracker // Per-client traffic quota (server mode, nil if disabled)
+
+	mirror    *mirror.Mirror  // Copies selected sessions' traffic to an IDS (nil if mirror_target is unset)
+	mirrorSel *mirrorSelector // Sessions to mirror (mirror_sessions)
+
+	accounting *accounting.Checkpointer // Usage reports for billing (nil if accounting_sink is unset)
+	usageMarks map[*ClientConnection]usageMark
+	usageSince time.Time     // When accounting started
+	usageStop  chan struct{} // Stops the accounting loop
+	usageMux   sync.Mutex
+
+	icmp      *faketcp.ICMPListener // ICMP errors about the fake TCP flows (raw mode, nil if unavailable)
+	icmpStats icmpStats
+
+	adminServer  *http.Server                // Admin API (nil if admin_listen is unset)
+	healthServer *http.Server                // Liveness and readiness endpoints (nil if health_listen is unset)
+	gossip       *gossipState                // Liveness exchange with other servers (nil if gossip_listen is unset)
+	natReflector *nat.Reflector              // Answers -nat-report probes (nil if nat_reflector is unset)
+	gossipMux    sync.Mutex
+	impair       atomic.Pointer[impairState] // Faults injected into sent packets (nil = none)
+	stages       recvStages                  // Receive path stage timing (PUT /profile)
+	frameTrace   frameTracer                 // Frame tracing at log level trace (PUT /loglevel)
+	frameHistory frameHistory                // First frames of the connections (first_frames, see support.go)
+	serverFrames atomic.Pointer[serverFrames] // Frames noted on the current connection to the server
+
+	// Response to the server's drop reports (client mode; per client on servers)
+	congestionPolicy congestionPolicy
+	congestion       congestionState
+	dropReport       dropReporter
+	parityOverride   int32 // Parity shards per full FEC group set by PUT /conn (0 = fec_parity, atomic)
+	clock            clockSync // Measured server clock (client mode)
+
+	limiter *ratelimit.Limiter // Cap on the traffic sent (nil unless rate_limit_mbps is set)
+
+	portHop *portHopper // Port hopping schedule (nil unless port_hop_range is set)
+
+	kcpSession *kcpSession // KCP conversation of the current connection (client mode, reliability kcp)
+	kcpMux     sync.Mutex
+
+	// Hitless upgrade (server mode)
+	upgradeListener *net.UnixListener // Accepts the successor process (nil if upgrade_socket is unset)
+	takeover        *takeoverState    // State received from the predecessor, resumed by startServer
+	handedOff       chan struct{}     // Closed once a successor took over the sessions
+	broker          *broker.Server    // Serves local programs sharing the tunnel (nil unless broker_socket is set)
+	started         time.Time         // When Start was called, for the reported uptime
+	transforms      []*namedTransform // Frame transforms added before Start (AddTransform)
+	unauth          *unauthTracker    // Drops before authentication (server mode)
+	mgmt            *firewallGuard    // Management bypass and confirmation of the firewall rules (server mode)
+	sockBuf         *socketBuffers    // Sizes of the socket buffers (see sockbuf.go)
+	idleNotify      idleNotifier      // Reports idle/active transitions (client mode)
 
 	// P2P and routing
 	p2pManager     *p2p.Manager          // P2P connection manager
@@ -268,6 +421,9 @@ type Tunnel struct {
 	lastRecvTime time.Time  // Last time we received ANY packet from server
 	lastRecvMux  sync.Mutex // Protects lastRecvTime
 
+	// UnixNano of the last completed handshake, client or server (0 = none yet)
+	lastHandshake atomic.Int64
+
 	routeMux         sync.RWMutex
 	advertisedRoutes []clientRoute
 	clientRoutes     map[*ClientConnection][]string
@@ -282,35 +438,77 @@ type Tunnel struct {
 	// Note: fecRecvSessions and fecReorderBufs are now thread-local in each fecIngressWorker
 
 	// Stats counters (atomic)
-	statFECShardsRecv       uint64
-	statFECSessionsRecovered uint64
-	statFECSessionsUnrecoverable uint64
-	statFECPacketsRecovered uint64
-	statFECLateBatchDrop    uint64
-	statFECGapSkip          uint64
-	statQueueDropSend       uint64
-	statQueueDropRecv       uint64
-	statQueueDropClientSend uint64
-	statQueueDropRouteSend  uint64
-	statQueueDropForward    uint64
-	statOversizedDrop       uint64
-	statFragmentsGenerated  uint64
+	statBytesIn                  atomic.Uint64 // Tunnel payload bytes written to TUN (client mode; server adds clients as they leave)
+	statBytesOut                 atomic.Uint64 // Tunnel payload bytes read from TUN (client mode; server adds clients as they leave)
+	statPacketsIn                atomic.Uint64 // Packets counted in statBytesIn
+	statPacketsOut               atomic.Uint64 // Packets counted in statBytesOut
+	statTUNWriteErrors           atomic.Uint64
+	statSendErrors               atomic.Uint64  // Failed writes of data to the network connection
+	srtt                         atomic.Int64   // Smoothed keepalive RTT to the server in nanoseconds (client mode)
+	sendPath                     pathProbe      // Keepalive probes to the server, for dead-path detection (client mode)
+	aggLimit                     aggregateLimit // Size of the aggregates sent to the server, following the send MTU (client mode)
+	control                      *controlLane   // Keepalives, echoes and reports, sent ahead of data (client mode)
+	statFECShardsRecv            atomic.Uint64
+	statFECSessionsRecovered     atomic.Uint64
+	statFECSessionsUnrecoverable atomic.Uint64
+	statFECPacketsRecovered      atomic.Uint64
+	statFECLateBatchDrop         atomic.Uint64
+	statFECGapSkip               atomic.Uint64
+	reorderDelay                 atomic.Int64 // Smoothed time gaps in FEC groups take to fill, drives the auto reorder hold (ns)
+	statFECShardCorrupt          atomic.Uint64
+	statPrioritySent             atomic.Uint64
+	statQUIC                     atomic.Uint64
+	heldPackets                  atomic.Int64 // Packets taken from a send queue into FEC groups not sent yet
+	statQueueDropSend            atomic.Uint64
+	statQueueDropRecv            atomic.Uint64
+	statQueueDropClientSend      atomic.Uint64
+	statQueueDropRouteSend       atomic.Uint64
+	statQueueDropForward         atomic.Uint64
+	statOversizedDrop            atomic.Uint64
+	statFragmentsGenerated       atomic.Uint64
+	statFragmentsReassembled     atomic.Uint64
+	statFragmentsExpired         atomic.Uint64
+	statBypassLeak               atomic.Uint64
+	statSelfEncap                atomic.Uint64
+	statKeepaliveSuppressed      atomic.Uint64
+	statDeadPath                 atomic.Uint64 // Connections abandoned because the peer stopped receiving
+	statControlDrop              atomic.Uint64 // Control packets dropped on a full control lane
+	statPanics                   atomic.Uint64 // Panics recovered in tunnel goroutines
+	statResumes                  atomic.Uint64 // Resumes from sleep noticed (client mode)
+	statTransformDrop            atomic.Uint64 // Frames dropped by a transform
+	selfEncapLogged              atomic.Int64  // Last self-encapsulation error (unix ns)
+	statImpairDrop               atomic.Uint64
+	statImpairDup                atomic.Uint64
+	statImpairCorrupt            atomic.Uint64
+	statImpairReorder            atomic.Uint64
+	statImpairDelay              atomic.Uint64
+	statDropReportsSent          atomic.Uint64
+	statPeerDrops                atomic.Uint64 // Receive drops reported by peers
+	statShed                     atomic.Uint64 // Low-priority packets dropped while a peer was congested
 
 	// Authentication state (for encrypt_after_auth mode)
 	authenticated    bool              // Whether client is authenticated (client mode)
 	authMux          sync.RWMutex      // Protects authenticated flag
 	authResponseChan chan error        // Channel for receiving auth response (client mode)
+	authNonce        string            // Nonce of the in-flight auth request (PKI mode, client)
+	disconnectErr    error             // Terminal disconnect received from the server (client mode), or a data loop that kept panicking
+	disconnectMux    sync.Mutex        // Protects disconnectErr
+
+	// Certificate authentication (nil unless ca_cert is configured)
+	pkiIdentity *pki.Identity
+	pkiVerifier *pki.Verifier
+	authReplay  *pki.ReplayCache // Nonces of accepted client handshakes (server mode)
 
 	// Work queue for parallel FEC processing (Send side)
 	fecWorkQueue chan *fecBatchWork
 	
-	// Work queue for parallel Decryption (Receive side)
-	fecDecryptionQueue chan [][]byte
-
-	// Work queue for parallel FEC Ingress/Reconstruction (Receive side)
+	// Work queue for parallel FEC Ingress/Reconstruction and decryption (Receive side)
 	// Decouples socket reading from heavy RS reconstruction math
-	// Sharded by (SessionID % SendWorkers) to ensure session affinity and avoid lock contention
+	// Sharded by (SessionID % fec_workers) to ensure session affinity and avoid lock contention
 	fecIngressQueues []chan *fecIngressWork
+
+	// Restore the session order of the groups the ingress workers finish (see sequencer.go)
+	sequencers []*fecSequencer
 }
 
 type fecIngressWork struct {
@@ -350,72 +548,15 @@ func (t *Tunnel) getPacketBuffer() []byte {
 	if t.packetPool == nil || t.packetBufSize == 0 {
 		return make([]byte, t.config.MTU+packetBufferSlack)
 	}
-	return t.packetPool.Get().([]byte)
-}
-
-// fragmentIPv4Packet splits an IPv4 packet into MTU-sized fragments.
-// Returns fragments with updated headers and checksums.
-func fragmentIPv4Packet(packet []byte, mtu int) ([][]byte, error) {
-	if len(packet) < IPv4MinHeaderLen {
-		return nil, errors.New("packet too small for IPv4")
-	}
-	if packet[0]>>4 != IPv4Version {
-		return nil, errors.New("not IPv4 packet")
-	}
-	ihl := int(packet[0]&0x0F) * 4
-	if ihl < IPv4MinHeaderLen || ihl > len(packet) {
-		return nil, errors.New("invalid IPv4 header length")
-	}
-	if mtu <= ihl+8 {
-		return nil, errors.New("MTU too small for fragmentation")
-	}
-
-	payload := packet[ihl:]
-	maxPayload := mtu - ihl
-	maxPayload &= ^7 // must be multiple of 8
-	if maxPayload <= 0 {
-		return nil, errors.New("invalid fragment payload size")
-	}
-
-	flagsOffset := binary.BigEndian.Uint16(packet[6:8])
-	reserved := flagsOffset & 0x8000
-	ident := packet[4:6]
-
-	var fragments [][]byte
-	for offset := 0; offset < len(payload); offset += maxPayload {
-		end := offset + maxPayload
-		if end > len(payload) {
-			end = len(payload)
-		}
-		fragPayload := payload[offset:end]
-
-		frag := make([]byte, ihl+len(fragPayload))
-		copy(frag[:ihl], packet[:ihl])
-		copy(frag[ihl:], fragPayload)
-
-		// Total length
-		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
-		// Identification
-		copy(frag[4:6], ident)
-
-		// Flags + Fragment offset
-		offsetUnits := uint16(offset / 8)
-		flagBits := reserved
-		if end < len(payload) {
-			flagBits |= 0x2000 // MF
+	if t.packetFree != nil {
+		select {
+		case buf := <-t.packetFree:
+			return buf
+		default:
+			return make([]byte, t.packetBufSize)
 		}
-		binary.BigEndian.PutUint16(frag[6:8], flagBits|offsetUnits)
-
-		// Clear checksum and recalc
-		frag[10] = 0
-		frag[11] = 0
-		checksum := rawsocket.CalculateChecksum(frag[:ihl])
-		binary.BigEndian.PutUint16(frag[10:12], checksum)
-
-		fragments = append(fragments, frag)
 	}
-
-	return fragments, nil
+	return t.packetPool.Get().([]byte)
 }
 
 // releasePacketBuffer returns a buffer to the pool when it matches the
@@ -424,9 +565,17 @@ func (t *Tunnel) releasePacketBuffer(buf []byte) {
 	if t.packetPool == nil || t.packetBufSize == 0 {
 		return
 	}
-	if cap(buf) >= t.packetBufSize {
-		t.packetPool.Put(buf[:t.packetBufSize])
+	if cap(buf) < t.packetBufSize {
+		return
 	}
+	if t.packetFree != nil {
+		select {
+		case t.packetFree <- buf[:t.packetBufSize]:
+		default: // Full: left to the garbage collector
+		}
+		return
+	}
+	t.packetPool.Put(buf[:t.packetBufSize])
 }
 
 // isUDPPacket reports whether the inner packet is IPv4 UDP.
@@ -442,7 +591,7 @@ func isUDPPacket(packet []byte) bool {
 
 func (t *Tunnel) logStatsLoop() {
 	t.wg.Add(1)
-	go func() {
+	t.goLoop(policyManagement, "stats loop", func() {
 		defer t.wg.Done()
 		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
@@ -451,24 +600,45 @@ func (t *Tunnel) logStatsLoop() {
 			case <-t.stopCh:
 				return
 			case <-ticker.C:
-				log.Printf("Stats: fec_shards=%d fec_recovered_sessions=%d fec_unrecoverable=%d fec_packets_recovered=%d fec_late_drop=%d fec_gap_skip=%d drops_send=%d drops_recv=%d drops_client_send=%d drops_route=%d drops_forward=%d oversized_drop=%d fragments=%d",
-					atomic.LoadUint64(&t.statFECShardsRecv),
-					atomic.LoadUint64(&t.statFECSessionsRecovered),
-					atomic.LoadUint64(&t.statFECSessionsUnrecoverable),
-					atomic.LoadUint64(&t.statFECPacketsRecovered),
-					atomic.LoadUint64(&t.statFECLateBatchDrop),
-					atomic.LoadUint64(&t.statFECGapSkip),
-					atomic.LoadUint64(&t.statQueueDropSend),
-					atomic.LoadUint64(&t.statQueueDropRecv),
-					atomic.LoadUint64(&t.statQueueDropClientSend),
-					atomic.LoadUint64(&t.statQueueDropRouteSend),
-					atomic.LoadUint64(&t.statQueueDropForward),
-					atomic.LoadUint64(&t.statOversizedDrop),
-					atomic.LoadUint64(&t.statFragmentsGenerated),
+				mtu, mtuSource := t.MTUStatus()
+				log.Printf("%sStats: fec_shards=%d fec_recovered_sessions=%d fec_unrecoverable=%d fec_packets_recovered=%d fec_late_drop=%d fec_gap_skip=%d fec_shard_corrupt=%d priority=%d quic=%d dup_sent=%d dup_dropped=%d drops_send=%d drops_recv=%d drops_client_send=%d drops_route=%d drops_forward=%d peer_drops=%d shed=%d oversized_drop=%d fragments=%d reassembled=%d reassembly_expired=%d bypass_leak=%d self_encap=%d keepalive_suppressed=%d dead_path=%d control_drop=%d panics=%d hibernating=%d malformed=%d sockbuf_overflow=%d mtu=%d mtu_source=%q",
+					t.tunnelPrefix(),
+					t.statFECShardsRecv.Load(),
+					t.statFECSessionsRecovered.Load(),
+					t.statFECSessionsUnrecoverable.Load(),
+					t.statFECPacketsRecovered.Load(),
+					t.statFECLateBatchDrop.Load(),
+					t.statFECGapSkip.Load(),
+					t.statFECShardCorrupt.Load(),
+					t.statPrioritySent.Load(),
+					t.statQUIC.Load(),
+					faketcp.Duplicates().Sent,
+					faketcp.Duplicates().Dropped,
+					t.statQueueDropSend.Load(),
+					t.statQueueDropRecv.Load(),
+					t.statQueueDropClientSend.Load(),
+					t.statQueueDropRouteSend.Load(),
+					t.statQueueDropForward.Load(),
+					t.statPeerDrops.Load(),
+					t.statShed.Load(),
+					t.statOversizedDrop.Load(),
+					t.statFragmentsGenerated.Load(),
+					t.statFragmentsReassembled.Load(),
+					t.statFragmentsExpired.Load(),
+					t.statBypassLeak.Load(),
+					t.statSelfEncap.Load(),
+					t.statKeepaliveSuppressed.Load(),
+					t.statDeadPath.Load(),
+					t.statControlDrop.Load(),
+					t.statPanics.Load(),
+					t.hibernatingSessions(),
+					faketcp.Malformed().Total(),
+					t.socketBufferOverflows(),
+					mtu, mtuSource,
 				)
 			}
 		}
-	}()
+	})
 }
 
 // nextFECSessionID generates a unique FEC session ID in a thread-safe manner.
@@ -476,20 +646,55 @@ func (t *Tunnel) nextFECSessionID() uint32 {
 	return atomic.AddUint32(&t.fecSessionID, 1)
 }
 
-// enqueueFECDecryption enqueues a packet batch to the FEC decryption queue with timeout handling
-func (t *Tunnel) enqueueFECDecryption(batch [][]byte) bool {
-	timer := time.NewTimer(QueueSendTimeout)
-	defer timer.Stop()
-	
-	select {
-	case t.fecDecryptionQueue <- batch:
-		return true
-	case <-timer.C:
-		atomic.AddUint64(&t.statQueueDropRecv, 1)
-		return false
-	case <-t.stopCh:
-		return false
+// configureFakeTCP applies the settings of the forged TCP segments shared by
+// every connection of the process
+func configureFakeTCP(cfg *config.Config) error {
+	// Raw sockets and their firewall rules may live in another network
+	// namespace, e.g. the host's when running in a container
+	if cfg.NetNS != "" {
+		path := netns.Path(cfg.NetNS)
+		if err := netns.Check(path); err != nil {
+			return err
+		}
+		faketcp.SetNetNS(path)
+		log.Printf("✅ Raw sockets and firewall rules in network namespace %s", path)
+	} else if cfg.Mode == "client" {
+		checkContainerNAT(cfg.RemoteAddr)
 	}
+
+	personality, err := faketcp.LookupPersonality(cfg.TCPPersonality)
+	if err != nil {
+		return err
+	}
+	faketcp.SetPersonality(personality)
+	if personality != faketcp.PersonalityDefault {
+		log.Printf("⚙️  TCP 指纹: %s (TTL %d, 窗口 %d)", personality.Name, personality.TTL, personality.SynWindow)
+	}
+
+	faketcp.SetTrace(faketcp.Trace{Seconds: cfg.TraceSeconds, Payload: cfg.TracePayload})
+	if err := faketcp.SetIPOptions(cfg.IPOptions); err != nil {
+		return err
+	}
+	if err := faketcp.SetIPIDStrategy(cfg.IPID); err != nil {
+		return err
+	}
+	faketcp.SetStrictValidation(cfg.StrictValidation)
+	faketcp.SetECN(cfg.ECN)
+	dscp, err := rawsocket.ParseDSCP(cfg.DSCP)
+	if err != nil {
+		return err
+	}
+	ecn, err := rawsocket.ParseECN(cfg.ECNCodepoint)
+	if err != nil {
+		return err
+	}
+	faketcp.SetMarking(rawsocket.Marking{TTL: uint8(cfg.TTL), DSCP: dscp, ECN: ecn})
+	faketcp.SetHandshakeCookies(cfg.HandshakeCookies)
+	faketcp.SetDuplicate(faketcp.Duplicate{
+		Copies:  cfg.Duplicate,
+		Spacing: time.Duration(cfg.DuplicateSpacingUs) * time.Microsecond,
+	})
+	return nil
 }
 
 // NewTunnel creates a new tunnel instance
@@ -498,6 +703,19 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 	cfg.Transport = "rawtcp"
 	faketcp.SetMode(faketcp.ModeRaw)
 
+	// mtu_cache predates the general state cache and names the same file
+	cfg.StateCacheFile = cmp.Or(cfg.StateCacheFile, cfg.MTUCacheFile)
+
+	// Name missing capabilities and devices before the calls that need them
+	// fail with a bare EPERM
+	if err := checkCapabilities(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := configureFakeTCP(cfg); err != nil {
+		return nil, err
+	}
+
 	// Check if raw socket is supported (requires root)
 	if err := faketcp.CheckRawSocketSupport(); err != nil {
 		return nil, fmt.Errorf("Raw Socket模式需要root权限运行\n"+
@@ -511,29 +729,53 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 	// Apply FakeTCP pacing to reduce burst loss in raw socket mode
 	pacingUs := cfg.FakeTCPWritePacingUs
 	maxSegment := cfg.FakeTCPMaxSegment
-	if maxSegment <= 0 && cfg.FECDataShards > 0 && cfg.FECParityShards > 0 {
+	if maxSegment <= 0 && isFECEnabled(cfg) {
 		maxSegment = 1200
 		log.Printf("⚙️  限制 FakeTCP 分段大小: %dB (FEC 模式自动开启，可通过 faketcp_max_segment 覆盖)", maxSegment)
 	} else if maxSegment > 0 {
 		log.Printf("⚙️  限制 FakeTCP 分段大小: %dB", maxSegment)
 	}
-	if pacingUs <= 0 && cfg.FECDataShards > 0 && cfg.FECParityShards > 0 {
+	if pacingUs <= 0 && isFECEnabled(cfg) {
 		pacingUs = 200
 		log.Printf("⚙️  启用 FakeTCP 发送节流: %dµs (FEC 模式自动开启，可通过 faketcp_pacing_us 覆盖)", pacingUs)
 	} else if pacingUs > 0 {
 		log.Printf("⚙️  启用 FakeTCP 发送节流: %dµs", pacingUs)
 	}
-	if pacingUs > 0 || maxSegment > 0 {
+	if cfg.RecvMTU > 0 {
+		log.Printf("⚙️  通告接收 MTU: %d (对端将据此限制发往本端的分段大小)", cfg.RecvMTU)
+	}
+	if pacingUs > 0 || maxSegment > 0 || cfg.RecvMTU > 0 {
 		faketcp.SetTuning(faketcp.Tuning{
 			WritePacingMinDelay: time.Duration(pacingUs) * time.Microsecond,
 			MaxSegmentSize:      maxSegment,
+			RecvMTU:             cfg.RecvMTU,
 		})
 	}
 
+	if cfg.Mode == "server" && cfg.LBWorkers > 1 {
+		faketcp.SetLoadBalance(faketcp.LoadBalance{WorkerID: cfg.LBWorkerID, Workers: cfg.LBWorkers})
+		log.Printf("✅ Load balancing enabled: worker %d of %d sharing %s", cfg.LBWorkerID, cfg.LBWorkers, cfg.LocalAddr)
+	}
+
+	if cfg.Mode == "server" && len(cfg.AFXDPInterfaces) > 0 {
+		faketcp.SetAFXDPInterfaces(cfg.AFXDPInterfaces)
+	}
+
+	if cfg.Mode == "server" && cfg.PacketRing != "" {
+		ifname := cfg.PacketRing
+		if ifname == "any" {
+			ifname = ""
+		}
+		faketcp.SetPacketRing(ifname)
+		log.Printf("✅ Receiving through an AF_PACKET ring on %s", cfg.PacketRing)
+	}
+
 	log.Printf("✅ 使用 Raw Socket 模式 (真正的TCP伪装，类似udp2raw)")
 	log.Printf("✅ 性能优化：低延迟，高吞吐量")
 
 	// Auto-detect MTU if not specified or set to 0
+	discoverPathMTU := false
+	mtuSel := mtuSelection{source: MTUSourceConfig}
 	if cfg.MTU == 0 {
 		log.Println("🔍 MTU未指定，启动自动检测...")
 
@@ -544,19 +786,13 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		// Get recommended MTU for network type
 		recommendedMTU := GetRecommendedMTU(networkType)
 		cfg.MTU = recommendedMTU
+		mtuSel.source = MTUSourceProfile
 
 		log.Printf("✅ 自动设置MTU为: %d", cfg.MTU)
 
 		// If in client mode and remote address is available, do path MTU discovery
-		if cfg.Mode == "client" && cfg.RemoteAddr != "" {
-			discovery := NewMTUDiscovery(cfg.RemoteAddr, cfg.MTU)
-			if optimalMTU, err := discovery.DiscoverOptimalMTU(); err == nil {
-				cfg.MTU = optimalMTU
-				log.Printf("✅ 通过路径MTU探测优化为: %d", cfg.MTU)
-			} else {
-				log.Printf("⚠️  路径MTU探测失败: %v，使用推荐值 %d", err, cfg.MTU)
-			}
-		}
+		// (after the overhead adjustments below)
+		discoverPathMTU = cfg.Mode == "client" && cfg.RemoteAddr != ""
 	} else {
 		log.Printf("使用配置的MTU: %d", cfg.MTU)
 	}
@@ -592,25 +828,20 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		// Therefore: MTU + 1 + overhead <= 1400
 		// MTU <= 1400 - 1 - overhead
 		if cfg.Transport == "rawtcp" {
-			const maxRawTCPSegment = 1400
 			const packetTypeOverhead = 1
 			encryptionOverhead := cipher.Overhead()
-			maxSafeMTU := maxRawTCPSegment - packetTypeOverhead - encryptionOverhead
-
-			if cfg.MTU > maxSafeMTU {
-				log.Printf("⚠️  Adjusting MTU from %d to %d to prevent TCP segmentation of encrypted packets", cfg.MTU, maxSafeMTU)
-				cfg.MTU = maxSafeMTU
-			}
+			maxSafeMTU := defaultRawTCPSegment - packetTypeOverhead - encryptionOverhead
+			mtuSel.clamp(&cfg.MTU, maxSafeMTU, "encrypted packet segment limit")
 		}
 	}
 
 	// Additional MTU adjustment for cross-packet FEC: ensure each shard fits within raw TCP segments
-	if cfg.Transport == "rawtcp" && cfg.FECDataShards > 0 && cfg.FECParityShards > 0 {
+	if cfg.Transport == "rawtcp" && isFECEnabled(cfg) {
 		maxRawTCPSegment := maxSegment
 		if maxRawTCPSegment <= 0 {
-			maxRawTCPSegment = 1400
+			maxRawTCPSegment = defaultRawTCPSegment
 		}
-		const fecHeaderOverhead = 1 + 4 + 2 + 2 + 2 + 2 // PacketType + sessionID + shardIndex + dataShards + parityShards + shardSize
+		const fecHeaderOverhead = fecShardHeaderLen + fecChecksumLen // Shard header + optional CRC-32C
 		const packetTypeOverhead = 1
 		const lengthPrefixOverhead = 2
 
@@ -631,22 +862,65 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 			return nil, fmt.Errorf("FEC configuration too small for raw TCP segmentation")
 		}
 
-		if cfg.MTU > maxSafeMTU {
-			log.Printf("⚠️  Adjusting MTU from %d to %d to prevent FEC shard segmentation", cfg.MTU, maxSafeMTU)
-			cfg.MTU = maxSafeMTU
+		mtuSel.clamp(&cfg.MTU, maxSafeMTU, "FEC shard segment limit")
+	}
+
+	// cfg.MTU stays the ceiling; a smaller cached or discovered path MTU is
+	// applied to the TUN device and raised again by background probing once
+	// the path allows it
+	var pathMTU int
+	if discoverPathMTU {
+		if cached, ok := loadCachedMTU(cfg.StateCacheFile, cfg.RemoteAddr); ok {
+			mtuSel.source = MTUSourceCache
+			if cached < cfg.MTU {
+				pathMTU = cached
+			}
+			log.Printf("✅ 使用缓存的路径MTU: %d (上限 %d)", cached, cfg.MTU)
+		} else {
+			discovery := NewMTUDiscovery(cfg.RemoteAddr, cfg.MTU)
+			if optimalMTU, err := discovery.DiscoverOptimalMTU(); err != nil {
+				log.Printf("⚠️  路径MTU探测失败: %v，使用推荐值 %d", err, cfg.MTU)
+			} else {
+				mtuSel.source = MTUSourceDiscovered
+				if optimalMTU < cfg.MTU {
+					pathMTU = optimalMTU
+					log.Printf("✅ 通过路径MTU探测优化为: %d (上限 %d)", pathMTU, cfg.MTU)
+				}
+				storeCachedMTU(cfg.StateCacheFile, cfg.RemoteAddr, min(optimalMTU, cfg.MTU))
+			}
 		}
 	}
+	log.Printf("Tunnel MTU: %d (%s)", cmp.Or(pathMTU, cfg.MTU), mtuSel)
+
+	pkiIdentity, pkiVerifier, err := loadPKI(cfg.CACertFile, cfg.CertFile, cfg.CertKeyFile, cfg.CRLFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificates: %v", err)
+	}
+	if pkiVerifier != nil {
+		log.Printf("✅ Certificate authentication enabled (identity: %s)", pki.Identify(pkiIdentity.Certificate()))
+	} else if pkiIdentity != nil {
+		log.Printf("Server key fingerprint: %s (clients can pin it with -server-fingerprint)", pki.Fingerprint(pkiIdentity.Certificate()))
+	}
 
 	// Create FEC encoder/decoder AFTER MTU adjustment
 	// This ensures FEC shard size accounts for encryption overhead
+	parityCodec, err := fec.ParseCodec(cfg.FECCodec)
+	if err != nil {
+		return nil, err
+	}
 	var fecCodec *fec.FEC
 	if isFECEnabled(cfg) {
-		fecCodec, err = fec.NewFEC(cfg.FECDataShards, cfg.FECParityShards, cfg.MTU/cfg.FECDataShards)
+		fecCodec, err = fec.NewFECWithCodec(parityCodec, cfg.FECDataShards, cfg.FECParityShards, cfg.MTU/cfg.FECDataShards)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create FEC: %v", err)
 		}
 	}
 
+	limiter, err := newRateLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	packetBufSize := cfg.MTU + packetBufferSlack
 	if packetBufSize < packetBufferSlack {
 		packetBufSize = packetBufferSlack
@@ -660,6 +934,13 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		log.Println("XDP fast path disabled, using regular path")
 	}
 
+	if cfg.FECMaxDataShards <= 0 {
+		cfg.FECMaxDataShards = 32
+	}
+	if cfg.FECMaxParityShards <= 0 {
+		cfg.FECMaxParityShards = 16
+	}
+
 	// Ensure at least one worker is running even if config is missing or 0
 	if cfg.SendWorkers <= 0 {
 		cfg.SendWorkers = 4
@@ -685,8 +966,11 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		config:             cfg,
 		configFilePath:     configFilePath,
 		fec:                fecCodec,
+		parityCodec:        parityCodec,
 		cipher:             cipher,
 		stopCh:             make(chan struct{}),
+		forceCh:            make(chan struct{}),
+		handedOff:          make(chan struct{}),
 		myTunnelIP:         myIP,
 		packetBufSize:      packetBufSize,
 		clientRoutes:       make(map[*ClientConnection][]string),
@@ -696,8 +980,18 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		fecEnabled:         isFECEnabled(cfg),
 		fecSessionID:       uint32(time.Now().UnixNano()),
 		fecWorkQueue:       make(chan *fecBatchWork, cfg.SendQueueSize), // Reuse send queue size for work queue
-		fecDecryptionQueue: make(chan [][]byte, cfg.RecvQueueSize*2),    // Sized for receive bursts (parallel decrypt)
-	}
+		pathMTU:            int32(pathMTU),
+		mtuSel:             mtuSel,
+		mtuProbeAcks:       make(chan mtuProbeAck, 1),
+		fragments:          newFragmentReassembler(),
+		fecDiag:            newFECDiagRing(cfg.FECDiagnostics),
+		pkiIdentity:        pkiIdentity,
+		pkiVerifier:        pkiVerifier,
+		authReplay:         pki.NewReplayCache(),
+		congestionPolicy:   parseCongestionPolicy(cfg.CongestionResponse),
+		limiter:            limiter,
+	}
+	t.control = newControlLane(&t.statControlDrop, limiter)
 
 	// Initialize sharded ingress queues
 	// Queue size should be reasonable to avoid excessive memory usage
@@ -716,24 +1010,31 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 	if ingressQueueSize > 8192 {
 		ingressQueueSize = 8192 // Maximum 8K per worker to prevent accumulation
 	}
-	if ingressQueueSize < 2048 {
+	if ingressQueueSize < 2048 && cfg.Profile != config.ProfileSmall {
 		ingressQueueSize = 2048 // Minimum 2K per worker
 	}
-	t.fecIngressQueues = make([]chan *fecIngressWork, cfg.SendWorkers)
-	for i := 0; i < cfg.SendWorkers; i++ {
+	t.fecIngressQueues = make([]chan *fecIngressWork, t.fecWorkers())
+	for i := range t.fecIngressQueues {
 		t.fecIngressQueues[i] = make(chan *fecIngressWork, ingressQueueSize)
 	}
+	t.sequencers = newFECSequencers(len(t.fecIngressQueues), cfg.RecvQueueSize)
 
 	t.packetPool = &sync.Pool{
 		New: func() any {
 			return make([]byte, packetBufSize)
 		},
 	}
+	if cfg.PacketPoolSize > 0 {
+		t.packetFree = make(chan []byte, cfg.PacketPoolSize)
+	}
 	
 	// Log FEC status
 	if t.fecEnabled {
 		log.Printf("✅ FEC纠错已启用: %d数据分片 + %d校验分片 (可容忍%d个分片丢失)",
 			cfg.FECDataShards, cfg.FECParityShards, cfg.FECParityShards)
+	} else if t.kcpEnabled() {
+		log.Printf("✅ KCP可靠传输已启用 (FEC关闭): nodelay=%d interval=%dms resend=%d nc=%v",
+			cfg.KCPNoDelay, cfg.KCPInterval, cfg.KCPResend, cfg.KCPNoCongestion)
 	} else {
 		log.Println("⚠️  FEC纠错未启用 (fec_data或fec_parity为0)")
 	}
@@ -741,6 +1042,38 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 	if cipher != nil {
 		t.cipherGen = 1
 	}
+	if cfg.LogLevel == LogLevelTrace {
+		t.frameTrace.enabled.Store(true)
+		log.Printf("Log level trace: logging every tunnel frame (at most %d lines/s)", traceLinesPerSecond)
+	}
+
+	if cfg.AuditLog != "" && cfg.Mode == "server" {
+		auditLog, err := audit.NewLogger(cfg.AuditLog, cfg.AuditLogMaxSizeMB, cfg.AuditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		t.auditLog = auditLog
+		log.Printf("✅ Session audit log enabled: %s", cfg.AuditLog)
+	}
+
+	if cfg.ClientQuotaMB > 0 && cfg.Mode == "server" {
+		t.quota = newQuotaTracker(cfg.ClientQuotaMB, cfg.ClientQuotaPeriod)
+	}
+
+	if cfg.PortHopRange != "" {
+		portHop, err := newPortHopper(cfg.PortHopRange, cfg.PortHopInterval, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		t.portHop = portHop
+		log.Printf("✅ Port hopping over %s every %v", cfg.PortHopRange, portHop.interval)
+	}
+
+	if cfg.MirrorTarget != "" && cfg.Mode == "server" {
+		if err := t.startMirror(); err != nil {
+			return nil, err
+		}
+	}
 
 	// Initialize P2P manager if enabled
 	if cfg.P2PEnabled && cfg.Mode == "client" {
@@ -751,12 +1084,23 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		t.routingTable = routing.NewRoutingTable(cfg.MaxHops)
 	}
 
-	if cfg.Mode == "client" {
+	// Peer mode settles on a role in Start, so it prepares for both
+	if cfg.Mode == "client" || cfg.Mode == "peer" {
 		t.sendQueue = make(chan []byte, cfg.SendQueueSize)
 		t.recvQueue = make(chan []byte, cfg.RecvQueueSize)
-		// Initialize auth response channel for encrypt_after_auth mode
+		t.bypassRules, err = parseBypassRules(cfg.Bypass)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.bypassRules) > 0 {
+			t.bypassClassifier = xdp.NewAccelerator(true)
+		}
+		if _, err := parseDNSServers(cfg.DNSServers); err != nil {
+			return nil, err
+		}
+		// Initialize auth response channel for encrypt_after_auth or PKI mode
 		// Only initialize if a key is provided, since authentication requires encryption
-		if cfg.EncryptAfterAuth && cfg.Key != "" {
+		if t.authHandshakeRequired() && cfg.Key != "" {
 			t.authResponseChan = make(chan error, 1)
 		}
 		// Register server as a peer in the routing table so stats show the
@@ -764,7 +1108,14 @@ func NewTunnel(cfg *config.Config, configFilePath string) (*Tunnel, error) {
 		if t.routingTable != nil {
 			t.registerServerPeer()
 		}
-	} else {
+	}
+	if cfg.Mode != "client" {
+		if err := validateClientPush(cfg); err != nil {
+			return nil, err
+		}
+		if t.mgmt, err = newFirewallGuard(cfg); err != nil {
+			return nil, err
+		}
 		// Server mode: multi-client support
 		t.clients = make(map[string]*ClientConnection)
 		// Server also needs routing table for mesh routing
@@ -803,29 +1154,61 @@ func parseTunnelIP(tunnelAddr string) (net.IP, error) {
 
 // Start starts the tunnel
 func (t *Tunnel) Start() error {
-	// Create TUN device
-	tunDev, err := t.createTUNWithFallback()
-	if err != nil {
-		return fmt.Errorf("failed to create TUN device: %v", err)
-	}
-	t.tunFile = tunDev
-	t.tunName = tunDev.Name()
+	t.started = time.Now()
+	if t.config.Takeover {
+		// The predecessor's TUN device is configured already
+		if err := t.takeOver(); err != nil {
+			return fmt.Errorf("failed to take over from running instance: %v", err)
+		}
+	} else {
+		// Create TUN device
+		tunDev, err := t.createTUNWithFallback()
+		if err != nil {
+			return fmt.Errorf("failed to create TUN device: %v", err)
+		}
+		t.tunFile = tunDev
+		t.tunName = tunDev.Name()
 
-	log.Printf("Created TUN device: %s", t.tunName)
+		log.Printf("Created TUN device: %s", t.tunName)
 
-	// Configure TUN device
-	if err := t.configureTUN(); err != nil {
-		t.tunFile.Close()
-		return fmt.Errorf("failed to configure TUN: %v", err)
+		// Configure TUN device
+		if err := t.configureTUN(); err != nil {
+			t.tunFile.Close()
+			return fmt.Errorf("failed to configure TUN: %v", err)
+		}
 	}
 
+	t.checkSysctls()
+
 	// Note: FEC cleanup is now handled by each fecIngressWorker locally
 	// Start stats logger
 	t.logStatsLoop()
+	t.socketBufferLoop()
 
-	// Start decryption worker
-	t.wg.Add(1)
-	go t.fecDecryptionWorker()
+	if t.config.AdminListen != "" {
+		if err := t.startAdmin(); err != nil {
+			t.tunFile.Close()
+			return fmt.Errorf("failed to start admin API: %v", err)
+		}
+	}
+	if t.config.HealthListen != "" {
+		if err := t.startHealth(); err != nil {
+			t.stopAdmin()
+			t.tunFile.Close()
+			return fmt.Errorf("failed to start health endpoints: %v", err)
+		}
+	}
+	t.startICMP()
+
+	// Start the sequencers the FEC ingress workers deliver through
+	t.startSequencers()
+
+	if t.config.Mode == "peer" {
+		if err := t.resolvePeerRole(); err != nil {
+			t.tunFile.Close()
+			return fmt.Errorf("failed to reach peer: %v", err)
+		}
+	}
 
 	// Establish connection based on mode
 	if t.config.Mode == "client" {
@@ -833,17 +1216,27 @@ func (t *Tunnel) Start() error {
 			t.tunFile.Close()
 			return fmt.Errorf("failed to connect as client: %v", err)
 		}
+		if err := t.installBypass(); err != nil {
+			log.Printf("⚠️  Failed to install bypass rules, matching traffic stays in the tunnel: %v", err)
+		}
+		if err := t.installDNS(); err != nil {
+			log.Printf("⚠️  Failed to configure system DNS, resolver settings left unchanged: %v", err)
+		}
 
 		netReaderStarted := false
-		if t.config.EncryptAfterAuth && t.cipher != nil {
+		if t.authHandshakeRequired() && t.cipher != nil {
 			t.wg.Add(1)
-			go t.netReader()
+			t.goLoop(policyData, "network reader", t.netReader)
 			netReaderStarted = true
 			if err := t.performClientAuthentication(); err != nil {
 				t.Stop()
 				return fmt.Errorf("failed to authenticate: %v", err)
 			}
-			log.Printf("✅ Authentication successful - data packets will not be encrypted")
+			if t.config.EncryptAfterAuth {
+				log.Printf("✅ Authentication successful - data packets will not be encrypted")
+			} else {
+				log.Printf("✅ Authentication successful")
+			}
 		}
 
 		// Start P2P manager if enabled
@@ -862,76 +1255,86 @@ func (t *Tunnel) Start() error {
 
 			// Start route update goroutine
 			t.wg.Add(1)
-			go t.routeUpdateLoop()
+			t.goLoop(policyManagement, "route update loop", t.routeUpdateLoop)
 		}
 
 		// Start client mode packet processing
 		if netReaderStarted {
-			// +1 main netWriter + 4 groups of workers (Send, FEC Send, FEC Ingress, Decrypt) + default ones
-			t.wg.Add(3 + t.config.SendWorkers*4) 
-			go t.tunReader()
-			
-			// Parallelize TUN writes
-			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.tunWriter()
-			}
+			// TUN reader + main netWriter + TUN writers, FEC Ingress workers and FEC Send workers
+			t.wg.Add(2 + t.tunWriters() + len(t.fecIngressQueues) + t.config.SendWorkers)
+			t.goLoop(policyData, "TUN reader", t.tunReader)
 			
-			// Parallelize Decryption workers
-			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.fecDecryptionWorker()
+			// TUN writes (one keeps the order the sequencers restored)
+			for i := 0; i < t.tunWriters(); i++ {
+				t.goLoop(policyData, "TUN writer", t.tunWriter)
 			}
 			
-			// Parallelize FEC Ingress workers (Reconstruction)
+			// Parallelize FEC Ingress workers (Reconstruction and decryption)
 			// This is CRITICAL: Moves math out of the socket read loop
 			// We use sharded queues to maintain session affinity
-			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.fecIngressWorker(t.fecIngressQueues[i]) // Pass the specific queue
+			for i := range t.fecIngressQueues {
+				t.goLoop(policyData, "FEC ingress worker", func() { t.fecIngressWorker(t.fecIngressQueues[i]) }) // Pass the specific queue
 			}
 
-			go t.netWriter() 
+			t.goLoop(policyData, "network writer", t.netWriter) 
 			
 			// Start multiple FEC Send workers
 			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.fecWorker()
+				t.goLoop(policyData, "FEC worker", t.fecWorker)
 			}
 		} else {
-			// TunWrites + FEC workers
-			t.wg.Add(4 + t.config.SendWorkers*4)
-			go t.tunReader()
+			// TUN reader + network reader and writer + TunWrites + FEC workers
+			t.wg.Add(3 + t.tunWriters() + len(t.fecIngressQueues) + t.config.SendWorkers)
+			t.goLoop(policyData, "TUN reader", t.tunReader)
 			
-			// Parallelize TUN writes
-			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.tunWriter()
+			// TUN writes (one keeps the order the sequencers restored)
+			for i := 0; i < t.tunWriters(); i++ {
+				t.goLoop(policyData, "TUN writer", t.tunWriter)
 			}
 
-			// Parallelize Decryption workers
-			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.fecDecryptionWorker()
-			}
-			
 			// Parallelize FEC Ingress workers
-			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.fecIngressWorker(t.fecIngressQueues[i]) // Pass the specific queue
+			for i := range t.fecIngressQueues {
+				t.goLoop(policyData, "FEC ingress worker", func() { t.fecIngressWorker(t.fecIngressQueues[i]) }) // Pass the specific queue
 			}
 
-			go t.netReader()
-			go t.netWriter() // Reverted to single netWriter (dispatcher)
+			t.goLoop(policyData, "network reader", t.netReader)
+			t.goLoop(policyData, "network writer", t.netWriter) // Reverted to single netWriter (dispatcher)
 			
 			// Start multiple FEC processing workers
 			for i := 0; i < t.config.SendWorkers; i++ {
-				go t.fecWorker()
+				t.goLoop(policyData, "FEC worker", t.fecWorker)
 			}
 		}
 
 		// Start keepalive
-		t.wg.Add(1)
-		go t.keepalive()
+		t.wg.Add(2)
+		t.goLoop(policyData, "keepalive", t.keepalive)
+		t.goLoop(policyData, "control writer", t.controlWriter)
+
+		// Recover a path MTU lowered at startup once the path allows it
+		if atomic.LoadInt32(&t.pathMTU) > 0 {
+			t.startMTUProbing()
+		}
 
 		// Periodically announce routes to server
 		if len(t.getAdvertisedRoutes()) > 0 {
 			t.wg.Add(1)
-			go t.routeAdvertLoop()
+			t.goLoop(policyManagement, "route advertisement loop", t.routeAdvertLoop)
+		}
+
+		if t.config.ServerFailover {
+			t.wg.Add(1)
+			t.goLoop(policyManagement, "server list loop", t.serverListLoop)
 		}
+
+		if t.portHop != nil {
+			t.wg.Add(1)
+			t.goLoop(policyManagement, "port hop loop", t.portHopClientLoop)
+		}
+
+		// Probe the server as soon as the machine wakes up
+		t.wg.Add(1)
+		t.goLoop(policyManagement, "resume watch", t.resumeWatchLoop)
 	} else {
 		// Server mode: start accepting clients
 		if err := t.startServer(); err != nil {
@@ -939,10 +1342,39 @@ func (t *Tunnel) Start() error {
 			return fmt.Errorf("failed to start as server: %v", err)
 		}
 
+		if t.portHop != nil {
+			t.wg.Add(1)
+			t.goLoop(policyManagement, "port hop loop", t.portHopServerLoop)
+		}
+
+		if t.config.GossipListen != "" {
+			if err := t.startGossip(); err != nil {
+				t.Stop()
+				return fmt.Errorf("failed to start server gossip: %v", err)
+			}
+		}
+
+		if t.config.NATReflector != "" {
+			reflector, err := nat.NewReflector(t.config.NATReflector)
+			if err != nil {
+				t.Stop()
+				return fmt.Errorf("failed to start NAT reflector: %v", err)
+			}
+			t.natReflector = reflector
+			log.Printf("Answering NAT behavior probes on UDP %s and the next port", reflector.Addr())
+		}
+
 		// Enable periodic config/key push if configured
 		if t.config.ConfigPushInterval > 0 && t.cipher != nil {
 			t.wg.Add(1)
-			go t.configPushLoop()
+			t.goLoop(policyManagement, "config push loop", t.configPushLoop)
+		}
+	}
+
+	if t.config.BrokerSocket != "" {
+		if err := t.startBroker(); err != nil {
+			t.Stop()
+			return fmt.Errorf("failed to start broker: %v", err)
 		}
 	}
 
@@ -970,6 +1402,7 @@ func (t *Tunnel) Stop() {
 				log.Printf("Error closing listener: %v", err)
 			}
 		}
+		t.closeHopListeners()
 
 		// Close single connection (client mode) - this will unblock Read/Write
 		if t.conn != nil {
@@ -978,9 +1411,18 @@ func (t *Tunnel) Stop() {
 			}
 		}
 
-		// Close all client connections and signal client goroutines (server mode)
-		t.clientsMux.Lock()
+		// Close all client connections and signal client goroutines (server mode).
+		// The notices are sent outside the lock: a slow write must not hold up
+		// the session goroutines that look clients up while they wind down.
+		t.clientsMux.RLock()
+		clients := make([]*ClientConnection, 0, len(t.clients))
 		for _, client := range t.clients {
+			clients = append(clients, client)
+		}
+		t.clientsMux.RUnlock()
+		for _, client := range clients {
+			t.sendDisconnect(client, DisconnectServerShutdown, "")
+			client.setDisconnectReason(DisconnectServerShutdown.String())
 			// Use stopOnce to safely close both connection and channel
 			client.stopOnce.Do(func() {
 				// Close connection first
@@ -991,11 +1433,11 @@ func (t *Tunnel) Stop() {
 				close(client.stopCh)
 			})
 		}
-		t.clientsMux.Unlock()
 
 		// Also close any clients that haven't been registered with a tunnel IP yet
 		t.allClientsMux.RLock()
 		for client := range t.allClients {
+			client.setDisconnectReason(DisconnectServerShutdown.String())
 			client.stopOnce.Do(func() {
 				if err := client.conn.Close(); err != nil {
 					log.Printf("Error closing client connection: %v", err)
@@ -1010,6 +1452,21 @@ func (t *Tunnel) Stop() {
 			t.p2pManager.Stop()
 		}
 
+		t.removeBypass()
+		t.removeDNS()
+		t.restoreSysctls()
+		t.stopAdmin()
+		t.stopHealth()
+		t.stopICMP()
+		t.stopGossip()
+		if t.natReflector != nil {
+			t.natReflector.Close()
+		}
+		t.stopUpgradeSocket()
+		t.stopBroker()
+		t.stopUnauth()
+		t.stopFirewallGuard()
+
 		// Now wait for all goroutines to finish
 		// Now wait for all goroutines to finish, but avoid indefinite hang by
 		// using a timeout. This prevents Stop() from blocking forever if some
@@ -1025,6 +1482,14 @@ func (t *Tunnel) Stop() {
 		case <-time.After(5 * time.Second):
 			log.Println("Timeout waiting for tunnel goroutines to stop; continuing shutdown")
 		}
+
+		t.stopAccounting(true)
+		if err := t.auditLog.Close(); err != nil {
+			log.Printf("Error closing audit log: %v", err)
+		}
+		if t.mirror != nil {
+			t.mirror.Close()
+		}
 	})
 }
 
@@ -1047,20 +1512,21 @@ func (t *Tunnel) addClient(client *ClientConnection, ip net.IP) {
 
 	ipStr := ip.String()
 	if existing, ok := t.clients[ipStr]; ok {
-		log.Printf("Warning: IP conflict detected for %s, closing old connection", ipStr)
-		existing.stopOnce.Do(func() {
-			// Close connection first to unblock I/O
-			if err := existing.conn.Close(); err != nil {
-				log.Printf("Error closing conflicting connection: %v", err)
-			}
-			// Then signal goroutines to stop
-			close(existing.stopCh)
-		})
+		client.logf("Warning: IP conflict detected for %s, closing old connection", ipStr)
+		t.disconnectClient(existing, DisconnectReplaced, "")
 	}
 
 	client.clientIP = ip
 	t.clients[ipStr] = client
-	log.Printf("Client registered with IP: %s (total clients: %d)", ipStr, len(t.clients))
+	client.logf("Client registered with IP: %s (total clients: %d)", ipStr, len(t.clients))
+
+	// With several workers sharing the tunnel subnet, steer this client's return
+	// traffic to our TUN device with a host route
+	if faketcp.GetLoadBalance().Enabled() {
+		if err := t.addRoute(ipStr + "/32"); err != nil {
+			client.logf("⚠️  Failed to add host route for %s: %v", ipStr, err)
+		}
+	}
 }
 
 // removeClient removes a client from the routing table
@@ -1075,9 +1541,12 @@ func (t *Tunnel) removeClient(client *ClientConnection) {
 		// Prevents race where a new client with the same IP has already replaced this one
 		if currentClient, exists := t.clients[ipStr]; exists && currentClient == client {
 			delete(t.clients, ipStr)
-			log.Printf("Client unregistered: %s (remaining clients: %d)", ipStr, len(t.clients))
+			client.logf("Client unregistered: %s (remaining clients: %d)", ipStr, len(t.clients))
+			if faketcp.GetLoadBalance().Enabled() {
+				t.deleteRoute(ipStr + "/32")
+			}
 		} else if exists {
-			log.Printf("Client %s no longer owns IP %s, skipping removal (already replaced)", client.conn.RemoteAddr(), ipStr)
+			client.logf("Client %s no longer owns IP %s, skipping removal (already replaced)", client.conn.RemoteAddr(), ipStr)
 		}
 	}
 	t.clientsMux.Unlock()
@@ -1086,7 +1555,7 @@ func (t *Tunnel) removeClient(client *ClientConnection) {
 		// Remove from routing table if mesh routing enabled (outside of lock)
 		if t.routingTable != nil {
 			t.routingTable.RemovePeer(clientIP)
-			log.Printf("Removed peer %s from routing table", clientIP)
+			client.logf("Removed peer %s from routing table", clientIP)
 		}
 
 		// Clean advertised routes
@@ -1197,7 +1666,7 @@ func (t *Tunnel) configureTUN() error {
 	}
 
 	// Set MTU
-	cmd = exec.Command("ip", "link", "set", "dev", t.tunName, "mtu", fmt.Sprintf("%d", t.config.MTU))
+	cmd = exec.Command("ip", "link", "set", "dev", t.tunName, "mtu", fmt.Sprintf("%d", t.tunMTU()))
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to set MTU: %v, output: %s", err, output)
 	}
@@ -1209,12 +1678,15 @@ func (t *Tunnel) configureTUN() error {
 		log.Printf("Disabled offloads on %s (gro/gso/tso off)", t.tunName)
 	}
 
-	log.Printf("Configured %s with IP %s/%s, MTU %d", t.tunName, ip, netmask, t.config.MTU)
+	log.Printf("Configured %s with IP %s/%s, MTU %d", t.tunName, ip, netmask, t.tunMTU())
 	return nil
 }
 
 // connectClient connects to server as client
 func (t *Tunnel) connectClient() error {
+	if t.conn != nil {
+		return nil // Already connected while resolving the peer-mode role
+	}
 	log.Printf("Connecting to server at %s...", t.config.RemoteAddr)
 
 	timeout := time.Duration(t.config.Timeout) * time.Second
@@ -1222,12 +1694,15 @@ func (t *Tunnel) connectClient() error {
 	mode := faketcp.GetMode()
 	log.Printf("Using %s for firewall bypass", faketcp.ModeString(mode))
 
-	conn, err := faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+	conn, err := t.dialRemote(timeout, mode)
 	if err != nil {
 		return err
 	}
 
-	t.conn = conn
+	t.conn = t.impairConn(conn)
+	t.setClientSendMTU(conn)
+	t.setOuterEndpoint(conn)
+	t.noteHandshake(false)
 	log.Printf("Connected to server: %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
 
 	return nil
@@ -1237,6 +1712,11 @@ func (t *Tunnel) connectClient() error {
 type AuthenticationRequest struct {
 	Timestamp int64  `json:"timestamp"` // Unix timestamp for replay attack prevention
 	TunnelIP  string `json:"tunnel_ip"` // Client's tunnel IP address
+
+	// PKI mode only, but for the nonce that is also sent when pinning the server key
+	Nonce       string `json:"nonce,omitempty"`       // Random nonce echoed in the server's signature
+	Certificate []byte `json:"certificate,omitempty"` // DER client certificate
+	Signature   []byte `json:"signature,omitempty"`   // Client signature proving key possession
 }
 
 // performClientAuthentication performs the authentication handshake with server
@@ -1256,9 +1736,18 @@ func (t *Tunnel) performClientAuthentication() error {
 		
 		// Create authentication request
 		authReq := AuthenticationRequest{
-			Timestamp: time.Now().Unix(),
+			Timestamp: t.peerNow().Unix(), // Server clock, as far as it was measured
 			TunnelIP:  t.myTunnelIP.String(),
 		}
+		if t.pkiEnabled() {
+			if err := t.signAuthRequest(&authReq); err != nil {
+				return err
+			}
+		} else if t.pinsServerKey() {
+			if err := t.challengeServerKey(&authReq); err != nil {
+				return err
+			}
+		}
 		
 		// Marshal to JSON
 		authData, err := json.Marshal(authReq)
@@ -1284,6 +1773,12 @@ func (t *Tunnel) performClientAuthentication() error {
 			return fmt.Errorf("failed to encrypt auth packet: %v", err)
 		}
 		
+		// Drop an answer left over from an earlier attempt or session
+		select {
+		case <-t.authResponseChan:
+		default:
+		}
+		
 		// Send authentication packet
 		if err := t.conn.WritePacket(encryptedAuth); err != nil {
 			lastErr = fmt.Errorf("failed to send auth packet: %v", err)
@@ -1299,6 +1794,11 @@ func (t *Tunnel) performClientAuthentication() error {
 		
 		select {
 		case err := <-t.authResponseChan:
+			var derr *DisconnectError
+			if errors.As(err, &derr) {
+				// The server ended the connection: retrying on it is pointless
+				return derr
+			}
 			if err != nil {
 				lastErr = err
 				errMsg := err.Error()
@@ -1306,8 +1806,14 @@ func (t *Tunnel) performClientAuthentication() error {
 				// Check if it's a permanent error (key mismatch) vs transient error
 				// Permanent errors: INVALID response, decryption errors, wrong key
 				// These indicate a configuration problem that won't be fixed by retrying
-				if strings.Contains(errMsg, "INVALID") || 
-				   strings.Contains(errMsg, "wrong key") ||
+				if strings.Contains(errMsg, "CERT_") {
+					return fmt.Errorf("authentication failed: %v - please check the configured certificates", err)
+				}
+				if strings.Contains(errMsg, "INVALID") {
+					// The server decrypted the request, so the key is right
+					return fmt.Errorf("authentication failed: %v - the server could not parse the request; check the tunnel IP and that both sides run compatible versions", err)
+				}
+				if strings.Contains(errMsg, "wrong key") ||
 				   strings.Contains(errMsg, "decryption") ||
 				   strings.Contains(errMsg, "cipher") {
 					return fmt.Errorf("authentication failed: incorrect encryption key - please verify both client and server use the same key")
@@ -1319,9 +1825,11 @@ func (t *Tunnel) performClientAuthentication() error {
 			t.authMux.Lock()
 			t.authenticated = true
 			t.authMux.Unlock()
+			t.noteHandshake(true)
 			return nil
 		case <-time.After(AuthenticationTimeout):
-			lastErr = fmt.Errorf("authentication timeout after %v - no response from server", AuthenticationTimeout)
+			// A server that cannot decrypt the request cannot answer it either
+			lastErr = fmt.Errorf("authentication timeout after %v - no response from server (is the key the same on both sides?)", AuthenticationTimeout)
 			log.Printf("⚠️  %v", lastErr)
 			continue
 		}
@@ -1364,9 +1872,12 @@ func (t *Tunnel) reconnectToServer() error {
 
 		log.Printf("Attempting to reconnect to server at %s (backoff %ds)", t.config.RemoteAddr, backoff)
 		mode := faketcp.GetMode()
-		conn, err := faketcp.DialWithMode(t.config.RemoteAddr, timeout, mode)
+		conn, err := t.dialServer(timeout, mode)
 		if err == nil {
-			t.conn = conn
+			t.conn = t.impairConn(conn)
+			t.setClientSendMTU(conn)
+			t.setOuterEndpoint(conn)
+			t.noteHandshake(false)
 			log.Printf("Reconnected to server: %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
 			return nil
 		}
@@ -1389,27 +1900,73 @@ func (t *Tunnel) startServer() error {
 	mode := faketcp.GetMode()
 	log.Printf("Using %s for firewall bypass", faketcp.ModeString(mode))
 
-	listener, err := faketcp.ListenWithMode(t.config.LocalAddr, mode)
-	if err != nil {
+	if err := t.installManagementBypass(); err != nil {
 		return err
 	}
 
-	// Store listener for later cleanup
-	t.listener = listener
+	// Peer mode already listens
+	listener := t.listener
+	if listener == nil {
+		var err error
+		if f := activatedSocket(); f != nil {
+			log.Printf("Using the socket passed by socket activation")
+			listener, err = faketcp.ListenFileWithMode(t.config.LocalAddr, mode, f)
+		} else {
+			listener, err = faketcp.ListenWithMode(t.config.LocalAddr, mode)
+		}
+		if err != nil {
+			return err
+		}
+		// Store listener for later cleanup
+		t.listener = listener
+	}
+	t.setOuterPort(listener)
+	t.startUnauth(listener)
 
 	// Start TUN reader for server mode
 	t.wg.Add(1)
-	go t.tunReaderServer()
+	t.goLoop(policyData, "TUN reader", t.tunReaderServer)
 
 	// Start accepting clients in a goroutine
 	t.wg.Add(1)
-	go t.acceptClients(listener)
+	t.goLoop(policyData, "accept loop", func() { t.acceptClients(listener) })
+	if t.peerConn != nil {
+		go t.handleClient(t.peerConn)
+	}
+	if t.takeover != nil {
+		if err := t.resumeSessions(); err != nil {
+			return err
+		}
+	}
+	if t.config.AccountingSink != "" {
+		if err := t.startAccounting(); err != nil {
+			return fmt.Errorf("failed to start usage accounting: %v", err)
+		}
+	}
+	if t.config.UpgradeSocket != "" {
+		if err := t.listenUpgradeSocket(); err != nil {
+			log.Printf("⚠️  Hitless upgrades unavailable: %v", err)
+		}
+	}
+
+	if t.pkiEnabled() {
+		t.wg.Add(1)
+		t.goLoop(policyManagement, "revocation check loop", t.revocationCheckLoop)
+	}
+	if t.quota != nil {
+		t.wg.Add(1)
+		go t.quotaLoop()
+	}
+	if t.config.MaxSessionDuration > 0 || t.config.RekeyAfterMB > 0 {
+		t.wg.Add(1)
+		t.goLoop(policyManagement, "session policy loop", t.sessionPolicyLoop)
+	}
 	
 	// Server Mode: Start FEC Ingress processing workers
 	// These handle high-speed FEC reconstruction for ALL clients
-	for i := 0; i < t.config.SendWorkers; i++ {
+	for i := range t.fecIngressQueues {
 		t.wg.Add(1)
-		go t.fecIngressWorker(t.fecIngressQueues[i]) // Pass the specific queue
+		t.goLoop(policyData, "FEC ingress worker", func() { t.fecIngressWorker(t.fecIngressQueues[i]) }) // Pass the specific queue
 	}
 
 	if t.config.MultiClient {
@@ -1418,6 +1975,7 @@ func (t *Tunnel) startServer() error {
 			log.Println("Client isolation enabled - clients cannot communicate with each other")
 		}
 	}
+	t.startFirewallConfirm()
 
 	return nil
 }
@@ -1439,7 +1997,10 @@ func (t *Tunnel) acceptClients(listener faketcp.ListenerAdapter) {
 			case <-t.stopCh:
 				// Tunnel is stopping, no need to log
 			default:
-				log.Printf("Accept error: %v", err)
+				// A hop listener closed after its interval is not an error
+				if listener == t.listener || t.hopListenerActive(listener) {
+					log.Printf("Accept error: %v", err)
+				}
 			}
 			return
 		}
@@ -1451,13 +2012,13 @@ func (t *Tunnel) acceptClients(listener faketcp.ListenerAdapter) {
 
 		if !t.config.MultiClient && clientCount >= 1 {
 			log.Printf("Single-client mode: rejecting connection from %s", conn.RemoteAddr())
-			conn.Close()
+			t.rejectConnection(conn, DisconnectServerFull, "server accepts a single client")
 			continue
 		}
 
 		if clientCount >= t.config.MaxClients {
 			log.Printf("Max clients reached (%d), rejecting connection from %s", t.config.MaxClients, conn.RemoteAddr())
-			conn.Close()
+			t.rejectConnection(conn, DisconnectServerFull, fmt.Sprintf("max_clients %d reached", t.config.MaxClients))
 			continue
 		}
 
@@ -1468,38 +2029,125 @@ func (t *Tunnel) acceptClients(listener faketcp.ListenerAdapter) {
 
 // handleClient handles a single client connection
 func (t *Tunnel) handleClient(conn faketcp.ConnAdapter) {
-	log.Printf("Client connected: %s", conn.RemoteAddr())
-
-	client := &ClientConnection{
-		conn:      conn,
-		sendQueue: make(chan []byte, t.config.SendQueueSize),
-		recvQueue: make(chan []byte, t.config.RecvQueueSize),
-		stopCh:    make(chan struct{}),
-	}
+	client := t.newClientConnection(conn)
+	client.logf("Client connected: %s", conn.RemoteAddr())
+	defer func() {
+		if r := recover(); r != nil {
+			// serveClient did not get to clean up
+			t.endSessionAfterPanic(client, "session handler", r)
+			t.removeClient(client)
+			t.untrackClientConnection(client)
+		}
+	}()
+	t.noteHandshake(false)
 
 	t.trackClientConnection(client)
+	t.auditLog.Log(audit.Record{
+		Event:      audit.EventConnect,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Session:    client.sessionID,
+	})
 
 	// Send client's public address for NAT traversal (if P2P enabled)
 	if t.config.P2PEnabled {
-		go t.sendPublicAddrToClient(client)
+		t.goSession(client, "public address announcement", func() { t.sendPublicAddrToClient(client) })
 	}
 
+	if t.pkiEnabled() {
+		t.goSession(client, "auth deadline", func() { t.enforceClientAuthDeadline(client) })
+	} else {
+		t.announceSession(client)
+	}
+
+	t.serveClient(client)
+}
+
+// announceSession sends a client the session settings it needs before data
+// flows: version, session ID, FEC offer, port hop secret and client_push.
+// PKI clients get them once authenticated (server mode).
+func (t *Tunnel) announceSession(client *ClientConnection) {
+	t.goSession(client, "version announcement", func() { t.announceVersion(client) })
+	t.goSession(client, "session ID announcement", func() { t.announceSessionID(client) })
+	t.goSession(client, "FEC offer", func() { t.offerFECParams(client) })
+	t.goSession(client, "port hop announcement", func() { t.announcePortHop(client) })
+	t.pushClientSettings(client)
+}
+
+// newClientConnection sets up the per-client state for conn (server mode)
+func (t *Tunnel) newClientConnection(conn faketcp.ConnAdapter) *ClientConnection {
+	conn = t.impairConn(conn)
+	return &ClientConnection{
+		conn:        conn,
+		sendQueue:   make(chan []byte, t.config.SendQueueSize),
+		control:     newControlLane(&t.statControlDrop, t.limiter),
+		stopCh:      make(chan struct{}),
+		connectedAt: time.Now(),
+		sendMTU:     int32(t.connSendMTU(conn)),
+		fragments:   newFragmentReassembler(),
+		fecSessionID: uint32(time.Now().UnixNano()),
+		sessionID:   newSessionID(),
+	}
+}
+
+// serveClient runs a tracked client's session until it disconnects (server mode)
+func (t *Tunnel) serveClient(client *ClientConnection) {
 	// Start client goroutines
-	client.wg.Add(3)
-	go t.clientNetReader(client)
-	go t.clientNetWriter(client)
-	go t.clientKeepalive(client)
+	client.wg.Add(4)
+	t.goSession(client, "client reader", func() { t.clientNetReader(client) })
+	t.goSession(client, "client writer", func() { t.clientNetWriter(client) })
+	t.goSession(client, "client keepalive", func() { t.clientKeepalive(client) })
+	t.goSession(client, "client control writer", func() { t.clientControlWriter(client) })
 
 	// Send server routes to client
-	go t.sendRoutesToClient(client)
+	t.goSession(client, "route announcement", func() { t.sendRoutesToClient(client) })
 
 	// Wait for client to disconnect
 	client.wg.Wait()
+	t.accountDisconnect(client)
 
 	t.untrackClientConnection(client)
+	t.chargeSession(client)
+	// Keep the server totals reported by Status monotonic
+	t.statBytesIn.Add(client.bytesIn.Load())
+	t.statBytesOut.Add(client.bytesOut.Load())
+	t.statPacketsIn.Add(client.packetsIn.Load())
+	t.statPacketsOut.Add(client.packetsOut.Load())
 	// Clean up client
 	t.removeClient(client)
-	log.Printf("Client disconnected: %s", conn.RemoteAddr())
+	t.auditDisconnect(client)
+	client.mu.RLock()
+	reason := client.disconnectReason
+	client.mu.RUnlock()
+	if traceDumpReasons[reason] {
+		t.dumpTrace(client.conn, reason)
+	}
+	client.logf("Client disconnected: %s", client.conn.RemoteAddr())
+}
+
+// auditDisconnect writes the end-of-session audit record for a client
+func (t *Tunnel) auditDisconnect(client *ClientConnection) {
+	if t.auditLog == nil {
+		return
+	}
+	client.mu.RLock()
+	rec := audit.Record{
+		Event:      audit.EventDisconnect,
+		RemoteAddr: client.conn.RemoteAddr().String(),
+		Identity:   client.identity,
+		BytesIn:    client.bytesIn.Load(),
+		BytesOut:   client.bytesOut.Load(),
+		Duration:   time.Since(client.connectedAt).Seconds(),
+		Reason:     client.disconnectReason,
+		Session:    client.sessionID,
+	}
+	client.mu.RUnlock()
+	if client.clientIP != nil {
+		rec.TunnelIP = client.clientIP.String()
+	}
+	if rec.Reason == "" {
+		rec.Reason = "connection closed"
+	}
+	t.auditLog.Log(rec)
 }
 
 // tunReader reads packets from TUN device and queues them for sending (client mode)
@@ -1545,37 +2193,39 @@ func (t *Tunnel) tunReader() {
 				continue
 			}
 
-			if n > t.config.MTU {
-				fragments, err := fragmentIPv4Packet(readBuf[:n], t.config.MTU)
+			if t.isSelfEncapsulated(readBuf[:n]) {
+				t.noteSelfEncap(readBuf[:n])
+				t.releasePacketBuffer(buf)
+				continue
+			}
+
+			if t.isBypassPacket(readBuf[:n]) {
+				t.noteBypassLeak(readBuf[:n])
+			}
+			t.statBytesOut.Add(uint64(n))
+			t.statPacketsOut.Add(1)
+
+			if sendMTU := t.clientSendMTU(); n > sendMTU {
+				t.noteOversized(n, sendMTU)
+				fragments, err := t.fragmentFor(readBuf[:n], sendMTU, t.ServerVersion() != "")
 				t.releasePacketBuffer(buf)
 				if err != nil {
-					atomic.AddUint64(&t.statOversizedDrop, 1)
+					t.statOversizedDrop.Add(1)
 					log.Printf("⚠️  Failed to fragment oversized packet (%d bytes): %v", n, err)
 					continue
 				}
-				atomic.AddUint64(&t.statFragmentsGenerated, uint64(len(fragments)))
+				t.statFragmentsGenerated.Add(uint64(len(fragments)))
 
+				// Fragments always go through the server, which reassembles and
+				// routes the packet; peers are addressed by inner IP only
 				for _, frag := range fragments {
-					fragCopy := make([]byte, len(frag))
-					copy(fragCopy, frag)
-					if t.config.P2PEnabled && t.routingTable != nil {
-						queued, err := t.sendPacketWithRouting(fragCopy)
-						if err != nil {
-							log.Printf("Failed to send fragment: %v", err)
-						}
-						if !queued {
-							// sendPacketWithRouting handled release if queued; nothing to release here
-						}
-					} else {
-						// CRITICAL FIX: Never block on send queue (affects both client and server TUN readers)
-						// Blocking can freeze the entire TUN reader loop
-						if !enqueueWithPolicy(t.sendQueue, fragCopy, t.stopCh, false) {
-							select {
-							case <-t.stopCh:
-								return
-							default:
-								log.Printf("Send queue full after timeout, dropping fragment")
-							}
+					if !enqueueWithPolicy(t.sendQueue, frag, t.stopCh, false) {
+						t.statQueueDropSend.Add(1)
+						select {
+						case <-t.stopCh:
+							return
+						default:
+							log.Printf("Send queue full after timeout, dropping fragment")
 						}
 					}
 				}
@@ -1597,7 +2247,7 @@ func (t *Tunnel) tunReader() {
 				// Default: queue for server
 				// CRITICAL FIX: Never block on send queue (affects TUN reader in both modes)
 				if !enqueueWithPolicy(t.sendQueue, packet, t.stopCh, false) {
-					atomic.AddUint64(&t.statQueueDropSend, 1)
+					t.statQueueDropSend.Add(1)
 					t.releasePacketBuffer(buf)
 					select {
 					case <-t.stopCh:
@@ -1645,42 +2295,12 @@ func (t *Tunnel) tunReaderServer() {
 			t.releasePacketBuffer(buf)
 			continue
 		}
+		t.mirrorRouted(readBuf[:n])
 
-		if n > t.config.MTU {
-			fragments, err := fragmentIPv4Packet(readBuf[:n], t.config.MTU)
+		if sendMTU := t.destSendMTU(readBuf[:n]); n > sendMTU {
+			t.noteOversized(n, sendMTU)
+			t.sendFragmentsToClient(readBuf[:n], sendMTU)
 			t.releasePacketBuffer(buf)
-			if err != nil {
-				atomic.AddUint64(&t.statOversizedDrop, 1)
-				log.Printf("⚠️  Failed to fragment oversized packet (%d bytes): %v", n, err)
-				continue
-			}
-			atomic.AddUint64(&t.statFragmentsGenerated, uint64(len(fragments)))
-
-			for _, frag := range fragments {
-				fragCopy := make([]byte, len(frag))
-				copy(fragCopy, frag)
-				if fragCopy[0]>>4 != IPv4Version {
-					continue
-				}
-				dstIP := net.IP(fragCopy[IPv4DstIPOffset : IPv4DstIPOffset+4])
-				client := t.getClientByIP(dstIP)
-				if client != nil {
-					// CRITICAL FIX: Never block indefinitely on fragment forwarding
-					queued := enqueueWithClientPolicy(client.sendQueue, fragCopy, t.stopCh, client.stopCh, false)
-					if !queued {
-						log.Printf("⚠️  Client send queue full for %s after timeout, dropping fragment", dstIP)
-					}
-					continue
-				}
-				if routeClient := t.findRouteClient(dstIP); routeClient != nil {
-					// CRITICAL FIX: Never block indefinitely on fragment forwarding
-					queued := enqueueWithClientPolicy(routeClient.sendQueue, fragCopy, t.stopCh, routeClient.stopCh, false)
-					if !queued {
-						log.Printf("⚠️  Route client queue full for %s after timeout, dropping fragment", dstIP)
-					}
-					continue
-				}
-			}
 			continue
 		}
 
@@ -1694,6 +2314,12 @@ func (t *Tunnel) tunReaderServer() {
 			continue
 		}
 
+		if t.isSelfEncapsulated(packet) {
+			t.noteSelfEncap(packet)
+			t.releasePacketBuffer(buf)
+			continue
+		}
+
 		dstIP := net.IP(packet[IPv4DstIPOffset : IPv4DstIPOffset+4])
 
 		// Check if packet is destined for server itself
@@ -1729,7 +2355,7 @@ func (t *Tunnel) tunReaderServer() {
 			// when a single client's queue was full. Always use non-blocking mode.
 			queued := enqueueWithClientPolicy(client.sendQueue, packet, t.stopCh, client.stopCh, false)
 			if !queued {
-				atomic.AddUint64(&t.statQueueDropClientSend, 1)
+				t.statQueueDropClientSend.Add(1)
 				log.Printf("⚠️  Client send queue full for %s after timeout, dropping packet", dstIP)
 				t.releasePacketBuffer(buf)
 			}
@@ -1739,7 +2365,7 @@ func (t *Tunnel) tunReaderServer() {
 				// CRITICAL FIX: Never block indefinitely on route client queue
 				queued := enqueueWithClientPolicy(routeClient.sendQueue, packet, t.stopCh, routeClient.stopCh, false)
 				if !queued {
-					atomic.AddUint64(&t.statQueueDropRouteSend, 1)
+					t.statQueueDropRouteSend.Add(1)
 					log.Printf("⚠️  Route client queue full for %s after timeout, dropping packet", dstIP)
 					t.releasePacketBuffer(buf)
 				}
@@ -1763,7 +2389,7 @@ func (t *Tunnel) tunWriter() {
 		case packet := <-t.recvQueue:
 			// CRITICAL FIX: Don't exit on single TUN write error
 			// Continue processing to avoid losing all buffered packets
-			if _, err := t.tunFile.Write(packet); err != nil {
+			if _, err := t.writeTUN(packet); err != nil {
 				select {
 				case <-t.stopCh:
 					// Tunnel is stopping, exit cleanly
@@ -1784,6 +2410,8 @@ func (t *Tunnel) tunWriter() {
 			} else {
 				// Reset error counter on successful write
 				consecutiveErrors = 0
+				t.statBytesIn.Add(uint64(len(packet)))
+				t.statPacketsIn.Add(1)
 			}
 		}
 	}
@@ -1823,8 +2451,10 @@ func (t *Tunnel) netReader() {
 				timeSinceLastRecv, IdleConnectionTimeout)
 
 			// Close and clear current connection
+			t.serverSilent.Store(true)
 			t.connMux.Lock()
 			if t.conn != nil {
+				t.dumpTrace(t.conn, "idle timeout")
 				_ = t.conn.Close()
 				t.conn = nil
 			}
@@ -1859,12 +2489,16 @@ func (t *Tunnel) netReader() {
 			t.lastRecvMux.Unlock()
 		}
 
-		packet, err := t.conn.ReadPacket()
+		conn := t.conn
+		packet, err := conn.ReadPacket()
 		if err != nil {
 			// Check if it's a timeout - if so, continue to allow checking stopCh and idle timeout
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
+			if t.connReplaced(conn) {
+				continue
+			}
 
 			select {
 			case <-t.stopCh:
@@ -1877,6 +2511,7 @@ func (t *Tunnel) netReader() {
 			// Close and clear current connection, then attempt reconnect
 			t.connMux.Lock()
 			if t.conn != nil {
+				t.dumpTrace(t.conn, "read error")
 				_ = t.conn.Close()
 				t.conn = nil
 			}
@@ -1888,8 +2523,8 @@ func (t *Tunnel) netReader() {
 				return
 			}
 			
-			// Re-authenticate if in encrypt_after_auth mode
-			if t.config.EncryptAfterAuth && t.cipher != nil {
+			// Re-authenticate if in encrypt_after_auth or PKI mode
+			if t.authHandshakeRequired() && t.cipher != nil {
 				t.authMux.Lock()
 				t.authenticated = false
 				t.authMux.Unlock()
@@ -1930,10 +2565,22 @@ func (t *Tunnel) netReader() {
 		t.lastRecvMux.Lock()
 		t.lastRecvTime = time.Now()
 		t.lastRecvMux.Unlock()
+		echoECN(t.conn, t.control, t.encryptPacket)
+		t.reportDrops(t.control, &t.dropReport, t.statQueueDropRecv.Load(), t.encryptPacket)
+		parseStart := t.stages.start()
+
+		// Corrupted shards are dropped so FEC recovers them as losses
+		if packet[0] == PacketTypeFECShardChecked {
+			var ok bool
+			if packet, ok = t.verifyShard(packet); !ok {
+				continue
+			}
+		}
 
 		// Check if this is an FEC shard (before decryption)
 		// FEC shards are NOT encrypted themselves - they contain pieces of encrypted data
 		if len(packet) > 0 && packet[0] == PacketTypeFECShard {
+			t.traceFrame(false, nil, packet)
 			if t.fecEnabled {
 				// Offload to worker pool
 				// Dispatch based on SessionID to ensure affinity
@@ -1943,7 +2590,7 @@ func (t *Tunnel) netReader() {
 				if len(packet) >= 5 {
 					// Use SessionID for affinity
 					sessionID := uint32(packet[1])<<24 | uint32(packet[2])<<16 | uint32(packet[3])<<8 | uint32(packet[4])
-					workerID := sessionID % uint32(t.config.SendWorkers)
+					workerID := sessionID % uint32(len(t.fecIngressQueues))
 					targetQueue = t.fecIngressQueues[workerID]
 				} else {
 					// Too short to be valid, but if we must dispatch, pick 0
@@ -1956,11 +2603,13 @@ func (t *Tunnel) netReader() {
 					packet:     packet[1:],
 				}:
 				default:
-					atomic.AddUint64(&t.statQueueDropRecv, 1)
+					t.statQueueDropRecv.Add(1)
 				}
 			}
+			t.stages.done(stageParse, parseStart)
 			continue
 		}
+		t.stages.done(stageParse, parseStart)
 
 		// Decrypt if cipher is available (for non-FEC packets)
 		decryptedPacket, err := t.decryptPacket(packet)
@@ -1968,6 +2617,7 @@ func (t *Tunnel) netReader() {
 			log.Printf("Decryption error (wrong key?): %v", err)
 			continue
 		}
+		t.traceFrame(false, nil, decryptedPacket)
 
 		if len(decryptedPacket) < 1 {
 			continue
@@ -1983,7 +2633,7 @@ func (t *Tunnel) netReader() {
 			// ROOT CAUSE: block=t.fecEnabled caused indefinite waiting when queue full
 			// Result: UDP test took 30s instead of 10s due to backlog accumulation
 			if !enqueueWithPolicy(t.recvQueue, payload, t.stopCh, false) {
-				atomic.AddUint64(&t.statQueueDropRecv, 1)
+				t.statQueueDropRecv.Add(1)
 				select {
 				case <-t.stopCh:
 					return
@@ -1991,11 +2641,24 @@ func (t *Tunnel) netReader() {
 					log.Printf("Receive queue full after timeout, dropping packet")
 				}
 			}
+		case PacketTypeAggregate:
+			forEachAggregateFrame(payload, func(packet []byte) bool {
+				if !enqueueWithPolicy(t.recvQueue, packet[1:], t.stopCh, false) {
+					t.statQueueDropRecv.Add(1)
+				}
+				return true
+			})
+		case PacketTypeFragment:
+			if packet := t.reassembleFragment(t.fragments, payload); packet != nil {
+				if !enqueueWithPolicy(t.recvQueue, packet[1:], t.stopCh, false) {
+					t.statQueueDropRecv.Add(1)
+				}
+			}
 		case PacketTypeAuthResponse:
 			// Handle authentication response (client mode)
-			// This should only be received in encrypt_after_auth mode
-			if !t.config.EncryptAfterAuth {
-				log.Printf("⚠️  Received unexpected auth response (encrypt_after_auth is disabled)")
+			// This should only be received in encrypt_after_auth or PKI mode
+			if !t.authHandshakeRequired() {
+				log.Printf("⚠️  Received unexpected auth response (authentication handshake is disabled)")
 				break
 			}
 			
@@ -2004,7 +2667,18 @@ func (t *Tunnel) netReader() {
 				break
 			}
 			
-			responseData := string(payload)
+			resp := parseAuthResponse(payload)
+			responseData := resp.Status
+			if responseData == "OK" && t.pkiEnabled() {
+				if err := t.verifyServerAuthResponse(&resp); err != nil {
+					responseData = err.Error()
+				}
+			}
+			if responseData == "OK" && t.pinsServerKey() {
+				if err := t.verifyPinnedServerKey(&resp); err != nil {
+					responseData = err.Error()
+				}
+			}
 			if responseData != "OK" {
 				select {
 				case t.authResponseChan <- fmt.Errorf("authentication rejected: %s", responseData):
@@ -2019,7 +2693,7 @@ func (t *Tunnel) netReader() {
 				}
 			}
 		case PacketTypeKeepalive:
-			// Keepalive received, no action needed
+			t.handleServerKeepalive(payload)
 		case PacketTypePublicAddr:
 			// Server sent us our public address
 			publicAddr := string(payload)
@@ -2031,8 +2705,8 @@ func (t *Tunnel) netReader() {
 			// Detect NAT type if enabled and announce peer info after detection
 			if t.config.EnableNATDetection && t.p2pManager != nil {
 				go func() {
-					// Perform NAT detection
-					t.p2pManager.DetectNATType(t.config.RemoteAddr)
+					// Perform NAT detection (or reuse the cached result)
+					t.detectNATType(publicAddr)
 					
 					// After NAT detection completes, announce peer info to server
 					// This ensures peer info is available when P2P connections are requested
@@ -2073,6 +2747,38 @@ func (t *Tunnel) netReader() {
 			t.handleRouteInfoPayload(payload)
 		case PacketTypeConfigUpdate:
 			t.handleConfigUpdate(payload)
+		case PacketTypeClientPush:
+			t.handleClientPush(payload)
+		case PacketTypeServerList:
+			t.handleServerList(payload)
+		case PacketTypeECNEcho:
+			handleECNEcho(t.conn, payload)
+		case PacketTypeDropReport:
+			t.handleDropReport(t.conn, &t.congestion, payload)
+		case PacketTypeKCP:
+			if t.kcpEnabled() {
+				t.handleKCP(conn, payload)
+			}
+		case PacketTypeDisconnect:
+			if t.handleServerDisconnect(payload) {
+				return
+			}
+		case PacketTypeMTUProbeAck:
+			t.handleMTUProbeAck(payload)
+		case PacketTypeRenew:
+			t.handleRenewRequest(payload)
+		case PacketTypeFECParams:
+			if t.handleServerFECParams(payload) {
+				return
+			}
+		case PacketTypeVersion:
+			t.handleServerVersion(payload)
+		case PacketTypeSessionID:
+			t.handleServerSessionID(payload)
+		case PacketTypePortHop:
+			t.handlePortHop(payload)
+		case PacketTypeClockSync:
+			t.handleClockSyncReply(payload)
 		}
 	}
 }
@@ -2081,63 +2787,86 @@ func (t *Tunnel) netReader() {
 func (t *Tunnel) netWriter() {
 	defer t.wg.Done()
 
+	if t.kcpEnabled() {
+		t.kcpNetWriter()
+		return
+	}
+
 	if !t.fecEnabled {
+		var carry []byte // Packet that did not fit into the previous aggregate
 		for {
-			select {
-			case <-t.stopCh:
-				return
-			case packet := <-t.sendQueue:
-				func() {
+			packet := carry
+			carry = nil
+			if packet == nil {
+				select {
+				case <-t.stopCh:
+					return
+				case packet = <-t.sendQueue:
+				}
+			}
+			if t.shedPacket(&t.congestion, packet) || t.overRate(packet) {
+				continue
+			}
+			func() {
+				var fullPacket []byte
+				if t.aggregatable(packet) {
+					fullPacket, carry, _, _ = t.collectAggregate(packet, t.sendQueue, t.aggLimit.next(t.clientSendMTU(), time.Now()))
+				} else {
 					defer t.releasePacketBuffer(packet)
+					fullPacket = typedPacket(packet)
+				}
 
-					fullPacket, _ := prependPacketType(packet, PacketTypeData)
+				// Encrypt if cipher is available
+				encryptedPacket, err := t.encryptPacket(fullPacket)
+				if err != nil {
+					log.Printf("Encryption error: %v", err)
+					return
+				}
 
-					// Encrypt if cipher is available
-					encryptedPacket, err := t.encryptPacket(fullPacket)
-					if err != nil {
-						log.Printf("Encryption error: %v", err)
+				// Ensure we have a live connection before writing
+				if t.conn == nil {
+					if err := t.reconnectToServer(); err != nil {
 						return
 					}
+				}
 
-					// Ensure we have a live connection before writing
-					if t.conn == nil {
-						if err := t.reconnectToServer(); err != nil {
-							return
-						}
+				conn := t.conn
+				t.control.drain(conn, controlBurst)
+				sendErr := conn.WritePacket(encryptedPacket)
+				if sendErr != nil && t.connReplaced(conn) {
+					sendErr = t.conn.WritePacket(encryptedPacket)
+				}
+				if sendErr != nil {
+					t.statSendErrors.Add(1)
+					select {
+					case <-t.stopCh:
+						return
+					default:
+						log.Printf("Network write error: %v, attempting reconnection...", sendErr)
 					}
 
-					sendErr := t.conn.WritePacket(encryptedPacket)
-					if sendErr != nil {
-						select {
-						case <-t.stopCh:
-							return
-						default:
-							log.Printf("Network write error: %v, attempting reconnection...", sendErr)
-						}
-
-						t.connMux.Lock()
-						if t.conn != nil {
-							_ = t.conn.Close()
-							t.conn = nil
-						}
-						t.connMux.Unlock()
+					t.connMux.Lock()
+					if t.conn != nil {
+						_ = t.conn.Close()
+						t.conn = nil
+					}
+					t.connMux.Unlock()
 
-						if err := t.reconnectToServer(); err != nil {
-							return
-						}
+					if err := t.reconnectToServer(); err != nil {
+						return
+					}
 
-						log.Printf("Reconnection successful, retrying packet send")
-						t.reannounceP2PInfoAfterReconnect()
+					log.Printf("Reconnection successful, retrying packet send")
+					t.reannounceP2PInfoAfterReconnect()
 
-						if t.conn != nil {
-							retryErr := t.conn.WritePacket(encryptedPacket)
-							if retryErr != nil {
-								log.Printf("Network write retry failed: %v, packet will be lost", retryErr)
-							}
+					if t.conn != nil {
+						retryErr := t.conn.WritePacket(encryptedPacket)
+						if retryErr != nil {
+							log.Printf("Network write retry failed: %v, packet will be lost", retryErr)
 						}
 					}
-				}()
-			}
+				}
+			}()
 		}
 	}
 
@@ -2168,6 +2897,7 @@ func (t *Tunnel) netWriter() {
 		for _, pkt := range workBatch {
 			t.releasePacketBuffer(pkt)
 		}
+		t.heldPackets.Add(-int64(len(workBatch)))
 	}
 
 	flushBatch := func(parityShards int) {
@@ -2195,7 +2925,7 @@ func (t *Tunnel) netWriter() {
 		case <-timer.C:
 			// Queue full, drop packets and clean up
 			cleanupBatch(workBatch)
-			atomic.AddUint64(&t.statQueueDropSend, 1)
+			t.statQueueDropSend.Add(1)
 		case <-t.stopCh:
 			timer.Stop()
 			// Tunnel stopping
@@ -2207,23 +2937,47 @@ func (t *Tunnel) netWriter() {
 		batch = batch[:0]
 	}
 
+	addToBatch := func(packet []byte) {
+		if t.shedPacket(&t.congestion, packet) || t.overRate(packet) {
+			return
+		}
+		if t.isPriorityPacket(packet) {
+			t.sendPriority(packet)
+			return
+		}
+		if t.quicSkipsFEC(packet) {
+			t.sendPlain(packet, 1)
+			return
+		}
+		batch = append(batch, packet)
+		t.heldPackets.Add(1)
+		if len(batch) == 1 {
+			resetTimer()
+		}
+		// Smart batching: flush at 6 packets to balance latency and FEC efficiency
+		if len(batch) >= t.fecGroupSize(&t.congestion) {
+			flushBatch(t.parityShards(&t.parityOverride))
+		} else if len(batch) >= 6 {
+			// Flush medium batch with reduced FEC overhead
+			flushBatch(1)
+		}
+	}
+
 	for {
 		select {
 		case <-t.stopCh:
 			flushBatch(1)
 			return
 		case packet := <-t.sendQueue:
-			batch = append(batch, packet)
-			if len(batch) == 1 {
-				resetTimer()
-			}
-			// Smart batching: flush at 6 packets to balance latency and FEC efficiency
-			if len(batch) >= dataShards {
-				flushBatch(t.config.FECParityShards)
-			} else if len(batch) >= 6 {
-				// Flush medium batch with reduced FEC overhead
-				flushBatch(1)
+			if t.aggregatable(packet) {
+				plaintext, carry, _, _ := t.collectAggregate(packet, t.sendQueue, t.aggLimit.next(t.clientSendMTU(), time.Now()))
+				addToBatch(batchElement(plaintext))
+				if carry != nil {
+					addToBatch(carry)
+				}
+				continue
 			}
+			addToBatch(packet)
 		case <-flushTimer.C:
 			if len(batch) > 0 {
 				flushBatch(1)
@@ -2236,18 +2990,27 @@ func (t *Tunnel) netWriter() {
 func (t *Tunnel) keepalive() {
 	defer t.wg.Done()
 
-	ticker := time.NewTicker(time.Duration(t.config.KeepaliveInterval) * time.Second)
+	interval := t.keepaliveInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	keepalivePacket := []byte{PacketTypeKeepalive}
-
+	var sent activityTracker
 	for {
 		select {
 		case <-t.stopCh:
 			return
 		case <-ticker.C:
+			if d := t.keepaliveInterval(); d != interval {
+				interval = d
+				ticker.Reset(interval)
+			}
+			t.sampleIdle()
+			t.checkSendPath()
+			if t.conn != nil && !t.sendPath.due(time.Now(), interval) && t.suppressKeepalive(&sent, &t.statBytesOut) {
+				continue
+			}
 			// Encrypt if cipher is available
-			encryptedPacket, err := t.encryptPacket(keepalivePacket)
+			encryptedPacket, err := t.encryptPacket(newKeepalivePacket())
 			if err != nil {
 				log.Printf("Keepalive encryption error: %v", err)
 				continue
@@ -2260,35 +3023,9 @@ func (t *Tunnel) keepalive() {
 				}
 			}
 
-			if err := t.conn.WritePacket(encryptedPacket); err != nil {
-				select {
-				case <-t.stopCh:
-					// Tunnel is stopping, no need to log
-					return
-				default:
-					log.Printf("Keepalive error: %v, attempting reconnection...", err)
-				}
-
-				// Close and clear connection then attempt reconnect
-				t.connMux.Lock()
-				if t.conn != nil {
-					_ = t.conn.Close()
-					t.conn = nil
-				}
-				t.connMux.Unlock()
-
-				// Keep trying to reconnect - only exits if tunnel is stopping
-				if err := t.reconnectToServer(); err != nil {
-					// Only returns error when stopCh is closed
-					return
-				}
-
-				log.Printf("Reconnection successful, keepalive will resume")
-
-				// Re-announce P2P info after reconnection to re-establish P2P connections
-				t.reannounceP2PInfoAfterReconnect()
-
-				// Don't return; let loop continue with the next tick
+			// Write errors are handled by controlWriter
+			if t.control.push(encryptedPacket) {
+				t.sendPath.sent(time.Now())
 			}
 		}
 	}
@@ -2303,6 +3040,7 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 	client.lastRecvTime = time.Now()
 	client.mu.Unlock()
 
+	var hib hibernation
 	for {
 		select {
 		case <-t.stopCh:
@@ -2311,6 +3049,7 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 			return
 		default:
 		}
+		t.checkHibernation(client, &hib)
 
 		// Check for idle connection timeout
 		client.mu.RLock()
@@ -2318,8 +3057,9 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 		client.mu.RUnlock()
 
 		if timeSinceLastRecv > IdleConnectionTimeout {
-			log.Printf("Client connection from %s idle for %v (threshold: %v), closing...",
+			client.logf("Client connection from %s idle for %v (threshold: %v), closing...",
 				client.conn.RemoteAddr(), timeSinceLastRecv, IdleConnectionTimeout)
+			client.setDisconnectReason("idle timeout")
 			client.stopOnce.Do(func() {
 				close(client.stopCh)
 			})
@@ -2338,8 +3078,9 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 			case <-client.stopCh:
 				// Client already stopped, no need to log
 			default:
-				log.Printf("Client network read error from %s: %v", client.conn.RemoteAddr(), err)
+				client.logf("Client network read error from %s: %v", client.conn.RemoteAddr(), err)
 			}
+			client.setDisconnectReason("read error")
 			client.stopOnce.Do(func() {
 				close(client.stopCh)
 			})
@@ -2354,10 +3095,23 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 		client.mu.Lock()
 		client.lastRecvTime = time.Now()
 		client.mu.Unlock()
+		encrypt := func(p []byte) ([]byte, error) { return t.encryptForClient(client, p) }
+		echoECN(client.conn, client.control, encrypt)
+		t.reportDrops(client.control, &client.dropReport, client.recvDrops.Load(), encrypt)
+		parseStart := t.stages.start()
+
+		// Corrupted shards are dropped so FEC recovers them as losses
+		if packet[0] == PacketTypeFECShardChecked {
+			var ok bool
+			if packet, ok = t.verifyShard(packet); !ok {
+				continue
+			}
+		}
 
 		// Check if this is an FEC shard (before decryption)
 		// FEC shards are NOT encrypted themselves - they contain pieces of encrypted data
 		if len(packet) > 0 && packet[0] == PacketTypeFECShard {
+			t.traceFrame(false, client, packet)
 			if t.fecEnabled {
 				// Offload to worker pool - do NOT process in this hot loop
 				// Dispatch based on SessionID to ensure affinity
@@ -2367,7 +3121,7 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 				if len(packet) >= 5 {
 					// Use SessionID for affinity
 					sessionID := uint32(packet[1])<<24 | uint32(packet[2])<<16 | uint32(packet[3])<<8 | uint32(packet[4])
-					workerID := sessionID % uint32(t.config.SendWorkers)
+					workerID := sessionID % uint32(len(t.fecIngressQueues))
 					targetQueue = t.fecIngressQueues[workerID]
 				} else {
 					targetQueue = t.fecIngressQueues[0]
@@ -2382,20 +3136,30 @@ func (t *Tunnel) clientNetReader(client *ClientConnection) {
 					client:     client,
 				}:
 				default:
-					atomic.AddUint64(&t.statQueueDropRecv, 1) // Using same drop stat for simplicity
+					t.statQueueDropRecv.Add(1) // Using same drop stat for simplicity
+					client.recvDrops.Add(1)
 				}
 			}
+			t.stages.done(stageParse, parseStart)
 			continue
 		} else {
+			t.stages.done(stageParse, parseStart)
 			// Decrypt if cipher is available (supports previous key during grace)
 			var err error
 			var usedCipher *crypto.Cipher
 			var gen uint64
 			packet, usedCipher, gen, err = t.decryptPacketFromClient(client, packet)
 			if err != nil {
-				log.Printf("Client decryption error from %s (wrong key?): %v", client.conn.RemoteAddr(), err)
+				client.logf("Client decryption error from %s (wrong key?): %v", client.conn.RemoteAddr(), err)
+				if atomic.LoadUint32(&client.verified) == 0 {
+					t.noteUnauth(client.conn.RemoteAddr(), unauthBadMAC)
+				}
 				continue
 			}
+			if atomic.LoadUint32(&client.verified) == 0 {
+				atomic.StoreUint32(&client.verified, 1)
+			}
+			t.traceFrame(false, client, packet)
 
 			if usedCipher != nil {
 				client.setCipherWithGen(usedCipher, gen)
@@ -2418,9 +3182,21 @@ func (t *Tunnel) handleClientPacket(client *ClientConnection, packet []byte) boo
 	packetType := packet[0]
 	payload := packet[1:]
 
+	// In PKI mode nothing but the handshake and keepalives is accepted until
+	// the client has presented a valid certificate.
+	if t.pkiEnabled() && packetType != PacketTypeAuth && packetType != PacketTypeKeepalive {
+		client.mu.RLock()
+		authenticated := client.authenticated
+		client.mu.RUnlock()
+		if !authenticated {
+			t.noteUnauth(client.conn.RemoteAddr(), unauthUnknownSession)
+			return true
+		}
+	}
+
 	switch packetType {
 	case PacketTypeAuth:
-		if t.config.EncryptAfterAuth {
+		if t.authHandshakeRequired() || t.pkiIdentity != nil {
 			t.handleClientAuthentication(client, payload)
 		}
 	case PacketTypeData:
@@ -2430,30 +3206,39 @@ func (t *Tunnel) handleClientPacket(client *ClientConnection, packet []byte) boo
 
 		if payload[0]>>4 == IPv4Version { // IPv4
 			srcIP := net.IP(payload[IPv4SrcIPOffset : IPv4SrcIPOffset+4])
+			client.bytesIn.Add(uint64(len(payload)))
+			client.packetsIn.Add(1)
 
 			if client.clientIP == nil {
+				if t.pkiEnabled() {
+					// PKI clients are registered at authentication, under the
+					// tunnel IP they signed for, never by their packets
+					return true
+				}
 				t.addClient(client, srcIP)
 			} else if !client.clientIP.Equal(srcIP) {
-				log.Printf("WARNING: Client %s trying to send packet with different source IP %s (registered as %s). Dropping packet.",
+				client.logf("WARNING: Client %s trying to send packet with different source IP %s (registered as %s). Dropping packet.",
 					client.conn.RemoteAddr(), srcIP, client.clientIP)
 				return true
 			}
+			t.mirrorFromClient(client, payload)
 
 			dstIP := net.IP(payload[IPv4DstIPOffset : IPv4DstIPOffset+4])
 
 			if t.config.ClientIsolation {
-				if _, err := t.tunFile.Write(payload); err != nil {
+				if _, err := t.writeTUN(payload); err != nil {
 					select {
 					case <-t.stopCh:
 						// Tunnel is stopping, no need to log
 					default:
-						log.Printf("TUN write error: %v", err)
+						client.logf("TUN write error: %v", err)
 					}
 					return false
 				}
 			} else {
 				targetClient := t.getClientByIP(dstIP)
 				if targetClient != nil && targetClient != client {
+					t.mirrorToClient(targetClient, payload)
 					forwardBuf := t.getPacketBuffer()
 					forwardPacket := forwardBuf[:len(payload)]
 					copy(forwardPacket, payload)
@@ -2461,52 +3246,83 @@ func (t *Tunnel) handleClientPacket(client *ClientConnection, packet []byte) boo
 					// CRITICAL FIX: Never block on client-to-client forwarding
 					queued := enqueueWithClientPolicy(targetClient.sendQueue, forwardPacket, t.stopCh, client.stopCh, false)
 					if !queued {
-						atomic.AddUint64(&t.statQueueDropForward, 1)
-						log.Printf("⚠️  Target client send queue full for %s after timeout, dropping packet", dstIP)
+						t.statQueueDropForward.Add(1)
+						client.logf("⚠️  Target client send queue full for %s after timeout, dropping packet", dstIP)
 						t.releasePacketBuffer(forwardBuf)
 					}
 				} else {
-					if _, err := t.tunFile.Write(payload); err != nil {
+					if _, err := t.writeTUN(payload); err != nil {
 						select {
 						case <-t.stopCh:
 							// Tunnel is stopping, no need to log
 						default:
-							log.Printf("TUN write error: %v", err)
+							client.logf("TUN write error: %v", err)
 						}
 						return false
 					}
 				}
 			}
 		}
+	case PacketTypeAggregate:
+		return forEachAggregateFrame(payload, func(packet []byte) bool {
+			return t.handleClientPacket(client, packet)
+		})
+	case PacketTypeFragment:
+		if packet := t.reassembleFragment(client.fragments, payload); packet != nil {
+			return t.handleClientPacket(client, packet)
+		}
+	case PacketTypeFECParams:
+		return t.handleClientFECParams(client, payload)
+	case PacketTypeVersion:
+		t.handleClientVersion(client, payload)
+	case PacketTypeClockSync:
+		t.handleClientClockSync(client, payload)
+	case PacketTypeServerList:
+		t.handleServerListRequest(client)
+	case PacketTypeECNEcho:
+		handleECNEcho(client.conn, payload)
+	case PacketTypeDropReport:
+		t.handleDropReport(client.conn, &client.congestion, payload)
+	case PacketTypeKCP:
+		if t.kcpEnabled() {
+			t.handleClientKCP(client, payload)
+		}
 	case PacketTypeKeepalive:
-		// Keepalive received, no action needed
+		t.handleClientKeepalive(client, payload)
 	case PacketTypePeerInfo:
 		if t.config.P2PEnabled {
 			peerInfoStr := string(payload)
-			log.Printf("Received and stored peer info from client: %s", peerInfoStr)
+			client.logf("Received and stored peer info from client: %s", peerInfoStr)
 
 			parts := strings.Split(peerInfoStr, "|")
 			if len(parts) >= 3 {
 				tunnelIP := net.ParseIP(parts[0])
 				if tunnelIP != nil {
-					if client.clientIP == nil {
+					if client.clientIP == nil && !t.pkiEnabled() {
 						t.addClient(client, tunnelIP)
 					}
+					if client.clientIP == nil || !client.clientIP.Equal(tunnelIP) {
+						client.logf("WARNING: Client %s announced peer info for %s (registered as %s). Dropping it.",
+							client.conn.RemoteAddr(), tunnelIP, client.clientIP)
+						break
+					}
 
 					client.mu.Lock()
 					client.lastPeerInfo = peerInfoStr
 					client.mu.Unlock()
-					log.Printf("Stored peer info for %s, ready for on-demand P2P", tunnelIP)
+					client.logf("Stored peer info for %s, ready for on-demand P2P", tunnelIP)
 				}
 			}
 		}
 	case PacketTypeP2PRequest:
 		t.handleP2PRequest(client, payload)
+	case PacketTypeMTUProbe:
+		t.answerMTUProbe(client, payload)
 	case PacketTypeRouteInfo:
 		routes := parseRouteList(string(payload))
 		if len(routes) > 0 {
 			t.registerClientRoutes(client, routes)
-			go t.sendRoutesToClient(client)
+			t.goSession(client, "route announcement", func() { t.sendRoutesToClient(client) })
 		}
 	}
 
@@ -2517,39 +3333,65 @@ func (t *Tunnel) handleClientPacket(client *ClientConnection, packet []byte) boo
 func (t *Tunnel) clientNetWriter(client *ClientConnection) {
 	defer client.wg.Done()
 
+	if t.kcpEnabled() {
+		t.clientKCPNetWriter(client)
+		return
+	}
+
 	if !t.fecEnabled {
+		var carry []byte // Packet that did not fit into the previous aggregate
 		for {
-			select {
-			case <-t.stopCh:
-				return
-			case <-client.stopCh:
-				return
-			case packet := <-client.sendQueue:
-				func() {
+			packet := carry
+			carry = nil
+			if packet == nil {
+				select {
+				case <-t.stopCh:
+					return
+				case <-client.stopCh:
+					return
+				case packet = <-client.sendQueue:
+				}
+			}
+			if t.shedPacket(&client.congestion, packet) || t.overRate(packet) {
+				continue
+			}
+			client.bytesOut.Add(uint64(len(packet)))
+			client.packetsOut.Add(1)
+			func() {
+				var fullPacket []byte
+				if t.aggregatable(packet) {
+					var added, joined int
+					fullPacket, carry, added, joined = t.collectAggregate(packet, client.sendQueue,
+						client.aggLimit.next(int(atomic.LoadInt32(&client.sendMTU)), time.Now()))
+					client.bytesOut.Add(uint64(added))
+					client.packetsOut.Add(uint64(joined))
+				} else {
 					defer t.releasePacketBuffer(packet)
+					fullPacket = typedPacket(packet)
+				}
 
-					fullPacket, _ := prependPacketType(packet, PacketTypeData)
-
-					encryptedPacket, err := t.encryptForClient(client, fullPacket)
-					if err != nil {
-						log.Printf("Client encryption error: %v", err)
-						return
-					}
+				encryptedPacket, err := t.encryptForClient(client, fullPacket)
+				if err != nil {
+					client.logf("Client encryption error: %v", err)
+					return
+				}
 
-					sendErr := client.conn.WritePacket(encryptedPacket)
-					if sendErr != nil {
-						select {
-						case <-t.stopCh:
-						case <-client.stopCh:
-						default:
-							log.Printf("Client network write error to %s: %v", client.conn.RemoteAddr(), sendErr)
-						}
-						client.stopOnce.Do(func() {
-							close(client.stopCh)
-						})
+				client.control.drain(client.conn, controlBurst)
+				sendErr := client.conn.WritePacket(encryptedPacket)
+				if sendErr != nil {
+					t.statSendErrors.Add(1)
+					select {
+					case <-t.stopCh:
+					case <-client.stopCh:
+					default:
+						client.logf("Client network write error to %s: %v", client.conn.RemoteAddr(), sendErr)
 					}
-				}()
-			}
+					client.setDisconnectReason("write error")
+					client.stopOnce.Do(func() {
+						close(client.stopCh)
+					})
+				}
+			}()
 		}
 	}
 
@@ -2583,25 +3425,67 @@ func (t *Tunnel) clientNetWriter(client *ClientConnection) {
 			for _, pkt := range batch {
 				t.releasePacketBuffer(pkt)
 			}
+			t.heldPackets.Add(-int64(len(batch)))
 			batch = batch[:0]
 		}()
 
-		sendErr := t.sendBatchWithFEC(client.conn, batch, parityShards, func(p []byte) ([]byte, error) {
+		sendErr := t.sendBatchWithFEC(client, batch, parityShards, func(p []byte) ([]byte, error) {
 			return t.encryptForClient(client, p)
 		})
 		if sendErr != nil {
+			t.statSendErrors.Add(1)
 			select {
 			case <-t.stopCh:
 			case <-client.stopCh:
 			default:
-				log.Printf("Client network write error to %s: %v", client.conn.RemoteAddr(), sendErr)
+				client.logf("Client network write error to %s: %v", client.conn.RemoteAddr(), sendErr)
 			}
+			client.setDisconnectReason("write error")
 			client.stopOnce.Do(func() {
 				close(client.stopCh)
 			})
 		}
 	}
 
+	addToBatch := func(packet []byte) {
+		if t.shedPacket(&client.congestion, packet) || t.overRate(packet) {
+			return
+		}
+		if t.isPriorityPacket(packet) {
+			if err := t.sendPriorityToClient(client, packet); err != nil {
+				t.statSendErrors.Add(1)
+				client.logf("Client network write error to %s: %v", client.conn.RemoteAddr(), err)
+				client.setDisconnectReason("write error")
+				client.stopOnce.Do(func() {
+					close(client.stopCh)
+				})
+			}
+			return
+		}
+		if t.quicSkipsFEC(packet) {
+			if _, err := t.sendPlainToClient(client, packet, 1); err != nil {
+				t.statSendErrors.Add(1)
+				client.logf("Client network write error to %s: %v", client.conn.RemoteAddr(), err)
+				client.setDisconnectReason("write error")
+				client.stopOnce.Do(func() {
+					close(client.stopCh)
+				})
+			}
+			return
+		}
+		batch = append(batch, packet)
+		t.heldPackets.Add(1)
+		if len(batch) == 1 {
+			resetTimer()
+		}
+		// Smart batching: flush at 6 packets to balance latency and FEC efficiency
+		if len(batch) >= t.fecGroupSize(&client.congestion) {
+			flushBatch(t.parityShards(&client.parityOverride))
+		} else if len(batch) >= 6 {
+			flushBatch(1)
+		}
+	}
+
 	for {
 		select {
 		case <-t.stopCh:
@@ -2611,16 +3495,22 @@ func (t *Tunnel) clientNetWriter(client *ClientConnection) {
 			flushBatch(1)
 			return
 		case packet := <-client.sendQueue:
-			batch = append(batch, packet)
-			if len(batch) == 1 {
-				resetTimer()
-			}
-			// Smart batching: flush at 6 packets to balance latency and FEC efficiency
-			if len(batch) >= dataShards {
-				flushBatch(t.config.FECParityShards)
-			} else if len(batch) >= 6 {
-				flushBatch(1)
+			client.bytesOut.Add(uint64(len(packet)))
+			client.packetsOut.Add(1)
+			if t.aggregatable(packet) {
+				plaintext, carry, added, joined := t.collectAggregate(packet, client.sendQueue,
+					client.aggLimit.next(int(atomic.LoadInt32(&client.sendMTU)), time.Now()))
+				client.bytesOut.Add(uint64(added))
+				client.packetsOut.Add(uint64(joined))
+				addToBatch(batchElement(plaintext))
+				if carry != nil {
+					client.bytesOut.Add(uint64(len(carry)))
+					client.packetsOut.Add(1)
+					addToBatch(carry)
+				}
+				continue
 			}
+			addToBatch(packet)
 		case <-flushTimer.C:
 			if len(batch) > 0 {
 				flushBatch(1)
@@ -2633,11 +3523,11 @@ func (t *Tunnel) clientNetWriter(client *ClientConnection) {
 func (t *Tunnel) clientKeepalive(client *ClientConnection) {
 	defer client.wg.Done()
 
-	ticker := time.NewTicker(time.Duration(t.config.KeepaliveInterval) * time.Second)
+	interval := time.Duration(t.config.KeepaliveInterval) * time.Second
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	keepalivePacket := []byte{PacketTypeKeepalive}
-
+	var sent activityTracker
 	for {
 		select {
 		case <-t.stopCh:
@@ -2645,26 +3535,26 @@ func (t *Tunnel) clientKeepalive(client *ClientConnection) {
 		case <-client.stopCh:
 			return
 		case <-ticker.C:
-			// Encrypt if cipher is available
-			encryptedPacket, err := t.encryptForClient(client, keepalivePacket)
-			if err != nil {
-				log.Printf("Client keepalive encryption error: %v", err)
-				continue
-			}
-			if err := client.conn.WritePacket(encryptedPacket); err != nil {
-				select {
-				case <-t.stopCh:
-					// Tunnel is stopping, no need to log
-				case <-client.stopCh:
-					// Client already stopped, no need to log
-				default:
-					log.Printf("Client keepalive error to %s: %v", client.conn.RemoteAddr(), err)
-				}
+			if t.clientSendPathDead(client) {
+				client.setDisconnectReason("dead path")
 				client.stopOnce.Do(func() {
 					close(client.stopCh)
 				})
 				return
 			}
+			if !client.sendPath.due(time.Now(), interval) && t.suppressKeepalive(&sent, &client.bytesOut) {
+				continue
+			}
+			// Encrypt if cipher is available
+			encryptedPacket, err := t.encryptForClient(client, newKeepalivePacket())
+			if err != nil {
+				client.logf("Client keepalive encryption error: %v", err)
+				continue
+			}
+			// Write errors are handled by clientControlWriter
+			if client.control.push(encryptedPacket) {
+				client.sendPath.sent(time.Now())
+			}
 		}
 	}
 }
@@ -2695,7 +3585,7 @@ func (t *Tunnel) handleP2PPacket(peerIP net.IP, data []byte) {
 		// CRITICAL FIX: Use timeout-based enqueue instead of immediate drop
 		// P2P packets should have same treatment as regular packets
 		if !enqueueWithPolicy(t.recvQueue, payload, t.stopCh, false) {
-			atomic.AddUint64(&t.statQueueDropRecv, 1)
+			t.statQueueDropRecv.Add(1)
 			log.Printf("⚠️  Receive queue full after timeout, dropping P2P packet from %s", peerIP)
 		}
 	case PacketTypePeerInfo:
@@ -3133,12 +4023,12 @@ func (t *Tunnel) sendRoutesToClient(client *ClientConnection) {
 
 	encryptedPacket, err := t.encryptForClient(client, fullPacket)
 	if err != nil {
-		log.Printf("Failed to encrypt routes for client: %v", err)
+		client.logf("Failed to encrypt routes for client: %v", err)
 		return
 	}
 
 	if err := client.conn.WritePacket(encryptedPacket); err != nil {
-		log.Printf("Failed to send routes to client: %v", err)
+		client.logf("Failed to send routes to client: %v", err)
 	}
 }
 
@@ -3183,7 +4073,7 @@ func (t *Tunnel) registerClientRoutes(client *ClientConnection, routes []string)
 	for _, route := range routes {
 		_, ipNet, err := net.ParseCIDR(route)
 		if err != nil {
-			log.Printf("Invalid advertised route %s: %v", route, err)
+			client.logf("Invalid advertised route %s: %v", route, err)
 			continue
 		}
 		t.advertisedRoutes = append(t.advertisedRoutes, clientRoute{
@@ -3197,7 +4087,7 @@ func (t *Tunnel) registerClientRoutes(client *ClientConnection, routes []string)
 	// Apply routes to local OS
 	for _, route := range routes {
 		if err := t.addRoute(route); err != nil {
-			log.Printf("Failed to install client route %s: %v", route, err)
+			client.logf("Failed to install client route %s: %v", route, err)
 		}
 	}
 }
@@ -3252,6 +4142,9 @@ func (t *Tunnel) addRoute(route string) error {
 		return fmt.Errorf("invalid route %s: %w", route, err)
 	}
 	route = ipNet.String()
+	if err := t.checkRouteLoop(ipNet); err != nil {
+		return err
+	}
 
 	cmd := exec.Command("ip", "route", "replace", route, "dev", t.tunName)
 	if output, err := cmd.CombinedOutput(); err != nil {
@@ -3517,8 +4410,14 @@ func (t *Tunnel) shouldSkipOuterEncryption(data []byte) bool {
 }
 
 // encryptPacket encrypts a packet if cipher is available
-// In encrypt_after_auth mode, only encrypts if not authenticated or for control packets
 func (t *Tunnel) encryptPacket(data []byte) ([]byte, error) {
+	t.traceFrame(true, nil, data)
+	return t.sealPacket(data)
+}
+
+// sealPacket encrypts a packet with the tunnel key.
+// In encrypt_after_auth mode, only encrypts if not authenticated or for control packets
+func (t *Tunnel) sealPacket(data []byte) ([]byte, error) {
 	t.cipherMux.RLock()
 	c := t.cipher
 	t.cipherMux.RUnlock()
@@ -3550,6 +4449,7 @@ func (t *Tunnel) encryptPacket(data []byte) ([]byte, error) {
 }
 
 func (t *Tunnel) decryptWithFallback(data []byte) ([]byte, *crypto.Cipher, uint64, error) {
+	defer t.stages.done(stageDecrypt, t.stages.start())
 	t.cipherMux.RLock()
 	active := t.cipher
 	activeGen := t.cipherGen
@@ -3636,6 +4536,7 @@ func (t *Tunnel) decryptPacketFromClient(client *ClientConnection, data []byte)
 }
 
 func (t *Tunnel) encryptForClient(client *ClientConnection, data []byte) ([]byte, error) {
+	t.traceFrame(true, client, data)
 	if !t.fecEnabled && t.shouldSkipOuterEncryption(data) {
 		return data, nil
 	}
@@ -3662,7 +4563,7 @@ func (t *Tunnel) encryptForClient(client *ClientConnection, data []byte) ([]byte
 			return c.Encrypt(data)
 		}
 	}
-	return t.encryptPacket(data)
+	return t.sealPacket(data)
 }
 
 func (t *Tunnel) isPrevCipherActive(prev *crypto.Cipher) bool {
@@ -3749,6 +4650,7 @@ func (t *Tunnel) rotateCipher(newKey string) error {
 	if oldCipher != nil {
 		go t.expirePrevCipher(oldCipher)
 	}
+	t.rekeyBase.Store(t.trafficTotal())
 
 	t.persistKeyToConfigFile(newKey)
 	return nil
@@ -3783,15 +4685,19 @@ func (t *Tunnel) handleClientAuthentication(client *ClientConnection, payload []
 	// Parse authentication request
 	var authReq AuthenticationRequest
 	if err := json.Unmarshal(payload, &authReq); err != nil {
-		log.Printf("Invalid authentication request from %s: failed to parse JSON: %v", client.conn.RemoteAddr(), err)
-		t.sendAuthResponse(client, "INVALID")
+		client.logf("Invalid authentication request from %s: failed to parse JSON: %v", client.conn.RemoteAddr(), err)
+		t.noteUnauth(client.conn.RemoteAddr(), unauthMalformed)
+		t.auditAuth(client, "", "", "INVALID")
+		t.rejectAuthentication(client, "INVALID")
 		return
 	}
 	
 	// Validate timestamp (prevent replay attacks)
 	now := time.Now().Unix()
 	if now-authReq.Timestamp > AuthenticationTimeWindow || authReq.Timestamp-now > AuthenticationTimeWindow {
-		log.Printf("Authentication request from %s rejected: timestamp out of range", client.conn.RemoteAddr())
+		client.logf("Authentication request from %s rejected: timestamp out of range", client.conn.RemoteAddr())
+		t.noteUnauth(client.conn.RemoteAddr(), unauthRejected)
+		t.auditAuth(client, authReq.TunnelIP, "", "EXPIRED")
 		t.sendAuthResponse(client, "EXPIRED")
 		return
 	}
@@ -3799,23 +4705,99 @@ func (t *Tunnel) handleClientAuthentication(client *ClientConnection, payload []
 	// Validate tunnel IP
 	tunnelIP := net.ParseIP(authReq.TunnelIP)
 	if tunnelIP == nil {
-		log.Printf("Invalid authentication request from %s: bad IP %s", client.conn.RemoteAddr(), authReq.TunnelIP)
-		t.sendAuthResponse(client, "INVALID")
+		client.logf("Invalid authentication request from %s: bad IP %s", client.conn.RemoteAddr(), authReq.TunnelIP)
+		t.noteUnauth(client.conn.RemoteAddr(), unauthMalformed)
+		t.auditAuth(client, authReq.TunnelIP, "", "INVALID")
+		t.rejectAuthentication(client, "INVALID")
 		return
 	}
 	
+	var identity string
+	var cert *x509.Certificate
+	if t.pkiEnabled() {
+		var status string
+		cert, status = t.verifyClientCertificate(&authReq, tunnelIP)
+		if status != "" {
+			client.logf("Authentication request from %s rejected: %s", client.conn.RemoteAddr(), status)
+			t.noteUnauth(client.conn.RemoteAddr(), unauthRejected)
+			t.auditAuth(client, authReq.TunnelIP, "", status)
+			t.rejectAuthentication(client, status)
+			return
+		}
+		identity = pki.Identify(cert)
+		// A captured request stays valid for the whole timestamp window; only
+		// its first use is accepted. A duplicate of an accepted request is
+		// ignored rather than answered, so it cannot end a live session.
+		expires := time.Unix(authReq.Timestamp+AuthenticationTimeWindow, 0)
+		if !t.authReplay.Fresh(authReq.Nonce, expires, time.Now()) {
+			client.logf("Authentication request from %s ignored: replayed nonce", client.conn.RemoteAddr())
+			t.noteUnauth(client.conn.RemoteAddr(), unauthRejected)
+			t.auditAuth(client, authReq.TunnelIP, identity, "REPLAY")
+			return
+		}
+		if client.clientIP != nil && !client.clientIP.Equal(tunnelIP) {
+			client.logf("Authentication request from %s rejected: session is registered as %s, not %s", client.conn.RemoteAddr(), client.clientIP, tunnelIP)
+			t.noteUnauth(client.conn.RemoteAddr(), unauthRejected)
+			t.auditAuth(client, authReq.TunnelIP, identity, "INVALID")
+			t.rejectAuthentication(client, "INVALID")
+			return
+		}
+	}
+	
 	// Mark client as authenticated
 	client.mu.Lock()
 	client.authenticated = true
+	client.identity = identity
+	client.cert = cert
 	client.mu.Unlock()
+	t.noteHandshake(true)
 	
-	log.Printf("✅ Client %s authenticated successfully (IP: %s) - data packets will not be encrypted", 
-		client.conn.RemoteAddr(), tunnelIP)
+	if identity != "" {
+		client.logf("✅ Client %s authenticated with certificate %q (IP: %s)", client.conn.RemoteAddr(), identity, tunnelIP)
+	} else if t.config.EncryptAfterAuth {
+		client.logf("✅ Client %s authenticated successfully (IP: %s) - data packets will not be encrypted", 
+			client.conn.RemoteAddr(), tunnelIP)
+	} else {
+		client.logf("✅ Client %s authenticated successfully (IP: %s)", client.conn.RemoteAddr(), tunnelIP)
+	}
 	
-	// Send success response
+	t.auditAuth(client, tunnelIP.String(), identity, "OK")
+
+	// Send success response; a server with a key proves it to clients that
+	// pin it (they send a nonce)
+	if t.pkiEnabled() || (t.pkiIdentity != nil && authReq.Nonce != "") {
+		resp, err := t.buildPKIAuthResponse(&authReq)
+		if err != nil {
+			client.logf("Failed to sign auth response: %v", err)
+			return
+		}
+		t.sendAuthResponse(client, string(resp))
+		if !t.pkiEnabled() {
+			return
+		}
+		// Register the client under the tunnel IP its certificate signed for,
+		// unless client_push assigns it another address
+		if push, ok := t.clientPushFor(identity); client.clientIP == nil && (!ok || push.TunnelAddr == "") {
+			t.addClient(client, tunnelIP)
+		}
+		t.announceSession(client)
+		return
+	}
 	t.sendAuthResponse(client, "OK")
 }
 
+// auditAuth records an authentication outcome in the audit log
+func (t *Tunnel) auditAuth(client *ClientConnection, tunnelIP, identity, result string) {
+	t.auditLog.Log(audit.Record{
+		Event:      audit.EventAuth,
+		RemoteAddr: client.conn.RemoteAddr().String(),
+		TunnelIP:   tunnelIP,
+		Identity:   identity,
+		Result:     result,
+		Session:    client.sessionID,
+	})
+}
+
 // sendAuthResponse sends authentication response to client
 func (t *Tunnel) sendAuthResponse(client *ClientConnection, status string) {
 	responsePacket := make([]byte, len(status)+1)
@@ -3828,21 +4810,29 @@ func (t *Tunnel) sendAuthResponse(client *ClientConnection, status string) {
 	t.cipherMux.RUnlock()
 	
 	if cipher == nil {
-		log.Printf("Cannot send auth response: no cipher available")
+		client.logf("Cannot send auth response: no cipher available")
 		return
 	}
 	
 	encryptedResponse, err := cipher.Encrypt(responsePacket)
 	if err != nil {
-		log.Printf("Failed to encrypt auth response: %v", err)
+		client.logf("Failed to encrypt auth response: %v", err)
 		return
 	}
 	
 	if err := client.conn.WritePacket(encryptedResponse); err != nil {
-		log.Printf("Failed to send auth response to %s: %v", client.conn.RemoteAddr(), err)
+		client.logf("Failed to send auth response to %s: %v", client.conn.RemoteAddr(), err)
 	}
 }
 
+// rejectAuthentication answers a request that retrying cannot fix and closes
+// the connection, so that the client stops with the status instead of
+// reconnecting. The status stays in the auth response for older clients.
+func (t *Tunnel) rejectAuthentication(client *ClientConnection, status string) {
+	t.sendAuthResponse(client, status)
+	t.disconnectClient(client, DisconnectAuthFailed, status)
+}
+
 // reannounceP2PInfoAfterReconnect re-announces P2P info after reconnection with retry logic
 func (t *Tunnel) reannounceP2PInfoAfterReconnect() {
 	if !t.config.P2PEnabled || t.p2pManager == nil {
@@ -3981,7 +4971,7 @@ func (t *Tunnel) sendPublicAddrToClient(client *ClientConnection) {
 	// Get client's public address from connection
 	remoteAddr := client.conn.RemoteAddr()
 	if remoteAddr == nil {
-		log.Printf("Cannot send public address: client has no remote address")
+		client.logf("Cannot send public address: client has no remote address")
 		return
 	}
 
@@ -3995,14 +4985,14 @@ func (t *Tunnel) sendPublicAddrToClient(client *ClientConnection) {
 	// Encrypt the packet (don't rely on clientNetWriter since this is not a data packet)
 	encryptedPacket, err := t.encryptForClient(client, fullPacket)
 	if err != nil {
-		log.Printf("Failed to encrypt public address: %v", err)
+		client.logf("Failed to encrypt public address: %v", err)
 		return
 	}
 
 	// Send directly to network connection (bypass sendQueue which is for data packets)
 	// This avoids double-wrapping by clientNetWriter
 	if err := client.conn.WritePacket(encryptedPacket); err != nil {
-		log.Printf("Failed to send public address to client: %v", err)
+		client.logf("Failed to send public address to client: %v", err)
 		// Signal client to disconnect on write error (consistent with clientNetWriter behavior)
 		client.stopOnce.Do(func() {
 			close(client.stopCh)
@@ -4010,7 +5000,7 @@ func (t *Tunnel) sendPublicAddrToClient(client *ClientConnection) {
 		return
 	}
 
-	log.Printf("Sent public address %s to client", publicAddrStr)
+	client.logf("Sent public address %s to client", publicAddrStr)
 }
 
 // configPushLoop periodically sends new configuration (rotated key) to clients (server mode).
@@ -4304,12 +5294,12 @@ func (t *Tunnel) sendPeerInfoAndPunch(client *ClientConnection, peerInfo string)
 	
 	encryptedPeerInfo, err := t.encryptForClient(client, peerInfoPacket)
 	if err != nil {
-		log.Printf("Failed to encrypt peer info: %v", err)
+		client.logf("Failed to encrypt peer info: %v", err)
 		return
 	}
 	
 	if err := client.conn.WritePacket(encryptedPeerInfo); err != nil {
-		log.Printf("Failed to send peer info: %v", err)
+		client.logf("Failed to send peer info: %v", err)
 		return
 	}
 	
@@ -4320,12 +5310,12 @@ func (t *Tunnel) sendPeerInfoAndPunch(client *ClientConnection, peerInfo string)
 	
 	encryptedPunch, err := t.encryptForClient(client, punchPacket)
 	if err != nil {
-		log.Printf("Failed to encrypt punch packet: %v", err)
+		client.logf("Failed to encrypt punch packet: %v", err)
 		return
 	}
 	
 	if err := client.conn.WritePacket(encryptedPunch); err != nil {
-		log.Printf("Failed to send punch packet: %v", err)
+		client.logf("Failed to send punch packet: %v", err)
 	}
 }
 
@@ -4349,6 +5339,7 @@ func (t *Tunnel) fecWorker() {
 					for _, pkt := range work.packets {
 						t.releasePacketBuffer(pkt)
 					}
+					t.heldPackets.Add(-int64(len(work.packets)))
 				}()
 
 				// Ensure connection
@@ -4366,7 +5357,7 @@ func (t *Tunnel) fecWorker() {
 				// Encrypt
 				encPackets := make([][]byte, len(work.packets))
 				for i, pkt := range work.packets {
-					fullPacket, _ := prependPacketType(pkt, PacketTypeData)
+					fullPacket := typedPacket(pkt)
 					if t.cipher != nil {
 						enc, err := t.encryptPacket(fullPacket)
 						if err != nil {
@@ -4418,31 +5409,19 @@ func (t *Tunnel) fecWorker() {
 				// Prepare all packets for batch send
 				packetsToSend := make([][]byte, 0, len(shards))
 				
+				checked := atomic.LoadUint32(&t.shardChecksum) != 0
 				for i, shard := range shards {
-					fecPacket := make([]byte, 1+4+2+2+2+2+len(shard))
-					fecPacket[0] = PacketTypeFECShard
-					fecPacket[1] = byte(sessionID >> 24)
-					fecPacket[2] = byte(sessionID >> 16)
-					fecPacket[3] = byte(sessionID >> 8)
-					fecPacket[4] = byte(sessionID)
-					fecPacket[5] = byte(i >> 8)
-					fecPacket[6] = byte(i)
-					fecPacket[7] = byte(dataShards >> 8)
-					fecPacket[8] = byte(dataShards)
-					fecPacket[9] = byte(work.parityShards >> 8)
-					fecPacket[10] = byte(work.parityShards)
-					fecPacket[11] = byte(shardSize >> 8)
-					fecPacket[12] = byte(shardSize)
-					copy(fecPacket[13:], shard)
-					
+					fecPacket := buildShardPacket(sessionID, i, dataShards, work.parityShards, shard, checked)
+					t.traceFrame(true, nil, fecPacket)
 					packetsToSend = append(packetsToSend, fecPacket)
 				}
 
+				t.control.drain(conn, controlBurst)
 				if err := conn.WriteBatch(packetsToSend); err != nil {
 					// Log but continue
 				}
 
-				if pacing := faketcp.GetTuning().WritePacingMinDelay; pacing > 0 {
+				if pacing := writePacing(conn); pacing > 0 {
 					time.Sleep(pacing)
 				}
 			}()
@@ -4450,9 +5429,10 @@ func (t *Tunnel) fecWorker() {
 	}
 }
 
-// fecIngressWorker processes incoming FEC shards (Reconstruction)
+// fecIngressWorker processes incoming FEC shards (Reconstruction and decryption)
 // This runs in a pool to keep the main read loop fast.
 // Each worker reads from its own queue to ensure session affinity (processFECShard concurrency safety)
+// and hands finished groups to the sequencers, which restore their order
 func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 	defer t.wg.Done()
 	
@@ -4464,12 +5444,41 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 		sessionID  uint32
 	}
 	sessions := make(map[sessionKey]*fecRecvSession)
-	
-	// Thread-Local Reorder Buffer (one per peer)
-	reorderBufs := make(map[string]*fecReorderBuffer)
+	groupTimeout := t.fecGroupTimeout()
+
+	// decrypt decrypts the packets of a reconstructed group, dropping those that fail
+	decrypt := func(client *ClientConnection, packets [][]byte) [][]byte {
+		frames := make([][]byte, 0, len(packets))
+		for _, reconstructedPacket := range packets {
+			var decryptedPacket []byte
+			if client != nil {
+				// Server mode: Client specific logic
+				dec, usedCipher, gen, err := t.decryptPacketFromClient(client, reconstructedPacket)
+				if err != nil {
+					continue
+				}
+				if usedCipher != nil {
+					client.setCipherWithGen(usedCipher, gen)
+				}
+				decryptedPacket = dec
+			} else {
+				dec, err := t.decryptPacket(reconstructedPacket)
+				if err != nil {
+					continue
+				}
+				decryptedPacket = dec
+			}
+			t.traceFrame(false, client, decryptedPacket)
+			if len(decryptedPacket) < 1 {
+				continue
+			}
+			frames = append(frames, decryptedPacket)
+		}
+		return frames
+	}
 	
 	// Local cleanup ticker for this worker
-	cleanupTicker := time.NewTicker(2 * time.Second)
+	cleanupTicker := time.NewTicker(groupTimeout / 2)
 	defer cleanupTicker.Stop()
 
 	for {
@@ -4477,21 +5486,17 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 		case <-t.stopCh:
 			return
 		case <-cleanupTicker.C:
-			// Cleanup stale sessions and reorder buffers local to this worker
+			// Cleanup stale sessions local to this worker
 			now := time.Now()
 			for k, s := range sessions {
-				if now.Sub(s.lastUpdate) > 2*time.Second {
+				if now.Sub(s.lastUpdate) > groupTimeout {
+					t.recordFECGroup(k.remoteAddr, k.sessionID, s, FECGroupExpired)
 					delete(sessions, k)
 				}
 			}
-			// Cleanup stale reorder buffers
-			for peerAddr, buf := range reorderBufs {
-				if now.Sub(buf.lastUpdate) > 10*time.Second && len(buf.pending) == 0 {
-					delete(reorderBufs, peerAddr)
-				}
-			}
 		case work := <-queue:
 			// Inlined processFECShard logic with Local State
+			fecStart := t.stages.start()
 			
 			// Simple packet validation (already done partly by sender, but double check)
 			if len(work.packet) < 12 {
@@ -4506,11 +5511,14 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 			parityShards := int(fecPacket[8])<<8 | int(fecPacket[9])
 			shardSize := int(fecPacket[10])<<8 | int(fecPacket[11])
 			shardData := fecPacket[12:]
-			atomic.AddUint64(&t.statFECShardsRecv, 1)
+			t.statFECShardsRecv.Add(1)
 
 			if dataShards <= 0 || parityShards <= 0 || shardSize <= 0 {
 				continue
 			}
+			if dataShards > t.config.FECMaxDataShards || parityShards > t.config.FECMaxParityShards {
+				continue
+			}
 			// Sanity check size
 			if len(shardData) != shardSize {
 				continue
@@ -4532,6 +5540,7 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 					totalShards:       totalShards,
 					receivedCount:     0,
 					lastUpdate:        time.Now(),
+					firstUpdate:       time.Now(),
 					expectedShardSize: shardSize,
 				}
 				sessions[key] = session
@@ -4553,6 +5562,7 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 			
 			// Check reconstruction
 			var reconstructedPackets [][]byte
+			reconstructed := false
 			if session.receivedCount >= session.dataShards {
 				// Mark missing as nil
 				for i := 0; i < session.totalShards; i++ {
@@ -4566,11 +5576,12 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 				if t.fec != nil && t.fec.DataShards() == session.dataShards && t.fec.ParityShards() == session.parityShards {
 					err = t.fec.Reconstruct(session.shards)
 				} else {
-					err = fec.ReconstructShards(session.shards, session.dataShards, session.parityShards)
+					err = fec.ReconstructShards(t.parityCodec, session.shards, session.dataShards, session.parityShards)
 				}
 
 				if err == nil {
-					atomic.AddUint64(&t.statFECSessionsRecovered, 1)
+					reconstructed = true
+					t.statFECSessionsRecovered.Add(1)
 					// Extract packets
 					for i := 0; i < session.dataShards; i++ {
 						shard := session.shards[i]
@@ -4580,7 +5591,7 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 							data := make([]byte, pktLen)
 							copy(data, shard[2:2+pktLen]) // Copy out
 							reconstructedPackets = append(reconstructedPackets, data)
-							atomic.AddUint64(&t.statFECPacketsRecovered, 1)
+							t.statFECPacketsRecovered.Add(1)
 						}
 					}
 					// Remove completed session immediately from local map
@@ -4588,181 +5599,27 @@ func (t *Tunnel) fecIngressWorker(queue chan *fecIngressWork) {
 				} else {
 					// wait later or give up if session.receivedCount >= totalShards
 					if session.receivedCount >= session.totalShards {
-						atomic.AddUint64(&t.statFECSessionsUnrecoverable, 1)
+						t.statFECSessionsUnrecoverable.Add(1)
+						t.recordFECGroup(work.remoteAddr, sessionID, session, FECGroupReconstructFailed)
 						delete(sessions, key)
 					}
 				}
 			}
 
-			// If we got reconstructed packets, handle them with LOCAL reorder buffer
-			if len(reconstructedPackets) > 0 {
-				// Inline reordering logic with thread-local state
-				const reorderTimeout = 20 * time.Millisecond
-				const reorderWindowSize = 256
-				
-				buf := reorderBufs[work.remoteAddr]
-				if buf == nil {
-					buf = &fecReorderBuffer{
-						next:       sessionID,
-						pending:    make(map[uint32][][]byte),
-						lastUpdate: time.Now(),
-					}
-					reorderBufs[work.remoteAddr] = buf
-				}
-				
-				// Handle late batch
-				if sessionID < buf.next {
-					atomic.AddUint64(&t.statFECLateBatchDrop, 1)
-					for _, pkt := range reconstructedPackets {
-						// Deliver late packets anyway
-						if work.client != nil {
-							decryptedPacket, usedCipher, gen, err := t.decryptPacketFromClient(work.client, pkt)
-							if err == nil {
-								if usedCipher != nil {
-									work.client.setCipherWithGen(usedCipher, gen)
-								}
-								t.handleClientPacket(work.client, decryptedPacket)
-							}
-						} else {
-							// Use helper to enqueue with timeout
-							if !t.enqueueFECDecryption([][]byte{pkt}) {
-								// Already logged in helper
-								if t.stopCh != nil {
-									select {
-									case <-t.stopCh:
-										return
-									default:
-									}
-								}
-							}
-						}
-					}
-					continue
-				}
-				
-				// Buffer packet
-				windowEnd := buf.next + reorderWindowSize
-				if sessionID >= buf.next && sessionID < windowEnd {
-				// Within window: normal buffering
-				buf.pending[sessionID] = reconstructedPackets
-				buf.lastUpdate = time.Now()
-			} else if sessionID >= windowEnd {
-				// Beyond window: skip forward gap
-				gapSize := sessionID - buf.next
-				atomic.AddUint64(&t.statFECGapSkip, uint64(gapSize))
-				buf.next = sessionID
-				buf.pending[sessionID] = reconstructedPackets
-				buf.lastUpdate = time.Now()
-				// Clean up old pending entries
-				for sid := range buf.pending {
-					if sid < buf.next {
-						delete(buf.pending, sid)
-					}
-				}
-			}
-			// else: sessionID < buf.next - late packet, already handled above
-				
-				// Sequential delivery
-				var toDeliver [][]byte
-				for {
-					if pkts, ok := buf.pending[buf.next]; ok {
-						toDeliver = append(toDeliver, pkts...)
-						delete(buf.pending, buf.next)
-						buf.next++
-						buf.gapSince = time.Time{}
-					} else {
-						break
-					}
-				}
-				
-				// Timeout-based gap skip
-				if len(buf.pending) > 0 {
-					if buf.gapSince.IsZero() {
-						buf.gapSince = time.Now()
-					} else if time.Since(buf.gapSince) > reorderTimeout {
-						var minAvailable uint32
-						found := false
-						for sid := range buf.pending {
-							if sid > buf.next && (!found || sid < minAvailable) {
-								minAvailable = sid
-								found = true
-							}
-						}
-						if found {
-							gap := minAvailable - buf.next
-							atomic.AddUint64(&t.statFECGapSkip, uint64(gap))
-							buf.next = minAvailable
-							buf.gapSince = time.Time{}
-							if pkts, ok := buf.pending[buf.next]; ok {
-								toDeliver = append(toDeliver, pkts...)
-								delete(buf.pending, buf.next)
-								buf.next++
-							}
-						}
-					}
-				} else {
-					buf.gapSince = time.Time{}
-				}
-				
-				// Deliver all ordered packets
-				for _, reconstructedPacket := range toDeliver {
-					if work.client != nil {
-						// Server mode: Client specific logic
-						decryptedPacket, usedCipher, gen, err := t.decryptPacketFromClient(work.client, reconstructedPacket)
-						if err != nil {
-							continue
-						}
-						
-						if usedCipher != nil {
-							work.client.setCipherWithGen(usedCipher, gen)
-						}
-						
-						t.handleClientPacket(work.client, decryptedPacket)
-					} else {
-						// Client mode: Tunnel logic - use helper to enqueue with timeout
-						if !t.enqueueFECDecryption([][]byte{reconstructedPacket}) {
-							// Already logged in helper
-							select {
-							case <-t.stopCh:
-								return
-							default:
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-}
-
-// fecDecryptionWorker processes batches of recovered packets with parallel decryption
-// Now runs in parallel without internal locking
-func (t *Tunnel) fecDecryptionWorker() {
-	defer t.wg.Done()
-
-	for {
-		select {
-		case <-t.stopCh:
-			return
-		case batch := <-t.fecDecryptionQueue:
-			if len(batch) == 0 {
-				continue
-			}
-
-			// Sequential processing within a worker, but parallel workers serve the queue
-			for _, pkt := range batch {
-				dec, err := t.decryptPacket(pkt)
-				if err != nil {
-					continue
-				}
-				if len(dec) < 1 {
-					continue
+			t.stages.done(stageFEC, fecStart)
+
+			// Decrypt here, in parallel with the other workers, and hand the group
+			// to the peer's sequencer for in-order delivery. Groups whose packets
+			// all failed still go, so the sequencer does not wait for them.
+			if reconstructed {
+				group := &fecGroup{
+					peer:      work.remoteAddr,
+					client:    work.client,
+					sessionID: sessionID,
+					frames:    decrypt(work.client, reconstructedPackets),
 				}
-				if dec[0] == PacketTypeData {
-					// Use non-blocking enqueue for high-speed reception
-					if !enqueueWithPolicy(t.recvQueue, dec[1:], t.stopCh, false) {
-						atomic.AddUint64(&t.statQueueDropRecv, 1)
-					}
+				if !t.submitFECGroup(group) {
+					return
 				}
 			}
 		}
@@ -4770,7 +5627,7 @@ func (t *Tunnel) fecDecryptionWorker() {
 }
 
 // sendBatchWithFEC sends packets using FEC encoding
-func (t *Tunnel) sendBatchWithFEC(conn faketcp.ConnAdapter, packets [][]byte, parityShards int, encryptFn func([]byte) ([]byte, error)) error {
+func (t *Tunnel) sendBatchWithFEC(client *ClientConnection, packets [][]byte, parityShards int, encryptFn func([]byte) ([]byte, error)) error {
 	if !t.fecEnabled || t.fec == nil {
 		return errors.New("FEC not enabled")
 	}
@@ -4785,8 +5642,7 @@ func (t *Tunnel) sendBatchWithFEC(conn faketcp.ConnAdapter, packets [][]byte, pa
 	encPackets := make([][]byte, dataShards)
 	maxLen := 0
 	for i, pkt := range packets {
-		fullPacket, _ := prependPacketType(pkt, PacketTypeData)
-		enc, err := encryptFn(fullPacket)
+		enc, err := encryptFn(typedPacket(pkt))
 		if err != nil {
 			return fmt.Errorf("packet encryption failed: %v", err)
 		}
@@ -4808,49 +5664,27 @@ func (t *Tunnel) sendBatchWithFEC(conn faketcp.ConnAdapter, packets [][]byte, pa
 		shards[i] = make([]byte, shardSize)
 	}
 
-	if err := fec.EncodeShards(shards, dataShards, parityShards); err != nil {
+	if err := fec.EncodeShards(t.parityCodec, shards, dataShards, parityShards); err != nil {
 		return fmt.Errorf("FEC encoding failed: %v", err)
 	}
 
 	// Send each shard with FEC header
 	// FEC header format: [PacketTypeFECShard][sessionID:4][shardIndex:2][dataShards:2][parityShards:2][shardSize:2][shard_data]
-	sessionID := t.nextFECSessionID()
+	sessionID := atomic.AddUint32(&client.fecSessionID, 1)
+	checked := atomic.LoadUint32(&client.shardChecksum) != 0
+	fecPackets := make([][]byte, len(shards))
 	for i, shard := range shards {
-		fecPacket := make([]byte, 1+4+2+2+2+2+len(shard))
-		fecPacket[0] = PacketTypeFECShard
-
-		// Session ID (4 bytes)
-		fecPacket[1] = byte(sessionID >> 24)
-		fecPacket[2] = byte(sessionID >> 16)
-		fecPacket[3] = byte(sessionID >> 8)
-		fecPacket[4] = byte(sessionID)
-
-		// Shard index (2 bytes)
-		fecPacket[5] = byte(i >> 8)
-		fecPacket[6] = byte(i)
-
-		// Data shards (2 bytes)
-		fecPacket[7] = byte(dataShards >> 8)
-		fecPacket[8] = byte(dataShards)
-
-		// Parity shards (2 bytes)
-		fecPacket[9] = byte(parityShards >> 8)
-		fecPacket[10] = byte(parityShards)
-
-		// Shard size (2 bytes)
-		fecPacket[11] = byte(shardSize >> 8)
-		fecPacket[12] = byte(shardSize)
-
-		// Shard data
-		copy(fecPacket[13:], shard)
-
-		if err := conn.WritePacket(fecPacket); err != nil {
-			log.Printf("Failed to send FEC shard %d/%d: %v", i+1, len(shards), err)
-		}
+		fecPackets[i] = buildShardPacket(sessionID, i, dataShards, parityShards, shard, checked)
+		t.traceFrame(true, client, fecPackets[i])
+	}
+	// One batched write per group: a single sendmmsg call in UDP mode
+	client.control.drain(client.conn, controlBurst)
+	if err := client.conn.WriteBatch(fecPackets); err != nil {
+		client.logf("Failed to send FEC shards (%d): %v", len(shards), err)
 	}
 
 	// Apply pacing once per batch instead of per shard to improve throughput
-	if pacing := faketcp.GetTuning().WritePacingMinDelay; pacing > 0 {
+	if pacing := writePacing(client.conn); pacing > 0 {
 		time.Sleep(pacing)
 	}
 
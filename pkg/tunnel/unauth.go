@@ -0,0 +1,333 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/pkg/api"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+	"github.com/openbmx/lightweight-tunnel/pkg/iptables"
+	"github.com/openbmx/lightweight-tunnel/pkg/netns"
+)
+
+// A server on a public address sees scans and key guessing. Packets dropped
+// before their sender authenticated are counted by class and source address:
+//
+//	bad_mac          did not decrypt, from a connection nothing decrypted on yet
+//	unknown_session  sent before the session presented its certificate (PKI mode)
+//	malformed        failed strict validation, or an unreadable auth request
+//	not_our_flow     segment of no known flow (raw listener), or a bad cookie
+//	auth_rejected    auth request refused (expired timestamp, certificate)
+//
+// With unauth_ban_threshold set, a source whose drops of the ban classes reach
+// the threshold within a minute is firewalled off the tunnel ports for
+// unauth_ban_duration. not_our_flow is left out of the ban classes by default:
+// clients of a restarted server send it until they reconnect.
+
+type unauthClass int
+
+const (
+	unauthBadMAC unauthClass = iota
+	unauthUnknownSession
+	unauthMalformed
+	unauthNotOurFlow
+	unauthRejected
+	unauthClasses
+)
+
+var unauthClassNames = [unauthClasses]string{"bad_mac", "unknown_session", "malformed", "not_our_flow", "auth_rejected"}
+
+const (
+	unauthWindow         = time.Minute
+	unauthForget         = 10 * time.Minute // Sources quiet this long are forgotten
+	unauthMaxSources     = 4096             // Sources tracked at most; later ones only count in the totals
+	unauthReportSources  = 20
+	unauthExpiryInterval = 10 * time.Second
+	unauthBanLabel       = "lightweight-tunnel-ban"
+)
+
+// ValidUnauthClass reports whether name is a class of unauthenticated drops
+func ValidUnauthClass(name string) bool {
+	for _, n := range unauthClassNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type unauthSource struct {
+	drops       [unauthClasses]uint64
+	lastSeen    time.Time
+	windowStart time.Time
+	windowDrops int // Drops of the ban classes since windowStart
+}
+
+// unauthTracker aggregates the drops before authentication (server mode)
+type unauthTracker struct {
+	threshold int
+	duration  time.Duration
+	banClass  [unauthClasses]bool
+	ipt       *iptables.IPTablesManager
+	port      uint16 // Listening port (0 = unknown)
+	hopLow    uint16 // Port hopping range (0 = not hopping)
+	hopHigh   uint16
+	proto     string
+	unobserve func()
+
+	mu      sync.Mutex
+	totals  [unauthClasses]uint64
+	sources map[string]*unauthSource
+	bans    map[string]time.Time // Banned address -> end of the ban
+	banned  uint64
+}
+
+// startUnauth starts counting drops before authentication and, when
+// configured, banning their sources (server mode)
+func (t *Tunnel) startUnauth(listener faketcp.ListenerAdapter) {
+	u := &unauthTracker{
+		threshold: t.config.UnauthBanThreshold,
+		duration:  time.Duration(t.config.UnauthBanDuration) * time.Second,
+		sources:   make(map[string]*unauthSource),
+		bans:      make(map[string]time.Time),
+		proto:     "tcp",
+	}
+	if faketcp.GetMode() == faketcp.ModeUDP {
+		u.proto = "udp"
+	}
+	classes := t.config.UnauthBanClasses
+	if len(classes) == 0 {
+		classes = []string{"bad_mac", "unknown_session", "malformed", "auth_rejected"}
+	}
+	for _, name := range classes {
+		for c, n := range unauthClassNames {
+			if n == name {
+				u.banClass[c] = true
+			}
+		}
+	}
+	if ap, ok := addrPortOf(listener.Addr()); ok {
+		u.port = ap.Port()
+	}
+	if t.portHop != nil {
+		u.hopLow, u.hopHigh = t.portHop.low, t.portHop.high
+	}
+	if u.threshold > 0 {
+		u.ipt = iptables.NewIPTablesManager()
+		if t.config.NetNS != "" {
+			u.ipt.SetNetNS(netns.Path(t.config.NetNS))
+		}
+		log.Printf("Banning sources with %d drops before authentication per minute (%s) for %v",
+			u.threshold, strings.Join(classes, ", "), u.duration)
+	}
+	t.unauth = u
+
+	// Other tunnels of the process have listeners of their own
+	u.unobserve = faketcp.ObserveDrops(func(reason faketcp.DropReason, src net.IP, port uint16) {
+		if !u.tunnelPort(port) {
+			return
+		}
+		if reason == faketcp.DropMalformed {
+			t.noteUnauthIP(src, unauthMalformed)
+		} else {
+			t.noteUnauthIP(src, unauthNotOurFlow)
+		}
+	})
+	t.wg.Add(1)
+	t.goLoop(policyManagement, "ban expiry loop", t.unauthExpiryLoop)
+}
+
+// noteUnauth counts a packet from addr dropped before authentication
+func (t *Tunnel) noteUnauth(addr net.Addr, class unauthClass) {
+	t.noteUnauthIP(remoteIP(addr), class)
+}
+
+func (t *Tunnel) noteUnauthIP(ip net.IP, class unauthClass) {
+	u := t.unauth
+	if u == nil || ip == nil {
+		return
+	}
+	key := ip.String()
+	now := time.Now()
+
+	u.mu.Lock()
+	u.totals[class]++
+	src := u.sources[key]
+	if src == nil {
+		if len(u.sources) >= unauthMaxSources {
+			u.mu.Unlock()
+			return
+		}
+		src = &unauthSource{windowStart: now}
+		u.sources[key] = src
+	}
+	src.drops[class]++
+	src.lastSeen = now
+	if u.threshold == 0 || !u.banClass[class] {
+		u.mu.Unlock()
+		return
+	}
+	if now.Sub(src.windowStart) >= unauthWindow {
+		src.windowStart, src.windowDrops = now, 0
+	}
+	src.windowDrops++
+	_, banned := u.bans[key]
+	ban := src.windowDrops >= u.threshold && !banned && ip.To4() != nil && // The ban rules are iptables (IPv4) rules
+		!t.mgmt.protects(ip)
+	if ban {
+		u.bans[key] = now.Add(u.duration)
+		u.banned++
+	}
+	u.mu.Unlock()
+
+	if ban {
+		// Off the receive path: iptables takes milliseconds
+		go t.banSource(ip, class)
+	}
+}
+
+// tunnelPort reports whether port is one the tunnel listens on
+func (u *unauthTracker) tunnelPort(port uint16) bool {
+	if u.port == 0 {
+		return true // Unknown: count everything
+	}
+	return port == u.port || u.hopLow != 0 && port >= u.hopLow && port <= u.hopHigh
+}
+
+// banRule is the firewall rule dropping the packets of ip to the tunnel ports
+func (u *unauthTracker) banRule(ip string) string {
+	rule := fmt.Sprintf("PREROUTING -t raw -s %s -p %s", ip, u.proto)
+	switch {
+	case u.hopLow != 0:
+		rule += fmt.Sprintf(" -m multiport --dports %d,%d:%d", u.port, u.hopLow, u.hopHigh)
+	case u.port != 0:
+		rule += " --dport " + strconv.Itoa(int(u.port))
+	}
+	return rule + " -m comment --comment " + unauthBanLabel + " -j DROP"
+}
+
+// banSource firewalls off ip, whose last drop was of class
+func (t *Tunnel) banSource(ip net.IP, class unauthClass) {
+	u := t.unauth
+	log.Printf("⚠️  Banning %s for %v: %d drops before authentication in a minute (last: %s)",
+		ip, u.duration, u.threshold, unauthClassNames[class])
+	if err := u.ipt.AddCustomRule(u.banRule(ip.String())); err != nil {
+		log.Printf("Failed to ban %s: %v", ip, err)
+	}
+}
+
+// unauthExpiryLoop lifts bans that ended and forgets quiet sources
+func (t *Tunnel) unauthExpiryLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(unauthExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+		u := t.unauth
+		now := time.Now()
+		var lifted []string
+		u.mu.Lock()
+		for addr, until := range u.bans {
+			if now.After(until) {
+				delete(u.bans, addr)
+				lifted = append(lifted, addr)
+			}
+		}
+		for addr, src := range u.sources {
+			if _, banned := u.bans[addr]; !banned && now.Sub(src.lastSeen) > unauthForget {
+				delete(u.sources, addr)
+			}
+		}
+		u.mu.Unlock()
+
+		if len(lifted) == 0 || u.ipt == nil {
+			continue
+		}
+		batch := u.ipt.NewBatch()
+		for _, addr := range lifted {
+			batch.RemoveCustomRule(u.banRule(addr))
+			log.Printf("Ban of %s lifted", addr)
+		}
+		if err := batch.Apply(); err != nil {
+			log.Printf("Failed to lift bans: %v", err)
+		}
+	}
+}
+
+// stopUnauth removes the ban rules
+func (t *Tunnel) stopUnauth() {
+	u := t.unauth
+	if u == nil {
+		return
+	}
+	u.unobserve()
+	if u.ipt != nil {
+		if err := u.ipt.RemoveAllRules(); err != nil {
+			log.Printf("Failed to remove ban rules: %v", err)
+		}
+	}
+}
+
+// unauthStatus reports the drops before authentication for /status
+func (t *Tunnel) unauthStatus() *api.UnauthStatus {
+	u := t.unauth
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.totals == ([unauthClasses]uint64{}) {
+		return nil
+	}
+	s := &api.UnauthStatus{Drops: classCounts(&u.totals), Banned: u.banned}
+	addrs := make([]string, 0, len(u.sources))
+	totals := make(map[string]uint64, len(u.sources))
+	for addr, src := range u.sources {
+		addrs = append(addrs, addr)
+		for _, n := range src.drops {
+			totals[addr] += n
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return totals[addrs[i]] > totals[addrs[j]] })
+	if len(addrs) > unauthReportSources {
+		addrs = addrs[:unauthReportSources]
+	}
+	for _, addr := range addrs {
+		src := u.sources[addr]
+		s.Sources = append(s.Sources, api.UnauthSource{Addr: addr, Drops: classCounts(&src.drops), LastSeen: src.lastSeen})
+	}
+	for addr, until := range u.bans {
+		s.Bans = append(s.Bans, api.UnauthBan{Addr: addr, Until: until})
+	}
+	sort.Slice(s.Bans, func(i, j int) bool { return s.Bans[i].Until.Before(s.Bans[j].Until) })
+	return s
+}
+
+// classCounts names the non-zero counts of drops
+func classCounts(counts *[unauthClasses]uint64) map[string]uint64 {
+	m := make(map[string]uint64)
+	for c, n := range counts {
+		if n > 0 {
+			m[unauthClassNames[c]] = n
+		}
+	}
+	return m
+}
+
+// unauthFirewallRules reports the ban rules and whether each is installed
+func (t *Tunnel) unauthFirewallRules() []iptables.RuleState {
+	if t.unauth == nil || t.unauth.ipt == nil {
+		return nil
+	}
+	return t.unauth.ipt.CheckRules()
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Version is announced to the peer after connecting. The command sets it from
+// its build version; embedders may set their own.
+var Version = "dev"
+
+// Versions are exchanged like FEC parameters: the server announces its version
+// when the session starts (after authentication in PKI mode) and the client
+// answers with its own. A differing major or minor version is logged on both
+// sides; peers without version support ignore the packet.
+//
+// Layout: [PacketTypeVersion][version string]
+
+// maxVersionLen bounds the version string accepted from the peer
+const maxVersionLen = 64
+
+// parseVersion splits "v1.2.3-rc1" into its numeric major, minor and patch parts
+func parseVersion(v string) (parts [3]int, ok bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// CompareVersions compares two dotted versions numerically, returning -1, 0 or
+// 1. Unparseable versions compare as equal.
+func CompareVersions(a, b string) int {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0
+	}
+	for i := range pa {
+		switch {
+		case pa[i] < pb[i]:
+			return -1
+		case pa[i] > pb[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// sameMinorVersion reports whether two versions share major and minor parts.
+// Unparseable versions (development builds) are treated as compatible.
+func sameMinorVersion(a, b string) bool {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	return !okA || !okB || (pa[0] == pb[0] && pa[1] == pb[1])
+}
+
+func encodeVersion() []byte {
+	v := Version
+	if len(v) > maxVersionLen {
+		v = v[:maxVersionLen]
+	}
+	return append([]byte{PacketTypeVersion}, v...)
+}
+
+func parsePeerVersion(payload []byte) string {
+	if len(payload) > maxVersionLen {
+		payload = payload[:maxVersionLen]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, string(payload))
+}
+
+// checkPeerVersion logs a structured warning when the peer's minor version differs
+func checkPeerVersion(role, addr, peer string) {
+	if sameMinorVersion(Version, peer) {
+		log.Printf("Peer %s %s runs version %s", role, addr, peer)
+		return
+	}
+	log.Printf("⚠️  version_mismatch local=%s peer=%s peer_role=%s peer_addr=%s - upgrade the older side to keep features and wire formats in sync",
+		Version, peer, role, addr)
+}
+
+// announceVersion sends the server's version to a client
+func (t *Tunnel) announceVersion(client *ClientConnection) {
+	encrypted, err := t.encryptForClient(client, encodeVersion())
+	if err != nil {
+		return
+	}
+	if err := client.conn.WritePacket(encrypted); err != nil {
+		client.logf("Failed to send version to %s: %v", client.conn.RemoteAddr(), err)
+	}
+}
+
+// handleServerVersion records the server's version and answers with ours (client mode)
+func (t *Tunnel) handleServerVersion(payload []byte) {
+	peer := parsePeerVersion(payload)
+	conn := t.conn
+	if conn == nil {
+		return
+	}
+	t.peerVersion.Store(peer)
+	checkPeerVersion("server", conn.RemoteAddr().String(), peer)
+
+	encrypted, err := t.encryptPacket(encodeVersion())
+	if err != nil {
+		return
+	}
+	if err := conn.WritePacket(encrypted); err != nil {
+		log.Printf("Failed to send version: %v", err)
+	}
+}
+
+// handleClientVersion records a client's version (server mode)
+func (t *Tunnel) handleClientVersion(client *ClientConnection, payload []byte) {
+	peer := parsePeerVersion(payload)
+	client.mu.Lock()
+	client.version = peer
+	client.mu.Unlock()
+	checkPeerVersion("client", client.conn.RemoteAddr().String(), peer)
+}
+
+// ServerVersion returns the version the server announced, or "" if it has not
+// announced one (client mode)
+func (t *Tunnel) ServerVersion() string {
+	v, _ := t.peerVersion.Load().(string)
+	return v
+}
@@ -0,0 +1,380 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openbmx/lightweight-tunnel/internal/config"
+	"github.com/openbmx/lightweight-tunnel/pkg/crypto"
+	"github.com/openbmx/lightweight-tunnel/pkg/faketcp"
+)
+
+// WireGuard passthrough carries an existing WireGuard flow instead of IP
+// packets from a TUN device. The client listens on a local UDP port that
+// WireGuard uses as its peer's endpoint and sends each datagram over a fake
+// TCP connection; the server passes them to the real WireGuard endpoint from
+// one UDP socket per client, so WireGuard tells its peers apart by port as
+// usual. WireGuard keeps its own crypto, keys and routing, and no second TUN
+// device sits in the path. With a key the datagrams are also encrypted, which
+// hides WireGuard's recognizable message types from DPI.
+//
+// Layout: [PacketTypeData][WireGuard datagram] or [PacketTypeKeepalive]
+
+const wgMaxDatagram = 65535
+
+// WireGuardPassthrough reports whether cfg relays a WireGuard flow instead of
+// running a TUN tunnel
+func WireGuardPassthrough(cfg *config.Config) bool {
+	return cfg.WireGuardListen != "" || cfg.WireGuardEndpoint != ""
+}
+
+// WireGuardRelay is one end of a WireGuard passthrough
+type WireGuardRelay struct {
+	config *config.Config
+	cipher *crypto.Cipher
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	// Client
+	local  *net.UDPConn
+	wgAddr atomic.Pointer[net.UDPAddr] // WireGuard's address, learnt from its datagrams
+	conn   atomic.Pointer[connHolder]  // Current connection to the server (nil while dialing)
+
+	// Server
+	listener faketcp.ListenerAdapter
+	mu       sync.Mutex
+	sessions map[faketcp.ConnAdapter]*net.UDPConn
+}
+
+// connHolder lets the connection interface be swapped atomically
+type connHolder struct {
+	faketcp.ConnAdapter
+}
+
+// NewWireGuardRelay prepares a relay for cfg (client or server mode)
+func NewWireGuardRelay(cfg *config.Config) (*WireGuardRelay, error) {
+	faketcp.SetMode(faketcp.ModeRaw)
+	if err := checkCapabilities(cfg); err != nil {
+		return nil, err
+	}
+	if err := faketcp.CheckRawSocketSupport(); err != nil {
+		return nil, fmt.Errorf("raw sockets unavailable (run as root): %v", err)
+	}
+	if err := configureFakeTCP(cfg); err != nil {
+		return nil, err
+	}
+
+	r := &WireGuardRelay{
+		config:   cfg,
+		stopCh:   make(chan struct{}),
+		sessions: make(map[faketcp.ConnAdapter]*net.UDPConn),
+	}
+	if cfg.Key != "" {
+		cipher, err := crypto.NewCipher(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %v", err)
+		}
+		r.cipher = cipher
+	}
+	return r, nil
+}
+
+// Start opens the local UDP port (client) or the fake TCP listener (server)
+func (r *WireGuardRelay) Start() error {
+	if r.config.Mode == "server" {
+		listener, err := faketcp.ListenWithMode(r.config.LocalAddr, faketcp.ModeRaw)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", r.config.LocalAddr, err)
+		}
+		r.listener = listener
+		log.Printf("WireGuard passthrough: accepting on %s, forwarding to %s", r.config.LocalAddr, r.config.WireGuardEndpoint)
+		r.wg.Add(1)
+		go r.acceptLoop()
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", r.config.WireGuardListen)
+	if err != nil {
+		return fmt.Errorf("invalid wg_listen: %v", err)
+	}
+	local, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	r.local = local
+	log.Printf("WireGuard passthrough: set the peer endpoint to %s, carried to %s", local.LocalAddr(), r.config.RemoteAddr)
+	r.wg.Add(3)
+	go r.localReader()
+	go r.serverLoop()
+	go r.keepalive()
+	return nil
+}
+
+// Stop closes the relay's sockets and connections
+func (r *WireGuardRelay) Stop() {
+	close(r.stopCh)
+	if r.local != nil {
+		r.local.Close()
+	}
+	if h := r.conn.Swap(nil); h != nil {
+		h.Close()
+	}
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	r.mu.Lock()
+	for conn, udp := range r.sessions {
+		conn.Close()
+		udp.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *WireGuardRelay) stopping() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// seal frames and encrypts a datagram
+func (r *WireGuardRelay) seal(packetType byte, payload []byte) ([]byte, error) {
+	frame := make([]byte, 1+len(payload))
+	frame[0] = packetType
+	copy(frame[1:], payload)
+	if r.cipher == nil {
+		return frame, nil
+	}
+	return r.cipher.Encrypt(frame)
+}
+
+// open decrypts a frame and returns the WireGuard datagram it carries, nil
+// for keepalives
+func (r *WireGuardRelay) open(packet []byte) ([]byte, error) {
+	if r.cipher != nil {
+		var err error
+		if packet, err = r.cipher.Decrypt(packet); err != nil {
+			return nil, err
+		}
+	}
+	if len(packet) < 1 {
+		return nil, fmt.Errorf("empty frame")
+	}
+	if packet[0] != PacketTypeData {
+		return nil, nil
+	}
+	return packet[1:], nil
+}
+
+func (r *WireGuardRelay) timeout() time.Duration {
+	return time.Duration(max(r.config.Timeout, 1)) * time.Second
+}
+
+// localReader sends WireGuard's datagrams to the server
+func (r *WireGuardRelay) localReader() {
+	defer r.wg.Done()
+	buf := make([]byte, wgMaxDatagram)
+	for {
+		n, addr, err := r.local.ReadFromUDP(buf)
+		if err != nil {
+			if r.stopping() {
+				return
+			}
+			log.Printf("WireGuard passthrough: local read error: %v", err)
+			continue
+		}
+		if prev := r.wgAddr.Load(); prev == nil || !prev.IP.Equal(addr.IP) || prev.Port != addr.Port {
+			r.wgAddr.Store(addr)
+		}
+		h := r.conn.Load()
+		if h == nil {
+			continue // WireGuard retransmits its handshake once connected
+		}
+		frame, err := r.seal(PacketTypeData, buf[:n])
+		if err != nil {
+			continue
+		}
+		if err := h.WritePacket(frame); err != nil && !r.stopping() {
+			log.Printf("WireGuard passthrough: write error: %v", err)
+		}
+	}
+}
+
+// serverLoop keeps a connection to the server and passes what it receives to
+// WireGuard, redialing when the connection fails or goes silent
+func (r *WireGuardRelay) serverLoop() {
+	defer r.wg.Done()
+	backoff := time.Second
+	for !r.stopping() {
+		conn, err := faketcp.DialWithMode(r.config.RemoteAddr, 10*time.Second, faketcp.ModeRaw)
+		if err != nil {
+			log.Printf("WireGuard passthrough: failed to connect to %s: %v, retrying in %v", r.config.RemoteAddr, err, backoff)
+			select {
+			case <-r.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			continue
+		}
+		backoff = time.Second
+		log.Printf("WireGuard passthrough: connected to %s", r.config.RemoteAddr)
+		r.conn.Store(&connHolder{conn})
+		// Tell the server at once, so its UDP socket exists before WireGuard
+		// sends the next handshake
+		if frame, err := r.seal(PacketTypeKeepalive, nil); err == nil {
+			conn.WritePacket(frame)
+		}
+
+		err = r.forward(conn, func(datagram []byte) error {
+			addr := r.wgAddr.Load()
+			if addr == nil {
+				return nil // WireGuard has not sent anything yet
+			}
+			_, err := r.local.WriteToUDP(datagram, addr)
+			return err
+		})
+		r.conn.Store(nil)
+		conn.Close()
+		if r.stopping() {
+			return
+		}
+		log.Printf("WireGuard passthrough: connection to %s lost (%v), reconnecting", r.config.RemoteAddr, err)
+	}
+}
+
+// keepalive keeps the client's connection from timing out while WireGuard is
+// idle
+func (r *WireGuardRelay) keepalive() {
+	defer r.wg.Done()
+	interval := time.Duration(max(r.config.KeepaliveInterval, 1)) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+		if h := r.conn.Load(); h != nil {
+			if frame, err := r.seal(PacketTypeKeepalive, nil); err == nil {
+				h.WritePacket(frame)
+			}
+		}
+	}
+}
+
+// forward reads conn until it fails or stays silent for the timeout, passing
+// each WireGuard datagram to deliver
+func (r *WireGuardRelay) forward(conn faketcp.ConnAdapter, deliver func([]byte) error) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(r.timeout()))
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			return err
+		}
+		datagram, err := r.open(packet)
+		if err != nil {
+			continue // Not ours or corrupted
+		}
+		if datagram == nil {
+			continue
+		}
+		if err := deliver(datagram); err != nil && !r.stopping() {
+			log.Printf("WireGuard passthrough: delivery error: %v", err)
+		}
+	}
+}
+
+// acceptLoop serves each client connection with its own UDP socket toward
+// the WireGuard endpoint
+func (r *WireGuardRelay) acceptLoop() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			if r.stopping() {
+				return
+			}
+			log.Printf("WireGuard passthrough: accept error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		r.wg.Add(1)
+		go r.serveClient(conn)
+	}
+}
+
+func (r *WireGuardRelay) serveClient(conn faketcp.ConnAdapter) {
+	defer r.wg.Done()
+	defer conn.Close()
+
+	endpoint, err := net.ResolveUDPAddr("udp", r.config.WireGuardEndpoint)
+	if err != nil {
+		log.Printf("WireGuard passthrough: invalid wg_endpoint: %v", err)
+		return
+	}
+	udp, err := net.DialUDP("udp", nil, endpoint)
+	if err != nil {
+		log.Printf("WireGuard passthrough: failed to reach %s: %v", endpoint, err)
+		return
+	}
+	defer udp.Close()
+
+	r.mu.Lock()
+	if r.stopping() {
+		r.mu.Unlock()
+		return
+	}
+	r.sessions[conn] = udp
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.sessions, conn)
+		r.mu.Unlock()
+	}()
+	log.Printf("WireGuard passthrough: client %s via %s", conn.RemoteAddr(), udp.LocalAddr())
+
+	// Replies from WireGuard
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, wgMaxDatagram)
+		for {
+			n, err := udp.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				continue // e.g. ICMP port unreachable while WireGuard restarts
+			}
+			frame, err := r.seal(PacketTypeData, buf[:n])
+			if err != nil {
+				continue
+			}
+			if err := conn.WritePacket(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = r.forward(conn, func(datagram []byte) error {
+		_, err := udp.Write(datagram)
+		return err
+	})
+	udp.Close()
+	<-done
+	if !r.stopping() {
+		log.Printf("WireGuard passthrough: client %s gone (%v)", conn.RemoteAddr(), err)
+	}
+}